@@ -0,0 +1,69 @@
+package bonfire
+
+import (
+	"net"
+	"time"
+)
+
+// introductionTTL is how long a Peer remembers the fingerprint of a peer which
+// it was introduced to by a Meet, so that it can be passed to AcceptPeer when
+// that peer's HelloPeer arrives, and so that the peer's Handshake is answered.
+const introductionTTL = time.Minute
+
+type introduction struct {
+	fingerprint []byte
+	t           time.Time
+}
+
+// acceptPeer returns whether the introduction of the peer at the given address
+// should go ahead, as determined by AcceptPeer.
+//
+// This must be called with the lock held.
+func (p *Peer) acceptPeer(addr net.Addr, fingerprint []byte) bool {
+	if p.po.AcceptPeer == nil || p.po.AcceptPeer(addr, fingerprint) {
+		return true
+	}
+	p.event(PeerEvent{Type: PeerEventPeerRejected, Addr: addr})
+	return false
+}
+
+// rememberIntroduction records the fingerprint of the peer introduced by the
+// Meet, keyed by all addresses which its HelloPeer messages might come from.
+// Expired introductions are forgotten at the same time.
+//
+// This must be called with the lock held.
+func (p *Peer) rememberIntroduction(meet Message) {
+	if p.po.AcceptPeer == nil && p.po.HandshakePayload == nil {
+		return
+	} else if p.introductions == nil {
+		p.introductions = map[string]introduction{}
+	}
+
+	now := time.Now()
+	for addrStr, intro := range p.introductions {
+		if now.Sub(intro.t) > introductionTTL {
+			delete(p.introductions, addrStr)
+		}
+	}
+
+	intro := introduction{fingerprint: meet.MeetBody.Fingerprint, t: now}
+	p.introductions[meet.MeetBody.Addr.String()] = intro
+	for _, addr := range meet.Candidates {
+		p.introductions[addr.String()] = intro
+	}
+	for _, addr := range meet.LANCandidates {
+		p.introductions[addr.String()] = intro
+	}
+}
+
+// introducedFingerprint returns the fingerprint of the peer at the given
+// address, if it was introduced to the Peer by a recent Meet, or nil.
+//
+// This must be called with the lock held.
+func (p *Peer) introducedFingerprint(addr net.Addr) []byte {
+	intro, ok := p.introductions[addr.String()]
+	if !ok || time.Since(intro.t) > introductionTTL {
+		return nil
+	}
+	return intro.fingerprint
+}
@@ -0,0 +1,69 @@
+package bonfire
+
+import (
+	"bytes"
+	"net"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerAcceptPeer(t *T) {
+	evCh := make(chan PeerEvent, 10)
+	allowed := bytes.Repeat([]byte{1}, FingerprintSize)
+	peer := &Peer{po: PeerOpts{
+		MaxPeers: 10,
+		EventCh:  evCh,
+		AcceptPeer: func(_ net.Addr, fingerprint []byte) bool {
+			return bytes.Equal(fingerprint, allowed)
+		},
+	}}
+	peer.clearPeers()
+
+	assertRejected := func(addr string) massert.Assertion {
+		ev := <-evCh
+		return massert.All(
+			massert.Equal(PeerEventPeerRejected, ev.Type),
+			massert.Equal(addr, ev.Addr.String()),
+		)
+	}
+
+	// the Peer has no connection, so it would panic if it tried to respond to
+	// the Meet.
+	err := peer.processMessage(addrString("127.0.0.1:1"), Message{
+		Type: Meet,
+		MeetBody: MeetBody{
+			Fingerprint: make([]byte, FingerprintSize),
+			Addr:        addrString("127.0.0.1:2"),
+		},
+	})
+	massert.Require(t, massert.Nil(err), assertRejected("127.0.0.1:2"))
+
+	// a HelloPeer from a peer which wasn't introduced by a Meet has no known
+	// fingerprint, so is rejected too.
+	hello := Message{
+		Type:          HelloPeer,
+		HelloPeerBody: HelloPeerBody{Addr: addrString("127.0.0.1:10")},
+	}
+	massert.Require(t,
+		massert.Nil(peer.processMessage(addrString("127.0.0.1:2"), hello)),
+		assertRejected("127.0.0.1:2"),
+		massert.Length(peer.PeerAddrs(), 0),
+	)
+
+	// once a Meet has introduced the peer, its HelloPeer is accepted from any
+	// of its addresses.
+	peer.rememberIntroduction(Message{
+		Type: Meet,
+		MeetBody: MeetBody{
+			Fingerprint: allowed,
+			Addr:        addrString("127.0.0.1:3"),
+		},
+		Candidates: []net.Addr{addrString("127.0.0.1:4")},
+	})
+	massert.Require(t,
+		massert.Nil(peer.processMessage(addrString("127.0.0.1:4"), hello)),
+		massert.Equal(0, len(evCh)),
+		massert.Equal([]net.Addr{addrString("127.0.0.1:4")}, peer.PeerAddrs()),
+	)
+}
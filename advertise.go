@@ -0,0 +1,25 @@
+package bonfire
+
+import (
+	"net"
+)
+
+// checkAdvertiseAddr is called when the server reports having observed the
+// Peer at the given address. If AdvertiseAddr is set and its IP differs then
+// PeerEventAdvertiseAddrMismatch is emitted. Only the IP is compared, since a
+// NAT may map the Peer's outgoing packets to a different port than the one
+// which has been forwarded to it.
+//
+// This must be called with the lock held.
+func (p *Peer) checkAdvertiseAddr(observed net.Addr) {
+	advertiseAddr, _ := p.advertiseAddr.(*net.UDPAddr)
+	if advertiseAddr == nil {
+		return
+	}
+
+	udpAddr, ok := observed.(*net.UDPAddr)
+	if ok && udpAddr.IP.Equal(advertiseAddr.IP) {
+		return
+	}
+	p.event(PeerEvent{Type: PeerEventAdvertiseAddrMismatch, Addr: observed})
+}
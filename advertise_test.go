@@ -0,0 +1,62 @@
+package bonfire
+
+import (
+	"net"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerAdvertiseAddr(t *T) {
+	eventCh := make(chan PeerEvent, 10)
+	serverAddr := addrString("198.51.100.1:1")
+	advertiseAddr := addrString("203.0.113.5:1000")
+	peer := &Peer{
+		po: PeerOpts{
+			MaxPeers:      10,
+			EventCh:       eventCh,
+			AdvertiseAddr: advertiseAddr.String(),
+		}.withDefaults(),
+		lastServerAddr: serverAddr,
+		advertiseAddr:  advertiseAddr,
+	}
+	peer.clearPeers()
+
+	// NAT gateway discovery is skipped, and the address is advertised even
+	// without AdvertiseCandidates.
+	massert.Require(t,
+		massert.Equal(-1, int(peer.po.InitTimeoutUntilGateway)),
+		massert.Equal([]net.Addr{advertiseAddr}, peer.candidates()),
+	)
+
+	youAre := func(observed string) {
+		peer.processMessage(serverAddr, Message{
+			Type:       YouAre,
+			YouAreBody: YouAreBody{Addr: addrString(observed)},
+		})
+	}
+
+	// the server observing the advertised IP, even at another port, is fine,
+	// and other peers' reports aren't checked.
+	youAre("203.0.113.5:2000")
+	peer.processMessage(addrString("198.51.100.2:1"), Message{
+		Type:          HelloPeer,
+		HelloPeerBody: HelloPeerBody{Addr: addrString("203.0.113.6:1000")},
+	})
+	for len(eventCh) > 0 {
+		ev := <-eventCh
+		massert.Require(t, massert.Not(massert.Equal(PeerEventAdvertiseAddrMismatch, ev.Type)))
+	}
+
+	// the server's report also tips the majority, changing the remote
+	// address.
+	youAre("203.0.113.6:1000")
+	massert.Require(t, massert.Equal(2, len(eventCh)))
+	ev := <-eventCh
+	massert.Require(t,
+		massert.Equal(PeerEventAdvertiseAddrMismatch, ev.Type),
+		massert.Equal("203.0.113.6:1000", ev.Addr.String()),
+	)
+	ev = <-eventCh
+	massert.Require(t, massert.Equal(PeerEventRemoteAddrChanged, ev.Type))
+}
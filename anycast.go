@@ -0,0 +1,54 @@
+package bonfire
+
+import (
+	"bytes"
+	"net"
+)
+
+// observeServerInstance records the InstanceID of a message received from the
+// server (see Server's InstanceID). If it differs from the one last seen then
+// the Peer's messages have started reaching a different instance of the
+// server, which doesn't know that the Peer is ready-to-mingle, so a
+// ReadyToMingle is sent to it straight away.
+//
+// This must be called with the lock held.
+func (p *Peer) observeServerInstance(addr net.Addr, msg Message) {
+	if len(msg.InstanceID) == 0 || bytes.Equal(msg.InstanceID, p.serverInstanceID) {
+		return
+	}
+	prev := p.serverInstanceID
+	p.serverInstanceID = bytes.Clone(msg.InstanceID)
+	if prev == nil {
+		return
+	}
+	p.event(PeerEvent{Type: PeerEventServerInstanceChanged, Addr: addr, Message: &msg})
+
+	// while bootstrapping a ReadyToMingle will be sent once it's done anyway.
+	if (p.state != PeerStateEstablished && p.state != PeerStateRebootstrapping) ||
+		!p.mingles() {
+		return
+	}
+	sb, err := p.readyToMingleBatch()
+	if err != nil {
+		p.event(PeerEvent{Type: PeerEventError, Addr: addr, Err: err})
+		return
+	}
+	p.flushAsync(sb, func(err error) {
+		p.event(PeerEvent{Type: PeerEventError, Addr: addr, Err: err})
+	})
+}
+
+// AddMingler adds a ready-to-mingle peer which another Server has received a
+// ReadyToMingle from, as reported by its OnMinglerAdded, as if this Server had
+// received it. The Mingler's LastSeen is ignored, the peer expires according to
+// this Server's ReadyToMingleTimeout unless added again. Meet messages for the
+// peer are sent from the Server's main endpoint, i.e. the first given to
+// Serve, so this is only useful if the peer knows the Server by that address,
+// e.g. because it's an anycast address shared by both Servers.
+//
+// OnMinglerAdded isn't called for peers added this way, so that they aren't
+// passed back to the Server they came from.
+func (s *Server) AddMingler(mingler Mingler) {
+	fingerprint := bytes.Clone(mingler.Fingerprint)
+	s.mingleZSets.add(mingler.Rendezvous, mingler.Addr, nil, fingerprint, MingleCapacity{})
+}
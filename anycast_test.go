@@ -0,0 +1,146 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerServerInstanceChanged(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	server.InstanceID = []byte("a")
+	go server.Serve(ctx, conn)
+
+	evCh := make(chan PeerEvent, 16)
+	peer, err := NewPeer(ctx, "udp", conn.LocalAddr().String(), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		ListenAddr:              "127.0.0.1:0",
+		EventCh:                 evCh,
+	})
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+
+	peer.l.RLock()
+	instanceID := string(peer.serverInstanceID)
+	peer.l.RUnlock()
+	massert.Require(t, massert.Equal("a", instanceID))
+
+	for server.Stats().ReadyToMingles == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	readyToMingles := server.Stats().ReadyToMingles
+
+	// the same instance again changes nothing.
+	peer.l.Lock()
+	err = peer.processMessage(conn.LocalAddr(), Message{
+		Fingerprint: peer.lastFingerprint,
+		Type:        YouAre,
+		YouAreBody:  YouAreBody{Addr: peer.LocalAddr()},
+		InstanceID:  []byte("a"),
+	})
+	peer.l.Unlock()
+	massert.Require(t, massert.Nil(err))
+
+	// a different instance causes a ReadyToMingle to be sent.
+	peer.l.Lock()
+	err = peer.processMessage(conn.LocalAddr(), Message{
+		Fingerprint: peer.lastFingerprint,
+		Type:        YouAre,
+		YouAreBody:  YouAreBody{Addr: peer.LocalAddr()},
+		InstanceID:  []byte("b"),
+	})
+	peer.l.Unlock()
+	massert.Require(t, massert.Nil(err))
+
+	for server.Stats().ReadyToMingles <= readyToMingles {
+		select {
+		case <-ctx.Done():
+			t.Fatal("no ReadyToMingle sent to new instance")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	var changed []PeerEvent
+	for len(evCh) > 0 {
+		if ev := <-evCh; ev.Type == PeerEventServerInstanceChanged {
+			changed = append(changed, ev)
+		}
+	}
+	massert.Require(t, massert.Equal(1, len(changed)))
+	massert.Require(t,
+		massert.Equal(conn.LocalAddr().String(), changed[0].Addr.String()),
+		massert.Equal([]byte("b"), changed[0].Message.InstanceID),
+	)
+}
+
+func TestServerShareMinglers(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// minglers which reach a are shared with b, and a reports them once
+	// they've expired.
+	b, bAddr := testServer(ctx, t, nil)
+	expiredCh := make(chan Mingler, 1)
+	_, aAddr := testServer(ctx, t, func(a *Server) {
+		a.ReadyToMingleTimeout = 200 * time.Millisecond
+		a.OnMinglerAdded = b.AddMingler
+		a.OnMinglerExpired = func(m Mingler) { expiredCh <- m }
+	})
+
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	send := func(conn net.PacketConn, dst net.Addr, msg Message) {
+		b, err := msg.MarshalBinary()
+		massert.Require(t, massert.Nil(err))
+		_, err = conn.WriteTo(b, dst)
+		massert.Require(t, massert.Nil(err))
+	}
+
+	mingler := listen()
+	send(mingler, aAddr, Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        ReadyToMingle,
+		Rendezvous:  rendezvousKey("foo"),
+	})
+	for len(b.Minglers()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	massert.Require(t,
+		massert.Equal(mingler.LocalAddr().String(), b.Minglers()[0].Addr.String()),
+		massert.Equal(rendezvousKey("foo"), b.Minglers()[0].Rendezvous),
+	)
+
+	// b introduces its own peers to the shared mingler, sending the Meet from
+	// its main endpoint.
+	send(listen(), bAddr, Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        HelloServer,
+		Rendezvous:  rendezvousKey("foo"),
+	})
+	mingler.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MaxMessageSize)
+	n, src, err := mingler.ReadFrom(buf)
+	massert.Require(t, massert.Nil(err))
+	var meet Message
+	massert.Require(t,
+		massert.Nil(meet.UnmarshalBinary(buf[:n])),
+		massert.Equal(Meet, meet.Type),
+		massert.Equal(bAddr.String(), src.String()),
+	)
+
+	expired := <-expiredCh
+	massert.Require(t, massert.Equal(mingler.LocalAddr().String(), expired.Addr.String()))
+}
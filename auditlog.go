@@ -0,0 +1,192 @@
+package bonfire
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Introduction describes a single Meet message sent by a Server, i.e. the
+// introduction of one peer to another.
+type Introduction struct {
+	Time time.Time
+
+	// The peer which sent the HelloServer message, and which is being
+	// introduced.
+	Addr        net.Addr
+	Fingerprint []byte
+
+	// The ready-to-mingle peer which was sent the Meet message.
+	MinglerAddr        net.Addr
+	MinglerFingerprint []byte
+}
+
+// AuditLogOpts are optional parameters to OpenAuditLog. A nil value is
+// equivalent to a zero value.
+type AuditLogOpts struct {
+	// The size, in bytes, which the log file may reach before it is rotated.
+	// Default is 100MB.
+	MaxSize int64
+
+	// The number of rotated log files which are kept, in addition to the
+	// current one. Rotated files are named by appending ".1", ".2", etc to the
+	// path, with ".1" being the most recent. Default is 5.
+	MaxBackups int
+
+	// If true, addresses are recorded only up to their network (a /24 for
+	// IPv4, a /48 for IPv6) and without their port.
+	RedactAddrs bool
+
+	// If set, fingerprints are recorded as an HMAC-SHA256 of the fingerprint
+	// using this key, truncated to 16 bytes. This allows for the introductions
+	// of a single peer to be correlated without the fingerprint itself being
+	// recorded.
+	FingerprintKey []byte
+}
+
+func (o AuditLogOpts) withDefaults() AuditLogOpts {
+	if o.MaxSize == 0 {
+		o.MaxSize = 100 * 1024 * 1024
+	}
+	if o.MaxBackups == 0 {
+		o.MaxBackups = 5
+	}
+	return o
+}
+
+// AuditLog is an append-only log of Introductions, written to a file as one
+// JSON object per line. It is intended to be used as a Server's
+// OnIntroduction callback, for the purpose of investigating abuse on public
+// servers.
+type AuditLog struct {
+	path string
+	opts AuditLogOpts
+
+	l    sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenAuditLog opens the file at the given path for appending, creating it if
+// it doesn't exist.
+func OpenAuditLog(path string, opts *AuditLogOpts) (*AuditLog, error) {
+	if opts == nil {
+		opts = new(AuditLogOpts)
+	}
+	al := &AuditLog{path: path, opts: opts.withDefaults()}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AuditLog) open() error {
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	al.f, al.size = f, stat.Size()
+	return nil
+}
+
+// rotate closes the current file, shifts it and all backups up by one, and
+// opens a new file.
+func (al *AuditLog) rotate() error {
+	if err := al.f.Close(); err != nil {
+		return err
+	}
+
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", al.path, i) }
+	os.Remove(backup(al.opts.MaxBackups))
+	for i := al.opts.MaxBackups - 1; i > 0; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(al.path, backup(1)); err != nil {
+		return err
+	}
+	return al.open()
+}
+
+type auditLogEntry struct {
+	Time               time.Time `json:"time"`
+	Addr               string    `json:"addr"`
+	Fingerprint        string    `json:"fingerprint"`
+	MinglerAddr        string    `json:"minglerAddr"`
+	MinglerFingerprint string    `json:"minglerFingerprint"`
+}
+
+func (al *AuditLog) addrString(addr net.Addr) string {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !al.opts.RedactAddrs {
+		return addr.String()
+	} else if !ok {
+		return ""
+	} else if ip := udpAddr.IP.To4(); ip != nil {
+		return ip.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return udpAddr.IP.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+func (al *AuditLog) fingerprintString(fingerprint []byte) string {
+	if al.opts.FingerprintKey == nil {
+		return hex.EncodeToString(fingerprint)
+	}
+	h := hmac.New(sha256.New, al.opts.FingerprintKey)
+	h.Write(fingerprint)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Log appends the Introduction to the log, rotating the log file first if
+// necessary. Its signature matches that of Server's OnIntroduction field.
+func (al *AuditLog) Log(intro Introduction) error {
+	b, err := json.Marshal(auditLogEntry{
+		Time:               intro.Time.UTC(),
+		Addr:               al.addrString(intro.Addr),
+		Fingerprint:        al.fingerprintString(intro.Fingerprint),
+		MinglerAddr:        al.addrString(intro.MinglerAddr),
+		MinglerFingerprint: al.fingerprintString(intro.MinglerFingerprint),
+	})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	al.l.Lock()
+	defer al.l.Unlock()
+	if al.f == nil {
+		return os.ErrClosed
+	} else if al.size > 0 && al.size+int64(len(b)) > al.opts.MaxSize {
+		if err := al.rotate(); err != nil {
+			return fmt.Errorf("rotating audit log: %w", err)
+		}
+	}
+
+	n, err := al.f.Write(b)
+	al.size += int64(n)
+	return err
+}
+
+// Close closes the log file.
+func (al *AuditLog) Close() error {
+	al.l.Lock()
+	defer al.l.Unlock()
+	if al.f == nil {
+		return os.ErrClosed
+	}
+	err := al.f.Close()
+	al.f = nil
+	return err
+}
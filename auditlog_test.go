@@ -0,0 +1,83 @@
+package bonfire
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestAuditLog(t *T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	readEntries := func(path string) []auditLogEntry {
+		f, err := os.Open(path)
+		massert.Require(t, massert.Nil(err))
+		defer f.Close()
+
+		var entries []auditLogEntry
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry auditLogEntry
+			massert.Require(t, massert.Nil(json.Unmarshal(scanner.Bytes(), &entry)))
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	intro := Introduction{
+		Time:               time.Now(),
+		Addr:               addrString("1.2.3.4:5678"),
+		Fingerprint:        []byte{1, 2, 3},
+		MinglerAddr:        addrString("[2001:db8:1:2::1]:6666"),
+		MinglerFingerprint: []byte{4, 5, 6},
+	}
+
+	al, err := OpenAuditLog(path, &AuditLogOpts{MaxSize: 300, MaxBackups: 1})
+	massert.Require(t, massert.Nil(err))
+	massert.Require(t, massert.Nil(al.Log(intro)))
+
+	entries := readEntries(path)
+	massert.Require(t,
+		massert.Length(entries, 1),
+		massert.Equal("1.2.3.4:5678", entries[0].Addr),
+		massert.Equal("010203", entries[0].Fingerprint),
+		massert.Equal("[2001:db8:1:2::1]:6666", entries[0].MinglerAddr),
+		massert.Equal("040506", entries[0].MinglerFingerprint),
+	)
+
+	// each entry is a bit under 200 bytes, so every entry should cause a
+	// rotation, and only one backup should be kept.
+	massert.Require(t,
+		massert.Nil(al.Log(intro)),
+		massert.Nil(al.Log(intro)),
+		massert.Nil(al.Close()),
+	)
+	_, err = os.Stat(path + ".2")
+	massert.Require(t,
+		massert.Length(readEntries(path), 1),
+		massert.Length(readEntries(path+".1"), 1),
+		massert.Equal(true, os.IsNotExist(err)),
+	)
+
+	// reopening should append to the existing file
+	al, err = OpenAuditLog(path, &AuditLogOpts{
+		RedactAddrs:    true,
+		FingerprintKey: []byte("key"),
+	})
+	massert.Require(t, massert.Nil(err))
+	massert.Require(t, massert.Nil(al.Log(intro)), massert.Nil(al.Close()))
+
+	entries = readEntries(path)
+	massert.Require(t,
+		massert.Length(entries, 2),
+		massert.Equal("1.2.3.0/24", entries[1].Addr),
+		massert.Equal(32, len(entries[1].Fingerprint)),
+		massert.Not(massert.Equal("010203", entries[1].Fingerprint)),
+		massert.Equal("2001:db8:1::/48", entries[1].MinglerAddr),
+	)
+}
@@ -0,0 +1,113 @@
+package bonfire
+
+import (
+	"container/list"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// authFailedInterval is the minimum time between AuthFailed messages sent
+	// by a Server to any one IP.
+	authFailedInterval = 10 * time.Second
+
+	// maxAuthFailureSources is the number of IPs for which a Server keeps
+	// count of failed fingerprint checks. Once reached, the least recently
+	// seen IP is forgotten to make room for each new one.
+	maxAuthFailureSources = 1024
+)
+
+// AuthFailure describes the messages from a single IP which have failed a
+// Server's FingerprintCheck.
+type AuthFailure struct {
+	IP       net.IP
+	Count    uint64
+	LastSeen time.Time
+}
+
+// authFailures counts failed fingerprint checks per IP. Each element of lru
+// holds an *AuthFailure, ordered from least to most recently seen.
+type authFailures struct {
+	l   sync.Mutex
+	m   map[string]*list.Element
+	lru list.List
+}
+
+func (af *authFailures) add(ip net.IP, now time.Time) {
+	af.l.Lock()
+	defer af.l.Unlock()
+
+	ipStr := ip.String()
+	if el, ok := af.m[ipStr]; ok {
+		f := el.Value.(*AuthFailure)
+		f.Count++
+		f.LastSeen = now
+		af.lru.MoveToBack(el)
+		return
+	} else if af.m == nil {
+		af.m = map[string]*list.Element{}
+	} else if len(af.m) >= maxAuthFailureSources {
+		oldest := af.lru.Front()
+		delete(af.m, oldest.Value.(*AuthFailure).IP.String())
+		af.lru.Remove(oldest)
+	}
+	af.m[ipStr] = af.lru.PushBack(&AuthFailure{IP: ip, Count: 1, LastSeen: now})
+}
+
+// AuthFailures returns, for each IP which has recently sent messages failing
+// the Server's FingerprintCheck, how many it has sent. They're ordered from
+// most to fewest failures. Only a limited number of IPs are tracked at once,
+// with the least recently seen being forgotten first.
+func (s *Server) AuthFailures() []AuthFailure {
+	s.authFailures.l.Lock()
+	failures := make([]AuthFailure, 0, len(s.authFailures.m))
+	for el := s.authFailures.lru.Front(); el != nil; el = el.Next() {
+		failures = append(failures, *el.Value.(*AuthFailure))
+	}
+	s.authFailures.l.Unlock()
+
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Count != failures[j].Count {
+			return failures[i].Count > failures[j].Count
+		}
+		return failures[i].IP.String() < failures[j].IP.String()
+	})
+	return failures
+}
+
+// authFailed is called when the given message, received on conn from src, has
+// failed the FingerprintCheck. The failure is counted, and if SendAuthFailed is
+// set the sender is told about it, at most once per authFailedInterval.
+func (s *Server) authFailed(conn net.PacketConn, src net.Addr, msg Message) {
+	s.stats.authFailures.Add(1)
+	now := s.now()
+	ip := addrIP(src)
+	if ip != nil {
+		s.authFailures.add(ip, now)
+	}
+
+	if !s.SendAuthFailed {
+		return
+	}
+	ipStr := src.String()
+	if ip != nil {
+		ipStr = ip.String()
+	}
+	if !s.authFailedLimits.allow(ipStr, now, authFailedInterval) {
+		return
+	}
+
+	// only a single AuthFailed is sent, so that it can't be used to amplify
+	// traffic towards a spoofed source.
+	err := multiSend(s.newSendBatch(conn), src, 1, Message{
+		Fingerprint: msg.Fingerprint,
+		Type:        AuthFailed,
+	})
+	if err != nil {
+		s.err(err)
+		return
+	}
+	s.stats.authFailedSent.Add(1)
+}
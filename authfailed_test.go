@@ -0,0 +1,133 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestServerAuthFailed(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	server.FingerprintCheck = func([]byte) bool { return false }
+	server.SendAuthFailed = true
+	go server.Serve(ctx, conn)
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer client.Close()
+
+	fingerprint := mrand.Bytes(FingerprintSize)
+	b, err := Message{Fingerprint: fingerprint, Type: HelloServer}.MarshalBinary()
+	massert.Require(t, massert.Nil(err))
+	for i := 0; i < 3; i++ {
+		_, err = client.WriteTo(b, conn.LocalAddr())
+		massert.Require(t, massert.Nil(err))
+	}
+
+	buf := make([]byte, MaxMessageSize)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := client.ReadFrom(buf)
+	massert.Require(t, massert.Nil(err))
+	var msg Message
+	massert.Require(t,
+		massert.Nil(msg.UnmarshalBinary(buf[:n])),
+		massert.Equal(AuthFailed, msg.Type),
+		massert.Equal(fingerprint, msg.Fingerprint),
+	)
+
+	// the rest of the failures are counted, but not responded to.
+	for server.Stats().AuthFailures < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = client.ReadFrom(buf)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	stats := server.Stats()
+	failures := server.AuthFailures()
+	massert.Require(t,
+		massert.Equal(uint64(1), stats.AuthFailedSent),
+		massert.Equal(uint64(3), stats.PacketsDropped),
+		massert.Equal(1, len(failures)),
+	)
+	massert.Require(t,
+		massert.Equal("127.0.0.1", failures[0].IP.String()),
+		massert.Equal(uint64(3), failures[0].Count),
+	)
+}
+
+func TestAuthFailures(t *T) {
+	var af authFailures
+	now := time.Now()
+	for i := 0; i < maxAuthFailureSources; i++ {
+		af.add(net.IPv4(10, 0, byte(i>>8), byte(i)), now.Add(time.Duration(i)))
+	}
+	af.add(net.IPv4(10, 0, 0, 1), now.Add(time.Hour))
+
+	// the least recently seen IP is forgotten to make room for a new one.
+	af.add(net.IPv4(10, 1, 0, 0), now.Add(time.Hour))
+	_, oldest := af.m["10.0.0.0"]
+	_, second := af.m["10.0.0.2"]
+	massert.Require(t,
+		massert.Equal(maxAuthFailureSources, len(af.m)),
+		massert.Equal(false, oldest),
+		massert.Equal(true, second),
+		massert.Equal(uint64(2), af.m["10.0.0.1"].Value.(*AuthFailure).Count),
+		massert.Equal(uint64(1), af.m["10.1.0.0"].Value.(*AuthFailure).Count),
+		massert.Equal(maxAuthFailureSources, af.lru.Len()),
+	)
+}
+
+func TestPeerAuthFailed(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	server.FingerprintCheck = func([]byte) bool { return false }
+	server.SendAuthFailed = true
+	go server.Serve(ctx, conn)
+
+	evCh := make(chan PeerEvent, 10)
+	peer, err := NewPeerAsync(ctx, "udp", conn.LocalAddr().String(), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		ListenAddr:              "127.0.0.1:0",
+		EventCh:                 evCh,
+	})
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+	go func() {
+		b := make([]byte, MaxMessageSize)
+		for {
+			if _, _, err := peer.ReadFrom(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev := <-evCh:
+			if ev.Type != PeerEventAuthFailed {
+				continue
+			}
+			massert.Require(t,
+				massert.Equal(conn.LocalAddr().String(), ev.Addr.String()),
+				massert.Not(massert.Equal(PeerStateEstablished, peer.State())),
+			)
+			return
+		case <-ctx.Done():
+			t.Fatal("no AuthFailed event emitted")
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Package bftest provides tools for testing applications which use bonfire.
+//
+// ImpairedConn can be used to run a Peer over a simulated bad network, in
+// order to check how an application's gossip logic copes with lost, duplicated,
+// reordered and delayed packets:
+//
+//	conn, err := net.ListenPacket("udp", ":0")
+//	if err != nil {
+//		// handle error
+//	}
+//	conn = bftest.NewImpairedConn(conn, bftest.Impairment{
+//		Loss:   0.1,
+//		Delay:  50 * time.Millisecond,
+//		Jitter: 20 * time.Millisecond,
+//	})
+//	peer, err := bonfire.NewPeerConn(ctx, conn, serverAddr, nil)
+//
+// Network can be used to run many Peers, and their Server, within a single
+// process over simulated sockets.
+package bftest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Impairment describes the ways in which an ImpairedConn mistreats packets
+// written to it. The zero value leaves packets untouched.
+type Impairment struct {
+	// Probability, between 0 and 1, that a packet is silently dropped.
+	Loss float64
+
+	// Probability, between 0 and 1, that a packet is sent twice. Each copy is
+	// delayed independently.
+	Duplicate float64
+
+	// Probability, between 0 and 1, that a packet is held back for an extra
+	// ReorderDelay, so that packets written after it overtake it.
+	Reorder float64
+
+	// The extra delay applied to reordered packets. Default is 20ms.
+	ReorderDelay time.Duration
+
+	// The time every packet is held for before being sent.
+	Delay time.Duration
+
+	// If set, every packet is held for a random extra amount of time, up to
+	// this duration.
+	Jitter time.Duration
+
+	// The seed for the random decisions made, so that runs can be repeated.
+	// If 0 a random seed is used.
+	Seed int64
+}
+
+func (imp Impairment) withDefaults() Impairment {
+	if imp.ReorderDelay == 0 {
+		imp.ReorderDelay = 20 * time.Millisecond
+	}
+	return imp
+}
+
+// ImpairedConn wraps a net.PacketConn, applying an Impairment to all packets
+// written to it. Packets read from it are untouched; to impair a network in
+// both directions every Peer on it should use an ImpairedConn.
+type ImpairedConn struct {
+	net.PacketConn
+
+	l      sync.Mutex
+	imp    Impairment
+	rand   *rand.Rand
+	closed bool
+}
+
+// NewImpairedConn wraps the given PacketConn such that packets written to it
+// are subject to the given Impairment.
+func NewImpairedConn(conn net.PacketConn, imp Impairment) *ImpairedConn {
+	c := &ImpairedConn{PacketConn: conn}
+	c.SetImpairment(imp)
+	return c
+}
+
+// SetImpairment changes the Impairment applied to packets written from now
+// on.
+func (c *ImpairedConn) SetImpairment(imp Impairment) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	seed := imp.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c.imp = imp.withDefaults()
+	c.rand = rand.New(rand.NewSource(seed))
+}
+
+// this must be called with the lock held.
+func (c *ImpairedConn) delay() time.Duration {
+	d := c.imp.Delay
+	if c.imp.Jitter > 0 {
+		d += time.Duration(c.rand.Int63n(int64(c.imp.Jitter)))
+	}
+	if c.rand.Float64() < c.imp.Reorder {
+		d += c.imp.ReorderDelay
+	}
+	return d
+}
+
+// WriteTo implements the method for the net.PacketConn interface. Packets
+// which aren't sent immediately are sent in the background, and any errors
+// encountered when doing so are discarded, as if the packet were lost.
+func (c *ImpairedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.l.Lock()
+	if c.closed {
+		c.l.Unlock()
+		return 0, net.ErrClosed
+	} else if c.rand.Float64() < c.imp.Loss {
+		c.l.Unlock()
+		return len(b), nil
+	}
+
+	delays := []time.Duration{c.delay()}
+	if c.rand.Float64() < c.imp.Duplicate {
+		delays = append(delays, c.delay())
+	}
+	c.l.Unlock()
+
+	var err error
+	for _, d := range delays {
+		if d <= 0 {
+			_, err = c.PacketConn.WriteTo(b, addr)
+			continue
+		}
+
+		// the caller may reuse b once WriteTo returns
+		b := append([]byte(nil), b...)
+		time.AfterFunc(d, func() {
+			c.l.Lock()
+			closed := c.closed
+			c.l.Unlock()
+			if !closed {
+				c.PacketConn.WriteTo(b, addr)
+			}
+		})
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close implements the method for the net.PacketConn interface. Packets which
+// are still being held are dropped.
+func (c *ImpairedConn) Close() error {
+	c.l.Lock()
+	c.closed = true
+	c.l.Unlock()
+	return c.PacketConn.Close()
+}
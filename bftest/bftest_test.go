@@ -0,0 +1,76 @@
+package bftest
+
+import (
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestImpairedConn(t *T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// readAll reads packets until none arrive for the given time, returning
+	// each packet's first byte.
+	readAll := func(conn net.PacketConn, wait time.Duration) []byte {
+		var got []byte
+		b := make([]byte, 16)
+		for {
+			conn.SetReadDeadline(time.Now().Add(wait))
+			n, _, err := conn.ReadFrom(b)
+			if err != nil {
+				return got
+			} else if n > 0 {
+				got = append(got, b[0])
+			}
+		}
+	}
+
+	dst := listen()
+	defer dst.Close()
+	conn := NewImpairedConn(listen(), Impairment{})
+	defer conn.Close()
+
+	send := func(bb ...byte) {
+		for _, b := range bb {
+			if _, err := conn.WriteTo([]byte{b}, dst.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	send(1, 2, 3)
+	massert.Require(t, massert.Equal([]byte{1, 2, 3}, readAll(dst, 50*time.Millisecond)))
+
+	conn.SetImpairment(Impairment{Loss: 1})
+	send(1, 2, 3)
+	massert.Require(t, massert.Length(readAll(dst, 50*time.Millisecond), 0))
+
+	conn.SetImpairment(Impairment{Duplicate: 1})
+	send(1)
+	massert.Require(t, massert.Equal([]byte{1, 1}, readAll(dst, 50*time.Millisecond)))
+
+	conn.SetImpairment(Impairment{Delay: 100 * time.Millisecond})
+	start := time.Now()
+	send(1)
+	massert.Require(t,
+		massert.Equal([]byte{1}, readAll(dst, 200*time.Millisecond)),
+	)
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Fatalf("packet arrived after %v, expected at least 100ms", took)
+	}
+
+	// the first packet is held back, so the second overtakes it
+	conn.SetImpairment(Impairment{Reorder: 1, ReorderDelay: 50 * time.Millisecond})
+	send(1)
+	conn.SetImpairment(Impairment{})
+	send(2)
+	massert.Require(t, massert.Equal([]byte{2, 1}, readAll(dst, 100*time.Millisecond)))
+}
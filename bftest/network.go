@@ -0,0 +1,230 @@
+package bftest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// networkQueueSize is the number of packets which may be waiting to be read
+// from a Network's PacketConn. Further packets are dropped, as they would be
+// by a full socket buffer.
+const networkQueueSize = 1024
+
+var errDeadlineChanged = errors.New("deadline changed")
+
+type networkPacket struct {
+	b   []byte
+	src net.Addr
+}
+
+// Network is an in-memory network of PacketConns, which allows many Peers
+// (along with their Server) to be run within a single process without using
+// real sockets:
+//
+//	network := bftest.NewNetwork()
+//	serverConn, err := network.ListenPacket("10.0.0.1:7890")
+//	if err != nil {
+//		// handle error
+//	}
+//	go bonfire.NewServer().Serve(ctx, serverConn)
+//
+//	conn, err := network.ListenPacket("")
+//	if err != nil {
+//		// handle error
+//	}
+//	peer, err := bonfire.NewPeerConn(ctx, conn, "10.0.0.1:7890", nil)
+//
+// Packets are delivered immediately and reliably; an ImpairedConn can be used
+// to make things harder.
+type Network struct {
+	l      sync.Mutex
+	conns  map[string]*networkConn
+	nextIP uint32
+}
+
+// NewNetwork initializes and returns an empty Network.
+func NewNetwork() *Network {
+	return &Network{conns: map[string]*networkConn{}, nextIP: 1}
+}
+
+// ListenPacket returns a PacketConn on the Network bound to the given UDP
+// address. If the address is empty, or its IP is unspecified, an unused IP
+// within 10.0.0.0/8 is assigned. If its port is 0 then 1 is used.
+func (n *Network) ListenPacket(addrStr string) (net.PacketConn, error) {
+	addr := new(net.UDPAddr)
+	if addrStr != "" {
+		var err error
+		if addr, err = net.ResolveUDPAddr("udp", addrStr); err != nil {
+			return nil, err
+		}
+	}
+	if addr.Port == 0 {
+		addr.Port = 1
+	}
+
+	n.l.Lock()
+	defer n.l.Unlock()
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		for {
+			ip := n.nextIP
+			n.nextIP++
+			addr.IP = net.IPv4(10, byte(ip>>16), byte(ip>>8), byte(ip))
+			if _, ok := n.conns[addr.String()]; !ok {
+				break
+			}
+		}
+	}
+
+	if _, ok := n.conns[addr.String()]; ok {
+		return nil, fmt.Errorf("address %s already in use", addr)
+	}
+	c := &networkConn{
+		n:          n,
+		addr:       addr,
+		inCh:       make(chan networkPacket, networkQueueSize),
+		closeCh:    make(chan struct{}),
+		deadlineCh: make(chan struct{}),
+	}
+	n.conns[addr.String()] = c
+	return c, nil
+}
+
+func (n *Network) conn(addr net.Addr) *networkConn {
+	n.l.Lock()
+	defer n.l.Unlock()
+	return n.conns[addr.String()]
+}
+
+func (n *Network) remove(c *networkConn) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	delete(n.conns, c.addr.String())
+}
+
+type networkConn struct {
+	n       *Network
+	addr    *net.UDPAddr
+	inCh    chan networkPacket
+	closeCh chan struct{}
+
+	l            sync.Mutex
+	closed       bool
+	readDeadline time.Time
+
+	// deadlineCh is closed, and replaced, whenever the read deadline changes,
+	// so that a blocked ReadFrom notices.
+	deadlineCh chan struct{}
+}
+
+func (c *networkConn) opErr(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: c.addr, Err: err}
+}
+
+func (c *networkConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.l.Lock()
+		closed, deadline, deadlineCh := c.closed, c.readDeadline, c.deadlineCh
+		c.l.Unlock()
+		if closed {
+			return 0, nil, c.opErr("read", net.ErrClosed)
+		}
+
+		var timer *time.Timer
+		var timeoutCh <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, c.opErr("read", os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(d)
+			timeoutCh = timer.C
+		}
+
+		var (
+			n   int
+			src net.Addr
+			err error
+		)
+		select {
+		case pkt := <-c.inCh:
+			n, src = copy(b, pkt.b), pkt.src
+		case <-c.closeCh:
+			err = c.opErr("read", net.ErrClosed)
+		case <-timeoutCh:
+			err = c.opErr("read", os.ErrDeadlineExceeded)
+		case <-deadlineCh:
+			// the deadline changed, start over with the new one.
+			err = errDeadlineChanged
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err == errDeadlineChanged {
+			continue
+		}
+		return n, src, err
+	}
+}
+
+func (c *networkConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closeCh:
+		return 0, c.opErr("write", net.ErrClosed)
+	default:
+	}
+
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		return 0, c.opErr("write", errors.New("address is not a UDP address"))
+	}
+
+	// as with UDP, packets to addresses which nothing is listening on, or
+	// which aren't being read quickly enough, are lost.
+	dst := c.n.conn(addr)
+	if dst == nil {
+		return len(b), nil
+	}
+	pkt := networkPacket{b: append([]byte(nil), b...), src: c.addr}
+	select {
+	case dst.inCh <- pkt:
+	default:
+	}
+	return len(b), nil
+}
+
+func (c *networkConn) Close() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.closed {
+		return c.opErr("close", net.ErrClosed)
+	}
+	c.closed = true
+	close(c.closeCh)
+	c.n.remove(c)
+	return nil
+}
+
+func (c *networkConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *networkConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *networkConn) SetReadDeadline(t time.Time) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.readDeadline = t
+	close(c.deadlineCh)
+	c.deadlineCh = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes never block.
+func (c *networkConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
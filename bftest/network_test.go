@@ -0,0 +1,97 @@
+package bftest
+
+import (
+	"context"
+	"errors"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/bonfire"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestNetwork(t *T) {
+	network := NewNetwork()
+	a, err := network.ListenPacket("")
+	massert.Require(t, massert.Nil(err))
+	b, err := network.ListenPacket("10.1.2.3:4")
+	massert.Require(t, massert.Nil(err))
+	_, err = network.ListenPacket("10.1.2.3:4")
+	massert.Require(t,
+		massert.Not(massert.Nil(err)),
+		massert.Equal("10.0.0.1:1", a.LocalAddr().String()),
+	)
+
+	_, err = a.WriteTo([]byte("hi"), b.LocalAddr())
+	massert.Require(t, massert.Nil(err))
+	buf := make([]byte, 16)
+	n, src, err := b.ReadFrom(buf)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal("hi", string(buf[:n])),
+		massert.Equal(a.LocalAddr(), src),
+	)
+
+	// reading times out once the deadline passes, even if it's set while
+	// already reading.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.SetReadDeadline(time.Now())
+	}()
+	_, _, err = b.ReadFrom(buf)
+	nErr, ok := err.(net.Error)
+	massert.Require(t,
+		massert.Equal(true, ok),
+		massert.Equal(true, nErr.Timeout()),
+	)
+
+	massert.Require(t, massert.Nil(b.Close()))
+	_, _, err = b.ReadFrom(buf)
+	massert.Require(t, massert.Equal(true, errors.Is(err, net.ErrClosed)))
+
+	// the address can be used again once closed.
+	b, err = network.ListenPacket("10.1.2.3:4")
+	massert.Require(t, massert.Nil(err))
+	b.Close()
+	a.Close()
+}
+
+func TestNetworkPeers(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	network := NewNetwork()
+	serverConn, err := network.ListenPacket("10.0.0.1:7890")
+	massert.Require(t, massert.Nil(err))
+	go bonfire.NewServer().Serve(ctx, serverConn)
+
+	newPeer := func() *bonfire.Peer {
+		conn, err := network.ListenPacket("")
+		massert.Require(t, massert.Nil(err))
+		peer, err := bonfire.NewPeerConn(ctx, conn, "10.0.0.1:7890", &bonfire.PeerOpts{
+			InitTimeoutUntilGateway: -1,
+		})
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { peer.Close() })
+		go func() {
+			b := make([]byte, bonfire.MaxMessageSize)
+			for {
+				if _, _, err := peer.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+		return peer
+	}
+
+	a := newPeer()
+	massert.Require(t, massert.Equal(a.LocalAddr().String(), a.RemoteAddr().String()))
+
+	// b is introduced to a by the server.
+	b := newPeer()
+	for len(b.PeerAddrs()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	massert.Require(t, massert.Equal([]net.Addr{a.LocalAddr()}, b.PeerAddrs()))
+}
@@ -0,0 +1,104 @@
+package bonfire
+
+import (
+	"net"
+	"sort"
+)
+
+// bogonNets are the networks, other than those covered by net.IP's own
+// methods, which IsBogon considers to not be publicly routable.
+var bogonNets = func() []*net.IPNet {
+	cidrs := []string{
+		"0.0.0.0/8",       // "this" network
+		"100.64.0.0/10",   // carrier-grade NAT
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // TEST-NET-1
+		"198.18.0.0/15",   // benchmarking
+		"198.51.100.0/24", // TEST-NET-2
+		"203.0.113.0/24",  // TEST-NET-3
+		"240.0.0.0/4",     // reserved, and broadcast
+		"64:ff9b:1::/48",  // local-use IPv4/IPv6 translation
+		"100::/64",        // discard-only
+		"2001:db8::/32",   // documentation
+	}
+	ipNets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNets[i], _ = net.ParseCIDR(cidr)
+	}
+	return ipNets
+}()
+
+// IsBogon returns true if the IP isn't publicly routable on the internet, i.e.
+// it's private (RFC 1918 or an IPv6 unique local address), loopback,
+// link-local, multicast, unspecified, carrier-grade NAT, or within one of the
+// ranges reserved for documentation or other special purposes.
+func IsBogon(ip net.IP) bool {
+	if ip.IsPrivate() ||
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() {
+		return true
+	}
+	for _, ipNet := range bogonNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBogonAddr is like IsBogon, but for a UDP address. Addresses of other types
+// are never considered to be bogons.
+func isBogonAddr(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	return ok && IsBogon(udpAddr.IP)
+}
+
+// withoutBogons returns the addresses which aren't bogons (see isBogonAddr).
+// The given slice isn't modified.
+func withoutBogons(addrs []net.Addr) []net.Addr {
+	var out []net.Addr
+	for _, addr := range addrs {
+		if !isBogonAddr(addr) {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// onlyBogons returns the addresses which are bogons (see isBogonAddr). The
+// given slice isn't modified.
+func onlyBogons(addrs []net.Addr) []net.Addr {
+	var out []net.Addr
+	for _, addr := range addrs {
+		if isBogonAddr(addr) {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// sameIP returns whether the two addresses are UDP addresses with the same IP.
+func sameIP(a, b net.Addr) bool {
+	aUDP, aOK := a.(*net.UDPAddr)
+	bUDP, bOK := b.(*net.UDPAddr)
+	return aOK && bOK && aUDP.IP.Equal(bUDP.IP)
+}
+
+// filterBogonCandidates returns the candidates of another peer which are worth
+// sending HelloPeer messages to, with bogons (see isBogonAddr) after all
+// others. Bogons are only kept if they're on one of the host's local networks.
+// The given slice isn't modified.
+func filterBogonCandidates(candidates []net.Addr) []net.Addr {
+	out := make([]net.Addr, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !isBogonAddr(candidate) || onLocalNetwork(candidate) {
+			out = append(out, candidate)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return !isBogonAddr(out[i]) && isBogonAddr(out[j])
+	})
+	return out
+}
@@ -0,0 +1,139 @@
+package bonfire
+
+import (
+	"net"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestIsBogon(t *T) {
+	for ipStr, exp := range map[string]bool{
+		"1.2.3.4":         false,
+		"8.8.8.8":         false,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.1.1":     true,
+		"127.0.0.1":       true,
+		"169.254.1.1":     true,
+		"100.64.0.1":      true,
+		"0.1.2.3":         true,
+		"192.0.2.1":       true,
+		"198.18.0.1":      true,
+		"224.0.0.1":       true,
+		"255.255.255.255": true,
+		"2606:4700::1":    false,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"2001:db8::1":     true,
+		"::ffff:10.0.0.1": true,
+		"::ffff:1.2.3.4":  false,
+	} {
+		massert.Require(t,
+			massert.Comment(massert.Equal(exp, IsBogon(net.ParseIP(ipStr))), "ip:%q", ipStr),
+		)
+	}
+}
+
+func TestFilterBogonCandidates(t *T) {
+	candidates := []net.Addr{
+		addrString("198.51.100.1:1"),
+		addrString("1.2.3.4:1"),
+		addrString("127.0.0.1:1"),
+		addrString("[2606:4700::1]:1"),
+	}
+	massert.Require(t,
+		massert.Equal([]net.Addr{
+			addrString("1.2.3.4:1"),
+			addrString("[2606:4700::1]:1"),
+		}, filterBogonCandidates(candidates)),
+		massert.Equal(addrString("198.51.100.1:1"), candidates[0]),
+	)
+
+	// bogons on the local network are kept, but come last
+	for _, ipNet := range localIPNets() {
+		if ipNet.IP.To4() == nil || !IsBogon(ipNet.IP) {
+			continue
+		}
+		local := &net.UDPAddr{IP: ipNet.IP, Port: 1}
+		massert.Require(t,
+			massert.Equal(
+				[]net.Addr{addrString("1.2.3.4:1"), local},
+				filterBogonCandidates([]net.Addr{local, addrString("1.2.3.4:1")}),
+			),
+		)
+		break
+	}
+}
+
+func TestServerFilterBogons(t *T) {
+	server := NewServer()
+	server.FilterBogons = true
+	cfg := server.Config()
+
+	msg := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        HelloServer,
+		Candidates: []net.Addr{
+			addrString("8.8.8.8:1"),
+			addrString("10.0.0.1:1"),
+		},
+	}
+
+	// meets returns the Meet messages which addMeet adds for the given source
+	// and mingler addresses.
+	meets := func(src, minglerAddr string) []Message {
+		sbs := server.newSendBatches()
+		server.addMeet(sbs, cfg, addrString(src), msg, zsetEl{
+			addr:        addrString(minglerAddr),
+			fingerprint: mrand.Bytes(FingerprintSize),
+		})
+		var msgs []Message
+		for _, sb := range sbs.m {
+			for _, pkt := range sb.pkts {
+				var meet Message
+				massert.Require(t, massert.Nil(meet.UnmarshalBinary(pkt.b)))
+				msgs = append(msgs, meet)
+			}
+		}
+		return msgs
+	}
+
+	// a public mingler isn't given private candidates
+	msgs := meets("1.2.3.4:1", "5.6.7.8:1")
+	massert.Require(t, massert.Length(msgs, cfg.PacketBlastCount))
+	massert.Require(t,
+		massert.Equal([]net.Addr{addrString("8.8.8.8:1")}, msgs[0].Candidates),
+	)
+
+	// nor introduced to a peer observed at a private address
+	massert.Require(t, massert.Length(meets("192.168.0.1:1", "5.6.7.8:1"), 0))
+
+	// a private mingler is given everything
+	msgs = meets("192.168.0.1:1", "192.168.0.2:1")
+	massert.Require(t, massert.Length(msgs, cfg.PacketBlastCount))
+	massert.Require(t, massert.Equal(msg.Candidates, msgs[0].Candidates))
+
+	// a mingler behind the same NAT is given private candidates separately,
+	// but only if SameNATCandidates is set.
+	msgs = meets("1.2.3.4:1", "1.2.3.4:2")
+	massert.Require(t, massert.Length(msgs, cfg.PacketBlastCount))
+	massert.Require(t,
+		massert.Equal([]net.Addr{addrString("8.8.8.8:1")}, msgs[0].Candidates),
+		massert.Length(msgs[0].LANCandidates, 0),
+	)
+
+	server.SameNATCandidates = true
+	msgs = meets("1.2.3.4:1", "1.2.3.4:2")
+	massert.Require(t, massert.Length(msgs, cfg.PacketBlastCount))
+	massert.Require(t,
+		massert.Equal([]net.Addr{addrString("8.8.8.8:1")}, msgs[0].Candidates),
+		massert.Equal([]net.Addr{addrString("10.0.0.1:1")}, msgs[0].LANCandidates),
+	)
+
+	msgs = meets("1.2.3.4:1", "5.6.7.8:1")
+	massert.Require(t, massert.Length(msgs, cfg.PacketBlastCount))
+	massert.Require(t, massert.Length(msgs[0].LANCandidates, 0))
+}
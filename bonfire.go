@@ -3,16 +3,26 @@
 package bonfire
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
+	"time"
 )
 
 // MaxMessageSize is the maximum number of bytes a Message could possibly be
-// when marshaled.
-const MaxMessageSize = 21 + (FingerprintSize * 2)
+// when marshaled. It was raised from 149 (now MaxVersion0MessageSize) to make
+// room for the extension fields of version1 messages, so buffers which were
+// sized using the old value may be too small.
+const MaxMessageSize = 512
+
+// MaxVersion0MessageSize is the maximum number of bytes a Message which doesn't
+// use any extension fields could possibly be when marshaled, i.e. a Meet
+// message describing an ipv6 address.
+const MaxVersion0MessageSize = 21 + (FingerprintSize * 2)
 
 // MinMessageSize is the minimum number of bytes a Message could possibly be
 // when marshaled.
@@ -21,6 +31,38 @@ const MinMessageSize = 2 + FingerprintSize
 // FingerprintSize is the length of the Fingerprint field in a Message.
 const FingerprintSize = 64
 
+// MaxInstanceIDSize is the maximum length of the InstanceID field in a
+// Message, see Server's InstanceID.
+const MaxInstanceIDSize = 32
+
+// Versions of the wire format. A Message is marshaled using version0 unless it
+// makes use of any extension fields, in which case version1 is used. Both are
+// always accepted when unmarshaling.
+const (
+	version0 = iota
+	version1
+
+	// maxVersion is the largest version which can be unmarshaled.
+	maxVersion = version1
+)
+
+// extType enumerates the extension fields which may follow the body of a
+// version1 message.
+type extType byte
+
+const (
+	extCandidates extType = iota
+	extMingleCapacity
+	extSealed
+	extSignature
+	extRendezvous
+	extPadding
+	extTimestamp
+	extLANCandidates
+	extInstanceID
+	extForwardedFor
+)
+
 // MessageType enumerates the type of a bonfire message being sent/received.
 type MessageType byte
 
@@ -30,6 +72,14 @@ const (
 	HelloPeer
 	Meet
 	ReadyToMingle
+	Busy
+	Greet
+	Seek
+	Occupancy
+	Probe
+	Handshake
+	YouAre
+	AuthFailed
 
 	invalid
 )
@@ -44,11 +94,33 @@ func (mt MessageType) String() string {
 		return "Meet"
 	case ReadyToMingle:
 		return "ReadyToMingle"
+	case Busy:
+		return "Busy"
+	case Greet:
+		return "Greet"
+	case Seek:
+		return "Seek"
+	case Occupancy:
+		return "Occupancy"
+	case Probe:
+		return "Probe"
+	case Handshake:
+		return "Handshake"
+	case YouAre:
+		return "YouAre"
+	case AuthFailed:
+		return "AuthFailed"
 	default:
-		panic(fmt.Sprintf("unknown MessageType: %q", byte(mt)))
+		return fmt.Sprintf("MessageType(%d)", byte(mt))
 	}
 }
 
+// MarshalText implements the encoding.TextMarshaler interface, so that the
+// MessageType is encoded by name, e.g. in JSON.
+func (mt MessageType) MarshalText() ([]byte, error) {
+	return []byte(mt.String()), nil
+}
+
 func splitHostPort(addr string) ([]byte, uint16, error) {
 	ipStr, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -84,6 +156,53 @@ type HelloPeerBody struct {
 	Addr net.Addr
 }
 
+// BusyBody describes further fields which are used for Busy messages.
+type BusyBody struct {
+	// RetryAfter is how long the server would like the peer to wait before
+	// sending another HelloServer. It is encoded with millisecond precision.
+	RetryAfter time.Duration
+}
+
+// SeekBody describes further fields which are used for Seek messages.
+type SeekBody struct {
+	// Fingerprint is that of the ReadyToMingle messages sent by the peer
+	// which the sender wishes to be introduced to.
+	Fingerprint []byte
+}
+
+// OccupancyBody describes further fields which are used for Occupancy
+// messages.
+type OccupancyBody struct {
+	// Minglers is the number of peers which are ready-to-mingle using the
+	// message's Rendezvous key. It is only meaningful on responses from the
+	// server.
+	Minglers uint32
+}
+
+// ProbeBody describes further fields which are used for Probe messages.
+type ProbeBody struct {
+	// Addr is the address which the server observed the probing peer's
+	// message coming from. It is only set on responses from the server.
+	Addr net.Addr
+}
+
+// HandshakeBody describes further fields which are used for Handshake
+// messages.
+type HandshakeBody struct {
+	// Ack is set on a Handshake sent in response to another.
+	Ack bool
+
+	// Payload is an application-defined blob, see PeerOpts' HandshakePayload.
+	Payload []byte
+}
+
+// YouAreBody describes further fields which are used for YouAre messages.
+type YouAreBody struct {
+	// Addr is the address which the server observed the peer's HelloServer
+	// coming from.
+	Addr net.Addr
+}
+
 // Message describes a bonfire message can be read to or written from a
 // connection.
 type Message struct {
@@ -92,67 +211,528 @@ type Message struct {
 
 	HelloPeerBody // Only used when Type == HelloPeer
 	MeetBody      // Only used when Type == Meet
+	BusyBody      // Only used when Type == Busy
+	SeekBody      // Only used when Type == Seek
+	OccupancyBody // Only used when Type == Occupancy
+	ProbeBody     // Only used when Type == Probe
+	HandshakeBody // Only used when Type == Handshake
+	YouAreBody    // Only used when Type == YouAre
+
+	// Candidates are addresses which the peer described by the message may be
+	// reachable at, in addition to the address the message was observed coming
+	// from. On a HelloServer or HelloPeer they are the sender's own
+	// candidates, on a Meet they are the candidates of the peer to be met. On
+	// a Probe response they are the server's other endpoints. Optional.
+	Candidates []net.Addr
+
+	// LANCandidates are candidates of the peer to be met on a Meet which
+	// aren't publicly routable (see IsBogon). A server which filters such
+	// candidates out of Candidates (see Server's FilterBogons) may include
+	// them here instead, when the recipient of the Meet shares the peer's
+	// public IP, i.e. the two are behind the same NAT. Optional.
+	LANCandidates []net.Addr
+
+	// InstanceID identifies the server instance which sent the message, when
+	// the server has one (see Server's InstanceID). Peers of a server
+	// deployed behind an anycast address use it to tell when their messages
+	// start reaching a different instance. At most MaxInstanceIDSize bytes.
+	// Optional.
+	InstanceID []byte
+
+	// ForwardedFor is set on a HelloServer which a server has forwarded to its
+	// upstream server, and is the address of the peer which originally sent
+	// it, which the upstream introduces in place of the forwarding server's.
+	// See Server's Upstream. Optional.
+	ForwardedFor net.Addr
+
+	// MingleCapacity is an optional hint on a ReadyToMingle message describing
+	// how many introductions its sender is willing to perform.
+	MingleCapacity MingleCapacity
+
+	// Sealed is an opaque blob which a server will copy from a HelloServer
+	// into the Meet messages it sends for it. It is used by peers in privacy
+	// mode (see PeerOpts' PrivacyKey) to pass information to each other which
+	// the server can't read. Optional.
+	Sealed []byte
+
+	// Rendezvous is an opaque key which may be included in HelloServer,
+	// ReadyToMingle and Seek messages, in which case the server will only
+	// introduce the sender to peers whose ReadyToMingle messages have the same
+	// key. On an Occupancy message it is the key being queried. See PeerOpts'
+	// Rendezvous. Optional.
+	Rendezvous []byte
+
+	// Timestamp is the time at which the message was sent, which receivers
+	// may use to discard messages which are too old, see PeerOpts'
+	// MaxMessageAge. It is encoded with millisecond precision. Optional.
+	Timestamp time.Time
+
+	// Padding is the number of meaningless bytes which are included in the
+	// marshaled message, so that it can be made to have the same size as any
+	// other. Optional.
+	Padding int
+
+	// Signature is set on Meet messages by a server which has a SigningKey,
+	// so that peers which know the server's public key can tell that the
+	// messages weren't forged. See Sign and VerifySignature. Optional.
+	Signature []byte
 }
 
-// MarshalBinary implements the encoding.BinaryMarshaler interface.
-func (m Message) MarshalBinary() ([]byte, error) {
-	b := make([]byte, 0, MaxMessageSize)
-	b = append(b, 0) // version
-	b = append(b, m.Fingerprint[:FingerprintSize]...)
-	b = append(b, byte(m.Type))
+// MingleCapacity describes the maximum number of Meet messages which a peer
+// wishes to receive per Interval. The zero value indicates no limit.
+type MingleCapacity struct {
+	Meets    int
+	Interval time.Duration
+}
+
+// MessageField describes a single field within a marshaled Message. See
+// MarshalLayout.
+type MessageField struct {
+	Name         string
+	Offset, Size int
+}
+
+// msgWriter is used to write sequential fields of a message being marshaled,
+// appending them to b starting at start. If fields is non-nil then each field
+// written will be recorded in it.
+//
+// Field names are only constructed when fields is non-nil, so that marshaling
+// doesn't otherwise allocate.
+type msgWriter struct {
+	b      []byte
+	start  int
+	fields *[]MessageField
+}
+
+func (w *msgWriter) write(name string, b ...byte) {
+	if w.fields != nil {
+		*w.fields = append(*w.fields, MessageField{
+			Name:   name,
+			Offset: len(w.b) - w.start,
+			Size:   len(b),
+		})
+	}
+	w.b = append(w.b, b...)
+}
+
+// name returns the concatenation of the given strings if fields are being
+// recorded, or the empty string otherwise.
+func (w *msgWriter) name(prefix, suffix string) string {
+	if w.fields == nil {
+		return ""
+	}
+	return prefix + suffix
+}
+
+func (w *msgWriter) writeUint16(name string, i uint16) {
+	w.write(name, byte(i>>8), byte(i))
+}
 
-	marshalAddr := func(addr net.Addr) error {
-		if addr.Network() != "udp" {
-			return fmt.Errorf("invalid address network: %q", addr.Network())
+// writeLen writes a zeroed length field of the given size (1 or 2 bytes), and
+// returns the offset just after it. endLen must be called with that offset
+// once the bytes being measured have been written.
+func (w *msgWriter) writeLen(name string, size int) int {
+	if size == 1 {
+		w.write(name, 0)
+	} else {
+		w.write(name, 0, 0)
+	}
+	return len(w.b)
+}
+
+func (w *msgWriter) endLen(off, size int) {
+	l := len(w.b) - off
+	if size == 1 {
+		w.b[off-1] = byte(l)
+	} else {
+		binary.BigEndian.PutUint16(w.b[off-2:off], uint16(l))
+	}
+}
+
+func (w *msgWriter) writeAddr(name string, addr net.Addr) error {
+	if addr.Network() != "udp" {
+		return fmt.Errorf("invalid address network: %q", addr.Network())
+	}
+
+	var ip []byte
+	var port uint16
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		// avoid the allocations of going through the string form
+		if ip = udpAddr.IP.To4(); ip == nil {
+			ip = udpAddr.IP.To16()
 		}
-		b = append(b, 0) // proto:udp
-		ip, port, err := splitHostPort(addr.String())
-		if err != nil {
+		port = uint16(udpAddr.Port)
+	}
+	if ip == nil {
+		var err error
+		if ip, port, err = splitHostPort(addr.String()); err != nil {
 			return err
 		}
-		binary.BigEndian.PutUint16(b[len(b):len(b)+2], port)
-		b = b[:len(b)+2]
-		b = append(b, ip...)
-		return nil
 	}
 
-	var err error
-	if m.Type == HelloPeer {
-		err = marshalAddr(m.HelloPeerBody.Addr)
-	} else if m.Type == Meet {
-		b = append(b, m.MeetBody.Fingerprint[:FingerprintSize]...)
-		err = marshalAddr(m.MeetBody.Addr)
+	w.write(w.name(name, ".proto"), 0) // proto:udp
+	w.writeUint16(w.name(name, ".port"), port)
+	w.write(w.name(name, ".ip"), ip...)
+	return nil
+}
+
+// writeCandidates writes each of the given addresses prefixed by its length.
+func (w *msgWriter) writeCandidates(name string, addrs []net.Addr) error {
+	for i, addr := range addrs {
+		var addrName string
+		if w.fields != nil {
+			addrName = fmt.Sprintf("%s[%d]", name, i)
+		}
+		addrOff := w.writeLen(w.name(addrName, ".len"), 1)
+		if err := w.writeAddr(addrName, addr); err != nil {
+			return err
+		}
+		w.endLen(addrOff, 1)
 	}
+	return nil
+}
 
-	return b, err
+// writeExt writes the header of an extension field, and returns the offset
+// which must be passed to endLen (with a size of 2) once the extension's value
+// has been written.
+func (w *msgWriter) writeExt(name string, typ extType) int {
+	w.write(w.name(name, ".extType"), byte(typ))
+	return w.writeLen(w.name(name, ".extLen"), 2)
 }
 
-// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
-func (m *Message) UnmarshalBinary(b []byte) error {
-	if len(b) > MaxMessageSize {
-		return errors.New("malformed message: too big")
+// parseAddr parses an addr field which takes up the entirety of the given
+// bytes. If noCopy is set the returned address's IP will refer to the given
+// bytes.
+func parseAddr(b []byte, noCopy bool) (net.Addr, error) {
+	if len(b) < 1 || b[0] != 0 {
+		return nil, errors.New("invalid proto")
+	} else if len(b) < 3 {
+		return nil, errors.New("too short")
 	}
 
-	var err error
-	read := func(n int) []byte {
-		if err != nil {
-			return nil
-		} else if len(b) < n {
-			err = errors.New("malformed message: too short")
+	port := binary.BigEndian.Uint16(b[1:3])
+	ip := b[3:]
+	if len(ip) != 4 && len(ip) != 16 {
+		return nil, errors.New("invalid ip")
+	}
+
+	if noCopy {
+		return &net.UDPAddr{IP: net.IP(ip), Port: int(port)}, nil
+	}
+
+	addrStr := net.JoinHostPort(net.IP(ip).String(), strconv.Itoa(int(port)))
+	return net.ResolveUDPAddr("udp", addrStr)
+}
+
+func (m Message) marshalBody(w *msgWriter) error {
+	switch m.Type {
+	case HelloPeer:
+		return w.writeAddr("addr", m.HelloPeerBody.Addr)
+	case Meet:
+		w.write("meetFingerprint", m.MeetBody.Fingerprint[:FingerprintSize]...)
+		return w.writeAddr("addr", m.MeetBody.Addr)
+	case Busy:
+		retryAfter := uint32(m.BusyBody.RetryAfter / time.Millisecond)
+		w.write("retryAfter",
+			byte(retryAfter>>24), byte(retryAfter>>16),
+			byte(retryAfter>>8), byte(retryAfter))
+	case Seek:
+		w.write("seekFingerprint", m.SeekBody.Fingerprint[:FingerprintSize]...)
+	case Occupancy:
+		minglers := m.OccupancyBody.Minglers
+		w.write("minglers",
+			byte(minglers>>24), byte(minglers>>16),
+			byte(minglers>>8), byte(minglers))
+	case Probe:
+		if m.ProbeBody.Addr != nil {
+			return w.writeAddr("addr", m.ProbeBody.Addr)
+		}
+	case Handshake:
+		var flags byte
+		if m.HandshakeBody.Ack {
+			flags |= 1
 		}
+		w.write("handshakeFlags", flags)
+		w.write("payload", m.HandshakeBody.Payload...)
+	case YouAre:
+		return w.writeAddr("addr", m.YouAreBody.Addr)
+	}
+	return nil
+}
+
+func (m Message) hasExts() bool {
+	return len(m.Candidates) > 0 ||
+		len(m.LANCandidates) > 0 ||
+		len(m.InstanceID) > 0 ||
+		m.ForwardedFor != nil ||
+		m.MingleCapacity != (MingleCapacity{}) ||
+		len(m.Sealed) > 0 ||
+		len(m.Rendezvous) > 0 ||
+		!m.Timestamp.IsZero() ||
+		m.Padding > 0 ||
+		len(m.Signature) > 0
+}
 
-		out := b[:n]
-		b = b[n:]
-		return out
+func (m Message) marshalExts(w *msgWriter) error {
+	if len(m.Candidates) > 0 {
+		extOff := w.writeExt("candidates", extCandidates)
+		if err := w.writeCandidates("candidates", m.Candidates); err != nil {
+			return err
+		}
+		w.endLen(extOff, 2)
 	}
 
-	version := read(1)
-	m.Fingerprint = read(FingerprintSize)
-	typ := read(1)
-	if err != nil {
+	if len(m.LANCandidates) > 0 {
+		extOff := w.writeExt("lanCandidates", extLANCandidates)
+		if err := w.writeCandidates("lanCandidates", m.LANCandidates); err != nil {
+			return err
+		}
+		w.endLen(extOff, 2)
+	}
+
+	if len(m.InstanceID) > 0 {
+		if len(m.InstanceID) > MaxInstanceIDSize {
+			return fmt.Errorf("invalid InstanceID: longer than %d bytes", MaxInstanceIDSize)
+		}
+		extOff := w.writeExt("instanceID", extInstanceID)
+		w.write("instanceID.value", m.InstanceID...)
+		w.endLen(extOff, 2)
+	}
+
+	if m.ForwardedFor != nil {
+		extOff := w.writeExt("forwardedFor", extForwardedFor)
+		if err := w.writeAddr("forwardedFor.addr", m.ForwardedFor); err != nil {
+			return err
+		}
+		w.endLen(extOff, 2)
+	}
+
+	if len(m.Sealed) > 0 {
+		extOff := w.writeExt("sealed", extSealed)
+		w.write("sealed.value", m.Sealed...)
+		w.endLen(extOff, 2)
+	}
+
+	if m.MingleCapacity != (MingleCapacity{}) {
+		if m.MingleCapacity.Meets < 0 || m.MingleCapacity.Meets > math.MaxUint16 {
+			return fmt.Errorf("invalid MingleCapacity.Meets: %d", m.MingleCapacity.Meets)
+		}
+		extOff := w.writeExt("mingleCapacity", extMingleCapacity)
+		w.writeUint16("mingleCapacity.meets", uint16(m.MingleCapacity.Meets))
+		interval := uint32(m.MingleCapacity.Interval / time.Millisecond)
+		w.write("mingleCapacity.interval",
+			byte(interval>>24), byte(interval>>16),
+			byte(interval>>8), byte(interval))
+		w.endLen(extOff, 2)
+	}
+
+	if len(m.Rendezvous) > 0 {
+		extOff := w.writeExt("rendezvous", extRendezvous)
+		w.write("rendezvous.value", m.Rendezvous...)
+		w.endLen(extOff, 2)
+	}
+
+	if !m.Timestamp.IsZero() {
+		extOff := w.writeExt("timestamp", extTimestamp)
+		w.write("timestamp.value", binary.BigEndian.AppendUint64(nil, uint64(m.Timestamp.UnixMilli()))...)
+		w.endLen(extOff, 2)
+	}
+
+	if m.Padding > 0 {
+		if m.Padding > MaxMessageSize {
+			return fmt.Errorf("invalid Padding: %d", m.Padding)
+		}
+		extOff := w.writeExt("padding", extPadding)
+		w.write("padding.value", paddingBytes[:m.Padding]...)
+		w.endLen(extOff, 2)
+	}
+
+	// the signature must come last, as it covers all fields before it.
+	if len(m.Signature) > 0 {
+		extOff := w.writeExt("signature", extSignature)
+		w.write("signature.value", m.Signature...)
+		w.endLen(extOff, 2)
+	}
+	return nil
+}
+
+func (m Message) marshal(w *msgWriter) error {
+	version := byte(version0)
+	if m.hasExts() {
+		version = version1
+	}
+
+	w.write("msgVersion", version)
+	w.write("fingerprint", m.Fingerprint[:FingerprintSize]...)
+	w.write("msgType", byte(m.Type))
+
+	bodyOff := -1
+	if version == version1 {
+		bodyOff = w.writeLen("bodyLen", 2)
+	}
+	if err := m.marshalBody(w); err != nil {
 		return err
-	} else if version[0] != 0 {
+	} else if bodyOff >= 0 {
+		w.endLen(bodyOff, 2)
+	}
+
+	if err := m.marshalExts(w); err != nil {
+		return err
+	} else if len(w.b)-w.start > MaxMessageSize {
+		return errors.New("marshaled message is larger than MaxMessageSize")
+	}
+	return nil
+}
+
+// fresh returns whether the Message should be accepted by a receiver which
+// only accepts messages sent within maxAge of now. If maxAge is 0 all
+// messages are accepted, otherwise the Message must have a Timestamp within
+// maxAge of now, in either direction.
+func (m Message) fresh(maxAge time.Duration, now time.Time) bool {
+	if maxAge <= 0 {
+		return true
+	} else if m.Timestamp.IsZero() {
+		return false
+	}
+	age := now.Sub(m.Timestamp)
+	return age <= maxAge && age >= -maxAge
+}
+
+// paddingBytes is the source of the Padding written into marshaled messages.
+var paddingBytes [MaxMessageSize]byte
+
+// padTo sets the Message's Padding so that its marshaled form is size bytes
+// long, or leaves it without Padding if it's too large for that. Signed
+// messages are left as they are, since changing their Padding would
+// invalidate the signature, and so must be padded prior to signing.
+func (m *Message) padTo(size int) {
+	if len(m.Signature) > 0 {
+		return
+	}
+
+	// marshaling with a single byte of padding accounts for the version1 and
+	// extension overhead, after which the padding grows byte-for-byte. Any
+	// error is left for the actual marshaling to return.
+	bp := msgBufPool.Get().(*[]byte)
+	defer msgBufPool.Put(bp)
+	m.Padding = 1
+	if b, err := m.AppendBinary((*bp)[:0]); err != nil || len(b) > size {
+		m.Padding = 0
+	} else {
+		m.Padding += size - len(b)
+	}
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface.
+func (m Message) MarshalBinary() ([]byte, error) {
+	w := &msgWriter{b: make([]byte, 0, MaxMessageSize)}
+	if err := m.marshal(w); err != nil {
+		return nil, err
+	}
+	return w.b, nil
+}
+
+// AppendBinary implements the encoding.BinaryAppender interface. It appends the
+// marshaled form of the Message to b and returns the extended slice. If b has
+// enough capacity (MaxMessageSize is always enough) this does not allocate.
+func (m Message) AppendBinary(b []byte) ([]byte, error) {
+	w := &msgWriter{b: b, start: len(b)}
+	if err := m.marshal(w); err != nil {
+		return b, err
+	}
+	return w.b, nil
+}
+
+// MarshalLayout works like MarshalBinary, but also returns a description of
+// every field in the marshaled bytes, in the order they were written. It is
+// intended for generating protocol documentation and test vectors.
+func (m Message) MarshalLayout() ([]byte, []MessageField, error) {
+	w := &msgWriter{fields: new([]MessageField)}
+	if err := m.marshal(w); err != nil {
+		return nil, nil, err
+	}
+	return w.b, *w.fields, nil
+}
+
+// msgReader is used to read sequential fields off of a marshaled message. Once
+// a read fails all further reads will return nil, and err will be set.
+type msgReader struct {
+	b   []byte
+	err error
+}
+
+func (r *msgReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	} else if len(r.b) < n {
+		r.err = errors.New("malformed message: too short")
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *msgReader) readUint16() int {
+	b := r.read(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface. The
+// Message doesn't refer to the given bytes once UnmarshalBinary returns, so
+// they may be modified or re-used freely.
+func (m *Message) UnmarshalBinary(b []byte) error {
+	return m.unmarshal(b, false)
+}
+
+// UnmarshalBinaryNoCopy works like UnmarshalBinary, but avoids allocations by
+// having every byte slice field of the Message (fingerprints, Sealed,
+// Rendezvous, Signature, handshake payloads) and the IPs of its addresses refer
+// directly to the given bytes. The bytes must therefore not be modified or
+// re-used while the Message is in use, and any part of the Message which needs
+// to outlive them must be copied.
+func (m *Message) UnmarshalBinaryNoCopy(b []byte) error {
+	return m.unmarshal(b, true)
+}
+
+// own returns b if noCopy is set, or otherwise a copy of it, so that the
+// Message being unmarshaled doesn't refer to the caller's bytes.
+func own(b []byte, noCopy bool) []byte {
+	if noCopy {
+		return b
+	}
+	return bytes.Clone(b)
+}
+
+func (m *Message) unmarshal(b []byte, noCopy bool) error {
+	if len(b) > MaxMessageSize {
+		return errors.New("malformed message: too big")
+	}
+
+	m.Candidates = nil
+	m.LANCandidates = nil
+	m.MingleCapacity = MingleCapacity{}
+	m.Sealed = nil
+	m.Rendezvous = nil
+	m.Timestamp = time.Time{}
+	m.InstanceID = nil
+	m.ForwardedFor = nil
+	m.Padding = 0
+	m.Signature = nil
+
+	r := &msgReader{b: b}
+	version := r.read(1)
+	m.Fingerprint = own(r.read(FingerprintSize), noCopy)
+	typ := r.read(1)
+	if r.err != nil {
+		return r.err
+	} else if version[0] > maxVersion {
 		return errors.New("malformed message: invalid version")
+	} else if version[0] == version0 && len(b) > MaxVersion0MessageSize {
+		return errors.New("malformed message: too big")
 	}
 
 	m.Type = MessageType(typ[0])
@@ -160,36 +740,144 @@ func (m *Message) UnmarshalBinary(b []byte) error {
 		return errors.New("malformed message: invalid type")
 	}
 
-	// will do nothing if err is non-nil
-	unmarshalAddr := func() (addr net.Addr) {
-		if proto := read(1); err != nil {
-			return
-		} else if proto[0] != 0 {
-			err = fmt.Errorf("malformed message: %s: invalid proto", m.Type.String())
-			return
-		}
-		portB := read(2)
-		ip := b
-		if err != nil {
-			return
-		} else if len(ip) != 4 && len(ip) != 16 {
-			err = fmt.Errorf("malformed message: %s: invalid ip", m.Type.String())
-			return
-		}
-
-		port := binary.BigEndian.Uint16(portB)
-		addrStr := net.JoinHostPort(net.IP(ip).String(), strconv.Itoa(int(port)))
-		addr, err = net.ResolveUDPAddr("udp", addrStr)
-		return
+	// in version1 the body is prefixed with its length and is followed by
+	// extensions, in version0 the body is the remainder of the message.
+	body := r.b
+	if version[0] == version1 {
+		body = r.read(r.readUint16())
+	} else {
+		r.b = nil
+	}
+	if r.err != nil {
+		return r.err
 	}
 
-	if m.Type == HelloPeer {
-		m.HelloPeerBody.Addr = unmarshalAddr()
+	if err := m.unmarshalBody(body, noCopy); err != nil {
+		return fmt.Errorf("malformed message: %s: %s", m.Type.String(), err)
+	}
 
-	} else if m.Type == Meet {
-		m.MeetBody.Fingerprint = read(FingerprintSize)
-		m.MeetBody.Addr = unmarshalAddr()
+	for len(r.b) > 0 {
+		typ := r.read(1)
+		val := r.read(r.readUint16())
+		if r.err != nil {
+			return r.err
+		} else if err := m.unmarshalExt(extType(typ[0]), val, noCopy); err != nil {
+			return fmt.Errorf("malformed message: %s: %s", m.Type.String(), err)
+		}
 	}
 
+	return nil
+}
+
+func (m *Message) unmarshalBody(body []byte, noCopy bool) error {
+	var err error
+	switch m.Type {
+	case HelloPeer:
+		m.HelloPeerBody.Addr, err = parseAddr(body, noCopy)
+	case Meet:
+		if len(body) < FingerprintSize {
+			return errors.New("too short")
+		}
+		m.MeetBody.Fingerprint = own(body[:FingerprintSize], noCopy)
+		m.MeetBody.Addr, err = parseAddr(body[FingerprintSize:], noCopy)
+	case Busy:
+		if len(body) < 4 {
+			return errors.New("too short")
+		}
+		m.BusyBody.RetryAfter = time.Duration(binary.BigEndian.Uint32(body)) * time.Millisecond
+	case Seek:
+		if len(body) < FingerprintSize {
+			return errors.New("too short")
+		}
+		m.SeekBody.Fingerprint = own(body[:FingerprintSize], noCopy)
+	case Occupancy:
+		if len(body) < 4 {
+			return errors.New("too short")
+		}
+		m.OccupancyBody.Minglers = binary.BigEndian.Uint32(body)
+	case Probe:
+		if len(body) > 0 {
+			m.ProbeBody.Addr, err = parseAddr(body, noCopy)
+		}
+	case Handshake:
+		if len(body) < 1 {
+			return errors.New("too short")
+		}
+		m.HandshakeBody.Ack = body[0]&1 == 1
+		m.HandshakeBody.Payload = nil
+		if len(body) > 1 {
+			m.HandshakeBody.Payload = own(body[1:], noCopy)
+		}
+	case YouAre:
+		m.YouAreBody.Addr, err = parseAddr(body, noCopy)
+	}
 	return err
 }
+
+// parseCandidates parses a sequence of length-prefixed addresses which takes
+// up the entirety of the given bytes.
+func parseCandidates(b []byte, noCopy bool) ([]net.Addr, error) {
+	var addrs []net.Addr
+	r := &msgReader{b: b}
+	for len(r.b) > 0 {
+		addrLen := r.read(1)
+		if r.err != nil {
+			return nil, r.err
+		}
+		addrB := r.read(int(addrLen[0]))
+		if r.err != nil {
+			return nil, r.err
+		}
+		addr, err := parseAddr(addrB, noCopy)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// unmarshalExt unmarshals a single extension field into the Message. Unknown
+// extension types are ignored, so that new ones may be added without breaking
+// older implementations.
+func (m *Message) unmarshalExt(typ extType, val []byte, noCopy bool) error {
+	switch typ {
+	case extCandidates:
+		var err error
+		if m.Candidates, err = parseCandidates(val, noCopy); err != nil {
+			return err
+		}
+	case extLANCandidates:
+		var err error
+		if m.LANCandidates, err = parseCandidates(val, noCopy); err != nil {
+			return err
+		}
+	case extInstanceID:
+		m.InstanceID = own(val, noCopy)
+	case extForwardedFor:
+		var err error
+		if m.ForwardedFor, err = parseAddr(val, noCopy); err != nil {
+			return err
+		}
+	case extSealed:
+		m.Sealed = own(val, noCopy)
+	case extRendezvous:
+		m.Rendezvous = own(val, noCopy)
+	case extTimestamp:
+		if len(val) < 8 {
+			return errors.New("timestamp too short")
+		}
+		m.Timestamp = time.UnixMilli(int64(binary.BigEndian.Uint64(val)))
+	case extPadding:
+		m.Padding = len(val)
+	case extSignature:
+		m.Signature = own(val, noCopy)
+	case extMingleCapacity:
+		if len(val) < 6 {
+			return errors.New("mingleCapacity too short")
+		}
+		m.MingleCapacity.Meets = int(binary.BigEndian.Uint16(val))
+		m.MingleCapacity.Interval = time.Duration(binary.BigEndian.Uint32(val[2:])) * time.Millisecond
+	}
+	return nil
+}
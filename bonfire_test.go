@@ -2,11 +2,14 @@ package bonfire
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"net"
 	"reflect"
 	. "testing"
+	"time"
 
 	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
 )
 
 func addrString(str string) net.Addr {
@@ -76,6 +79,60 @@ func TestMessage(t *T) {
 			Message{Type: ReadyToMingle},
 			[]byte{0x3},
 		},
+		{
+			Message{
+				Type:     Busy,
+				BusyBody: BusyBody{RetryAfter: 1500 * time.Millisecond},
+			},
+			[]byte{0x4, 0x0, 0x0, 0x5, 0xdc},
+		},
+		{
+			Message{Type: Greet},
+			[]byte{0x5},
+		},
+		{
+			Message{
+				Type:     Seek,
+				SeekBody: SeekBody{Fingerprint: randFingerprint},
+			},
+			append([]byte{0x6}, randFingerprint...),
+		},
+		{
+			Message{
+				Type:          Occupancy,
+				OccupancyBody: OccupancyBody{Minglers: 258},
+			},
+			[]byte{0x7, 0x0, 0x0, 0x1, 0x2},
+		},
+		{
+			Message{Type: Probe},
+			[]byte{0x8},
+		},
+		{
+			Message{
+				Type:      Probe,
+				ProbeBody: ProbeBody{Addr: addrString("127.0.0.1:6666")},
+			},
+			[]byte{0x8, 0x0, 0x1a, 0xa, 0x7f, 0x0, 0x0, 0x1},
+		},
+		{
+			Message{Type: Handshake, HandshakeBody: HandshakeBody{Ack: true}},
+			[]byte{0x9, 0x1},
+		},
+		{
+			Message{
+				Type:          Handshake,
+				HandshakeBody: HandshakeBody{Payload: []byte("foo")},
+			},
+			[]byte{0x9, 0x0, 'f', 'o', 'o'},
+		},
+		{
+			Message{
+				Type:       YouAre,
+				YouAreBody: YouAreBody{Addr: addrString("127.0.0.1:6666")},
+			},
+			[]byte{0xa, 0x0, 0x1a, 0xa, 0x7f, 0x0, 0x0, 0x1},
+		},
 	}
 
 	for _, test := range tests {
@@ -105,3 +162,494 @@ func TestMessage(t *T) {
 		}
 	}
 }
+
+func TestMessageExtensions(t *T) {
+	msg := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        Meet,
+		MeetBody: MeetBody{
+			Fingerprint: mrand.Bytes(FingerprintSize),
+			Addr:        addrString("127.0.0.1:6666"),
+		},
+		Candidates: []net.Addr{
+			addrString("10.0.0.1:6666"),
+			addrString("[::1]:6667"),
+		},
+	}
+
+	b, err := msg.MarshalBinary()
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(byte(version1), b[0]),
+	)
+
+	var msg2 Message
+	massert.Require(t,
+		massert.Nil(msg2.UnmarshalBinary(b)),
+		massert.Equal(msg, msg2),
+	)
+
+	// unknown extensions should be ignored
+	b = append(b, 0xff, 0, 3, 'f', 'o', 'o')
+	var msg3 Message
+	massert.Require(t,
+		massert.Nil(msg3.UnmarshalBinary(b)),
+		massert.Equal(msg, msg3),
+	)
+
+	// truncated extensions should not be
+	var msg4 Message
+	massert.Require(t,
+		massert.Not(massert.Nil(msg4.UnmarshalBinary(b[:len(b)-1]))),
+	)
+
+	// a ReadyToMingle with a capacity hint
+	msg = Message{
+		Fingerprint:    mrand.Bytes(FingerprintSize),
+		Type:           ReadyToMingle,
+		MingleCapacity: MingleCapacity{Meets: 5, Interval: time.Minute},
+	}
+	b, err = msg.MarshalBinary()
+	var msg5 Message
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Nil(msg5.UnmarshalBinary(b)),
+		massert.Equal(msg, msg5),
+	)
+
+	// a Meet with LAN candidates
+	msg = Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        Meet,
+		MeetBody: MeetBody{
+			Fingerprint: mrand.Bytes(FingerprintSize),
+			Addr:        addrString("1.2.3.4:6666"),
+		},
+		Candidates:    []net.Addr{addrString("5.6.7.8:6666")},
+		LANCandidates: []net.Addr{addrString("192.168.1.2:6666")},
+	}
+	b, err = msg.MarshalBinary()
+	var msgLAN Message
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Nil(msgLAN.UnmarshalBinary(b)),
+		massert.Equal(msg, msgLAN),
+	)
+
+	// a HelloPeer from a server with an instance ID
+	msg = Message{
+		Fingerprint:   mrand.Bytes(FingerprintSize),
+		Type:          HelloPeer,
+		HelloPeerBody: HelloPeerBody{Addr: addrString("1.2.3.4:6666")},
+		InstanceID:    []byte("eu-west-1a"),
+	}
+	b, err = msg.MarshalBinary()
+	var msgInstance Message
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Nil(msgInstance.UnmarshalBinary(b)),
+		massert.Equal(msg, msgInstance),
+	)
+
+	// a HelloServer forwarded by a server to its upstream
+	msg = Message{
+		Fingerprint:  mrand.Bytes(FingerprintSize),
+		Type:         HelloServer,
+		ForwardedFor: addrString("1.2.3.4:6666"),
+	}
+	b, err = msg.MarshalBinary()
+	var msgForwarded Message
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Nil(msgForwarded.UnmarshalBinary(b)),
+		massert.Equal(msg, msgForwarded),
+	)
+
+	// a Meet with a sealed blob
+	msg = Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        Meet,
+		MeetBody: MeetBody{
+			Fingerprint: mrand.Bytes(FingerprintSize),
+			Addr:        addrString("127.0.0.1:6666"),
+		},
+		Sealed: mrand.Bytes(40),
+	}
+	b, err = msg.MarshalBinary()
+	var msg6 Message
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Nil(msg6.UnmarshalBinary(b)),
+		massert.Equal(msg, msg6),
+	)
+
+	// a HelloServer with a rendezvous key
+	msg = Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        HelloServer,
+		Rendezvous:  rendezvousKey("foo"),
+	}
+	b, err = msg.MarshalBinary()
+	var msg7 Message
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Nil(msg7.UnmarshalBinary(b)),
+		massert.Equal(msg, msg7),
+	)
+
+	// a HelloServer with a timestamp, which only has millisecond precision
+	msg = Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        HelloServer,
+		Timestamp:   time.UnixMilli(time.Now().UnixMilli()),
+	}
+	b, err = msg.MarshalBinary()
+	var msg8 Message
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Nil(msg8.UnmarshalBinary(b)),
+		massert.Equal(msg, msg8),
+	)
+}
+
+func TestMessageUnmarshalReused(t *T) {
+	// fields which are absent from a message aren't left over from the
+	// previous one of the same type unmarshaled into the same Message.
+	for _, msgs := range [][2]Message{
+		{
+			{Type: Handshake, HandshakeBody: HandshakeBody{Payload: []byte("foo")}},
+			{Type: Handshake, HandshakeBody: HandshakeBody{Ack: true}},
+		},
+		{
+			{
+				Type:          HelloPeer,
+				HelloPeerBody: HelloPeerBody{Addr: addrString("1.2.3.4:6666")},
+				InstanceID:    []byte("eu-west-1a"),
+			},
+			{
+				Type:          HelloPeer,
+				HelloPeerBody: HelloPeerBody{Addr: addrString("1.2.3.4:6666")},
+			},
+		},
+		{
+			{Type: HelloServer, ForwardedFor: addrString("1.2.3.4:6666")},
+			{Type: HelloServer},
+		},
+	} {
+		var reused Message
+		for _, msg := range msgs {
+			msg.Fingerprint = mrand.Bytes(FingerprintSize)
+			b, err := msg.MarshalBinary()
+			massert.Require(t,
+				massert.Nil(err),
+				massert.Nil(reused.UnmarshalBinary(b)),
+				massert.Equal(msg, reused),
+			)
+		}
+	}
+}
+
+func TestMessageUnmarshalOwnership(t *T) {
+	msgs := []Message{
+		{
+			Type: Meet,
+			MeetBody: MeetBody{
+				Fingerprint: mrand.Bytes(FingerprintSize),
+				Addr:        addrString("127.0.0.1:6666"),
+			},
+			Candidates: []net.Addr{addrString("[::1]:6667")},
+			Sealed:     mrand.Bytes(40),
+			Signature:  mrand.Bytes(ed25519.SignatureSize),
+		},
+		{
+			Type:       Seek,
+			SeekBody:   SeekBody{Fingerprint: mrand.Bytes(FingerprintSize)},
+			Rendezvous: rendezvousKey("foo"),
+		},
+		{
+			Type:          Handshake,
+			HandshakeBody: HandshakeBody{Ack: true, Payload: []byte("payload")},
+		},
+	}
+
+	// every byte slice of a Message unmarshaled with UnmarshalBinaryNoCopy,
+	// and nothing of one unmarshaled with UnmarshalBinary, should change along
+	// with the bytes it was unmarshaled from.
+	const fill = 0xaa
+	filled := func(b []byte) bool {
+		return len(b) > 0 && bytes.Count(b, []byte{fill}) == len(b)
+	}
+
+	for _, msg := range msgs {
+		msg.Fingerprint = mrand.Bytes(FingerprintSize)
+		b, err := msg.MarshalBinary()
+		massert.Require(t, massert.Nil(err))
+
+		var msg2, msg3 Message
+		b2 := append([]byte(nil), b...)
+		massert.Require(t,
+			massert.Nil(msg2.UnmarshalBinary(b)),
+			massert.Nil(msg3.UnmarshalBinaryNoCopy(b2)),
+		)
+		for i := range b {
+			b[i], b2[i] = fill, fill
+		}
+
+		massert.Require(t,
+			massert.Equal(msg, msg2),
+			massert.Equal(true, filled(msg3.Fingerprint)),
+		)
+
+		switch msg.Type {
+		case Meet:
+			massert.Require(t,
+				massert.Equal(true, filled(msg3.MeetBody.Fingerprint)),
+				massert.Equal(true, filled(msg3.MeetBody.Addr.(*net.UDPAddr).IP)),
+				massert.Equal(true, filled(msg3.Candidates[0].(*net.UDPAddr).IP)),
+				massert.Equal(true, filled(msg3.Sealed)),
+				massert.Equal(true, filled(msg3.Signature)),
+			)
+		case Seek:
+			massert.Require(t,
+				massert.Equal(true, filled(msg3.SeekBody.Fingerprint)),
+				massert.Equal(true, filled(msg3.Rendezvous)),
+			)
+		case Handshake:
+			massert.Require(t,
+				massert.Equal(true, filled(msg3.HandshakeBody.Payload)),
+			)
+		}
+	}
+}
+
+func TestMessageFresh(t *T) {
+	now := time.Now()
+	msg := Message{Timestamp: now.Add(-time.Minute)}
+	massert.Require(t,
+		massert.Equal(true, msg.fresh(0, now)),
+		massert.Equal(true, Message{}.fresh(0, now)),
+		massert.Equal(false, Message{}.fresh(time.Hour, now)),
+		massert.Equal(true, msg.fresh(time.Hour, now)),
+		massert.Equal(false, msg.fresh(time.Second, now)),
+		massert.Equal(false, msg.fresh(time.Second, now.Add(-2*time.Minute))),
+	)
+}
+
+func TestMessagePadding(t *T) {
+	msgs := []Message{
+		{Type: HelloServer},
+		{
+			Type:          HelloPeer,
+			HelloPeerBody: HelloPeerBody{Addr: addrString("[::1]:6666")},
+		},
+		{
+			Type: Meet,
+			MeetBody: MeetBody{
+				Fingerprint: mrand.Bytes(FingerprintSize),
+				Addr:        addrString("127.0.0.1:6666"),
+			},
+			Candidates: []net.Addr{addrString("10.0.0.1:6666")},
+		},
+	}
+
+	for _, msg := range msgs {
+		msg.Fingerprint = mrand.Bytes(FingerprintSize)
+		msg.padTo(MaxMessageSize)
+		b, err := msg.MarshalBinary()
+		var msg2 Message
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(MaxMessageSize, len(b)),
+			massert.Nil(msg2.UnmarshalBinary(b)),
+			massert.Equal(msg, msg2),
+		)
+	}
+
+	// a message which is already too large is left without padding
+	msg := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        HelloServer,
+		Sealed:      mrand.Bytes(MaxMessageSize - 72),
+	}
+	msg.padTo(MaxMessageSize)
+	massert.Require(t, massert.Equal(0, msg.Padding))
+
+	// a message which is padded prior to signing still verifies, and ends up
+	// at the full size.
+	pub, key, err := ed25519.GenerateKey(nil)
+	massert.Require(t, massert.Nil(err))
+	msg = msgs[2]
+	msg.Fingerprint = mrand.Bytes(FingerprintSize)
+	msg.padTo(MaxMessageSize - signatureExtSize)
+	massert.Require(t, massert.Nil(msg.Sign(key)))
+
+	// padding can't be changed once signed
+	padding := msg.Padding
+	msg.padTo(MaxMessageSize)
+	b, err := msg.MarshalBinary()
+	var msg2 Message
+	massert.Require(t,
+		massert.Equal(padding, msg.Padding),
+		massert.Nil(err),
+		massert.Equal(MaxMessageSize, len(b)),
+		massert.Nil(msg2.UnmarshalBinary(b)),
+		massert.Nil(msg2.VerifySignature(pub)),
+	)
+}
+
+func TestMarshalLayout(t *T) {
+	msg := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        Meet,
+		MeetBody: MeetBody{
+			Fingerprint: mrand.Bytes(FingerprintSize),
+			Addr:        addrString("127.0.0.1:6666"),
+		},
+		Candidates: []net.Addr{addrString("[::1]:6667")},
+	}
+
+	b, fields, err := msg.MarshalLayout()
+	massert.Require(t, massert.Nil(err))
+
+	expB, err := msg.MarshalBinary()
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(expB, b),
+	)
+
+	// the fields should cover every byte exactly once, in order
+	var off int
+	for _, field := range fields {
+		massert.Require(t, massert.Comment(
+			massert.Equal(off, field.Offset),
+			"field:%q", field.Name,
+		))
+		off += field.Size
+	}
+	massert.Require(t, massert.Equal(len(b), off))
+}
+
+func TestMessageVersion0Size(t *T) {
+	msg := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        Meet,
+		MeetBody: MeetBody{
+			Fingerprint: mrand.Bytes(FingerprintSize),
+			Addr:        addrString("[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"),
+		},
+	}
+	b, err := msg.MarshalBinary()
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(byte(version0), b[0]),
+		massert.Equal(true, len(b) <= MaxVersion0MessageSize),
+	)
+
+	b = append(b, make([]byte, MaxVersion0MessageSize-len(b)+1)...)
+	var msg2 Message
+	massert.Require(t, massert.Not(massert.Nil(msg2.UnmarshalBinary(b))))
+}
+
+func TestAppendBinary(t *T) {
+	msg := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        Meet,
+		MeetBody: MeetBody{
+			Fingerprint: mrand.Bytes(FingerprintSize),
+			Addr:        addrString("127.0.0.1:6666"),
+		},
+		Candidates: []net.Addr{addrString("[::1]:6667")},
+	}
+
+	expB, err := msg.MarshalBinary()
+	massert.Require(t, massert.Nil(err))
+
+	prefix := []byte("prefix")
+	b, err := msg.AppendBinary(append([]byte(nil), prefix...))
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(prefix, b[:len(prefix)]),
+		massert.Equal(expB, b[len(prefix):]),
+	)
+
+	var msg2 Message
+	massert.Require(t, massert.Nil(msg2.UnmarshalBinaryNoCopy(expB)))
+	massert.Require(t,
+		massert.Equal(msg.Fingerprint, msg2.Fingerprint),
+		massert.Equal(msg.MeetBody.Fingerprint, msg2.MeetBody.Fingerprint),
+		massert.Equal(msg.MeetBody.Addr.String(), msg2.MeetBody.Addr.String()),
+		massert.Length(msg2.Candidates, 1),
+		massert.Equal(msg.Candidates[0].String(), msg2.Candidates[0].String()),
+	)
+}
+
+func benchMessage() Message {
+	return Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        Meet,
+		MeetBody: MeetBody{
+			Fingerprint: mrand.Bytes(FingerprintSize),
+			Addr:        addrString("127.0.0.1:6666"),
+		},
+		Candidates: []net.Addr{
+			addrString("10.0.0.1:6666"),
+			addrString("[::1]:6667"),
+		},
+	}
+}
+
+func BenchmarkMarshalBinary(b *B) {
+	msg := benchMessage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := msg.MarshalBinary(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendBinary(b *B) {
+	msg := benchMessage()
+	buf := make([]byte, 0, MaxMessageSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := msg.AppendBinary(buf[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalBinary(b *B) {
+	msgB, err := benchMessage().MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var msg Message
+		if err := msg.UnmarshalBinary(msgB); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalBinaryNoCopy(b *B) {
+	msgB, err := benchMessage().MarshalBinary()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var msg Message
+		if err := msg.UnmarshalBinaryNoCopy(msgB); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMessageTypeString(t *T) {
+	massert.Require(t,
+		massert.Equal("HelloServer", HelloServer.String()),
+		massert.Equal("MessageType(200)", MessageType(200).String()),
+	)
+}
@@ -0,0 +1,121 @@
+package bonfire
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Errors which may be wrapped by the BootstrapError returned when a Peer fails
+// to bootstrap. Use errors.Is to check for them.
+var (
+	// ErrServerUnreachable means that nothing at all was received from the
+	// server, e.g. because its address is wrong, it's down, or a firewall is
+	// dropping the Peer's traffic.
+	ErrServerUnreachable = errors.New("no response received from server")
+
+	// ErrNoIntroductions means that the server responded, but no peer (nor
+	// the server itself) said hello to the Peer in time. This is usually
+	// because the server has no other peers to introduce, or because the
+	// Peer's NAT is blocking the peers it was introduced to.
+	ErrNoIntroductions = errors.New("server responded but no peers said hello")
+
+	// ErrGatewayUnavailable means that, having received no hello, the Peer
+	// couldn't fall back to forwarding a port on its NAT gateway, either
+	// because no gateway was discovered or because it refused the mapping.
+	ErrGatewayUnavailable = errors.New("NAT gateway unavailable")
+)
+
+// Names of the phases which may appear in a BootstrapReport.
+const (
+	BootstrapPhaseHello           = "hello"
+	BootstrapPhaseGateway         = "gateway"
+	BootstrapPhaseHelloViaGateway = "hello-via-gateway"
+)
+
+// BootstrapPhase describes a phase of a Peer's bootstrap sequence which was
+// attempted.
+type BootstrapPhase struct {
+	Name     string // one of the BootstrapPhase* constants
+	Start    time.Time
+	Duration time.Duration
+	Err      error // nil if the phase succeeded
+}
+
+// BootstrapReport describes how a Peer's bootstrap sequence went, for
+// diagnosing why it failed.
+type BootstrapReport struct {
+	// The phases which were attempted, in order.
+	Phases []BootstrapPhase
+
+	// Whether any message was received from the server.
+	ServerResponded bool
+}
+
+// phase runs the function as the named phase, recording it in the report.
+func (r *BootstrapReport) phase(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	r.Phases = append(r.Phases, BootstrapPhase{
+		Name:     name,
+		Start:    start,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+	return err
+}
+
+// BootstrapError is returned by NewPeer, and by BootstrapErr for Peers created
+// by NewPeerAsync, when a Peer fails to find any other peers. Err will wrap
+// ErrServerUnreachable, ErrNoIntroductions or ErrGatewayUnavailable where
+// one of those applies, and otherwise is the error which ended the bootstrap
+// (e.g. the Context's).
+type BootstrapError struct {
+	Err    error
+	Report BootstrapReport
+}
+
+func (e *BootstrapError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "bootstrapping: %v", e.Err)
+	for i, phase := range e.Report.Phases {
+		if i == 0 {
+			b.WriteString(" (")
+		} else {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s took %v", phase.Name, phase.Duration.Round(time.Millisecond))
+		if phase.Err != nil {
+			fmt.Fprintf(&b, ": %v", phase.Err)
+		}
+	}
+	if len(e.Report.Phases) > 0 {
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+func (e *BootstrapError) Unwrap() error {
+	return e.Err
+}
+
+// wrapBootstrapErr returns the error which the bootstrap sequence, having
+// failed with the given error, returns. Failures to hear from any peers are
+// classified according to whether the server was heard from at all.
+func (p *Peer) wrapBootstrapErr(err error, report BootstrapReport) error {
+	report.ServerResponded = p.serverResponded.Load()
+	classErr := ErrServerUnreachable
+	if report.ServerResponded {
+		classErr = ErrNoIntroductions
+	}
+
+	switch {
+	case err == errNoHelloPeer:
+		err = classErr
+	case err == context.DeadlineExceeded && p.serverAddrStr != "":
+		err = fmt.Errorf("%w: %w", classErr, err)
+	}
+	return &BootstrapError{Err: err, Report: report}
+}
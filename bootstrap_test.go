@@ -0,0 +1,75 @@
+package bonfire
+
+import (
+	"context"
+	"errors"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerBootstrapError(t *T) {
+	// a server which responds to every HelloServer with a YouAre, but never
+	// introduces the peer to anyone.
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer server.Close()
+	go func() {
+		b := make([]byte, MaxMessageSize)
+		for {
+			n, addr, err := server.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var hello Message
+			if err := hello.UnmarshalBinary(b[:n]); err != nil || hello.Type != HelloServer {
+				continue
+			}
+			youAre, _ := Message{
+				Fingerprint: hello.Fingerprint,
+				Type:        YouAre,
+				YouAreBody:  YouAreBody{Addr: addr},
+			}.MarshalBinary()
+			server.WriteTo(youAre, addr)
+		}
+	}()
+
+	_, err = NewPeer(context.Background(), "udp", server.LocalAddr().String(), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		HelloWaitTimeout:        200 * time.Millisecond,
+		ListenAddr:              "127.0.0.1:0",
+	})
+
+	var bsErr *BootstrapError
+	massert.Require(t,
+		massert.Equal(true, errors.As(err, &bsErr)),
+		massert.Equal(true, errors.Is(err, ErrNoIntroductions)),
+		massert.Equal(false, errors.Is(err, ErrServerUnreachable)),
+	)
+	massert.Require(t,
+		massert.Equal(true, bsErr.Report.ServerResponded),
+		massert.Equal(1, len(bsErr.Report.Phases)),
+	)
+	phase := bsErr.Report.Phases[0]
+	massert.Require(t,
+		massert.Equal(BootstrapPhaseHello, phase.Name),
+		massert.Not(massert.Nil(phase.Err)),
+		massert.Equal(true, phase.Duration >= 200*time.Millisecond),
+	)
+}
+
+func TestBootstrapErrorString(t *T) {
+	err := &BootstrapError{
+		Err: ErrServerUnreachable,
+		Report: BootstrapReport{Phases: []BootstrapPhase{
+			{Name: BootstrapPhaseHello, Duration: time.Second, Err: errNoHelloPeer},
+			{Name: BootstrapPhaseGateway, Duration: 1500 * time.Millisecond},
+		}},
+	}
+	massert.Require(t, massert.Equal(
+		"bootstrapping: no response received from server (hello took 1s: no messages from peers or server received, gateway took 1.5s)",
+		err.Error(),
+	))
+}
@@ -0,0 +1,84 @@
+package bonfire
+
+import (
+	"math"
+	mrand "math/rand"
+	"net"
+	"sort"
+)
+
+// BroadcastPolicy determines which of a Peer's peers are sent to by Broadcast.
+// The zero value selects all peers.
+type BroadcastPolicy struct {
+	// If set, only peers which have all of these tags (see TagPeer) are
+	// considered.
+	Tags []string
+
+	// If greater than 0, a random selection of this fraction of the peers
+	// being considered are sent to, rounded up, so that at least one is
+	// always chosen when any are available. Ignored if TopK is set.
+	Fraction float64
+
+	// If greater than 0, at most this many of the peers being considered are
+	// sent to. If Score is set it's those with the highest scores, otherwise
+	// they are chosen at random.
+	TopK int
+
+	// An optional function used along with TopK, which returns the score of
+	// the peer at the given address. It's called with the Peer's lock held,
+	// so must not call any methods on the Peer.
+	Score func(addr net.Addr) float64
+}
+
+// selectPeers returns the addresses of the peers selected by the
+// BroadcastPolicy.
+//
+// This must be called with the lock held.
+func (p *Peer) selectPeers(policy BroadcastPolicy) []net.Addr {
+	addrs := make([]net.Addr, 0, len(p.peers))
+	for addrStr, addr := range p.peers {
+		if p.hasTags(addrStr, policy.Tags) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	n := len(addrs)
+	if policy.TopK > 0 {
+		n = min(n, policy.TopK)
+	} else if policy.Fraction > 0 {
+		n = min(n, int(math.Ceil(policy.Fraction*float64(len(addrs)))))
+	}
+	if n == len(addrs) {
+		return addrs
+	}
+
+	if policy.TopK > 0 && policy.Score != nil {
+		scores := make(map[net.Addr]float64, len(addrs))
+		for _, addr := range addrs {
+			scores[addr] = policy.Score(addr)
+		}
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return scores[addrs[i]] > scores[addrs[j]]
+		})
+		return addrs[:n]
+	}
+
+	mrand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	return addrs[:n]
+}
+
+// Broadcast sends the packet to the peers selected by the BroadcastPolicy,
+// using Send, and returns the addresses which were selected. This allows the
+// fanout of application messages (e.g. gossip) to be controlled without the
+// application keeping track of peers itself.
+//
+// As with Send, failing to write to one peer doesn't prevent the others from
+// being written to; if any fail a SendError is returned describing which.
+func (p *Peer) Broadcast(b []byte, policy BroadcastPolicy) ([]net.Addr, error) {
+	p.l.RLock()
+	addrs := p.selectPeers(policy)
+	p.l.RUnlock()
+	return addrs, p.Send(b, addrs...)
+}
@@ -0,0 +1,76 @@
+package bonfire
+
+import (
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerSelectPeers(t *T) {
+	peer := &Peer{po: PeerOpts{MaxPeers: 10}}
+	peer.clearPeers()
+	var addrs []net.Addr
+	for _, addrStr := range []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3", "127.0.0.1:4"} {
+		addr := addrString(addrStr)
+		addrs = append(addrs, addr)
+		peer.addPeer(addr)
+	}
+	massert.Require(t, massert.Nil(peer.TagPeer(addrs[0], "relay")))
+	massert.Require(t, massert.Nil(peer.TagPeer(addrs[3], "relay")))
+
+	score := func(addr net.Addr) float64 {
+		return float64(addr.(*net.UDPAddr).Port)
+	}
+
+	massert.Require(t,
+		massert.Length(peer.selectPeers(BroadcastPolicy{}), 4),
+		massert.Subset(addrs, peer.selectPeers(BroadcastPolicy{})),
+		massert.Length(peer.selectPeers(BroadcastPolicy{Fraction: 0.5}), 2),
+		massert.Length(peer.selectPeers(BroadcastPolicy{Fraction: 0.1}), 1),
+		massert.Length(peer.selectPeers(BroadcastPolicy{TopK: 3}), 3),
+		massert.Length(peer.selectPeers(BroadcastPolicy{TopK: 5}), 4),
+		massert.Equal(
+			[]net.Addr{addrs[3], addrs[2]},
+			peer.selectPeers(BroadcastPolicy{TopK: 2, Score: score}),
+		),
+		massert.Length(peer.selectPeers(BroadcastPolicy{Tags: []string{"relay"}}), 2),
+		massert.Equal(
+			[]net.Addr{addrs[3]},
+			peer.selectPeers(BroadcastPolicy{Tags: []string{"relay"}, TopK: 1, Score: score}),
+		),
+		massert.Length(peer.selectPeers(BroadcastPolicy{Tags: []string{"storage"}}), 0),
+	)
+}
+
+func TestPeerBroadcast(t *T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	peer := &Peer{po: PeerOpts{MaxPeers: 10}, mconn: newMigratingConn(conn)}
+	defer conn.Close()
+	peer.clearPeers()
+
+	var dsts []net.PacketConn
+	for range 3 {
+		dst, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		defer dst.Close()
+		dsts = append(dsts, dst)
+		peer.addPeer(dst.LocalAddr())
+	}
+
+	sent, err := peer.Broadcast([]byte("hi"), BroadcastPolicy{TopK: 2})
+	massert.Require(t, massert.Nil(err), massert.Length(sent, 2))
+
+	var received int
+	b := make([]byte, 16)
+	for _, dst := range dsts {
+		dst.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if n, _, err := dst.ReadFrom(b); err == nil {
+			massert.Require(t, massert.Equal("hi", string(b[:n])))
+			received++
+		}
+	}
+	massert.Require(t, massert.Equal(2, received))
+}
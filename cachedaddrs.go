@@ -0,0 +1,80 @@
+package bonfire
+
+import (
+	"net"
+	"net/netip"
+)
+
+// CachedAddrs holds the addresses which a Peer has learned for itself, so that
+// an application can persist them and pass them back in when the Peer is
+// restarted, see PeerOpts' CachedAddrs.
+type CachedAddrs struct {
+	// The local port of the Peer's socket. The other addresses are only used
+	// by a restarted Peer whose socket has the same port, since a NAT maps
+	// each port separately.
+	LocalPort int
+
+	// The Peer's remote address ("ip:port"), see RemoteAddr, or empty if it
+	// wasn't known.
+	RemoteAddr string
+
+	// The external address ("ip:port") of the Peer's port mapping on its NAT
+	// gateway, or empty if it didn't create one.
+	GatewayAddr string
+}
+
+// parseCachedAddr parses an address from CachedAddrs, which is empty or an
+// "ip:port".
+func parseCachedAddr(addrStr string) (net.Addr, error) {
+	if addrStr == "" {
+		return nil, nil
+	}
+	addrPort, err := netip.ParseAddrPort(addrStr)
+	if err != nil {
+		return nil, err
+	}
+	return net.UDPAddrFromAddrPort(addrPort), nil
+}
+
+// CachedAddrs returns the addresses which the Peer has learned for itself, for
+// the application to persist and pass in as PeerOpts' CachedAddrs when it
+// restarts.
+func (p *Peer) CachedAddrs() CachedAddrs {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	cached := CachedAddrs{LocalPort: p.localPort()}
+	if p.remoteAddr != nil {
+		cached.RemoteAddr = p.remoteAddr.String()
+	}
+	if p.gwAddr != nil {
+		cached.GatewayAddr = p.gwAddr.String()
+	}
+	return cached
+}
+
+// useCachedAddrs applies PeerOpts' CachedAddrs, if they were cached for the
+// same local port as the Peer now has. The addresses have already been
+// validated.
+//
+// This must be called with the lock held, prior to bootstrapping.
+func (p *Peer) useCachedAddrs() {
+	cached := p.po.CachedAddrs
+	if cached.LocalPort == 0 || cached.LocalPort != p.localPort() {
+		return
+	}
+	p.remoteAddr, _ = parseCachedAddr(cached.RemoteAddr)
+	p.remoteAddrCached = p.remoteAddr != nil
+	p.gwAddr, _ = parseCachedAddr(cached.GatewayAddr)
+	p.gwAddrCached = p.gwAddr != nil
+}
+
+// dropCachedGatewayAddr forgets the cached gateway address once bootstrapping
+// has finished without a new port mapping being made, since then there's no
+// telling whether the gateway still has the old one.
+//
+// This must be called with the lock held.
+func (p *Peer) dropCachedGatewayAddr() {
+	if p.gwAddrCached {
+		p.gwAddr, p.gwAddrCached = nil, false
+	}
+}
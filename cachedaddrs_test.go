@@ -0,0 +1,84 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	"strconv"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerCachedAddrs(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a server which never responds, so that nothing is learned while
+	// bootstrapping.
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer server.Close()
+
+	freePort := func() int {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	newPeer := func(port int, cached CachedAddrs) *Peer {
+		peer, err := NewPeerAsync(ctx, "udp", server.LocalAddr().String(), &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			HelloWaitTimeout:        time.Minute,
+			AdvertiseCandidates:     true,
+			ListenAddr:              net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+			CachedAddrs:             cached,
+		})
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { peer.Close() })
+		return peer
+	}
+
+	port := freePort()
+	cached := CachedAddrs{
+		LocalPort:   port,
+		RemoteAddr:  "1.2.3.4:5",
+		GatewayAddr: "1.2.3.4:6",
+	}
+	peer := newPeer(port, cached)
+	peer.l.Lock()
+	var candidates []string
+	for _, addr := range peer.candidates() {
+		candidates = append(candidates, addr.String())
+	}
+	peer.l.Unlock()
+	massert.Require(t,
+		massert.Equal("1.2.3.4:5", peer.RemoteAddr().String()),
+		massert.Equal(cached, peer.CachedAddrs()),
+		massert.Subset(candidates, []string{"1.2.3.4:5", "1.2.3.4:6"}),
+	)
+
+	// the first report of the Peer's address replaces the cached one, even if
+	// it's from a local network.
+	peer.l.Lock()
+	err = peer.processMessage(server.LocalAddr(), Message{
+		Fingerprint:   peer.lastFingerprint,
+		Type:          HelloPeer,
+		HelloPeerBody: HelloPeerBody{Addr: peer.LocalAddr()},
+	})
+	peer.l.Unlock()
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(peer.LocalAddr().String(), peer.RemoteAddr().String()),
+	)
+
+	// addresses cached for a different port aren't used.
+	peer = newPeer(freePort(), cached)
+	massert.Require(t, massert.Nil(peer.RemoteAddr()))
+
+	_, err = NewPeerAsync(ctx, "udp", server.LocalAddr().String(), &PeerOpts{
+		CachedAddrs: CachedAddrs{RemoteAddr: "example.com:5"},
+	})
+	massert.Require(t, massert.Not(massert.Nil(err)))
+}
@@ -0,0 +1,119 @@
+package bonfire
+
+import (
+	"net"
+)
+
+// maxCandidates is the maximum number of candidates a Peer will advertise,
+// which keeps messages well within MaxMessageSize.
+const maxCandidates = 12
+
+// localIPNets returns the networks of all of the host's non-loopback interface
+// addresses. Link-local addresses are skipped, as they can't be used without
+// knowing the zone they're in.
+func localIPNets() []*net.IPNet {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	ipNets := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok ||
+			ipNet.IP.IsLoopback() ||
+			ipNet.IP.IsLinkLocalUnicast() ||
+			ipNet.IP.IsUnspecified() {
+			continue
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets
+}
+
+// onLocalNetwork returns true if the given address is within the network of
+// one of the host's interfaces.
+func onLocalNetwork(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range localIPNets() {
+		if ipNet.Contains(udpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates returns all addresses which this Peer might be reachable at. This
+// includes AdvertiseAddr (if set), the addresses of all non-loopback
+// interfaces, the external address of the gateway port mapping (if any), and
+// the Peer's remote address as observed by others (if known). If
+// AdvertiseCandidates isn't set only AdvertiseAddr is included, and nil is
+// returned if that isn't set either.
+//
+// This must be called with the lock held.
+func (p *Peer) candidates() []net.Addr {
+	if !p.po.AdvertiseCandidates {
+		if p.advertiseAddr == nil {
+			return nil
+		}
+		return []net.Addr{p.advertiseAddr}
+	}
+
+	var addrs []net.Addr
+	seen := map[string]bool{}
+	add := func(addr net.Addr) {
+		if addr == nil || seen[addr.String()] || len(addrs) >= maxCandidates {
+			return
+		}
+		seen[addr.String()] = true
+		addrs = append(addrs, addr)
+	}
+
+	add(p.advertiseAddr)
+
+	// if the socket is bound to a specific ip then that's the only local
+	// address it can be reached on.
+	localAddr, _ := p.PacketConn.LocalAddr().(*net.UDPAddr)
+	if localAddr != nil && !localAddr.IP.IsUnspecified() {
+		if !localAddr.IP.IsLoopback() {
+			add(localAddr)
+		}
+	} else {
+		port := p.localPort()
+		for _, ipNet := range localIPNets() {
+			add(&net.UDPAddr{IP: ipNet.IP, Port: port})
+		}
+	}
+
+	add(p.gwAddr)
+	add(p.remoteAddr)
+	return addrs
+}
+
+// knownViaCandidates is used when a HelloPeer has been received from the given
+// address, carrying the given candidates of its sender. If the sender is
+// already known at one of its other candidate addresses, this returns true,
+// unless the given address is a more direct path to the sender (i.e. it's on
+// a local network), in which case the old entry is removed so the new one can
+// replace it.
+//
+// This must be called with the lock held.
+func (p *Peer) knownViaCandidates(addr net.Addr, candidates []net.Addr) bool {
+	direct := onLocalNetwork(addr)
+	addrStr := addr.String()
+	for _, candidate := range candidates {
+		candidateStr := candidate.String()
+		if candidateStr == addrStr {
+			continue
+		} else if _, ok := p.peers[candidateStr]; !ok {
+			continue
+		} else if !direct {
+			return true
+		}
+		p.removePeer(candidateStr)
+	}
+	return false
+}
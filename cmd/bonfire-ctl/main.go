@@ -0,0 +1,59 @@
+// Command bonfire-ctl manages a running bonfire-server over its control socket
+// (see bonfire-server's --control-socket-path parameter). The command and its
+// arguments are given as arguments to bonfire-ctl, e.g.:
+//
+//	bonfire-ctl -socket /run/bonfire.sock ban 1.2.3.4
+//
+// Run "bonfire-ctl help" for the list of commands.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+func run(socketPath string, args []string) error {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := fmt.Fprintln(conn, strings.Join(args, " ")); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	if b, _ := r.Peek(4); string(b) == "ERR " {
+		line, _ := r.ReadString('\n')
+		return fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(line, "ERR ")))
+	}
+	_, err = io.Copy(os.Stdout, r)
+	return err
+}
+
+func main() {
+	socketPath := flag.String("socket", "/run/bonfire-server.sock", "Path to the control socket of the bonfire-server")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <command> [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*socketPath, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,130 @@
+// Command bonfire-keygen generates the keys used to secure a bonfire network,
+// along with snippets showing how to configure bonfire-server and peers with
+// them. The kind of key is given as an argument:
+//
+//	bonfire-keygen ed25519
+//	bonfire-keygen hmac
+//
+// An "ed25519" keypair is used by the server to sign its messages (see
+// bonfire-server's --signing-key parameter), and by peers to verify them (see
+// bonfire.PeerOpts' ServerPublicKey). An "hmac" key is shared by the server
+// and all peers, which prove knowledge of it in their fingerprints (see
+// bonfire-server's --fingerprint-key parameter and bonfire.PSKFingerprintFunc).
+//
+// Keys are written hex-encoded. The fingerprint of an existing key can be
+// printed, e.g. to check that two hosts have the same key without revealing
+// it, with:
+//
+//	bonfire-keygen fingerprint <hex key>
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mediocregopher/bonfire"
+)
+
+// keyFingerprint returns a short, printable identifier for a key, in the same
+// form as ssh-keygen uses. The fingerprint of an Ed25519 keypair is that of
+// its public key.
+func keyFingerprint(key []byte) string {
+	if len(key) == ed25519.PrivateKeySize {
+		key = ed25519.PrivateKey(key).Public().(ed25519.PublicKey)
+	}
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func genEd25519(w io.Writer) error {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	keyHex, pubHex := hex.EncodeToString(key), hex.EncodeToString(pub)
+
+	fmt.Fprintf(w, "# Ed25519 keypair. The private key must only be given to the server.\n")
+	fmt.Fprintf(w, "private-key: %s\n", keyHex)
+	fmt.Fprintf(w, "public-key:  %s\n", pubHex)
+	fmt.Fprintf(w, "fingerprint: %s\n\n", keyFingerprint(pub))
+
+	fmt.Fprintf(w, "# bonfire-server\n")
+	fmt.Fprintf(w, "--signing-key=%s\n\n", keyHex)
+
+	fmt.Fprintf(w, "# peers\n")
+	fmt.Fprintf(w, "pub, _ := hex.DecodeString(%q)\n", pubHex)
+	fmt.Fprintf(w, "opts := &bonfire.PeerOpts{ServerPublicKey: ed25519.PublicKey(pub)}\n")
+	return nil
+}
+
+func genHMAC(w io.Writer) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	keyHex := hex.EncodeToString(key)
+
+	// an example fingerprint is included, which can be used to check an
+	// implementation of the scheme in some other language.
+	fingerprint, err := bonfire.PSKFingerprintFunc(key)()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "# HMAC pre-shared key. It must be given to the server and all peers.\n")
+	fmt.Fprintf(w, "key:         %s\n", keyHex)
+	fmt.Fprintf(w, "fingerprint: %s\n", keyFingerprint(key))
+	fmt.Fprintf(w, "example peer fingerprint: %s\n\n", hex.EncodeToString(fingerprint))
+
+	fmt.Fprintf(w, "# bonfire-server\n")
+	fmt.Fprintf(w, "--fingerprint-key=%s\n\n", keyHex)
+
+	fmt.Fprintf(w, "# peers\n")
+	fmt.Fprintf(w, "key, _ := hex.DecodeString(%q)\n", keyHex)
+	fmt.Fprintf(w, "opts := &bonfire.PeerOpts{FingerprintFunc: bonfire.PSKFingerprintFunc(key)}\n")
+	return nil
+}
+
+func run(w io.Writer, args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "ed25519":
+		return genEd25519(w)
+	case len(args) == 1 && args[0] == "hmac":
+		return genHMAC(w)
+	case len(args) == 2 && args[0] == "fingerprint":
+		key, err := hex.DecodeString(args[1])
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, keyFingerprint(key))
+		return err
+	default:
+		return errors.New(`expected "ed25519", "hmac", or "fingerprint <hex key>"`)
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s ed25519|hmac|fingerprint <hex key>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(os.Stdout, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
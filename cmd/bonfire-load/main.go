@@ -0,0 +1,198 @@
+// Command bonfire-load simulates many bonfire peers talking to a single
+// server, and reports on how quickly and reliably the server responds. It is
+// intended for capacity planning, and should only be pointed at servers which
+// you operate.
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bonfire"
+)
+
+type simPeer struct {
+	conn        net.PacketConn
+	fingerprint []byte // used for ReadyToMingle
+}
+
+type stats struct {
+	sync.Mutex
+	pending   map[string]time.Time // HelloServer fingerprint -> time sent
+	latencies []time.Duration
+	sent      int
+	busy      int
+	meets     int
+}
+
+// answered records a response which pertains to the HelloServer with the given
+// fingerprint. Only the first response for each HelloServer is counted.
+func (s *stats) answered(fingerprint []byte, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	key := string(fingerprint)
+	if sentAt, ok := s.pending[key]; ok {
+		s.latencies = append(s.latencies, now.Sub(sentAt))
+		delete(s.pending, key)
+	}
+}
+
+func percentile(dd []time.Duration, p float64) time.Duration {
+	if len(dd) == 0 {
+		return 0
+	}
+	i := int(float64(len(dd)-1) * p)
+	return dd[i]
+}
+
+func randFingerprint() []byte {
+	b := make([]byte, bonfire.FingerprintSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func send(conn net.PacketConn, dst net.Addr, msg bonfire.Message) error {
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(b, dst)
+	return err
+}
+
+func read(conn net.PacketConn, s *stats) {
+	b := make([]byte, bonfire.MaxMessageSize)
+	for {
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+
+		var msg bonfire.Message
+		if err := msg.UnmarshalBinary(b[:n]); err != nil {
+			continue
+		}
+		switch msg.Type {
+		case bonfire.HelloPeer:
+			s.answered(msg.Fingerprint, now)
+		case bonfire.Meet:
+			s.Lock()
+			s.meets++
+			s.Unlock()
+			s.answered(msg.MeetBody.Fingerprint, now)
+		case bonfire.Busy:
+			s.Lock()
+			s.busy++
+			s.Unlock()
+			s.answered(msg.Fingerprint, now)
+		}
+	}
+}
+
+func ticker(rate float64) <-chan time.Time {
+	if rate <= 0 {
+		return nil
+	}
+	return time.NewTicker(time.Duration(float64(time.Second) / rate)).C
+}
+
+func main() {
+	serverAddrStr := flag.String("addr", "127.0.0.1:7890", "Address of the bonfire server to test")
+	numPeers := flag.Int("peers", 100, "Number of peers to simulate")
+	helloRate := flag.Float64("hello-rate", 50, "HelloServer messages sent per second, across all peers")
+	mingleRate := flag.Float64("mingle-rate", 10, "ReadyToMingle messages sent per second, across all peers")
+	duration := flag.Duration("duration", 30*time.Second, "How long to send messages for")
+	wait := flag.Duration("wait", 2*time.Second, "How long to wait for responses once sending has stopped")
+	distinctPorts := flag.Bool("distinct-ports", false, "Give each simulated peer its own source port, so the server sees them as distinct peers")
+	flag.Parse()
+
+	serverAddr, err := net.ResolveUDPAddr("udp", *serverAddrStr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	s := &stats{pending: map[string]time.Time{}}
+	peers := make([]simPeer, *numPeers)
+	var sharedConn net.PacketConn
+	for i := range peers {
+		if sharedConn == nil || *distinctPorts {
+			conn, err := net.ListenPacket("udp", ":0")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer conn.Close()
+			go read(conn, s)
+			sharedConn = conn
+		}
+		peers[i] = simPeer{conn: sharedConn, fingerprint: randFingerprint()}
+	}
+
+	helloCh, mingleCh := ticker(*helloRate), ticker(*mingleRate)
+	stopCh := time.After(*duration)
+	var sendErrs int
+loop:
+	for {
+		var err error
+		select {
+		case <-helloCh:
+			peer := peers[mrand.Intn(len(peers))]
+			fingerprint := randFingerprint()
+			s.Lock()
+			s.pending[string(fingerprint)] = time.Now()
+			s.sent++
+			s.Unlock()
+			err = send(peer.conn, serverAddr, bonfire.Message{
+				Fingerprint: fingerprint,
+				Type:        bonfire.HelloServer,
+			})
+		case <-mingleCh:
+			peer := peers[mrand.Intn(len(peers))]
+			err = send(peer.conn, serverAddr, bonfire.Message{
+				Fingerprint: peer.fingerprint,
+				Type:        bonfire.ReadyToMingle,
+			})
+		case <-stopCh:
+			break loop
+		}
+		if err != nil {
+			sendErrs++
+		}
+	}
+
+	time.Sleep(*wait)
+
+	s.Lock()
+	defer s.Unlock()
+	sort.Slice(s.latencies, func(i, j int) bool {
+		return s.latencies[i] < s.latencies[j]
+	})
+	var loss float64
+	if s.sent > 0 {
+		loss = float64(len(s.pending)) / float64(s.sent) * 100
+	}
+
+	fmt.Printf("HelloServer sent:  %d\n", s.sent)
+	fmt.Printf("answered:          %d\n", len(s.latencies))
+	fmt.Printf("unanswered:        %d (%.2f%% loss)\n", len(s.pending), loss)
+	fmt.Printf("busy responses:    %d\n", s.busy)
+	fmt.Printf("meets received:    %d\n", s.meets)
+	fmt.Printf("send errors:       %d\n", sendErrs)
+	fmt.Printf("latency p50:       %v\n", percentile(s.latencies, 0.5))
+	fmt.Printf("latency p90:       %v\n", percentile(s.latencies, 0.9))
+	fmt.Printf("latency p99:       %v\n", percentile(s.latencies, 0.99))
+	if len(s.latencies) > 0 {
+		fmt.Printf("latency max:       %v\n", s.latencies[len(s.latencies)-1])
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/bonfire"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// The control socket accepts one command per connection. A command is a single
+// line of space separated words. The response is zero or more lines of
+// output, after which the connection is closed. If the command failed the
+// response is instead a single line starting with "ERR ".
+//
+// See cmd/bonfire-ctl for a client.
+const controlUsage = `Commands:
+	stats              Print counters describing the server's activity, and
+	                   how long introductions take
+	minglers           List all ready-to-mingle peers
+	ban <ip>           Drop all packets from the given ip (or ip:port)
+	unban <ip>         Undo a previous ban
+	bans               List all banned ips
+	log-level <level>  Change the maximum log level which is printed
+	help               Print this message`
+
+type control struct {
+	ctx context.Context
+	srv *bonfire.Server
+	l   net.Listener
+}
+
+func listenControl(ctx context.Context, path string, srv *bonfire.Server) (*control, error) {
+	ctx = mctx.Annotate(ctx, "control-socket-path", path)
+
+	// a socket file left behind by a previous process would prevent listening.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, merr.Wrap(err, ctx)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, merr.Wrap(err, ctx)
+	} else if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, merr.Wrap(err, ctx)
+	}
+
+	c := &control{ctx: ctx, srv: srv, l: l}
+	go c.spin()
+	mlog.Info("listening on control socket", ctx)
+	return c, nil
+}
+
+func (c *control) spin() {
+	for {
+		conn, err := c.l.Accept()
+		if err != nil {
+			// the listener is closed on stop
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *control) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		mlog.Warn("error reading control command", c.ctx, merr.Context(err))
+		return
+	}
+
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+	if err := c.command(w, strings.Fields(line)); err != nil {
+		w.Reset(conn)
+		fmt.Fprintf(w, "ERR %s\n", err)
+	}
+}
+
+func parseIP(str string) (net.IP, error) {
+	if host, _, err := net.SplitHostPort(str); err == nil {
+		str = host
+	}
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %q", str)
+	}
+	return ip, nil
+}
+
+func (c *control) command(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command given")
+	}
+
+	cmd, args := args[0], args[1:]
+	wantArgs := 0
+	switch cmd {
+	case "ban", "unban", "log-level":
+		wantArgs = 1
+	}
+	if len(args) != wantArgs {
+		return fmt.Errorf("%s expects %d argument(s), got %d", cmd, wantArgs, len(args))
+	}
+
+	switch cmd {
+	case "stats":
+		stats := c.srv.Stats()
+		fmt.Fprintf(w, "packets-received %d\n", stats.PacketsReceived)
+		fmt.Fprintf(w, "packets-dropped %d\n", stats.PacketsDropped)
+		fmt.Fprintf(w, "hello-servers %d\n", stats.HelloServers)
+		fmt.Fprintf(w, "ready-to-mingles %d\n", stats.ReadyToMingles)
+		fmt.Fprintf(w, "seeks %d\n", stats.Seeks)
+		fmt.Fprintf(w, "occupancies %d\n", stats.Occupancies)
+		fmt.Fprintf(w, "probes %d\n", stats.Probes)
+		fmt.Fprintf(w, "meets-sent %d\n", stats.MeetsSent)
+		fmt.Fprintf(w, "hello-peers-sent %d\n", stats.HelloPeersSent)
+		fmt.Fprintf(w, "busy-sent %d\n", stats.BusySent)
+		fmt.Fprintf(w, "you-ares-sent %d\n", stats.YouAresSent)
+		fmt.Fprintf(w, "hello-servers-forwarded %d\n", stats.HelloServersForwarded)
+		fmt.Fprintf(w, "meets-relayed %d\n", stats.MeetsRelayed)
+		fmt.Fprintf(w, "minglers %d\n", stats.Minglers)
+
+		intro := stats.IntroLatency
+		fmt.Fprintf(w, "intro-latency-count %d\n", intro.Count)
+		fmt.Fprintf(w, "intro-latency-mean %s\n", intro.Mean())
+		fmt.Fprintf(w, "intro-latency-p50 %s\n", intro.Quantile(0.5))
+		fmt.Fprintf(w, "intro-latency-p99 %s\n", intro.Quantile(0.99))
+		fmt.Fprintf(w, "intro-latency-max %s\n", intro.Max)
+		buckets := bonfire.LatencyBuckets()
+		for i, count := range intro.Buckets {
+			le := "+Inf"
+			if i < len(buckets) {
+				le = buckets[i].String()
+			}
+			fmt.Fprintf(w, "intro-latency-bucket %s %d\n", le, count)
+		}
+
+	case "minglers":
+		for _, m := range c.srv.Minglers() {
+			fmt.Fprintf(w, "%s %x %s\n",
+				m.Addr, m.Fingerprint, m.LastSeen.UTC().Format(time.RFC3339))
+		}
+
+	case "ban", "unban":
+		ip, err := parseIP(args[0])
+		if err != nil {
+			return err
+		}
+		ctx := mctx.Annotate(c.ctx, "ip", ip.String())
+		if cmd == "ban" {
+			c.srv.Ban(ip)
+			mlog.Info("banned ip", ctx)
+		} else {
+			c.srv.Unban(ip)
+			mlog.Info("unbanned ip", ctx)
+		}
+
+	case "bans":
+		for _, ip := range c.srv.Bans() {
+			fmt.Fprintln(w, ip)
+		}
+
+	case "log-level":
+		lvl := mlog.LevelFromString(args[0])
+		if lvl == nil {
+			return fmt.Errorf("invalid log level %q", args[0])
+		}
+		mlog.From(c.ctx).SetMaxLevel(lvl)
+
+	case "help":
+		fmt.Fprintln(w, controlUsage)
+
+	default:
+		return fmt.Errorf("unknown command %q, see help", cmd)
+	}
+	return nil
+}
+
+func (c *control) Close() error {
+	// closing a unix listener also removes its socket file.
+	return c.l.Close()
+}
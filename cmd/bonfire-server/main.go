@@ -2,38 +2,386 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mediocregopher/bonfire"
+	"github.com/mediocregopher/bonfire/internal/logfmt"
 	"github.com/mediocregopher/mediocre-go-lib/m"
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
 	"github.com/mediocregopher/mediocre-go-lib/merr"
 	"github.com/mediocregopher/mediocre-go-lib/mlog"
 	"github.com/mediocregopher/mediocre-go-lib/mnet"
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
 	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/mediocregopher/mediocre-go-lib/mtime"
 )
 
+// duration is a time.Duration which is given as a string (e.g. "2m") in the
+// config file.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	dd, err := time.ParseDuration(str)
+	*d = duration(dd)
+	return err
+}
+
+// fileConfig describes the file given by --config-path. Fields which are
+// missing from the file are left at their values from the command-line.
+type fileConfig struct {
+	PacketBlastCount     int      `json:"packetBlastCount"`
+	PeersToMeet          int      `json:"peersToMeet"`
+	ReadyToMingleTimeout duration `json:"readyToMingleTimeout"`
+	MaxConcurrent        int      `json:"maxConcurrent"`
+	MaxMeetsPerMingler   int      `json:"maxMeetsPerMingler"`
+	MeetBudgetInterval   duration `json:"meetBudgetInterval"`
+	BusyRetryAfter       duration `json:"busyRetryAfter"`
+	OccupancyInterval    duration `json:"occupancyInterval"`
+	MaxMessageAge        duration `json:"maxMessageAge"`
+}
+
+func loadConfig(path string, cfg bonfire.ServerConfig) (bonfire.ServerConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	fc := fileConfig{
+		PacketBlastCount:     cfg.PacketBlastCount,
+		PeersToMeet:          cfg.PeersToMeet,
+		ReadyToMingleTimeout: duration(cfg.ReadyToMingleTimeout),
+		MaxConcurrent:        cfg.MaxConcurrent,
+		MaxMeetsPerMingler:   cfg.MaxMeetsPerMingler,
+		MeetBudgetInterval:   duration(cfg.MeetBudgetInterval),
+		BusyRetryAfter:       duration(cfg.BusyRetryAfter),
+		OccupancyInterval:    duration(cfg.OccupancyInterval),
+		MaxMessageAge:        duration(cfg.MaxMessageAge),
+	}
+	if err := json.NewDecoder(f).Decode(&fc); err != nil {
+		return cfg, err
+	}
+	return bonfire.ServerConfig{
+		PacketBlastCount:     fc.PacketBlastCount,
+		PeersToMeet:          fc.PeersToMeet,
+		ReadyToMingleTimeout: time.Duration(fc.ReadyToMingleTimeout),
+		MaxConcurrent:        fc.MaxConcurrent,
+		MaxMeetsPerMingler:   fc.MaxMeetsPerMingler,
+		MeetBudgetInterval:   time.Duration(fc.MeetBudgetInterval),
+		BusyRetryAfter:       time.Duration(fc.BusyRetryAfter),
+		OccupancyInterval:    time.Duration(fc.OccupancyInterval),
+		MaxMessageAge:        time.Duration(fc.MaxMessageAge),
+	}, nil
+}
+
 func main() {
-	ctx := m.ServiceContext()
+	// "bonfire-server selftest [flags...]" configures the server from the
+	// same flags, but then runs a selftest rather than serving.
+	isSelftest := len(os.Args) > 1 && os.Args[1] == "selftest"
+	if isSelftest {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	ctx := logfmt.WithLogFormat(m.ServiceContext())
+
+	// if systemd has passed in a socket then that's used, and the usual
+	// listener (along with its parameters) isn't set up at all.
+	conn, err := sdListenPacketConn()
+	if err != nil {
+		mlog.Fatal("error using systemd socket", ctx, merr.Context(err))
+	} else if conn == nil {
+		var listener *mnet.Listener
+		ctx, listener = mnet.WithListener(ctx,
+			mnet.ListenerProtocol("udp"),
+			mnet.ListenerAddr(":7890"),
+		)
+		ctx = mrun.WithStartHook(ctx, func(context.Context) error {
+			conn = listener.PacketConn
+			return nil
+		})
+	}
+
+	ctx, altListenAddr := mcfg.WithString(ctx, "alt-listen-addr", "", "If set, an additional UDP address which the server listens on, so that peers can detect whether they're behind a symmetric NAT (see bonfire.Peer's ProbeNAT). It should differ from the main address by IP, or at least by port.")
+
+	ctx, proxyListenAddr := mcfg.WithString(ctx, "proxy-listen-addr", "", "If set, an additional UDP address which the server listens on for packets forwarded by a load balancer, each prefixed with a PROXY protocol v2 header carrying its original source address (see bonfire.ProxyConn).")
+	ctx, proxyTrusted := mcfg.WithString(ctx, "proxy-trusted-networks", "", "Comma-separated list of networks (e.g. \"10.0.0.0/8\") from which packets are accepted on --proxy-listen-addr. Required if --proxy-listen-addr is set, since packets from anywhere else could spoof their source addresses.")
+
+	ctx, maxMeets := mcfg.WithInt(ctx, "max-meets-per-mingler", 0, "Maximum number of Meet messages sent to any single ready-to-mingle peer per ready-to-mingle timeout. 0 means no limit.")
+
+	ctx, padMessages := mcfg.WithBool(ctx, "pad-messages", "If set, all messages sent by the server are padded to the same size, so that they're harder to identify on the network.")
+
+	ctx, segmentOffload := mcfg.WithBool(ctx, "segment-offload", "If set, and running on Linux, the copies of each message sent due to the packet blast count are written using UDP segmentation offload, so that busy servers make fewer syscalls. Falls back to sending normally where it's not supported.")
+
+	ctx, sendYouAre := mcfg.WithBool(ctx, "send-you-are", "If set, the server tells every peer which says hello to it the address it observed the peer at, so that the peer always learns its remote address.")
 
-	ctx, listener := mnet.WithListener(ctx,
-		mnet.ListenerProtocol("udp"),
-		mnet.ListenerAddr(":7890"),
-	)
+	ctx, filterBogons := mcfg.WithBool(ctx, "filter-bogons", "If set, peers with public addresses are never introduced to private or otherwise non-routable addresses, which peers behind broken NATs sometimes advertise.")
+
+	ctx, sameNATCandidates := mcfg.WithBool(ctx, "same-nat-candidates", "If set along with --filter-bogons, peers which share a public IP are still introduced to each other's private addresses, so that they can connect over their local network.")
+
+	ctx, instanceID := mcfg.WithString(ctx, "instance-id", "", "If set, an ID (at most 32 bytes) which is included in every message sent by the server. When multiple servers share an anycast address each should be given a distinct ID, so that peers can tell when they start reaching a different one.")
+
+	ctx, obfuscationKey := mcfg.WithString(ctx, "obfuscation-key", "", "If set, a hex-encoded AES key (16, 24 or 32 bytes) with which all of the server's traffic is obfuscated. Peers must use the same key (see bonfire.NewObfuscatedConn).")
+
+	ctx, signingKey := mcfg.WithString(ctx, "signing-key", "", "If set, a hex-encoded Ed25519 private key with which every message sent by the server is signed. Peers can pin the server's identity using the public key (see bonfire.PeerOpts' ServerPublicKey). Generate one with bonfire-keygen.")
+
+	ctx, fingerprintKey := mcfg.WithString(ctx, "fingerprint-key", "", "If set, a hex-encoded pre-shared key which peers must prove knowledge of in their fingerprints (see bonfire.PSKFingerprintFunc), otherwise their messages are dropped. Generate one with bonfire-keygen.")
+
+	ctx, upstream := mcfg.WithString(ctx, "upstream", "", "If set, the UDP address of an upstream server which this one federates with: it registers with the upstream as a ready-to-mingle peer, relays the upstream's introductions to its own peers, and forwards HelloServer messages to the upstream when it doesn't have enough ready-to-mingle peers itself. The upstream must list this server in its --downstreams.")
+	ctx, upstreamPublicKey := mcfg.WithString(ctx, "upstream-public-key", "", "Hex-encoded Ed25519 public key which Meet messages from the upstream must be signed with in order to be relayed. Required if --upstream is set.")
+	ctx, downstreams := mcfg.WithString(ctx, "downstreams", "", "Comma-separated list of networks (e.g. \"10.0.0.0/8\") of the downstream servers whose forwarded HelloServer messages are accepted.")
+
+	ctx, configPath := mcfg.WithString(ctx, "config-path", "", "If set, a JSON file containing server parameters (e.g. {\"peersToMeet\": 5, \"readyToMingleTimeout\": \"2m\"}), which override those given on the command-line. The file is re-read when the process receives SIGHUP.")
+
+	ctx, controlSocketPath := mcfg.WithString(ctx, "control-socket-path", "", "If set, a unix socket will be created at this path which can be used to manage the running server (see bonfire-ctl).")
+
+	ctx, auditLogPath := mcfg.WithString(ctx, "audit-log-path", "", "If set, a log of all introductions made by the server will be appended to this file.")
+	ctx, auditLogMaxSize := mcfg.WithInt64(ctx, "audit-log-max-size", 100*1024*1024, "Size in bytes at which the audit log file is rotated.")
+	ctx, auditLogMaxBackups := mcfg.WithInt(ctx, "audit-log-max-backups", 5, "Number of rotated audit log files to keep.")
+	ctx, auditLogRedact := mcfg.WithBool(ctx, "audit-log-redact", "If set, only the networks of addresses are recorded in the audit log, and fingerprints are recorded as a keyed hash.")
+
+	ctx, selftestPeers := mcfg.WithInt(ctx, "selftest-peers", 100, "Only used by the selftest subcommand: the number of in-process peers which the server is tested with.")
+	ctx, selftestDuration := mcfg.WithDuration(ctx, "selftest-duration", mtime.Duration{Duration: 5 * time.Second}, "Only used by the selftest subcommand: how long the in-process peers repeatedly re-bootstrap for, in order to measure the server's capacity.")
 
 	srv := bonfire.NewServer()
 	srvCtx, cancel := context.WithCancel(ctx)
+	var auditLog *bonfire.AuditLog
+	var ctl *control
 	ctx = mrun.WithStartHook(ctx, func(context.Context) error {
+		srv.MaxMeetsPerMingler = *maxMeets
+		srv.PadMessages = *padMessages
+		srv.SegmentOffload = *segmentOffload
+		srv.SendYouAre = *sendYouAre
+		srv.FilterBogons = *filterBogons
+		srv.SameNATCandidates = *sameNATCandidates
+		if *instanceID != "" {
+			srv.InstanceID = []byte(*instanceID)
+		}
+
+		if *obfuscationKey != "" {
+			key, err := hex.DecodeString(*obfuscationKey)
+			if err != nil {
+				return merr.Wrap(err, ctx)
+			}
+			srv.WrapConn = func(conn net.PacketConn) (net.PacketConn, error) {
+				return bonfire.NewObfuscatedConn(conn, key)
+			}
+		}
+
+		if *signingKey != "" {
+			key, err := hex.DecodeString(*signingKey)
+			if err != nil {
+				return merr.Wrap(err, ctx)
+			}
+			srv.SigningKey = ed25519.PrivateKey(key)
+		}
+
+		if *fingerprintKey != "" {
+			key, err := hex.DecodeString(*fingerprintKey)
+			if err != nil {
+				return merr.Wrap(err, ctx)
+			}
+			srv.FingerprintCheck = bonfire.PSKFingerprintCheck(key)
+		}
+
+		srv.Upstream = *upstream
+		if *upstreamPublicKey != "" {
+			key, err := hex.DecodeString(*upstreamPublicKey)
+			if err != nil {
+				return merr.Wrap(err, ctx)
+			}
+			srv.UpstreamPublicKey = ed25519.PublicKey(key)
+		}
+		if *downstreams != "" {
+			for _, cidr := range strings.Split(*downstreams, ",") {
+				_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+				if err != nil {
+					return merr.Wrap(err, ctx)
+				}
+				srv.Downstreams = append(srv.Downstreams, ipNet)
+			}
+		}
+
+		// the config from the command-line is kept, so that fields removed
+		// from the config file revert to it on reload.
+		baseCfg := srv.Config()
+		if *configPath != "" {
+			cfg, err := loadConfig(*configPath, baseCfg)
+			if err != nil {
+				return merr.Wrap(err, ctx)
+			} else if err := srv.UpdateConfig(cfg); err != nil {
+				return merr.Wrap(err, ctx)
+			}
+		}
+
+		// in a selftest the listeners are checked, but nothing which would
+		// affect an already running server (e.g. its control socket) is set
+		// up, and the upstream isn't contacted.
+		if isSelftest {
+			return checkSelftestListeners(ctx, *altListenAddr, *proxyListenAddr, srv)
+		}
+
+		if *auditLogPath != "" {
+			opts := &bonfire.AuditLogOpts{
+				MaxSize:     *auditLogMaxSize,
+				MaxBackups:  *auditLogMaxBackups,
+				RedactAddrs: *auditLogRedact,
+			}
+			if *auditLogRedact {
+				// the key only needs to be consistent for the lifetime of the
+				// process, so that a peer's introductions can be correlated.
+				opts.FingerprintKey = mrand.Bytes(32)
+			}
+
+			var err error
+			if auditLog, err = bonfire.OpenAuditLog(*auditLogPath, opts); err != nil {
+				return merr.Wrap(err, ctx)
+			}
+			srv.OnIntroduction = auditLog.Log
+		}
+
+		if *controlSocketPath != "" {
+			var err error
+			if ctl, err = listenControl(ctx, *controlSocketPath, srv); err != nil {
+				return err
+			}
+		}
+
+		conns := []net.PacketConn{conn}
+		if *altListenAddr != "" {
+			altConn, err := net.ListenPacket("udp", *altListenAddr)
+			if err != nil {
+				return merr.Wrap(err, ctx)
+			}
+			conns = append(conns, altConn)
+		}
+		if *proxyListenAddr != "" {
+			opts := new(bonfire.ProxyConnOpts)
+			if *proxyTrusted != "" {
+				for _, cidr := range strings.Split(*proxyTrusted, ",") {
+					_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+					if err != nil {
+						return merr.Wrap(err, ctx)
+					}
+					opts.TrustedProxies = append(opts.TrustedProxies, ipNet)
+				}
+			}
+			proxyConn, err := net.ListenPacket("udp", *proxyListenAddr)
+			if err != nil {
+				return merr.Wrap(err, ctx)
+			}
+			pc, err := bonfire.NewProxyConn(proxyConn, opts)
+			if err != nil {
+				proxyConn.Close()
+				return merr.Wrap(err, ctx)
+			}
+			conns = append(conns, pc)
+		}
+
 		go func() {
-			if err := srv.Serve(srvCtx, listener.PacketConn); err != context.Canceled {
+			if err := srv.Serve(srvCtx, conns...); err != context.Canceled {
 				mlog.Fatal("error when serving", srvCtx, merr.Context(err))
 			}
 		}()
+
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go func() {
+			defer signal.Stop(hupCh)
+			for {
+				select {
+				case <-srvCtx.Done():
+					return
+				case <-hupCh:
+				}
+
+				if *configPath == "" {
+					mlog.Warn("received SIGHUP but no config file is set", srvCtx)
+					continue
+				}
+				mlog.Info("reloading config", srvCtx)
+				sdNotify("RELOADING=1")
+				cfg, err := loadConfig(*configPath, baseCfg)
+				if err == nil {
+					err = srv.UpdateConfig(cfg)
+				}
+				if err != nil {
+					mlog.Error("error reloading config", srvCtx, merr.Context(err))
+				}
+				sdNotify("READY=1")
+			}
+		}()
+
+		if interval := sdWatchdogInterval(); interval > 0 {
+			go spinSDWatchdog(srvCtx, interval)
+		}
 		return nil
 	})
 
 	ctx = mrun.WithStopHook(ctx, func(context.Context) error {
 		cancel()
-		return nil
+		var err error
+		if ctl != nil {
+			err = merr.Wrap(ctl.Close(), ctx)
+		}
+		if auditLog != nil {
+			if closeErr := auditLog.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
 	})
 
-	m.StartWaitStop(ctx)
+	m.Start(ctx)
+	if isSelftest {
+		st := selftest{
+			srv:      srv,
+			peers:    *selftestPeers,
+			duration: selftestDuration.Duration,
+			out:      os.Stdout,
+		}
+		if *fingerprintKey != "" {
+			// this was already checked to be valid hex by the start hook.
+			st.fingerprintKey, _ = hex.DecodeString(*fingerprintKey)
+		}
+		err := st.run(ctx)
+		if stopErr := mrun.Stop(ctx); err == nil {
+			err = stopErr
+		}
+		if err != nil {
+			mlog.Fatal("selftest failed", ctx, merr.Context(err))
+		}
+		fmt.Println("selftest passed")
+		return
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		mlog.Warn("error notifying systemd", ctx, merr.Context(err))
+	}
+
+	// systemd stops services with SIGTERM, so that's handled in addition to
+	// interrupts.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigCh
+	mlog.Info("signal received, stopping", mctx.Annotate(ctx, "signal", sig))
+
+	sdNotify("STOPPING=1")
+	if err := mrun.Stop(ctx); err != nil {
+		mlog.Fatal("error triggering stop event", ctx, merr.Context(err))
+	}
+	mlog.Info("exiting process", ctx)
 }
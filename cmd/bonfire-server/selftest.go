@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bonfire"
+	"github.com/mediocregopher/bonfire/bftest"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+)
+
+// selftestServerAddr is the address which the server is given on the
+// in-process network used by the selftest subcommand.
+const selftestServerAddr = "10.0.0.1:7890"
+
+// selftest runs the server, configured exactly as it would be otherwise, on an
+// in-process network (see bftest.Network) along with a swarm of peers which are
+// configured to match it, e.g. with its obfuscation and signing keys. Peers
+// which fail to bootstrap or become ready-to-mingle indicate that the server is
+// misconfigured. Once they have, every peer repeatedly re-bootstraps for the
+// given duration, and the rate at which the server handled their HelloServer
+// messages is reported as its expected capacity. That doesn't account for the
+// cost of real sockets, so is an upper bound.
+type selftest struct {
+	srv            *bonfire.Server
+	fingerprintKey []byte
+	peers          int
+	duration       time.Duration
+	out            io.Writer
+}
+
+// peerOpts returns the PeerOpts which peers of the server need.
+func (st selftest) peerOpts() *bonfire.PeerOpts {
+	opts := &bonfire.PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		WrapConn:                st.srv.WrapConn,
+		MaxMessageAge:           st.srv.Config().MaxMessageAge,
+	}
+	if st.srv.SigningKey != nil {
+		opts.ServerPublicKey = st.srv.SigningKey.Public().(ed25519.PublicKey)
+	}
+	if st.fingerprintKey != nil {
+		opts.FingerprintFunc = bonfire.PSKFingerprintFunc(st.fingerprintKey)
+	}
+	return opts
+}
+
+// checkSelftestListeners checks that the server's additional listen addresses
+// can be bound (the main one already has been), and that its upstream (if any)
+// resolves. The Server's Upstream is cleared, so that the selftest doesn't
+// register with it.
+func checkSelftestListeners(ctx context.Context, altAddr, proxyAddr string, srv *bonfire.Server) error {
+	for _, addr := range []string{altAddr, proxyAddr} {
+		if addr == "" {
+			continue
+		}
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return merr.Wrap(err, mctx.Annotate(ctx, "addr", addr))
+		}
+		conn.Close()
+	}
+
+	if srv.Upstream != "" {
+		if _, err := net.ResolveUDPAddr("udp", srv.Upstream); err != nil {
+			return merr.Wrap(err, mctx.Annotate(ctx, "upstream", srv.Upstream))
+		}
+		srv.Upstream = ""
+	}
+	return nil
+}
+
+type bootstrapResult struct {
+	peer *bonfire.Peer
+	err  error
+}
+
+// bootstrap creates the swarm of peers, returning those which bootstrapped
+// successfully along with the first error encountered by any which didn't.
+// Each peer reads from its PacketConn until it's closed, so that it handles
+// the Meet and HelloPeer messages it receives.
+func (st selftest) bootstrap(ctx context.Context, network *bftest.Network, serveErrCh <-chan error) ([]*bonfire.Peer, error) {
+	opts := st.peerOpts()
+	resCh := make(chan bootstrapResult, st.peers)
+	for range st.peers {
+		go func() {
+			conn, err := network.ListenPacket("")
+			if err != nil {
+				resCh <- bootstrapResult{err: err}
+				return
+			}
+			peer, err := bonfire.NewPeerConn(ctx, conn, selftestServerAddr, opts)
+			resCh <- bootstrapResult{peer: peer, err: err}
+			if err != nil {
+				return
+			}
+
+			b := make([]byte, bonfire.MaxMessageSize)
+			for {
+				if _, _, err := peer.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	var (
+		peers    []*bonfire.Peer
+		firstErr error
+	)
+	for range st.peers {
+		select {
+		case res := <-resCh:
+			if res.err != nil && firstErr == nil {
+				firstErr = res.err
+			} else if res.peer != nil {
+				peers = append(peers, res.peer)
+			}
+		case err := <-serveErrCh:
+			return peers, fmt.Errorf("serving: %w", err)
+		}
+	}
+	return peers, firstErr
+}
+
+// burst has every peer re-bootstrap repeatedly for the duration, returning how
+// long that actually took.
+func (st selftest) burst(ctx context.Context, peers []*bonfire.Peer) time.Duration {
+	ctx, cancel := context.WithTimeout(ctx, st.duration)
+	defer cancel()
+
+	start := time.Now()
+	wg := new(sync.WaitGroup)
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				// errors are expected if the server tells the peer it's busy,
+				// which the stats will show.
+				peer.ResetPeers()
+			}
+		}()
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func (st selftest) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	network := bftest.NewNetwork()
+	serverConn, err := network.ListenPacket(selftestServerAddr)
+	if err != nil {
+		return err
+	}
+	serveErrCh := make(chan error, 1)
+	go func() { serveErrCh <- st.srv.Serve(ctx, serverConn) }()
+
+	start := time.Now()
+	peers, err := st.bootstrap(ctx, network, serveErrCh)
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+	fmt.Fprintf(st.out, "peers bootstrapped:   %d/%d in %v\n", len(peers), st.peers, time.Since(start))
+	if err != nil {
+		return fmt.Errorf("bootstrapping peers: %w", err)
+	}
+
+	// peers send their first ReadyToMingle once bootstrapped, but it may not
+	// have been handled yet.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(st.srv.Minglers()) < len(peers) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	minglers := len(st.srv.Minglers())
+	fmt.Fprintf(st.out, "ready-to-mingle:      %d/%d\n", minglers, len(peers))
+	if minglers < len(peers) {
+		return errors.New("not all peers became ready-to-mingle")
+	}
+
+	before := st.srv.Stats()
+	took := st.burst(ctx, peers)
+	after := st.srv.Stats()
+
+	hellos := after.HelloServers - before.HelloServers
+	rate := float64(hellos) / took.Seconds()
+	intro := after.IntroLatency
+	fmt.Fprintf(st.out, "hello-servers:        %d in %v\n", hellos, took.Round(time.Millisecond))
+	fmt.Fprintf(st.out, "meets sent:           %d\n", after.MeetsSent-before.MeetsSent)
+	fmt.Fprintf(st.out, "busy responses:       %d\n", after.BusySent-before.BusySent)
+	fmt.Fprintf(st.out, "intro latency p50:    %v\n", intro.Quantile(0.5))
+	fmt.Fprintf(st.out, "intro latency p99:    %v\n", intro.Quantile(0.99))
+	fmt.Fprintf(st.out, "expected capacity:    %.0f HelloServer/s (at most)\n", rate)
+	if hellos == 0 {
+		return errors.New("no HelloServer messages were handled")
+	}
+
+	cancel()
+	if err := <-serveErrCh; err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("serving: %w", err)
+	}
+	return nil
+}
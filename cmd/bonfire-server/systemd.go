@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// The first file descriptor passed by systemd's socket activation, see
+// sd_listen_fds(3).
+const sdListenFDsStart = 3
+
+// sdListenPacketConn returns the socket passed in by systemd's socket
+// activation, or nil if the process wasn't socket activated. Only a single
+// socket is expected.
+//
+// When the socket is kept open by systemd across restarts of the server, the
+// NAT bindings peers have towards it are kept as well.
+func sdListenPacketConn() (net.PacketConn, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing LISTEN_FDS: %w", err)
+	} else if n != 1 {
+		return nil, fmt.Errorf("expected 1 socket from LISTEN_FDS, got %d", n)
+	}
+
+	// FilePacketConn makes its own copy of the file descriptor, so the
+	// original is closed.
+	f := os.NewFile(sdListenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("using socket from LISTEN_FDS: %w", err)
+	}
+	return conn, nil
+}
+
+// sdNotify sends the given state to systemd, see sd_notify(3). It does nothing
+// if the process isn't being run by systemd with notify support.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	} else if addr[0] == '@' {
+		// abstract namespace
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval on which systemd expects
+// "WATCHDOG=1" to be sent, or 0 if the watchdog isn't enabled.
+func sdWatchdogInterval() time.Duration {
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		if pid, err := strconv.Atoi(pidStr); err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	// notifying at half the interval is what systemd recommends.
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// spinSDWatchdog pings the systemd watchdog on the given interval until the
+// context is canceled.
+func spinSDWatchdog(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			mlog.Warn("error notifying systemd watchdog", ctx, merr.Context(err))
+		}
+	}
+}
@@ -0,0 +1,382 @@
+// Command bonfire-spec generates a description of the bonfire wire format,
+// including the byte layout of each message type and test vectors, directly
+// from the marshaling code of the bonfire package. Implementations in other
+// languages can use its output to stay in sync with this one.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/mediocregopher/bonfire"
+)
+
+// example describes a single Message which will be included in the output.
+// Every MessageType, and every optional field, should be represented by at
+// least one example.
+type example struct {
+	Name string
+	Msg  bonfire.Message
+}
+
+// seq returns n bytes counting up from start, so that examples are
+// deterministic but fields are still easy to tell apart.
+func seq(n int, start byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+func fingerprint(start byte) []byte {
+	return seq(bonfire.FingerprintSize, start)
+}
+
+func addr(str string) net.Addr {
+	addr, err := net.ResolveUDPAddr("udp", str)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+// signed returns the Message with a signature extension, made using a fixed
+// key and time so that the output is deterministic. The signed bytes are
+// constructed here as described in the README, rather than using
+// Message.Sign, so that this also serves as a check of that description.
+func signed(msg bonfire.Message) bonfire.Message {
+	key := ed25519.NewKeyFromSeed(seq(ed25519.SeedSize, 0xc0))
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	signedAt := binary.BigEndian.AppendUint64(nil, uint64(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()))
+	msg.Signature = append(signedAt, ed25519.Sign(key, append(b, signedAt...))...)
+	return msg
+}
+
+// rendezvous returns the rendezvous key for the given string, derived as
+// described in the README.
+func rendezvous(str string) []byte {
+	h := sha256.Sum256([]byte(str))
+	return h[:]
+}
+
+func examples() []example {
+	fp, meetFP := fingerprint(0), fingerprint(bonfire.FingerprintSize)
+	return []example{
+		{
+			Name: "HelloServer",
+			Msg:  bonfire.Message{Fingerprint: fp, Type: bonfire.HelloServer},
+		},
+		{
+			Name: "HelloPeer (ipv4)",
+			Msg: bonfire.Message{
+				Fingerprint:   fp,
+				Type:          bonfire.HelloPeer,
+				HelloPeerBody: bonfire.HelloPeerBody{Addr: addr("127.0.0.1:6666")},
+			},
+		},
+		{
+			Name: "HelloPeer (ipv6)",
+			Msg: bonfire.Message{
+				Fingerprint:   fp,
+				Type:          bonfire.HelloPeer,
+				HelloPeerBody: bonfire.HelloPeerBody{Addr: addr("[::1]:6666")},
+			},
+		},
+		{
+			Name: "Meet",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.Meet,
+				MeetBody: bonfire.MeetBody{
+					Fingerprint: meetFP,
+					Addr:        addr("127.0.0.1:6666"),
+				},
+			},
+		},
+		{
+			Name: "ReadyToMingle",
+			Msg:  bonfire.Message{Fingerprint: fp, Type: bonfire.ReadyToMingle},
+		},
+		{
+			Name: "Busy",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.Busy,
+				BusyBody:    bonfire.BusyBody{RetryAfter: 5 * time.Second},
+			},
+		},
+		{
+			Name: "Greet",
+			Msg:  bonfire.Message{Fingerprint: fp, Type: bonfire.Greet},
+		},
+		{
+			Name: "Seek",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.Seek,
+				SeekBody:    bonfire.SeekBody{Fingerprint: meetFP},
+			},
+		},
+		{
+			Name: "Occupancy",
+			Msg: bonfire.Message{
+				Fingerprint:   fp,
+				Type:          bonfire.Occupancy,
+				OccupancyBody: bonfire.OccupancyBody{Minglers: 42},
+			},
+		},
+		{
+			Name: "Probe",
+			Msg:  bonfire.Message{Fingerprint: fp, Type: bonfire.Probe},
+		},
+		{
+			Name: "Probe response with endpoints (version 1)",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.Probe,
+				ProbeBody:   bonfire.ProbeBody{Addr: addr("1.2.3.4:6666")},
+				Candidates:  []net.Addr{addr("5.6.7.8:7890")},
+			},
+		},
+		{
+			Name: "Handshake",
+			Msg: bonfire.Message{
+				Fingerprint:   fp,
+				Type:          bonfire.Handshake,
+				HandshakeBody: bonfire.HandshakeBody{Payload: []byte("v1.2.3")},
+			},
+		},
+		{
+			Name: "Handshake ack",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.Handshake,
+				HandshakeBody: bonfire.HandshakeBody{
+					Ack:     true,
+					Payload: []byte("v1.2.4"),
+				},
+			},
+		},
+		{
+			Name: "YouAre",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.YouAre,
+				YouAreBody:  bonfire.YouAreBody{Addr: addr("1.2.3.4:6666")},
+			},
+		},
+		{
+			Name: "AuthFailed",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.AuthFailed,
+			},
+		},
+		{
+			Name: "Meet with candidates (version 1)",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.Meet,
+				MeetBody: bonfire.MeetBody{
+					Fingerprint: meetFP,
+					Addr:        addr("1.2.3.4:6666"),
+				},
+				Candidates: []net.Addr{
+					addr("192.168.1.2:6666"),
+					addr("[fd00::2]:6666"),
+				},
+			},
+		},
+		{
+			Name: "Meet with LAN candidates (version 1)",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.Meet,
+				MeetBody: bonfire.MeetBody{
+					Fingerprint: meetFP,
+					Addr:        addr("1.2.3.4:6666"),
+				},
+				Candidates:    []net.Addr{addr("5.6.7.8:6666")},
+				LANCandidates: []net.Addr{addr("192.168.1.2:6666")},
+			},
+		},
+		{
+			Name: "HelloPeer with instance ID (version 1)",
+			Msg: bonfire.Message{
+				Fingerprint:   fp,
+				Type:          bonfire.HelloPeer,
+				HelloPeerBody: bonfire.HelloPeerBody{Addr: addr("1.2.3.4:6666")},
+				InstanceID:    []byte("eu-west-1a"),
+			},
+		},
+		{
+			Name: "HelloServer forwarded to an upstream (version 1)",
+			Msg: bonfire.Message{
+				Fingerprint:  fp,
+				Type:         bonfire.HelloServer,
+				ForwardedFor: addr("1.2.3.4:6666"),
+			},
+		},
+		{
+			Name: "Meet with sealed blob (version 1)",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.Meet,
+				MeetBody: bonfire.MeetBody{
+					Fingerprint: meetFP,
+					Addr:        addr("1.2.3.4:6666"),
+				},
+				Sealed: seq(40, 0xa0),
+			},
+		},
+		{
+			// the key's seed is 32 bytes counting up from 0xc0.
+			Name: "Meet with signature (version 1)",
+			Msg: signed(bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.Meet,
+				MeetBody: bonfire.MeetBody{
+					Fingerprint: meetFP,
+					Addr:        addr("1.2.3.4:6666"),
+				},
+			}),
+		},
+		{
+			Name: "ReadyToMingle with capacity (version 1)",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.ReadyToMingle,
+				MingleCapacity: bonfire.MingleCapacity{
+					Meets:    10,
+					Interval: time.Minute,
+				},
+			},
+		},
+		{
+			Name: "HelloServer with padding (version 1)",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.HelloServer,
+				Padding:     16,
+			},
+		},
+		{
+			Name: "HelloServer with timestamp (version 1)",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.HelloServer,
+				Timestamp:   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			// the rendezvous is the SHA-256 hash of "example".
+			Name: "HelloServer with rendezvous (version 1)",
+			Msg: bonfire.Message{
+				Fingerprint: fp,
+				Type:        bonfire.HelloServer,
+				Rendezvous:  rendezvous("example"),
+			},
+		},
+	}
+}
+
+type vector struct {
+	Name   string                 `json:"name"`
+	Hex    string                 `json:"hex"`
+	Fields []bonfire.MessageField `json:"fields"`
+	b      []byte
+}
+
+func vectors() ([]vector, error) {
+	var vv []vector
+	for _, ex := range examples() {
+		b, fields, err := ex.Msg.MarshalLayout()
+		if err != nil {
+			return nil, fmt.Errorf("marshaling example %q: %s", ex.Name, err)
+		}
+
+		var check bonfire.Message
+		if err := check.UnmarshalBinary(b); err != nil {
+			return nil, fmt.Errorf("unmarshaling example %q: %s", ex.Name, err)
+		}
+
+		vv = append(vv, vector{
+			Name:   ex.Name,
+			Hex:    hex.EncodeToString(b),
+			Fields: fields,
+			b:      b,
+		})
+	}
+	return vv, nil
+}
+
+func writeMarkdown(w io.Writer, vv []vector) {
+	fmt.Fprintln(w, "# bonfire wire format")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "This file is generated by cmd/bonfire-spec, do not edit it by hand.")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "* FingerprintSize: %d\n", bonfire.FingerprintSize)
+	fmt.Fprintf(w, "* MinMessageSize: %d\n", bonfire.MinMessageSize)
+	fmt.Fprintf(w, "* MaxMessageSize: %d\n", bonfire.MaxMessageSize)
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "## Message types")
+	fmt.Fprintln(w)
+	seen := map[bonfire.MessageType]bool{}
+	for _, ex := range examples() {
+		if seen[ex.Msg.Type] {
+			continue
+		}
+		seen[ex.Msg.Type] = true
+		fmt.Fprintf(w, "* `%d` -> `%s`\n", byte(ex.Msg.Type), ex.Msg.Type)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "## Messages")
+	for _, v := range vv {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "### %s\n\n", v.Name)
+		fmt.Fprintln(w, "| offset | size | field | value |")
+		fmt.Fprintln(w, "|-------:|-----:|-------|-------|")
+		for _, f := range v.Fields {
+			fmt.Fprintf(w, "| %d | %d | %s | `%x` |\n",
+				f.Offset, f.Size, f.Name, v.b[f.Offset:f.Offset+f.Size])
+		}
+		fmt.Fprintf(w, "\n```\n%s\n```\n", v.Hex)
+	}
+}
+
+func main() {
+	asJSON := flag.Bool("json", false, "Output test vectors as JSON rather than markdown")
+	flag.Parse()
+
+	vv, err := vectors()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(vv); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	writeMarkdown(os.Stdout, vv)
+}
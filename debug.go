@@ -0,0 +1,162 @@
+package bonfire
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDebugMessages is the number of bonfire messages, sent and received,
+	// which a Peer remembers for DebugDump.
+	maxDebugMessages = 64
+
+	// maxRemoteAddrHistory is the number of changes to its remote address
+	// which a Peer remembers for DebugDump.
+	maxRemoteAddrHistory = 16
+)
+
+// DebugMessage describes a bonfire message which was sent or received by a
+// Peer.
+type DebugMessage struct {
+	Time time.Time   `json:"time"`
+	Sent bool        `json:"sent"` // false if the message was received
+	Addr string      `json:"addr"` // the destination if Sent, otherwise the source
+	Type MessageType `json:"type"`
+}
+
+// DebugPeer describes one of a Peer's current peers.
+type DebugPeer struct {
+	Addr string `json:"addr"`
+
+	// The last time a bonfire message was received from the peer, or when it
+	// was added to the set of peers if that's more recent.
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// DebugRemoteAddr describes a change to a Peer's remote address (see
+// RemoteAddr).
+type DebugRemoteAddr struct {
+	Time time.Time `json:"time"`
+	Addr string    `json:"addr"`
+}
+
+// PeerDebugDump is a snapshot of a Peer's internal state, as returned by
+// DebugDump. It can be encoded as JSON.
+type PeerDebugDump struct {
+	Time       time.Time `json:"time"`
+	State      PeerState `json:"state"`
+	LocalAddr  string    `json:"localAddr"`
+	RemoteAddr string    `json:"remoteAddr"` // empty if not yet known
+	Stats      PeerStats `json:"stats"`
+
+	// The state of the Peer's circuit breaker around its server.
+	ServerCircuit ServerCircuitState `json:"serverCircuit"`
+
+	// The Peer's current peers, sorted by address.
+	Peers []DebugPeer `json:"peers"`
+
+	// The most recent changes to the Peer's remote address, oldest first.
+	RemoteAddrHistory []DebugRemoteAddr `json:"remoteAddrHistory"`
+
+	// The most recent bonfire messages sent and received by the Peer, oldest
+	// first. Each message is only included once, even if it was sent multiple
+	// times (see PeerOpts' PacketBlastCount). Messages are only recorded if
+	// PeerOpts' DebugMessages is set.
+	Messages []DebugMessage `json:"messages"`
+}
+
+// debugLog remembers the most recent bonfire messages sent and received by a
+// Peer. It has its own lock, since messages are sent both with and without the
+// Peer's lock held.
+type debugLog struct {
+	l    sync.Mutex
+	msgs []DebugMessage // used as a ring once full
+	next int
+}
+
+func (dl *debugLog) add(sent bool, addr net.Addr, typ MessageType) {
+	msg := DebugMessage{Time: time.Now(), Sent: sent, Addr: addr.String(), Type: typ}
+	dl.l.Lock()
+	defer dl.l.Unlock()
+	if len(dl.msgs) < maxDebugMessages {
+		dl.msgs = append(dl.msgs, msg)
+		return
+	}
+	dl.msgs[dl.next] = msg
+	dl.next = (dl.next + 1) % maxDebugMessages
+}
+
+func (dl *debugLog) messages() []DebugMessage {
+	dl.l.Lock()
+	defer dl.l.Unlock()
+	msgs := make([]DebugMessage, 0, len(dl.msgs))
+	msgs = append(msgs, dl.msgs[dl.next:]...)
+	return append(msgs, dl.msgs[:dl.next]...)
+}
+
+// seen records that a bonfire message has been received from the address, if
+// it's one of the Peer's peers.
+//
+// This must be called with the lock held.
+func (p *Peer) seen(addr net.Addr) {
+	addrStr := addr.String()
+	if _, ok := p.peers[addrStr]; !ok {
+		return
+	} else if p.peerLastSeen == nil {
+		p.peerLastSeen = map[string]time.Time{}
+	}
+	p.peerLastSeen[addrStr] = time.Now()
+}
+
+// recordRemoteAddr adds the remote address to the history returned by
+// DebugDump, if it's different from the last one added.
+//
+// This must be called with the lock held.
+func (p *Peer) recordRemoteAddr(addr net.Addr) {
+	if n := len(p.remoteAddrHistory); n > 0 && p.remoteAddrHistory[n-1].Addr == addr.String() {
+		return
+	}
+	p.remoteAddrHistory = append(p.remoteAddrHistory, DebugRemoteAddr{
+		Time: time.Now(),
+		Addr: addr.String(),
+	})
+	if n := len(p.remoteAddrHistory); n > maxRemoteAddrHistory {
+		p.remoteAddrHistory = p.remoteAddrHistory[n-maxRemoteAddrHistory:]
+	}
+}
+
+// DebugDump returns a snapshot of the Peer's internal state, for debugging.
+// Applications may expose it however they like, e.g. as JSON on a debug HTTP
+// endpoint. Its contents aren't part of the Peer's stable API, and may change
+// between versions.
+func (p *Peer) DebugDump() PeerDebugDump {
+	dump := PeerDebugDump{
+		Time:      time.Now(),
+		LocalAddr: p.LocalAddr().String(),
+		Stats:     p.Stats(),
+		Messages:  p.debugLog.messages(),
+	}
+
+	p.l.RLock()
+	defer p.l.RUnlock()
+	dump.State = p.state
+	dump.ServerCircuit = p.circuit.state
+	if p.remoteAddr != nil {
+		dump.RemoteAddr = p.remoteAddr.String()
+	}
+	dump.RemoteAddrHistory = append([]DebugRemoteAddr(nil), p.remoteAddrHistory...)
+
+	dump.Peers = make([]DebugPeer, 0, len(p.peers))
+	for addrStr := range p.peers {
+		dump.Peers = append(dump.Peers, DebugPeer{
+			Addr:     addrStr,
+			LastSeen: p.peerLastSeen[addrStr],
+		})
+	}
+	sort.Slice(dump.Peers, func(i, j int) bool {
+		return dump.Peers[i].Addr < dump.Peers[j].Addr
+	})
+	return dump
+}
@@ -0,0 +1,82 @@
+package bonfire
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestDebugLog(t *T) {
+	var dl debugLog
+	addr := addrString("127.0.0.1:1")
+	for i := 0; i < maxDebugMessages+2; i++ {
+		dl.add(i%2 == 0, addr, MessageType(i))
+	}
+
+	// the oldest are overwritten, and the rest returned in order.
+	msgs := dl.messages()
+	massert.Require(t, massert.Equal(maxDebugMessages, len(msgs)))
+	massert.Require(t,
+		massert.Equal(MessageType(2), msgs[0].Type),
+		massert.Equal(MessageType(maxDebugMessages+1), msgs[len(msgs)-1].Type),
+		massert.Equal(false, msgs[len(msgs)-1].Sent),
+	)
+}
+
+func TestPeerDebugDump(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	server.SendYouAre = true
+	go server.Serve(ctx, conn)
+
+	peer, err := NewPeer(ctx, "udp", conn.LocalAddr().String(), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		ListenAddr:              "127.0.0.1:0",
+		DebugMessages:           true,
+	})
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+
+	dump := peer.DebugDump()
+	massert.Require(t,
+		massert.Equal(PeerStateEstablished, dump.State),
+		massert.Equal(peer.LocalAddr().String(), dump.LocalAddr),
+		massert.Equal(peer.RemoteAddr().String(), dump.RemoteAddr),
+		massert.Equal(1, len(dump.RemoteAddrHistory)),
+	)
+	massert.Require(t, massert.Equal(dump.RemoteAddr, dump.RemoteAddrHistory[0].Addr))
+
+	// the exchange with the server is recorded in order.
+	massert.Require(t, massert.Not(massert.Equal(0, len(dump.Messages))))
+	first := dump.Messages[0]
+	massert.Require(t,
+		massert.Equal(HelloServer, first.Type),
+		massert.Equal(true, first.Sent),
+		massert.Equal(conn.LocalAddr().String(), first.Addr),
+	)
+	var received bool
+	for _, msg := range dump.Messages {
+		received = received || (!msg.Sent && msg.Type == HelloPeer)
+	}
+	massert.Require(t, massert.Equal(true, received))
+
+	b, err := json.Marshal(dump)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(true, strings.Contains(string(b), `"state":"Established"`)),
+		massert.Equal(true, strings.Contains(string(b), `"type":"HelloServer"`)),
+	)
+
+	// messages are only recorded if asked for.
+	other := testPeer(ctx, t, conn.LocalAddr().String(), PeerOpts{})
+	massert.Require(t, massert.Equal(0, len(other.DebugDump().Messages)))
+}
@@ -0,0 +1,181 @@
+package bonfire
+
+import (
+	"fmt"
+	"net"
+)
+
+// PeerEventType enumerates the kinds of PeerEvent which a Peer may emit.
+type PeerEventType int
+
+// Possible PeerEvent types.
+const (
+	// PeerEventError is emitted when the Peer encounters an error while
+	// performing some background task, and so can't return the error to the
+	// caller.
+	PeerEventError PeerEventType = iota
+
+	// PeerEventResolveFailed is emitted when the server's address could not be
+	// resolved. If a previously resolved address is available it will continue
+	// to be used.
+	PeerEventResolveFailed
+
+	// PeerEventServerBusy is emitted when the server responds to a HelloServer
+	// with a Busy message. The Peer will wait at least the requested time
+	// before sending another HelloServer.
+	PeerEventServerBusy
+
+	// PeerEventUnreachable is emitted when an address the Peer has sent to is
+	// reported as being unreachable, see PeerOpts' UnreachableThreshold.
+	PeerEventUnreachable
+
+	// PeerEventStateChanged is emitted when the Peer moves into a new
+	// PeerState, which is given in the event.
+	PeerEventStateChanged
+
+	// PeerEventRemoteAddrDisputed is emitted when a HelloPeer, from another
+	// peer or the server, reports having observed the Peer at an address
+	// other than the one most others have (see RemoteAddr). The event's Addr
+	// is that of the HelloPeer's sender.
+	PeerEventRemoteAddrDisputed
+
+	// PeerEventSameNAT is emitted when the server introduces the Peer to a
+	// peer which shares its external IP address, i.e. which is behind the
+	// same NAT. Many NATs don't support hairpinning, so such peers can often
+	// only reach each other over their local network, using the addresses
+	// advertised by AdvertiseCandidates. If the introduced peer advertised no
+	// addresses on the Peer's local network then the event's Err is set, and
+	// the Peer announces itself to its multicast group (see MulticastAddr),
+	// if it has one, in case the other peer is a member of it. The Peer
+	// doesn't relay traffic through other peers or the server, so if that
+	// fails too the two can only communicate if the application relays their
+	// packets itself, e.g. through a peer which both can reach.
+	PeerEventSameNAT
+
+	// PeerEventAdvertiseAddrMismatch is emitted when the server reports having
+	// observed the Peer at an IP other than that of AdvertiseAddr, which
+	// likely means AdvertiseAddr is wrong and other peers won't be able to
+	// reach the Peer at it. The event's Addr is the address the server
+	// observed.
+	PeerEventAdvertiseAddrMismatch
+
+	// PeerEventPeerRejected is emitted when PeerOpts' AcceptPeer returns false
+	// for an introduction. The event's Addr is the address of the rejected
+	// peer.
+	PeerEventPeerRejected
+
+	// PeerEventAuthFailed is emitted when the server responds with an
+	// AuthFailed message, meaning that it rejected one of the Peer's messages
+	// on account of its fingerprint (see PeerOpts' FingerprintFunc). This usually
+	// means the Peer and server are configured with different secrets. The
+	// Peer keeps trying as usual, and the event's Addr is the server's.
+	PeerEventAuthFailed
+
+	// PeerEventServerCircuitChanged is emitted when the Peer's circuit breaker
+	// around its server (see PeerOpts' ServerFailureThreshold) moves into a
+	// new ServerCircuitState, which is given in the event. When the circuit
+	// opens the event's Err is the failure which caused it to.
+	PeerEventServerCircuitChanged
+
+	// PeerEventServerInstanceChanged is emitted when a message from the server
+	// carries a different InstanceID than the last, meaning that the Peer's
+	// messages are now reaching a different instance of an anycast server
+	// (see Server's InstanceID). The Peer sends a ReadyToMingle to the new
+	// instance straight away. The event's Message is the one which carried
+	// the new InstanceID.
+	PeerEventServerInstanceChanged
+
+	// PeerEventServerChanged is emitted when the server's address is resolved
+	// to a different address than before (see PeerOpts' ServerAddrTTL),
+	// meaning that the Peer has switched to a different server, e.g. because
+	// of DNS-based failover. The new server has no record of the Peer, so a
+	// ReadyToMingle is sent to it straight away. The event's Addr is the new
+	// server's address, which is also returned by Peer's ServerAddr.
+	PeerEventServerChanged
+
+	// PeerEventRemoteAddrChanged is emitted whenever the Peer's remote
+	// address (see RemoteAddr) changes from one address to another, e.g.
+	// because its NAT mapping changed or it migrated (see Migrate), or because
+	// a cached address (see PeerOpts' CachedAddrs) turned out to be wrong. It
+	// isn't emitted when the address is first learned. Applications which
+	// advertise the address to other peers should advertise the new one. The
+	// event's Addr is the new remote address, and its Message is the report
+	// which caused the change.
+	PeerEventRemoteAddrChanged
+
+	// PeerEventWatchdog is emitted when the Peer hasn't read any packets
+	// within PeerOpts' WatchdogTimeout, once it has acted on it. If its socket
+	// couldn't be probed the socket was re-bound, as with Migrate, and the
+	// event's Err says why. Otherwise Err is nil, or describes why the Peer
+	// failed to re-bootstrap. The event's Addr is the Peer's local address.
+	PeerEventWatchdog
+)
+
+func (et PeerEventType) String() string {
+	switch et {
+	case PeerEventError:
+		return "Error"
+	case PeerEventResolveFailed:
+		return "ResolveFailed"
+	case PeerEventServerBusy:
+		return "ServerBusy"
+	case PeerEventUnreachable:
+		return "Unreachable"
+	case PeerEventStateChanged:
+		return "StateChanged"
+	case PeerEventRemoteAddrDisputed:
+		return "RemoteAddrDisputed"
+	case PeerEventSameNAT:
+		return "SameNAT"
+	case PeerEventAdvertiseAddrMismatch:
+		return "AdvertiseAddrMismatch"
+	case PeerEventPeerRejected:
+		return "PeerRejected"
+	case PeerEventAuthFailed:
+		return "AuthFailed"
+	case PeerEventServerCircuitChanged:
+		return "ServerCircuitChanged"
+	case PeerEventServerInstanceChanged:
+		return "ServerInstanceChanged"
+	case PeerEventServerChanged:
+		return "ServerChanged"
+	case PeerEventRemoteAddrChanged:
+		return "RemoteAddrChanged"
+	case PeerEventWatchdog:
+		return "Watchdog"
+	default:
+		return fmt.Sprintf("PeerEventType(%d)", int(et))
+	}
+}
+
+// PeerEvent describes something which has happened within a Peer, and which
+// the application may want to know about.
+type PeerEvent struct {
+	Type PeerEventType
+
+	// The address which the event pertains to, if any.
+	Addr net.Addr
+
+	// The error which caused the event, if any.
+	Err error
+
+	// The bonfire message which caused the event, if any.
+	Message *Message
+
+	// The state which the Peer moved into, for PeerEventStateChanged.
+	State PeerState
+
+	// The state which the Peer's circuit breaker around its server moved
+	// into, for PeerEventServerCircuitChanged.
+	ServerCircuit ServerCircuitState
+}
+
+func (p *Peer) event(ev PeerEvent) {
+	if p.po.EventCh == nil {
+		return
+	}
+	select {
+	case p.po.EventCh <- ev:
+	default:
+	}
+}
@@ -0,0 +1,170 @@
+package bonfire
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"time"
+)
+
+// relayInterval is how long a Meet from the Upstream is remembered for once
+// relayed, so that the copies of it sent due to the upstream's
+// PacketBlastCount aren't relayed as well.
+const relayInterval = 10 * time.Second
+
+// resolveUpstream resolves the Server's Upstream, if it has one, using the
+// network of the endpoint which is used to reach it (see connNetwork).
+func (s *Server) resolveUpstream(network string) error {
+	if s.Upstream == "" {
+		return nil
+	}
+	upstream, err := net.ResolveUDPAddr(network, s.Upstream)
+	if err != nil {
+		return fmt.Errorf("resolving Server.Upstream: %w", err)
+	}
+	s.upstream = upstream
+	return nil
+}
+
+// connNetwork returns the network which the PacketConn was created on, as far
+// as can be told from its local address: "udp4" for an IPv4 address, "udp6"
+// for a specific IPv6 address, and otherwise "udp", since a socket bound to
+// the unspecified IPv6 address may be dual-stack.
+func connNetwork(conn net.PacketConn) string {
+	ip := addrIP(conn.LocalAddr())
+	switch {
+	case ip == nil:
+		return "udp"
+	case ip.To4() != nil:
+		return "udp4"
+	case ip.IsUnspecified():
+		return "udp"
+	default:
+		return "udp6"
+	}
+}
+
+// isUpstream returns whether the address is that of the Server's Upstream.
+func (s *Server) isUpstream(addr net.Addr) bool {
+	return s.upstream != nil && excluded(addr, []net.Addr{s.upstream})
+}
+
+// verifyUpstreamMeet returns whether the Message is a Meet from the Server's
+// Upstream, signed using the private key corresponding to its
+// UpstreamPublicKey.
+func (s *Server) verifyUpstreamMeet(src net.Addr, msg Message) bool {
+	if msg.Type != Meet || !s.isUpstream(src) {
+		return false
+	} else if err := msg.VerifySignature(s.UpstreamPublicKey); err != nil {
+		s.err(fmt.Errorf("verifying Meet from upstream: %w", err))
+		return false
+	}
+	return true
+}
+
+// isDownstream returns whether the address is within one of the Server's
+// Downstreams.
+func (s *Server) isDownstream(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range s.Downstreams {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) upstreamFingerprint() ([]byte, error) {
+	if s.UpstreamFingerprintFunc != nil {
+		fingerprint, err := s.UpstreamFingerprintFunc()
+		if err != nil {
+			return nil, err
+		} else if len(fingerprint) != FingerprintSize {
+			return nil, fmt.Errorf("UpstreamFingerprintFunc returned %d bytes, expected %d", len(fingerprint), FingerprintSize)
+		}
+		return fingerprint, nil
+	}
+	fingerprint := make([]byte, FingerprintSize)
+	_, err := rand.Read(fingerprint)
+	return fingerprint, err
+}
+
+// spinUpstream sends a ReadyToMingle to the Upstream every half of the
+// ReadyToMingleTimeout, so that the upstream (assuming it has a similar
+// timeout) always considers the Server to be ready-to-mingle, until the
+// context is canceled.
+func (s *Server) spinUpstream(ctx context.Context) {
+	for {
+		fingerprint, err := s.upstreamFingerprint()
+		if err == nil {
+			err = multiSend(s.newSendBatch(s.conns[0]), s.upstream, s.Config().PacketBlastCount, Message{
+				Fingerprint: fingerprint,
+				Type:        ReadyToMingle,
+			})
+		}
+		if err != nil {
+			s.err(fmt.Errorf("registering with upstream: %w", err))
+		}
+
+		t := time.NewTimer(s.Config().ReadyToMingleTimeout / 2)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// forwardHelloServer adds the HelloServer, received from the peer at src, to
+// the batches to be forwarded to the Upstream, if the Server has one and the
+// HelloServer can be federated.
+func (s *Server) forwardHelloServer(sbs *sendBatches, src net.Addr, msg Message) {
+	if s.upstream == nil || len(msg.Rendezvous) > 0 {
+		return
+	}
+	// the HelloServer is only forwarded once, as a Busy is, since every copy
+	// would cause the upstream to make another set of introductions.
+	err := sbs.get(s.conns[0]).add(s.upstream, 1, Message{
+		Fingerprint:  msg.Fingerprint,
+		Type:         HelloServer,
+		ForwardedFor: src,
+		Candidates:   msg.Candidates,
+		Sealed:       msg.Sealed,
+	})
+	if err != nil {
+		s.err(err)
+		return
+	}
+	s.stats.helloServersForwarded.Add(1)
+}
+
+// relayMeet introduces the peer described by a Meet from the Upstream to one
+// of the Server's own ready-to-mingle peers. The Meet's signature must already
+// have been verified, see verifyUpstreamMeet.
+func (s *Server) relayMeet(cfg ServerConfig, msg Message) error {
+	key := string(msg.MeetBody.Fingerprint) + msg.MeetBody.Addr.String()
+	if !s.relayLimits.allow(key, s.now(), relayInterval) {
+		return nil
+	}
+
+	minglers := s.getMinglers(nil, 1, msg.MeetBody.Addr, s.upstream)
+	if len(minglers) == 0 {
+		return nil
+	}
+
+	// the Meet's LANCandidates were chosen for the Server, not the mingler,
+	// so aren't passed on.
+	sbs := s.newSendBatches()
+	s.addMeet(sbs, cfg, msg.MeetBody.Addr, Message{
+		Fingerprint: msg.MeetBody.Fingerprint,
+		Candidates:  msg.Candidates,
+		Sealed:      msg.Sealed,
+	}, minglers[0])
+	s.stats.meetsRelayed.Add(1)
+	return sbs.flush()
+}
@@ -0,0 +1,138 @@
+package bonfire
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestServerFederation(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	send := func(conn net.PacketConn, dst net.Addr, msg Message) {
+		msg.Fingerprint = mrand.Bytes(FingerprintSize)
+		b, err := msg.MarshalBinary()
+		massert.Require(t, massert.Nil(err))
+		_, err = conn.WriteTo(b, dst)
+		massert.Require(t, massert.Nil(err))
+	}
+
+	readMeet := func(conn net.PacketConn) Message {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, MaxMessageSize)
+		for {
+			n, _, err := conn.ReadFrom(b)
+			massert.Require(t, massert.Nil(err))
+			var msg Message
+			massert.Require(t, massert.Nil(msg.UnmarshalBinary(b[:n])))
+			if msg.Type == Meet {
+				return msg
+			}
+		}
+	}
+
+	waitMinglers := func(s *Server, n int) {
+		for len(s.Minglers()) < n {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	massert.Require(t, massert.Nil(err))
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	massert.Require(t, massert.Nil(err))
+
+	upConn := listen()
+	up := NewServer()
+	up.Downstreams = []*net.IPNet{loopback}
+	up.SigningKey = priv
+	go up.Serve(ctx, upConn)
+
+	downConn := listen()
+	down := NewServer()
+	down.Upstream = upConn.LocalAddr().String()
+	down.UpstreamPublicKey = pub
+	go down.Serve(ctx, downConn)
+
+	// the downstream registers with the upstream as a mingler.
+	waitMinglers(up, 1)
+	upMingler := listen()
+	send(upMingler, upConn.LocalAddr(), Message{Type: ReadyToMingle})
+	waitMinglers(up, 2)
+
+	// a HelloServer which the downstream doesn't have enough minglers for is
+	// forwarded, and the upstream introduces the original peer to its own
+	// mingler, but not back to the downstream.
+	peer := listen()
+	send(peer, downConn.LocalAddr(), Message{Type: HelloServer})
+	meet := readMeet(upMingler)
+	massert.Require(t,
+		massert.Equal(peer.LocalAddr().String(), meet.MeetBody.Addr.String()),
+		massert.Equal(uint64(1), down.Stats().HelloServersForwarded),
+		massert.Equal(uint64(1), up.Stats().MeetsSent),
+	)
+
+	// a Meet from the upstream is relayed to one of the downstream's
+	// minglers, once despite being sent PacketBlastCount times.
+	downMingler := listen()
+	send(downMingler, downConn.LocalAddr(), Message{Type: ReadyToMingle})
+	waitMinglers(down, 1)
+
+	peer2 := listen()
+	send(peer2, upConn.LocalAddr(), Message{Type: HelloServer})
+	meet = readMeet(downMingler)
+	massert.Require(t, massert.Equal(peer2.LocalAddr().String(), meet.MeetBody.Addr.String()))
+	time.Sleep(100 * time.Millisecond)
+	massert.Require(t, massert.Equal(uint64(1), down.Stats().MeetsRelayed))
+
+	// forwarded HelloServer messages from elsewhere are dropped.
+	otherConn := listen()
+	other := NewServer()
+	go other.Serve(ctx, otherConn)
+	send(peer, otherConn.LocalAddr(), Message{
+		Type:         HelloServer,
+		ForwardedFor: peer2.LocalAddr(),
+	})
+	for other.Stats().PacketsDropped == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	massert.Require(t, massert.Equal(uint64(0), other.Stats().HelloServers))
+
+	// a federated server must be given the upstream's public key.
+	noKey := NewServer()
+	noKey.Upstream = upConn.LocalAddr().String()
+	massert.Require(t, massert.Not(massert.Nil(noKey.Serve(ctx, listen()))))
+}
+
+func TestConnNetwork(t *T) {
+	for _, test := range []struct {
+		network, addr, exp string
+	}{
+		{"udp4", "127.0.0.1:0", "udp4"},
+		{"udp4", ":0", "udp4"},
+		{"udp6", "[::1]:0", "udp6"},
+		{"udp", ":0", "udp"},
+	} {
+		conn, err := net.ListenPacket(test.network, test.addr)
+		if err != nil {
+			t.Logf("skipping %s %s: %v", test.network, test.addr, err)
+			continue
+		}
+		massert.Require(t, massert.Equal(test.exp, connNetwork(conn)))
+		conn.Close()
+	}
+}
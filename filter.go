@@ -0,0 +1,41 @@
+package bonfire
+
+import (
+	"fmt"
+	"net"
+)
+
+// Verdict is returned by PeerOpts' PacketFilter to decide what happens to a
+// packet.
+type Verdict int
+
+// Verdicts which may be returned by a PacketFilter.
+const (
+	// The packet is handled as normal, as a bonfire message or an application
+	// packet.
+	VerdictAccept Verdict = iota
+
+	// The packet is discarded without any further processing.
+	VerdictDrop
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictAccept:
+		return "Accept"
+	case VerdictDrop:
+		return "Drop"
+	default:
+		return fmt.Sprintf("Verdict(%d)", int(v))
+	}
+}
+
+// filtered returns whether the packet, received from the given address, was
+// dropped by the PacketFilter.
+func (p *Peer) filtered(addr net.Addr, b []byte) bool {
+	if p.po.PacketFilter == nil || p.po.PacketFilter(addr, b) != VerdictDrop {
+		return false
+	}
+	p.stats.packetsFiltered.Add(1)
+	return true
+}
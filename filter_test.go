@@ -0,0 +1,51 @@
+package bonfire
+
+import (
+	"bytes"
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerPacketFilter(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	go NewServer().Serve(ctx, conn)
+
+	peer, err := NewPeer(ctx, "udp", conn.LocalAddr().String(), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		ListenAddr:              "127.0.0.1:0",
+		PacketFilter: func(addr net.Addr, b []byte) Verdict {
+			if bytes.HasPrefix(b, []byte("blocked")) {
+				return VerdictDrop
+			}
+			return VerdictAccept
+		},
+	})
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+
+	appConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer appConn.Close()
+	for _, str := range []string{"blocked", "allowed"} {
+		_, err := appConn.WriteTo([]byte(str), peer.LocalAddr())
+		massert.Require(t, massert.Nil(err))
+	}
+
+	b := make([]byte, MaxMessageSize)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := peer.ReadFrom(b)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal("allowed", string(b[:n])),
+		massert.Equal(appConn.LocalAddr().String(), addr.String()),
+		massert.Equal(uint64(1), peer.Stats().PacketsFiltered),
+	)
+}
@@ -0,0 +1,66 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+// testServer starts a Server on a new loopback socket, which is served until
+// the Context is canceled. If configure is given it's called on the Server
+// before it's served.
+func testServer(ctx context.Context, t *T, configure func(*Server)) (*Server, net.Addr) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	if configure != nil {
+		configure(server)
+	}
+	go server.Serve(ctx, conn)
+	return server, conn.LocalAddr()
+}
+
+// tryTestPeer creates a Peer of the server at the given address, which is
+// closed when the test ends and is read from in the meantime (see readAll).
+// Unless opts says otherwise the Peer binds to a loopback address and doesn't
+// fall back to its gateway.
+func tryTestPeer(ctx context.Context, t *T, serverAddr string, opts PeerOpts) (*Peer, error) {
+	if opts.InitTimeoutUntilGateway == 0 {
+		opts.InitTimeoutUntilGateway = -1
+	}
+	if opts.ListenAddr == "" {
+		opts.ListenAddr = "127.0.0.1:0"
+	}
+	peer, err := NewPeer(ctx, "udp", serverAddr, &opts)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { peer.Close() })
+	readAll(peer)
+	return peer, nil
+}
+
+// testPeer is like tryTestPeer, but fails the test if the Peer can't be
+// created.
+func testPeer(ctx context.Context, t *T, serverAddr string, opts PeerOpts) *Peer {
+	peer, err := tryTestPeer(ctx, t, serverAddr, opts)
+	massert.Require(t, massert.Nil(err))
+	return peer
+}
+
+// readAll reads from the Peer in the background until it's closed, so that the
+// bonfire messages it receives are processed.
+func readAll(peer *Peer) {
+	peer.SetReadDeadline(time.Time{})
+	go func() {
+		b := make([]byte, MaxMessageSize)
+		for {
+			if _, _, err := peer.ReadFrom(b); err != nil {
+				return
+			}
+		}
+	}()
+}
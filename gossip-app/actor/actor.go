@@ -0,0 +1,682 @@
+// Package actor implements an actor of the gossip testing framework, an
+// example app where peers declare either their possession or their need for
+// arbitrary resources, with resources being identified by some unique (and
+// mostly arbitrary) string.
+//
+// Actors are normally run one per process by cmd/actor, but Run can also be
+// used to run many of them as go-routines within a single process.
+package actor
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bonfire"
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// MsgType denotes what kind of information is being conveyed in a Msg.
+type MsgType int
+
+// The possible values of MsgType.
+const (
+	MsgTypeHave MsgType = iota
+	MsgTypeDontHave
+	MsgTypeNeeds
+
+	// MsgTypeShuffle and MsgTypeShuffleReply exchange samples of the sender's
+	// partial view of the network, see membership.
+	MsgTypeShuffle
+	MsgTypeShuffleReply
+
+	// MsgTypePing, MsgTypePingReq and MsgTypeAck probe whether a peer is still
+	// alive, see detector.
+	MsgTypePing
+	MsgTypePingReq
+	MsgTypeAck
+)
+
+func (t MsgType) String() string {
+	switch t {
+	case MsgTypeHave:
+		return "have"
+	case MsgTypeDontHave:
+		return "dont-have"
+	case MsgTypeNeeds:
+		return "needs"
+	case MsgTypeShuffle:
+		return "shuffle"
+	case MsgTypeShuffleReply:
+		return "shuffle-reply"
+	case MsgTypePing:
+		return "ping"
+	case MsgTypePingReq:
+		return "ping-req"
+	case MsgTypeAck:
+		return "ack"
+	default:
+		return "unknown"
+	}
+}
+
+// Msg describes the structure of a message which is gossiped around the
+// network.
+type Msg struct {
+	MsgType MsgType `db:"state"`
+
+	// These two values form a uniqueness key. In other words, a peer can only
+	// have one state ("has", "needs", etc...) per resource. Addr is that of
+	// the message's origin, i.e. the peer whose state it describes.
+	Addr     string // host:port
+	Resource string
+
+	// If set, the host:port of the peer which sent the message on the origin's
+	// behalf, having learned of the origin's state itself, rather than the
+	// origin sending it first-hand.
+	Relayer string
+
+	// Used when a peer is sending messages to denote message order to other
+	// peers. Nonces increase monotonically per Addr/Resource, see
+	// gossip.Sequencer. 0 means the sender doesn't know the nonce, which
+	// orders the message before all others.
+	Nonce uint64
+
+	// Addresses of peers, exchanged by shuffle messages. Ping, PingReq and
+	// Ack messages use it to carry the peer being probed on behalf of.
+	Peers []string `msgpack:",omitempty"`
+}
+
+type app struct {
+	peer   *peer
+	db     *db
+	seq    *gossip.Sequencer
+	events *gossip.EventLog
+	rand   *rand.Rand
+
+	// the bonfire peer's remote address, which identifies the actor. It's
+	// only changed by readdress, see addr.
+	addrL    sync.Mutex
+	thisAddr string
+
+	coordConn  *coordConn
+	coordMsgCh chan gossip.CoordMsg
+
+	// written to by handleCoord when the coordinator sends a
+	// CoordMsgShutdown, see shutdown.
+	shutdownCh chan struct{}
+
+	// Needs messages from peers which are waiting to be answered.
+	needsQ *msgQueue
+
+	// guards resources and needs, which are shared by the pipelines, see run.
+	l         sync.Mutex
+	resources map[string]bool
+
+	// resources which the coordinator has said the actor needs, but which it
+	// hasn't yet found a peer having.
+	needs map[string]bool
+
+	// the bonfire peer's set of peers, kept up-to-date incrementally using
+	// PeerAddrsSince.
+	peerAddrs    map[string]struct{}
+	peerAddrsGen uint64
+
+	// the actor's partial view of the network, which messages are sprayed to.
+	members *membership
+
+	// detects failed peers in the active view.
+	detector *detector
+
+	// the peerAddrsGen which was last reported to the coordinator.
+	reportedPeerAddrsGen uint64
+
+	// the number of dropped peer messages which was last reported to the
+	// coordinator.
+	reportedDropped uint64
+
+	// the number of evicted database rows which was last reported to the
+	// coordinator.
+	reportedEvicted uint64
+
+	// how long queued messages may be processed for once the actor is
+	// stopping.
+	drainTimeout time.Duration
+
+	// how often resources are sprayed, needs sought, and reports sent to the
+	// coordinator.
+	tickInterval time.Duration
+
+	// how recently a peer must have been heard of having a resource for that
+	// to be believed, see Config's PeerActiveTimeout.
+	peerActiveTimeout time.Duration
+
+	// the number of active peers each message is sprayed to, or 0 for half of
+	// them plus one.
+	sprayFanout int
+
+	// when each resource is next sprayed, and the limit on how quickly
+	// packets are sprayed. These are only used by the schedule pipeline.
+	sprays *sprayScheduler
+	pacer  pacer
+}
+
+// addr returns the address which currently identifies the actor.
+func (app *app) addr() string {
+	app.addrL.Lock()
+	defer app.addrL.Unlock()
+	return app.thisAddr
+}
+
+// event writes an Event concerning this actor to the event log, if there is
+// one. Errors are only logged, as the event log is purely diagnostic.
+func (app *app) event(ctx context.Context, event string, fields map[string]string) {
+	err := app.events.Log(gossip.Event{
+		Source: app.addr(),
+		Actor:  app.addr(),
+		Event:  event,
+		Fields: fields,
+	})
+	if err != nil {
+		mlog.Warn("error writing to event log", ctx, merr.Context(err))
+	}
+}
+
+// updatePeerAddrs brings peerAddrs up-to-date with the bonfire peer's set of
+// peers, adding and removing them from the membership as well.
+func (app *app) updatePeerAddrs() {
+	now := time.Now()
+	diff := app.peer.PeerAddrsSince(app.peerAddrsGen)
+	prev := app.peerAddrs
+	if diff.Full {
+		app.peerAddrs = map[string]struct{}{}
+	}
+	for _, addr := range diff.Added {
+		app.peerAddrs[addr.String()] = struct{}{}
+		app.members.add(addr.String(), now)
+	}
+	for _, addr := range diff.Removed {
+		delete(app.peerAddrs, addr.String())
+		app.members.remove(addr.String(), now)
+	}
+	if diff.Full {
+		for addr := range prev {
+			if _, ok := app.peerAddrs[addr]; !ok {
+				app.members.remove(addr, now)
+			}
+		}
+	}
+	app.peerAddrsGen = diff.Gen
+}
+
+// reportMsgQueue tells the coordinator how saturated the queue of messages
+// received from peers has been since the last report, warning if any have been
+// dropped, either from it or from the queue of Needs messages waiting to be
+// answered.
+func (app *app) reportMsgQueue(ctx context.Context) error {
+	curLen, maxLen, dropped := app.peer.msgs.stats()
+	_, _, needsDropped := app.needsQ.stats()
+	dropped += needsDropped
+	if dropped > app.reportedDropped {
+		ctx := mctx.Annotate(ctx,
+			"dropped", dropped-app.reportedDropped,
+			"total-dropped", dropped,
+		)
+		mlog.Warn("messages from peers were dropped due to a full queue", ctx)
+		app.event(ctx, "msgs-dropped", map[string]string{
+			"dropped":       strconv.FormatUint(dropped-app.reportedDropped, 10),
+			"total-dropped": strconv.FormatUint(dropped, 10),
+		})
+	}
+
+	msg := &gossip.CoordMsgMsgQueue{
+		Len:     curLen,
+		MaxLen:  maxLen,
+		Dropped: dropped,
+	}
+	if app.peer.msgs.overflow == MsgOverflowDrop {
+		msg.Size = app.peer.msgs.size
+	}
+	if err := app.coordConn.Encode(msg); err != nil {
+		return err
+	}
+	app.reportedDropped = dropped
+	return nil
+}
+
+// reportDB tells the coordinator how large the database is and how long its
+// queries have taken, warning if any rows have been evicted since the last
+// report.
+func (app *app) reportDB(ctx context.Context) error {
+	rows, evicted, err := app.db.stats()
+	if err != nil {
+		return err
+	} else if evicted > app.reportedEvicted {
+		ctx := mctx.Annotate(ctx,
+			"evicted", evicted-app.reportedEvicted,
+			"total-evicted", evicted,
+		)
+		mlog.Warn("database rows were evicted due to the database being full", ctx)
+		app.event(ctx, "db-evicted", map[string]string{
+			"evicted":       strconv.FormatUint(evicted-app.reportedEvicted, 10),
+			"total-evicted": strconv.FormatUint(evicted, 10),
+		})
+	}
+
+	err = app.coordConn.Encode(&gossip.CoordMsgDB{
+		Rows:    rows,
+		MaxRows: app.db.maxRows,
+		Evicted: evicted,
+		Queries: app.db.queryStats(),
+	})
+	if err != nil {
+		return err
+	}
+	app.reportedEvicted = evicted
+	return nil
+}
+
+// reportPeers tells the coordinator about the bonfire peer's set of peers, if
+// it's changed since the last time.
+func (app *app) reportPeers(ctx context.Context) error {
+	app.updatePeerAddrs()
+	if app.peerAddrsGen == app.reportedPeerAddrsGen {
+		return nil
+	}
+
+	addrs := make([]string, 0, len(app.peerAddrs))
+	for addr := range app.peerAddrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	if err := app.coordConn.Encode(&gossip.CoordMsgPeers{Addrs: addrs}); err != nil {
+		return err
+	}
+	app.reportedPeerAddrsGen = app.peerAddrsGen
+	app.event(ctx, "peers-changed", map[string]string{
+		"peers": strconv.Itoa(len(addrs)),
+	})
+	return nil
+}
+
+// updateMembers brings the membership up-to-date with the bonfire peer's set of
+// peers and with those recently heard of, expires active peers which haven't
+// been heard from, and starts a shuffle.
+func (app *app) updateMembers(ctx context.Context, thisAddr string) error {
+	app.updatePeerAddrs()
+
+	now := time.Now()
+	dbPeerAddrs, err := app.db.peers(now.Add(-app.peerActiveTimeout))
+	if err != nil {
+		return err
+	}
+	app.members.integrate(dbPeerAddrs, now)
+
+	if expired := app.members.expire(now); len(expired) > 0 {
+		mlog.Info("active peers expired", mctx.Annotate(ctx, "expired", len(expired)))
+		app.event(ctx, "peers-expired", map[string]string{
+			"expired": strings.Join(expired, ","),
+		})
+	}
+
+	dst, addrs, ok := app.members.shuffle()
+	if !ok {
+		return nil
+	}
+	return app.peer.Send(Msg{
+		MsgType: MsgTypeShuffle,
+		Addr:    thisAddr,
+		Peers:   addrs,
+	}, dst)
+}
+
+// spray sends the message to a random sample of the actor's active peers, see
+// Config's SprayFanout, first waiting for the pacer to allow it.
+func (app *app) spray(ctx context.Context, msg Msg) error {
+	fanout := app.sprayFanout
+	if fanout == 0 {
+		fanout = app.members.activeLen()/2 + 1
+	}
+	addrs := app.members.sample(fanout)
+
+	if wait := app.pacer.reserve(len(addrs), time.Now()); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return app.peer.Send(msg, addrs...)
+}
+
+// seek checks whether any peer is known to have the needed resource, in which
+// case the actor obtains it from them and tells the coordinator. Otherwise it
+// sprays a message asking for the resource.
+func (app *app) seek(ctx context.Context, thisAddr, resource string) error {
+	ctx = mctx.Annotate(ctx, "resource", resource)
+	since := time.Now().Add(-app.peerActiveTimeout)
+	claims, err := app.db.claimsWith(resource, since)
+	if err != nil {
+		return err
+	} else if len(claims) > 0 {
+		// claims are ordered such that first-hand ones come first.
+		ctx := mctx.Annotate(ctx,
+			"from", claims[0].Addr,
+			"learned-from", claims[0].LearnedFrom,
+			"first-hand", claims[0].FirstHand,
+		)
+		mlog.Info("obtained needed resource", ctx)
+		app.event(ctx, "obtained", map[string]string{
+			"resource":     resource,
+			"from":         claims[0].Addr,
+			"learned-from": claims[0].LearnedFrom,
+			"first-hand":   strconv.FormatBool(claims[0].FirstHand),
+		})
+		app.l.Lock()
+		delete(app.needs, resource)
+		app.resources[resource] = true
+		app.l.Unlock()
+		return app.coordConn.Encode(&gossip.CoordMsgHave{Resource: resource})
+	}
+
+	nonce, err := app.seq.Next(thisAddr, resource)
+	if err != nil {
+		return err
+	}
+
+	mlog.Info("spraying need", ctx)
+	return app.spray(ctx, Msg{
+		MsgType:  MsgTypeNeeds,
+		Addr:     thisAddr,
+		Resource: resource,
+		Nonce:    nonce,
+	})
+}
+
+// Config describes an actor to be run by Run.
+type Config struct {
+	// Address of a bonfire server which can be used to find other peers.
+	ServerAddr string
+
+	// If set, ServerAddr is ignored and the actor's bonfire Peer only greets
+	// these peers (see bonfire.PeerOpts' SeedPeers), and accepts greetings
+	// from others which have it in their lists. This gives a static topology,
+	// as a control group against which bonfire's discovery can be compared.
+	StaticPeers []string
+
+	// If set, messages the actor sends to its peers are encrypted and
+	// authenticated with this key, and those received from its peers which
+	// weren't sealed with it are dropped, so every actor in the network must
+	// be given the same key. It must be 16, 24 or 32 bytes long, selecting
+	// AES-128, AES-192 or AES-256.
+	NetworkKey []byte
+
+	// If set, the actor's bonfire Peer uses this socket rather than binding
+	// one of its own, e.g. one from a bftest.Network so that many actors can
+	// share a simulated network. It is closed when Run returns.
+	PacketConn net.PacketConn
+
+	// Options for the actor's bonfire Peer, may be nil.
+	PeerOpts *bonfire.PeerOpts
+
+	// Connection to the coordination server which will tell the actor what to
+	// do. It is closed when Run returns.
+	CoordConn net.Conn
+
+	// The number of messages received from peers which may be waiting to be
+	// processed, and separately the number of Needs messages which may be
+	// waiting to be answered. Default is 128.
+	MsgQueueSize int
+
+	// What happens to messages received from peers once MsgQueueSize are
+	// already waiting to be processed. Default is MsgOverflowDrop.
+	MsgOverflow MsgOverflow
+
+	// The maximum number of peer/resource states which the actor records.
+	// Once there are this many, recording another evicts the least recently
+	// updated. Default is 0, meaning no limit.
+	MaxDBRows int
+
+	// Queries to the actor's database which take at least this long are
+	// logged. Default is 100ms. If negative no queries are logged.
+	SlowQueryThreshold time.Duration
+
+	// How often the actor sprays the resources it has, seeks those it needs,
+	// and reports to the coordinator. Default is 2 seconds. Must not be
+	// negative.
+	TickInterval time.Duration
+
+	// How long ago a peer may last have been heard of having a resource for
+	// the actor to still believe it does. Older claims aren't used to find
+	// needed resources, answer Needs messages, or fill the actor's views.
+	// Default is 5 minutes.
+	PeerActiveTimeout time.Duration
+
+	// The number of active peers which each message the actor sprays is sent
+	// to. Default is 0, meaning half of them plus one. Must not be negative.
+	SprayFanout int
+
+	// Each resource the actor has is sprayed once every TickInterval, at its
+	// own point within the interval, plus or minus up to half of SprayJitter.
+	// Default is a quarter of TickInterval. If negative there is no jitter.
+	SprayJitter time.Duration
+
+	// The most packets per second which the actor sprays, including those
+	// seeking resources it needs. Sprays wait until they're allowed. Default
+	// is 0, meaning no limit.
+	MaxSprayRate int
+
+	// The number of peers in the actor's active view of the network, which
+	// messages are sprayed to, and in its passive view, which replaces active
+	// peers as they fail. Defaults are 8 and 32. Active peers which aren't
+	// heard from within 3*ActiveViewSize ticks are considered to have failed.
+	ActiveViewSize, PassiveViewSize int
+
+	// How long an active peer which is suspected of having failed, having not
+	// acked a ping, may go without being heard from before it's confirmed as
+	// failed. It is then removed from the active view, and the resources it
+	// was recorded as having are marked stale. Default is 5*TickInterval.
+	SuspectTimeout time.Duration
+
+	// How long messages which are still queued when the actor stops may be
+	// processed for before being dropped. Default is 5 seconds. If negative
+	// they are always dropped.
+	DrainTimeout time.Duration
+
+	// The seed for the random decisions made by the actor, i.e. which peers
+	// messages are sprayed to, so that runs can be repeated. If 0 a random
+	// seed is used, which is logged and written to the EventLog.
+	Seed int64
+
+	// If set, the actor writes Events describing what it's doing to this
+	// EventLog, with its peer address as their Source. It is not closed when
+	// Run returns.
+	EventLog *gossip.EventLog
+}
+
+func (cfg Config) withDefaults() Config {
+	if cfg.MsgQueueSize == 0 {
+		cfg.MsgQueueSize = 128
+	}
+	if cfg.TickInterval == 0 {
+		cfg.TickInterval = 2 * time.Second
+	}
+	if cfg.ActiveViewSize == 0 {
+		cfg.ActiveViewSize = 8
+	}
+	if cfg.PassiveViewSize == 0 {
+		cfg.PassiveViewSize = 32
+	}
+	if cfg.PeerActiveTimeout == 0 {
+		cfg.PeerActiveTimeout = 5 * time.Minute
+	}
+	if cfg.SuspectTimeout == 0 {
+		cfg.SuspectTimeout = 5 * cfg.TickInterval
+	}
+	if cfg.SprayJitter == 0 {
+		cfg.SprayJitter = cfg.TickInterval / 4
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = 5 * time.Second
+	}
+	if cfg.SlowQueryThreshold == 0 {
+		cfg.SlowQueryThreshold = 100 * time.Millisecond
+	}
+	return cfg
+}
+
+// validate returns an error if the Config, with defaults applied, can't be run
+// with.
+func (cfg Config) validate(ctx context.Context) error {
+	if cfg.TickInterval < 0 {
+		return merr.New("TickInterval must not be negative",
+			mctx.Annotate(ctx, "tick-interval", cfg.TickInterval.String()))
+	} else if cfg.SprayFanout < 0 {
+		return merr.New("SprayFanout must not be negative",
+			mctx.Annotate(ctx, "spray-fanout", strconv.Itoa(cfg.SprayFanout)))
+	}
+	return nil
+}
+
+// Run runs an actor until the given Context is canceled or the coordinator
+// sends a CoordMsgShutdown, in which case nil is returned, or until it
+// encounters an error. Each actor has its own in-memory database, so any number
+// may be run at once. When stopping, messages from peers which are still queued
+// are processed (see DrainTimeout) before the database is closed. When shut
+// down by the coordinator the actor also sends it final reports, see shutdown.
+func Run(ctx context.Context, cfg Config) error {
+	// the actor's components create their own children (e.g. "coord"), which
+	// mustn't collide with those of the caller's Context.
+	ctx = mctx.NewChild(ctx, "actor")
+	cfg = cfg.withDefaults()
+	coordConn := newCoordConn(ctx, cfg.CoordConn)
+	defer coordConn.Close()
+
+	if err := cfg.validate(ctx); err != nil {
+		if cfg.PacketConn != nil {
+			cfg.PacketConn.Close()
+		}
+		return err
+	}
+
+	db, err := newDB(ctx, cfg)
+	if err != nil {
+		if cfg.PacketConn != nil {
+			cfg.PacketConn.Close()
+		}
+		return err
+	}
+	defer db.Close()
+
+	peer, err := newPeer(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	thisAddr := peer.addr()
+	app := &app{
+		peer:       peer,
+		db:         db,
+		seq:        &gossip.Sequencer{Store: db},
+		events:     cfg.EventLog,
+		rand:       rand.New(rand.NewSource(seed)),
+		thisAddr:   thisAddr,
+		coordConn:  coordConn,
+		coordMsgCh: make(chan gossip.CoordMsg),
+		shutdownCh: make(chan struct{}, 1),
+		needsQ:     newMsgQueue(cfg.MsgQueueSize, MsgOverflowDrop),
+		resources:  map[string]bool{},
+		needs:      map[string]bool{},
+		peerAddrs:  map[string]struct{}{},
+
+		drainTimeout: cfg.DrainTimeout,
+		tickInterval: cfg.TickInterval,
+		pacer:        pacer{rate: cfg.MaxSprayRate},
+
+		peerActiveTimeout: cfg.PeerActiveTimeout,
+		sprayFanout:       cfg.SprayFanout,
+	}
+	app.members = newMembership(
+		thisAddr, cfg.ActiveViewSize, cfg.PassiveViewSize,
+		3*time.Duration(cfg.ActiveViewSize)*cfg.TickInterval, seed,
+	)
+	app.detector = newDetector(cfg.SuspectTimeout, seed)
+	app.sprays = newSprayScheduler(cfg.TickInterval, cfg.SprayJitter, app.rand)
+
+	seedStr := strconv.FormatInt(seed, 10)
+	mlog.Info("actor started", mctx.Annotate(ctx, "addr", thisAddr, "seed", seedStr))
+	app.event(ctx, "started", map[string]string{"seed": seedStr})
+
+	// the first of the go-routines to return stops the others.
+	threadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, 3)
+	wg := new(sync.WaitGroup)
+	thread := func(fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh <- fn()
+		}()
+	}
+
+	thread(func() error { return peer.spin(threadCtx) })
+	thread(func() error { return coordConn.run(threadCtx, thisAddr, app.coordMsgCh) })
+	thread(func() error { return app.run(threadCtx) })
+
+	var shutdown bool
+	select {
+	case err = <-errCh:
+	case <-app.shutdownCh:
+		shutdown = true
+	}
+	cancel()
+	wg.Wait()
+	if shutdown {
+		return app.shutdown(ctx)
+	} else if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// shutdown is called once the coordinator has sent a CoordMsgShutdown and the
+// pipelines have stopped, and so queued messages have been drained. It closes
+// the bonfire peer, so that no more messages are received, sends the final
+// reports to the coordinator, and acknowledges the shutdown by sending a
+// CoordMsgShutdown back.
+func (app *app) shutdown(ctx context.Context) error {
+	mlog.Info("shutting down at the coordinator's request", ctx)
+	if err := app.peer.Close(); err != nil {
+		mlog.Warn("error closing peer", ctx, merr.Context(err))
+	}
+
+	if err := app.reportPeers(ctx); err != nil {
+		return err
+	} else if err := app.reportMsgQueue(ctx); err != nil {
+		return err
+	} else if err := app.reportDB(ctx); err != nil {
+		return err
+	} else if err := app.coordConn.Encode(&gossip.CoordMsgShutdown{}); err != nil {
+		return err
+	}
+	app.event(ctx, "shutdown", nil)
+
+	// the coordinator closes the connection once it's read the acknowledgement.
+	app.coordConn.awaitClose(5 * time.Second)
+	return nil
+}
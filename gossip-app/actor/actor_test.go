@@ -0,0 +1,266 @@
+package actor
+
+import (
+	"context"
+	"net"
+	"strconv"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/bonfire"
+	"github.com/mediocregopher/bonfire/bftest"
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/mediocre-go-lib/mtest"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestRunInProcess(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	network := bftest.NewNetwork()
+	serverConn, err := network.ListenPacket("10.0.0.1:7890")
+	massert.Require(t, massert.Nil(err))
+	go bonfire.NewServer().Serve(ctx, serverConn)
+
+	const numActors = 10
+	runCtx, stop := context.WithCancel(ctx)
+	errCh := make(chan error, numActors)
+	var coords []*gossip.CoordConn
+	for range numActors {
+		conn, err := network.ListenPacket("")
+		massert.Require(t, massert.Nil(err))
+		actorCoordConn, coordConn := net.Pipe()
+		coords = append(coords, gossip.NewCoordConn(coordConn))
+		go func() {
+			errCh <- Run(runCtx, Config{
+				ServerAddr: "10.0.0.1:7890",
+				PacketConn: conn,
+				PeerOpts:   &bonfire.PeerOpts{InitTimeoutUntilGateway: -1},
+				CoordConn:  actorCoordConn,
+			})
+		}()
+	}
+
+	// every actor says hello to the coordinator with its own address.
+	addrs := map[string]bool{}
+	for _, coord := range coords {
+		msg, err := coord.Decode()
+		massert.Require(t, massert.Nil(err))
+		hello, ok := msg.(*gossip.CoordMsgHello)
+		massert.Require(t, massert.Equal(true, ok))
+		addrs[hello.Addr] = true
+	}
+	massert.Require(t, massert.Length(addrs, numActors))
+
+	stop()
+	for range numActors {
+		massert.Require(t, massert.Nil(<-errCh))
+	}
+}
+
+func TestRunShutdown(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	network := bftest.NewNetwork()
+	serverConn, err := network.ListenPacket("10.0.0.1:7890")
+	massert.Require(t, massert.Nil(err))
+	go bonfire.NewServer().Serve(ctx, serverConn)
+
+	conn, err := network.ListenPacket("")
+	massert.Require(t, massert.Nil(err))
+	actorCoordConn, coordConn := net.Pipe()
+	coord := gossip.NewCoordConn(coordConn)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Run(ctx, Config{
+			ServerAddr: "10.0.0.1:7890",
+			PacketConn: conn,
+			PeerOpts:   &bonfire.PeerOpts{InitTimeoutUntilGateway: -1},
+			CoordConn:  actorCoordConn,
+		})
+	}()
+
+	msg, err := coord.Decode()
+	massert.Require(t, massert.Nil(err))
+	massert.Require(t, massert.Equal(gossip.CoordMsgTypeHello, msg.Type()))
+	massert.Require(t, massert.Nil(coord.Encode(&gossip.CoordMsgShutdown{})))
+
+	// the final reports are sent before the shutdown is acknowledged, and
+	// once the connection is closed the actor stops without its Context being
+	// canceled.
+	reports := map[gossip.CoordMsgType]bool{}
+	for {
+		msg, err := coord.Decode()
+		massert.Require(t, massert.Nil(err))
+		if msg.Type() == gossip.CoordMsgTypeShutdown {
+			break
+		}
+		reports[msg.Type()] = true
+	}
+	coord.Close()
+	massert.Require(t,
+		massert.Equal(true, reports[gossip.CoordMsgTypeMsgQueue]),
+		massert.Equal(true, reports[gossip.CoordMsgTypeDB]),
+		massert.Nil(<-errCh),
+	)
+}
+
+func TestAppDrain(t *T) {
+	ctx := mtest.Context()
+
+	newApp := func(drainTimeout time.Duration) *app {
+		db, err := newDB(ctx, Config{})
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { db.Close() })
+
+		app := &app{
+			peer:         &peer{msgs: newMsgQueue(128, MsgOverflowDrop)},
+			db:           db,
+			members:      newMembership("10.0.0.1:1", 8, 32, time.Minute, 1),
+			detector:     newDetector(time.Minute, 1),
+			drainTimeout: drainTimeout,
+		}
+		for _, addr := range []string{"10.0.0.2:1", "10.0.0.3:1"} {
+			app.peer.msgs.push(msgEvent{
+				Msg: Msg{
+					MsgType:  MsgTypeHave,
+					Addr:     addr,
+					Resource: "foo",
+					Nonce:    1,
+				},
+				PeerAddr: addr,
+				TS:       time.Now(),
+			})
+		}
+		return app
+	}
+
+	since := time.Now().Add(-time.Minute)
+
+	app := newApp(time.Second)
+	app.drain(ctx)
+	peerAddrs, err := app.db.peersWith("foo", since)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(peerAddrs, 2),
+	)
+	_, ok := app.peer.msgs.pop()
+	massert.Require(t, massert.Equal(false, ok))
+
+	// with a negative timeout queued messages are dropped.
+	app = newApp(-1)
+	app.drain(ctx)
+	peerAddrs, err = app.db.peersWith("foo", since)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(peerAddrs, 0),
+	)
+	_, ok = app.peer.msgs.pop()
+	massert.Require(t, massert.Equal(false, ok))
+}
+
+func TestAppIngestBatch(t *T) {
+	ctx := mtest.Context()
+	db, err := newDB(ctx, Config{})
+	massert.Require(t, massert.Nil(err))
+	defer db.Close()
+
+	app := &app{
+		peer:     &peer{msgs: newMsgQueue(ingestBatchSize*2, MsgOverflowDrop)},
+		db:       db,
+		needsQ:   newMsgQueue(ingestBatchSize, MsgOverflowDrop),
+		members:  newMembership("10.0.0.1:1", 8, 32, time.Minute, 1),
+		detector: newDetector(time.Minute, 1),
+	}
+	msg := func(msgType MsgType, i int) msgEvent {
+		addr := "10.0.0.2:" + strconv.Itoa(i+1)
+		return msgEvent{
+			Msg: Msg{
+				MsgType:  msgType,
+				Addr:     addr,
+				Resource: "foo",
+				Nonce:    1,
+			},
+			PeerAddr: addr,
+			TS:       time.Now(),
+		}
+	}
+	for i := range ingestBatchSize + 1 {
+		app.peer.msgs.push(msg(MsgTypeHave, i))
+	}
+	app.peer.msgs.push(msg(MsgTypeNeeds, 0))
+
+	// batches are limited in size.
+	since := time.Now().Add(-time.Minute)
+	massert.Require(t, massert.Equal(ingestBatchSize, app.ingestBatch(ctx, true)))
+	peerAddrs, err := app.db.peersWith("foo", since)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(peerAddrs, ingestBatchSize),
+	)
+
+	// Needs aren't recorded, but are passed on to needsQ.
+	massert.Require(t, massert.Equal(2, app.ingestBatch(ctx, true)))
+	massert.Require(t, massert.Equal(0, app.ingestBatch(ctx, true)))
+	peerAddrs, err = app.db.peersWith("foo", since)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(peerAddrs, ingestBatchSize+1),
+	)
+
+	var needs []string
+	for ev, ok := app.needsQ.pop(); ok; ev, ok = app.needsQ.pop() {
+		needs = append(needs, ev.Addr)
+	}
+	massert.Require(t, massert.Equal([]string{"10.0.0.2:1"}, needs))
+}
+
+func TestPeerSpinEvents(t *T) {
+	ctx, cancel := context.WithCancel(mtest.Context())
+	defer cancel()
+
+	peer := &peer{addrCh: make(chan string, 1)}
+	eventCh := make(chan bonfire.PeerEvent)
+	appEventCh := make(chan bonfire.PeerEvent, 8)
+	go peer.spinEvents(ctx, eventCh, appEventCh)
+
+	addrChanged := func(addr string) bonfire.PeerEvent {
+		return bonfire.PeerEvent{
+			Type: bonfire.PeerEventRemoteAddrChanged,
+			Addr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: len(addr)},
+		}
+	}
+	eventCh <- bonfire.PeerEvent{Type: bonfire.PeerEventError}
+	eventCh <- addrChanged("a")
+	eventCh <- addrChanged("bb")
+
+	// every event is passed on, but only the latest address is kept.
+	for _, typ := range []bonfire.PeerEventType{
+		bonfire.PeerEventError,
+		bonfire.PeerEventRemoteAddrChanged,
+		bonfire.PeerEventRemoteAddrChanged,
+	} {
+		massert.Require(t, massert.Equal(typ, (<-appEventCh).Type))
+	}
+	massert.Require(t, massert.Equal("10.0.0.1:2", <-peer.addrCh))
+	select {
+	case addr := <-peer.addrCh:
+		t.Fatalf("unexpected address %q", addr)
+	default:
+	}
+}
+
+func TestRunInvalidConfig(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, cfg := range []Config{
+		{TickInterval: -time.Second},
+		{SprayFanout: -1},
+	} {
+		_, cfg.CoordConn = net.Pipe()
+		massert.Require(t, massert.Not(massert.Nil(Run(ctx, cfg))))
+	}
+}
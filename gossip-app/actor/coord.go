@@ -1,50 +1,58 @@
-package main
+package actor
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/mediocregopher/bonfire/gossip-app"
-	"github.com/mediocregopher/mediocre-go-lib/mcfg"
 	"github.com/mediocregopher/mediocre-go-lib/mctx"
 	"github.com/mediocregopher/mediocre-go-lib/merr"
 	"github.com/mediocregopher/mediocre-go-lib/mlog"
-	"github.com/mediocregopher/mediocre-go-lib/mrun"
 )
 
 type coordConn struct {
 	ctx  context.Context
 	conn net.Conn
 	*gossip.CoordConn
+
+	// messages are encoded both by run and by the app.
+	encL sync.Mutex
 }
 
-func withCoordConn(parent context.Context) (context.Context, *coordConn) {
-	cc := &coordConn{
-		ctx: mctx.NewChild(parent, "coord"),
+func newCoordConn(ctx context.Context, conn net.Conn) *coordConn {
+	return &coordConn{
+		ctx:       mctx.Annotate(mctx.NewChild(ctx, "coord"), "addr", conn.RemoteAddr().String()),
+		conn:      conn,
+		CoordConn: gossip.NewCoordConn(conn),
 	}
+}
 
-	var addr *string
-	cc.ctx, addr = mcfg.WithString(cc.ctx, "addr", "127.0.0.1:9876", "Address of the coordination server which will tell this actor what to do")
-
-	cc.ctx = mrun.WithStartHook(cc.ctx, func(context.Context) error {
-		cc.ctx = mctx.Annotate(cc.ctx, "addr", *addr)
-		mlog.Info("dialing coord server", cc.ctx)
-		conn, err := net.Dial("tcp", *addr)
-		if err != nil {
-			return merr.Wrap(err, cc.ctx)
-		}
-		cc.conn = conn
-		cc.CoordConn = gossip.NewCoordConn(conn)
-		return nil
-	})
+// Encode encodes the message onto the connection to the coordination server.
+// It may be called from multiple go-routines.
+func (cc *coordConn) Encode(msg gossip.CoordMsg) error {
+	cc.encL.Lock()
+	defer cc.encL.Unlock()
+	return cc.CoordConn.Encode(msg)
+}
 
-	cc.ctx = mrun.WithStopHook(cc.ctx, func(context.Context) error {
-		mlog.Info("closing connection to coord server", cc.ctx)
-		return cc.CoordConn.Close()
-	})
+// Close closes the connection to the coordination server.
+func (cc *coordConn) Close() error {
+	mlog.Info("closing connection to coord server", cc.ctx)
+	return cc.CoordConn.Close()
+}
 
-	return mctx.WithChild(parent, cc.ctx), cc
+// awaitClose discards anything read from the connection until the coordinator
+// closes it, or until the timeout has elapsed. If the connection were closed
+// with unread data it would be reset, and what was last written to it may never
+// be read by the coordinator.
+func (cc *coordConn) awaitClose(timeout time.Duration) {
+	cc.conn.SetReadDeadline(time.Now().Add(timeout))
+	io.Copy(io.Discard, cc.conn)
 }
 
 // run will block until the given Context is canceled or an error is
@@ -57,22 +65,35 @@ func (cc *coordConn) run(ctx context.Context, peerAddr string, msgCh chan<- goss
 		return merr.Wrap(err, cc.ctx, ctx)
 	}
 
+	// reading is interrupted once the Context is done, rather than waiting for
+	// the deadline.
+	stop := context.AfterFunc(ctx, func() {
+		cc.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
 	doneCh := ctx.Done()
 	for {
+		// the Context is checked after setting the deadline, so that it can't
+		// overwrite the one set by AfterFunc.
+		cc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 		select {
 		case <-doneCh:
 			return merr.Wrap(ctx.Err(), cc.ctx, ctx)
 		default:
 		}
 
-		cc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 		msg, err := cc.Decode()
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		if errors.Is(merr.Base(err), os.ErrDeadlineExceeded) {
 			continue
 		} else if err != nil {
 			return merr.Wrap(err, cc.ctx, ctx)
 		}
 
-		msgCh <- msg
+		select {
+		case msgCh <- msg:
+		case <-doneCh:
+			return merr.Wrap(ctx.Err(), cc.ctx, ctx)
+		}
 	}
 }
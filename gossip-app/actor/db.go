@@ -1,87 +1,293 @@
-package main
+package actor
 
 import (
 	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/mediocregopher/bonfire/gossip-app"
 	"github.com/mediocregopher/mediocre-go-lib/mctx"
 	"github.com/mediocregopher/mediocre-go-lib/merr"
 	"github.com/mediocregopher/mediocre-go-lib/mlog"
-	"github.com/mediocregopher/mediocre-go-lib/mrun"
 	"github.com/mediocregopher/mediocre-go-lib/mtime"
 )
 
 type db struct {
 	ctx context.Context
 	*sqlx.DB
+
+	// the maximum number of rows in peer_resources, or 0 for no limit, and
+	// the number of rows which have been evicted to stay within it.
+	maxRows int
+	evicted atomic.Uint64
+
+	// queries taking at least this long are logged, if it's greater than 0.
+	slowQuery time.Duration
+
+	queriesL sync.Mutex
+	queries  map[string]*gossip.QueryStats
 }
 
-func withDB(ctx context.Context) (context.Context, *db) {
+// newDB creates a new, empty, in-memory database, using the Config's MaxDBRows
+// and SlowQueryThreshold.
+func newDB(ctx context.Context, cfg Config) (*db, error) {
 	db := db{
-		ctx: mctx.NewChild(ctx, "db"),
+		ctx:       mctx.NewChild(ctx, "db"),
+		maxRows:   cfg.MaxDBRows,
+		slowQuery: cfg.SlowQueryThreshold,
+		queries:   map[string]*gossip.QueryStats{},
 	}
 
-	db.ctx = mrun.WithStartHook(db.ctx, func(context.Context) error {
-		mlog.Info("creating sqlite db", db.ctx)
-		var err error
-		if db.DB, err = sqlx.Connect("sqlite3", ":memory:"); err != nil {
-			return merr.Wrap(err, db.ctx)
-		}
-		return db.init()
+	mlog.Info("creating sqlite db", db.ctx)
+	var err error
+	if db.DB, err = sqlx.Connect("sqlite3", ":memory:"); err != nil {
+		return nil, merr.Wrap(err, db.ctx)
+	}
+
+	// every connection to ":memory:" gets its own database, so only one may
+	// be used.
+	db.DB.SetMaxOpenConns(1)
+	if err := db.init(); err != nil {
+		db.DB.Close()
+		return nil, err
+	}
+	return &db, nil
+}
+
+// timed calls the function, which makes the named query, recording how long
+// it took and logging it if it was slow.
+func (db *db) timed(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	took := time.Since(start)
+
+	db.queriesL.Lock()
+	stats, ok := db.queries[name]
+	if !ok {
+		stats = &gossip.QueryStats{Name: name}
+		db.queries[name] = stats
+	}
+	stats.Observe(took)
+	db.queriesL.Unlock()
+
+	if db.slowQuery > 0 && took >= db.slowQuery {
+		mlog.Warn("slow query", mctx.Annotate(db.ctx,
+			"query", name,
+			"took", took.String(),
+		))
+	}
+	return err
+}
+
+func (db *db) exec(name, query string, args ...interface{}) (res sql.Result, err error) {
+	err = db.timed(name, func() error {
+		res, err = db.DB.Exec(query, args...)
+		return err
 	})
+	return res, err
+}
 
-	db.ctx = mrun.WithStopHook(db.ctx, func(context.Context) error {
-		return db.DB.Close()
+func (db *db) get(name string, dest interface{}, query string, args ...interface{}) error {
+	return db.timed(name, func() error {
+		return db.DB.Get(dest, query, args...)
 	})
+}
 
-	return mctx.WithChild(ctx, db.ctx), &db
+func (db *db) selectAll(name string, dest interface{}, query string, args ...interface{}) error {
+	return db.timed(name, func() error {
+		return db.DB.Select(dest, query, args...)
+	})
+}
+
+// queryStats returns how long each query made so far has taken, sorted by
+// name.
+func (db *db) queryStats() []gossip.QueryStats {
+	db.queriesL.Lock()
+	defer db.queriesL.Unlock()
+	stats := make([]gossip.QueryStats, 0, len(db.queries))
+	for _, s := range db.queries {
+		s := *s
+		s.Buckets = append([]uint64(nil), s.Buckets...)
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
 }
 
 func (db *db) init() error {
 	mlog.Info("initializing tables", db.ctx)
-	_, err := db.Exec(
+	_, err := db.exec("init",
 		`CREATE TABLE peer_resources (
 			addr TEXT,
 			resource TEXT,
 			state INTEGER,
 			nonce INTEGER,
 			lastTS REAL,
+			learnedFrom TEXT,
+			firstHand INTEGER,
 			PRIMARY KEY(addr, resource)
 		);
+		CREATE INDEX peer_resources_lastTS ON peer_resources (lastTS);
+		CREATE TABLE nonces (
+			origin TEXT,
+			resource TEXT,
+			nonce INTEGER,
+			PRIMARY KEY(origin, resource)
+		);
 	`)
 	return merr.Wrap(err, db.ctx)
 }
 
+// recordHave records the state described by the message, unless a message with
+// a greater nonce has already been recorded for the same peer/resource. A
+// first-hand message replaces a relayed one with the same nonce, so that
+// which peer the state was learned from is as accurate as possible.
 func (db *db) recordHave(msg msgEvent) error {
-	_, err := db.Exec(
-		`INSERT OR REPLACE INTO peer_resources
+	return db.recordHaves([]msgEvent{msg})
+}
+
+// recordHaves is like recordHave, but records all of the messages within a
+// single transaction.
+func (db *db) recordHaves(msgs []msgEvent) error {
+	var recorded int64
+	err := db.timed("recordHaves", func() error {
+		tx, err := db.DB.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, msg := range msgs {
+			res, err := tx.Exec(recordHaveQuery,
+				msg.Addr, msg.Resource, msg.MsgType, msg.Nonce,
+				mtime.NewTS(msg.TS).Float64(), msg.PeerAddr, msg.firstHand(),
+			)
+			if err != nil {
+				return err
+			}
+			n, _ := res.RowsAffected()
+			recorded += n
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return merr.Wrap(err, db.ctx)
+	} else if recorded == 0 {
+		return nil
+	}
+	// the database only has one connection, so this can't be done within
+	// the transaction.
+	return db.evict()
+}
+
+const recordHaveQuery = `INSERT OR REPLACE INTO peer_resources
 			SELECT newdata.* FROM
     			(SELECT
 					? AS addr,
 					? AS resource,
 					? AS state,
 					? AS nonce,
-					? AS lastTS) AS newdata
+					? AS lastTS,
+					? AS learnedFrom,
+					? AS firstHand) AS newdata
     		LEFT JOIN peer_resources as olddata
 				ON newdata.addr=olddata.addr
 				AND newdata.resource=olddata.resource
     			WHERE newdata.nonce>olddata.nonce
-				OR olddata.addr IS NULL;`,
-		msg.Addr, msg.Resource, msg.MsgType, msg.Nonce,
-		mtime.NewTS(msg.TS).Float64(),
+				OR (newdata.nonce=olddata.nonce
+					AND newdata.firstHand>olddata.firstHand)
+				OR olddata.addr IS NULL;`
+
+// evict deletes the least recently updated rows of peer_resources until there
+// are no more than maxRows, if there's a limit. The nonces of evicted rows are
+// forgotten, so a stale message about an evicted peer/resource will be
+// recorded as if it were new.
+func (db *db) evict() error {
+	if db.maxRows <= 0 {
+		return nil
+	}
+	res, err := db.exec("evict",
+		`DELETE FROM peer_resources WHERE rowid IN (
+			SELECT rowid FROM peer_resources
+			ORDER BY lastTS
+			LIMIT MAX(0, (SELECT COUNT(*) FROM peer_resources) - ?)
+		);`,
+		db.maxRows,
+	)
+	if err != nil {
+		return merr.Wrap(err, db.ctx)
+	}
+	n, err := res.RowsAffected()
+	db.evicted.Add(uint64(n))
+	return merr.Wrap(err, db.ctx)
+}
+
+// stats returns the number of rows in peer_resources, and the total number
+// which have been evicted.
+func (db *db) stats() (rows int, evicted uint64, err error) {
+	err = db.get("stats", &rows, "SELECT COUNT(*) FROM peer_resources")
+	return rows, db.evicted.Load(), merr.Wrap(err, db.ctx)
+}
+
+// claim describes a recorded claim that a peer has a resource.
+type claim struct {
+	Addr        string `db:"addr"`
+	LearnedFrom string `db:"learnedFrom"`
+	FirstHand   bool   `db:"firstHand"`
+}
+
+// claimsWith returns claims of peers having the given resource which were
+// recorded since the given time, first-hand ones first, and then the most
+// recent first.
+func (db *db) claimsWith(resource string, since time.Time) ([]claim, error) {
+	var claims []claim
+	err := db.selectAll("claimsWith", &claims,
+		`SELECT addr, learnedFrom, firstHand FROM peer_resources
+		WHERE resource = ?
+		AND lastTS >= ?
+		AND state = 0
+		ORDER BY firstHand DESC, lastTS DESC, addr;`,
+		resource, mtime.NewTS(since).Float64(),
+	)
+	return claims, merr.Wrap(err, db.ctx)
+}
+
+// LoadNonce implements the method for the gossip.NonceStore interface. Nonces
+// of messages recorded by recordHave are taken into account.
+func (db *db) LoadNonce(origin, resource string) (uint64, error) {
+	var nonce int64
+	err := db.get("LoadNonce", &nonce,
+		`SELECT COALESCE(MAX(nonce), 0) FROM (
+			SELECT nonce FROM nonces WHERE origin = ? AND resource = ?
+			UNION ALL
+			SELECT nonce FROM peer_resources WHERE addr = ? AND resource = ?
+		);`,
+		origin, resource, origin, resource,
+	)
+	return uint64(nonce), merr.Wrap(err, db.ctx)
+}
+
+// StoreNonce implements the method for the gossip.NonceStore interface.
+func (db *db) StoreNonce(origin, resource string, nonce uint64) error {
+	_, err := db.exec("StoreNonce",
+		`INSERT INTO nonces (origin, resource, nonce) VALUES (?, ?, ?)
+		ON CONFLICT(origin, resource) DO UPDATE SET nonce = excluded.nonce
+		WHERE excluded.nonce > nonces.nonce;`,
+		origin, resource, int64(nonce),
 	)
 	return merr.Wrap(err, db.ctx)
 }
 
 // peers returns the addresses of all peers from which a message was received
 // since the given time.
-//
-// TODO index on lastTS
 func (db *db) peers(since time.Time) ([]string, error) {
 	var addrs []string
-	err := db.Select(&addrs,
+	err := db.selectAll("peers", &addrs,
 		`SELECT DISTINCT addr FROM peer_resources
 		WHERE lastTS >= ?
 		AND state = 0;`,
@@ -92,7 +298,7 @@ func (db *db) peers(since time.Time) ([]string, error) {
 
 func (db *db) peersWith(resource string, since time.Time) ([]string, error) {
 	var addrs []string
-	err := db.Select(&addrs,
+	err := db.selectAll("peersWith", &addrs,
 		`SELECT DISTINCT addr FROM peer_resources
 		WHERE resource = ?
 		AND lastTS >= ?
@@ -101,3 +307,14 @@ func (db *db) peersWith(resource string, since time.Time) ([]string, error) {
 	)
 	return addrs, merr.Wrap(err, db.ctx)
 }
+
+// markStale marks all states recorded for the peer as stale, as if they hadn't
+// been updated since long before Config's PeerActiveTimeout, so that the peer
+// isn't claimed to have any resource until a newer message from it is
+// recorded. Stale rows are also the first to be evicted.
+func (db *db) markStale(addr string) error {
+	_, err := db.exec("markStale",
+		`UPDATE peer_resources SET lastTS = 0 WHERE addr = ?;`, addr,
+	)
+	return merr.Wrap(err, db.ctx)
+}
@@ -1,16 +1,19 @@
-package main
+package actor
 
 import (
 	. "testing"
 	"time"
 
+	"github.com/mediocregopher/bonfire/gossip-app"
 	"github.com/mediocregopher/mediocre-go-lib/mtest"
 	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
 )
 
 func TestDB(t *T) {
 	ctx := mtest.Context()
-	ctx, db := withDB(ctx)
+	db, err := newDB(ctx, Config{})
+	massert.Require(t, massert.Nil(err))
+	defer db.Close()
 
 	assertPeers := func(since time.Time, expPeers ...string) massert.Assertion {
 		peers, err := db.peers(since)
@@ -149,3 +152,223 @@ func TestDB(t *T) {
 		)
 	})
 }
+
+func TestDBNonces(t *T) {
+	ctx := mtest.Context()
+	db, err := newDB(ctx, Config{})
+	massert.Require(t, massert.Nil(err))
+	defer db.Close()
+
+	assertNonce := func(origin, resource string, exp uint64) massert.Assertion {
+		nonce, err := db.LoadNonce(origin, resource)
+		return massert.All(
+			massert.Nil(err),
+			massert.Equal(exp, nonce),
+		)
+	}
+
+	massert.Require(t,
+		assertNonce("0.0.0.0:1", "foo", 0),
+
+		// stored nonces only ever increase
+		massert.Nil(db.StoreNonce("0.0.0.0:1", "foo", 5)),
+		assertNonce("0.0.0.0:1", "foo", 5),
+		massert.Nil(db.StoreNonce("0.0.0.0:1", "foo", 3)),
+		assertNonce("0.0.0.0:1", "foo", 5),
+		assertNonce("0.0.0.0:1", "bar", 0),
+
+		// nonces of recorded messages are taken into account
+		massert.Nil(db.recordHave(msgEvent{
+			Msg: Msg{
+				MsgType:  MsgTypeHave,
+				Addr:     "0.0.0.0:1",
+				Resource: "foo",
+				Nonce:    7,
+			},
+			TS: time.Now(),
+		})),
+		assertNonce("0.0.0.0:1", "foo", 7),
+		massert.Nil(db.StoreNonce("0.0.0.0:1", "foo", 1<<62)),
+		assertNonce("0.0.0.0:1", "foo", 1<<62),
+	)
+}
+
+func TestDBClaims(t *T) {
+	ctx := mtest.Context()
+	db, err := newDB(ctx, Config{})
+	massert.Require(t, massert.Nil(err))
+	defer db.Close()
+
+	now := time.Now()
+	have := func(addr, peerAddr, relayer string, nonce uint64) msgEvent {
+		return msgEvent{
+			Msg: Msg{
+				MsgType:  MsgTypeHave,
+				Addr:     addr,
+				Resource: "foo",
+				Relayer:  relayer,
+				Nonce:    nonce,
+			},
+			PeerAddr: peerAddr,
+			TS:       now,
+		}
+	}
+
+	assertClaims := func(exp ...claim) massert.Assertion {
+		claims, err := db.claimsWith("foo", now.Add(-time.Second))
+		return massert.All(
+			massert.Nil(err),
+			massert.Equal(exp, claims),
+		)
+	}
+
+	massert.Require(t,
+		// b relays that a has foo
+		massert.Nil(db.recordHave(have("0.0.0.0:1", "0.0.0.0:2", "0.0.0.0:2", 1))),
+		assertClaims(claim{Addr: "0.0.0.0:1", LearnedFrom: "0.0.0.0:2"}),
+
+		// c says first-hand that it has foo, which comes first
+		massert.Nil(db.recordHave(have("0.0.0.0:3", "0.0.0.0:3", "", 1))),
+		assertClaims(
+			claim{Addr: "0.0.0.0:3", LearnedFrom: "0.0.0.0:3", FirstHand: true},
+			claim{Addr: "0.0.0.0:1", LearnedFrom: "0.0.0.0:2"},
+		),
+
+		// a says the same thing first-hand, which replaces the relayed claim
+		massert.Nil(db.recordHave(have("0.0.0.0:1", "0.0.0.0:1", "", 1))),
+		assertClaims(
+			claim{Addr: "0.0.0.0:1", LearnedFrom: "0.0.0.0:1", FirstHand: true},
+			claim{Addr: "0.0.0.0:3", LearnedFrom: "0.0.0.0:3", FirstHand: true},
+		),
+
+		// but a relayed claim with the same nonce doesn't replace a
+		// first-hand one.
+		massert.Nil(db.recordHave(have("0.0.0.0:1", "0.0.0.0:2", "0.0.0.0:2", 1))),
+		assertClaims(
+			claim{Addr: "0.0.0.0:1", LearnedFrom: "0.0.0.0:1", FirstHand: true},
+			claim{Addr: "0.0.0.0:3", LearnedFrom: "0.0.0.0:3", FirstHand: true},
+		),
+	)
+}
+
+func TestDBEvict(t *T) {
+	ctx := mtest.Context()
+	db, err := newDB(ctx, Config{MaxDBRows: 2})
+	massert.Require(t, massert.Nil(err))
+	defer db.Close()
+
+	now := time.Now()
+	have := func(addr string, nonce uint64, ts time.Time) msgEvent {
+		return msgEvent{
+			Msg: Msg{
+				MsgType:  MsgTypeHave,
+				Addr:     addr,
+				Resource: "foo",
+				Nonce:    nonce,
+			},
+			TS: ts,
+		}
+	}
+
+	assertStats := func(expRows int, expEvicted uint64) massert.Assertion {
+		rows, evicted, err := db.stats()
+		return massert.All(
+			massert.Nil(err),
+			massert.Equal(expRows, rows),
+			massert.Equal(expEvicted, evicted),
+		)
+	}
+
+	assertPeers := func(expPeers ...string) massert.Assertion {
+		peers, err := db.peers(now.Add(-time.Minute))
+		return massert.All(
+			massert.Nil(err),
+			massert.Length(peers, len(expPeers)),
+			massert.Subset(peers, expPeers),
+		)
+	}
+
+	massert.Require(t,
+		massert.Nil(db.recordHave(have("0.0.0.0:1", 1, now))),
+		massert.Nil(db.recordHave(have("0.0.0.0:2", 1, now.Add(time.Second)))),
+		assertStats(2, 0),
+
+		// updating an existing row doesn't evict anything, but makes it the
+		// most recently updated.
+		massert.Nil(db.recordHave(have("0.0.0.0:1", 2, now.Add(2*time.Second)))),
+		assertStats(2, 0),
+
+		// a new row evicts the least recently updated one.
+		massert.Nil(db.recordHave(have("0.0.0.0:3", 1, now.Add(3*time.Second)))),
+		assertStats(2, 1),
+		assertPeers("0.0.0.0:1", "0.0.0.0:3"),
+
+		// a stale message which isn't recorded doesn't evict anything.
+		massert.Nil(db.recordHave(have("0.0.0.0:3", 1, now.Add(4*time.Second)))),
+		assertStats(2, 1),
+		assertPeers("0.0.0.0:1", "0.0.0.0:3"),
+	)
+}
+
+func TestDBQueryStats(t *T) {
+	ctx := mtest.Context()
+	db, err := newDB(ctx, Config{})
+	massert.Require(t, massert.Nil(err))
+	defer db.Close()
+
+	_, err = db.peers(time.Now())
+	massert.Require(t, massert.Nil(err))
+	_, err = db.peers(time.Now())
+	massert.Require(t, massert.Nil(err))
+
+	stats := db.queryStats()
+	massert.Require(t, massert.Equal(2, len(stats)))
+	massert.Require(t,
+		massert.Equal("init", stats[0].Name),
+		massert.Equal(uint64(1), stats[0].Count),
+		massert.Equal("peers", stats[1].Name),
+		massert.Equal(uint64(2), stats[1].Count),
+		massert.Equal(len(gossip.QueryBuckets)+1, len(stats[1].Buckets)),
+	)
+}
+
+func TestDBMarkStale(t *T) {
+	ctx := mtest.Context()
+	db, err := newDB(ctx, Config{})
+	massert.Require(t, massert.Nil(err))
+	defer db.Close()
+
+	now := time.Now()
+	have := func(addr string, nonce uint64) msgEvent {
+		return msgEvent{
+			Msg: Msg{
+				MsgType:  MsgTypeHave,
+				Addr:     addr,
+				Resource: "foo",
+				Nonce:    nonce,
+			},
+			PeerAddr: addr,
+			TS:       now,
+		}
+	}
+
+	assertPeersWith := func(expPeers ...string) massert.Assertion {
+		peers, err := db.peersWith("foo", now.Add(-time.Minute))
+		return massert.All(
+			massert.Nil(err),
+			massert.Length(peers, len(expPeers)),
+			massert.Subset(peers, expPeers),
+		)
+	}
+
+	massert.Require(t,
+		massert.Nil(db.recordHave(have("0.0.0.0:1", 1))),
+		massert.Nil(db.recordHave(have("0.0.0.0:2", 1))),
+		massert.Nil(db.markStale("0.0.0.0:1")),
+		assertPeersWith("0.0.0.0:2"),
+
+		// a newer message from the peer makes it fresh again.
+		massert.Nil(db.recordHave(have("0.0.0.0:1", 2))),
+		assertPeersWith("0.0.0.0:1", "0.0.0.0:2"),
+	)
+}
@@ -0,0 +1,214 @@
+package actor
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// the number of active peers asked to ping a peer which hasn't acked a direct
+// ping.
+const indirectPings = 3
+
+// detector detects failed peers in the actor's active view, SWIM-style. Each
+// tick one active peer is probed, in turn, by sending it a Ping. If it hasn't
+// been heard from by the next tick then other active peers are asked to ping
+// it on the actor's behalf with PingReq, and if it still hasn't been heard from
+// by the tick after that it is suspected. A suspected peer which isn't heard
+// from within the suspect timeout is confirmed as having failed.
+//
+// Unlike SWIM, suspicions aren't disseminated to other peers; each actor
+// reaches its own conclusions. And a PingReq is only acted on if its target is
+// in the actor's own active view.
+//
+// detector is safe to use from multiple go-routines.
+type detector struct {
+	suspectTimeout time.Duration
+
+	l        sync.Mutex
+	rand     *rand.Rand
+	probe    *probe
+	lastAddr string               // the most recently probed peer
+	suspects map[string]time.Time // addr -> when it was suspected
+}
+
+type probe struct {
+	target   string
+	indirect bool
+}
+
+// probeActions describe what the actor should do as the result of a tick of
+// its detector.
+type probeActions struct {
+	// If set, the peer which should be sent a Ping.
+	Ping string
+
+	// If set, the peers which should be sent a PingReq for Target.
+	PingReq []string
+	Target  string
+
+	// Peers which have newly been suspected, or confirmed as having failed.
+	Suspected, Confirmed []string
+}
+
+func newDetector(suspectTimeout time.Duration, seed int64) *detector {
+	return &detector{
+		suspectTimeout: suspectTimeout,
+		rand:           rand.New(rand.NewSource(seed)),
+		suspects:       map[string]time.Time{},
+	}
+}
+
+// tick advances the detector, given the current active peers, returning what
+// the actor should do.
+func (d *detector) tick(now time.Time, active []string) probeActions {
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	var a probeActions
+	for _, addr := range sorted(d.suspects) {
+		if now.Sub(d.suspects[addr]) >= d.suspectTimeout {
+			delete(d.suspects, addr)
+			a.Confirmed = append(a.Confirmed, addr)
+		}
+	}
+
+	if p := d.probe; p != nil && !p.indirect {
+		p.indirect = true
+		for _, addr := range active {
+			if addr != p.target {
+				a.PingReq = append(a.PingReq, addr)
+			}
+		}
+		d.rand.Shuffle(len(a.PingReq), func(i, j int) {
+			a.PingReq[i], a.PingReq[j] = a.PingReq[j], a.PingReq[i]
+		})
+		a.PingReq = a.PingReq[:min(indirectPings, len(a.PingReq))]
+		a.Target = p.target
+		return a
+	} else if p != nil {
+		d.suspects[p.target] = now
+		a.Suspected = append(a.Suspected, p.target)
+		d.probe = nil
+	}
+
+	// peers are probed in address order, so that each is probed once every
+	// len(active) ticks.
+	candidates := make([]string, 0, len(active))
+	for _, addr := range active {
+		if _, ok := d.suspects[addr]; !ok {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		return a
+	}
+	sort.Strings(candidates)
+	i := sort.SearchStrings(candidates, d.lastAddr)
+	if i < len(candidates) && candidates[i] == d.lastAddr {
+		i++
+	}
+	target := candidates[i%len(candidates)]
+
+	d.probe = &probe{target: target}
+	d.lastAddr = target
+	a.Ping = target
+	return a
+}
+
+// heard records that the peer has been heard from, either directly or via an
+// indirect ping, ending any probe of it and refuting any suspicion of it. It
+// returns whether the peer was suspected.
+func (d *detector) heard(addr string) bool {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if d.probe != nil && d.probe.target == addr {
+		d.probe = nil
+	}
+	_, suspected := d.suspects[addr]
+	delete(d.suspects, addr)
+	return suspected
+}
+
+// detect ticks the detector and carries out the resulting actions.
+func (app *app) detect(ctx context.Context, thisAddr string) error {
+	a := app.detector.tick(time.Now(), app.members.sample(app.members.activeLen()))
+
+	var errs []error
+	if a.Ping != "" {
+		errs = append(errs, app.peer.Send(Msg{MsgType: MsgTypePing, Addr: thisAddr}, a.Ping))
+	}
+	if len(a.PingReq) > 0 {
+		errs = append(errs, app.peer.Send(Msg{
+			MsgType: MsgTypePingReq,
+			Addr:    thisAddr,
+			Peers:   []string{a.Target},
+		}, a.PingReq...))
+	}
+	if len(a.Suspected) > 0 {
+		ctx := mctx.Annotate(ctx, "suspected", strings.Join(a.Suspected, ","))
+		mlog.Info("peers suspected of failing", ctx)
+		app.event(ctx, "peers-suspected", map[string]string{
+			"suspected": strings.Join(a.Suspected, ","),
+		})
+	}
+	for _, addr := range a.Confirmed {
+		ctx := mctx.Annotate(ctx, "peer-addr", addr)
+		mlog.Info("peer confirmed as failed", ctx)
+		app.event(ctx, "peer-failed", map[string]string{"peer": addr})
+		app.members.remove(addr, time.Now())
+		errs = append(errs, app.db.markStale(addr))
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleProbe handles a Ping, PingReq or Ack message.
+func (app *app) handleProbe(ctx context.Context, msg msgEvent) {
+	var err error
+	switch msg.MsgType {
+	case MsgTypePing:
+		// the Ack carries the peer the Ping was sent on behalf of, if any,
+		// so that the pinger can forward it.
+		err = app.peer.Send(Msg{
+			MsgType: MsgTypeAck,
+			Addr:    app.addr(),
+			Peers:   msg.Peers,
+		}, msg.PeerAddr)
+	case MsgTypePingReq:
+		// only active peers are pinged on another's behalf, so that the actor
+		// can't be used to send Pings to arbitrary addresses.
+		if len(msg.Peers) == 0 || !app.members.isActive(msg.Peers[0]) {
+			return
+		}
+		err = app.peer.Send(Msg{
+			MsgType: MsgTypePing,
+			Addr:    app.addr(),
+			Peers:   []string{msg.Addr},
+		}, msg.Peers[0])
+	case MsgTypeAck:
+		if len(msg.Peers) > 0 {
+			err = app.peer.Send(Msg{
+				MsgType: MsgTypeAck,
+				Addr:    msg.Addr,
+				Relayer: app.addr(),
+			}, msg.Peers[0])
+		} else if app.detector.heard(msg.Addr) {
+			mlog.Info("suspected peer acked", mctx.Annotate(ctx, "peer-addr", msg.Addr))
+		}
+	}
+	if err != nil {
+		mlog.Warn("error handling probe", ctx, merr.Context(err))
+	}
+}
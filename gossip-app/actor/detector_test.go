@@ -0,0 +1,64 @@
+package actor
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestDetector(t *T) {
+	now := time.Now()
+	d := newDetector(3*time.Second, 1)
+	active := []string{"10.0.0.3:1", "10.0.0.2:1", "10.0.0.4:1"}
+	tick := func() probeActions {
+		now = now.Add(time.Second)
+		return d.tick(now, active)
+	}
+
+	// peers are probed in address order, moving on once one acks.
+	massert.Require(t, massert.Equal(probeActions{Ping: "10.0.0.2:1"}, tick()))
+	massert.Require(t, massert.Equal(false, d.heard("10.0.0.2:1")))
+	massert.Require(t, massert.Equal(probeActions{Ping: "10.0.0.3:1"}, tick()))
+
+	// a peer which doesn't ack is pinged indirectly via the others, and then
+	// suspected, at which point the next peer is probed.
+	d.heard("10.0.0.3:1")
+	massert.Require(t, massert.Equal(probeActions{Ping: "10.0.0.4:1"}, tick()))
+	a := tick()
+	massert.Require(t,
+		massert.Equal("", a.Ping),
+		massert.Equal("10.0.0.4:1", a.Target),
+		massert.Length(a.PingReq, 2),
+		massert.Subset(a.PingReq, []string{"10.0.0.2:1", "10.0.0.3:1"}),
+	)
+	massert.Require(t, massert.Equal(probeActions{
+		Ping:      "10.0.0.2:1",
+		Suspected: []string{"10.0.0.4:1"},
+	}, tick()))
+
+	// suspected peers aren't probed, and are confirmed as failed once the
+	// suspect timeout has passed without them being heard from.
+	d.heard("10.0.0.2:1")
+	massert.Require(t, massert.Equal(probeActions{Ping: "10.0.0.3:1"}, tick()))
+	d.heard("10.0.0.3:1")
+	massert.Require(t, massert.Equal(probeActions{Ping: "10.0.0.2:1"}, tick()))
+	d.heard("10.0.0.2:1")
+	massert.Require(t, massert.Equal(probeActions{
+		Ping:      "10.0.0.3:1",
+		Confirmed: []string{"10.0.0.4:1"},
+	}, tick()))
+
+	// a suspected peer which is heard from is no longer suspected.
+	active = []string{"10.0.0.2:1"}
+	d.heard("10.0.0.3:1")
+	massert.Require(t, massert.Equal(probeActions{Ping: "10.0.0.2:1"}, tick()))
+	massert.Require(t, massert.Equal(
+		probeActions{Target: "10.0.0.2:1"}, tick(),
+	))
+	massert.Require(t, massert.Equal(
+		probeActions{Suspected: []string{"10.0.0.2:1"}}, tick(),
+	))
+	massert.Require(t, massert.Equal(true, d.heard("10.0.0.2:1")))
+	massert.Require(t, massert.Equal(probeActions{Ping: "10.0.0.2:1"}, tick()))
+}
@@ -0,0 +1,231 @@
+package actor
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the number of addresses exchanged by each side of a shuffle.
+const shuffleSize = 6
+
+// membership maintains the actor's partial view of the network, à la
+// HyParView: a small active view of peers which messages are sprayed to, and a
+// larger passive view of peers which replace active ones as they fail.
+//
+// Peers enter the views when the bonfire Peer learns of them, when they're
+// heard from, and through shuffles. Each tick the actor shuffles with the
+// active peer it has heard from least recently, sending it a sample of its
+// views and receiving one in return, which keeps the passive view fresh. Failed
+// active peers are usually removed by the detector, but as a backstop those
+// which aren't heard from within the timeout are considered to have failed.
+//
+// membership is safe to use from multiple go-routines.
+type membership struct {
+	thisAddr                string
+	activeSize, passiveSize int
+	timeout                 time.Duration
+
+	l       sync.Mutex
+	rand    *rand.Rand
+	active  map[string]time.Time // addr -> when it was last heard from
+	passive map[string]struct{}
+}
+
+func newMembership(thisAddr string, activeSize, passiveSize int, timeout time.Duration, seed int64) *membership {
+	return &membership{
+		thisAddr:    thisAddr,
+		activeSize:  activeSize,
+		passiveSize: passiveSize,
+		timeout:     timeout,
+		rand:        rand.New(rand.NewSource(seed)),
+		active:      map[string]time.Time{},
+		passive:     map[string]struct{}{},
+	}
+}
+
+// setThisAddr changes the actor's own address, which is never added to either
+// view, and is included in shuffles.
+func (m *membership) setThisAddr(addr string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.thisAddr = addr
+	delete(m.active, addr)
+	delete(m.passive, addr)
+}
+
+// sorted returns the keys of the map sorted, so that given the same seed the
+// same random choices are made.
+func sorted[V any](m map[string]V) []string {
+	addrs := make([]string, 0, len(m))
+	for addr := range m {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// addLocked adds the peer to the active view if it has room, and otherwise to
+// the passive view.
+//
+// This must be called with the lock held.
+func (m *membership) addLocked(addr string, now time.Time) {
+	if addr == m.thisAddr {
+		return
+	} else if _, ok := m.active[addr]; ok {
+		return
+	} else if len(m.active) < m.activeSize {
+		delete(m.passive, addr)
+		m.active[addr] = now
+		return
+	}
+	m.addPassiveLocked(addr)
+}
+
+// addPassiveLocked adds the peer to the passive view, evicting a random
+// passive peer if it's full.
+//
+// This must be called with the lock held.
+func (m *membership) addPassiveLocked(addr string) {
+	if addr == m.thisAddr {
+		return
+	} else if _, ok := m.active[addr]; ok {
+		return
+	} else if _, ok := m.passive[addr]; ok {
+		return
+	} else if len(m.passive) >= m.passiveSize {
+		addrs := sorted(m.passive)
+		delete(m.passive, addrs[m.rand.Intn(len(addrs))])
+	}
+	m.passive[addr] = struct{}{}
+}
+
+// promoteLocked fills the active view with random passive peers.
+//
+// This must be called with the lock held.
+func (m *membership) promoteLocked(now time.Time) {
+	for len(m.active) < m.activeSize && len(m.passive) > 0 {
+		addrs := sorted(m.passive)
+		addr := addrs[m.rand.Intn(len(addrs))]
+		delete(m.passive, addr)
+		m.active[addr] = now
+	}
+}
+
+// add adds a peer which has been learned of, e.g. from the bonfire Peer, to the
+// active view if it has room, and otherwise to the passive view.
+func (m *membership) add(addr string, now time.Time) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.addLocked(addr, now)
+}
+
+// heard records that a message was received from the peer, adding it as add
+// does if it isn't already active.
+func (m *membership) heard(addr string, now time.Time) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if _, ok := m.active[addr]; ok {
+		m.active[addr] = now
+		return
+	}
+	m.addLocked(addr, now)
+}
+
+// remove removes a peer which is known to have gone from both views, promoting
+// a passive peer to replace it if it was active.
+func (m *membership) remove(addr string, now time.Time) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	delete(m.active, addr)
+	delete(m.passive, addr)
+	m.promoteLocked(now)
+}
+
+// expire removes active peers which haven't been heard from within the
+// timeout, promoting passive peers to replace them, and returns the removed
+// peers.
+func (m *membership) expire(now time.Time) []string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	var expired []string
+	for _, addr := range sorted(m.active) {
+		if now.Sub(m.active[addr]) > m.timeout {
+			delete(m.active, addr)
+			expired = append(expired, addr)
+		}
+	}
+	m.promoteLocked(now)
+	return expired
+}
+
+// sample returns up to n random peers from the active view.
+func (m *membership) sample(n int) []string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	addrs := sorted(m.active)
+	m.rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	return addrs[:min(n, len(addrs))]
+}
+
+// activeLen returns the number of peers in the active view.
+func (m *membership) activeLen() int {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return len(m.active)
+}
+
+// isActive returns whether the peer is in the active view.
+func (m *membership) isActive(addr string) bool {
+	m.l.Lock()
+	defer m.l.Unlock()
+	_, ok := m.active[addr]
+	return ok
+}
+
+// exchangeLocked returns a random sample of shuffleSize addresses from both
+// views, including this actor's own, to be sent in a shuffle.
+//
+// This must be called with the lock held.
+func (m *membership) exchangeLocked() []string {
+	addrs := append(sorted(m.active), sorted(m.passive)...)
+	m.rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	addrs = addrs[:min(shuffleSize-1, len(addrs))]
+	return append(addrs, m.thisAddr)
+}
+
+// shuffle returns the active peer which was heard from least recently, which a
+// shuffle should be sent to, along with the addresses to send it. It returns
+// false if there are no active peers.
+func (m *membership) shuffle() (string, []string, bool) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	var dst string
+	for _, addr := range sorted(m.active) {
+		if dst == "" || m.active[addr].Before(m.active[dst]) {
+			dst = addr
+		}
+	}
+	if dst == "" {
+		return "", nil, false
+	}
+	return dst, m.exchangeLocked(), true
+}
+
+// integrate adds the addresses received in a shuffle to the passive view, and
+// returns the addresses to reply with if the shuffle is being answered.
+func (m *membership) integrate(addrs []string, now time.Time) []string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	reply := m.exchangeLocked()
+	for _, addr := range addrs {
+		m.addPassiveLocked(addr)
+	}
+	m.promoteLocked(now)
+	return reply
+}
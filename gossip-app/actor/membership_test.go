@@ -0,0 +1,72 @@
+package actor
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestMembership(t *T) {
+	const thisAddr = "10.0.0.1:1"
+	now := time.Now()
+	m := newMembership(thisAddr, 2, 2, time.Minute, 1)
+
+	assertViews := func(expActive, expPassive []string) massert.Assertion {
+		m.l.Lock()
+		active, passive := sorted(m.active), sorted(m.passive)
+		m.l.Unlock()
+		return massert.All(
+			massert.Equal(expActive, active),
+			massert.Equal(expPassive, passive),
+		)
+	}
+
+	// the active view is filled first, this actor is never added.
+	m.add(thisAddr, now)
+	m.add("10.0.0.2:1", now)
+	m.heard("10.0.0.3:1", now)
+	m.add("10.0.0.4:1", now)
+	massert.Require(t, assertViews(
+		[]string{"10.0.0.2:1", "10.0.0.3:1"},
+		[]string{"10.0.0.4:1"},
+	))
+	massert.Require(t,
+		massert.Equal(true, m.isActive("10.0.0.2:1")),
+		massert.Equal(false, m.isActive("10.0.0.4:1")),
+		massert.Equal(false, m.isActive(thisAddr)),
+	)
+
+	// shuffles go to the active peer heard from least recently, and include
+	// this actor.
+	m.heard("10.0.0.2:1", now.Add(time.Second))
+	dst, addrs, ok := m.shuffle()
+	massert.Require(t,
+		massert.Equal(true, ok),
+		massert.Equal("10.0.0.3:1", dst),
+		massert.Equal(thisAddr, addrs[len(addrs)-1]),
+		massert.Length(addrs, 4),
+	)
+
+	// integrated addresses go to the passive view, which is bounded.
+	reply := m.integrate([]string{thisAddr, "10.0.0.2:1", "10.0.0.5:1", "10.0.0.6:1"}, now)
+	massert.Require(t, massert.Length(reply, 4))
+	m.l.Lock()
+	passiveLen := len(m.passive)
+	m.l.Unlock()
+	massert.Require(t, massert.Equal(2, passiveLen))
+
+	// a removed active peer is replaced from the passive view.
+	m.remove("10.0.0.2:1", now)
+	massert.Require(t, massert.Equal(2, m.activeLen()))
+
+	// as are active peers which haven't been heard from.
+	expired := m.expire(now.Add(2 * time.Minute))
+	massert.Require(t,
+		massert.Length(expired, 2),
+		massert.Equal(1, m.activeLen()),
+	)
+
+	// and samples only come from the active view.
+	massert.Require(t, massert.Length(m.sample(5), 1))
+}
@@ -0,0 +1,87 @@
+package actor
+
+import "sync"
+
+// MsgOverflow describes what an actor does with messages received from its
+// peers once its queue of messages waiting to be processed is full.
+type MsgOverflow int
+
+// The possible values of MsgOverflow.
+const (
+	// MsgOverflowDrop drops the oldest queued message to make room for each
+	// new one. Dropped messages are counted and reported to the coordinator.
+	MsgOverflowDrop MsgOverflow = iota
+
+	// MsgOverflowExpand grows the queue to hold however many messages are
+	// received. The largest size it reaches is reported to the coordinator.
+	MsgOverflowExpand
+)
+
+// msgQueue holds messages read from the bonfire Peer until they're processed.
+// Pushing to it never blocks, so that the socket keeps being read even when
+// processing falls behind; otherwise the kernel would drop packets without
+// anyone knowing.
+type msgQueue struct {
+	size     int
+	overflow MsgOverflow
+	notifyCh chan struct{}
+
+	l       sync.Mutex
+	q       []msgEvent
+	dropped uint64
+
+	// the largest len(q) has been since the last call to stats.
+	maxLen int
+}
+
+func newMsgQueue(size int, overflow MsgOverflow) *msgQueue {
+	return &msgQueue{
+		size:     size,
+		overflow: overflow,
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+// push adds the msgEvent to the queue, returning false if another msgEvent had
+// to be dropped to make room for it.
+func (mq *msgQueue) push(ev msgEvent) bool {
+	mq.l.Lock()
+	ok := true
+	if mq.overflow == MsgOverflowDrop && len(mq.q) >= mq.size {
+		mq.q[0] = msgEvent{}
+		mq.q = mq.q[1:]
+		mq.dropped++
+		ok = false
+	}
+	mq.q = append(mq.q, ev)
+	mq.maxLen = max(mq.maxLen, len(mq.q))
+	mq.l.Unlock()
+
+	select {
+	case mq.notifyCh <- struct{}{}:
+	default:
+	}
+	return ok
+}
+
+func (mq *msgQueue) pop() (msgEvent, bool) {
+	mq.l.Lock()
+	defer mq.l.Unlock()
+	if len(mq.q) == 0 {
+		return msgEvent{}, false
+	}
+	ev := mq.q[0]
+	mq.q[0] = msgEvent{}
+	mq.q = mq.q[1:]
+	return ev, true
+}
+
+// stats returns the current length of the queue, the largest it's been since
+// the last call to stats, and the total number of msgEvents dropped.
+func (mq *msgQueue) stats() (curLen, maxLen int, dropped uint64) {
+	mq.l.Lock()
+	defer mq.l.Unlock()
+	curLen, maxLen = len(mq.q), mq.maxLen
+	mq.maxLen = len(mq.q)
+	return curLen, maxLen, mq.dropped
+}
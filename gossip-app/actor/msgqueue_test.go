@@ -0,0 +1,61 @@
+package actor
+
+import (
+	"strconv"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestMsgQueue(t *T) {
+	ev := func(i int) msgEvent {
+		return msgEvent{Msg: Msg{Resource: strconv.Itoa(i)}}
+	}
+	popAll := func(mq *msgQueue) []string {
+		var resources []string
+		for ev, ok := mq.pop(); ok; ev, ok = mq.pop() {
+			resources = append(resources, ev.Resource)
+		}
+		return resources
+	}
+
+	t.Run("drop", func(t *T) {
+		mq := newMsgQueue(3, MsgOverflowDrop)
+		for i := range 3 {
+			massert.Require(t, massert.Equal(true, mq.push(ev(i))))
+		}
+		massert.Require(t,
+			massert.Equal(false, mq.push(ev(3))),
+			massert.Equal(false, mq.push(ev(4))),
+		)
+
+		curLen, maxLen, dropped := mq.stats()
+		massert.Require(t,
+			massert.Equal(3, curLen),
+			massert.Equal(3, maxLen),
+			massert.Equal(uint64(2), dropped),
+			massert.Equal([]string{"2", "3", "4"}, popAll(mq)),
+		)
+
+		// the max length is reset by each call to stats.
+		mq.push(ev(5))
+		_, maxLen, _ = mq.stats()
+		massert.Require(t, massert.Equal(3, maxLen))
+		_, maxLen, _ = mq.stats()
+		massert.Require(t, massert.Equal(1, maxLen))
+	})
+
+	t.Run("expand", func(t *T) {
+		mq := newMsgQueue(3, MsgOverflowExpand)
+		for i := range 5 {
+			massert.Require(t, massert.Equal(true, mq.push(ev(i))))
+		}
+		curLen, maxLen, dropped := mq.stats()
+		massert.Require(t,
+			massert.Equal(5, curLen),
+			massert.Equal(5, maxLen),
+			massert.Equal(uint64(0), dropped),
+			massert.Equal([]string{"0", "1", "2", "3", "4"}, popAll(mq)),
+		)
+	})
+}
@@ -1,82 +1,142 @@
-package main
+package actor
 
 import (
 	"context"
+	"errors"
 	"net"
 	"time"
 
 	"github.com/mediocregopher/bonfire"
-	"github.com/mediocregopher/mediocre-go-lib/mcfg"
 	"github.com/mediocregopher/mediocre-go-lib/mctx"
 	"github.com/mediocregopher/mediocre-go-lib/merr"
 	"github.com/mediocregopher/mediocre-go-lib/mlog"
-	"github.com/mediocregopher/mediocre-go-lib/mrun"
 	"github.com/vmihailenco/msgpack"
 )
 
 type msgEvent struct {
 	Msg
-	PeerAddr string
+	PeerAddr string // the peer which the message was received from
 	TS       time.Time
 }
 
+// firstHand returns whether the message was received directly from its
+// origin, rather than being relayed by some other peer.
+func (ev msgEvent) firstHand() bool {
+	return ev.Relayer == "" && ev.PeerAddr == ev.Addr
+}
+
 type peer struct {
 	ctx context.Context
 	*bonfire.Peer
 
-	msgCh  chan msgEvent
-	stopCh chan struct{}
+	msgs *msgQueue
+
+	// seals the messages sent to and opened from other actors, or nil if they
+	// aren't encrypted.
+	sealer *sealer
+
+	// addrCache saves resolving each destination of every message sent.
+	addrCache bonfire.AddrCache
+
+	// addrCh holds the Peer's latest remote address, whenever it changes, see
+	// spinEvents.
+	addrCh chan string
 }
 
-func withPeer(ctx context.Context) (context.Context, *peer) {
+func newPeer(ctx context.Context, cfg Config) (*peer, error) {
 	peer := peer{
-		ctx:    mctx.NewChild(ctx, "peer"),
-		msgCh:  make(chan msgEvent, 128),
-		stopCh: make(chan struct{}),
+		ctx:    mctx.Annotate(mctx.NewChild(ctx, "peer"), "server-addr", cfg.ServerAddr),
+		msgs:   newMsgQueue(cfg.MsgQueueSize, cfg.MsgOverflow),
+		addrCh: make(chan string, 1),
 	}
 
-	var serverAddr *string
-	peer.ctx, serverAddr = mcfg.WithString(peer.ctx, "server-addr", "127.0.0.1:7890", "Address of a bonfire server which can be used to find other peers")
-
-	peer.ctx = mrun.WithStartHook(peer.ctx, func(innerCtx context.Context) error {
-		peer.ctx = mctx.Annotate(peer.ctx, "server-addr", *serverAddr)
-		mlog.Info("peering with bonfire server", peer.ctx, innerCtx)
-		var err error
-		peer.Peer, err = bonfire.NewPeer(innerCtx, "udp", *serverAddr, nil)
-		if err != nil {
-			return merr.Wrap(err, peer.ctx, innerCtx)
-		}
+	var err error
+	if peer.sealer, err = newSealer(cfg.NetworkKey); err != nil {
+		return nil, merr.Wrap(err, peer.ctx)
+	}
 
-		peer.ctx = mctx.Annotate(peer.ctx,
-			"remote-addr", peer.Peer.RemoteAddr().String())
-		mlog.Info("peering completed", peer.ctx)
+	// the Peer's events are intercepted, to learn of changes to its remote
+	// address, and then passed on.
+	serverAddr, opts := cfg.ServerAddr, new(bonfire.PeerOpts)
+	if cfg.PeerOpts != nil {
+		*opts = *cfg.PeerOpts
+	}
+	eventCh := make(chan bonfire.PeerEvent, 16)
+	go peer.spinEvents(ctx, eventCh, opts.EventCh)
+	opts.EventCh = eventCh
+
+	if len(cfg.StaticPeers) > 0 {
+		opts.SeedPeers = cfg.StaticPeers
+		opts.AcceptGreetings = true
+		serverAddr = ""
+		peer.ctx = mctx.Annotate(peer.ctx, "static-peers", len(cfg.StaticPeers))
+		mlog.Info("peering with static peers", peer.ctx)
+	} else {
+		mlog.Info("peering with bonfire server", peer.ctx)
+	}
 
-		peer.ctx = mrun.WithThreads(peer.ctx, 1, func() error {
-			if err := peer.spin(); err != nil {
-				mlog.Fatal("peer loop failed", peer.ctx, merr.Context(err))
-			}
-			return nil
-		})
-		return nil
-	})
+	if cfg.PacketConn != nil {
+		peer.Peer, err = bonfire.NewPeerConn(ctx, cfg.PacketConn, serverAddr, opts)
+	} else {
+		peer.Peer, err = bonfire.NewPeer(ctx, "udp", serverAddr, opts)
+	}
+	if err != nil {
+		return nil, merr.Wrap(err, peer.ctx)
+	}
 
-	peer.ctx = mrun.WithStopHook(peer.ctx, func(innerCtx context.Context) error {
-		close(peer.stopCh)
-		mrun.Wait(peer.ctx, innerCtx.Done())
-		close(peer.msgCh)
-		return peer.Close()
-	})
+	peer.ctx = mctx.Annotate(peer.ctx, "remote-addr", peer.addr())
+	mlog.Info("peering completed", peer.ctx)
+	return &peer, nil
+}
 
-	return mctx.WithChild(ctx, peer.ctx), &peer
+// addr returns the address which identifies the actor to its coordinator and
+// peers. This is the Peer's remote address, unless no other peer has said
+// hello to it yet (as for the first actor of a static topology), in which
+// case its local address is used.
+func (peer *peer) addr() string {
+	if addr := peer.Peer.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return peer.Peer.LocalAddr().String()
 }
 
-func (peer *peer) spin() error {
-	b := make([]byte, 512)
+// spinEvents passes the Peer's events on to the application's channel, if it
+// has one, until the Context is canceled. When the Peer's remote address
+// changes the new address is written to addrCh, replacing any which hasn't
+// been read yet.
+func (peer *peer) spinEvents(ctx context.Context, eventCh <-chan bonfire.PeerEvent, appEventCh chan<- bonfire.PeerEvent) {
 	for {
+		var ev bonfire.PeerEvent
 		select {
-		case <-peer.stopCh:
+		case ev = <-eventCh:
+		case <-ctx.Done():
+			return
+		}
+
+		if ev.Type == bonfire.PeerEventRemoteAddrChanged {
+			select {
+			case <-peer.addrCh:
+			default:
+			}
+			peer.addrCh <- ev.Addr.String()
+		}
+
+		if appEventCh != nil {
+			select {
+			case appEventCh <- ev:
+			default:
+			}
+		}
+	}
+}
+
+// spin reads messages from the Peer and pushes them to msgs, until the given
+// Context is canceled (in which case it returns nil) or reading fails.
+func (peer *peer) spin(ctx context.Context) error {
+	b := make([]byte, 512+peer.sealer.overhead())
+	for {
+		if ctx.Err() != nil {
 			return nil
-		default:
 		}
 
 		peer.Peer.SetReadDeadline(time.Now().Add(1 * time.Second))
@@ -90,7 +150,10 @@ func (peer *peer) spin() error {
 		now := time.Now()
 
 		var msg Msg
-		if err := msgpack.Unmarshal(b[:n], &msg); err != nil {
+		if opened, err := peer.sealer.open(b[:n]); err != nil {
+			mlog.Warn("error opening sealed msg", peer.ctx, merr.Context(err))
+			continue
+		} else if err := msgpack.Unmarshal(opened, &msg); err != nil {
 			mlog.Warn("error unmarshaling msg", peer.ctx, merr.Context(err))
 			continue
 		} else if ip, _, err := net.SplitHostPort(msg.Addr); err != nil {
@@ -100,30 +163,48 @@ func (peer *peer) spin() error {
 			err := merr.New("invalid ip")
 			mlog.Warn("msg addr is malformed", peer.ctx, merr.Context(err))
 			continue
+		} else if msg.Relayer != "" && msg.Relayer != peerAddr.String() {
+			// a peer can only relay messages itself.
+			ctx := mctx.Annotate(peer.ctx,
+				"relayer", msg.Relayer,
+				"peer-addr", peerAddr.String(),
+			)
+			mlog.Warn("msg relayer doesn't match sender", ctx)
+			continue
 		}
 
-		peer.msgCh <- msgEvent{
+		peer.msgs.push(msgEvent{
 			Msg:      msg,
 			PeerAddr: peerAddr.String(),
 			TS:       now,
-		}
+		})
 	}
 }
 
-// Send sends the given Msg to the given addrs
+// Send sends the given Msg to the given addrs. Failing to send to one addr
+// doesn't prevent it being sent to the others; all failures are returned
+// together.
 func (peer *peer) Send(msg Msg, dstAddrs ...string) error {
 	b, err := msgpack.Marshal(msg)
 	if err != nil {
 		return merr.Wrap(err, peer.ctx)
+	} else if b, err = peer.sealer.seal(b); err != nil {
+		return merr.Wrap(err, peer.ctx)
 	}
 
+	var errs []error
+	udpAddrs := make([]net.Addr, 0, len(dstAddrs))
 	for _, addr := range dstAddrs {
-		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		udpAddr, err := peer.addrCache.Resolve(peer.ctx, addr)
 		if err != nil {
-			return merr.Wrap(err, mctx.Annotate(peer.ctx, "addr", addr))
-		} else if _, err := peer.WriteTo(b, udpAddr); err != nil {
-			return merr.Wrap(err, mctx.Annotate(peer.ctx, "addr", addr))
+			errs = append(errs, merr.Wrap(err, mctx.Annotate(peer.ctx, "addr", addr)))
+			continue
 		}
+		udpAddrs = append(udpAddrs, udpAddr)
+	}
+
+	if err := peer.Peer.Send(b, udpAddrs...); err != nil {
+		errs = append(errs, merr.Wrap(err, peer.ctx))
 	}
-	return nil
+	return errors.Join(errs...)
 }
@@ -0,0 +1,418 @@
+package actor
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// the most messages from peers which are recorded in a single transaction.
+const ingestBatchSize = 64
+
+// run runs the actor's pipelines until the Context is canceled:
+//
+//   - ingest records the Have and DontHave messages received from peers in
+//     batches, passes Needs messages on to answerNeeds, and answers shuffles
+//     and probes.
+//   - answerNeeds answers Needs messages by querying the database.
+//   - schedule sprays the resources the actor has, spread across the
+//     TickInterval, and periodically updates the actor's membership, probes
+//     a peer for failure, seeks the resources it needs, and reports to the
+//     coordinator. It also re-advertises the actor's resources when its
+//     address changes, see readdress.
+//   - handleCoord applies what the coordinator says to the actor's resources
+//     and needs, and tells Run when the coordinator has said to shut down.
+//
+// The pipelines are connected by bounded queues, and otherwise only share the
+// actor's resources, needs, membership and detector, so that one being slow
+// (e.g. spraying to many peers) doesn't stall the others. The database only
+// has a single connection though, so their queries are still serialized.
+func (app *app) run(ctx context.Context) error {
+	pipelines := []func(context.Context){
+		app.ingest, app.answerNeeds, app.schedule, app.handleCoord,
+	}
+
+	wg := new(sync.WaitGroup)
+	for _, pipeline := range pipelines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pipeline(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (app *app) hasResource(resource string) bool {
+	app.l.Lock()
+	defer app.l.Unlock()
+	return app.resources[resource]
+}
+
+func (app *app) ingest(ctx context.Context) {
+	for {
+		select {
+		case <-app.peer.msgs.notifyCh:
+			for app.ingestBatch(ctx, true) > 0 {
+			}
+		case <-ctx.Done():
+			app.drain(ctx)
+			return
+		}
+	}
+}
+
+// ingestBatch pops up to ingestBatchSize messages from peers off the queue,
+// records those which are Have or DontHave messages, and if answer is set
+// pushes Needs messages onto needsQ and handles shuffles and probes. It returns
+// the number of messages popped.
+func (app *app) ingestBatch(ctx context.Context, answer bool) int {
+	var n int
+	batch := make([]msgEvent, 0, ingestBatchSize)
+	for ; n < ingestBatchSize; n++ {
+		msg, ok := app.peer.msgs.pop()
+		if !ok {
+			break
+		}
+
+		app.logPeerMsg(ctx, msg)
+		app.members.heard(msg.PeerAddr, msg.TS)
+		if app.detector.heard(msg.PeerAddr) {
+			mlog.Info("suspected peer heard from", mctx.Annotate(ctx, "peer-addr", msg.PeerAddr))
+		}
+		switch msg.MsgType {
+		case MsgTypeHave, MsgTypeDontHave:
+			batch = append(batch, msg)
+		case MsgTypeNeeds:
+			if answer {
+				app.needsQ.push(msg)
+			}
+		case MsgTypeShuffle, MsgTypeShuffleReply:
+			if answer {
+				app.handleShuffle(ctx, msg)
+			}
+		case MsgTypePing, MsgTypePingReq, MsgTypeAck:
+			if answer {
+				app.handleProbe(ctx, msg)
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := app.db.recordHaves(batch); err != nil {
+			ctx := mctx.Annotate(ctx, "batch-size", len(batch))
+			mlog.Warn("error recording msgs", ctx, merr.Context(err))
+		}
+	}
+	return n
+}
+
+// handleShuffle integrates the addresses received in a shuffle into the
+// membership, replying to the sender if the shuffle was initiated by them.
+func (app *app) handleShuffle(ctx context.Context, msg msgEvent) {
+	reply := app.members.integrate(msg.Peers, msg.TS)
+	if msg.MsgType != MsgTypeShuffle {
+		return
+	}
+	err := app.peer.Send(Msg{
+		MsgType: MsgTypeShuffleReply,
+		Addr:    app.addr(),
+		Peers:   reply,
+	}, msg.PeerAddr)
+	if err != nil {
+		mlog.Warn("error replying to shuffle", ctx, merr.Context(err))
+	}
+}
+
+func (app *app) logPeerMsg(ctx context.Context, msg msgEvent) {
+	ctx = mctx.Annotate(ctx,
+		"addr", msg.Addr,
+		"resource", msg.Resource,
+	)
+	mlog.Info("got peer message", ctx)
+	app.event(ctx, "peer-msg", map[string]string{
+		"type":     msg.MsgType.String(),
+		"from":     msg.PeerAddr,
+		"addr":     msg.Addr,
+		"relayer":  msg.Relayer,
+		"resource": msg.Resource,
+	})
+}
+
+// drain records messages from peers which are still queued, so that records
+// which the coordinator may believe were delivered aren't lost, until either
+// the queue is empty or drainTimeout has elapsed. Needs messages aren't
+// answered.
+func (app *app) drain(ctx context.Context) {
+	var drained int
+	deadline := time.Now().Add(app.drainTimeout)
+	for app.drainTimeout > 0 && time.Now().Before(deadline) {
+		n := app.ingestBatch(ctx, false)
+		if n == 0 {
+			break
+		}
+		drained += n
+	}
+
+	var dropped int
+	for _, ok := app.peer.msgs.pop(); ok; _, ok = app.peer.msgs.pop() {
+		dropped++
+	}
+
+	ctx = mctx.Annotate(ctx, "drained", drained, "dropped", dropped)
+	if dropped > 0 {
+		mlog.Warn("dropped queued messages while draining", ctx)
+	} else if drained > 0 {
+		mlog.Info("drained queued messages", ctx)
+	}
+	app.event(ctx, "drained", map[string]string{
+		"drained": strconv.Itoa(drained),
+		"dropped": strconv.Itoa(dropped),
+	})
+}
+
+func (app *app) answerNeeds(ctx context.Context) {
+	for {
+		select {
+		case <-app.needsQ.notifyCh:
+			for msg, ok := app.needsQ.pop(); ok; msg, ok = app.needsQ.pop() {
+				if err := app.answerNeed(app.addr(), msg); err != nil {
+					ctx := mctx.Annotate(ctx,
+						"addr", msg.Addr,
+						"resource", msg.Resource,
+					)
+					mlog.Warn("error answering need", ctx, merr.Context(err))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// answerNeed tells the peer which sent the Needs message about all peers known
+// to have the resource, including this one.
+func (app *app) answerNeed(thisAddr string, msg msgEvent) error {
+	since := time.Now().Add(-app.peerActiveTimeout)
+	peerAddrs, err := app.db.peersWith(msg.Resource, since)
+	if err != nil {
+		return err
+	} else if app.hasResource(msg.Resource) {
+		peerAddrs = append(peerAddrs, thisAddr)
+	}
+
+	// if the msg was sent on behalf of a different peer, send the responses
+	// to both the sender and the original requester, so the sender can have
+	// it stored for themselves if they or someone else needs to know
+	dstAddrs := make([]string, 0, 2)
+	dstAddrs = append(dstAddrs, msg.Addr)
+	if msg.Addr != msg.PeerAddr {
+		dstAddrs = append(dstAddrs, msg.PeerAddr)
+	}
+
+	// responses carry the latest nonce known for the peer/resource, so that
+	// they're ordered the same as the peer's own messages. If this peer has
+	// never sent one about its own resource then it allocates one, rather
+	// than have its first-hand answer ordered before stale messages.
+	for _, peerAddr := range peerAddrs {
+		nonce, nonceErr := app.seq.Current(peerAddr, msg.Resource)
+		if nonceErr == nil && nonce == 0 && peerAddr == thisAddr {
+			nonce, nonceErr = app.seq.Next(thisAddr, msg.Resource)
+		}
+		if nonceErr != nil {
+			err = errors.Join(err, nonceErr)
+			continue
+		}
+		resMsg := Msg{
+			MsgType:  MsgTypeHave,
+			Addr:     peerAddr,
+			Resource: msg.Resource,
+			Nonce:    nonce,
+		}
+		if peerAddr != thisAddr {
+			resMsg.Relayer = thisAddr
+		}
+		err = errors.Join(err, app.peer.Send(resMsg, dstAddrs...))
+	}
+	return err
+}
+
+func (app *app) schedule(ctx context.Context) {
+	ticker := time.NewTicker(app.tickInterval)
+	defer ticker.Stop()
+	sprayTimer := time.NewTimer(app.tickInterval)
+	defer sprayTimer.Stop()
+
+	// resources which were obtained since the last wake-up are scheduled at
+	// the next, so may have to wait up to another interval to be sprayed.
+	reschedule := func() {
+		now := time.Now()
+		app.sprays.sync(app.resourceList(), now)
+		if next, ok := app.sprays.next(); ok {
+			sprayTimer.Reset(next.Sub(now))
+		} else {
+			sprayTimer.Reset(app.tickInterval)
+		}
+	}
+
+	reschedule()
+	for {
+		select {
+		case <-ticker.C:
+			app.tick(ctx, app.addr())
+		case <-sprayTimer.C:
+			app.sprayDue(ctx, app.addr())
+		case addr := <-app.peer.addrCh:
+			app.readdress(ctx, addr)
+		case <-ctx.Done():
+			return
+		}
+		reschedule()
+	}
+}
+
+// readdress is called when the bonfire peer's remote address changes, e.g.
+// because a NAT gateway assigned it a new external port. Subsequent messages
+// are sent from the new address, and for each of the actor's resources a
+// DontHave is sprayed on behalf of the old address, so that peers stop
+// directing others to it, followed by a Have from the new one.
+func (app *app) readdress(ctx context.Context, addr string) {
+	oldAddr := app.addr()
+	if addr == oldAddr {
+		return
+	}
+	app.addrL.Lock()
+	app.thisAddr = addr
+	app.addrL.Unlock()
+	app.members.setThisAddr(addr)
+
+	ctx = mctx.Annotate(ctx, "old-addr", oldAddr, "addr", addr)
+	mlog.Info("actor address changed", ctx)
+	app.event(ctx, "addr-changed", map[string]string{"old": oldAddr, "new": addr})
+
+	for _, resource := range app.resourceList() {
+		for _, msg := range []Msg{
+			{MsgType: MsgTypeDontHave, Addr: oldAddr, Relayer: addr, Resource: resource},
+			{MsgType: MsgTypeHave, Addr: addr, Resource: resource},
+		} {
+			var err error
+			if msg.Nonce, err = app.seq.Next(msg.Addr, resource); err != nil {
+				mlog.Warn("error allocating nonce", ctx, merr.Context(err))
+				continue
+			} else if err := app.spray(ctx, msg); err != nil {
+				mlog.Warn("error spraying msg", ctx, merr.Context(err))
+			}
+		}
+	}
+}
+
+func (app *app) resourceList() []string {
+	app.l.Lock()
+	defer app.l.Unlock()
+	resources := make([]string, 0, len(app.resources))
+	for resource := range app.resources {
+		resources = append(resources, resource)
+	}
+	return resources
+}
+
+// sprayDue sprays each resource which the sprayScheduler says is due.
+func (app *app) sprayDue(ctx context.Context, thisAddr string) {
+	for _, resource := range app.sprays.pop(time.Now()) {
+		if !app.hasResource(resource) {
+			continue
+		}
+
+		nonce, err := app.seq.Next(thisAddr, resource)
+		if err != nil {
+			mlog.Warn("error allocating nonce", ctx, merr.Context(err))
+			continue
+		}
+		msg := Msg{
+			MsgType:  MsgTypeHave,
+			Addr:     thisAddr,
+			Resource: resource,
+			Nonce:    nonce,
+		}
+		mlog.Info("spraying message", mctx.Annotate(ctx,
+			"addr", msg.Addr,
+			"resource", msg.Resource,
+		))
+		if err := app.spray(ctx, msg); err != nil {
+			mlog.Warn("error spraying msg", ctx, merr.Context(err))
+		}
+	}
+}
+
+// tick updates the actor's membership, probes a peer for failure, seeks the
+// resources it needs, and reports to the coordinator.
+func (app *app) tick(ctx context.Context, thisAddr string) {
+	if err := app.updateMembers(ctx, thisAddr); err != nil {
+		mlog.Warn("error updating members", ctx, merr.Context(err))
+	}
+	if err := app.detect(ctx, thisAddr); err != nil {
+		mlog.Warn("error detecting failed peers", ctx, merr.Context(err))
+	}
+
+	app.l.Lock()
+	needs := make([]string, 0, len(app.needs))
+	for resource := range app.needs {
+		needs = append(needs, resource)
+	}
+	app.l.Unlock()
+
+	for _, resource := range needs {
+		if err := app.seek(ctx, thisAddr, resource); err != nil {
+			mlog.Warn("error seeking resource", ctx, merr.Context(err))
+		}
+	}
+	if err := app.reportPeers(ctx); err != nil {
+		mlog.Warn("error reporting peers", ctx, merr.Context(err))
+	}
+	if err := app.reportMsgQueue(ctx); err != nil {
+		mlog.Warn("error reporting msg queue", ctx, merr.Context(err))
+	}
+	if err := app.reportDB(ctx); err != nil {
+		mlog.Warn("error reporting db", ctx, merr.Context(err))
+	}
+}
+
+func (app *app) handleCoord(ctx context.Context) {
+	for {
+		select {
+		case msg := <-app.coordMsgCh:
+			ctx := mctx.Annotate(ctx, "msgType", msg.Type())
+			mlog.Info("got coord message", ctx)
+			app.event(ctx, "coord-msg", gossip.CoordMsgEventFields(msg))
+
+			app.l.Lock()
+			switch msgT := msg.(type) {
+			case *gossip.CoordMsgNeed:
+				if !app.resources[msgT.Resource] {
+					app.needs[msgT.Resource] = true
+				}
+			case *gossip.CoordMsgHave:
+				app.resources[msgT.Resource] = true
+			case *gossip.CoordMsgDontHave:
+				delete(app.resources, msgT.Resource)
+			case *gossip.CoordMsgShutdown:
+				select {
+				case app.shutdownCh <- struct{}{}:
+				default:
+				}
+			}
+			app.l.Unlock()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
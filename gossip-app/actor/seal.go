@@ -0,0 +1,73 @@
+package actor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// sealer encrypts and authenticates the messages which actors send each other
+// using a key shared by the whole network, see Config's NetworkKey. This only
+// provides confidentiality from, and protection against forgery by, those
+// outside the network; any actor with the key can read and forge any message.
+// Replayed messages are dealt with as they would be unencrypted, i.e. by their
+// nonces.
+//
+// Messages are sealed individually, rather than the socket being wrapped,
+// because the Peer multiplexes bonfire's own packets over the same socket,
+// and those must remain readable by the bonfire Server.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+// newSealer returns a sealer using AES-GCM with the given key, which must be
+// 16, 24 or 32 bytes long. If the key is empty then nil is returned, and the
+// nil sealer leaves messages as they are.
+func newSealer(key []byte) (*sealer, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// overhead returns the number of bytes which sealing adds to a message.
+func (s *sealer) overhead() int {
+	if s == nil {
+		return 0
+	}
+	return s.aead.NonceSize() + s.aead.Overhead()
+}
+
+// seal returns the encrypted message, prefixed with the random nonce which it
+// was encrypted with.
+func (s *sealer) seal(b []byte) ([]byte, error) {
+	if s == nil {
+		return b, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(b)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, b, nil), nil
+}
+
+// open returns the decrypted message, or an error if it wasn't sealed using
+// the same key or has been tampered with.
+func (s *sealer) open(b []byte) ([]byte, error) {
+	if s == nil {
+		return b, nil
+	} else if len(b) < s.aead.NonceSize() {
+		return nil, errors.New("sealed msg is too short")
+	}
+	nonce, b := b[:s.aead.NonceSize()], b[s.aead.NonceSize():]
+	return s.aead.Open(nil, nonce, b, nil)
+}
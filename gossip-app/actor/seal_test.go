@@ -0,0 +1,56 @@
+package actor
+
+import (
+	"bytes"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestSealer(t *T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	s, err := newSealer(key)
+	massert.Require(t, massert.Nil(err))
+
+	msg := []byte("hello")
+	sealed, err := s.seal(msg)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(len(msg)+s.overhead(), len(sealed)),
+		massert.Not(massert.Equal(true, bytes.Contains(sealed, msg))),
+	)
+
+	opened, err := s.open(sealed)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(msg, opened),
+	)
+
+	// messages sealed with a different key, tampered with, or not sealed at
+	// all can't be opened.
+	other, err := newSealer(bytes.Repeat([]byte{2}, 32))
+	massert.Require(t, massert.Nil(err))
+	_, err = other.open(sealed)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = s.open(sealed)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	_, err = s.open(msg)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	// invalid keys are rejected, and no key means no sealing.
+	_, err = newSealer([]byte("short"))
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	var none *sealer
+	none, err = newSealer(nil)
+	massert.Require(t, massert.Nil(err))
+	sealed, err = none.seal(msg)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(msg, sealed),
+		massert.Equal(0, none.overhead()),
+	)
+}
@@ -0,0 +1,113 @@
+package actor
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// sprayScheduler decides when each of the actor's resources is next sprayed,
+// so that they're spread across the TickInterval rather than all being sprayed
+// at once.
+type sprayScheduler struct {
+	interval time.Duration
+
+	// each spray is scheduled an interval after the previous, plus or minus up
+	// to half of jitter.
+	jitter time.Duration
+
+	rand *rand.Rand
+	due  map[string]time.Time
+}
+
+func newSprayScheduler(interval, jitter time.Duration, rand *rand.Rand) *sprayScheduler {
+	return &sprayScheduler{
+		interval: interval,
+		jitter:   max(jitter, 0),
+		rand:     rand,
+		due:      map[string]time.Time{},
+	}
+}
+
+// sync schedules resources which the actor has newly obtained at random points
+// within the next interval, and forgets those which it no longer has.
+func (s *sprayScheduler) sync(resources []string, now time.Time) {
+	has := make(map[string]bool, len(resources))
+	for _, resource := range resources {
+		has[resource] = true
+	}
+	for resource := range s.due {
+		if !has[resource] {
+			delete(s.due, resource)
+		}
+	}
+
+	// resources are sorted so that, given the same seed, the same schedule is
+	// chosen.
+	resources = append([]string(nil), resources...)
+	sort.Strings(resources)
+	for _, resource := range resources {
+		if _, ok := s.due[resource]; !ok {
+			s.due[resource] = now.Add(time.Duration(s.rand.Int63n(int64(s.interval))))
+		}
+	}
+}
+
+// pop returns the resources which are due to be sprayed at the given time,
+// sorted, and schedules the next spray of each.
+func (s *sprayScheduler) pop(now time.Time) []string {
+	var resources []string
+	for resource, due := range s.due {
+		if !due.After(now) {
+			resources = append(resources, resource)
+		}
+	}
+	sort.Strings(resources)
+
+	for _, resource := range resources {
+		next := s.due[resource].Add(s.interval)
+		if s.jitter > 0 {
+			next = next.Add(time.Duration(s.rand.Int63n(int64(s.jitter))) - s.jitter/2)
+		}
+		// a resource which fell far behind, e.g. due to the pacer, isn't
+		// sprayed repeatedly to catch up.
+		if earliest := now.Add(s.interval / 2); next.Before(earliest) {
+			next = earliest
+		}
+		s.due[resource] = next
+	}
+	return resources
+}
+
+// next returns when the next resource is due to be sprayed, or false if there
+// are no resources.
+func (s *sprayScheduler) next() (time.Time, bool) {
+	var next time.Time
+	for _, due := range s.due {
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// pacer limits the rate at which packets are sprayed, see Config's
+// MaxSprayRate.
+type pacer struct {
+	rate int // packets per second, or 0 for no limit
+	next time.Time
+}
+
+// reserve reserves the sending of n packets at the given time, returning how
+// long the sender must wait before sending them.
+func (p *pacer) reserve(n int, now time.Time) time.Duration {
+	if p.rate <= 0 {
+		return 0
+	}
+	if p.next.Before(now) {
+		p.next = now
+	}
+	wait := p.next.Sub(now)
+	p.next = p.next.Add(time.Duration(n) * time.Second / time.Duration(p.rate))
+	return wait
+}
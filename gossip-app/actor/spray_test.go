@@ -0,0 +1,70 @@
+package actor
+
+import (
+	"math/rand"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestSprayScheduler(t *T) {
+	const interval = time.Second
+	now := time.Now()
+	s := newSprayScheduler(interval, interval/4, rand.New(rand.NewSource(1)))
+
+	_, ok := s.next()
+	massert.Require(t, massert.Equal(false, ok))
+
+	// new resources are spread across the next interval.
+	resources := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	s.sync(resources, now)
+	for _, resource := range resources {
+		due := s.due[resource]
+		massert.Require(t,
+			massert.Equal(false, due.Before(now)),
+			massert.Equal(true, due.Before(now.Add(interval))),
+		)
+	}
+	massert.Require(t, massert.Length(s.pop(now.Add(-time.Millisecond)), 0))
+
+	// every resource is sprayed once per interval, give or take the jitter,
+	// but no sooner than half an interval after being popped.
+	popped := s.pop(now.Add(interval))
+	massert.Require(t, massert.Equal(resources, popped))
+	for _, resource := range resources {
+		due := s.due[resource]
+		massert.Require(t,
+			massert.Equal(false, due.Before(now.Add(interval+interval/2))),
+			massert.Equal(true, due.Before(now.Add(2*interval+interval/8))),
+		)
+	}
+
+	next, ok := s.next()
+	massert.Require(t, massert.Equal(true, ok))
+	for _, due := range s.due {
+		massert.Require(t, massert.Equal(false, due.Before(next)))
+	}
+
+	// resources which are no longer had are forgotten.
+	s.sync([]string{"a"}, now)
+	massert.Require(t, massert.Length(s.due, 1))
+}
+
+func TestPacer(t *T) {
+	now := time.Now()
+
+	var p pacer
+	massert.Require(t, massert.Equal(time.Duration(0), p.reserve(100, now)))
+
+	p = pacer{rate: 10}
+	massert.Require(t,
+		massert.Equal(time.Duration(0), p.reserve(5, now)),
+		massert.Equal(500*time.Millisecond, p.reserve(1, now)),
+		massert.Equal(400*time.Millisecond, p.reserve(1, now.Add(200*time.Millisecond))),
+
+		// time which passes unused doesn't accumulate.
+		massert.Equal(time.Duration(0), p.reserve(1, now.Add(time.Minute))),
+		massert.Equal(100*time.Millisecond, p.reserve(1, now.Add(time.Minute))),
+	)
+}
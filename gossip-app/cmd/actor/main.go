@@ -0,0 +1,151 @@
+// Command actor runs a single actor of the gossip testing framework, see the
+// actor package.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/bonfire/gossip-app/actor"
+	"github.com/mediocregopher/bonfire/internal/logfmt"
+	"github.com/mediocregopher/mediocre-go-lib/m"
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/mediocregopher/mediocre-go-lib/mtime"
+)
+
+func main() {
+	ctx := logfmt.WithLogFormat(m.ServiceContext())
+
+	peerCtx := mctx.NewChild(ctx, "peer")
+	peerCtx, serverAddr := mcfg.WithString(peerCtx, "server-addr", "127.0.0.1:7890", "Address of a bonfire server which can be used to find other peers")
+	ctx = mctx.WithChild(ctx, peerCtx)
+
+	coordCtx := mctx.NewChild(ctx, "coord")
+	coordCtx, coordAddr := mcfg.WithString(coordCtx, "addr", "127.0.0.1:9876", "Address of the coordination server which will tell this actor what to do. A \"unix://\" or \"ws://\" (or \"wss://\") URL may be given to connect over a unix socket or a websocket instead of TCP.")
+	ctx = mctx.WithChild(ctx, coordCtx)
+
+	ctx, networkKey := mcfg.WithString(ctx, "network-key", "", "If set, hex-encoded 16, 24 or 32 byte key which messages to and from peers are encrypted with. Every actor in the network must be given the same key.")
+
+	ctx, eventLogPath := mcfg.WithString(ctx, "event-log-path", "", "If set, events describing what the actor does are appended to this file, which may be shared with the coordinator and other actors (see cmd/timeline)")
+
+	ctx, seed := mcfg.WithInt64(ctx, "seed", 0, "Seed for the actor's random decisions, so that a run can be repeated. If 0 a random seed is used, which is logged.")
+
+	ctx, msgQueueSize := mcfg.WithInt(ctx, "msg-queue-size", 128, "Number of messages received from peers which may be waiting to be processed")
+	ctx, activeViewSize := mcfg.WithInt(ctx, "active-view-size", 8, "Number of peers in the actor's active view of the network, which messages are sprayed to")
+	ctx, passiveViewSize := mcfg.WithInt(ctx, "passive-view-size", 32, "Number of peers in the actor's passive view of the network, which replace active peers as they fail")
+	ctx, tickInterval := mcfg.WithDuration(ctx, "tick-interval", mtime.Duration{Duration: 2 * time.Second}, "How often resources are sprayed, needs sought, and reports sent to the coordinator. Must be positive.")
+	ctx, peerActiveTimeout := mcfg.WithDuration(ctx, "peer-active-timeout", mtime.Duration{Duration: 5 * time.Minute}, "How long ago a peer may last have been heard of having a resource for that to still be believed")
+	ctx, suspectTimeout := mcfg.WithDuration(ctx, "suspect-timeout", mtime.Duration{}, "How long an active peer which is suspected of having failed may go without being heard from before it's confirmed as failed, and the resources it had are marked stale. 0 means 5 times tick-interval.")
+	ctx, sprayFanout := mcfg.WithInt(ctx, "spray-fanout", 0, "Number of active peers each message is sprayed to. 0 means half of them plus one, and it must not be negative.")
+	ctx, sprayJitter := mcfg.WithDuration(ctx, "spray-jitter", mtime.Duration{}, "Each resource is sprayed every tick-interval, at its own point within the interval, plus or minus up to half of this. 0 means a quarter of tick-interval, and if negative there is no jitter.")
+	ctx, maxSprayRate := mcfg.WithInt(ctx, "max-spray-rate", 0, "Most packets per second which are sprayed. 0 means no limit.")
+	ctx, maxDBRows := mcfg.WithInt(ctx, "max-db-rows", 0, "Maximum number of peer/resource states recorded, beyond which the least recently updated are evicted. 0 means no limit.")
+	ctx, slowQueryThreshold := mcfg.WithDuration(ctx, "slow-query-threshold", mtime.Duration{Duration: 100 * time.Millisecond}, "Database queries taking at least this long are logged. If negative no queries are logged.")
+	ctx, msgOverflow := mcfg.WithString(ctx, "msg-overflow", "drop", "What to do with messages received from peers once msg-queue-size are waiting to be processed: \"drop\" the oldest, or \"expand\" the queue")
+
+	threadCtx, threadCancel := context.WithCancel(ctx)
+	doneCh := make(chan struct{}) // closed once actor.Run returns
+	var eventLog *gossip.EventLog
+	ctx = mrun.WithStartHook(ctx, func(context.Context) error {
+		// a zero TickInterval would be defaulted by the actor, but the flag
+		// already has a default so 0 is a mistake. Negative values are
+		// rejected by the actor itself.
+		if tickInterval.Duration == 0 {
+			return merr.New("tick-interval must be positive", ctx)
+		}
+
+		var overflow actor.MsgOverflow
+		switch *msgOverflow {
+		case "drop":
+			overflow = actor.MsgOverflowDrop
+		case "expand":
+			overflow = actor.MsgOverflowExpand
+		default:
+			return merr.New("unknown msg-overflow", mctx.Annotate(ctx, "msg-overflow", *msgOverflow))
+		}
+
+		key, err := hex.DecodeString(*networkKey)
+		if err != nil {
+			return merr.Wrap(err, ctx)
+		}
+
+		if *eventLogPath != "" {
+			if eventLog, err = gossip.OpenEventLog(*eventLogPath); err != nil {
+				return merr.Wrap(err, mctx.Annotate(ctx, "path", *eventLogPath))
+			}
+		}
+
+		coordCtx := mctx.Annotate(coordCtx, "addr", *coordAddr)
+		mlog.Info("dialing coord server", coordCtx)
+		conn, err := gossip.DialCoord(coordCtx, *coordAddr)
+		if err != nil {
+			return merr.Wrap(err, coordCtx)
+		}
+
+		threadCtx = mrun.WithThreads(threadCtx, 1, func() error {
+			defer close(doneCh)
+			return actor.Run(threadCtx, actor.Config{
+				ServerAddr: *serverAddr,
+				CoordConn:  conn,
+				EventLog:   eventLog,
+				Seed:       *seed,
+				NetworkKey: key,
+
+				MsgQueueSize: *msgQueueSize,
+				MsgOverflow:  overflow,
+
+				ActiveViewSize:  *activeViewSize,
+				PassiveViewSize: *passiveViewSize,
+				SuspectTimeout:  suspectTimeout.Duration,
+
+				TickInterval:      tickInterval.Duration,
+				PeerActiveTimeout: peerActiveTimeout.Duration,
+
+				SprayFanout:  *sprayFanout,
+				SprayJitter:  sprayJitter.Duration,
+				MaxSprayRate: *maxSprayRate,
+
+				MaxDBRows:          *maxDBRows,
+				SlowQueryThreshold: slowQueryThreshold.Duration,
+			})
+		})
+		return nil
+	})
+
+	ctx = mrun.WithStopHook(ctx, func(innerCtx context.Context) error {
+		threadCancel()
+		err := mrun.Wait(threadCtx, innerCtx.Done())
+		eventLog.Close()
+		return err
+	})
+
+	// the actor stops by itself if the coordinator tells it to shut down.
+	startWaitStop(ctx, doneCh)
+}
+
+// startWaitStop is m.StartWaitStop, but also stops once doneCh is closed rather
+// than only when an interrupt signal is received.
+func startWaitStop(ctx context.Context, doneCh <-chan struct{}) {
+	m.Start(ctx)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	select {
+	case s := <-sigCh:
+		mlog.Info("signal received, stopping", mctx.Annotate(ctx, "signal", s))
+	case <-doneCh:
+		mlog.Info("actor stopped, stopping", ctx)
+	}
+
+	if err := mrun.Stop(ctx); err != nil {
+		mlog.Fatal("error triggering stop event", ctx, merr.Context(err))
+	}
+	mlog.Info("exiting process", ctx)
+}
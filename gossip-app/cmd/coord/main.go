@@ -0,0 +1,243 @@
+// Command coord runs the coordinator of the gossip testing framework, which
+// actors (see cmd/actor) connect to, and which tells them what to do according
+// to a scenario.
+//
+// If root-addr is set the coordinator runs as a worker instead, relaying the
+// actors which connect to it to the root coordinator at that address, which
+// runs the scenario. This allows experiments with more actors than a single
+// coordinator can handle connections from.
+//
+// With the "compare" scenario no actors connect. Instead the replication
+// scenario is run twice in-process (see the e2e package), once with actors
+// finding each other using bonfire and once with a static topology as a control
+// group, and metrics describing how quickly each converged are printed.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/bonfire/gossip-app/coord"
+	"github.com/mediocregopher/bonfire/gossip-app/e2e"
+	"github.com/mediocregopher/bonfire/internal/logfmt"
+	"github.com/mediocregopher/mediocre-go-lib/m"
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+	"github.com/mediocregopher/mediocre-go-lib/mtime"
+)
+
+func main() {
+	ctx := logfmt.WithLogFormat(m.ServiceContext())
+
+	ctx, listenAddr := mcfg.WithString(ctx, "listen-addr", "127.0.0.1:9876", "Address which actors connect to. A \"unix://\" or \"ws://\" URL may be given to accept connections over a unix socket or websockets instead of TCP, see gossip.DialCoord.")
+	ctx, httpAddr := mcfg.WithString(ctx, "http-addr", "", "If set, TCP address on which a dashboard showing the actors' topology and the scenario's progress is served")
+	ctx, eventLogPath := mcfg.WithString(ctx, "event-log-path", "", "If set, events describing what the coordinator does are appended to this file, which may be shared with the actors (see cmd/timeline)")
+	ctx, rootAddr := mcfg.WithString(ctx, "root-addr", "", "If set, run as a worker coordinator, relaying actors which connect to listen-addr to the root coordinator at this address, which is in the same format as listen-addr. The scenario and dashboard are then the root's, and those flags are ignored.")
+	ctx, shutdownTimeout := mcfg.WithDuration(ctx, "shutdown-timeout", mtime.Duration{Duration: 10 * time.Second}, "How long actors are given to shut down, sending their final reports, once a signal is received")
+	ctx, scenario := mcfg.WithString(ctx, "scenario", "replication", "Scenario to run, either \"replication\" or \"compare\", which runs the replication scenario in-process with and without bonfire and prints how quickly each converged.")
+
+	replCtx := mctx.NewChild(ctx, "replication")
+	replCtx, replResources := mcfg.WithInt(replCtx, "resources", 10, "Number of resources to replicate")
+	replCtx, replFactor := mcfg.WithInt(replCtx, "factor", 3, "Number of actors which should hold each resource")
+	replCtx, replInterval := mcfg.WithDuration(replCtx, "interval", mtime.Duration{Duration: time.Second}, "How often holders are counted and actors told what they need")
+	replCtx, replSeed := mcfg.WithInt64(replCtx, "seed", 0, "Seed for the scenario's random decisions, so that a run can be repeated. If 0 a random seed is used, which is logged.")
+	ctx = mctx.WithChild(ctx, replCtx)
+
+	compareCtx := mctx.NewChild(ctx, "compare")
+	compareCtx, compareActors := mcfg.WithInt(compareCtx, "actors", 6, "Number of actors to run in each half of the comparison")
+	compareCtx, compareStaticPeers := mcfg.WithInt(compareCtx, "static-peers", 3, "Number of peers each actor is given in the static half of the comparison")
+	compareCtx, compareTimeout := mcfg.WithDuration(compareCtx, "timeout", mtime.Duration{Duration: 30 * time.Second}, "How long each half of the comparison may take to converge")
+	ctx = mctx.WithChild(ctx, compareCtx)
+
+	c := coord.New(ctx)
+	threadCtx, threadCancel := context.WithCancel(ctx)
+	var listener net.Listener
+	var httpSrv *http.Server
+	var worker *coord.Worker
+	ctx = mrun.WithStartHook(ctx, func(context.Context) error {
+		if *rootAddr != "" {
+			var err error
+			if listener, err = gossip.ListenCoord(ctx, *listenAddr); err != nil {
+				return err
+			}
+			rootCtx := mctx.Annotate(ctx, "root-addr", *rootAddr)
+			rootConn, err := gossip.DialCoord(ctx, *rootAddr)
+			if err != nil {
+				return err
+			}
+			if worker, err = coord.NewWorker(ctx, listener.Addr().String(), rootConn); err != nil {
+				return err
+			}
+			mlog.Info("relaying actors to root coordinator", mctx.Annotate(rootCtx, "addr", listener.Addr().String()))
+
+			threadCtx = mrun.WithThreads(threadCtx, 1, func() error {
+				return worker.Serve(listener)
+			})
+			threadCtx = mrun.WithThreads(threadCtx, 1, func() error {
+				return worker.Run()
+			})
+			return nil
+		} else if *scenario == "compare" {
+			return nil
+		} else if *scenario != "replication" {
+			return merr.New("unknown scenario", mctx.Annotate(ctx, "scenario", *scenario))
+		}
+
+		if *eventLogPath != "" {
+			var err error
+			if c.EventLog, err = gossip.OpenEventLog(*eventLogPath); err != nil {
+				return merr.Wrap(err, mctx.Annotate(ctx, "path", *eventLogPath))
+			}
+		}
+
+		repl := &coord.Replication{
+			Factor:   *replFactor,
+			Interval: replInterval.Duration,
+			Seed:     *replSeed,
+			OnViolation: func(v coord.Violation) {
+				mlog.Warn("replication factor was violated", mctx.Annotate(replCtx,
+					"resource", v.Resource,
+					"duration", v.Duration().String(),
+					"min-holders", v.MinHolders,
+				))
+			},
+		}
+		for i := range *replResources {
+			repl.Resources = append(repl.Resources, fmt.Sprintf("resource-%d", i))
+		}
+
+		var err error
+		if listener, err = gossip.ListenCoord(ctx, *listenAddr); err != nil {
+			return err
+		}
+		mlog.Info("listening for actors", mctx.Annotate(ctx, "addr", listener.Addr().String()))
+
+		threadCtx = mrun.WithThreads(threadCtx, 1, func() error {
+			return c.Serve(listener)
+		})
+		threadCtx = mrun.WithThreads(threadCtx, 1, func() error {
+			return repl.Run(threadCtx, c)
+		})
+
+		if *httpAddr != "" {
+			httpSrv = &http.Server{
+				Addr:    *httpAddr,
+				Handler: &coord.Dashboard{Coordinator: c, Replication: repl},
+			}
+			mlog.Info("serving dashboard", mctx.Annotate(ctx, "addr", *httpAddr))
+			threadCtx = mrun.WithThreads(threadCtx, 1, func() error {
+				if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
+					return merr.Wrap(err, ctx)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	ctx = mrun.WithStopHook(ctx, func(innerCtx context.Context) error {
+		threadCancel()
+		if listener != nil {
+			listener.Close()
+		}
+		if httpSrv != nil {
+			httpSrv.Close()
+		}
+		if worker != nil {
+			worker.Close()
+		}
+		err := mrun.Wait(threadCtx, innerCtx.Done())
+		c.EventLog.Close()
+		return err
+	})
+
+	// this is m.StartWaitStop, except that the compare scenario stops once
+	// it's done rather than waiting for a signal, and actors are shut down
+	// before stopping. The scenario isn't known until m.Start has populated
+	// the configuration.
+	m.Start(ctx)
+	if worker == nil && *scenario == "compare" {
+		if err := compare(ctx, &e2e.CompareOpts{
+			Opts:      &e2e.Opts{StaticPeers: *compareStaticPeers},
+			Actors:    *compareActors,
+			Resources: *replResources,
+			Factor:    *replFactor,
+			Timeout:   compareTimeout.Duration,
+		}); err != nil {
+			mlog.Fatal("comparison failed", compareCtx, merr.Context(err))
+		}
+	} else {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt)
+		s := <-ch
+		mlog.Info("signal received, stopping", mctx.Annotate(ctx, "signal", s))
+		if worker == nil {
+			shutdownActors(ctx, c, shutdownTimeout.Duration)
+		}
+	}
+
+	if err := mrun.Stop(ctx); err != nil {
+		mlog.Fatal("error triggering stop event", ctx, merr.Context(err))
+	}
+	mlog.Info("exiting process", ctx)
+}
+
+// shutdownActors tells all actors to shut down and logs their final states.
+func shutdownActors(ctx context.Context, c *coord.Coordinator, timeout time.Duration) {
+	shutdownCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	states, err := c.Shutdown(shutdownCtx)
+	for _, state := range states {
+		mlog.Info("actor shut down", mctx.Annotate(ctx,
+			"actor-addr", state.Addr,
+			"resources", len(state.Resources),
+			"peers", len(state.Peers),
+			"msgs-dropped", state.MsgsDropped,
+			"db-rows", state.DBRows,
+			"db-evicted", state.DBEvicted,
+		))
+	}
+	if err != nil {
+		mlog.Warn("not all actors shut down cleanly", ctx, merr.Context(err))
+	}
+}
+
+// compare runs e2e.Compare and prints the metrics of both halves as a table.
+func compare(ctx context.Context, opts *e2e.CompareOpts) error {
+	discovered, static, err := e2e.Compare(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	orNever := func(d time.Duration) string {
+		if d == 0 {
+			return "never"
+		}
+		return d.Round(time.Millisecond).String()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPOLOGY\tACTORS\tSTARTUP\tCONNECTED AFTER\tCONVERGED AFTER\tVIOLATIONS\tMSGS DROPPED")
+	for _, m := range []e2e.Metrics{discovered, static} {
+		topology := "bonfire"
+		if m.StaticTopology {
+			topology = "static"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%v\t%s\t%s\t%d\t%d\n",
+			topology, m.Actors, m.StartupTime.Round(time.Millisecond),
+			orNever(m.ConnectedAfter), orNever(m.ConvergedAfter),
+			m.Violations, m.MsgsDropped,
+		)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,85 @@
+// Command timeline merges the event logs written by the coordinator and actors
+// of the gossip testing framework (see their --event-log-path parameters) and
+// renders them as a single timeline, e.g.:
+//
+//	timeline -actor 127.0.0.1:5000 coord.jsonl actor-*.jsonl
+//
+// Each line of the timeline gives the time since the first event, the source
+// of the event, the actor it concerns, and the event itself.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mediocregopher/bonfire/gossip-app"
+)
+
+func readEvents(paths []string) ([]gossip.Event, error) {
+	var sets [][]gossip.Event
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		events, err := gossip.ReadEvents(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %q: %w", path, err)
+		}
+		sets = append(sets, events)
+	}
+	return gossip.MergeEvents(sets...), nil
+}
+
+func render(w io.Writer, events []gossip.Event, actor string) {
+	if len(events) == 0 {
+		return
+	}
+	start := events[0].Time
+	for _, e := range events {
+		if actor != "" && e.Actor != actor && e.Source != actor {
+			continue
+		}
+
+		keys := make([]string, 0, len(e.Fields))
+		for k := range e.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fields := make([]string, len(keys))
+		for i, k := range keys {
+			fields[i] = k + "=" + e.Fields[k]
+		}
+
+		fmt.Fprintf(w, "%12.6fs  %-21s  %-21s  %-18s  %s\n",
+			e.Time.Sub(start).Seconds(), e.Source, e.Actor, e.Event,
+			strings.Join(fields, " "),
+		)
+	}
+}
+
+func main() {
+	actor := flag.String("actor", "", "If set, only events written by, or concerning, the actor with this address are shown")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <event-log>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	events, err := readEvents(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	render(os.Stdout, events, *actor)
+}
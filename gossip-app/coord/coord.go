@@ -0,0 +1,381 @@
+// Package coord implements the coordinator of the gossip testing framework,
+// which actors connect to in order to be told which resources they have and
+// need, according to some scenario.
+package coord
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// encoder is implemented by gossip.CoordConn, and by relayEncoder for actors
+// which are connected to a worker coordinator.
+type encoder interface {
+	Encode(gossip.CoordMsg) error
+}
+
+type actor struct {
+	enc       encoder
+	worker    string // name of the worker the actor is connected to, if any
+	resources map[string]bool
+	peers     []string
+	msgQueue  gossip.CoordMsgMsgQueue
+	db        gossip.CoordMsgDB
+
+	// set once the actor has acknowledged a CoordMsgShutdown, to its state at
+	// that point, see Shutdown.
+	final *ActorState
+
+	// closed once the actor has been removed.
+	doneCh chan struct{}
+
+	// encoding may happen from multiple go-routines.
+	encL sync.Mutex
+}
+
+func (a *actor) encode(msg gossip.CoordMsg) error {
+	a.encL.Lock()
+	defer a.encL.Unlock()
+	return a.enc.Encode(msg)
+}
+
+// Coordinator keeps track of the actors connected to it, either directly or via
+// a worker coordinator (see Worker), and of which resources each has. Actors
+// are identified by the peer address given in their CoordMsgHello.
+type Coordinator struct {
+	// If set, Events describing actors connecting and disconnecting, and the
+	// messages sent to and received from them, are written to this EventLog.
+	// It must be set before Serve or Handle are called.
+	EventLog *gossip.EventLog
+
+	ctx context.Context
+
+	l      sync.Mutex
+	actors map[string]*actor
+}
+
+// New initializes and returns a Coordinator with no actors. The Context is
+// only used for logging.
+func New(ctx context.Context) *Coordinator {
+	return &Coordinator{
+		ctx:    mctx.NewChild(ctx, "coord"),
+		actors: map[string]*actor{},
+	}
+}
+
+// event writes an Event concerning the given actor to the EventLog, if there
+// is one. Errors are only logged, as the EventLog is purely diagnostic.
+func (c *Coordinator) event(actor, event string, fields map[string]string) {
+	err := c.EventLog.Log(gossip.Event{
+		Source: gossip.EventSourceCoord,
+		Actor:  actor,
+		Event:  event,
+		Fields: fields,
+	})
+	if err != nil {
+		mlog.Warn("error writing to event log", c.ctx, merr.Context(err))
+	}
+}
+
+// Serve accepts connections from actors on the Listener, handling each in its
+// own go-routine (see Handle), until the Listener is closed.
+func (c *Coordinator) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return merr.Wrap(err, c.ctx)
+		}
+		go func() {
+			ctx := mctx.Annotate(c.ctx, "remote-addr", conn.RemoteAddr().String())
+			if err := c.Handle(conn); err != nil {
+				mlog.Warn("actor connection closed", ctx, merr.Context(err))
+			}
+		}()
+	}
+}
+
+// Handle reads messages from an actor's connection until it's closed, until the
+// actor acknowledges a shutdown (see Shutdown), or until an error is
+// encountered, and then removes the actor. If the connection is from a worker
+// coordinator rather than an actor then all of the actors connected to the
+// worker are handled, see gossip.CoordMsgWorker. The connection is closed when
+// Handle returns.
+func (c *Coordinator) Handle(conn net.Conn) error {
+	cc := gossip.NewCoordConn(conn)
+	defer cc.Close()
+
+	msg, err := cc.Decode()
+	if err != nil {
+		return err
+	} else if worker, ok := msg.(*gossip.CoordMsgWorker); ok {
+		return c.handleWorker(cc, worker.Name)
+	}
+	hello, ok := msg.(*gossip.CoordMsgHello)
+	if !ok {
+		return merr.New("expected hello message", c.ctx)
+	}
+
+	ctx := mctx.Annotate(c.ctx, "actor-addr", hello.Addr)
+	a := c.addActor(ctx, hello.Addr, "", cc)
+	defer c.removeActor(ctx, hello.Addr, a)
+
+	for {
+		msg, err := cc.Decode()
+		if err != nil {
+			return merr.Wrap(err, ctx)
+		} else if c.handleMsg(ctx, hello.Addr, a, msg) {
+			return nil
+		}
+	}
+}
+
+// addActor records a newly connected actor, which is sent messages using the
+// encoder.
+func (c *Coordinator) addActor(ctx context.Context, addr, worker string, enc encoder) *actor {
+	a := &actor{
+		enc:       enc,
+		worker:    worker,
+		resources: map[string]bool{},
+		doneCh:    make(chan struct{}),
+	}
+	c.l.Lock()
+	c.actors[addr] = a
+	c.l.Unlock()
+
+	mlog.Info("actor connected", ctx)
+	var fields map[string]string
+	if worker != "" {
+		fields = map[string]string{"worker": worker}
+	}
+	c.event(addr, "connected", fields)
+	return a
+}
+
+// removeActor removes an actor which was added by addActor, unless it's since
+// been replaced by one which connected with the same address. It must only be
+// called once per actor.
+func (c *Coordinator) removeActor(ctx context.Context, addr string, a *actor) {
+	c.l.Lock()
+	if c.actors[addr] == a {
+		delete(c.actors, addr)
+	}
+	c.l.Unlock()
+	close(a.doneCh)
+	mlog.Info("actor disconnected", ctx)
+	c.event(addr, "disconnected", nil)
+}
+
+// handleMsg applies a message received from an actor. It returns true if the
+// message acknowledged a shutdown, in which case no more are expected.
+func (c *Coordinator) handleMsg(ctx context.Context, addr string, a *actor, msg gossip.CoordMsg) bool {
+	c.event(addr, "msg-received", gossip.CoordMsgEventFields(msg))
+	c.l.Lock()
+	defer c.l.Unlock()
+	switch msg := msg.(type) {
+	case *gossip.CoordMsgHave:
+		a.resources[msg.Resource] = true
+	case *gossip.CoordMsgDontHave:
+		delete(a.resources, msg.Resource)
+	case *gossip.CoordMsgPeers:
+		a.peers = msg.Addrs
+	case *gossip.CoordMsgMsgQueue:
+		a.msgQueue = *msg
+	case *gossip.CoordMsgDB:
+		a.db = *msg
+	case *gossip.CoordMsgShutdown:
+		final := a.state(addr)
+		a.final = &final
+		mlog.Info("actor shut down", ctx)
+		return true
+	}
+	return false
+}
+
+// Actors returns the addresses of all connected actors, sorted.
+func (c *Coordinator) Actors() []string {
+	c.l.Lock()
+	defer c.l.Unlock()
+	addrs := make([]string, 0, len(c.actors))
+	for addr := range c.actors {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Holders returns the addresses of all connected actors which have the given
+// resource, sorted.
+func (c *Coordinator) Holders(resource string) []string {
+	c.l.Lock()
+	defer c.l.Unlock()
+	var addrs []string
+	for addr, a := range c.actors {
+		if a.resources[resource] {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// ActorState describes a connected actor as of some point in time.
+type ActorState struct {
+	Addr string `json:"addr"`
+
+	// The name of the worker coordinator which the actor is connected to, if
+	// it isn't connected to the Coordinator directly.
+	Worker string `json:"worker,omitempty"`
+
+	// The actors which the actor's bonfire Peer lists as its peers, as last
+	// reported by the actor. Addresses which aren't those of connected actors
+	// may be included.
+	Peers []string `json:"peers"`
+
+	// The resources which the actor has, sorted.
+	Resources []string `json:"resources"`
+
+	// The largest number of messages from peers which were waiting to be
+	// processed by the actor during its last reporting period, and the number
+	// which can be waiting (0 if unbounded), as last reported by the actor.
+	MsgQueueMaxLen int `json:"msgQueueMaxLen"`
+	MsgQueueSize   int `json:"msgQueueSize"`
+
+	// Total number of messages from peers which the actor has dropped due to
+	// its queue being full.
+	MsgsDropped uint64 `json:"msgsDropped"`
+
+	// The number of rows in the actor's database, the number it can hold (0
+	// if unlimited), and the total number evicted due to it being full, as
+	// last reported by the actor.
+	DBRows    int    `json:"dbRows"`
+	DBMaxRows int    `json:"dbMaxRows"`
+	DBEvicted uint64 `json:"dbEvicted"`
+
+	// How long each of the actor's database queries has taken, as last
+	// reported by the actor.
+	DBQueries []gossip.QueryStats `json:"dbQueries"`
+}
+
+// Saturated returns whether the actor's queue of messages from peers was full
+// at some point during its last reporting period.
+func (s ActorState) Saturated() bool {
+	return s.MsgQueueSize > 0 && s.MsgQueueMaxLen >= s.MsgQueueSize
+}
+
+// State returns the state of all connected actors, sorted by address.
+func (c *Coordinator) State() []ActorState {
+	c.l.Lock()
+	defer c.l.Unlock()
+	states := make([]ActorState, 0, len(c.actors))
+	for addr, a := range c.actors {
+		states = append(states, a.state(addr))
+	}
+	sortStates(states)
+	return states
+}
+
+func sortStates(states []ActorState) {
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Addr < states[j].Addr
+	})
+}
+
+// state returns the actor's ActorState. The Coordinator's lock must be held.
+func (a *actor) state(addr string) ActorState {
+	state := ActorState{
+		Addr:      addr,
+		Worker:    a.worker,
+		Peers:     append([]string{}, a.peers...),
+		Resources: make([]string, 0, len(a.resources)),
+
+		MsgQueueMaxLen: a.msgQueue.MaxLen,
+		MsgQueueSize:   a.msgQueue.Size,
+		MsgsDropped:    a.msgQueue.Dropped,
+
+		DBRows:    a.db.Rows,
+		DBMaxRows: a.db.MaxRows,
+		DBEvicted: a.db.Evicted,
+		DBQueries: append([]gossip.QueryStats(nil), a.db.Queries...),
+	}
+	for resource := range a.resources {
+		state.Resources = append(state.Resources, resource)
+	}
+	sort.Strings(state.Resources)
+	return state
+}
+
+// Send sends the message to the actor with the given address. A CoordMsgHave
+// or CoordMsgDontHave is also recorded as changing the actor's resources.
+func (c *Coordinator) Send(addr string, msg gossip.CoordMsg) error {
+	c.l.Lock()
+	a, ok := c.actors[addr]
+	if ok {
+		switch msg := msg.(type) {
+		case *gossip.CoordMsgHave:
+			a.resources[msg.Resource] = true
+		case *gossip.CoordMsgDontHave:
+			delete(a.resources, msg.Resource)
+		}
+	}
+	c.l.Unlock()
+
+	if !ok {
+		return merr.New("unknown actor", mctx.Annotate(c.ctx, "actor-addr", addr))
+	}
+	c.event(addr, "msg-sent", gossip.CoordMsgEventFields(msg))
+	return a.encode(msg)
+}
+
+// Shutdown sends a CoordMsgShutdown to every connected actor, and waits for
+// each to send its final reports and disconnect, or for the Context to be
+// done. It returns the final state of every actor which acknowledged the
+// shutdown, sorted by address, along with an error if any didn't.
+func (c *Coordinator) Shutdown(ctx context.Context) ([]ActorState, error) {
+	c.l.Lock()
+	actors := make(map[string]*actor, len(c.actors))
+	for addr, a := range c.actors {
+		actors[addr] = a
+	}
+	c.l.Unlock()
+
+	var errs []error
+	for addr, a := range actors {
+		c.event(addr, "msg-sent", gossip.CoordMsgEventFields(&gossip.CoordMsgShutdown{}))
+		if err := a.encode(&gossip.CoordMsgShutdown{}); err != nil {
+			errs = append(errs, merr.Wrap(err, mctx.Annotate(c.ctx, "actor-addr", addr)))
+			delete(actors, addr)
+		}
+	}
+
+	states := make([]ActorState, 0, len(actors))
+	for addr, a := range actors {
+		actorCtx := mctx.Annotate(c.ctx, "actor-addr", addr)
+		select {
+		case <-a.doneCh:
+		case <-ctx.Done():
+			errs = append(errs, merr.Wrap(ctx.Err(), actorCtx))
+			continue
+		}
+
+		c.l.Lock()
+		final := a.final
+		c.l.Unlock()
+		if final == nil {
+			errs = append(errs, merr.New("actor disconnected without acknowledging shutdown", actorCtx))
+			continue
+		}
+		states = append(states, *final)
+	}
+	sortStates(states)
+	return states, errors.Join(errs...)
+}
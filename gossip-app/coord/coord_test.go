@@ -0,0 +1,62 @@
+package coord
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestShutdown(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := New(ctx)
+
+	// connect has an actor connect, which when told to shut down sends a
+	// final report, and then acknowledges it if ack is set.
+	connect := func(addr string, ack bool) {
+		actorConn, coordConn := net.Pipe()
+		go c.Handle(coordConn)
+
+		cc := gossip.NewCoordConn(actorConn)
+		massert.Require(t, massert.Nil(cc.Encode(&gossip.CoordMsgHello{Addr: addr})))
+		go func() {
+			defer cc.Close()
+			for {
+				msg, err := cc.Decode()
+				if err != nil {
+					return
+				} else if msg.Type() != gossip.CoordMsgTypeShutdown {
+					continue
+				}
+				cc.Encode(&gossip.CoordMsgDB{Rows: 5})
+				if ack {
+					cc.Encode(&gossip.CoordMsgShutdown{})
+				}
+				return
+			}
+		}()
+	}
+	connect("a", true)
+	connect("b", false)
+	connect("c", true)
+	for len(c.Actors()) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	states, err := c.Shutdown(ctx)
+	massert.Require(t,
+		massert.Not(massert.Nil(err)),
+		massert.Length(states, 2),
+		massert.Length(c.Actors(), 0),
+	)
+	for i, addr := range []string{"a", "c"} {
+		massert.Require(t,
+			massert.Equal(addr, states[i].Addr),
+			massert.Equal(5, states[i].DBRows),
+		)
+	}
+}
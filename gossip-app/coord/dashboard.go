@@ -0,0 +1,166 @@
+package coord
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// ResourceState describes how widely a resource is held.
+type ResourceState struct {
+	Resource string `json:"resource"`
+	Holders  int    `json:"holders"`
+
+	// The number of holders the scenario is aiming for.
+	Target int `json:"target"`
+}
+
+// DashboardState is what's rendered by a Dashboard, and is served by it as
+// JSON at /state.json.
+type DashboardState struct {
+	Time      time.Time       `json:"time"`
+	Actors    []ActorState    `json:"actors"`
+	Resources []ResourceState `json:"resources"`
+
+	// The fraction of actors which are in the largest group of actors which
+	// can reach each other via the peers they list, regardless of which one
+	// did the listing. 1 once the topology has fully converged.
+	Connected float64 `json:"connected"`
+
+	// The fraction of resources which have reached their target number of
+	// holders.
+	Replicated float64 `json:"replicated"`
+
+	// The number of actors whose queue of messages from peers was full during
+	// their last reporting period, and the total number of messages dropped
+	// by all actors due to their queues being full.
+	SaturatedActors int    `json:"saturatedActors"`
+	MsgsDropped     uint64 `json:"msgsDropped"`
+
+	// The total number of database rows evicted by all actors due to their
+	// databases being full.
+	DBEvicted uint64 `json:"dbEvicted"`
+
+	// The seed of the scenario, with which it can be repeated.
+	Seed int64 `json:"seed,omitempty,string"`
+
+	// Violations of the scenario which haven't yet ended.
+	OpenViolations []Violation `json:"openViolations"`
+}
+
+// Dashboard is an http.Handler serving a page which shows the actors connected
+// to a Coordinator, which of them list each other as peers, how resources are
+// distributed amongst them, and how close the scenario is to converging. The
+// page updates itself in real time.
+type Dashboard struct {
+	Coordinator *Coordinator
+
+	// If set, the progress of the Replication scenario is shown as well.
+	Replication *Replication
+}
+
+// State returns the current DashboardState.
+func (d *Dashboard) State() DashboardState {
+	state := DashboardState{
+		Time:   time.Now(),
+		Actors: d.Coordinator.State(),
+	}
+	state.Connected = connected(state.Actors)
+	for _, a := range state.Actors {
+		if a.Saturated() {
+			state.SaturatedActors++
+		}
+		state.MsgsDropped += a.MsgsDropped
+		state.DBEvicted += a.DBEvicted
+	}
+
+	if r := d.Replication; r != nil {
+		factor := r.factor()
+		state.Seed = r.seed()
+		var replicated int
+		for _, resource := range r.Resources {
+			holders := len(d.Coordinator.Holders(resource))
+			if holders >= factor {
+				replicated++
+			}
+			state.Resources = append(state.Resources, ResourceState{
+				Resource: resource,
+				Holders:  holders,
+				Target:   factor,
+			})
+		}
+		if len(r.Resources) > 0 {
+			state.Replicated = float64(replicated) / float64(len(r.Resources))
+		}
+		for _, v := range r.Violations() {
+			if v.End.IsZero() {
+				state.OpenViolations = append(state.OpenViolations, v)
+			}
+		}
+	}
+
+	return state
+}
+
+// connected returns the fraction of actors in the largest connected component
+// of the graph formed by their peers, with peers being treated as undirected
+// edges.
+func connected(actors []ActorState) float64 {
+	if len(actors) == 0 {
+		return 0
+	}
+
+	edges := map[string][]string{}
+	for _, a := range actors {
+		edges[a.Addr] = append(edges[a.Addr], a.Peers...)
+		for _, peer := range a.Peers {
+			edges[peer] = append(edges[peer], a.Addr)
+		}
+	}
+
+	isActor := map[string]bool{}
+	for _, a := range actors {
+		isActor[a.Addr] = true
+	}
+
+	seen := map[string]bool{}
+	var largest int
+	for _, a := range actors {
+		if seen[a.Addr] {
+			continue
+		}
+		var size int
+		seen[a.Addr] = true
+		stack := []string{a.Addr}
+		for len(stack) > 0 {
+			addr := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			size++
+			for _, next := range edges[addr] {
+				if isActor[next] && !seen[next] {
+					seen[next] = true
+					stack = append(stack, next)
+				}
+			}
+		}
+		largest = max(largest, size)
+	}
+	return float64(largest) / float64(len(actors))
+}
+
+func (d *Dashboard) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/":
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Write(dashboardHTML)
+	case "/state.json":
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(d.State())
+	default:
+		http.NotFound(rw, r)
+	}
+}
@@ -0,0 +1,83 @@
+package coord
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestConnected(t *T) {
+	actors := func(peers ...[]string) []ActorState {
+		var states []ActorState
+		for i, p := range peers {
+			states = append(states, ActorState{Addr: string(rune('a' + i)), Peers: p})
+		}
+		return states
+	}
+
+	massert.Require(t,
+		massert.Equal(float64(0), connected(nil)),
+		massert.Equal(0.25, connected(actors(nil, nil, nil, nil))),
+		// b listing a is enough for them to be connected, and peers which
+		// aren't actors don't count.
+		massert.Equal(0.5, connected(actors(nil, []string{"a", "z"}, nil, nil))),
+		massert.Equal(0.75, connected(actors(nil, []string{"a"}, []string{"b"}, nil))),
+		massert.Equal(float64(1), connected(actors(
+			[]string{"b"}, nil, []string{"d"}, []string{"a"},
+		))),
+	)
+}
+
+func TestDashboard(t *T) {
+	c := New(context.Background())
+	actorConn, coordConn := net.Pipe()
+	go c.Handle(coordConn)
+	cc := gossip.NewCoordConn(actorConn)
+	defer cc.Close()
+	massert.Require(t,
+		massert.Nil(cc.Encode(&gossip.CoordMsgHello{Addr: "10.0.0.1:1"})),
+		massert.Nil(cc.Encode(&gossip.CoordMsgPeers{Addrs: []string{"10.0.0.2:1"}})),
+		massert.Nil(cc.Encode(&gossip.CoordMsgHave{Resource: "foo"})),
+	)
+	for len(c.Holders("foo")) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	repl := &Replication{Resources: []string{"foo", "bar"}, Factor: 1}
+	srv := httptest.NewServer(&Dashboard{Coordinator: c, Replication: repl})
+	defer srv.Close()
+
+	res, err := srv.Client().Get(srv.URL + "/state.json")
+	massert.Require(t, massert.Nil(err))
+	defer res.Body.Close()
+
+	var state DashboardState
+	massert.Require(t, massert.Nil(json.NewDecoder(res.Body).Decode(&state)))
+	massert.Require(t,
+		massert.Equal([]ActorState{{
+			Addr:      "10.0.0.1:1",
+			Peers:     []string{"10.0.0.2:1"},
+			Resources: []string{"foo"},
+		}}, state.Actors),
+		massert.Equal([]ResourceState{
+			{Resource: "foo", Holders: 1, Target: 1},
+			{Resource: "bar", Holders: 0, Target: 1},
+		}, state.Resources),
+		massert.Equal(float64(1), state.Connected),
+		massert.Equal(0.5, state.Replicated),
+	)
+
+	res, err = srv.Client().Get(srv.URL + "/")
+	massert.Require(t, massert.Nil(err))
+	res.Body.Close()
+	massert.Require(t,
+		massert.Equal(200, res.StatusCode),
+		massert.Equal("text/html; charset=utf-8", res.Header.Get("Content-Type")),
+	)
+}
@@ -0,0 +1,264 @@
+package coord
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// Violation describes a window of time during which a resource was held by
+// fewer actors than a Replication's Factor.
+type Violation struct {
+	Resource string
+	Start    time.Time
+
+	// End is zero if the violation is ongoing.
+	End time.Time
+
+	// The fewest actors which held the resource during the window.
+	MinHolders int
+}
+
+// Duration returns how long the violation lasted, or has lasted so far if it's
+// ongoing.
+func (v Violation) Duration() time.Duration {
+	if v.End.IsZero() {
+		return time.Since(v.Start)
+	}
+	return v.End.Sub(v.Start)
+}
+
+// Replication is a scenario in which the coordinator tries to keep each of a
+// set of resources held by Factor actors, despite actors coming and going. A
+// resource held by no actors is given to one with a CoordMsgHave, after which
+// further actors are told they need it with a CoordMsgNeed, and are expected
+// to obtain it from the others via the gossip layer.
+type Replication struct {
+	// The resources to replicate.
+	Resources []string
+
+	// The number of actors which should hold each resource. Default is 3.
+	Factor int
+
+	// How often holders are counted and Need commands sent. Default is
+	// time.Second.
+	Interval time.Duration
+
+	// How long an actor is given to obtain a resource it has been told it
+	// needs before another actor is asked in its place. Default is 10 *
+	// Interval.
+	NeedTimeout time.Duration
+
+	// The seed for the random decisions made, i.e. which actors are given or
+	// told they need resources, so that runs can be repeated. If 0 a random
+	// seed is used, and Seed is set to it by Run.
+	Seed int64
+
+	// If set, OnViolation is called (from the go-routine calling Run) each
+	// time a violation ends.
+	OnViolation func(Violation)
+
+	l          sync.Mutex
+	rand       *rand.Rand
+	violations []Violation
+	open       map[string]int // index into violations, by resource
+	pending    map[string]map[string]time.Time
+}
+
+func (r *Replication) withDefaults() {
+	if r.Factor == 0 {
+		r.Factor = 3
+	}
+	if r.Interval == 0 {
+		r.Interval = time.Second
+	}
+	if r.NeedTimeout == 0 {
+		r.NeedTimeout = 10 * r.Interval
+	}
+	if r.Seed == 0 {
+		r.Seed = time.Now().UnixNano()
+	}
+}
+
+// init prepares the Replication to be run, returning the seed being used.
+func (r *Replication) init() int64 {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.withDefaults()
+	r.rand = rand.New(rand.NewSource(r.Seed))
+	r.open = map[string]int{}
+	r.pending = map[string]map[string]time.Time{}
+	return r.Seed
+}
+
+// Run runs the scenario against the Coordinator's actors until the Context is
+// canceled.
+func (r *Replication) Run(ctx context.Context, c *Coordinator) error {
+	seedStr := strconv.FormatInt(r.init(), 10)
+	mlog.Info("running replication scenario", mctx.Annotate(c.ctx, "seed", seedStr))
+	c.event("", "scenario-started", map[string]string{
+		"scenario": "replication",
+		"seed":     seedStr,
+	})
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		r.tick(c, time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Violations returns all violations which have occurred so far, including
+// ongoing ones, in the order they started.
+func (r *Replication) Violations() []Violation {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return append([]Violation(nil), r.violations...)
+}
+
+// factor returns Factor, which may be set by Run concurrently.
+func (r *Replication) factor() int {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.Factor
+}
+
+// seed returns Seed, which may be set by Run concurrently.
+func (r *Replication) seed() int64 {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.Seed
+}
+
+func (r *Replication) tick(c *Coordinator, now time.Time) {
+	actors := c.Actors()
+	for _, resource := range r.Resources {
+		ctx := mctx.Annotate(c.ctx, "resource", resource)
+		holders := c.Holders(resource)
+		started, ended, ok := r.track(resource, len(holders), now)
+		if started {
+			c.event("", "violation-started", map[string]string{
+				"resource": resource,
+				"holders":  strconv.Itoa(len(holders)),
+			})
+		} else if ok {
+			c.event("", "violation-ended", map[string]string{
+				"resource":    resource,
+				"duration":    ended.Duration().String(),
+				"min-holders": strconv.Itoa(ended.MinHolders),
+			})
+			if r.OnViolation != nil {
+				r.OnViolation(ended)
+			}
+		}
+
+		for _, addr := range r.assign(resource, actors, holders, now) {
+			var msg gossip.CoordMsg = &gossip.CoordMsgNeed{Resource: resource}
+			if len(holders) == 0 {
+				msg = &gossip.CoordMsgHave{Resource: resource}
+			}
+			if err := c.Send(addr, msg); err != nil {
+				ctx := mctx.Annotate(ctx, "actor-addr", addr)
+				mlog.Warn("error sending to actor", ctx, merr.Context(err))
+			}
+		}
+	}
+}
+
+// track updates the open violation for the resource, if any, given its
+// current number of holders. It returns whether a violation started, or else
+// the violation which ended, if any.
+func (r *Replication) track(resource string, holders int, now time.Time) (bool, Violation, bool) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	i, ok := r.open[resource]
+	switch {
+	case holders < r.Factor && !ok:
+		r.open[resource] = len(r.violations)
+		r.violations = append(r.violations, Violation{
+			Resource:   resource,
+			Start:      now,
+			MinHolders: holders,
+		})
+		return true, Violation{}, false
+	case holders < r.Factor:
+		r.violations[i].MinHolders = min(r.violations[i].MinHolders, holders)
+	case ok:
+		delete(r.open, resource)
+		r.violations[i].End = now
+		return false, r.violations[i], true
+	}
+	return false, Violation{}, false
+}
+
+// assign returns the actors which should be sent a command for the resource,
+// given all connected actors and those which currently hold it. If there are
+// no holders a single actor is returned, which should be given the resource
+// outright.
+func (r *Replication) assign(resource string, actors, holders []string, now time.Time) []string {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	isHolder := map[string]bool{}
+	for _, addr := range holders {
+		isHolder[addr] = true
+	}
+
+	// actors which obtained the resource, timed out, or went away are no
+	// longer pending.
+	isActor := map[string]bool{}
+	for _, addr := range actors {
+		isActor[addr] = true
+	}
+	pending := r.pending[resource]
+	for addr, ts := range pending {
+		if isHolder[addr] || !isActor[addr] || now.Sub(ts) > r.NeedTimeout {
+			delete(pending, addr)
+		}
+	}
+
+	want := r.Factor - len(holders) - len(pending)
+	if len(holders) == 0 {
+		want = min(want, 1)
+	}
+
+	var assigned []string
+	for _, i := range r.rand.Perm(len(actors)) {
+		if len(assigned) >= want {
+			break
+		}
+		addr := actors[i]
+		if isHolder[addr] {
+			continue
+		} else if _, ok := pending[addr]; ok {
+			continue
+		}
+		assigned = append(assigned, addr)
+	}
+
+	// an actor given the resource outright will be a holder by the next tick,
+	// so only those told they need it are pending.
+	if len(holders) > 0 && len(assigned) > 0 {
+		if pending == nil {
+			pending = map[string]time.Time{}
+			r.pending[resource] = pending
+		}
+		for _, addr := range assigned {
+			pending[addr] = now
+		}
+	}
+	return assigned
+}
@@ -0,0 +1,142 @@
+package coord
+
+import (
+	"context"
+	"fmt"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+// fakeActor connects to the Coordinator (or a Worker) and obtains every
+// resource it's told it needs immediately. It returns a function which
+// disconnects it.
+func fakeActor(t *T, c interface{ Handle(net.Conn) error }, addr string) func() {
+	actorConn, coordConn := net.Pipe()
+	go c.Handle(coordConn)
+
+	cc := gossip.NewCoordConn(actorConn)
+	massert.Require(t, massert.Nil(cc.Encode(&gossip.CoordMsgHello{Addr: addr})))
+	go func() {
+		for {
+			msg, err := cc.Decode()
+			if err != nil {
+				return
+			}
+			if need, ok := msg.(*gossip.CoordMsgNeed); ok {
+				cc.Encode(&gossip.CoordMsgHave{Resource: need.Resource})
+			}
+		}
+	}()
+	return func() { cc.Close() }
+}
+
+func TestReplication(t *T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := New(ctx)
+	var disconnects []func()
+	for i := range 5 {
+		disconnects = append(disconnects, fakeActor(t, c, fmt.Sprintf("10.0.0.%d:1", i+1)))
+	}
+	defer func() {
+		for _, disconnect := range disconnects {
+			disconnect()
+		}
+	}()
+	for len(c.Actors()) < 5 {
+		time.Sleep(time.Millisecond)
+	}
+
+	repl := &Replication{
+		Resources: []string{"a", "b"},
+		Factor:    3,
+		Interval:  5 * time.Millisecond,
+	}
+	go repl.Run(ctx, c)
+
+	assertReplicated := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			ok := true
+			for _, v := range repl.Violations() {
+				ok = ok && !v.End.IsZero()
+			}
+			for _, resource := range repl.Resources {
+				ok = ok && len(c.Holders(resource)) >= repl.Factor
+			}
+			if ok {
+				return
+			} else if time.Now().After(deadline) {
+				t.Fatalf("resources not replicated, violations: %+v", repl.Violations())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// both resources start out with no holders.
+	assertReplicated()
+	violations := repl.Violations()
+	massert.Require(t, massert.Length(violations, 2))
+	massert.Require(t,
+		massert.Equal(0, violations[0].MinHolders),
+		massert.Equal(0, violations[1].MinHolders),
+	)
+
+	// a holder going away causes a new violation for each resource it held,
+	// which gets repaired.
+	holder := c.Holders("a")[0]
+	for i, addr := range c.Actors() {
+		if addr == holder {
+			disconnects[i]()
+		}
+	}
+	for len(c.Actors()) == 5 {
+		time.Sleep(time.Millisecond)
+	}
+	assertReplicated()
+
+	violations = repl.Violations()[2:]
+	massert.Require(t, massert.Not(massert.Length(violations, 0)))
+	massert.Require(t, massert.Equal("a", violations[0].Resource))
+	for _, v := range violations {
+		massert.Require(t, massert.Equal(2, v.MinHolders))
+	}
+	for _, addr := range c.Holders("a") {
+		massert.Require(t, massert.Not(massert.Equal(holder, addr)))
+	}
+}
+
+func TestReplicationSeed(t *T) {
+	var actors []string
+	for i := range 20 {
+		actors = append(actors, fmt.Sprintf("10.0.0.%d:1", i+1))
+	}
+
+	assignments := func(seed int64) [][]string {
+		r := &Replication{Resources: []string{"a"}, Factor: 5, Seed: seed}
+		r.init()
+		var assigned [][]string
+		for i := range 10 {
+			now := time.Unix(int64(i), 0)
+			assigned = append(assigned, r.assign("a", actors, actors[:1], now))
+			r.pending = map[string]map[string]time.Time{}
+		}
+		return assigned
+	}
+
+	massert.Require(t,
+		massert.Equal(assignments(1), assignments(1)),
+		massert.Not(massert.Equal(assignments(1), assignments(2))),
+	)
+
+	// a random seed is chosen, and recorded, if none is given.
+	r := &Replication{}
+	massert.Require(t, massert.Not(massert.Equal(int64(0), r.init())))
+	massert.Require(t, massert.Equal(r.Seed, r.seed()))
+}
@@ -0,0 +1,286 @@
+package coord
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mediocregopher/bonfire/gossip-app"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+)
+
+// the number of messages from the root which may be waiting to be sent to each
+// of a Worker's actors, beyond which relaying to all of them is held up.
+const workerSendQueueSize = 64
+
+// relayEncoder is the encoder of an actor which is connected to a worker
+// coordinator, wrapping messages to it in a CoordMsgRelay.
+type relayEncoder struct {
+	cc   *gossip.CoordConn
+	l    *sync.Mutex // shared by all of the worker's actors
+	addr string
+}
+
+func (e relayEncoder) Encode(msg gossip.CoordMsg) error {
+	relay, err := gossip.NewCoordMsgRelay(e.addr, msg)
+	if err != nil {
+		return err
+	}
+	e.l.Lock()
+	defer e.l.Unlock()
+	return e.cc.Encode(relay)
+}
+
+// handleWorker handles the connection from a worker coordinator, adding and
+// removing the actors connected to it as it relays their messages. All of them
+// are removed once the connection is closed.
+func (c *Coordinator) handleWorker(cc *gossip.CoordConn, name string) error {
+	ctx := mctx.Annotate(c.ctx, "worker", name)
+	mlog.Info("worker connected", ctx)
+
+	encL := new(sync.Mutex)
+	actors := map[string]*actor{}
+	defer func() {
+		for addr, a := range actors {
+			c.removeActor(mctx.Annotate(ctx, "actor-addr", addr), addr, a)
+		}
+		mlog.Info("worker disconnected", ctx)
+	}()
+
+	for {
+		msg, err := cc.Decode()
+		if err != nil {
+			return merr.Wrap(err, ctx)
+		}
+		relay, ok := msg.(*gossip.CoordMsgRelay)
+		if !ok {
+			return merr.New("expected relay message", mctx.Annotate(ctx, "msgType", msg.Type()))
+		}
+
+		actorCtx := mctx.Annotate(ctx, "actor-addr", relay.Actor)
+		msg, err = relay.Unwrap()
+		if err != nil {
+			return merr.Wrap(err, actorCtx)
+		}
+
+		a := actors[relay.Actor]
+		switch {
+		case relay.Disconnected:
+			if a != nil {
+				delete(actors, relay.Actor)
+				c.removeActor(actorCtx, relay.Actor, a)
+			}
+		case msg.Type() == gossip.CoordMsgTypeHello:
+			if a != nil {
+				c.removeActor(actorCtx, relay.Actor, a)
+			}
+			actors[relay.Actor] = c.addActor(actorCtx, relay.Actor, name, relayEncoder{
+				cc:   cc,
+				l:    encL,
+				addr: relay.Actor,
+			})
+		case a == nil:
+			mlog.Warn("relayed message from unknown actor", actorCtx)
+		case c.handleMsg(actorCtx, relay.Actor, a, msg):
+			delete(actors, relay.Actor)
+			c.removeActor(actorCtx, relay.Actor, a)
+		}
+	}
+}
+
+type workerActor struct {
+	conn   *gossip.CoordConn
+	sendCh chan gossip.CoordMsg
+	doneCh chan struct{} // closed once the actor has disconnected
+}
+
+// Worker is a worker coordinator. For experiments with more actors than a
+// single Coordinator can handle connections from, actors may instead connect to
+// one of a number of Workers, each of which relays messages between its actors
+// and the root Coordinator over a single connection. The root runs the
+// scenario, and aggregates the state of all actors, as if they were connected
+// to it directly. See gossip.CoordMsgWorker.
+type Worker struct {
+	ctx  context.Context
+	name string
+
+	root     *gossip.CoordConn
+	rootEncL sync.Mutex
+	closed   atomic.Bool
+
+	l      sync.Mutex
+	actors map[string]*workerActor
+}
+
+// NewWorker initializes a Worker which relays to the root Coordinator over the
+// given connection, identifying itself with the given name. Run must be called
+// for messages from the root to be relayed.
+func NewWorker(ctx context.Context, name string, root net.Conn) (*Worker, error) {
+	w := &Worker{
+		ctx:    mctx.Annotate(mctx.NewChild(ctx, "worker"), "name", name),
+		name:   name,
+		root:   gossip.NewCoordConn(root),
+		actors: map[string]*workerActor{},
+	}
+	if err := w.root.Encode(&gossip.CoordMsgWorker{Name: name}); err != nil {
+		root.Close()
+		return nil, merr.Wrap(err, w.ctx)
+	}
+	return w, nil
+}
+
+// relay sends a CoordMsgRelay to the root.
+func (w *Worker) relay(relay *gossip.CoordMsgRelay) error {
+	w.rootEncL.Lock()
+	defer w.rootEncL.Unlock()
+	return w.root.Encode(relay)
+}
+
+// Run reads messages for actors from the root, passing each on to its actor,
+// until the connection to the root is closed, in which case the connections of
+// all actors are closed too.
+func (w *Worker) Run() error {
+	defer func() {
+		w.l.Lock()
+		defer w.l.Unlock()
+		for _, a := range w.actors {
+			a.conn.Close()
+		}
+	}()
+
+	for {
+		msg, err := w.root.Decode()
+		if w.closed.Load() {
+			return nil
+		} else if err != nil {
+			return merr.Wrap(err, w.ctx)
+		}
+		relay, ok := msg.(*gossip.CoordMsgRelay)
+		if !ok {
+			return merr.New("expected relay message", mctx.Annotate(w.ctx, "msgType", msg.Type()))
+		}
+
+		ctx := mctx.Annotate(w.ctx, "actor-addr", relay.Actor)
+		msg, err = relay.Unwrap()
+		if err != nil {
+			return merr.Wrap(err, ctx)
+		}
+
+		w.l.Lock()
+		a, ok := w.actors[relay.Actor]
+		w.l.Unlock()
+		if !ok {
+			mlog.Debug("message for disconnected actor", ctx)
+			continue
+		}
+		select {
+		case a.sendCh <- msg:
+		case <-a.doneCh:
+		}
+	}
+}
+
+// Serve accepts connections from actors on the Listener, handling each in its
+// own go-routine (see Handle), until the Listener is closed.
+func (w *Worker) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return merr.Wrap(err, w.ctx)
+		}
+		go func() {
+			ctx := mctx.Annotate(w.ctx, "remote-addr", conn.RemoteAddr().String())
+			if err := w.Handle(conn); err != nil {
+				mlog.Warn("actor connection closed", ctx, merr.Context(err))
+			}
+		}()
+	}
+}
+
+// Handle relays messages from an actor's connection to the root until it's
+// closed, until the actor acknowledges a shutdown, or until an error is
+// encountered, and then tells the root that the actor has disconnected. The
+// connection is closed when Handle returns.
+func (w *Worker) Handle(conn net.Conn) error {
+	cc := gossip.NewCoordConn(conn)
+	defer cc.Close()
+
+	msg, err := cc.Decode()
+	if err != nil {
+		return err
+	}
+	hello, ok := msg.(*gossip.CoordMsgHello)
+	if !ok {
+		return merr.New("expected hello message", w.ctx)
+	}
+
+	ctx := mctx.Annotate(w.ctx, "actor-addr", hello.Addr)
+	a := &workerActor{
+		conn:   cc,
+		sendCh: make(chan gossip.CoordMsg, workerSendQueueSize),
+		doneCh: make(chan struct{}),
+	}
+	w.l.Lock()
+	w.actors[hello.Addr] = a
+	w.l.Unlock()
+	mlog.Info("actor connected", ctx)
+
+	defer func() {
+		close(a.doneCh)
+		w.l.Lock()
+		if w.actors[hello.Addr] == a {
+			delete(w.actors, hello.Addr)
+		}
+		w.l.Unlock()
+		mlog.Info("actor disconnected", ctx)
+
+		err := w.relay(&gossip.CoordMsgRelay{Actor: hello.Addr, Disconnected: true})
+		if err != nil && !w.closed.Load() {
+			mlog.Warn("error relaying disconnect", ctx, merr.Context(err))
+		}
+	}()
+
+	// messages from the root are sent to the actor in their own go-routine, so
+	// that a slow actor doesn't hold up the others, unless its sendCh fills.
+	go func() {
+		for {
+			select {
+			case msg := <-a.sendCh:
+				if err := cc.Encode(msg); err != nil {
+					mlog.Warn("error sending message to actor", ctx, merr.Context(err))
+					cc.Close()
+					return
+				}
+			case <-a.doneCh:
+				return
+			}
+		}
+	}()
+
+	for {
+		relay, err := gossip.NewCoordMsgRelay(hello.Addr, msg)
+		if err != nil {
+			return merr.Wrap(err, ctx)
+		} else if err := w.relay(relay); err != nil {
+			return merr.Wrap(err, ctx)
+		} else if msg.Type() == gossip.CoordMsgTypeShutdown {
+			return nil
+		}
+
+		if msg, err = cc.Decode(); err != nil {
+			return merr.Wrap(err, ctx)
+		}
+	}
+}
+
+// Close closes the connection to the root, which causes Run to return.
+func (w *Worker) Close() error {
+	w.closed.Store(true)
+	return w.root.Close()
+}
@@ -0,0 +1,63 @@
+package coord
+
+import (
+	"context"
+	"fmt"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestWorker(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := New(ctx)
+	rootConn, workerConn := net.Pipe()
+	go c.Handle(rootConn)
+	w, err := NewWorker(ctx, "w1", workerConn)
+	massert.Require(t, massert.Nil(err))
+	runErrCh := make(chan error, 1)
+	go func() { runErrCh <- w.Run() }()
+
+	// actors connected to the worker and directly to the root are treated the
+	// same.
+	defer fakeActor(t, c, "10.0.0.1:1")()
+	for i := range 3 {
+		defer fakeActor(t, w, fmt.Sprintf("10.0.1.%d:1", i+1))()
+	}
+	for len(c.Actors()) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	repl := &Replication{
+		Resources: []string{"a", "b"},
+		Factor:    4,
+		Interval:  5 * time.Millisecond,
+	}
+	go repl.Run(ctx, c)
+	for len(c.Holders("a")) < 4 || len(c.Holders("b")) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, state := range c.State() {
+		worker := "w1"
+		if state.Addr == "10.0.0.1:1" {
+			worker = ""
+		}
+		massert.Require(t,
+			massert.Equal(worker, state.Worker),
+			massert.Equal([]string{"a", "b"}, state.Resources),
+		)
+	}
+
+	// the worker's actors are removed once it's gone.
+	massert.Require(t, massert.Nil(w.Close()))
+	massert.Require(t, massert.Nil(<-runErrCh))
+	for len(c.Actors()) > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	massert.Require(t, massert.Equal([]string{"10.0.0.1:1"}, c.Actors()))
+}
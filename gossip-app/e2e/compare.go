@@ -0,0 +1,173 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mediocregopher/bonfire/gossip-app/coord"
+)
+
+// CompareOpts are passed to Measure and Compare to describe the run of the
+// replication scenario which is measured.
+type CompareOpts struct {
+	// Options for the Cluster, whose StaticTopology field is overwritten by
+	// Compare. Default is the same as Start's.
+	Opts *Opts
+
+	// Number of actors added to the Cluster. Default is 6.
+	Actors int
+
+	// Number of resources to replicate, and the number of actors which
+	// should hold each. Defaults are 3 and 3.
+	Resources, Factor int
+
+	// How long to wait for the scenario to converge, from when the first
+	// actor is added. Default is 30s.
+	Timeout time.Duration
+}
+
+func (o *CompareOpts) withDefaults() *CompareOpts {
+	if o == nil {
+		o = new(CompareOpts)
+	}
+	if o.Actors == 0 {
+		o.Actors = 6
+	}
+	if o.Resources == 0 {
+		o.Resources = 3
+	}
+	if o.Factor == 0 {
+		o.Factor = 3
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 30 * time.Second
+	}
+	return o
+}
+
+// Metrics describe how quickly a Cluster converged while running the
+// replication scenario, see Measure.
+type Metrics struct {
+	StaticTopology bool
+	Actors         int
+
+	// How long it took to add all actors to the Cluster, i.e. for each of
+	// their Peers to bootstrap.
+	StartupTime time.Duration
+
+	// How long after the first actor was added the actors' topology became
+	// fully connected, and the scenario converged (all resources replicated
+	// with no open violations). Zero if that didn't happen within the
+	// timeout.
+	ConnectedAfter, ConvergedAfter time.Duration
+
+	// The number of violations of the replication factor which occurred, and
+	// the total number of messages dropped by actors due to their queues
+	// being full.
+	Violations  int
+	MsgsDropped uint64
+
+	// The final state of the Cluster, whose Connected and Replicated fields
+	// will be less than 1 if it didn't converge.
+	State coord.DashboardState
+}
+
+// Converged returns whether the scenario converged within the timeout.
+func (m Metrics) Converged() bool {
+	return m.ConvergedAfter > 0
+}
+
+// Measure starts a Cluster with the given options, adds actors to it while
+// running the replication scenario, and measures how quickly it converges.
+func Measure(ctx context.Context, opts *CompareOpts) (Metrics, error) {
+	opts = opts.withDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cluster, err := Start(ctx, opts.Opts)
+	if err != nil {
+		return Metrics{}, err
+	}
+	defer cluster.Close()
+
+	repl := &coord.Replication{
+		Factor:   opts.Factor,
+		Interval: 50 * time.Millisecond,
+	}
+	for i := range opts.Resources {
+		repl.Resources = append(repl.Resources, fmt.Sprintf("resource-%d", i))
+	}
+	go repl.Run(ctx, cluster.Coordinator)
+	dashboard := &coord.Dashboard{
+		Coordinator: cluster.Coordinator,
+		Replication: repl,
+	}
+
+	metrics := Metrics{
+		StaticTopology: cluster.opts.StaticTopology,
+		Actors:         opts.Actors,
+	}
+	start := time.Now()
+	for range opts.Actors {
+		if _, err := cluster.AddActor(); err != nil {
+			return metrics, err
+		}
+	}
+	metrics.StartupTime = time.Since(start)
+
+	cluster.WaitFor(opts.Timeout-time.Since(start), func() bool {
+		state := dashboard.State()
+		if metrics.ConnectedAfter == 0 && state.Connected == 1 {
+			metrics.ConnectedAfter = time.Since(start)
+		}
+		if len(state.Actors) == opts.Actors &&
+			state.Connected == 1 &&
+			state.Replicated == 1 &&
+			len(state.OpenViolations) == 0 {
+			metrics.ConvergedAfter = time.Since(start)
+		}
+		metrics.State = state
+		return metrics.Converged()
+	})
+
+	metrics.Violations = len(repl.Violations())
+
+	// the actors' final reports include messages dropped while draining.
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, actorShutdownTimeout)
+	defer shutdownCancel()
+	final, err := cluster.Shutdown(shutdownCtx)
+	if err != nil {
+		return metrics, err
+	}
+	for _, state := range final {
+		metrics.MsgsDropped += state.MsgsDropped
+	}
+	return metrics, nil
+}
+
+// Compare runs Measure twice with the same options, once with actors finding
+// each other using bonfire and once with StaticTopology set as a control
+// group, returning the Metrics of each.
+func Compare(ctx context.Context, opts *CompareOpts) (discovered, static Metrics, err error) {
+	opts = opts.withDefaults()
+	for _, isStatic := range []bool{false, true} {
+		clusterOpts := new(Opts)
+		if opts.Opts != nil {
+			*clusterOpts = *opts.Opts
+		}
+		clusterOpts.StaticTopology = isStatic
+
+		runOpts := *opts
+		runOpts.Opts = clusterOpts
+		m, err := Measure(ctx, &runOpts)
+		if err != nil {
+			return discovered, static, err
+		} else if isStatic {
+			static = m
+		} else {
+			discovered = m
+		}
+	}
+	return discovered, static, nil
+}
@@ -0,0 +1,262 @@
+// Package e2e runs the whole stack of the gossip testing framework within a
+// single process: a bonfire Server, a coordinator, and any number of actors,
+// each with its own bonfire Peer, all communicating over a bftest.Network. It
+// exists so that the stack can be tested end-to-end, see e2e_test.go.
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/bonfire"
+	"github.com/mediocregopher/bonfire/bftest"
+	"github.com/mediocregopher/bonfire/gossip-app/actor"
+	"github.com/mediocregopher/bonfire/gossip-app/coord"
+)
+
+// ServerAddr is the address of the Cluster's bonfire Server on its Network.
+const ServerAddr = "10.0.0.1:7890"
+
+// how long AddActor waits for an actor to connect to the coordinator.
+const actorConnectTimeout = 10 * time.Second
+
+// how long Measure waits for actors to shut down once it's done measuring.
+const actorShutdownTimeout = 10 * time.Second
+
+// Opts are passed to Start to affect the Cluster.
+type Opts struct {
+	// Options for every actor's bonfire Peer. Default has ReadyToMingleInterval
+	// set to 250ms, so that peers meet each other quickly, and NAT gateways
+	// never used.
+	PeerOpts *bonfire.PeerOpts
+
+	// Passed to every actor. Default is 100ms.
+	TickInterval time.Duration
+
+	// Passed to every actor, see actor.Config's NetworkKey.
+	NetworkKey []byte
+
+	// If set the actors don't use the Server to find each other. Instead each
+	// is given a static list of peers (see actor.Config's StaticPeers) made up
+	// of the most recently added actors which are still running. This gives a
+	// control group against which bonfire's discovery can be compared, see
+	// Compare.
+	StaticTopology bool
+
+	// The number of peers each actor is given when StaticTopology is set.
+	// Default is 3.
+	StaticPeers int
+}
+
+func (o *Opts) withDefaults() *Opts {
+	if o == nil {
+		o = new(Opts)
+	}
+	if o.PeerOpts == nil {
+		o.PeerOpts = &bonfire.PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			ReadyToMingleInterval:   250 * time.Millisecond,
+		}
+	}
+	if o.TickInterval == 0 {
+		o.TickInterval = 100 * time.Millisecond
+	}
+	if o.StaticPeers == 0 {
+		o.StaticPeers = 3
+	}
+	return o
+}
+
+type clusterActor struct {
+	stop  context.CancelFunc
+	errCh chan error
+}
+
+// Cluster is a running bonfire Server and coordinator, along with the actors
+// which have been added to it.
+type Cluster struct {
+	Network     *bftest.Network
+	Server      *bonfire.Server
+	Coordinator *coord.Coordinator
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	opts   *Opts
+
+	l      sync.Mutex
+	actors map[string]clusterActor
+	order  []string // addresses of actors, in the order they were added
+}
+
+// Start starts a bonfire Server and a coordinator with no actors. The Context
+// is used for logging and to stop everything, though Close should be called
+// as well to wait for everything to stop.
+func Start(ctx context.Context, opts *Opts) (*Cluster, error) {
+	network := bftest.NewNetwork()
+	serverConn, err := network.ListenPacket(ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	c := &Cluster{
+		Network:     network,
+		Server:      bonfire.NewServer(),
+		Coordinator: coord.New(ctx),
+		ctx:         ctx,
+		cancel:      cancel,
+		opts:        opts.withDefaults(),
+		actors:      map[string]clusterActor{},
+	}
+	go c.Server.Serve(ctx, serverConn)
+	return c, nil
+}
+
+// AddActor starts a new actor and waits for it to connect to the coordinator,
+// returning the address of its bonfire Peer, which identifies it to the
+// coordinator.
+func (c *Cluster) AddActor() (string, error) {
+	conn, err := c.Network.ListenPacket("")
+	if err != nil {
+		return "", err
+	}
+	addr := conn.LocalAddr().String()
+
+	actorCoordConn, coordConn := net.Pipe()
+	go c.Coordinator.Handle(coordConn)
+
+	cfg := actor.Config{
+		ServerAddr:   ServerAddr,
+		PacketConn:   conn,
+		PeerOpts:     c.opts.PeerOpts,
+		CoordConn:    actorCoordConn,
+		TickInterval: c.opts.TickInterval,
+		NetworkKey:   c.opts.NetworkKey,
+	}
+	if c.opts.StaticTopology {
+		cfg.StaticPeers = c.staticPeers(addr)
+	}
+
+	ctx, stop := context.WithCancel(c.ctx)
+	a := clusterActor{stop: stop, errCh: make(chan error, 1)}
+	go func() { a.errCh <- actor.Run(ctx, cfg) }()
+
+	// the actor only connects to the coordinator once its Peer has been
+	// introduced and is ready to mingle. Waiting for that means the next actor
+	// added is introduced to this one; actors which bootstrap simultaneously
+	// never meet.
+	connected := func() bool { return slices.Contains(c.Coordinator.Actors(), addr) }
+	deadline := time.Now().Add(actorConnectTimeout)
+	for !connected() {
+		select {
+		case err := <-a.errCh:
+			return "", fmt.Errorf("actor %s stopped before connecting: %w", addr, err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			stop()
+			return "", fmt.Errorf("actor %s didn't connect: %w", addr, <-a.errCh)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.l.Lock()
+	c.actors[addr] = a
+	c.order = append(c.order, addr)
+	c.l.Unlock()
+	return addr, nil
+}
+
+// staticPeers returns the peers given to a new actor with the given address
+// when StaticTopology is set.
+func (c *Cluster) staticPeers(addr string) []string {
+	c.l.Lock()
+	defer c.l.Unlock()
+	peers := slices.Clone(c.order[max(0, len(c.order)-c.opts.StaticPeers):])
+	if len(peers) == 0 {
+		// a Peer without a server needs at least one seed. The first actor
+		// is given its own address, and ignores its own greetings.
+		peers = []string{addr}
+	}
+	return peers
+}
+
+// StopActor stops the actor with the given address, returning the error it
+// returned, if any.
+func (c *Cluster) StopActor(addr string) error {
+	c.l.Lock()
+	a, ok := c.actors[addr]
+	delete(c.actors, addr)
+	c.order = slices.DeleteFunc(c.order, func(a string) bool { return a == addr })
+	c.l.Unlock()
+	if !ok {
+		return errors.New("unknown actor " + addr)
+	}
+	a.stop()
+	return <-a.errCh
+}
+
+// WaitFor calls fn periodically until it returns true, returning false if it
+// doesn't do so within the timeout.
+func (c *Cluster) WaitFor(timeout time.Duration, fn func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !fn() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Shutdown has the coordinator tell every actor to shut down (see
+// coord.Coordinator's Shutdown), and waits for them all to stop, returning
+// their final states. Actors which don't stop before the Context is done are
+// stopped as StopActor would.
+func (c *Cluster) Shutdown(ctx context.Context) ([]coord.ActorState, error) {
+	states, err := c.Coordinator.Shutdown(ctx)
+	errs := []error{err}
+
+	c.l.Lock()
+	actors := c.actors
+	c.actors = map[string]clusterActor{}
+	c.order = nil
+	c.l.Unlock()
+
+	for addr, a := range actors {
+		select {
+		case err := <-a.errCh:
+			if err != nil {
+				errs = append(errs, fmt.Errorf("actor %s: %w", addr, err))
+			}
+			continue
+		case <-ctx.Done():
+		}
+		a.stop()
+		<-a.errCh
+	}
+	return states, errors.Join(errs...)
+}
+
+// Close stops all actors, the coordinator and the Server, returning the errors
+// returned by any actors.
+func (c *Cluster) Close() error {
+	c.l.Lock()
+	addrs := make([]string, 0, len(c.actors))
+	for addr := range c.actors {
+		addrs = append(addrs, addr)
+	}
+	c.l.Unlock()
+
+	var errs []error
+	for _, addr := range addrs {
+		errs = append(errs, c.StopActor(addr))
+	}
+	c.cancel()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,89 @@
+package e2e
+
+import (
+	"context"
+	"slices"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/bonfire/gossip-app/coord"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestReplicationConverges(t *T) {
+	if Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cluster, err := Start(ctx, nil)
+	massert.Require(t, massert.Nil(err))
+	defer cluster.Close()
+
+	for range 6 {
+		_, err := cluster.AddActor()
+		massert.Require(t, massert.Nil(err))
+	}
+
+	repl := &coord.Replication{
+		Resources: []string{"a", "b", "c"},
+		Factor:    3,
+		Interval:  50 * time.Millisecond,
+	}
+	go repl.Run(ctx, cluster.Coordinator)
+
+	dashboard := &coord.Dashboard{
+		Coordinator: cluster.Coordinator,
+		Replication: repl,
+	}
+	converged := func() bool {
+		state := dashboard.State()
+		return len(state.Actors) == 6 &&
+			state.Connected == 1 &&
+			state.Replicated == 1 &&
+			len(state.OpenViolations) == 0
+	}
+	if !cluster.WaitFor(30*time.Second, converged) {
+		t.Fatalf("cluster didn't converge: %+v", dashboard.State())
+	}
+
+	// a holder going away is recovered from.
+	holder := cluster.Coordinator.Holders("a")[0]
+	massert.Require(t, massert.Nil(cluster.StopActor(holder)))
+	_, err = cluster.AddActor()
+	massert.Require(t, massert.Nil(err))
+
+	gone := func() bool {
+		return !slices.Contains(cluster.Coordinator.Actors(), holder)
+	}
+	if !cluster.WaitFor(time.Second, gone) {
+		t.Fatal("stopped actor is still connected to the coordinator")
+	}
+	if !cluster.WaitFor(30*time.Second, converged) {
+		t.Fatalf("cluster didn't re-converge: %+v", dashboard.State())
+	}
+	for _, addr := range cluster.Coordinator.Holders("a") {
+		massert.Require(t, massert.Not(massert.Equal(holder, addr)))
+	}
+}
+
+func TestCompare(t *T) {
+	if Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	discovered, static, err := Compare(ctx, &CompareOpts{Actors: 5})
+	massert.Require(t, massert.Nil(err))
+	massert.Require(t,
+		massert.Equal(false, discovered.StaticTopology),
+		massert.Equal(true, static.StaticTopology),
+		massert.Equal(true, discovered.Converged()),
+		massert.Equal(true, static.Converged()),
+		massert.Equal(5, len(static.State.Actors)),
+	)
+}
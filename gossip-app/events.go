@@ -0,0 +1,146 @@
+package gossip
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventSourceCoord is the Source of Events written by the coordinator. Events
+// written by actors have the actor's peer address as their Source.
+const EventSourceCoord = "coord"
+
+// Event describes a single thing which happened during a run of the gossip
+// testing framework, as written to an event log by either the coordinator or
+// an actor. Event logs consist of one JSON encoded Event per line.
+type Event struct {
+	Time time.Time `json:"ts"`
+
+	// Either EventSourceCoord, or the peer address of the actor which wrote
+	// the Event.
+	Source string `json:"source"`
+
+	// The peer address of the actor which the Event concerns.
+	Actor string `json:"actor"`
+
+	// A short description of what happened, e.g. "need-sent".
+	Event string `json:"event"`
+
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// CoordMsgEventFields returns Fields describing a CoordMsg, for use in an
+// Event.
+func CoordMsgEventFields(msg CoordMsg) map[string]string {
+	fields := map[string]string{"type": msg.Type().String()}
+	switch msg := msg.(type) {
+	case *CoordMsgHello:
+		fields["addr"] = msg.Addr
+	case *CoordMsgNeed:
+		fields["resource"] = msg.Resource
+	case *CoordMsgHave:
+		fields["resource"] = msg.Resource
+	case *CoordMsgDontHave:
+		fields["resource"] = msg.Resource
+	case *CoordMsgPeers:
+		fields["peers"] = strconv.Itoa(len(msg.Addrs))
+	case *CoordMsgMsgQueue:
+		fields["max-len"] = strconv.Itoa(msg.MaxLen)
+		fields["dropped"] = strconv.FormatUint(msg.Dropped, 10)
+	case *CoordMsgDB:
+		fields["rows"] = strconv.Itoa(msg.Rows)
+		fields["evicted"] = strconv.FormatUint(msg.Evicted, 10)
+	}
+	return fields
+}
+
+// EventLog writes Events to an io.Writer. It is safe to use from multiple
+// go-routines, and all of its methods do nothing if it is nil.
+type EventLog struct {
+	l      sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewEventLog returns an EventLog which writes Events to the io.Writer.
+func NewEventLog(w io.Writer) *EventLog {
+	return &EventLog{w: w}
+}
+
+// OpenEventLog returns an EventLog which appends to the file at the given path,
+// creating it if necessary. Close must be called once the EventLog is no longer
+// used. Each Event is written with a single write, so the coordinator and
+// actors may all append to the same file.
+func OpenEventLog(path string) (*EventLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := NewEventLog(f)
+	l.closer = f
+	return l, nil
+}
+
+// Log writes an Event. If its Time is zero then the current time is used.
+func (l *EventLog) Log(e Event) error {
+	if l == nil {
+		return nil
+	} else if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the underlying file, if the EventLog was opened using
+// OpenEventLog.
+func (l *EventLog) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// ReadEvents reads all Events from an event log.
+func ReadEvents(r io.Reader) ([]Event, error) {
+	var events []Event
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+	return events, s.Err()
+}
+
+// MergeEvents merges multiple sets of Events into a single timeline, sorted by
+// Time. Events with the same Time retain their relative order.
+func MergeEvents(sets ...[]Event) []Event {
+	var events []Event
+	for _, set := range sets {
+		events = append(events, set...)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events
+}
@@ -0,0 +1,74 @@
+package gossip
+
+import (
+	"bytes"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestEventLog(t *T) {
+	// a nil EventLog does nothing.
+	var nilLog *EventLog
+	massert.Require(t,
+		massert.Nil(nilLog.Log(Event{Event: "foo"})),
+		massert.Nil(nilLog.Close()),
+	)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	event := func(source string, offset time.Duration, event string) Event {
+		return Event{
+			Time:   start.Add(offset),
+			Source: source,
+			Actor:  "10.0.0.1:1",
+			Event:  event,
+			Fields: map[string]string{"resource": "foo"},
+		}
+	}
+
+	coordBuf, actorBuf := new(bytes.Buffer), new(bytes.Buffer)
+	coordLog, actorLog := NewEventLog(coordBuf), NewEventLog(actorBuf)
+	coordEvents := []Event{
+		event(EventSourceCoord, 0, "connected"),
+		event(EventSourceCoord, 2*time.Second, "msg-sent"),
+	}
+	actorEvents := []Event{
+		event("10.0.0.1:1", time.Second, "peers-changed"),
+		event("10.0.0.1:1", 2*time.Second, "coord-msg"),
+		event("10.0.0.1:1", 3*time.Second, "obtained"),
+	}
+	for _, e := range coordEvents {
+		massert.Require(t, massert.Nil(coordLog.Log(e)))
+	}
+	for _, e := range actorEvents {
+		massert.Require(t, massert.Nil(actorLog.Log(e)))
+	}
+
+	gotCoord, err := ReadEvents(coordBuf)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(coordEvents, gotCoord),
+	)
+	gotActor, err := ReadEvents(actorBuf)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(actorEvents, gotActor),
+	)
+
+	// events with the same time keep their relative order.
+	massert.Require(t, massert.Equal(
+		[]Event{
+			coordEvents[0], actorEvents[0], coordEvents[1], actorEvents[1],
+			actorEvents[2],
+		},
+		MergeEvents(gotCoord, gotActor),
+	))
+
+	// a zero Time is filled in.
+	buf := new(bytes.Buffer)
+	massert.Require(t, massert.Nil(NewEventLog(buf).Log(Event{Event: "foo"})))
+	got, err := ReadEvents(buf)
+	massert.Require(t, massert.Nil(err), massert.Length(got, 1))
+	massert.Require(t, massert.Equal(false, got[0].Time.IsZero()))
+}
@@ -4,6 +4,7 @@ package gossip
 
 import (
 	"io"
+	"time"
 
 	"github.com/mediocregopher/mediocre-go-lib/merr"
 	"github.com/vmihailenco/msgpack"
@@ -18,8 +19,41 @@ const (
 	CoordMsgTypeNeed
 	CoordMsgTypeHave
 	CoordMsgTypeDontHave
+	CoordMsgTypePeers
+	CoordMsgTypeMsgQueue
+	CoordMsgTypeDB
+	CoordMsgTypeShutdown
+	CoordMsgTypeWorker
+	CoordMsgTypeRelay
 )
 
+func (t CoordMsgType) String() string {
+	switch t {
+	case CoordMsgTypeHello:
+		return "hello"
+	case CoordMsgTypeNeed:
+		return "need"
+	case CoordMsgTypeHave:
+		return "have"
+	case CoordMsgTypeDontHave:
+		return "dont-have"
+	case CoordMsgTypePeers:
+		return "peers"
+	case CoordMsgTypeMsgQueue:
+		return "msg-queue"
+	case CoordMsgTypeDB:
+		return "db"
+	case CoordMsgTypeShutdown:
+		return "shutdown"
+	case CoordMsgTypeWorker:
+		return "worker"
+	case CoordMsgTypeRelay:
+		return "relay"
+	default:
+		return "unknown"
+	}
+}
+
 // CoordMsg describes any of the CoordMsg types available in this package.
 type CoordMsg interface {
 	Type() CoordMsgType
@@ -48,7 +82,8 @@ func (*CoordMsgNeed) Type() CoordMsgType {
 }
 
 // CoordMsgHave is used by the coordinator to tell an actor that it has a
-// resource.
+// resource. It is also sent by an actor to the coordinator once it has
+// obtained a resource which it was told it needs.
 type CoordMsgHave struct {
 	Resource string
 }
@@ -69,6 +104,173 @@ func (*CoordMsgDontHave) Type() CoordMsgType {
 	return CoordMsgTypeDontHave
 }
 
+// CoordMsgPeers is sent by an actor to the coordinator whenever the set of
+// peers its bonfire Peer knows about changes.
+type CoordMsgPeers struct {
+	Addrs []string
+}
+
+// Type implements the method for the CoordMsg interface.
+func (*CoordMsgPeers) Type() CoordMsgType {
+	return CoordMsgTypePeers
+}
+
+// CoordMsgMsgQueue is sent periodically by an actor to the coordinator to
+// describe how saturated its queue of messages received from peers, but not
+// yet processed, has been.
+type CoordMsgMsgQueue struct {
+	Len    int // current number of messages in the queue
+	MaxLen int // largest number of messages in the queue since the last report
+
+	// The number of messages the queue can hold, or 0 if it's unbounded.
+	Size int
+
+	// Total number of messages which have been dropped due to the queue being
+	// full.
+	Dropped uint64
+}
+
+// Type implements the method for the CoordMsg interface.
+func (*CoordMsgMsgQueue) Type() CoordMsgType {
+	return CoordMsgTypeMsgQueue
+}
+
+// CoordMsgDB is sent periodically by an actor to the coordinator to describe
+// the size of its database of what its peers have.
+type CoordMsgDB struct {
+	Rows    int // current number of rows
+	MaxRows int // the number of rows the database can hold, or 0 if unlimited
+
+	// Total number of rows which have been evicted due to the database being
+	// full.
+	Evicted uint64
+
+	// How long each of the database's queries has taken, sorted by name.
+	Queries []QueryStats
+}
+
+// QueryBuckets are the upper bounds of the buckets of QueryStats' histograms.
+var QueryBuckets = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// QueryStats describes how long a particular query made by an actor to its
+// database has taken.
+type QueryStats struct {
+	Name       string
+	Count      uint64
+	Total, Max time.Duration
+
+	// The number of queries whose duration fell into each of QueryBuckets,
+	// plus a final one for those which took longer than the last.
+	Buckets []uint64
+}
+
+// Observe records that the query took the given duration.
+func (s *QueryStats) Observe(d time.Duration) {
+	if s.Buckets == nil {
+		s.Buckets = make([]uint64, len(QueryBuckets)+1)
+	}
+	s.Count++
+	s.Total += d
+	s.Max = max(s.Max, d)
+
+	i := 0
+	for i < len(QueryBuckets) && d > QueryBuckets[i] {
+		i++
+	}
+	s.Buckets[i]++
+}
+
+// Mean returns the mean duration of the query, or 0 if there haven't been any.
+func (s QueryStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// Type implements the method for the CoordMsg interface.
+func (*CoordMsgDB) Type() CoordMsgType {
+	return CoordMsgTypeDB
+}
+
+// CoordMsgShutdown is sent from the coordinator to an actor to tell it to stop.
+// The actor stops taking on work, drains its queue of messages from peers,
+// closes its bonfire Peer, sends its final CoordMsgPeers, CoordMsgMsgQueue and
+// CoordMsgDB reports, and then sends a CoordMsgShutdown back before
+// disconnecting.
+type CoordMsgShutdown struct{}
+
+// Type implements the method for the CoordMsg interface.
+func (*CoordMsgShutdown) Type() CoordMsgType {
+	return CoordMsgTypeShutdown
+}
+
+// CoordMsgWorker is sent from a worker coordinator to the root coordinator,
+// instead of a CoordMsgHello, to start off the communication. Everything sent
+// between them afterwards is a CoordMsgRelay.
+//
+// Worker coordinators allow experiments with more actors than a single
+// coordinator could handle connections from. Each worker accepts connections
+// from a subset of the actors and relays their messages to the root, which
+// runs the scenario as if they were connected to it directly.
+type CoordMsgWorker struct {
+	Name string // identifies the worker, for logging
+}
+
+// Type implements the method for the CoordMsg interface.
+func (*CoordMsgWorker) Type() CoordMsgType {
+	return CoordMsgTypeWorker
+}
+
+// CoordMsgRelay wraps a CoordMsg sent to or from an actor which is connected to
+// a worker coordinator, see CoordMsgWorker. The actor's CoordMsgHello is
+// relayed like any other message. Use NewCoordMsgRelay and Unwrap to create and
+// read one.
+type CoordMsgRelay struct {
+	Actor string // the address of the actor, as given in its CoordMsgHello
+
+	// Set, instead of a message, once the actor has disconnected from the
+	// worker.
+	Disconnected bool
+
+	MsgType CoordMsgType
+	Msg     []byte // the msgpack encoding of the message
+}
+
+// Type implements the method for the CoordMsg interface.
+func (*CoordMsgRelay) Type() CoordMsgType {
+	return CoordMsgTypeRelay
+}
+
+// NewCoordMsgRelay returns a CoordMsgRelay wrapping the message, which is to or
+// from the actor with the given address.
+func NewCoordMsgRelay(actor string, msg CoordMsg) (*CoordMsgRelay, error) {
+	b, err := msgpack.Marshal(msg)
+	if err != nil {
+		return nil, merr.Wrap(err)
+	}
+	return &CoordMsgRelay{Actor: actor, MsgType: msg.Type(), Msg: b}, nil
+}
+
+// Unwrap decodes the wrapped message, which will be one of the CoordMsg
+// structs, and will be a pointer. It returns nil if Disconnected is set.
+func (r *CoordMsgRelay) Unwrap() (CoordMsg, error) {
+	if r.Disconnected {
+		return nil, nil
+	}
+	msg, err := newCoordMsg(r.MsgType)
+	if err != nil {
+		return nil, err
+	}
+	return msg, merr.Wrap(msgpack.Unmarshal(r.Msg, msg))
+}
+
 // CoordConn wraps an io.ReadWriteCloser to enable encoding/decoding CoordMsgs.
 type CoordConn struct {
 	rwc io.ReadWriteCloser
@@ -102,8 +304,17 @@ func (cc *CoordConn) Decode() (CoordMsg, error) {
 		return nil, merr.Wrap(err)
 	}
 
-	var res interface{}
-	switch CoordMsgType(typ) {
+	res, err := newCoordMsg(CoordMsgType(typ))
+	if err != nil {
+		return nil, err
+	}
+	return res, merr.Wrap(cc.dec.Decode(res))
+}
+
+// newCoordMsg returns a pointer to a new CoordMsg struct of the given type.
+func newCoordMsg(typ CoordMsgType) (CoordMsg, error) {
+	var res CoordMsg
+	switch typ {
 	case CoordMsgTypeHello:
 		res = &CoordMsgHello{}
 	case CoordMsgTypeNeed:
@@ -112,12 +323,22 @@ func (cc *CoordConn) Decode() (CoordMsg, error) {
 		res = &CoordMsgHave{}
 	case CoordMsgTypeDontHave:
 		res = &CoordMsgDontHave{}
+	case CoordMsgTypePeers:
+		res = &CoordMsgPeers{}
+	case CoordMsgTypeMsgQueue:
+		res = &CoordMsgMsgQueue{}
+	case CoordMsgTypeDB:
+		res = &CoordMsgDB{}
+	case CoordMsgTypeShutdown:
+		res = &CoordMsgShutdown{}
+	case CoordMsgTypeWorker:
+		res = &CoordMsgWorker{}
+	case CoordMsgTypeRelay:
+		res = &CoordMsgRelay{}
 	default:
 		return nil, merr.New("unknown msg type")
 	}
-
-	err = cc.dec.Decode(res)
-	return res.(CoordMsg), merr.Wrap(err)
+	return res, nil
 }
 
 // Close calls Close on the underlying io.Closer.
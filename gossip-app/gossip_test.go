@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	. "testing"
+	"time"
 
 	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
 )
@@ -44,5 +45,37 @@ func TestCoordConnEncodeDecode(t *T) {
 		assertEncDec(&CoordMsgDontHave{
 			Resource: "foo",
 		}),
+		assertEncDec(&CoordMsgPeers{
+			Addrs: []string{"0.0.0.0:2", "0.0.0.0:3"},
+		}),
+		assertEncDec(&CoordMsgMsgQueue{
+			Len: 1, MaxLen: 128, Size: 128, Dropped: 5,
+		}),
+		assertEncDec(&CoordMsgDB{
+			Rows: 10, MaxRows: 10, Evicted: 3,
+			Queries: []QueryStats{{
+				Name:    "foo",
+				Count:   2,
+				Total:   3 * time.Millisecond,
+				Max:     2 * time.Millisecond,
+				Buckets: []uint64{0, 1, 1, 0, 0, 0},
+			}},
+		}),
+	)
+}
+
+func TestQueryStats(t *T) {
+	var s QueryStats
+	massert.Require(t, massert.Equal(time.Duration(0), s.Mean()))
+
+	s.Observe(50 * time.Microsecond)
+	s.Observe(time.Millisecond)
+	s.Observe(5 * time.Millisecond)
+	s.Observe(time.Minute)
+	massert.Require(t,
+		massert.Equal(uint64(4), s.Count),
+		massert.Equal(time.Minute, s.Max),
+		massert.Equal([]uint64{1, 1, 1, 0, 0, 1}, s.Buckets),
+		massert.Equal((time.Minute+6050*time.Microsecond)/4, s.Mean()),
 	)
 }
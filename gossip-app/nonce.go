@@ -0,0 +1,61 @@
+package gossip
+
+import (
+	"sync"
+	"time"
+)
+
+// NonceStore stores the latest nonce known for each (origin, resource) pair,
+// where origin is the peer address of the actor whose state for the resource
+// the nonce orders.
+type NonceStore interface {
+	// LoadNonce returns the latest nonce stored for the pair, or 0 if there is
+	// none.
+	LoadNonce(origin, resource string) (uint64, error)
+
+	// StoreNonce stores the nonce for the pair, unless a greater one is
+	// already stored.
+	StoreNonce(origin, resource string, nonce uint64) error
+}
+
+// Sequencer allocates the nonces which order messages about each (origin,
+// resource) pair, using a NonceStore to remember the latest for each. Nonces
+// which are allocated are never less than the current time in nanoseconds, so
+// that they keep increasing even if the NonceStore is lost, e.g. when an actor
+// restarts with an empty database.
+//
+// Sequencer is safe to use from multiple go-routines.
+type Sequencer struct {
+	Store NonceStore
+
+	l sync.Mutex
+}
+
+// Next allocates and returns a new nonce for the pair, which is greater than
+// any previously stored for it. It should be used for messages about the
+// actor's own resources.
+func (s *Sequencer) Next(origin, resource string) (uint64, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	last, err := s.Store.LoadNonce(origin, resource)
+	if err != nil {
+		return 0, err
+	}
+	nonce := max(last+1, uint64(time.Now().UnixNano()))
+	if err := s.Store.StoreNonce(origin, resource, nonce); err != nil {
+		return 0, err
+	}
+	return nonce, nil
+}
+
+// Current returns the latest nonce stored for the pair, or 0 if there is none.
+// Next never allocates 0, so it denotes an unknown nonce, which orders a
+// message before all others about the pair. It should be used when relaying
+// what's known about another actor's resources, so that the relayed message is
+// ordered the same as the original.
+func (s *Sequencer) Current(origin, resource string) (uint64, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.Store.LoadNonce(origin, resource)
+}
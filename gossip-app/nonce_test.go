@@ -0,0 +1,66 @@
+package gossip
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+type mapNonceStore map[[2]string]uint64
+
+func (m mapNonceStore) LoadNonce(origin, resource string) (uint64, error) {
+	return m[[2]string{origin, resource}], nil
+}
+
+func (m mapNonceStore) StoreNonce(origin, resource string, nonce uint64) error {
+	key := [2]string{origin, resource}
+	m[key] = max(m[key], nonce)
+	return nil
+}
+
+func TestSequencer(t *T) {
+	store := mapNonceStore{}
+	seq := &Sequencer{Store: store}
+
+	// nonces are at least the current time, and increase monotonically even
+	// if the time doesn't.
+	start := uint64(time.Now().UnixNano())
+	a1, err := seq.Next("a", "foo")
+	massert.Require(t, massert.Nil(err))
+	a2, err := seq.Next("a", "foo")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(true, a1 >= start),
+		massert.Equal(true, a2 > a1),
+	)
+
+	// a stored nonce far in the future is continued from.
+	store[[2]string{"a", "bar"}] = 1 << 62
+	bar, err := seq.Next("a", "bar")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(uint64(1<<62+1), bar),
+	)
+
+	// Current returns the stored nonce, or 0 if there isn't one, without
+	// allocating one.
+	store[[2]string{"b", "foo"}] = 5
+	b, err := seq.Current("b", "foo")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(uint64(5), b),
+	)
+	a, err := seq.Current("a", "foo")
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(a2, a),
+	)
+	c, err := seq.Current("c", "foo")
+	_, stored := store[[2]string{"c", "foo"}]
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(uint64(0), c),
+		massert.Equal(false, stored),
+	)
+}
@@ -0,0 +1,225 @@
+package gossip
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"golang.org/x/net/websocket"
+)
+
+// parseCoordAddr parses the address of a coordinator, see DialCoord.
+func parseCoordAddr(ctx context.Context, addr string) (*url.URL, error) {
+	ctx = mctx.Annotate(ctx, "addr", addr)
+	if !strings.Contains(addr, "://") {
+		return &url.URL{Scheme: "tcp", Host: addr}, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, merr.Wrap(err, ctx)
+	}
+	switch u.Scheme {
+	case "tcp", "ws", "wss":
+	case "unix":
+		// allow for relative paths, e.g. "unix://coord.sock".
+		u.Path = u.Host + u.Path
+	default:
+		return nil, merr.New("unknown coordinator address scheme", ctx)
+	}
+	return u, nil
+}
+
+// DialCoord connects to a coordinator at the given address, whose scheme gives
+// the transport used:
+//
+//   - "tcp://host:port", or just "host:port"
+//   - "unix:///path/to/socket", for actors on the same host as the coordinator
+//   - "ws://host:port/path" or "wss://host:port/path", for actors which can
+//     only reach the coordinator over HTTP, e.g. through a proxy
+//
+// Whichever is used, the returned net.Conn is wrapped by a CoordConn as usual.
+func DialCoord(ctx context.Context, addr string) (net.Conn, error) {
+	u, err := parseCoordAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx = mctx.Annotate(ctx, "addr", addr)
+
+	var dialer net.Dialer
+	switch u.Scheme {
+	case "tcp":
+		conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+		return conn, merr.Wrap(err, ctx)
+	case "unix":
+		conn, err := dialer.DialContext(ctx, "unix", u.Path)
+		return conn, merr.Wrap(err, ctx)
+	}
+
+	hostPort := u.Host
+	if u.Port() == "" {
+		hostPort = net.JoinHostPort(u.Hostname(), map[string]string{"ws": "80", "wss": "443"}[u.Scheme])
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, merr.Wrap(err, ctx)
+	}
+
+	// the handshakes don't take a Context, so are interrupted by a deadline.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, merr.Wrap(err, ctx)
+		}
+		conn = tlsConn
+	}
+
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	cfg, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		conn.Close()
+		return nil, merr.Wrap(err, ctx)
+	}
+	ws, err := websocket.NewClient(cfg, conn)
+	if err != nil {
+		conn.Close()
+		return nil, merr.Wrap(err, ctx)
+	} else if !stop() {
+		ws.Close()
+		return nil, merr.Wrap(ctx.Err(), ctx)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// ListenCoord returns a net.Listener which accepts connections to a
+// coordinator on the given address, which is in the same format as for
+// DialCoord. The "wss" scheme isn't supported, as TLS is expected to be
+// terminated by a proxy in front of the coordinator. The Context is only used
+// for annotating errors.
+func ListenCoord(ctx context.Context, addr string) (net.Listener, error) {
+	u, err := parseCoordAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx = mctx.Annotate(ctx, "addr", addr)
+
+	switch u.Scheme {
+	case "tcp":
+		l, err := net.Listen("tcp", u.Host)
+		return l, merr.Wrap(err, ctx)
+	case "unix":
+		l, err := net.Listen("unix", u.Path)
+		return l, merr.Wrap(err, ctx)
+	case "wss":
+		return nil, merr.New("listening on wss isn't supported", ctx)
+	}
+
+	tcpL, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, merr.Wrap(err, ctx)
+	}
+	l := &wsListener{
+		Listener: tcpL,
+		connCh:   make(chan net.Conn),
+		closedCh: make(chan struct{}),
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		// actors aren't browsers, so their Origin isn't checked.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   l.handle,
+	})
+	l.srv = &http.Server{Handler: mux}
+	go l.srv.Serve(tcpL)
+	return l, nil
+}
+
+// wsListener is a net.Listener which accepts websocket connections, see
+// ListenCoord.
+type wsListener struct {
+	net.Listener // the underlying TCP listener, which the http.Server serves
+	srv          *http.Server
+
+	connCh    chan net.Conn
+	closedCh  chan struct{}
+	closeOnce sync.Once
+}
+
+// handle passes a new websocket connection on to Accept. The connection is
+// closed by the websocket.Server once handle returns, so it waits for the
+// connection to be closed by whoever accepted it.
+func (l *wsListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &wsConn{
+		Conn:       ws,
+		remoteAddr: wsAddr(ws.Request().RemoteAddr),
+		closedCh:   make(chan struct{}),
+	}
+	select {
+	case l.connCh <- conn:
+	case <-l.closedCh:
+		return
+	}
+	<-conn.closedCh
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.closedCh:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections. Connections which have already been
+// accepted aren't closed.
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closedCh) })
+	return l.srv.Close()
+}
+
+// wsConn is a websocket connection accepted by a wsListener.
+type wsConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+	closedCh   chan struct{}
+	closeOnce  sync.Once
+}
+
+// RemoteAddr returns the address of the client. The websocket.Conn's own would
+// be the Origin it sent, which isn't checked.
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.closedCh) })
+	return err
+}
+
+// wsAddr is the address of the client of a wsConn.
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
@@ -0,0 +1,85 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestCoordTransports(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sockPath := filepath.Join(t.TempDir(), "coord.sock")
+	for _, addr := range []string{
+		"127.0.0.1:0",
+		"tcp://127.0.0.1:0",
+		"unix://" + sockPath,
+		"ws://127.0.0.1:0/coord",
+	} {
+		t.Run(addr, func(t *T) {
+			l, err := ListenCoord(ctx, addr)
+			massert.Require(t, massert.Nil(err))
+
+			// the port is only known once listening.
+			dialAddr := addr
+			if tcpAddr, ok := l.Addr().(*net.TCPAddr); ok {
+				u, err := parseCoordAddr(ctx, addr)
+				massert.Require(t, massert.Nil(err))
+				u.Host = tcpAddr.String()
+				dialAddr = u.String()
+			}
+
+			acceptCh := make(chan net.Conn, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					t.Error(err)
+				}
+				acceptCh <- conn
+			}()
+
+			actorConn, err := DialCoord(ctx, dialAddr)
+			massert.Require(t, massert.Nil(err))
+			actor := NewCoordConn(actorConn)
+			defer actor.Close()
+			coord := NewCoordConn(<-acceptCh)
+			defer coord.Close()
+
+			massert.Require(t, massert.Nil(actor.Encode(&CoordMsgHello{Addr: "0.0.0.0:1"})))
+			msg, err := coord.Decode()
+			massert.Require(t,
+				massert.Nil(err),
+				massert.Equal(&CoordMsgHello{Addr: "0.0.0.0:1"}, msg),
+			)
+
+			// the actor relies on being able to read again once a read deadline
+			// has been exceeded.
+			actorConn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			_, err = actor.Decode()
+			massert.Require(t, massert.Equal(true, errors.Is(merr.Base(err), os.ErrDeadlineExceeded)))
+			actorConn.SetReadDeadline(time.Time{})
+
+			massert.Require(t, massert.Nil(coord.Encode(&CoordMsgNeed{Resource: "foo"})))
+			msg, err = actor.Decode()
+			massert.Require(t,
+				massert.Nil(err),
+				massert.Equal(&CoordMsgNeed{Resource: "foo"}, msg),
+			)
+
+			massert.Require(t, massert.Nil(l.Close()))
+			_, err = l.Accept()
+			massert.Require(t, massert.Equal(true, errors.Is(err, net.ErrClosed)))
+		})
+	}
+
+	_, err := ListenCoord(ctx, "udp://127.0.0.1:0")
+	massert.Require(t, massert.Not(massert.Nil(err)))
+}
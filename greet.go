@@ -0,0 +1,75 @@
+package bonfire
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// greetSeeds sends a Greet message, using the current fingerprint, to each of
+// the SeedPeers the given number of times. Seeds whose addresses can't be
+// resolved are skipped, with a PeerEventResolveFailed being emitted for each.
+//
+// This must be called with the lock held.
+func (p *Peer) greetSeeds(blastCount int) error {
+	msg := Message{
+		Fingerprint: p.lastFingerprint,
+		Type:        Greet,
+		Candidates:  p.candidates(),
+	}
+
+	// as with HelloServer, in privacy mode the candidates are only sent in
+	// sealed form, which also proves to the seed that the greeting is from a
+	// member of the network.
+	var err error
+	if p.sealer != nil {
+		if msg.Sealed, err = p.sealer.seal(msg.Candidates); err != nil {
+			return err
+		}
+		msg.Candidates = nil
+	}
+
+	sb := p.newSendBatch()
+	for _, seedAddrStr := range p.po.SeedPeers {
+		seedAddr, err := resolveUDPAddr(context.Background(), p.po.Resolver, p.network, seedAddrStr)
+		if err != nil {
+			err = fmt.Errorf("resolving seed peer address %q: %s", seedAddrStr, err)
+			p.event(PeerEvent{Type: PeerEventResolveFailed, Err: err})
+			continue
+		} else if err := sb.add(seedAddr, blastCount, msg); err != nil {
+			sb.release()
+			return err
+		}
+	}
+	return sb.flush()
+}
+
+// isGreeting returns whether the packet looks like a Greet message. Greetings
+// use the greeting peer's fingerprint, so they can only be recognized by their
+// type.
+func isGreeting(b []byte) bool {
+	return len(b) >= MinMessageSize && MessageType(b[1+FingerprintSize]) == Greet
+}
+
+// processGreeting handles a Greet message (or multicast announcement) from
+// the peer at the given address. The greeting peer is added to the set of
+// peers, and is sent HelloPeer messages in return as if the server had
+// introduced them.
+//
+// This must be called with the lock held.
+func (p *Peer) processGreeting(addr net.Addr, msg Message) {
+	if p.closed || p.isOwnFingerprint(msg.Fingerprint) {
+		return
+	} else if p.sealer != nil {
+		candidates, err := p.sealer.open(msg.Sealed)
+		if err != nil {
+			return
+		}
+		msg.Candidates = candidates
+	}
+	if !p.acceptPeer(addr, msg.Fingerprint) {
+		return
+	}
+	p.addPeer(addr)
+	p.helloPeer(addr, msg.Fingerprint, msg.Candidates, nil)
+}
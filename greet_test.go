@@ -0,0 +1,78 @@
+package bonfire
+
+import (
+	"context"
+	"fmt"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerSeedPeers(t *T) {
+	ctx := context.Background()
+	port := func(addr net.Addr) int { return addr.(*net.UDPAddr).Port }
+
+	// newSeed returns a Peer which can act as a seed, but which has no seed of
+	// its own to contact.
+	newSeed := func(acceptGreetings bool) *Peer {
+		seed, err := NewPeer(ctx, "udp", "", &PeerOpts{
+			SeedPeers:               []string{"127.0.0.1:1"},
+			InitTimeoutUntilGateway: 250 * time.Millisecond,
+			AcceptGreetings:         acceptGreetings,
+		})
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { seed.Close() })
+		seed.SetReadDeadline(time.Time{})
+		go func() {
+			b := make([]byte, MaxMessageSize)
+			for {
+				if _, _, err := seed.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+		return seed
+	}
+
+	seedAddr := func(seed *Peer) string {
+		return fmt.Sprintf("127.0.0.1:%d", port(seed.LocalAddr()))
+	}
+
+	seed := newSeed(true)
+	peer, err := NewPeer(ctx, "udp", "", &PeerOpts{
+		SeedPeers:               []string{seedAddr(seed)},
+		InitTimeoutUntilGateway: 250 * time.Millisecond,
+	})
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+
+	peerAddrs, seedPeerAddrs := peer.PeerAddrs(), seed.PeerAddrs()
+	massert.Require(t,
+		massert.Length(peerAddrs, 1),
+		massert.Equal(port(seed.LocalAddr()), port(peerAddrs[0])),
+		massert.Equal(port(peer.LocalAddr()), port(peer.RemoteAddr())),
+		massert.Equal(PeerStateEstablished, peer.State()),
+		massert.Length(seedPeerAddrs, 1),
+		massert.Equal(port(peer.LocalAddr()), port(seedPeerAddrs[0])),
+	)
+
+	// a seed which doesn't accept greetings should treat them as application
+	// packets.
+	seed = newSeed(false)
+	peer, err = NewPeer(ctx, "udp", "", &PeerOpts{
+		SeedPeers:               []string{seedAddr(seed)},
+		InitTimeoutUntilGateway: 250 * time.Millisecond,
+	})
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+	massert.Require(t,
+		massert.Length(peer.PeerAddrs(), 0),
+		massert.Length(seed.PeerAddrs(), 0),
+	)
+
+	// without a server, seed peers or multicast there's no way to find peers.
+	_, err = NewPeer(ctx, "udp", "", nil)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+}
@@ -0,0 +1,196 @@
+//go:build linux && (amd64 || arm64)
+
+package bonfire
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// solUDP and udpSegment are SOL_UDP and UDP_SEGMENT, which the syscall
+	// package doesn't define.
+	solUDP     = 17
+	udpSegment = 103
+
+	// maxSegments is the number of packets which are sent in a single
+	// segmentation offload send, and maxSegmentBytes is their total size,
+	// which must fit within a single (pre-segmentation) UDP datagram.
+	maxSegments     = 64
+	maxSegmentBytes = 65000
+
+	// maxSegmentIovs is the number of packets passed into a single sendmmsg
+	// call by writeSegmentsUDP.
+	maxSegmentIovs = 256
+)
+
+// udpSegmentUnsupported is set once a segmentation offload send has failed in
+// a way which indicates that the kernel, or the network device, doesn't
+// support it, so that it isn't attempted again.
+var udpSegmentUnsupported atomic.Bool
+
+// isSegmentUnsupported returns whether the errno returned from a segmentation
+// offload send means that it isn't supported.
+func isSegmentUnsupported(errno syscall.Errno) bool {
+	switch errno {
+	case syscall.EINVAL, syscall.EIO, syscall.ENOPROTOOPT, syscall.EOPNOTSUPP:
+		return true
+	default:
+		return false
+	}
+}
+
+// sockFamily returns the address family of the UDP socket (e.g. AF_INET), or
+// -1 if it can't be determined.
+func sockFamily(conn *net.UDPConn) int {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	family := -1
+	rawConn.Control(func(fd uintptr) {
+		family, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+	})
+	return family
+}
+
+// writeSegmentsUDP works like writeBatchUDP, but consecutive packets of the
+// same size to the same destination (e.g. the copies of a message sent due to
+// PacketBlastCount) are passed to the kernel as a single UDP segmentation
+// offload (UDP_SEGMENT) send, which it splits back into individual packets.
+// This means that large batches of small packets are written using fewer
+// syscalls, and less work per-packet within the kernel. If segmentation
+// offload isn't supported then writeBatchUDP is used instead.
+//
+// family is that of the socket, as returned by sockFamily, or 0 if it isn't
+// known, in which case it's looked up.
+func writeSegmentsUDP(conn *net.UDPConn, family int, pkts []outPacket) (int, error) {
+	if udpSegmentUnsupported.Load() {
+		return writeBatchUDP(conn, pkts)
+	}
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return writeEach(conn, pkts)
+	}
+
+	if family == 0 {
+		family = sockFamily(conn)
+	}
+	if family != syscall.AF_INET && family != syscall.AF_INET6 {
+		return writeEach(conn, pkts)
+	}
+
+	cmsgLen := syscall.CmsgSpace(2)
+	var (
+		hdrs   [maxBatchSize]mmsghdr
+		iovs   [maxSegmentIovs]syscall.Iovec
+		addrs  [maxBatchSize]syscall.RawSockaddrInet6
+		cmsgs  = make([]byte, maxBatchSize*cmsgLen)
+		counts [maxBatchSize]int
+	)
+
+	var total int
+	for total < len(pkts) {
+		var h, iovN int
+		for i := total; i < len(pkts) && h < maxBatchSize && iovN < len(iovs); h++ {
+			pkt := pkts[i]
+			udpAddr, ok := pkt.dst.(*net.UDPAddr)
+			if !ok || udpAddr.Zone != "" {
+				break
+			}
+			addrLen, ok := putSockaddr(&addrs[h], family, udpAddr)
+			if !ok {
+				break
+			}
+
+			// all copies of a message share a buffer, and are queued together.
+			size, count := len(pkt.b), 1
+			for i+count < len(pkts) &&
+				count < maxSegments &&
+				iovN+count < len(iovs) &&
+				(count+1)*size <= maxSegmentBytes &&
+				pkts[i+count].dst == pkt.dst &&
+				len(pkts[i+count].b) == size {
+				count++
+			}
+
+			hdrs[h] = mmsghdr{hdr: syscall.Msghdr{
+				Name:    (*byte)(unsafe.Pointer(&addrs[h])),
+				Namelen: addrLen,
+				Iov:     &iovs[iovN],
+				Iovlen:  uint64(count),
+			}}
+			for _, pkt := range pkts[i : i+count] {
+				iovs[iovN].Base = unsafe.SliceData(pkt.b)
+				iovs[iovN].SetLen(len(pkt.b))
+				iovN++
+			}
+
+			if count > 1 {
+				cmsg := cmsgs[h*cmsgLen : (h+1)*cmsgLen]
+				clear(cmsg)
+				cmsgHdr := (*syscall.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+				cmsgHdr.Level, cmsgHdr.Type = solUDP, udpSegment
+				cmsgHdr.SetLen(syscall.CmsgLen(2))
+				*(*uint16)(unsafe.Pointer(&cmsg[syscall.CmsgLen(0)])) = uint16(size)
+				hdrs[h].hdr.Control = &cmsg[0]
+				hdrs[h].hdr.SetControllen(cmsgLen)
+			}
+
+			counts[h] = count
+			i += count
+		}
+
+		if h == 0 {
+			// the next packet can't be sent using sendmmsg at all.
+			n, err := writeBatchUDP(conn, pkts[total:])
+			return total + n, err
+		}
+
+		var n int
+		var errno syscall.Errno
+		err := rawConn.Write(func(fd uintptr) bool {
+			r, _, e := syscall.Syscall6(
+				sysSENDMMSG, fd,
+				uintptr(unsafe.Pointer(&hdrs[0])), uintptr(h),
+				0, 0, 0,
+			)
+			if e == syscall.EAGAIN {
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		})
+
+		switch {
+		case err != nil:
+			return total, err
+		case errno == syscall.ENOSYS:
+			n, err := writeEach(conn, pkts[total:])
+			return total + n, err
+		case errno != 0 && counts[0] > 1 && isSegmentUnsupported(errno):
+			// sendmmsg only returns an error if the first message failed.
+			udpSegmentUnsupported.Store(true)
+			n, err := writeBatchUDP(conn, pkts[total:])
+			return total + n, err
+		case errno != 0:
+			return total, &net.OpError{
+				Op:   "write",
+				Net:  conn.LocalAddr().Network(),
+				Addr: pkts[total].dst,
+				Err:  os.NewSyscallError("sendmmsg", errno),
+			}
+		case n <= 0:
+			return total, io.ErrShortWrite
+		}
+		for _, count := range counts[:n] {
+			total += count
+		}
+	}
+	return total, nil
+}
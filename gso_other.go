@@ -0,0 +1,15 @@
+//go:build !linux || !(amd64 || arm64)
+
+package bonfire
+
+import "net"
+
+// sockFamily always returns 0, since segmentation offload isn't supported on
+// this platform.
+func sockFamily(conn *net.UDPConn) int {
+	return 0
+}
+
+func writeSegmentsUDP(conn *net.UDPConn, family int, pkts []outPacket) (int, error) {
+	return writeBatchUDP(conn, pkts)
+}
@@ -0,0 +1,115 @@
+package bonfire
+
+import (
+	"net"
+	"time"
+)
+
+// MaxHandshakePayloadSize is the maximum size of PeerOpts' HandshakePayload.
+// It leaves room in a Handshake message for the extensions which may be
+// included alongside it.
+const MaxHandshakePayloadSize = 256
+
+// maxHandshakes is the number of addresses which a Peer will remember having
+// completed a handshake with, beyond which arbitrary ones are forgotten.
+// Forgotten addresses have OnPeerHandshake called for them again, should they
+// send another Handshake.
+const maxHandshakes = 1024
+
+// isHandshakeRequest returns whether the packet looks like a Handshake message
+// which isn't an answer to one. Such messages use the sending peer's
+// fingerprint, so they can only be recognized by their type.
+func isHandshakeRequest(b []byte) bool {
+	if len(b) < MinMessageSize+1 || MessageType(b[1+FingerprintSize]) != Handshake {
+		return false
+	}
+
+	// in version1 the body is preceded by its length.
+	flagsOff := 1 + FingerprintSize + 1
+	if b[0] == version1 {
+		flagsOff += 2
+	}
+	return len(b) > flagsOff && b[flagsOff]&1 == 0
+}
+
+// sendHandshake sends a Handshake message, carrying the Peer's
+// HandshakePayload, to the given address using the given fingerprint. If ack
+// is false the message asks for a Handshake in return, and the fingerprint
+// should be the Peer's own, so that it's recognized when echoed back. If
+// HandshakePayload isn't set then nothing is sent.
+//
+// This must be called with the lock held.
+func (p *Peer) sendHandshake(addr net.Addr, fingerprint []byte, ack bool) {
+	if p.po.HandshakePayload == nil || p.closed {
+		return
+	}
+
+	// answers are only sent once, so that unknown hosts can't use the Peer to
+	// multiply their traffic.
+	blastCount := p.po.PacketBlastCount
+	if ack {
+		blastCount = 1
+	}
+
+	sb := p.newSendBatch()
+	err := sb.add(addr, blastCount, Message{
+		Fingerprint: fingerprint,
+		Type:        Handshake,
+		HandshakeBody: HandshakeBody{
+			Ack:     ack,
+			Payload: p.po.HandshakePayload,
+		},
+	})
+	if err != nil {
+		p.event(PeerEvent{Type: PeerEventError, Addr: addr, Err: err})
+		return
+	}
+	p.flushAsync(sb, func(err error) {
+		p.event(PeerEvent{Type: PeerEventError, Addr: addr, Err: err})
+	})
+}
+
+// processHandshake handles a Handshake message from the given address,
+// answering it if it's not itself an answer, and passing its payload to
+// OnPeerHandshake if it's not the same as was last passed for the address.
+// Handshakes are only accepted from addresses in the set of peers, or which
+// the Peer was recently introduced to, so that it can't be used to reflect
+// traffic towards a spoofed source.
+//
+// This must be called with the lock held.
+func (p *Peer) processHandshake(addr net.Addr, msg Message) {
+	if p.po.HandshakePayload == nil {
+		return
+	} else if _, ok := p.peers[addr.String()]; !ok && p.introducedFingerprint(addr) == nil {
+		return
+	} else if !msg.HandshakeBody.Ack {
+		if p.isOwnFingerprint(msg.Fingerprint) {
+			return
+		}
+		p.sendHandshake(addr, msg.Fingerprint, true)
+	} else if !p.introStart.IsZero() {
+		p.stats.handshakeLatency.observe(time.Since(p.introStart))
+		p.introStart = time.Time{}
+	}
+
+	addrStr := addr.String()
+	if prev, ok := p.handshakes[addrStr]; ok && string(prev) == string(msg.HandshakeBody.Payload) {
+		return
+	}
+
+	if p.handshakes == nil {
+		p.handshakes = map[string][]byte{}
+	} else if len(p.handshakes) >= maxHandshakes {
+		for prevAddrStr := range p.handshakes {
+			delete(p.handshakes, prevAddrStr)
+			break
+		}
+	}
+
+	// the payload refers into the packet's buffer, which will be re-used.
+	payload := append([]byte{}, msg.HandshakeBody.Payload...)
+	p.handshakes[addrStr] = payload
+	if p.po.OnPeerHandshake != nil {
+		go p.po.OnPeerHandshake(addr, append([]byte{}, payload...))
+	}
+}
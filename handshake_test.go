@@ -0,0 +1,120 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestIsHandshakeRequest(t *T) {
+	for _, msg := range []Message{
+		{Type: Handshake},
+		{Type: Handshake, Rendezvous: rendezvousKey("foo")},
+		{Type: Handshake, HandshakeBody: HandshakeBody{Ack: true}},
+		{Type: Greet},
+	} {
+		msg.Fingerprint = mrand.Bytes(FingerprintSize)
+		b, err := msg.MarshalBinary()
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(msg.Type == Handshake && !msg.HandshakeBody.Ack, isHandshakeRequest(b)),
+		)
+	}
+}
+
+func TestPeerHandshake(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	go server.Serve(ctx, conn)
+	serverAddr := conn.LocalAddr().String()
+
+	type handshake struct {
+		addr    string
+		payload string
+	}
+
+	newPeer := func(payload string) (*Peer, chan handshake) {
+		ch := make(chan handshake, 10)
+		peer, err := NewPeer(ctx, "udp", serverAddr, &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			PacketBlastCount:        2,
+			ListenAddr:              "127.0.0.1:0",
+			HandshakePayload:        []byte(payload),
+			OnPeerHandshake: func(addr net.Addr, payload []byte) {
+				ch <- handshake{addr.String(), string(payload)}
+			},
+		})
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { peer.Close() })
+		peer.SetReadDeadline(time.Time{})
+		go func() {
+			b := make([]byte, MaxMessageSize)
+			for {
+				if _, _, err := peer.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+		return peer, ch
+	}
+
+	a, aCh := newPeer("a")
+	for len(server.Minglers()) < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	b, bCh := newPeer("b")
+
+	// b learns of a via introduction and initiates the handshake, which a
+	// answers.
+	massert.Require(t,
+		massert.Equal(handshake{b.LocalAddr().String(), "b"}, <-aCh),
+		massert.Equal(handshake{a.LocalAddr().String(), "a"}, <-bCh),
+	)
+
+	// duplicates due to PacketBlastCount aren't passed on.
+	time.Sleep(100 * time.Millisecond)
+	massert.Require(t,
+		massert.Equal(0, len(aCh)),
+		massert.Equal(0, len(bCh)),
+	)
+
+	// b's introduction and the answer to its handshake were both timed.
+	massert.Require(t,
+		massert.Equal(uint64(1), b.Stats().HandshakeLatency.Count),
+		massert.Equal(true, server.Stats().IntroLatency.Count > 0),
+	)
+
+	// a handshake from an address which a was never introduced to is neither
+	// answered nor passed on.
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer stranger.Close()
+	req, err := Message{
+		Fingerprint:   mrand.Bytes(FingerprintSize),
+		Type:          Handshake,
+		HandshakeBody: HandshakeBody{Payload: []byte("c")},
+	}.MarshalBinary()
+	massert.Require(t, massert.Nil(err))
+	_, err = stranger.WriteTo(req, a.LocalAddr())
+	massert.Require(t, massert.Nil(err))
+
+	stranger.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = stranger.ReadFrom(make([]byte, MaxMessageSize))
+	massert.Require(t,
+		massert.Not(massert.Nil(err)),
+		massert.Equal(0, len(aCh)),
+	)
+
+	_, err = NewPeer(ctx, "udp", serverAddr, &PeerOpts{
+		HandshakePayload: make([]byte, MaxHandshakePayloadSize+1),
+	})
+	massert.Require(t, massert.Not(massert.Nil(err)))
+}
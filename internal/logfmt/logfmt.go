@@ -0,0 +1,85 @@
+// Package logfmt adds a --log-format configuration parameter to the binaries
+// in this repo, which determines how mlog messages are written.
+package logfmt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mediocregopher/mediocre-go-lib/mcfg"
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/merr"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mrun"
+)
+
+// WithLogFormat adds a --log-format parameter to the given Context, which
+// should already have a Logger set on it (e.g. by m.ServiceContext). Its value
+// may be:
+//
+//   - "json" (the default): one JSON object per message, as written by
+//     mlog.DefaultHandler. This is suitable for log aggregators.
+//
+//   - "text": one line of plain text per message, which is easier to read
+//     in a terminal.
+//
+// The maximum log level is still set by the --log-level parameter.
+func WithLogFormat(ctx context.Context) context.Context {
+	ctx, format := mcfg.WithString(ctx, "log-format", "json", `Format log messages are written in, either "json" or "text".`)
+	return mrun.WithStartHook(ctx, func(context.Context) error {
+		switch *format {
+		case "json":
+		case "text":
+			mlog.From(ctx).SetHandler(TextHandler(os.Stderr))
+		default:
+			ctx := mctx.Annotate(ctx, "log-format", *format)
+			return merr.New("invalid log format", ctx)
+		}
+		return nil
+	})
+}
+
+// TextHandler returns an mlog.Handler which writes each message to the given
+// io.Writer as a single line of the form:
+//
+//	LEVEL description key=value key=value ...
+//
+// Annotation keys are prefixed with their path, if they have one, and are
+// sorted. Values containing spaces are quoted.
+func TextHandler(out io.Writer) mlog.Handler {
+	l := new(sync.Mutex)
+	return func(msg mlog.Message) error {
+		var kvs []string
+		if len(msg.Contexts) > 0 {
+			ctx := mctx.MergeAnnotations(msg.Contexts...)
+			for path, m := range mctx.Annotations(ctx).StringMapByPath() {
+				prefix := strings.Trim(path, "/")
+				if prefix != "" {
+					prefix = strings.ReplaceAll(prefix, "/", ".") + "."
+				}
+				for k, v := range m {
+					if strings.ContainsAny(v, " \t\n\"") {
+						v = fmt.Sprintf("%q", v)
+					}
+					kvs = append(kvs, prefix+k+"="+v)
+				}
+			}
+			sort.Strings(kvs)
+		}
+
+		line := msg.Level.String() + " " + msg.Description
+		if len(kvs) > 0 {
+			line += " " + strings.Join(kvs, " ")
+		}
+
+		l.Lock()
+		defer l.Unlock()
+		_, err := fmt.Fprintln(out, line)
+		return err
+	}
+}
@@ -0,0 +1,34 @@
+package logfmt
+
+import (
+	"bytes"
+	"context"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/mlog"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestTextHandler(t *T) {
+	buf := new(bytes.Buffer)
+	h := TextHandler(buf)
+
+	ctx := mctx.Annotate(context.Background(), "b", "2", "a", "has space")
+	ctx = mctx.NewChild(ctx, "child")
+	ctx = mctx.Annotate(ctx, "c", "3")
+
+	massert.Require(t,
+		massert.Nil(h(mlog.Message{Level: mlog.InfoLevel, Description: "no annotations"})),
+		massert.Nil(h(mlog.Message{
+			Level:       mlog.WarnLevel,
+			Description: "annotations",
+			Contexts:    []context.Context{ctx},
+		})),
+		massert.Equal(
+			"INFO no annotations\n"+
+				`WARN annotations a="has space" b=2 child.c=3`+"\n",
+			buf.String(),
+		),
+	)
+}
@@ -0,0 +1,98 @@
+package bonfire
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// numLatencyBuckets is the number of bounded buckets of a LatencyHistogram.
+const numLatencyBuckets = 17
+
+// latencyBuckets are the upper bounds of the buckets of a LatencyHistogram, see
+// LatencyBuckets.
+var latencyBuckets = func() [numLatencyBuckets]time.Duration {
+	var buckets [numLatencyBuckets]time.Duration
+	for i := range buckets {
+		buckets[i] = 100 * time.Microsecond << i
+	}
+	return buckets
+}()
+
+// LatencyBuckets returns the upper bounds of the buckets of a
+// LatencyHistogram. They grow exponentially, each being double the last, from
+// 100µs to a little over 6.5s.
+func LatencyBuckets() []time.Duration {
+	return append([]time.Duration(nil), latencyBuckets[:]...)
+}
+
+// LatencyHistogram describes the distribution of some latency, see
+// ServerStats' IntroLatency and PeerStats' HandshakeLatency.
+type LatencyHistogram struct {
+	Count      uint64
+	Total, Max time.Duration
+
+	// The number of latencies which fell into each of the LatencyBuckets, plus
+	// a final one for those which were longer than the last.
+	Buckets []uint64
+}
+
+// Mean returns the mean latency, or 0 if none have been observed.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+// Quantile returns the upper bound of the bucket which the given quantile (e.g.
+// 0.99) of latencies fell into, or Max if that's lower. It returns 0 if none
+// have been observed.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	var n uint64
+	for i, count := range h.Buckets {
+		if n += count; n > rank && i < len(latencyBuckets) {
+			return min(latencyBuckets[i], h.Max)
+		}
+	}
+	return h.Max
+}
+
+// latencyHistogram is a LatencyHistogram which can be observed concurrently.
+type latencyHistogram struct {
+	count, total, max atomic.Uint64
+	buckets           [numLatencyBuckets + 1]atomic.Uint64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	d = max(d, 0)
+	h.count.Add(1)
+	h.total.Add(uint64(d))
+	for prev := h.max.Load(); uint64(d) > prev; prev = h.max.Load() {
+		if h.max.CompareAndSwap(prev, uint64(d)) {
+			break
+		}
+	}
+
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+}
+
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	snap := LatencyHistogram{
+		Count:   h.count.Load(),
+		Total:   time.Duration(h.total.Load()),
+		Max:     time.Duration(h.max.Load()),
+		Buckets: make([]uint64, len(h.buckets)),
+	}
+	for i := range h.buckets {
+		snap.Buckets[i] = h.buckets[i].Load()
+	}
+	return snap
+}
@@ -0,0 +1,39 @@
+package bonfire
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestLatencyHistogram(t *T) {
+	var h latencyHistogram
+	massert.Require(t,
+		massert.Equal(time.Duration(0), h.snapshot().Mean()),
+		massert.Equal(time.Duration(0), h.snapshot().Quantile(0.5)),
+	)
+
+	for _, d := range []time.Duration{
+		50 * time.Microsecond,
+		150 * time.Microsecond,
+		150 * time.Microsecond,
+		time.Millisecond,
+		time.Minute,
+	} {
+		h.observe(d)
+	}
+
+	snap := h.snapshot()
+	wantBuckets := make([]uint64, len(LatencyBuckets())+1)
+	wantBuckets[0], wantBuckets[1], wantBuckets[4] = 1, 2, 1
+	wantBuckets[len(LatencyBuckets())] = 1
+	massert.Require(t,
+		massert.Equal(uint64(5), snap.Count),
+		massert.Equal(time.Minute, snap.Max),
+		massert.Equal(wantBuckets, snap.Buckets),
+		massert.Equal(200*time.Microsecond, snap.Quantile(0.5)),
+		massert.Equal(1600*time.Microsecond, snap.Quantile(0.7)),
+		massert.Equal(time.Minute, snap.Quantile(0.99)),
+	)
+}
@@ -0,0 +1,325 @@
+package bonfire
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// migratingConn wraps a PacketConn such that the underlying PacketConn may be
+// replaced with a freshly bound one at any time, without callers which are
+// blocked on it noticing anything other than a short delay.
+type migratingConn struct {
+	l                           sync.RWMutex
+	conn                        net.PacketConn
+	gen                         uint64
+	readDeadline, writeDeadline time.Time
+	closed                      bool
+
+	// errCh is written to (without blocking) whenever a socket error is
+	// encountered which might indicate that the local address has changed.
+	errCh chan struct{}
+
+	// rec is only set if PeerOpts' RecordWriter is, and is set prior to the
+	// migratingConn being used.
+	rec *recorder
+
+	// unreachableCh is only set if watchUnreachable has been called, see
+	// there.
+	unreachableCh chan net.Addr
+}
+
+func newMigratingConn(conn net.PacketConn) *migratingConn {
+	return &migratingConn{
+		conn:  conn,
+		errCh: make(chan struct{}, 1),
+	}
+}
+
+func isTimeout(err error) bool {
+	nErr, ok := err.(net.Error)
+	return ok && nErr.Timeout()
+}
+
+// handleErr returns true if the operation which returned the error should be
+// retried on the new underlying PacketConn.
+func (c *migratingConn) handleErr(err error, gen uint64) bool {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	if c.closed {
+		return false
+	} else if c.gen != gen {
+		return true
+	} else if !isTimeout(err) && !isUnreachableErr(err) {
+		select {
+		case c.errCh <- struct{}{}:
+		default:
+		}
+	}
+	return false
+}
+
+func (c *migratingConn) current() (net.PacketConn, uint64) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return c.conn, c.gen
+}
+
+func (c *migratingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		conn, gen := c.current()
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil && c.unreachableCh != nil && isUnreachableErr(err) {
+			// the error pertains to some previously sent packet, not this
+			// read, so read the details of it and try again.
+			for _, addr := range readErrQueue(conn) {
+				c.reportUnreachable(addr)
+			}
+			continue
+		} else if err != nil && c.handleErr(err, gen) {
+			continue
+		} else if err == nil {
+			c.rec.record(RecordIn, addr, b[:n])
+		}
+		return n, addr, err
+	}
+}
+
+func (c *migratingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	for {
+		conn, gen := c.current()
+		n, err := conn.WriteTo(b, addr)
+		if isUnreachableErr(err) {
+			c.reportUnreachable(addr)
+		}
+		if err != nil && c.handleErr(err, gen) {
+			continue
+		} else if err == nil {
+			c.rec.record(RecordOut, addr, b)
+		}
+		return n, err
+	}
+}
+
+func (c *migratingConn) writeBatch(pkts []outPacket) (int, error) {
+	var total int
+	for {
+		conn, gen := c.current()
+		n, err := writePackets(conn, pkts[total:])
+		for _, pkt := range pkts[total : total+n] {
+			c.rec.record(RecordOut, pkt.dst, pkt.b)
+		}
+		total += n
+		if isUnreachableErr(err) && total < len(pkts) {
+			c.reportUnreachable(pkts[total].dst)
+		}
+		if err != nil && c.handleErr(err, gen) {
+			continue
+		}
+		return total, err
+	}
+}
+
+func (c *migratingConn) Close() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *migratingConn) LocalAddr() net.Addr {
+	conn, _ := c.current()
+	return conn.LocalAddr()
+}
+
+func (c *migratingConn) SetDeadline(t time.Time) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return c.conn.SetDeadline(t)
+}
+
+func (c *migratingConn) SetReadDeadline(t time.Time) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *migratingConn) SetWriteDeadline(t time.Time) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
+
+// rebind replaces the current underlying PacketConn with a newly bound one,
+// which is passed through wrap if given. The new one is bound before the old
+// one is closed, so that the old one remains in use if binding fails.
+//
+// The exception is when addr has a fixed port and reusePort isn't set, as the
+// old one must then be closed before the new one can bind to the same port. If
+// binding fails in that case, the old one's address is bound again so that
+// there's still a usable PacketConn, but the original error is returned.
+func (c *migratingConn) rebind(network, addr string, reusePort bool, wrap func(net.PacketConn) (net.PacketConn, error)) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.closed {
+		return errors.New("connection is closed")
+	}
+
+	bind := func(addr string) (net.PacketConn, error) {
+		conn, err := listenPacket(network, addr, reusePort)
+		if err != nil {
+			return nil, err
+		}
+		return wrapConn(wrap, conn)
+	}
+
+	oldConn := c.conn
+	closeFirst := !reusePort && hasFixedPort(addr)
+	if closeFirst {
+		oldConn.Close()
+	}
+
+	conn, err := bind(addr)
+	if err != nil && !closeFirst {
+		return err
+	} else if err != nil {
+		restored, restoreErr := bind(oldConn.LocalAddr().String())
+		if restoreErr != nil {
+			return err
+		}
+		c.swap(restored)
+		return err
+	}
+
+	if !closeFirst {
+		oldConn.Close()
+	}
+	c.swap(conn)
+	return nil
+}
+
+// swap makes the given PacketConn the current underlying one, applying the
+// deadlines and options set on the previous one. c.l must be held.
+func (c *migratingConn) swap(conn net.PacketConn) {
+	conn.SetReadDeadline(c.readDeadline)
+	conn.SetWriteDeadline(c.writeDeadline)
+	if c.unreachableCh != nil {
+		enableRecvErr(conn)
+	}
+	c.conn = conn
+	c.gen++
+}
+
+// hasFixedPort returns true if the given listen address specifies a port other
+// than 0.
+func hasFixedPort(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port != "" && port != "0"
+}
+
+// interfaceAddrsKey returns a string describing the current set of local
+// interface addresses, for the purpose of detecting when it changes.
+func interfaceAddrsKey() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	strs := make([]string, len(addrs))
+	for i := range addrs {
+		strs[i] = addrs[i].String()
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, ",")
+}
+
+// Migrate re-binds the Peer's socket and re-bootstraps with the server, as if
+// the Peer were new. This is done automatically when MigrateCheckInterval is
+// set, but may be called manually as well, e.g. if the application knows the
+// host has changed networks.
+//
+// The Peer's RemoteAddr will be updated by the next HelloPeer message
+// received, at which point OnMigrate will be called (if set). As with
+// ResetPeers, ReadFrom must be called in order for that message to be
+// processed. An error is returned if the Peer hasn't yet finished
+// bootstrapping, e.g. if it was created by NewPeerAsync.
+func (p *Peer) Migrate() error {
+	p.l.Lock()
+	err := p.migrate()
+	mingles := p.mingles()
+	hasGW := p.gw != nil
+	p.l.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// the new socket needs its own port mapping. The gateway may no longer be
+	// reachable, so this is best effort, and is done without the lock held
+	// since it's a round trip to the gateway.
+	if hasGW {
+		if gwAddr, err := p.natForward(); err == nil {
+			p.l.Lock()
+			p.gwAddr = gwAddr
+			p.l.Unlock()
+		} else {
+			p.event(PeerEvent{Type: PeerEventError, Err: fmt.Errorf("refreshing gateway port mapping: %w", err)})
+		}
+	}
+
+	if !mingles {
+		return nil
+	}
+	return p.readyToMingle()
+}
+
+func (p *Peer) migrate() error {
+	if p.closed {
+		return errors.New("bonfire.Peer is closed")
+	} else if p.multi != nil {
+		return errors.New("realms of a MultiPeer can't be migrated")
+	} else if err := p.checkCanRebootstrap(); err != nil {
+		return err
+	} else if err := p.mconn.rebind(p.network, p.po.ListenAddr, p.po.ReusePort, p.po.WrapConn); err != nil {
+		return err
+	}
+
+	p.migrating = true
+	p.setState(PeerStateRebootstrapping)
+	return p.resetPeers(p.po.PacketBlastCount)
+}
+
+func (p *Peer) spinMigrate() {
+	defer p.wg.Done()
+	t := time.NewTicker(p.po.MigrateCheckInterval)
+	defer t.Stop()
+
+	ifaceKey := interfaceAddrsKey()
+	var lastMigrate time.Time
+	for {
+		select {
+		case <-t.C:
+			newIfaceKey := interfaceAddrsKey()
+			if newIfaceKey == ifaceKey {
+				continue
+			}
+			ifaceKey = newIfaceKey
+		case <-p.mconn.errCh:
+			// socket errors might be persistent (e.g. there's no network at
+			// all), so don't migrate more often than the check interval.
+			if time.Since(lastMigrate) < p.po.MigrateCheckInterval {
+				continue
+			}
+		case <-p.closeCh:
+			return
+		}
+
+		lastMigrate = time.Now()
+		p.Migrate()
+	}
+}
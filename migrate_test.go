@@ -0,0 +1,137 @@
+package bonfire
+
+import (
+	"net"
+	"runtime"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestMigratingConn(t *T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mconn := newMigratingConn(conn)
+	defer mconn.Close()
+	mconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	type readRes struct {
+		b   []byte
+		err error
+	}
+	readCh := make(chan readRes)
+	go func() {
+		b := make([]byte, 100)
+		n, _, err := mconn.ReadFrom(b)
+		readCh <- readRes{b[:n], err}
+	}()
+
+	// give ReadFrom a chance to block on the original conn
+	time.Sleep(100 * time.Millisecond)
+	oldAddr := mconn.LocalAddr()
+	massert.Require(t, massert.Nil(mconn.rebind("udp", "127.0.0.1:0", false, nil)))
+	newAddr := mconn.LocalAddr()
+
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	bExp := mrand.Bytes(100)
+	if _, err := other.WriteTo(bExp, newAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-readCh
+	massert.Require(t,
+		massert.Not(massert.Equal(oldAddr.String(), newAddr.String())),
+		massert.Nil(res.err),
+		massert.Equal(bExp, res.b),
+	)
+
+	// the socket error from the old conn being closed should not have been
+	// treated as a reason to migrate
+	select {
+	case <-mconn.errCh:
+		t.Fatal("unexpected write to errCh")
+	default:
+	}
+}
+
+func TestMigratingConnRebindFailure(t *T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mconn := newMigratingConn(conn)
+	defer mconn.Close()
+	oldAddr := mconn.LocalAddr()
+
+	// binding fails, so the original conn should still be in use.
+	massert.Require(t, massert.Not(massert.Nil(mconn.rebind("udp", "256.0.0.1:0", false, nil))))
+	massert.Require(t, massert.Equal(oldAddr.String(), mconn.LocalAddr().String()))
+
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	bExp := mrand.Bytes(100)
+	if _, err := other.WriteTo(bExp, oldAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	mconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 100)
+	n, _, err := mconn.ReadFrom(b)
+	massert.Require(t, massert.Nil(err), massert.Equal(bExp, b[:n]))
+}
+
+func TestMigratingConnUnreachable(t *T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ICMP errors are only read on linux")
+	}
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mconn := newMigratingConn(conn)
+	defer mconn.Close()
+	unreachableCh := mconn.watchUnreachable()
+
+	// get an address which nothing is listening on.
+	dead, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.LocalAddr()
+	dead.Close()
+
+	_, err = mconn.WriteTo([]byte("hi"), deadAddr)
+	massert.Require(t, massert.Nil(err))
+
+	// the ICMP error is delivered to the next read, which should swallow it
+	// and carry on until its deadline.
+	mconn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = mconn.ReadFrom(make([]byte, 100))
+	massert.Require(t, massert.Equal(true, isTimeout(err)))
+
+	select {
+	case addr := <-unreachableCh:
+		massert.Require(t, massert.Equal(deadAddr.String(), addr.String()))
+	default:
+		t.Fatal("expected address on unreachableCh")
+	}
+
+	// the error shouldn't be treated as a reason to migrate
+	select {
+	case <-mconn.errCh:
+		t.Fatal("unexpected write to errCh")
+	default:
+	}
+}
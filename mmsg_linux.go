@@ -0,0 +1,224 @@
+//go:build linux && (amd64 || arm64)
+
+package bonfire
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// maxBatchSize is the maximum number of packets passed into a single sendmmsg
+// or recvmmsg call.
+const maxBatchSize = 64
+
+// mmsghdr corresponds to the C struct of the same name.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// putSockaddr fills in the raw form of the address for a socket of the given
+// family, returning its length, or false if the socket can't send to it.
+func putSockaddr(sa *syscall.RawSockaddrInet6, family int, addr *net.UDPAddr) (uint32, bool) {
+	*sa = syscall.RawSockaddrInet6{}
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	port[0], port[1] = byte(addr.Port>>8), byte(addr.Port)
+
+	if family == syscall.AF_INET {
+		ip := addr.IP.To4()
+		if ip == nil {
+			return 0, false
+		}
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		sa4.Family = syscall.AF_INET
+		copy(sa4.Addr[:], ip)
+		return syscall.SizeofSockaddrInet4, true
+	}
+
+	// an IPv6 socket can send to IPv4 addresses using their mapped form, which
+	// To16 returns.
+	ip := addr.IP.To16()
+	if ip == nil {
+		return 0, false
+	}
+	sa.Family = syscall.AF_INET6
+	copy(sa.Addr[:], ip)
+	return syscall.SizeofSockaddrInet6, true
+}
+
+// writeBatchUDP writes the packets using the sendmmsg system call. If any of
+// the packets can't be sent this way then they are all written individually.
+func writeBatchUDP(conn *net.UDPConn, pkts []outPacket) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return writeEach(conn, pkts)
+	}
+
+	family := -1
+	rawConn.Control(func(fd uintptr) {
+		family, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+	})
+	if family != syscall.AF_INET && family != syscall.AF_INET6 {
+		return writeEach(conn, pkts)
+	}
+
+	var (
+		hdrs  [maxBatchSize]mmsghdr
+		iovs  [maxBatchSize]syscall.Iovec
+		addrs [maxBatchSize]syscall.RawSockaddrInet6
+	)
+
+	var total int
+	for total < len(pkts) {
+		batch := pkts[total:]
+		if len(batch) > maxBatchSize {
+			batch = batch[:maxBatchSize]
+		}
+
+		for i, pkt := range batch {
+			udpAddr, ok := pkt.dst.(*net.UDPAddr)
+			if !ok || udpAddr.Zone != "" {
+				n, err := writeEach(conn, pkts[total:])
+				return total + n, err
+			}
+			addrLen, ok := putSockaddr(&addrs[i], family, udpAddr)
+			if !ok {
+				n, err := writeEach(conn, pkts[total:])
+				return total + n, err
+			}
+
+			iovs[i].Base = unsafe.SliceData(pkt.b)
+			iovs[i].SetLen(len(pkt.b))
+			hdrs[i] = mmsghdr{hdr: syscall.Msghdr{
+				Name:    (*byte)(unsafe.Pointer(&addrs[i])),
+				Namelen: addrLen,
+				Iov:     &iovs[i],
+				Iovlen:  1,
+			}}
+		}
+
+		var n int
+		var errno syscall.Errno
+		err := rawConn.Write(func(fd uintptr) bool {
+			r, _, e := syscall.Syscall6(
+				sysSENDMMSG, fd,
+				uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(batch)),
+				0, 0, 0,
+			)
+			if e == syscall.EAGAIN {
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		})
+
+		switch {
+		case err != nil:
+			return total, err
+		case errno == syscall.ENOSYS:
+			n, err := writeEach(conn, pkts[total:])
+			return total + n, err
+		case errno != 0:
+			return total, &net.OpError{
+				Op:   "write",
+				Net:  conn.LocalAddr().Network(),
+				Addr: batch[0].dst,
+				Err:  os.NewSyscallError("sendmmsg", errno),
+			}
+		case n <= 0:
+			return total, io.ErrShortWrite
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// getSockaddr returns the address described by the raw form filled in by the
+// kernel, or nil if it's not an IP address.
+func getSockaddr(sa *syscall.RawSockaddrInet6) net.Addr {
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	addr := &net.UDPAddr{Port: int(port[0])<<8 | int(port[1])}
+	switch sa.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		addr.IP = net.IPv4(sa4.Addr[0], sa4.Addr[1], sa4.Addr[2], sa4.Addr[3])
+	case syscall.AF_INET6:
+		addr.IP = make(net.IP, net.IPv6len)
+		copy(addr.IP, sa.Addr[:])
+		if sa.Scope_id != 0 {
+			addr.Zone = strconv.Itoa(int(sa.Scope_id))
+		}
+	default:
+		return nil
+	}
+	return addr
+}
+
+// readBatchUDP reads as many packets as are available, up to len(pkts), using
+// the recvmmsg system call. It blocks until at least one is available.
+func readBatchUDP(conn *net.UDPConn, pkts []inPacket) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return readOne(conn, pkts)
+	}
+	if len(pkts) > maxBatchSize {
+		pkts = pkts[:maxBatchSize]
+	}
+
+	var (
+		hdrs  [maxBatchSize]mmsghdr
+		iovs  [maxBatchSize]syscall.Iovec
+		addrs [maxBatchSize]syscall.RawSockaddrInet6
+	)
+	for i := range pkts {
+		iovs[i].Base = unsafe.SliceData(pkts[i].b)
+		iovs[i].SetLen(len(pkts[i].b))
+		hdrs[i] = mmsghdr{hdr: syscall.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&addrs[i])),
+			Namelen: syscall.SizeofSockaddrInet6,
+			Iov:     &iovs[i],
+			Iovlen:  1,
+		}}
+	}
+
+	var n int
+	var errno syscall.Errno
+	err = rawConn.Read(func(fd uintptr) bool {
+		// the socket is non-blocking, so this returns whatever packets are
+		// available, or EAGAIN if there are none.
+		r, _, e := syscall.Syscall6(
+			sysRECVMMSG, fd,
+			uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(pkts)),
+			0, 0, 0,
+		)
+		if e == syscall.EAGAIN {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+
+	switch {
+	case err != nil:
+		return 0, err
+	case errno == syscall.ENOSYS:
+		return readOne(conn, pkts)
+	case errno != 0:
+		return 0, &net.OpError{
+			Op:   "read",
+			Net:  conn.LocalAddr().Network(),
+			Addr: conn.LocalAddr(),
+			Err:  os.NewSyscallError("recvmmsg", errno),
+		}
+	}
+
+	for i := range pkts[:n] {
+		pkts[i].n = min(int(hdrs[i].len), len(pkts[i].b))
+		pkts[i].src = getSockaddr(&addrs[i])
+	}
+	return n, nil
+}
@@ -0,0 +1,9 @@
+package bonfire
+
+import "syscall"
+
+// the syscall package doesn't define SYS_SENDMMSG for amd64.
+const (
+	sysSENDMMSG = 307
+	sysRECVMMSG = syscall.SYS_RECVMMSG
+)
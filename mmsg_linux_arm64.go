@@ -0,0 +1,8 @@
+package bonfire
+
+import "syscall"
+
+const (
+	sysSENDMMSG = syscall.SYS_SENDMMSG
+	sysRECVMMSG = syscall.SYS_RECVMMSG
+)
@@ -0,0 +1,13 @@
+//go:build !linux || !(amd64 || arm64)
+
+package bonfire
+
+import "net"
+
+func writeBatchUDP(conn *net.UDPConn, pkts []outPacket) (int, error) {
+	return writeEach(conn, pkts)
+}
+
+func readBatchUDP(conn *net.UDPConn, pkts []inPacket) (int, error) {
+	return readOne(conn, pkts)
+}
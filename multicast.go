@@ -0,0 +1,115 @@
+package bonfire
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// joinMulticast creates the socket on which multicast announcements by other
+// peers are received, as determined by MulticastAddr.
+func (p *Peer) joinMulticast() error {
+	groupAddr, err := net.ResolveUDPAddr("udp", p.po.MulticastAddr)
+	if err != nil {
+		return fmt.Errorf("resolving MulticastAddr %q: %w", p.po.MulticastAddr, err)
+	} else if !groupAddr.IP.IsMulticast() {
+		return fmt.Errorf("MulticastAddr %q is not a multicast address", p.po.MulticastAddr)
+	}
+
+	network := "udp6"
+	if groupAddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	if p.mcastConn, err = net.ListenMulticastUDP(network, nil, groupAddr); err != nil {
+		return err
+	}
+	p.mcastAddr = groupAddr
+	return nil
+}
+
+// announce sends a HelloPeer message to the multicast group, using the current
+// fingerprint, the given number of times. Other peers in the group will
+// respond with HelloPeer messages of their own.
+//
+// This must be called with the lock held.
+func (p *Peer) announce(blastCount int) error {
+	conn, _ := p.mconn.current()
+	if err := setMulticastTTL(conn, p.po.MulticastTTL); err != nil {
+		return fmt.Errorf("setting multicast TTL: %w", err)
+	}
+
+	// the addr is required by the message format, but receivers use the
+	// address the announcement was sent from instead.
+	msg := Message{
+		Fingerprint:   p.lastFingerprint,
+		Type:          HelloPeer,
+		HelloPeerBody: HelloPeerBody{Addr: p.mconn.LocalAddr()},
+		Candidates:    p.candidates(),
+	}
+
+	// as with HelloServer, in privacy mode the candidates are only sent in
+	// sealed form, which also proves to other peers that the announcement is
+	// from a member of the network.
+	var err error
+	if p.sealer != nil {
+		if msg.Sealed, err = p.sealer.seal(msg.Candidates); err != nil {
+			return err
+		}
+		msg.Candidates = nil
+	}
+
+	return multiSend(p.newSendBatch(), p.mcastAddr, blastCount, msg)
+}
+
+// The bounds of the time spinMulticast waits before reading again after an
+// error, which doubles with each consecutive error.
+const (
+	multicastMinBackoff = 10 * time.Millisecond
+	multicastMaxBackoff = 5 * time.Second
+)
+
+// spinMulticast handles announcements received on the multicast socket until
+// it is closed.
+func (p *Peer) spinMulticast() {
+	defer p.wg.Done()
+	b := make([]byte, MaxMessageSize)
+	var backoff time.Duration
+	for {
+		n, addr, err := p.mcastConn.ReadFrom(b)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			p.event(PeerEvent{Type: PeerEventError, Err: fmt.Errorf("reading multicast socket: %w", err)})
+
+			// errors may be persistent (e.g. the interface has gone away),
+			// in which case reading again straight away would spin.
+			backoff = min(max(2*backoff, multicastMinBackoff), multicastMaxBackoff)
+			select {
+			case <-time.After(backoff):
+			case <-p.closeCh:
+				return
+			}
+			continue
+		}
+
+		backoff = 0
+		if p.filtered(addr, b[:n]) {
+			continue
+		}
+
+		var msg Message
+		if err := msg.UnmarshalBinary(b[:n]); err != nil || msg.Type != HelloPeer {
+			continue
+		} else if !msg.fresh(p.po.MaxMessageAge, time.Now()) {
+			continue
+		}
+
+		// an announcement is handled just like a greeting, except that it
+		// uses the HelloPeer type, as it can't be mistaken for anything else
+		// on this socket.
+		p.l.Lock()
+		p.processGreeting(addr, msg)
+		p.l.Unlock()
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package bonfire
+
+import "net"
+
+// setMulticastTTL does nothing on this platform, multicast packets are sent
+// with the system's default TTL.
+func setMulticastTTL(conn net.PacketConn, ttl int) error {
+	return nil
+}
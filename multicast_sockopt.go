@@ -0,0 +1,37 @@
+//go:build unix || windows
+
+package bonfire
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastTTL sets the TTL (or hop limit) of multicast packets sent on the
+// socket, if it is one.
+func setMulticastTTL(conn net.PacketConn, ttl int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		// which of these applies depends on the socket's family, and a
+		// dual-stack socket needs both, so it's only an error if neither
+		// can be set.
+		errV4 := setsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+		errV6 := setsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+		if errV4 != nil && errV6 != nil {
+			sockErr = errV4
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
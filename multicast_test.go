@@ -0,0 +1,127 @@
+package bonfire
+
+import (
+	"context"
+	"fmt"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerMulticast(t *T) {
+	opts := &PeerOpts{
+		MulticastAddr:           fmt.Sprintf("239.255.66.1:%d", 20000+mrand.Intn(40000)),
+		InitTimeoutUntilGateway: 250 * time.Millisecond,
+		PrivacyKey:              mrand.Bytes(16),
+	}
+	ctx := context.Background()
+
+	// the first peer has nobody to hear from, but should start anyway.
+	peerA, err := NewPeer(ctx, "udp", "", opts)
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer peerA.Close()
+	massert.Require(t,
+		massert.Length(peerA.PeerAddrs(), 0),
+		massert.Nil(peerA.RemoteAddr()),
+	)
+
+	// the second should hear from the first in response to its announcement.
+	peerB, err := NewPeer(ctx, "udp", "", opts)
+	massert.Require(t, massert.Nil(err))
+	defer peerB.Close()
+
+	port := func(addr net.Addr) int { return addr.(*net.UDPAddr).Port }
+	peerBAddrs := peerB.PeerAddrs()
+	if len(peerBAddrs) == 0 {
+		t.Skip("multicast announcement not received, multicast is likely unavailable")
+	}
+	massert.Require(t,
+		massert.Length(peerBAddrs, 1),
+		massert.Equal(port(peerA.LocalAddr()), port(peerBAddrs[0])),
+		massert.Equal(port(peerB.LocalAddr()), port(peerB.RemoteAddr())),
+	)
+
+	peerAAddrs := peerA.PeerAddrs()
+	massert.Require(t,
+		massert.Length(peerAAddrs, 1),
+		massert.Equal(port(peerB.LocalAddr()), port(peerAAddrs[0])),
+	)
+
+	// a peer with a different key should be ignored.
+	otherOpts := *opts
+	otherOpts.PrivacyKey = mrand.Bytes(16)
+	peerC, err := NewPeer(ctx, "udp", "", &otherOpts)
+	massert.Require(t, massert.Nil(err))
+	defer peerC.Close()
+	massert.Require(t,
+		massert.Length(peerC.PeerAddrs(), 0),
+		massert.Length(peerA.PeerAddrs(), 1),
+	)
+}
+
+func TestPeerMulticastReadErrors(t *T) {
+	eventCh := make(chan PeerEvent, 1000)
+	peer, err := NewPeer(context.Background(), "udp", "", &PeerOpts{
+		MulticastAddr:           fmt.Sprintf("239.255.66.1:%d", 20000+mrand.Intn(40000)),
+		InitTimeoutUntilGateway: 250 * time.Millisecond,
+		EventCh:                 eventCh,
+	})
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer peer.Close()
+
+	// with a deadline in the past every read fails, which shouldn't cause
+	// more than a handful of errors while the reader backs off.
+	peer.mcastConn.SetReadDeadline(time.Unix(1, 0))
+	time.Sleep(300 * time.Millisecond)
+
+	var errs int
+	for len(eventCh) > 0 {
+		if ev := <-eventCh; ev.Type == PeerEventError {
+			errs++
+		}
+	}
+	massert.Require(t,
+		massert.Equal(true, errs > 0),
+		massert.Equal(true, errs < 10),
+	)
+}
+
+func TestPeerMulticastWithServer(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// peers which use both a server and multicast handle announcements from
+	// each other while they're still bootstrapping with the server.
+	_, serverAddr := testServer(ctx, t, nil)
+	mcastAddr := fmt.Sprintf("239.255.66.1:%d", 20000+mrand.Intn(40000))
+
+	const numPeers = 3
+	peerCh := make(chan *Peer, numPeers)
+	errCh := make(chan error, numPeers)
+	for range numPeers {
+		go func() {
+			peer, err := tryTestPeer(ctx, t, serverAddr.String(), PeerOpts{
+				ListenAddr:    "0.0.0.0:0",
+				MulticastAddr: mcastAddr,
+			})
+			peerCh <- peer
+			errCh <- err
+		}()
+	}
+
+	for range numPeers {
+		if err := <-errCh; err != nil {
+			t.Skipf("multicast unavailable: %v", err)
+		}
+	}
+	for range numPeers {
+		massert.Require(t, massert.Nil((<-peerCh).WaitForPeers(ctx, 1)))
+	}
+}
@@ -0,0 +1,279 @@
+package bonfire
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// MultiPeer allows for participating in multiple bonfire networks (realms),
+// each having its own server and options, over a single socket. Each realm is
+// managed by its own Peer, and incoming bonfire messages are passed to
+// whichever realm's Peer they were meant for, as determined by their
+// fingerprint.
+//
+// As with Peer, ReadFrom must be called repeatedly in order for bonfire
+// messages to be processed, and packets which aren't bonfire messages are
+// returned from it. ReadFrom must not be called on the realms' Peers
+// themselves.
+type MultiPeer struct {
+	// MultiPeer wraps a PacketConn, overwriting some of its methods and
+	// exposing the rest.
+	net.PacketConn
+	mconn   *migratingConn
+	network string
+
+	// readL is held by whichever go-routine is currently reading from the
+	// connection. Realms being bootstrapped need to read from the connection
+	// themselves, and kicks is incremented while they are waiting to do so.
+	readL        sync.Mutex
+	kicks        int
+	readDeadline time.Time
+
+	l      sync.RWMutex
+	realms map[string]*Peer
+	closed bool
+}
+
+// NewMultiPeer initializes a MultiPeer listening on the given address. The
+// network is as for NewPeer, and applies to all realms. Realms must be added
+// to it using AddRealm.
+func NewMultiPeer(network, listenAddr string) (*MultiPeer, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	} else if listenAddr == "" {
+		listenAddr = ":0"
+	}
+
+	conn, err := net.ListenPacket(network, listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	mconn := newMigratingConn(conn)
+	return &MultiPeer{
+		PacketConn: mconn,
+		mconn:      mconn,
+		network:    network,
+		realms:     map[string]*Peer{},
+	}, nil
+}
+
+// AddRealm adds a realm with the given name to the MultiPeer, creating a Peer
+// which communicates with the server at the given address as NewPeer would.
+// The ListenAddr and MigrateCheckInterval options are ignored, as the socket
+// is shared by all realms.
+//
+// While the new realm is bootstrapping any concurrent calls to ReadFrom will
+// be blocked.
+func (mp *MultiPeer) AddRealm(ctx context.Context, name, serverAddr string, opts *PeerOpts) (*Peer, error) {
+	if opts == nil {
+		opts = new(PeerOpts)
+	}
+
+	mp.l.Lock()
+	if mp.closed {
+		mp.l.Unlock()
+		return nil, errors.New("bonfire.MultiPeer is closed")
+	} else if _, ok := mp.realms[name]; ok {
+		mp.l.Unlock()
+		return nil, fmt.Errorf("realm %q already exists", name)
+	}
+	// reserve the name, so concurrent calls can't add it as well.
+	mp.realms[name] = nil
+	mp.l.Unlock()
+
+	mp.lockRead()
+	peer, err := newPeer(ctx, mp.network, serverAddr, *opts, mp.mconn, mp, false)
+	mp.unlockRead()
+
+	mp.l.Lock()
+	defer mp.l.Unlock()
+	if err != nil {
+		delete(mp.realms, name)
+		return nil, err
+	}
+	mp.realms[name] = peer
+	return peer, nil
+}
+
+// Realm returns the Peer for the realm of the given name, or nil if there
+// isn't one.
+func (mp *MultiPeer) Realm(name string) *Peer {
+	mp.l.RLock()
+	defer mp.l.RUnlock()
+	return mp.realms[name]
+}
+
+// RemoveRealm closes the Peer for the realm of the given name and removes it
+// from the MultiPeer. This is equivalent to calling Close on the Peer.
+func (mp *MultiPeer) RemoveRealm(name string) error {
+	peer := mp.Realm(name)
+	if peer == nil {
+		return fmt.Errorf("no realm %q", name)
+	}
+	return peer.Close()
+}
+
+// removeRealm is called by a realm's Peer once it has been closed.
+func (mp *MultiPeer) removeRealm(peer *Peer) {
+	mp.l.Lock()
+	defer mp.l.Unlock()
+	for name, realmPeer := range mp.realms {
+		if realmPeer == peer {
+			delete(mp.realms, name)
+		}
+	}
+}
+
+// lockRead acquires readL, interrupting any ReadFrom currently in progress in
+// order to do so.
+func (mp *MultiPeer) lockRead() {
+	mp.l.Lock()
+	mp.kicks++
+	mp.l.Unlock()
+
+	mp.mconn.SetReadDeadline(time.Now())
+	mp.readL.Lock()
+}
+
+func (mp *MultiPeer) unlockRead() {
+	mp.l.Lock()
+	mp.kicks--
+	mp.mconn.SetReadDeadline(mp.readDeadline)
+	mp.l.Unlock()
+	mp.readL.Unlock()
+}
+
+// kicked returns true if the given error, returned from reading the
+// connection, was caused by lockRead rather than the caller's deadline.
+func (mp *MultiPeer) kicked(err error) bool {
+	if !isTimeout(err) {
+		return false
+	}
+	mp.l.RLock()
+	defer mp.l.RUnlock()
+	return mp.kicks > 0 ||
+		mp.readDeadline.IsZero() ||
+		time.Now().Before(mp.readDeadline)
+}
+
+// SetDeadline implements the method for the net.PacketConn interface.
+func (mp *MultiPeer) SetDeadline(t time.Time) error {
+	if err := mp.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return mp.mconn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements the method for the net.PacketConn interface.
+func (mp *MultiPeer) SetReadDeadline(t time.Time) error {
+	mp.l.Lock()
+	defer mp.l.Unlock()
+	mp.readDeadline = t
+	if mp.kicks > 0 {
+		// the deadline will be applied once the realm being bootstrapped is
+		// done with the connection.
+		return nil
+	}
+	return mp.mconn.SetReadDeadline(t)
+}
+
+// dispatch passes the packet to the realm it is meant for, if it is a bonfire
+// message for any of them, returning true if so.
+func (mp *MultiPeer) dispatch(b []byte, addr net.Addr) bool {
+	mp.l.RLock()
+	defer mp.l.RUnlock()
+	for _, peer := range mp.realms {
+		if peer == nil {
+			continue
+		} else if msg, ok := peer.bonfireMessage(b); ok {
+			peer.l.Lock()
+			peer.processMessage(addr, msg)
+			peer.l.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// acceptApp returns whether an application packet from the given address
+// should be passed on, which is the case if any realm's Peer would do so.
+func (mp *MultiPeer) acceptApp(addr net.Addr) bool {
+	mp.l.RLock()
+	defer mp.l.RUnlock()
+	for _, peer := range mp.realms {
+		if peer != nil && peer.acceptApp(addr) {
+			return true
+		}
+	}
+	return len(mp.realms) == 0
+}
+
+// routeProtocol passes the packet to the first realm which has registered its
+// protocol, returning true if there is one.
+func (mp *MultiPeer) routeProtocol(b []byte, addr net.Addr) bool {
+	mp.l.RLock()
+	defer mp.l.RUnlock()
+	for _, peer := range mp.realms {
+		if peer != nil && peer.routeProtocol(b, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadFrom implements the method for the net.PacketConn interface. It works
+// like Peer's ReadFrom, processing bonfire messages for all realms and passing
+// on other packets to the caller.
+//
+// The length of the passed in b must be at least MaxMessageSize.
+func (mp *MultiPeer) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(b) < MaxMessageSize {
+		return 0, nil, errors.New("length of []byte passed into ReadFrom must be at least bonfire.MaxMessageSize")
+	}
+
+	for {
+		mp.readL.Lock()
+		n, addr, err := mp.mconn.ReadFrom(b)
+		mp.readL.Unlock()
+		if err != nil && mp.kicked(err) {
+			continue
+		} else if err != nil {
+			return n, addr, err
+		}
+
+		if mp.dispatch(b[:n], addr) {
+			continue
+		} else if !mp.acceptApp(addr) {
+			continue
+		} else if mp.routeProtocol(b[:n], addr) {
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+// Close closes the Peers of all realms, and then the underlying PacketConn.
+func (mp *MultiPeer) Close() error {
+	mp.l.Lock()
+	if mp.closed {
+		mp.l.Unlock()
+		return errors.New("bonfire.MultiPeer already closed")
+	}
+	mp.closed = true
+	realms := make([]*Peer, 0, len(mp.realms))
+	for _, peer := range mp.realms {
+		if peer != nil {
+			realms = append(realms, peer)
+		}
+	}
+	mp.l.Unlock()
+
+	for _, peer := range realms {
+		peer.Close()
+	}
+	return mp.mconn.Close()
+}
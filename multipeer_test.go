@@ -0,0 +1,106 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestMultiPeer(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	startServer := func() string {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go NewServer().Serve(ctx, conn)
+		return conn.LocalAddr().String()
+	}
+	serverAddrA, serverAddrB := startServer(), startServer()
+
+	peerOpts := &PeerOpts{InitTimeoutUntilGateway: -1}
+
+	mp, err := NewMultiPeer("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mp.Close()
+
+	realmA, err := mp.AddRealm(ctx, "a", serverAddrA, peerOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read from the MultiPeer forever, passing back app packets
+	appCh := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, MaxMessageSize)
+		for {
+			n, _, err := mp.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			appCh <- append([]byte(nil), b[:n]...)
+		}
+	}()
+
+	// adding a realm while ReadFrom is blocked should work
+	realmB, err := mp.AddRealm(ctx, "b", serverAddrB, peerOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mp.AddRealm(ctx, "b", serverAddrB, peerOpts)
+	massert.Require(t,
+		massert.Not(massert.Nil(err)),
+		massert.Equal(mp.LocalAddr().String(), realmA.RemoteAddr().String()),
+		massert.Equal(mp.LocalAddr().String(), realmB.RemoteAddr().String()),
+		massert.Equal(true, realmB == mp.Realm("b")),
+	)
+
+	// give the servers a chance to process the ReadyToMingle messages, then
+	// have a new peer join realm a. The MultiPeer should receive the Meet and
+	// introduce itself.
+	time.Sleep(250 * time.Millisecond)
+	peer, err := NewPeer(ctx, "udp", serverAddrA, &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		ListenAddr:              "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	b := make([]byte, MaxMessageSize)
+	peer.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	peer.ReadFrom(b)
+	peerAddrs := peer.PeerAddrs()
+	massert.Require(t,
+		massert.Length(peerAddrs, 1),
+		massert.Equal(mp.LocalAddr().String(), peerAddrs[0].String()),
+	)
+
+	// app packets should be passed through
+	bExp := mrand.Bytes(100)
+	if _, err := peer.WriteTo(bExp, mp.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-appCh:
+		massert.Require(t, massert.Equal(bExp, b))
+	case <-time.After(time.Second):
+		t.Fatal("app packet not received")
+	}
+
+	// removing a realm should close its Peer
+	massert.Require(t,
+		massert.Nil(mp.RemoveRealm("b")),
+		massert.Nil(mp.Realm("b")),
+		massert.Not(massert.Nil(realmB.Close())),
+	)
+}
@@ -1,20 +1,330 @@
 package bonfire
 
-import "net"
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
 
-func multiSend(dst net.Addr, conn net.PacketConn, n int, msg Message) error {
-	b, err := msg.MarshalBinary()
+// msgBufPool holds buffers large enough to marshal any Message into, so that
+// sending doesn't need to allocate.
+var msgBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, MaxMessageSize)
+		return &b
+	},
+}
+
+// errReusePortUnsupported is returned when creating a socket with SO_REUSEPORT
+// on a platform which doesn't have it.
+var errReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+// listenPacket is like net.ListenPacket, but optionally sets SO_REUSEPORT on
+// the socket prior to binding it.
+func listenPacket(network, addr string, reusePort bool) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.ListenPacket(context.Background(), network, addr)
+}
+
+// wrapConn passes the PacketConn through fn (see PeerOpts' and Server's
+// WrapConn), if fn is set, closing the PacketConn if fn fails.
+func wrapConn(fn func(net.PacketConn) (net.PacketConn, error), conn net.PacketConn) (net.PacketConn, error) {
+	if fn == nil {
+		return conn, nil
+	}
+	wrapped, err := fn(conn)
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
+	return wrapped, nil
+}
 
-	// This doesn't use a write timeout, because it ought to happen within a
-	// go-routine separate from the message processing, and writing should never
-	// really block anyway.
-	for i := 0; i < n; i++ {
-		if _, err := conn.WriteTo(b, dst); err != nil {
+// outPacket is a single packet waiting to be written to its destination.
+type outPacket struct {
+	b   []byte
+	dst net.Addr
+}
+
+// SendFailure describes a destination which a packet couldn't be written to.
+type SendFailure struct {
+	Addr net.Addr
+	Err  error
+}
+
+// SendError is returned when sending to multiple destinations and one or more
+// of them couldn't be written to. Destinations which aren't included were
+// written to successfully.
+type SendError []SendFailure
+
+func (e SendError) Error() string {
+	strs := make([]string, len(e))
+	for i, f := range e {
+		strs[i] = fmt.Sprintf("writing to %v: %s", f.Addr, f.Err)
+	}
+	return strings.Join(strs, "; ")
+}
+
+// Unwrap returns the errors of all failed destinations.
+func (e SendError) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i := range e {
+		errs[i] = e[i].Err
+	}
+	return errs
+}
+
+// batchWriter is implemented by PacketConns which are able to write multiple
+// packets in a single operation. writeBatch returns the number of packets
+// written; if this is less than len(pkts) then the error describes why the
+// next packet couldn't be written.
+type batchWriter interface {
+	writeBatch(pkts []outPacket) (int, error)
+}
+
+// writePackets writes the packets to the PacketConn, using the most efficient
+// method available for it. It has the same semantics as batchWriter.
+func writePackets(conn net.PacketConn, pkts []outPacket) (int, error) {
+	switch conn := conn.(type) {
+	case batchWriter:
+		return conn.writeBatch(pkts)
+	case *net.UDPConn:
+		return writeBatchUDP(conn, pkts)
+	default:
+		return writeEach(conn, pkts)
+	}
+}
+
+// writeSegments works like writePackets, but uses UDP segmentation offload
+// where it's supported (see Server's SegmentOffload), falling back to
+// writePackets otherwise. family is that of the conn's socket, or 0 if it
+// isn't known.
+func writeSegments(conn net.PacketConn, family int, pkts []outPacket) (int, error) {
+	if conn, ok := conn.(*net.UDPConn); ok {
+		return writeSegmentsUDP(conn, family, pkts)
+	}
+	return writePackets(conn, pkts)
+}
+
+func writeEach(conn net.PacketConn, pkts []outPacket) (int, error) {
+	for i, pkt := range pkts {
+		if _, err := conn.WriteTo(pkt.b, pkt.dst); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
+// readBatchSize is the number of packets which a Server will attempt to read
+// in a single operation.
+const readBatchSize = 16
+
+// inPacket is a buffer which a single packet may be read into. Once read, n is
+// the size of the packet and src is where it came from.
+type inPacket struct {
+	b   []byte
+	n   int
+	src net.Addr
+}
+
+// batchReader is implemented by PacketConns which are able to read multiple
+// packets in a single operation. readBatch blocks until at least one packet
+// is available, and returns the number of packets read.
+type batchReader interface {
+	readBatch(pkts []inPacket) (int, error)
+}
+
+// readPackets reads packets from the PacketConn, using the most efficient
+// method available for it. It has the same semantics as batchReader.
+func readPackets(conn net.PacketConn, pkts []inPacket) (int, error) {
+	switch conn := conn.(type) {
+	case batchReader:
+		return conn.readBatch(pkts)
+	case *net.UDPConn:
+		return readBatchUDP(conn, pkts)
+	default:
+		return readOne(conn, pkts)
+	}
+}
+
+func readOne(conn net.PacketConn, pkts []inPacket) (int, error) {
+	n, src, err := conn.ReadFrom(pkts[0].b)
+	if err != nil {
+		return 0, err
+	}
+	pkts[0].n, pkts[0].src = n, src
+	return 1, nil
+}
+
+// sendBatch collects marshaled messages for any number of destinations, so
+// that they can be written together rather than one WriteTo at a time.
+// Marshaling is done into buffers from msgBufPool, which are returned to it
+// once the batch is flushed.
+type sendBatch struct {
+	conn net.PacketConn
+	bufs []*[]byte
+	pkts []outPacket
+
+	// if greater than 0, messages are padded to this size when added.
+	padTo int
+
+	// if true, messages are given a Timestamp when added, unless signed.
+	stamp bool
+
+	// if set, messages are given this InstanceID when added, unless signed.
+	instanceID []byte
+
+	// if set, messages are signed with this key when added, unless already
+	// signed. They're stamped and padded first, so that the signature covers
+	// those too.
+	signKey ed25519.PrivateKey
+
+	// if true, copies of a message are written using UDP segmentation
+	// offload, where it's supported.
+	segment bool
+
+	// if set, the address family of conn's socket, which segmentation offload
+	// would otherwise look up on every flush. See sockFamily.
+	family int
+
+	// if set, used in place of time.Now when stamping and signing messages.
+	now func() time.Time
+
+	// if set, called for every message added.
+	onAdd func(dst net.Addr, typ MessageType)
+}
+
+func newSendBatch(conn net.PacketConn) *sendBatch {
+	return &sendBatch{conn: conn}
+}
+
+// add marshals the Message and queues it to be written to dst n times.
+func (sb *sendBatch) add(dst net.Addr, n int, msg Message) error {
+	now := time.Now
+	if sb.now != nil {
+		now = sb.now
+	}
+	if sb.stamp && len(msg.Signature) == 0 {
+		msg.Timestamp = now()
+	}
+	if sb.instanceID != nil && len(msg.Signature) == 0 {
+		msg.InstanceID = sb.instanceID
+	}
+	if sb.signKey != nil && len(msg.Signature) == 0 {
+		if sb.padTo > 0 {
+			msg.padTo(sb.padTo - signatureExtSize)
+		}
+		if err := msg.signAt(sb.signKey, now()); err != nil {
 			return err
 		}
+	} else if sb.padTo > 0 {
+		msg.padTo(sb.padTo)
+	}
+
+	bp := msgBufPool.Get().(*[]byte)
+	b, err := msg.AppendBinary((*bp)[:0])
+	if err != nil {
+		msgBufPool.Put(bp)
+		return err
+	}
+	sb.bufs = append(sb.bufs, bp)
+	if sb.onAdd != nil {
+		sb.onAdd(dst, msg.Type)
+	}
+	for i := 0; i < n; i++ {
+		sb.pkts = append(sb.pkts, outPacket{b: b, dst: dst})
+	}
+	return nil
+}
+
+// addRaw queues the already marshaled packet to be written to dst. The packet
+// must not be modified until the batch is flushed.
+func (sb *sendBatch) addRaw(dst net.Addr, b []byte) {
+	sb.pkts = append(sb.pkts, outPacket{b: b, dst: dst})
+}
+
+// flush writes all queued packets. Failing to write to one destination doesn't
+// prevent the others from being written to; if any fail a SendError is
+// returned.
+//
+// This doesn't use a write timeout, because it ought to happen within a
+// go-routine separate from the message processing, and writing should never
+// really block anyway.
+func (sb *sendBatch) flush() error {
+	defer sb.release()
+
+	var sendErr SendError
+	pkts := sb.pkts
+	for len(pkts) > 0 {
+		var n int
+		var err error
+		if sb.segment {
+			n, err = writeSegments(sb.conn, sb.family, pkts)
+		} else {
+			n, err = writePackets(sb.conn, pkts)
+		}
+		if pkts = pkts[n:]; err == nil {
+			continue
+		} else if len(pkts) == 0 {
+			// shouldn't happen, but the error shouldn't be lost if it does.
+			sendErr = append(sendErr, SendFailure{Err: err})
+			break
+		}
+
+		// all copies of a message are queued together, so skip the remaining
+		// copies for the failed destination.
+		dst := pkts[0].dst
+		sendErr = append(sendErr, SendFailure{Addr: dst, Err: err})
+		for len(pkts) > 0 && pkts[0].dst == dst {
+			pkts = pkts[1:]
+		}
+	}
+
+	if len(sendErr) > 0 {
+		return sendErr
 	}
 	return nil
 }
+
+// flushAsync works like flush, but performs the writes in a separate
+// go-routine. If errFn is given it will be called with the error returned from
+// flush, if any.
+func (sb *sendBatch) flushAsync(errFn func(error)) {
+	go func() {
+		if err := sb.flush(); err != nil && errFn != nil {
+			errFn(err)
+		}
+	}()
+}
+
+func (sb *sendBatch) release() {
+	for _, bp := range sb.bufs {
+		msgBufPool.Put(bp)
+	}
+	sb.bufs, sb.pkts = nil, nil
+}
+
+// multiSend adds the Message to the empty batch and flushes it.
+func multiSend(sb *sendBatch, dst net.Addr, n int, msg Message) error {
+	if err := sb.add(dst, n, msg); err != nil {
+		return err
+	}
+	return sb.flush()
+}
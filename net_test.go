@@ -0,0 +1,242 @@
+package bonfire
+
+import (
+	"context"
+	"errors"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestSendBatch(t *T) {
+	listen := func(network, addr string) net.PacketConn {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	recvCount := func(conn net.PacketConn, exp []byte) int {
+		var n int
+		b := make([]byte, MaxMessageSize)
+		for {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			l, _, err := conn.ReadFrom(b)
+			if err != nil {
+				return n
+			}
+			massert.Require(t, massert.Equal(exp, b[:l]))
+			n++
+		}
+	}
+
+	msg := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        ReadyToMingle,
+	}
+	expB, err := msg.MarshalBinary()
+	massert.Require(t, massert.Nil(err))
+
+	// a dual-stack socket, which needs IPv4 destinations to be mapped, and an
+	// IPv4-only one.
+	for _, network := range []string{"udp", "udp4"} {
+		recvA := listen("udp4", "127.0.0.1:0")
+		recvB := listen("udp4", "127.0.0.1:0")
+
+		sb := newSendBatch(listen(network, ":0"))
+		massert.Require(t,
+			massert.Nil(sb.add(recvA.LocalAddr(), 3, msg)),
+			massert.Nil(sb.add(recvB.LocalAddr(), 2, msg)),
+		)
+		massert.Require(t, massert.Nil(sb.flush()))
+		massert.Require(t,
+			massert.Equal(3, recvCount(recvA, expB)),
+			massert.Equal(2, recvCount(recvB, expB)),
+		)
+	}
+
+	// a destination which can't be written to shouldn't prevent the others
+	// from being written to.
+	recv := listen("udp4", "127.0.0.1:0")
+	sb := newSendBatch(listen("udp4", "127.0.0.1:0"))
+	massert.Require(t,
+		massert.Nil(sb.add(addrString("[::1]:6666"), 2, msg)),
+		massert.Nil(sb.add(recv.LocalAddr(), 2, msg)),
+	)
+	err = sb.flush()
+	sendErr, ok := err.(SendError)
+	massert.Require(t,
+		massert.Equal(true, ok),
+		massert.Length(sendErr, 1),
+		massert.Equal("[::1]:6666", sendErr[0].Addr.String()),
+		massert.Equal(2, recvCount(recv, expB)),
+	)
+}
+
+func TestSendBatchSegment(t *T) {
+	listen := func(network string) net.PacketConn {
+		conn, err := net.ListenPacket(network, "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	recvAll := func(conn net.PacketConn) map[string]int {
+		got := map[string]int{}
+		b := make([]byte, MaxMessageSize)
+		for {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			l, _, err := conn.ReadFrom(b)
+			if err != nil {
+				return got
+			}
+			got[string(b[:l])]++
+		}
+	}
+
+	msgA := Message{Fingerprint: mrand.Bytes(FingerprintSize), Type: ReadyToMingle}
+	msgB := Message{Fingerprint: mrand.Bytes(FingerprintSize), Type: Seek, SeekBody: SeekBody{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+	}}
+	bA, err := msgA.MarshalBinary()
+	massert.Require(t, massert.Nil(err))
+	bB, err := msgB.MarshalBinary()
+	massert.Require(t, massert.Nil(err))
+
+	recvA, recvB := listen("udp4"), listen("udp4")
+	sb := newSendBatch(listen("udp4"))
+	sb.segment = true
+
+	// more copies than fit in a single segmentation offload send, and
+	// messages of different sizes to the same destination.
+	massert.Require(t,
+		massert.Nil(sb.add(recvA.LocalAddr(), 100, msgA)),
+		massert.Nil(sb.add(recvA.LocalAddr(), 3, msgB)),
+		massert.Nil(sb.add(recvB.LocalAddr(), 1, msgA)),
+		massert.Nil(sb.add(recvB.LocalAddr(), 2, msgB)),
+	)
+	massert.Require(t, massert.Nil(sb.flush()))
+	massert.Require(t,
+		massert.Equal(map[string]int{string(bA): 100, string(bB): 3}, recvAll(recvA)),
+		massert.Equal(map[string]int{string(bA): 1, string(bB): 2}, recvAll(recvB)),
+	)
+}
+
+func TestSendError(t *T) {
+	errA, errB := errors.New("a"), errors.New("b")
+	err := error(SendError{
+		{Addr: addrString("127.0.0.1:1"), Err: errA},
+		{Addr: addrString("127.0.0.1:2"), Err: errB},
+	})
+	massert.Require(t,
+		massert.Equal("writing to 127.0.0.1:1: a; writing to 127.0.0.1:2: b", err.Error()),
+		massert.Equal(true, errors.Is(err, errA)),
+		massert.Equal(true, errors.Is(err, errB)),
+	)
+}
+
+func TestReadPackets(t *T) {
+	// plainConn hides the UDPConn, so that readPackets must fall back to
+	// reading a single packet at a time.
+	type plainConn struct{ net.PacketConn }
+
+	for _, wrap := range []bool{false, true} {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		defer conn.Close()
+
+		sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		defer sender.Close()
+
+		var exp [][]byte
+		for i := 0; i < 5; i++ {
+			b := mrand.Bytes(10 + i)
+			exp = append(exp, b)
+			_, err := sender.WriteTo(b, conn.LocalAddr())
+			massert.Require(t, massert.Nil(err))
+		}
+
+		var readConn net.PacketConn = conn
+		if wrap {
+			readConn = plainConn{conn}
+		}
+
+		pkts := make([]inPacket, 3)
+		for i := range pkts {
+			pkts[i].b = make([]byte, MaxMessageSize)
+		}
+
+		var got [][]byte
+		for len(got) < len(exp) {
+			readConn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := readPackets(readConn, pkts)
+			massert.Require(t, massert.Nil(err))
+			for _, pkt := range pkts[:n] {
+				massert.Require(t,
+					massert.Equal(sender.LocalAddr().String(), pkt.src.String()),
+				)
+				got = append(got, append([]byte(nil), pkt.b[:pkt.n]...))
+			}
+		}
+		massert.Require(t, massert.Equal(exp, got))
+
+		// with nothing to read the deadline should be hit.
+		readConn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err = readPackets(readConn, pkts)
+		massert.Require(t, massert.Equal(true, isTimeout(err)))
+	}
+}
+
+func TestListenReusePort(t *T) {
+	connA, err := listenPacket("udp4", "127.0.0.1:0", true)
+	if errors.Is(err, errReusePortUnsupported) {
+		t.Skip(err)
+	}
+	massert.Require(t, massert.Nil(err))
+	defer connA.Close()
+
+	addr := connA.LocalAddr().String()
+	connB, err := listenPacket("udp4", addr, true)
+	massert.Require(t, massert.Nil(err))
+	defer connB.Close()
+
+	// without the option set on both the port can't be shared.
+	_, err = listenPacket("udp4", addr, false)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+}
+
+func TestPeerNetwork(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	go NewServer().Serve(ctx, conn)
+
+	// the server's hostname is resolved to an IPv4 address, and the Peer's
+	// socket only accepts IPv4.
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	peer, err := NewPeer(ctx, "udp4", net.JoinHostPort("localhost", port), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+	})
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+
+	peer.l.RLock()
+	serverAddr := peer.lastServerAddr.String()
+	peer.l.RUnlock()
+	localAddr := peer.LocalAddr().(*net.UDPAddr)
+	massert.Require(t,
+		massert.Equal(conn.LocalAddr().String(), serverAddr),
+		massert.Not(massert.Nil(localAddr.IP.To4())),
+	)
+
+	_, err = NewPeer(ctx, "tcp", "", nil)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+}
@@ -0,0 +1,95 @@
+package bonfire
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"net"
+	"sync"
+)
+
+// ObfuscatedConn wraps a PacketConn such that every packet written to it is
+// encrypted using AES-GCM, and every packet read from it is decrypted, with
+// packets which can't be decrypted being silently dropped. To an observer the
+// packets are indistinguishable from random data, apart from their size and
+// timing (see PeerOpts' PadMessages).
+//
+// An ObfuscatedConn is intended to be used as the WrapConn of a Peer and its
+// Server, all using the same key. Each packet carries an extra
+// ObfuscatedConnOverhead bytes.
+type ObfuscatedConn struct {
+	net.PacketConn
+	aead    cipher.AEAD
+	bufPool sync.Pool
+}
+
+// ObfuscatedConnOverhead is the number of bytes which an ObfuscatedConn adds to
+// each packet: a random nonce and an authentication tag.
+const ObfuscatedConnOverhead = 12 + 16
+
+// NewObfuscatedConn wraps the PacketConn in an ObfuscatedConn, which uses the
+// given AES key (16, 24 or 32 bytes long).
+func NewObfuscatedConn(conn net.PacketConn, key []byte) (*ObfuscatedConn, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &ObfuscatedConn{PacketConn: conn, aead: aead}, nil
+}
+
+// getBuf returns a buffer with room for a packet of the given size, along with
+// the overhead.
+func (c *ObfuscatedConn) getBuf(size int) *[]byte {
+	bp, _ := c.bufPool.Get().(*[]byte)
+	if bp == nil || cap(*bp) < size+ObfuscatedConnOverhead {
+		b := make([]byte, size+ObfuscatedConnOverhead)
+		bp = &b
+	}
+	*bp = (*bp)[:size+ObfuscatedConnOverhead]
+	return bp
+}
+
+// ReadFrom implements the method for the net.PacketConn interface. Packets
+// which can't be decrypted are dropped, and reading continues with the next.
+func (c *ObfuscatedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	bp := c.getBuf(len(b))
+	defer c.bufPool.Put(bp)
+	nonceSize := c.aead.NonceSize()
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(*bp)
+		if err != nil {
+			return 0, addr, err
+		} else if n < ObfuscatedConnOverhead {
+			continue
+		}
+
+		// the buffer has room for len(b) bytes of plaintext, so opening into
+		// b never needs to grow it.
+		nonce, ciphertext := (*bp)[:nonceSize], (*bp)[nonceSize:n]
+		plaintext, err := c.aead.Open(b[:0], nonce, ciphertext, nil)
+		if err != nil {
+			continue
+		}
+		return len(plaintext), addr, nil
+	}
+}
+
+// WriteTo implements the method for the net.PacketConn interface.
+func (c *ObfuscatedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	bp := c.getBuf(len(b))
+	defer c.bufPool.Put(bp)
+	nonceSize := c.aead.NonceSize()
+	nonce := (*bp)[:nonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	packet := c.aead.Seal(nonce, nonce, b, nil)
+	if _, err := c.PacketConn.WriteTo(packet, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,120 @@
+package bonfire
+
+import (
+	"bytes"
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestObfuscatedConn(t *T) {
+	key := mrand.Bytes(16)
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	obfuscate := func(conn net.PacketConn) *ObfuscatedConn {
+		oc, err := NewObfuscatedConn(conn, key)
+		massert.Require(t, massert.Nil(err))
+		return oc
+	}
+
+	a, b, raw := obfuscate(listen()), obfuscate(listen()), listen()
+	b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	raw.SetReadDeadline(time.Now().Add(2 * time.Second))
+	bExp := mrand.Bytes(100)
+
+	// what's written to the network shouldn't contain the plaintext
+	n, err := a.WriteTo(bExp, raw.LocalAddr())
+	massert.Require(t, massert.Nil(err), massert.Equal(len(bExp), n))
+	rawB := make([]byte, 200)
+	n, _, err = raw.ReadFrom(rawB)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(len(bExp)+ObfuscatedConnOverhead, n),
+		massert.Equal(false, bytes.Contains(rawB[:n], bExp[:16])),
+	)
+
+	// packets which weren't obfuscated with the key are dropped
+	_, err = raw.WriteTo(bExp, b.LocalAddr())
+	massert.Require(t, massert.Nil(err))
+	other, err := NewObfuscatedConn(listen(), mrand.Bytes(16))
+	massert.Require(t, massert.Nil(err))
+	_, err = other.WriteTo(bExp, b.LocalAddr())
+	massert.Require(t, massert.Nil(err))
+	_, err = a.WriteTo(bExp, b.LocalAddr())
+	massert.Require(t, massert.Nil(err))
+
+	buf := make([]byte, 200)
+	n, addr, err := b.ReadFrom(buf)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(a.LocalAddr().String(), addr.String()),
+		massert.Equal(bExp, buf[:n]),
+	)
+}
+
+func TestPeerWrapConn(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key := mrand.Bytes(16)
+	wrapConn := func(conn net.PacketConn) (net.PacketConn, error) {
+		return NewObfuscatedConn(conn, key)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	server.WrapConn = wrapConn
+	go server.Serve(ctx, conn)
+	serverAddr := conn.LocalAddr().String()
+
+	newPeer := func(wrapConn func(net.PacketConn) (net.PacketConn, error)) (*Peer, error) {
+		peer, err := NewPeer(ctx, "udp", serverAddr, &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			HelloWaitTimeout:        500 * time.Millisecond,
+			ListenAddr:              "127.0.0.1:0",
+			WrapConn:                wrapConn,
+		})
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() { peer.Close() })
+		peer.SetReadDeadline(time.Time{})
+		go func() {
+			b := make([]byte, MaxMessageSize)
+			for {
+				if _, _, err := peer.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+		return peer, nil
+	}
+
+	peerA, err := newPeer(wrapConn)
+	massert.Require(t, massert.Nil(err))
+	for len(server.Minglers()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	peerB, err := newPeer(wrapConn)
+	massert.Require(t, massert.Nil(err))
+
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	massert.Require(t, massert.Nil(peerB.WaitForPeers(waitCtx, 1)))
+	massert.Require(t,
+		massert.Equal(peerA.LocalAddr().String(), peerB.PeerAddrs()[0].String()),
+	)
+
+	// a peer which doesn't obfuscate its traffic can't talk to the server
+	_, err = newPeer(nil)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+}
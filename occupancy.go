@@ -0,0 +1,168 @@
+package bonfire
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxIPLimits is the number of IPs which an ipLimiter will track at once. Once
+// reached, IPs which aren't already tracked are refused until older entries
+// can be pruned.
+const maxIPLimits = 4096
+
+// ipLimiter tracks when a response was last sent to each IP, e.g. answering
+// an Occupancy query, so that each IP is responded to at most once per
+// interval.
+type ipLimiter struct {
+	l sync.Mutex
+	m map[string]time.Time
+}
+
+// allow returns whether the given IP should be responded to, and if so records
+// it as having been.
+func (ol *ipLimiter) allow(ip string, now time.Time, interval time.Duration) bool {
+	ol.l.Lock()
+	defer ol.l.Unlock()
+
+	if last, ok := ol.m[ip]; ok && now.Sub(last) < interval {
+		return false
+	} else if !ok && len(ol.m) >= maxIPLimits {
+		ol.pruneLocked(now.Add(-interval))
+		if len(ol.m) >= maxIPLimits {
+			return false
+		}
+	}
+
+	if ol.m == nil {
+		ol.m = map[string]time.Time{}
+	}
+	ol.m[ip] = now
+	return true
+}
+
+// prune forgets all IPs which were last responded to prior to the given time.
+func (ol *ipLimiter) prune(t time.Time) {
+	ol.l.Lock()
+	defer ol.l.Unlock()
+	ol.pruneLocked(t)
+}
+
+func (ol *ipLimiter) pruneLocked(t time.Time) {
+	for ip, last := range ol.m {
+		if last.Before(t) {
+			delete(ol.m, ip)
+		}
+	}
+}
+
+// Occupancy returns the number of peers currently ready-to-mingle using the
+// given rendezvous key, which is nil for peers not using one. Occupancy
+// messages from peers are answered using this.
+func (s *Server) Occupancy(rendezvous []byte) int {
+	z := s.mingleZSets.get(rendezvous)
+	if z == nil {
+		return 0
+	}
+	return z.count(s.now().Add(-s.Config().ReadyToMingleTimeout))
+}
+
+// occupancyAllowed returns whether an Occupancy message from the given address
+// should be answered, according to the Server's OccupancyCheck and
+// OccupancyInterval.
+func (s *Server) occupancyAllowed(msg Message, src net.Addr, cfg ServerConfig) bool {
+	if s.OccupancyCheck != nil && !s.OccupancyCheck(msg.Fingerprint) {
+		return false
+	}
+	ipStr := src.String()
+	if ip := addrIP(src); ip != nil {
+		ipStr = ip.String()
+	}
+	return s.occupancyLimits.allow(ipStr, s.now(), cfg.OccupancyInterval)
+}
+
+// Occupancy asks the server how many peers are currently ready-to-mingle using
+// the given rendezvous (see PeerOpts' Rendezvous), which need not be the one
+// the Peer itself is using. This allows an application to show how many
+// peers are online before joining them. The empty rendezvous refers to all
+// peers which don't use one.
+//
+// An error is returned if the Context is done before the server answers.
+// Servers only answer a limited number of queries from each IP, and may be
+// configured to only answer certain peers, in which case they don't answer at
+// all. Servers which predate Occupancy don't answer either.
+//
+// As with WaitForPeers, ReadFrom must be called in order for the answer to be
+// processed.
+func (p *Peer) Occupancy(ctx context.Context, rendezvous string) (int, error) {
+	key := rendezvousKey(rendezvous)
+	ch := make(chan uint32, 1)
+
+	p.l.Lock()
+	if p.serverAddrStr == "" {
+		p.l.Unlock()
+		return 0, errors.New("a server address is required to query Occupancy")
+	}
+	serverAddr, err := p.serverAddr()
+	if err != nil {
+		p.l.Unlock()
+		return 0, err
+	}
+
+	if p.occupancyChs == nil {
+		p.occupancyChs = map[string][]chan uint32{}
+	}
+	p.occupancyChs[string(key)] = append(p.occupancyChs[string(key)], ch)
+	defer p.removeOccupancyCh(key, ch)
+
+	err = multiSend(p.newSendBatch(), serverAddr, p.po.PacketBlastCount, Message{
+		Fingerprint: p.lastFingerprint,
+		Type:        Occupancy,
+		Rendezvous:  key,
+	})
+	p.l.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case minglers := <-ch:
+		return int(minglers), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-p.closeCh:
+		return 0, errors.New("bonfire.Peer is closed")
+	}
+}
+
+func (p *Peer) removeOccupancyCh(key []byte, ch chan uint32) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	chs := p.occupancyChs[string(key)]
+	for i := range chs {
+		if chs[i] == ch {
+			chs = append(chs[:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(chs) == 0 {
+		delete(p.occupancyChs, string(key))
+	} else {
+		p.occupancyChs[string(key)] = chs
+	}
+}
+
+// processOccupancy passes an Occupancy message from the server on to all calls
+// to Occupancy which are waiting on its rendezvous key.
+//
+// This must be called with the lock held.
+func (p *Peer) processOccupancy(msg Message) {
+	for _, ch := range p.occupancyChs[string(msg.Rendezvous)] {
+		select {
+		case ch <- msg.OccupancyBody.Minglers:
+		default:
+		}
+	}
+}
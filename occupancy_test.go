@@ -0,0 +1,94 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerOccupancy(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	go server.Serve(ctx, conn)
+	serverAddr := conn.LocalAddr().String()
+
+	newPeer := func(rendezvous string, declineIntroductions bool) *Peer {
+		peer, err := NewPeer(ctx, "udp", serverAddr, &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			PacketBlastCount:        1,
+			ListenAddr:              "127.0.0.1:0",
+			Rendezvous:              rendezvous,
+			DeclineIntroductions:    declineIntroductions,
+		})
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { peer.Close() })
+		peer.SetReadDeadline(time.Time{})
+		go func() {
+			b := make([]byte, MaxMessageSize)
+			for {
+				if _, _, err := peer.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+		return peer
+	}
+
+	newPeer("a", false)
+	newPeer("a", false)
+	querier := newPeer("", true)
+	for server.Occupancy(rendezvousKey("a")) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	query := func(rendezvous string, timeout time.Duration) (int, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return querier.Occupancy(ctx, rendezvous)
+	}
+
+	n, err := query("a", 2*time.Second)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(2, n),
+	)
+
+	// the server won't answer again within OccupancyInterval
+	_, err = query("b", 200*time.Millisecond)
+	massert.Require(t, massert.Equal(context.DeadlineExceeded, err))
+
+	cfg := server.Config()
+	cfg.OccupancyInterval = time.Millisecond
+	server.UpdateConfig(cfg)
+	n, err = query("b", 2*time.Second)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(0, n),
+		massert.Equal(uint64(2), server.Stats().Occupancies),
+		massert.Equal(uint64(1), server.Stats().PacketsDropped),
+	)
+}
+
+func TestIPLimiter(t *T) {
+	var ol ipLimiter
+	now := time.Now()
+	massert.Require(t,
+		massert.Equal(true, ol.allow("1.1.1.1", now, time.Second)),
+		massert.Equal(false, ol.allow("1.1.1.1", now.Add(500*time.Millisecond), time.Second)),
+		massert.Equal(true, ol.allow("2.2.2.2", now, time.Second)),
+		massert.Equal(true, ol.allow("1.1.1.1", now.Add(time.Second), time.Second)),
+	)
+
+	ol.prune(now.Add(time.Millisecond))
+	massert.Require(t,
+		massert.Equal(1, len(ol.m)),
+		massert.Equal(true, ol.allow("2.2.2.2", now, time.Second)),
+	)
+}
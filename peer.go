@@ -1,16 +1,21 @@
 package bonfire
 
 import (
-	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	nat "github.com/mediocregopher/go-nat"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PeerOpts are passed to the NewPeer function to affect the Peer's behavior.
@@ -27,6 +32,37 @@ type PeerOpts struct {
 	// attempted.
 	InitTimeoutUntilGateway time.Duration
 
+	// The time NewPeer will wait for HelloPeer messages on any attempt which
+	// isn't limited by InitTimeoutUntilGateway, i.e. the attempt made after a
+	// port has been forwarded on the NAT gateway, or the only attempt if
+	// InitTimeoutUntilGateway is -1. If 0 (the default) these attempts are
+	// only limited by TotalBootstrapTimeout and the Context passed to NewPeer.
+	HelloWaitTimeout time.Duration
+
+	// The time NewPeer will spend discovering the NAT gateway, when falling
+	// back to it. If 0 (the default) this is only limited by
+	// TotalBootstrapTimeout and the Context passed to NewPeer.
+	GatewayDiscoveryTimeout time.Duration
+
+	// The total time NewPeer may take, including StartJitter and all of the
+	// above, after which it returns context.DeadlineExceeded. If 0 (the
+	// default) this is only limited by the Context passed to NewPeer.
+	TotalBootstrapTimeout time.Duration
+
+	// If true, NewPeer starts discovering the NAT gateway at the same time as
+	// it first contacts the server, rather than once InitTimeoutUntilGateway
+	// has passed, so that no further time is spent on discovery if it has to
+	// fall back to the gateway. If no fallback is needed the discovery is
+	// abandoned. GatewayDiscoveryTimeout applies from when discovery starts.
+	ParallelGatewayDiscovery bool
+
+	// If set, the Peer will only be introduced to other peers using the same
+	// Rendezvous, and vice-versa, allowing a single server to host many
+	// separate groups of peers (e.g. one per room or per file). Only a hash of
+	// the Rendezvous is sent to the server. Servers which predate this option
+	// will ignore it, and introduce the Peer to any other.
+	Rendezvous string
+
 	// When a port mapping is created on a NAT gateway for this peer, this
 	// timeout will be used as the expiration for that mapping on the gateway
 	// and to determine how often to refresh that mapping (so it doesn't expire
@@ -41,6 +77,11 @@ type PeerOpts struct {
 	// means any IP address over a randomly picked port.
 	ListenAddr string
 
+	// If true, the UDP port is created with SO_REUSEPORT set, so that other
+	// sockets (with the option also set) may bind to the same ListenAddr.
+	// NewPeer will return an error on platforms where this isn't supported.
+	ReusePort bool
+
 	// MaxPeers indicates the maximum number of peers to keep track of (i.e.,
 	// maximum number which will be returned from PeerAddrs). Default is 10.
 	MaxPeers int
@@ -49,13 +90,334 @@ type PeerOpts struct {
 	// the Peer. A fingerprint must be exactly FingerprintSize bytes. See
 	// Server's FingerprintCheck field for an example of how this might be used.
 	FingerprintFunc func() ([]byte, error)
+
+	// If true, application packets (i.e. those which aren't bonfire messages)
+	// will be dropped by ReadFrom unless they come from an address in the
+	// current set of peers (see PeerAddrs), or AcceptFrom returns true for the
+	// address.
+	AcceptFromKnownPeersOnly bool
+
+	// AcceptFrom is an optional allowlist which is consulted when
+	// AcceptFromKnownPeersOnly is set and an application packet arrives from
+	// an address which isn't a known peer.
+	AcceptFrom func(net.Addr) bool
+
+	// AcceptPeer is an optional hook which is consulted before the Peer sends
+	// HelloPeer messages in response to a Meet (or a greeting, see
+	// AcceptGreetings), and before it adds the sender of a HelloPeer to its
+	// set of peers. If it returns false the introduction is ignored, and
+	// PeerEventPeerRejected is emitted. The fingerprint is that of the peer
+	// being introduced by a Meet, or of the greeting's sender. For a HelloPeer
+	// it's the fingerprint given by the Meet which introduced its sender, if
+	// the Peer received one recently, and nil otherwise. AcceptPeer is called
+	// with the Peer's lock held, and so must not call any methods on the Peer.
+	AcceptPeer func(addr net.Addr, fingerprint []byte) bool
+
+	// The interval on which the Peer checks whether the host's set of network
+	// interface addresses has changed, in which case it will call Migrate. The
+	// Peer will also migrate if it encounters a socket error, but not more
+	// often than this interval. If 0 (the default) the Peer will never
+	// migrate on its own.
+	MigrateCheckInterval time.Duration
+
+	// OnMigrate is an optional callback which is called, in its own
+	// go-routine, once the Peer has migrated and has learned its new remote
+	// address.
+	OnMigrate func(oldRemoteAddr, newRemoteAddr net.Addr)
+
+	// If set, the Peer will act if it hasn't read any packet for this long,
+	// as might happen if its socket has silently stopped working. The Peer
+	// first sends a probe packet to itself. If ReadFrom reads it the Peer
+	// re-bootstraps, and otherwise its socket is re-bound, as with Migrate.
+	// PeerEventWatchdog is emitted either way. A Peer in contact with the
+	// server and its peers reads packets regularly, but this should still be
+	// several times ReadyToMingleInterval. If 0 (the default) the watchdog is
+	// disabled. It isn't used by the realms of a MultiPeer.
+	WatchdogTimeout time.Duration
+
+	// If true the Peer will advertise all addresses it might be reachable at
+	// (see Message's Candidates field) to the server and to peers it says
+	// hello to, so that peers on the same local network can communicate
+	// directly rather than through their NAT. Servers and peers which predate
+	// this option will not understand messages which include candidates.
+	AdvertiseCandidates bool
+
+	// If set, the external address ("host:port") which the Peer is reachable
+	// at, for deployments where a port has been forwarded to it manually on its
+	// NAT. The Peer doesn't attempt to discover a NAT gateway (as though
+	// InitTimeoutUntilGateway were -1), and advertises the address to other
+	// peers as a candidate, even if AdvertiseCandidates isn't set (so the same
+	// caveat about servers and peers which predate that applies). It's
+	// verified against the address the server observes the Peer at, see
+	// PeerEventAdvertiseAddrMismatch.
+	AdvertiseAddr string
+
+	// If set, the addresses which the Peer had when it was last run, as
+	// returned by its CachedAddrs method and persisted by the application. If
+	// the Peer's socket has the same local port as it had then, RemoteAddr
+	// returns the cached remote address until the server or another peer
+	// reports the Peer's address, so that applications using NewPeerAsync
+	// can advertise a likely-correct address straight away rather than none.
+	// The cached gateway address is advertised as a candidate (see
+	// AdvertiseCandidates) while bootstrapping, since the gateway may still
+	// have the mapping.
+	CachedAddrs CachedAddrs
+
+	// If true, the candidates of other peers which are private or otherwise
+	// not publicly routable (see IsBogon) are only sent HelloPeer messages if
+	// they're within the network of one of the host's interfaces, and only
+	// after all other candidates. Peers behind broken NATs sometimes advertise
+	// such addresses, which would otherwise cause this Peer to send packets to
+	// unrelated hosts on its own network. See also Server's FilterBogons.
+	FilterBogonCandidates bool
+
+	// ServerAddrTTL determines how long a resolved server address is used
+	// before being resolved again. If 0 (the default) the address is resolved
+	// every time a message is sent to the server, in case it is a hostname
+	// whose records have changed. If -1 it is resolved only once.
+	ServerAddrTTL time.Duration
+
+	// Resolver is used to resolve the server's address. Default is
+	// net.DefaultResolver.
+	Resolver *net.Resolver
+
+	// Background events and errors encountered by the Peer will be written
+	// here. If nil or if the channel blocks events will be dropped.
+	EventCh chan<- PeerEvent
+
+	// If set, NewPeer will wait a random amount of time, up to this duration,
+	// before first contacting the server. This is useful when very many peers
+	// are likely to be started at the same moment, so that the server doesn't
+	// receive a synchronized wave of HelloServer messages.
+	StartJitter time.Duration
+
+	// If true, NewPeer will send its initial HelloServer messages one at a
+	// time, only sending the next if no response has been received after a
+	// short wait, rather than sending all PacketBlastCount at once.
+	RampBlastCount bool
+
+	// If true the Peer will not act as an introducer for other peers: it will
+	// never send ReadyToMingle messages, and will ignore any Meet messages it
+	// receives. It will still discover peers for itself. This is useful for
+	// peers which are short-lived or on metered connections. When set
+	// ReadyToMingleInterval is ignored.
+	DeclineIntroductions bool
+
+	// If greater than 0, the Peer will ask the server to send it no more than
+	// this many Meet messages per ReadyToMingleInterval, so that the server
+	// spreads introductions across other peers instead. Servers and peers
+	// which predate this option will not understand the ReadyToMingle
+	// messages it causes to be sent.
+	MaxIntroductions int
+
+	// PrivacyKey enables privacy mode when set. It must be an AES key (16, 24
+	// or 32 bytes long) which is shared by all peers in the network, but not
+	// with the server. In privacy mode:
+	//
+	//	* A fresh fingerprint is used for every HelloServer and ReadyToMingle
+	//	  message, so the server can't link them to each other by
+	//	  fingerprint. See PrivacyFingerprints.
+	//
+	//	* Candidates (see AdvertiseCandidates) are sent to the server only in
+	//	  encrypted form, so that only other peers can read them.
+	//
+	//	* Meet messages are ignored unless they carry data encrypted with the
+	//	  same key, so the server can only introduce peers which are part of
+	//	  the network.
+	//
+	// Servers and peers which predate this option will not understand the
+	// messages it causes to be sent.
+	PrivacyKey []byte
+
+	// The number of the most recent fingerprints used in privacy mode (see
+	// PrivacyKey) which messages are still accepted for. The server may send
+	// a Meet or HelloPeer using any fingerprint it was given up until its
+	// ReadyToMingleTimeout, so this needs to cover every HelloServer and
+	// ReadyToMingle sent within that time. Default is 4, which covers the
+	// default server timeout of 2 minutes at the default
+	// ReadyToMingleInterval, with room for a couple of HelloServer messages.
+	PrivacyFingerprints int
+
+	// If true, every bonfire message sent by the Peer is padded to
+	// MaxMessageSize bytes, so that they can't be told apart from each other
+	// (or identified as bonfire messages) by their size. Padded messages are
+	// always accepted, whether or not this is set. Servers and peers which
+	// predate this option will not understand the messages it causes to be
+	// sent.
+	PadMessages bool
+
+	// If greater than 0, every bonfire message sent by the Peer includes the
+	// time it was sent, and bonfire messages received which don't, or which
+	// were sent more than MaxMessageAge ago (or claim to have been sent more
+	// than MaxMessageAge in the future, to allow for clock skew), are
+	// dropped. This bounds how long captured or delayed messages remain
+	// usable. The server and all other peers must set it as well (see
+	// Server's MaxMessageAge), otherwise their messages will be dropped.
+	MaxMessageAge time.Duration
+
+	// If set, OpenTelemetry spans are recorded for each step of NewPeer's
+	// bootstrap sequence (resolving the server, HelloServer, waiting for
+	// peers, and NAT gateway forwarding), as children of any span in the
+	// Context passed to NewPeer.
+	TracerProvider trace.TracerProvider
+
+	// If set, every packet received or sent by the Peer is written here, along
+	// with the time. The result can be decoded with ReadRecording, and
+	// replayed using a ReplayConn. If writing fails an error event is emitted
+	// (see EventCh) and nothing further is written. This is ignored for
+	// realms of a MultiPeer.
+	RecordWriter io.Writer
+
+	// If set, every PacketConn which the Peer binds (including after a
+	// migration, see Migrate), or which is given to NewPeerConn, is passed
+	// through WrapConn, and the returned PacketConn is used in its place. All
+	// bonfire messages and application packets pass through the wrapper, so it
+	// can be used to obfuscate the Peer's traffic (see NewObfuscatedConn), as
+	// long as the server and all other peers use a matching wrapper (see
+	// Server's WrapConn). If WrapConn returns an error the original
+	// PacketConn is closed.
+	//
+	// Batched reads and writes, and the ICMP reports used by
+	// UnreachableThreshold, depend on the PacketConn being the socket itself,
+	// and so are not available when it's wrapped. This is ignored for realms
+	// of a MultiPeer.
+	WrapConn func(net.PacketConn) (net.PacketConn, error)
+
+	// If greater than 0, the Peer watches for addresses it has sent to being
+	// reported as unreachable, and removes a peer from its set of peers (see
+	// PeerAddrs) once it has been reported this many times without a
+	// HelloPeer message being received from it in between. Reports come from
+	// ICMP port and host unreachable messages on platforms which deliver them
+	// to the socket (currently linux), and from write errors. A
+	// PeerEventUnreachable is emitted for every report. This is ignored for
+	// realms of a MultiPeer.
+	UnreachableThreshold int
+
+	// If greater than 0, the Peer stops sending ReadyToMingle messages to the
+	// server once this many in a row have failed, i.e. sending them errored,
+	// (if UnreachableThreshold is set) the server was reported as
+	// unreachable, or nothing was received from the server before the next
+	// was due. It then waits for a backoff, starting at
+	// ReadyToMingleInterval, before probing the server with a single
+	// ReadyToMingle, doubling the backoff each time the probe fails. Any
+	// message received from the server resets the backoff. See
+	// ServerCircuitState and PeerEventServerCircuitChanged.
+	//
+	// So that a healthy server always sends something, a Probe message is
+	// sent along with each ReadyToMingle, which the server answers. Servers
+	// which predate Probe messages never answer, and so will always be
+	// considered to have failed.
+	ServerFailureThreshold int
+
+	// The longest backoff used once ServerFailureThreshold is reached.
+	// Default is 10 minutes.
+	ServerMaxBackoff time.Duration
+
+	// If set, the Peer joins this multicast group (e.g. "239.255.66.1:6966")
+	// and announces itself to it whenever it would send a HelloServer, in
+	// addition to contacting the server. Peers in the group which hear an
+	// announcement add the announcing peer to their set of peers, and say
+	// hello to it as if the server had introduced them. If NewPeer is given an
+	// empty server address then this is the only way peers are discovered.
+	// This is intended for controlled networks, such as within a cluster. It
+	// is ignored for realms of a MultiPeer.
+	MulticastAddr string
+
+	// The TTL (or hop limit) of multicast announcements, which limits how far
+	// beyond the local network they may travel. Default is 1, i.e. they don't
+	// leave the local network.
+	MulticastTTL int
+
+	// Addresses of peers (e.g. from a list distributed out of band) which the
+	// Peer greets directly whenever it would send a HelloServer, in addition
+	// to contacting the server. A seed peer which has AcceptGreetings set will
+	// add the Peer to its set of peers and say hello to it, as if the server
+	// had introduced them. If NewPeer is given an empty server address then
+	// the seed peers (and multicast, if MulticastAddr is set) are the only way
+	// peers are discovered.
+	SeedPeers []string
+
+	// If true the Peer responds to Greet messages sent by other peers which
+	// have it as one of their SeedPeers. Greet messages can only be recognized
+	// by their type, so application packets which aren't sent using a
+	// registered protocol (see RegisterProtocol) may be mistaken for them.
+	AcceptGreetings bool
+
+	// If non-nil, the Peer performs a handshake with every peer which it adds
+	// to its set of peers, by sending it a Handshake message carrying this
+	// payload, and answers Handshake messages from those peers with a
+	// Handshake carrying it in return. Handshake messages from addresses
+	// which are neither in the set of peers nor recently introduced to the
+	// Peer by a server are ignored. This allows applications to exchange
+	// metadata (e.g. a version) on first contact. It may be at most
+	// MaxHandshakePayloadSize bytes long.
+	//
+	// Handshake messages which aren't answers can only be recognized by their
+	// type, so application packets which aren't sent using a registered
+	// protocol (see RegisterProtocol) may be mistaken for them.
+	HandshakePayload []byte
+
+	// OnPeerHandshake is an optional callback which is called, in its own
+	// go-routine, with the address and payload of each peer which the Peer
+	// completes a handshake with (see HandshakePayload). It is only called
+	// again for the same address if the peer's payload changes, or if the
+	// peer is removed from the set of peers and later added back.
+	OnPeerHandshake func(addr net.Addr, payload []byte)
+
+	// If set, messages from the server are ignored unless they have been
+	// signed using the private key corresponding to this one (see Server's
+	// SigningKey), pinning the server's identity. This covers all messages
+	// which only a server sends (Meet, Busy, Occupancy, Probe, YouAre and
+	// AuthFailed) wherever they come from, so that nobody else can cause the
+	// Peer to send HelloPeer messages, and all messages coming from the
+	// server's address, so that its HelloPeer messages can't be spoofed
+	// either. Servers which predate this option can't sign messages, and
+	// those which predate signing all messages only sign Meet messages.
+	ServerPublicKey ed25519.PublicKey
+
+	// Bonfire messages which the Peer sends in response to messages it
+	// receives (e.g. HelloPeer messages to a newly met peer) are written by a
+	// background go-routine, so that a slow socket doesn't hold up ReadFrom.
+	// This is the maximum number of batches of such messages which may be
+	// waiting to be written; once it's reached the oldest waiting batch is
+	// dropped to make room for each new one (see Stats). Default is 256.
+	//
+	// Packets passed to SendAsync are queued separately, and are limited to
+	// the same number.
+	SendQueueSize int
+
+	// If true, packets passed to WriteTo and Send are queued as if they were
+	// passed to SendAsync, rather than being written before those methods
+	// return, so that a slow or blocked socket doesn't stall the application
+	// loops calling them. WriteTo then always returns len(b) and no error, and
+	// Send no error; errors encountered when writing are emitted as
+	// PeerEventError events instead.
+	QueueSends bool
+
+	// If set, PacketFilter is called with every packet the Peer receives,
+	// before anything else is done with it, and packets for which it returns
+	// VerdictDrop are discarded (see Stats). This allows applications to
+	// cheaply drop unwanted traffic, e.g. from blocked sources or lacking the
+	// expected magic bytes. Bonfire messages pass through the filter too, so
+	// dropping those from the server or other peers will prevent the Peer
+	// from working. The packet must not be retained or modified, and the
+	// filter must not call any methods on the Peer. This is ignored for realms
+	// of a MultiPeer.
+	PacketFilter func(addr net.Addr, b []byte) Verdict
+
+	// If true, the Peer remembers the most recent bonfire messages which it
+	// sent and received, so that they can be included in DebugDump. This adds
+	// to the cost of every message, so should only be set while debugging.
+	DebugMessages bool
 }
 
 func (po PeerOpts) withDefaults() PeerOpts {
 	if po.PacketBlastCount == 0 {
 		po.PacketBlastCount = 3
 	}
-	if po.InitTimeoutUntilGateway == 0 {
+	if po.AdvertiseAddr != "" {
+		po.InitTimeoutUntilGateway = -1
+	} else if po.InitTimeoutUntilGateway == 0 {
 		po.InitTimeoutUntilGateway = 1 * time.Second
 	}
 	if po.GatewayPortMapTimeout == 0 {
@@ -70,6 +432,18 @@ func (po PeerOpts) withDefaults() PeerOpts {
 	if po.MaxPeers == 0 {
 		po.MaxPeers = 10
 	}
+	if po.MulticastTTL == 0 {
+		po.MulticastTTL = 1
+	}
+	if po.SendQueueSize == 0 {
+		po.SendQueueSize = 256
+	}
+	if po.ServerMaxBackoff == 0 {
+		po.ServerMaxBackoff = 10 * time.Minute
+	}
+	if po.PrivacyFingerprints == 0 {
+		po.PrivacyFingerprints = 4
+	}
 	return po
 }
 
@@ -88,130 +462,750 @@ type Peer struct {
 	// Peer wraps a PacketConn, overwriting some of its methods and exposing the
 	// rest.
 	net.PacketConn
+	mconn *migratingConn
+
+	// multi is set if the Peer is a realm of a MultiPeer, in which case the
+	// connection is shared with the MultiPeer's other realms.
+	multi *MultiPeer
 
 	po                     PeerOpts
 	network, serverAddrStr string
 	gw                     nat.NAT
+	gwAddr                 net.Addr
+	gwAddrCached           bool // whether gwAddr came from CachedAddrs
+	advertiseAddr          net.Addr
+	sealer                 *sealer // only set in privacy mode
+	rendezvous             []byte
+	mcastConn              *net.UDPConn
+	mcastAddr              *net.UDPAddr
+	tracer                 trace.Tracer
+
+	// traceCtx is only set during NewPeer, and is used as the parent of spans
+	// created by methods which don't take a Context.
+	traceCtx context.Context
 
 	wg      *sync.WaitGroup
 	closeCh chan bool
 
-	l               sync.RWMutex
-	lastServerAddr  net.Addr
-	lastFingerprint []byte
-	remoteAddr      net.Addr
-	peers           map[string]net.Addr
-	closed          bool
+	// sendq holds batches of messages waiting to be written by
+	// spinSendQueue. If nil they are written in their own go-routine instead.
+	sendq *sendQueue
+
+	stats    peerStats
+	debugLog debugLog
+
+	// wd is only set if PeerOpts' WatchdogTimeout is, see spinWatchdog.
+	wd *watchdog
+
+	// introStart is when the Peer last (re-)bootstrapped, or the zero value
+	// once a handshake has been answered since then. See PeerStats'
+	// HandshakeLatency.
+	introStart time.Time
+
+	// readyCh is closed once the bootstrap sequence has finished.
+	readyCh chan struct{}
+
+	// helloSentCh and helloCh are only set by NewPeerAsync. helloSentCh is
+	// closed once the first hello messages have been sent, and helloCh is
+	// written to (without blocking) by processMessage when it receives a
+	// HelloPeer during the bootstrap sequence.
+	helloSentCh chan struct{}
+	helloCh     chan struct{}
+
+	// reconfigCh is written to (without blocking) by SetOptions, so that
+	// background go-routines pick up the new options.
+	reconfigCh chan struct{}
+
+	// remingleCh is written to (without blocking) when the Peer switches to a
+	// different server, so that a ReadyToMingle is sent to it straight away.
+	remingleCh chan struct{}
+
+	// serverResponded is set once any message has been received from the
+	// server, see BootstrapReport.
+	serverResponded atomic.Bool
+
+	l                sync.RWMutex
+	lastServerAddr   net.Addr
+	lastServerAddrTS time.Time
+	serverBusyUntil  time.Time
+	busyTimer        *time.Timer
+	lastFingerprint  []byte
+	remoteAddr       net.Addr
+	remoteAddrCached bool // whether remoteAddr came from CachedAddrs
+	peers            map[string]net.Addr
+	peersGen         uint64
+	peerChanges      []peerChange
+	protocols        map[ProtocolID]chan<- Packet
+	state            PeerState
+	bootstrapErr     error
+	circuit          serverCircuit
+	serverInstanceID []byte
+	servers          []*PeerServerStats
+	migrating        bool
+	closed           bool
+
+	// privacyFingerprints holds the most recent fingerprints used for
+	// HelloServer and ReadyToMingle messages, if the Peer is in privacy mode.
+	privacyFingerprints [][]byte
+
+	// introductions holds the fingerprints of peers recently introduced by
+	// Meet messages, keyed by each of their addresses. It's only used if
+	// AcceptPeer or HandshakePayload is set.
+	introductions map[string]introduction
+
+	// peerLastSeen and remoteAddrHistory are only used by DebugDump.
+	peerLastSeen      map[string]time.Time
+	remoteAddrHistory []DebugRemoteAddr
+
+	// peersChangedCh, if set, is closed the next time the set of peers
+	// changes. See WaitForPeers.
+	peersChangedCh chan struct{}
+
+	// unreachableCounts holds the number of times each peer has been reported
+	// unreachable since a HelloPeer was last received from it.
+	unreachableCounts map[string]int
+
+	// occupancyChs holds the channels of calls to Occupancy which are waiting
+	// for an answer, keyed by rendezvous key.
+	occupancyChs map[string][]chan uint32
+
+	// remoteAddrVotes holds the remote address which each peer (and the
+	// server) has most recently observed this Peer at, keyed by the address
+	// of the observer. See observeRemoteAddr.
+	remoteAddrVotes map[string]net.Addr
+
+	// peerTags holds the tags given to each peer using TagPeer, keyed by the
+	// peer's address.
+	peerTags map[string]map[string]struct{}
+
+	// handshakes holds the payload most recently passed to OnPeerHandshake for
+	// each address. See processHandshake.
+	handshakes map[string][]byte
+
+	// probeChs holds the channels of calls to ProbeNAT which are waiting for
+	// a Probe response, keyed by the address of the server endpoint probed.
+	probeChs map[string][]chan Message
 }
 
 var errNoHelloPeer = errors.New("no messages from peers or server received")
 
+const (
+	// blastRampInterval is the time waited between HelloServer messages when
+	// RampBlastCount is set.
+	blastRampInterval = 250 * time.Millisecond
+
+	// busyBackoff is the time waited before resending a HelloServer message
+	// after receiving a Busy message from the server, if the message doesn't
+	// indicate a time itself.
+	busyBackoff = 1 * time.Second
+)
+
+// jitter returns a random duration between 0 and 2*d, such that the average is
+// d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(mrand.Int63n(int64(d) * 2))
+}
+
 // NewPeer intializes a *Peer instance and communicates with the server at the
-// given address to discover other peers. The only supported value for network
-// right now is "udp".
+// given address to discover other peers. The network may be "udp", or "udp4"
+// or "udp6" to restrict the Peer to a single address family, both for its
+// socket and when resolving addresses (e.g. the server's).
 //
-// If PeerOpts is nil all default values will be used.
+// The server address may be empty if PeerOpts' SeedPeers or MulticastAddr are
+// set, in which case peers are only discovered using those. NewPeer will then
+// return once a peer has said hello to it, or once InitTimeoutUntilGateway (or
+// HelloWaitTimeout if that is -1, or 1 second if that is also unset) has
+// passed without any doing so, as there may not be any other peers yet.
+//
+// If PeerOpts is nil all default values will be used. An error is returned if
+// any of its fields are invalid.
+//
+// If no other peers could be found then a *BootstrapError is returned,
+// describing which phases of the bootstrap were attempted and, where possible,
+// why they failed (see ErrServerUnreachable, ErrNoIntroductions and
+// ErrGatewayUnavailable).
 //
 // Canceling the context after this function has returned successfully has no
 // effect.
 func NewPeer(ctx context.Context, network, serverAddr string, opts *PeerOpts) (*Peer, error) {
-	if network != "udp" {
-		panic("only network 'udp' is supported by NewPeer")
+	if err := checkNetwork(network); err != nil {
+		return nil, err
 	} else if opts == nil {
 		opts = new(PeerOpts)
 	}
 
-	var err error
+	po := opts.withDefaults()
+	conn, err := listenPacket(network, po.ListenAddr, po.ReusePort)
+	if err != nil {
+		return nil, err
+	}
+	return NewPeerConn(ctx, conn, serverAddr, opts)
+}
+
+// NewPeerConn is like NewPeer, but uses the given PacketConn rather than
+// creating one, in which case ListenAddr is ignored. The Peer takes ownership
+// of the PacketConn, and will close it when the Peer is closed.
+//
+// This is useful for running a Peer over a connection with special behavior,
+// for example a ReplayConn. If the Peer is migrated (see Migrate) the
+// PacketConn is replaced with one bound to ListenAddr.
+func NewPeerConn(ctx context.Context, conn net.PacketConn, serverAddr string, opts *PeerOpts) (*Peer, error) {
+	if opts == nil {
+		opts = new(PeerOpts)
+	}
+	network := conn.LocalAddr().Network()
+	conn, err := wrapConn(opts.WrapConn, conn)
+	if err != nil {
+		return nil, err
+	}
+	return newPeer(ctx, network, serverAddr, *opts, newMigratingConn(conn), nil, false)
+}
+
+// NewPeerAsync is like NewPeer, but returns as soon as the socket has been
+// bound and the server (and seed peers and multicast group, if any) contacted,
+// rather than once a peer has said hello. The rest of the bootstrap sequence
+// continues in the background, and the returned Peer's Ready channel is closed
+// once it has finished. This is useful for applications which mostly serve
+// inbound traffic, and so can start doing so immediately.
+//
+// The Peer relies on ReadFrom to receive the HelloPeer messages which complete
+// the bootstrap, so ReadFrom must be called repeatedly from the moment this
+// returns. If the bootstrap fails the Peer is closed, and the error is
+// available from BootstrapErr.
+//
+// Unlike NewPeer, canceling the context after this function has returned will
+// cancel the remainder of the bootstrap sequence.
+func NewPeerAsync(ctx context.Context, network, serverAddr string, opts *PeerOpts) (*Peer, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	} else if opts == nil {
+		opts = new(PeerOpts)
+	}
+
+	po := opts.withDefaults()
+	conn, err := listenPacket(network, po.ListenAddr, po.ReusePort)
+	if err != nil {
+		return nil, err
+	} else if conn, err = wrapConn(po.WrapConn, conn); err != nil {
+		return nil, err
+	}
+	return newPeer(ctx, network, serverAddr, *opts, newMigratingConn(conn), nil, true)
+}
+
+// newPeer does the work of NewPeer, using the given connection. If multi is
+// given then the connection is shared with other Peers by it. If async is set
+// then it does the work of NewPeerAsync instead.
+func newPeer(
+	ctx context.Context,
+	network, serverAddr string,
+	opts PeerOpts,
+	mconn *migratingConn,
+	multi *MultiPeer,
+	async bool,
+) (
+	*Peer, error,
+) {
 	peer := &Peer{
-		po:            (*opts).withDefaults(),
+		PacketConn:    mconn,
+		mconn:         mconn,
+		multi:         multi,
+		po:            opts.withDefaults(),
 		network:       network,
 		serverAddrStr: serverAddr,
 		wg:            new(sync.WaitGroup),
 		closeCh:       make(chan bool),
+		reconfigCh:    make(chan struct{}, 1),
+		remingleCh:    make(chan struct{}, 1),
+		readyCh:       make(chan struct{}),
+		protocols:     map[ProtocolID]chan<- Packet{},
 	}
+	peer.rendezvous = rendezvousKey(peer.po.Rendezvous)
+	peer.tracer = tracer(peer.po.TracerProvider)
 
-	peer.PacketConn, err = net.ListenPacket(peer.network, peer.po.ListenAddr)
-	if err != nil {
+	if err := peer.po.validate(); err != nil {
+		if multi == nil {
+			mconn.Close()
+		}
 		return nil, err
 	}
 
-	innerCtx := ctx
-	if peer.po.InitTimeoutUntilGateway > 0 {
-		var cancel func()
-		innerCtx, cancel = context.WithTimeout(ctx, peer.po.InitTimeoutUntilGateway)
-		defer cancel()
+	if peer.po.WatchdogTimeout > 0 && multi == nil {
+		var err error
+		if peer.wd, err = newWatchdog(); err != nil {
+			mconn.Close()
+			return nil, err
+		}
 	}
 
-	err = peer.meetPeer(innerCtx)
-	if peer.po.InitTimeoutUntilGateway > 0 && err == errNoHelloPeer {
-		// TODO gateway stuff
-		if peer.gw, err = nat.DiscoverGateway(ctx); err != nil {
-			peer.Close()
-			return nil, err
-		} else if err := peer.natForward(); err != nil {
-			peer.Close()
+	if serverAddr == "" && len(peer.po.SeedPeers) == 0 &&
+		(peer.po.MulticastAddr == "" || multi != nil) {
+		if multi == nil {
+			mconn.Close()
+		}
+		return nil, errors.New("a server address is required unless SeedPeers or MulticastAddr are set")
+	}
+
+	peer.l.Lock()
+	peer.useCachedAddrs()
+	peer.l.Unlock()
+
+	peer.sendq = newSendQueue(peer.po.SendQueueSize, &peer.stats)
+	peer.wg.Add(1)
+	go peer.spinSendQueue()
+
+	if !async {
+		return peer.runBootstrap(ctx)
+	}
+
+	// the remainder of the bootstrap must stop if the Peer is closed.
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-peer.closeCh
+		cancel()
+	}()
+
+	helloSentCh := make(chan struct{})
+	peer.helloSentCh = helloSentCh
+	peer.helloCh = make(chan struct{}, 1)
+	go peer.runBootstrap(ctx)
+
+	select {
+	case <-helloSentCh:
+	case <-peer.readyCh:
+		if err := peer.BootstrapErr(); err != nil {
 			return nil, err
 		}
+	}
+	return peer, nil
+}
 
-		err = peer.meetPeer(ctx)
+// runBootstrap calls bootstrap within a tracing span, and records its result
+// for Ready and BootstrapErr.
+func (peer *Peer) runBootstrap(ctx context.Context) (*Peer, error) {
+	ctx, span := peer.tracer.Start(ctx, "bonfire.Peer.bootstrap", trace.WithAttributes(
+		attrServerAddr.String(peer.serverAddrStr),
+	))
+	err := peer.bootstrap(ctx)
+	if remoteAddr := peer.RemoteAddr(); err == nil && remoteAddr != nil {
+		span.SetAttributes(attrRemoteAddr.String(remoteAddr.String()))
 	}
+	endSpan(span, err)
+
+	peer.l.Lock()
+	peer.bootstrapErr = err
+	peer.l.Unlock()
+
+	// Close waits for readyCh, so it can't be used here. If the Peer has
+	// already been closed by the application then that Close call will do the
+	// waiting instead.
+	var closeErr error
+	if err != nil {
+		closeErr = peer.close()
+	}
+	close(peer.readyCh)
 	if err != nil {
-		peer.Close()
+		if closeErr == nil {
+			peer.waitClosed()
+		}
 		return nil, err
 	}
+	return peer, nil
+}
+
+// Ready returns a channel which is closed once the Peer has finished
+// bootstrapping, successfully or not (see BootstrapErr). For Peers created
+// by NewPeerAsync this is after it has returned, for all others the channel is
+// already closed.
+func (p *Peer) Ready() <-chan struct{} {
+	return p.readyCh
+}
+
+// BootstrapErr returns the error which caused the Peer's bootstrap sequence
+// to fail, in which case the Peer will have been closed. It returns nil if the
+// bootstrap hasn't finished yet (see Ready) or was successful. As with NewPeer,
+// failing to find other peers results in a *BootstrapError.
+func (p *Peer) BootstrapErr() error {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	return p.bootstrapErr
+}
+
+// bootstrap performs the work of newPeer once the Peer has been initialized,
+// returning once it has contacted the server and found a peer. If it returns an
+// error the Peer must be closed.
+func (peer *Peer) bootstrap(ctx context.Context) error {
+	if timeout := peer.po.TotalBootstrapTimeout; timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var err error
+	if peer.po.RecordWriter != nil && peer.multi == nil {
+		peer.mconn.rec, err = newRecorder(peer.po.RecordWriter, peer.mconn.LocalAddr(), func(err error) {
+			peer.event(PeerEvent{Type: PeerEventError, Err: err})
+		})
+		if err != nil {
+			return fmt.Errorf("writing to RecordWriter: %w", err)
+		}
+	}
 
-	if peer.po.ReadyToMingleInterval > 0 {
+	// this is done prior to contacting the server, so that the server itself
+	// being unreachable is reported.
+	var unreachableCh <-chan net.Addr
+	if peer.po.UnreachableThreshold > 0 && peer.multi == nil {
+		unreachableCh = peer.mconn.watchUnreachable()
+	}
+
+	if peer.po.PrivacyKey != nil {
+		if peer.sealer, err = newSealer(peer.po.PrivacyKey); err != nil {
+			return fmt.Errorf("invalid PrivacyKey: %w", err)
+		}
+	}
+
+	if peer.po.AdvertiseAddr != "" {
+		if peer.advertiseAddr, err = net.ResolveUDPAddr(peer.network, peer.po.AdvertiseAddr); err != nil {
+			return fmt.Errorf("invalid AdvertiseAddr: %w", err)
+		}
+	}
+
+	if peer.po.MulticastAddr != "" && peer.multi == nil {
+		if err := peer.joinMulticast(); err != nil {
+			return fmt.Errorf("joining multicast group: %w", err)
+		}
+		peer.wg.Add(1)
+		go peer.spinMulticast()
+	}
+
+	if peer.po.StartJitter > 0 {
+		select {
+		case <-time.After(jitter(peer.po.StartJitter) / 2):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	useGateway := peer.po.InitTimeoutUntilGateway > 0 && peer.serverAddrStr != ""
+	helloTimeout := peer.po.HelloWaitTimeout
+	if peer.po.InitTimeoutUntilGateway > 0 {
+		helloTimeout = peer.po.InitTimeoutUntilGateway
+	} else if helloTimeout <= 0 && peer.serverAddrStr == "" {
+		helloTimeout = 1 * time.Second
+	}
+
+	var gwCh <-chan gatewayResult
+	if useGateway && peer.po.ParallelGatewayDiscovery {
+		gwCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		gwCh = peer.discoverGateway(gwCtx)
+	}
+
+	var report BootstrapReport
+	peer.lockedSetState(PeerStateAwaitingHello)
+	err = report.phase(BootstrapPhaseHello, func() error {
+		return peer.meetPeer(ctx, helloTimeout)
+	})
+	if peer.serverAddrStr == "" && err == errNoHelloPeer {
+		// without a server nothing is guaranteed to respond, there may simply
+		// be no other peers yet.
+		err = nil
+	} else if useGateway && err == errNoHelloPeer {
+		peer.lockedSetState(PeerStateGatewayFallback)
+		if gwCh == nil {
+			gwCh = peer.discoverGateway(ctx)
+		}
+		err = report.phase(BootstrapPhaseGateway, func() error {
+			return peer.forwardGateway(ctx, gwCh)
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				err = fmt.Errorf("%w: %w", ErrGatewayUnavailable, err)
+			}
+			return peer.wrapBootstrapErr(err, report)
+		}
+		err = report.phase(BootstrapPhaseHelloViaGateway, func() error {
+			return peer.meetPeer(ctx, peer.po.HelloWaitTimeout)
+		})
+	}
+	if err == nil {
+		// if the Peer was closed while bootstrapping asynchronously the
+		// Context will have been canceled.
+		err = ctx.Err()
+	}
+	if err != nil {
+		return peer.wrapBootstrapErr(err, report)
+	}
+	peer.l.Lock()
+	peer.dropCachedGatewayAddr()
+	peer.setState(PeerStateEstablished)
+	mingles := peer.mingles()
+	peer.l.Unlock()
+	if mingles {
 		// If readyToMingle errors at this point it's because it couldn't
 		// resolve the server or sending failed. The server is known to be
 		// resolvable already, and we know we can send on our connection too. So
 		// assume the problem is temporary and continue on.
 		peer.readyToMingle()
-		peer.wg.Add(1)
-		go peer.spinReadyToMingle()
 	}
 
+	// this is started even if the Peer doesn't mingle, in case SetOptions
+	// changes that.
+	peer.wg.Add(1)
+	go peer.spinReadyToMingle()
+
 	if peer.gw != nil {
 		peer.wg.Add(1)
 		go peer.spinNATForward()
 	}
 
-	return peer, nil
+	if peer.po.MigrateCheckInterval > 0 && peer.multi == nil {
+		peer.wg.Add(1)
+		go peer.spinMigrate()
+	}
+
+	if peer.wd != nil {
+		peer.wg.Add(1)
+		go peer.spinWatchdog()
+	}
+
+	if unreachableCh != nil {
+		peer.wg.Add(1)
+		go peer.spinUnreachable(unreachableCh)
+	}
+
+	return nil
+}
+
+type gatewayResult struct {
+	gw  nat.NAT
+	err error
+}
+
+// discoverGateway discovers the NAT gateway in a separate go-routine, within
+// GatewayDiscoveryTimeout, and writes the result to the returned channel. The
+// go-routine will not block on writing the result if it's never read.
+func (p *Peer) discoverGateway(ctx context.Context) <-chan gatewayResult {
+	ch := make(chan gatewayResult, 1)
+	go func() {
+		if timeout := p.po.GatewayDiscoveryTimeout; timeout > 0 {
+			var cancel func()
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		gw, err := nat.DiscoverGateway(ctx)
+		ch <- gatewayResult{gw, err}
+	}()
+	return ch
 }
 
-func (p *Peer) meetPeer(ctx context.Context) error {
-	if err := p.resetPeers(); err != nil {
+// forwardGateway waits for the NAT gateway to be discovered and forwards a
+// port on it to the Peer.
+func (p *Peer) forwardGateway(ctx context.Context, gwCh <-chan gatewayResult) error {
+	_, span := p.tracer.Start(ctx, "bonfire.Peer.natForward")
+
+	var res gatewayResult
+	select {
+	case res = <-gwCh:
+	case <-ctx.Done():
+		res.err = ctx.Err()
+	}
+
+	if res.err != nil {
+		endSpan(span, res.err)
+		return res.err
+	}
+
+	p.l.Lock()
+	p.gw = res.gw
+	p.l.Unlock()
+	gwAddr, err := p.natForward()
+	if err != nil {
+		endSpan(span, err)
 		return err
-	} else if err = p.waitForPeer(ctx); err == context.DeadlineExceeded {
-		return errNoHelloPeer
 	}
+
+	p.l.Lock()
+	p.gwAddr, p.gwAddrCached = gwAddr, false
+	p.l.Unlock()
+	span.SetAttributes(attrRemoteAddr.String(gwAddr.String()))
+	endSpan(span, nil)
 	return nil
 }
 
-func (p *Peer) readyToMingle() error {
+// meetPeer contacts the server (and seed peers and multicast group, if any)
+// and waits for a HelloPeer in response. If timeout is greater than 0 and
+// passes first then errNoHelloPeer is returned, whereas if the Context is done
+// first its error is returned.
+func (p *Peer) meetPeer(ctx context.Context, timeout time.Duration) error {
+	waitCtx := ctx
+	if timeout > 0 {
+		var cancel func()
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	blastCount := p.po.PacketBlastCount
+	if p.po.RampBlastCount {
+		blastCount = 1
+	}
+
+	helloCtx, span := p.tracer.Start(waitCtx, "bonfire.Peer.helloServer", trace.WithAttributes(
+		attrBlastCount.Int(blastCount),
+	))
 	p.l.Lock()
-	serverAddr, err := p.serverAddr()
+	p.traceCtx = helloCtx
+	err := p.resetPeers(blastCount)
+	p.traceCtx = nil
+	p.l.Unlock()
+	endSpan(span, err)
 	if err != nil {
-		p.l.Unlock()
 		return err
+	} else if p.helloSentCh != nil {
+		close(p.helloSentCh)
+		p.helloSentCh = nil
+	}
+
+	_, span = p.tracer.Start(waitCtx, "bonfire.Peer.waitForPeer")
+	if resends := p.po.PacketBlastCount - blastCount; p.helloCh != nil {
+		err = p.waitForHello(waitCtx, resends)
+	} else {
+		err = p.waitForPeer(waitCtx, resends)
+	}
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		err = errNoHelloPeer
 	}
+	endSpan(span, err)
+	return err
+}
+
+// mingles returns whether the Peer sends ReadyToMingle messages, and so acts as
+// an introducer for other peers.
+//
+// This must be called with the lock held, once NewPeer has returned.
+func (p *Peer) mingles() bool {
+	return p.po.ReadyToMingleInterval > 0 &&
+		!p.po.DeclineIntroductions &&
+		p.serverAddrStr != ""
+}
+
+func (p *Peer) readyToMingle() error {
+	p.l.Lock()
+	sb, err := p.readyToMingleBatch()
 	p.l.Unlock()
+	if err != nil {
+		return err
+	}
+	return sb.flush()
+}
 
-	return multiSend(serverAddr, p.PacketConn, p.po.PacketBlastCount, Message{
-		Fingerprint: p.lastFingerprint,
-		Type:        ReadyToMingle,
+// readyToMingleBatch returns a sendBatch containing the ReadyToMingle messages
+// for the server, which hasn't been flushed.
+//
+// This must be called with the lock held.
+func (p *Peer) readyToMingleBatch() (*sendBatch, error) {
+	serverAddr, err := p.serverAddr()
+	if err != nil {
+		return nil, err
+	}
+	// if the server has only just been switched to, this is the ReadyToMingle
+	// which it's due.
+	select {
+	case <-p.remingleCh:
+	default:
+	}
+	fingerprint := p.lastFingerprint
+	if p.sealer != nil {
+		if fingerprint, err = p.privacyFingerprint(); err != nil {
+			return nil, err
+		}
+	}
+
+	var capacity MingleCapacity
+	if p.po.MaxIntroductions > 0 {
+		capacity = MingleCapacity{
+			Meets:    p.po.MaxIntroductions,
+			Interval: p.po.ReadyToMingleInterval,
+		}
+	}
+
+	sb := p.newSendBatch()
+	err = sb.add(serverAddr, p.po.PacketBlastCount, Message{
+		Fingerprint:    fingerprint,
+		Type:           ReadyToMingle,
+		MingleCapacity: capacity,
+		Rendezvous:     p.rendezvous,
 	})
+
+	// the circuit breaker needs the server to answer every attempt, see
+	// serverCircuit.
+	if err == nil && p.po.ServerFailureThreshold > 0 {
+		err = sb.add(serverAddr, p.po.PacketBlastCount, Message{
+			Fingerprint: fingerprint,
+			Type:        Probe,
+		})
+	}
+	if err != nil {
+		sb.release()
+		return nil, err
+	}
+	return sb, nil
 }
 
 func (p *Peer) spinReadyToMingle() {
 	defer p.wg.Done()
-	t := time.NewTicker(p.po.ReadyToMingleInterval)
-	defer t.Stop()
 	for {
+		// the interval is re-checked every time, in case it's been changed by
+		// SetOptions.
+		var timer *time.Timer
+		var timerCh <-chan time.Time
+		p.l.RLock()
+		if p.mingles() {
+			timer = time.NewTimer(p.po.ReadyToMingleInterval)
+			timerCh = timer.C
+		}
+		p.l.RUnlock()
+
+		select {
+		case <-timerCh:
+			p.l.Lock()
+			allow := p.circuitAllow(time.Now())
+			p.l.Unlock()
+			if !allow {
+				continue
+			} else if err := p.readyToMingle(); err != nil {
+				p.l.Lock()
+				p.serverFailed(err)
+				p.l.Unlock()
+				p.event(PeerEvent{Type: PeerEventError, Err: err})
+			}
+			continue
+		case <-p.remingleCh:
+			p.l.Lock()
+			remingle := (p.state == PeerStateEstablished || p.state == PeerStateRebootstrapping) &&
+				p.mingles() && p.circuitAllow(time.Now())
+			p.l.Unlock()
+			if !remingle {
+				break
+			} else if err := p.readyToMingle(); err != nil {
+				p.l.Lock()
+				p.serverFailed(err)
+				p.l.Unlock()
+				p.event(PeerEvent{Type: PeerEventError, Err: err})
+			}
+		case <-p.reconfigCh:
+		case <-p.closeCh:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
 		select {
-		case <-t.C:
-			p.readyToMingle()
 		case <-p.closeCh:
 			return
+		default:
 		}
 	}
 }
@@ -231,14 +1225,24 @@ func (p *Peer) localPort() int {
 	return port
 }
 
-func (p *Peer) natForward() error {
-	_, err := p.gw.AddPortMapping(
+// natForward creates or refreshes the port mapping on the gateway, returning
+// the external address of the mapping.
+func (p *Peer) natForward() (net.Addr, error) {
+	port, err := p.gw.AddPortMapping(
 		p.PacketConn.LocalAddr().Network(),
 		p.localPort(),
 		"port forwarding for bonfire peer",
 		p.po.GatewayPortMapTimeout,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := p.gw.GetExternalAddress()
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
 }
 
 func (p *Peer) spinNATForward() {
@@ -249,7 +1253,11 @@ func (p *Peer) spinNATForward() {
 	for {
 		select {
 		case <-t.C:
-			p.natForward()
+			if gwAddr, err := p.natForward(); err == nil {
+				p.l.Lock()
+				p.gwAddr = gwAddr
+				p.l.Unlock()
+			}
 		case <-p.closeCh:
 			p.gw.DeletePortMapping(proto, p.localPort())
 			return
@@ -269,24 +1277,100 @@ func (p *Peer) PeerAddrs() []net.Addr {
 }
 
 // RemoteAddr returns the remote address for this Peer, as gathered by
-// communicating with other peers and the server.
+// communicating with other peers and the server. If there is no server (see
+// MulticastAddr) this is nil until another peer has said hello.
+//
+// Each peer and the server reports the address it observed the Peer at, and
+// the address reported by the majority of them is used, so that a single peer
+// can't lie about it. Reports which disagree with the majority are emitted as
+// PeerEventRemoteAddrDisputed.
 func (p *Peer) RemoteAddr() net.Addr {
 	p.l.RLock()
 	defer p.l.RUnlock()
 	return p.remoteAddr
 }
 
-// we re-resolve this every time in case it is a hostname.
-func (p *Peer) serverAddr() (net.Addr, error) {
-	addr, err := net.ResolveUDPAddr(p.network, p.serverAddrStr)
+// Options returns the PeerOpts currently in effect for the Peer, with defaults
+// filled in.
+func (p *Peer) Options() PeerOpts {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	return p.po
+}
+
+// SetOptions changes the options of a running Peer. Only the following fields
+// of the given PeerOpts are applied, all others are ignored:
+//
+//   - PacketBlastCount
+//   - ReadyToMingleInterval
+//   - MaxPeers
+//   - AcceptFromKnownPeersOnly
+//   - AcceptFrom
+//   - ServerAddrTTL
+//   - DeclineIntroductions
+//   - MaxIntroductions
+//   - AcceptGreetings
+//
+// As with NewPeer, zero values are replaced with their defaults, so the
+// simplest way to change a single field is to modify the value returned from
+// Options and pass that in.
+//
+// If MaxPeers is lowered then peers are evicted from the set of peers until it
+// fits. If the Peer wasn't previously sending ReadyToMingle messages but now
+// should, one is sent immediately and its error returned, if any.
+func (p *Peer) SetOptions(opts PeerOpts) error {
+	opts = opts.withDefaults()
+
+	p.l.Lock()
+	wasMingling := p.mingles()
+	p.po.PacketBlastCount = opts.PacketBlastCount
+	p.po.ReadyToMingleInterval = opts.ReadyToMingleInterval
+	p.po.MaxPeers = opts.MaxPeers
+	p.po.AcceptFromKnownPeersOnly = opts.AcceptFromKnownPeersOnly
+	p.po.AcceptFrom = opts.AcceptFrom
+	p.po.ServerAddrTTL = opts.ServerAddrTTL
+	p.po.DeclineIntroductions = opts.DeclineIntroductions
+	p.po.MaxIntroductions = opts.MaxIntroductions
+	p.po.AcceptGreetings = opts.AcceptGreetings
+
+	for addrStr := range p.peers {
+		if len(p.peers) <= p.po.MaxPeers {
+			break
+		}
+		p.removePeer(addrStr)
+	}
+	if max := p.po.MaxPeers * maxPeerChanges; len(p.peerChanges) > max {
+		p.peerChanges = p.peerChanges[len(p.peerChanges)-max:]
+	}
+	isMingling := p.mingles()
+	p.l.Unlock()
+
+	// wake up spinReadyToMingle so it uses the new interval
+	select {
+	case p.reconfigCh <- struct{}{}:
+	default:
+	}
+
+	if !wasMingling && isMingling {
+		return p.readyToMingle()
+	}
+	return nil
+}
+
+// fingerprint generates a new fingerprint for the Peer, which will be used for
+// all messages sent to the server until the next call.
+//
+// This must be called with the lock held.
+func (p *Peer) fingerprint() ([]byte, error) {
+	fingerprint, err := p.genFingerprint()
 	if err != nil {
 		return nil, err
 	}
-	p.lastServerAddr = addr
-	return addr, nil
+	p.lastFingerprint = fingerprint
+	return fingerprint, nil
 }
 
-func (p *Peer) fingerprint() ([]byte, error) {
+func (p *Peer) genFingerprint() ([]byte, error) {
 	var err error
 	var fingerprint []byte
 	if p.po.FingerprintFunc == nil {
@@ -301,132 +1385,523 @@ func (p *Peer) fingerprint() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	p.lastFingerprint = fingerprint
 	return fingerprint, nil
 }
 
-func (p *Peer) resetPeers() error {
-	p.peers = map[string]net.Addr{}
-
-	fingerprint, err := p.fingerprint()
-	if err != nil {
+func (p *Peer) resetPeers(blastCount int) error {
+	p.clearPeers()
+	p.introStart = time.Now()
+	if _, err := p.fingerprint(); err != nil {
 		return err
+	} else if p.mcastConn != nil {
+		if err := p.announce(blastCount); err != nil {
+			return err
+		}
 	}
 
+	if len(p.po.SeedPeers) > 0 {
+		if err := p.greetSeeds(blastCount); err != nil {
+			return err
+		}
+	}
+
+	if p.serverAddrStr == "" {
+		return nil
+	} else if time.Now().Before(p.serverBusyUntil) {
+		p.retryHelloServerAt(p.serverBusyUntil)
+		return nil
+	}
+	return p.helloServer(blastCount)
+}
+
+// serverBusy records that the server has responded to a HelloServer with the
+// given Busy message, and returns the time at which the next HelloServer may be
+// sent.
+//
+// This must be called with the lock held.
+func (p *Peer) serverBusy(addr net.Addr, msg Message) time.Time {
+	retryAfter := msg.BusyBody.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = busyBackoff
+	}
+	until := time.Now().Add(retryAfter + jitter(retryAfter/4))
+	if until.After(p.serverBusyUntil) {
+		p.serverBusyUntil = until
+	}
+	p.event(PeerEvent{Type: PeerEventServerBusy, Addr: addr, Message: &msg})
+	return p.serverBusyUntil
+}
+
+// retryHelloServerAt schedules HelloServer messages to be sent at the given
+// time, replacing any previously scheduled ones.
+//
+// This must be called with the lock held.
+func (p *Peer) retryHelloServerAt(t time.Time) {
+	if p.busyTimer != nil {
+		p.busyTimer.Stop()
+	}
+	p.busyTimer = time.AfterFunc(time.Until(t), func() {
+		p.l.Lock()
+		defer p.l.Unlock()
+		if p.closed {
+			return
+		} else if err := p.helloServer(p.po.PacketBlastCount); err != nil {
+			p.event(PeerEvent{Type: PeerEventError, Err: err})
+		}
+	})
+}
+
+// helloServer sends a HelloServer message, using the current fingerprint (or a
+// fresh one in privacy mode), the given number of times.
+func (p *Peer) helloServer(blastCount int) error {
 	serverAddr, err := p.serverAddr()
 	if err != nil {
 		return err
 	}
 
-	return multiSend(serverAddr, p, p.po.PacketBlastCount, Message{
+	fingerprint := p.lastFingerprint
+	if p.sealer != nil {
+		if fingerprint, err = p.privacyFingerprint(); err != nil {
+			return err
+		}
+	}
+
+	msg := Message{
 		Fingerprint: fingerprint,
 		Type:        HelloServer,
-	})
+		Candidates:  p.candidates(),
+		Rendezvous:  p.rendezvous,
+	}
+
+	// in privacy mode the candidates are only given to the server in sealed
+	// form, and the sealed blob is always included so that other peers can
+	// tell the Meet is legitimate.
+	if p.sealer != nil {
+		if msg.Sealed, err = p.sealer.seal(msg.Candidates); err != nil {
+			return err
+		}
+		msg.Candidates = nil
+	}
+
+	return multiSend(p.newSendBatch(), serverAddr, blastCount, msg)
+}
+
+// resendHello sends a single HelloServer message or, if there is no server,
+// a single multicast announcement and Greet to each seed peer.
+func (p *Peer) resendHello() error {
+	if p.serverAddrStr != "" {
+		return p.helloServer(1)
+	} else if p.mcastConn != nil {
+		if err := p.announce(1); err != nil {
+			return err
+		}
+	}
+	if len(p.po.SeedPeers) > 0 {
+		return p.greetSeeds(1)
+	}
+	return nil
 }
 
 // ResetPeers clears the internal list of known peers and sends a message to the
-// server to retrieve some more. Once this is called ReadFrom will need to be
-// called repeatedly, even if it's not otherwise being used, in order to collect
-// the hello messages from peers.
+// server (and seed peers and multicast group, if any) to retrieve some more.
+// Once this is called ReadFrom will need to be called repeatedly, even if it's
+// not otherwise being used, in order to collect the hello messages from peers.
+// An error is returned if the Peer hasn't yet finished bootstrapping, e.g. if
+// it was created by NewPeerAsync.
 func (p *Peer) ResetPeers() error {
 	p.l.Lock()
 	defer p.l.Unlock()
-	return p.resetPeers()
+	if err := p.checkCanRebootstrap(); err != nil {
+		return err
+	}
+	p.setState(PeerStateRebootstrapping)
+	return p.resetPeers(p.po.PacketBlastCount)
 }
 
 // returns errNoHelloPeer if it didn't receive any messages at all.
 // p.peerAddrs may be empty if there are no other peers, but in that case the
 // server should at least send something.
-func (p *Peer) waitForPeer(ctx context.Context) error {
+//
+// resends indicates how many more HelloServer messages may be sent, one at a
+// time, while no response has been received. A Busy message from the server
+// will also cause a HelloServer to be resent, once the Peer has backed off.
+func (p *Peer) waitForPeer(ctx context.Context, resends int) error {
+	// the read deadline is used to interrupt reading once the Context is done,
+	// as well as to wake up for resends.
+	// if the Context is done just as this returns, the deadline must be set
+	// before returning, not after, or it would clobber whatever deadline the
+	// caller sets next.
+	afterDoneCh := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(afterDoneCh)
+		p.PacketConn.SetReadDeadline(time.Now())
+	})
+	defer func() {
+		if !stop() {
+			<-afterDoneCh
+		}
+	}()
+
+	nextResend := time.Now().Add(blastRampInterval)
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
+		deadline, _ := ctx.Deadline()
+		if resends > 0 && (deadline.IsZero() || nextResend.Before(deadline)) {
+			deadline = nextResend
 		}
 
+		// the Context is checked after setting the deadline, so that it can't
+		// overwrite the one set by AfterFunc.
 		b := make([]byte, MaxMessageSize)
-		p.PacketConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		p.PacketConn.SetReadDeadline(deadline)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		n, addr, err := p.PacketConn.ReadFrom(b)
 		if err != nil {
-			if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+			if nErr, ok := err.(net.Error); !ok || !nErr.Timeout() {
+				return err
+			} else if resends > 0 && !time.Now().Before(nextResend) {
+				p.l.Lock()
+				err := p.resendHello()
+				p.l.Unlock()
+				if err != nil {
+					return err
+				}
+				resends--
+				nextResend = time.Now().Add(blastRampInterval)
+			}
+			continue
+		}
+
+		if p.multi == nil && p.filtered(addr, b[:n]) {
+			continue
+		}
+
+		// if the connection is shared then packets for the other realms may be
+		// read here, and must be passed on.
+		if p.multi != nil {
+			if _, ok := p.bonfireMessage(b[:n]); !ok {
+				p.multi.dispatch(b[:n], addr)
 				continue
 			}
-			return err
 		}
 
 		var msg Message
 		if err := msg.UnmarshalBinary(b[:n]); err != nil {
 			continue
+		} else if !msg.fresh(p.po.MaxMessageAge, time.Now()) {
+			continue
+		}
+
+		// the server's address and keys may be changed concurrently, e.g. by
+		// the multicast go-routine, so are only looked at with the lock held.
+		p.l.Lock()
+		if err := p.verifyServerMessage(addr, msg); err != nil {
+			p.event(PeerEvent{Type: PeerEventError, Addr: addr, Err: err, Message: &msg})
+			p.l.Unlock()
+			continue
+		}
+		isServer := p.isServer(addr)
+		if isServer {
+			p.serverResponded.Store(true)
+		}
+		if msg.Type == Busy && isServer {
+			if resends < 1 {
+				resends = 1
+			}
+			nextResend = p.serverBusy(addr, msg)
+			p.l.Unlock()
+			continue
+		}
+		p.l.Unlock()
+
+		if msg.Type == YouAre || msg.Type == AuthFailed {
+			// the remote address is recorded, or the failure reported, but
+			// bootstrapping isn't finished until a HelloPeer arrives.
+			p.l.Lock()
+			p.processMessage(addr, msg)
+			p.l.Unlock()
+			continue
 		} else if msg.Type != HelloPeer {
 			continue
 		}
 
+		p.l.Lock()
+		defer p.l.Unlock()
 		return p.processMessage(addr, msg)
 	}
 }
 
+// waitForHello is like waitForPeer, but is used by Peers created with
+// NewPeerAsync, whose packets are read by the application via ReadFrom. It
+// waits for processMessage to report that a HelloPeer has been received.
+func (p *Peer) waitForHello(ctx context.Context, resends int) error {
+	for {
+		var resendCh <-chan time.Time
+		if resends > 0 {
+			resendCh = time.After(blastRampInterval)
+		}
+
+		select {
+		case <-p.helloCh:
+			return nil
+		case <-resendCh:
+			p.l.Lock()
+			err := p.resendHello()
+			p.l.Unlock()
+			if err != nil {
+				return err
+			}
+			resends--
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 // ReadFrom implements the method for the net.PacketConn interface. It will
 // process all incoming packets, implicitly handling any bonfire packets and
-// passing on others to the caller.
+// packets for protocols registered with RegisterProtocol, and passing on others
+// to the caller.
 //
 // The length of the passed in b must be at least MaxMessageSize.
 func (p *Peer) ReadFrom(b []byte) (int, net.Addr, error) {
-	if len(b) < MaxMessageSize {
+	if p.multi != nil {
+		return 0, nil, errors.New("ReadFrom must be called on the MultiPeer, not its realms")
+	} else if len(b) < MaxMessageSize {
 		return 0, nil, errors.New("length of []byte passed into ReadFrom must be at least bonfire.MaxMessageSize")
 	}
 
 	for {
 		n, addr, err := p.PacketConn.ReadFrom(b)
-		if err != nil || n > MaxMessageSize || n < MinMessageSize || b[0] != 0 {
+		if err != nil {
 			return n, addr, err
 		}
 
-		p.l.RLock()
-		lastFingerprint := p.lastFingerprint
-		p.l.RUnlock()
-		if !bytes.Equal(b[1:1+FingerprintSize], lastFingerprint) {
-			return n, addr, nil
+		if p.wd.read(b[:n]) {
+			continue
+		} else if p.filtered(addr, b[:n]) {
+			continue
+		} else if msg, ok := p.bonfireMessage(b[:n]); ok {
+			// from this point on assume it's a bonfire message, any errors
+			// encountered will be ignored
+			p.l.Lock()
+			p.processMessage(addr, msg)
+			p.l.Unlock()
+			continue
+		} else if !p.acceptApp(addr) {
+			continue
+		} else if p.routeProtocol(b[:n], addr) {
+			continue
 		}
 
-		var msg Message
-		if err := msg.UnmarshalBinary(b[:n]); err != nil {
-			return n, addr, nil
+		return n, addr, nil
+	}
+}
+
+// Send writes the packet to all of the given addresses, as if WriteTo were
+// called for each. The writes are batched together where the platform allows
+// it. Failing to write to one address doesn't prevent the others from being
+// written to; if any fail a SendError is returned describing which.
+//
+// Send is safe to call concurrently with all other methods. See also PeerOpts'
+// QueueSends.
+func (p *Peer) Send(b []byte, addrs ...net.Addr) error {
+	if p.po.QueueSends {
+		p.SendAsync(b, addrs...)
+		return nil
+	}
+	sb := newSendBatch(p.mconn)
+	for _, addr := range addrs {
+		sb.addRaw(addr, b)
+	}
+	return sb.flush()
+}
+
+// bonfireMessage returns the unmarshaled bonfire message contained in b, if b
+// contains one which was meant for this Peer.
+func (p *Peer) bonfireMessage(b []byte) (Message, bool) {
+	if len(b) > MaxMessageSize || len(b) < MinMessageSize || b[0] > maxVersion {
+		return Message{}, false
+	}
+
+	p.l.RLock()
+	isOwn := p.isOwnFingerprint(b[1 : 1+FingerprintSize])
+	acceptGreetings := p.po.AcceptGreetings
+	handshakes := p.po.HandshakePayload != nil
+	p.l.RUnlock()
+	if !isOwn && !(acceptGreetings && isGreeting(b)) &&
+		!(handshakes && isHandshakeRequest(b)) {
+		return Message{}, false
+	}
+
+	var msg Message
+	if err := msg.UnmarshalBinary(b); err != nil {
+		return Message{}, false
+	}
+	return msg, true
+}
+
+// acceptApp returns whether an application packet from the given address
+// should be passed on, as determined by AcceptFromKnownPeersOnly.
+func (p *Peer) acceptApp(addr net.Addr) bool {
+	p.l.RLock()
+	if !p.po.AcceptFromKnownPeersOnly {
+		p.l.RUnlock()
+		return true
+	}
+	_, ok := p.peers[addr.String()]
+	acceptFrom := p.po.AcceptFrom
+	p.l.RUnlock()
+
+	if ok {
+		return true
+	}
+	return acceptFrom != nil && acceptFrom(addr)
+}
+
+// helloPeer sends HelloPeer messages to the peer at the given address, and to
+// all other addresses it might be reachable at, using the given fingerprint.
+// lanCandidates are those which the server has said are on the peer's local
+// network (see Message's LANCandidates), which are tried before the others and
+// aren't subject to FilterBogonCandidates.
+//
+// This must be called with the lock held.
+func (p *Peer) helloPeer(addr net.Addr, fingerprint []byte, candidates, lanCandidates []net.Addr) {
+	helloPeer := Message{
+		Fingerprint: fingerprint,
+		Type:        HelloPeer,
+		HelloPeerBody: HelloPeerBody{
+			Addr: addr,
+		},
+		Candidates: p.candidates(),
+	}
+	sb := p.newSendBatch()
+	if err := sb.add(addr, p.po.PacketBlastCount, helloPeer); err != nil {
+		p.event(PeerEvent{Type: PeerEventError, Addr: addr, Err: err})
+		return
+	}
+
+	// also try all other addresses the peer might be reachable at, in case
+	// one of them is more direct. The HelloPeerBody.Addr is left as it is,
+	// since that's the address the peer was observed at.
+	if p.po.FilterBogonCandidates {
+		candidates = filterBogonCandidates(candidates)
+	}
+	candidates = append(append([]net.Addr(nil), lanCandidates...), candidates...)
+	for _, candidate := range candidates {
+		if candidate.String() == addr.String() {
+			continue
 		}
+		sb.add(candidate, p.po.PacketBlastCount, helloPeer)
+	}
 
-		// from this point on assume it's a bonfire message, any errors
-		// encountered will be ignored
-		p.l.Lock()
-		p.processMessage(addr, msg)
-		p.l.Unlock()
+	// the lock is held here, and ReadFrom shouldn't be held up by writes, so
+	// the batch is sent in the background.
+	p.flushAsync(sb, func(err error) {
+		p.event(PeerEvent{Type: PeerEventError, Addr: addr, Err: err})
+	})
+}
+
+// newSendBatch returns a sendBatch for sending bonfire messages from the Peer.
+func (p *Peer) newSendBatch() *sendBatch {
+	sb := newSendBatch(p.mconn)
+	if p.po.PadMessages {
+		sb.padTo = MaxMessageSize
 	}
+	sb.stamp = p.po.MaxMessageAge > 0
+	if p.po.DebugMessages {
+		sb.onAdd = p.debugSent
+	}
+	return sb
+}
+
+func (p *Peer) debugSent(dst net.Addr, typ MessageType) {
+	p.debugLog.add(true, dst, typ)
 }
 
 func (p *Peer) processMessage(addr net.Addr, msg Message) error {
+	if !msg.fresh(p.po.MaxMessageAge, time.Now()) {
+		return nil
+	}
+	if p.po.DebugMessages {
+		p.debugLog.add(false, addr, msg.Type)
+	}
+	if err := p.verifyServerMessage(addr, msg); err != nil {
+		p.event(PeerEvent{Type: PeerEventError, Addr: addr, Err: err, Message: &msg})
+		return nil
+	}
+	p.seen(addr)
+	if p.isServer(addr) {
+		p.serverResponded.Store(true)
+		if stats := p.serverStats(addr); stats != nil {
+			stats.Received++
+			stats.LastReceived = time.Now()
+		}
+		p.serverSucceeded()
+		p.observeServerInstance(addr, msg)
+	}
+
 	switch msg.Type {
 	case Meet:
-		return multiSend(msg.MeetBody.Addr, p, p.po.PacketBlastCount, Message{
-			Fingerprint: msg.MeetBody.Fingerprint,
-			Type:        HelloPeer,
-			HelloPeerBody: HelloPeerBody{
-				Addr: msg.MeetBody.Addr,
-			},
-		})
-	case HelloPeer:
-		if p.remoteAddr == nil {
-			p.remoteAddr = msg.HelloPeerBody.Addr
+		if p.po.DeclineIntroductions {
+			break
+		} else if p.sealer != nil {
+			candidates, err := p.sealer.open(msg.Sealed)
+			if err != nil {
+				break
+			}
+			msg.Candidates = candidates
 		}
-		addrString := addr.String()
-		if addrString == p.lastServerAddr.String() {
+		if !p.acceptPeer(msg.MeetBody.Addr, msg.MeetBody.Fingerprint) {
 			break
 		}
-		if len(p.peers) >= p.po.MaxPeers {
-			for peerAddrStr := range p.peers {
-				delete(p.peers, peerAddrStr)
-				break
+		p.rememberIntroduction(msg)
+		p.checkSameNAT(msg.MeetBody.Addr, append(msg.LANCandidates, msg.Candidates...))
+		p.helloPeer(msg.MeetBody.Addr, msg.MeetBody.Fingerprint, msg.Candidates, msg.LANCandidates)
+		return nil
+	case Greet:
+		if p.po.AcceptGreetings {
+			p.processGreeting(addr, msg)
+		}
+	case Busy:
+		if p.isServer(addr) {
+			p.retryHelloServerAt(p.serverBusy(addr, msg))
+		}
+	case Occupancy:
+		if p.isServer(addr) {
+			p.processOccupancy(msg)
+		}
+	case Probe:
+		p.processProbe(addr, msg)
+	case Handshake:
+		p.processHandshake(addr, msg)
+	case YouAre:
+		if p.isServer(addr) {
+			p.observeRemoteAddr(addr, msg)
+		}
+	case AuthFailed:
+		if p.isServer(addr) {
+			p.event(PeerEvent{Type: PeerEventAuthFailed, Addr: addr, Message: &msg})
+		}
+	case HelloPeer:
+		p.observeRemoteAddr(addr, msg)
+		if p.state == PeerStateRebootstrapping {
+			p.setState(PeerStateEstablished)
+		} else if p.helloCh != nil && p.state != PeerStateEstablished {
+			select {
+			case p.helloCh <- struct{}{}:
+			default:
 			}
 		}
-		p.peers[addrString] = addr
+		if p.isServer(addr) {
+			break
+		} else if !p.acceptPeer(addr, p.introducedFingerprint(addr)) {
+			break
+		} else if p.knownViaCandidates(addr, msg.Candidates) {
+			break
+		}
+		p.addPeer(addr)
 	}
 	return nil
 }
@@ -434,17 +1909,47 @@ func (p *Peer) processMessage(addr net.Addr, msg Message) error {
 // Close closes the underlying PacketConn and cleans up all other resources used
 // by Peer.
 func (p *Peer) Close() error {
+	if err := p.close(); err != nil {
+		return err
+	}
+
+	// a Peer created by NewPeerAsync may still be bootstrapping, in which case
+	// it will stop now that closeCh is closed.
+	<-p.readyCh
+	p.waitClosed()
+	return nil
+}
+
+// close closes the underlying PacketConn and signals all background
+// go-routines to stop, but doesn't wait for them to do so.
+func (p *Peer) close() error {
 	p.l.Lock()
 	defer p.l.Unlock()
-
 	if p.closed {
 		return errors.New("bonfire.Peer already closed")
-
-	} else if err := p.PacketConn.Close(); err != nil {
-		return err
+	} else if p.multi == nil {
+		if err := p.PacketConn.Close(); err != nil {
+			return err
+		}
 	}
 	close(p.closeCh)
-	p.wg.Wait()
 	p.closed = true
+	if p.mcastConn != nil {
+		p.mcastConn.Close()
+	}
+	if p.busyTimer != nil {
+		p.busyTimer.Stop()
+	}
 	return nil
 }
+
+// waitClosed waits for the background go-routines to stop once close has been
+// called. The background go-routines may need to acquire the lock in order to
+// notice closeCh has been closed, so it must not be held.
+func (p *Peer) waitClosed() {
+	p.wg.Wait()
+
+	if p.multi != nil {
+		p.multi.removeRealm(p)
+	}
+}
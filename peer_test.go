@@ -0,0 +1,542 @@
+package bonfire
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerAcceptApp(t *T) {
+	known, unknown, allowed := addrString("127.0.0.1:1"), addrString("127.0.0.1:2"), addrString("127.0.0.1:3")
+	peer := &Peer{
+		peers: map[string]net.Addr{known.String(): known},
+	}
+
+	massert.Require(t,
+		massert.Equal(true, peer.acceptApp(known)),
+		massert.Equal(true, peer.acceptApp(unknown)),
+	)
+
+	peer.po.AcceptFromKnownPeersOnly = true
+	massert.Require(t,
+		massert.Equal(true, peer.acceptApp(known)),
+		massert.Equal(false, peer.acceptApp(unknown)),
+		massert.Equal(false, peer.acceptApp(allowed)),
+	)
+
+	peer.po.AcceptFrom = func(addr net.Addr) bool {
+		return addr.String() == allowed.String()
+	}
+	massert.Require(t,
+		massert.Equal(true, peer.acceptApp(known)),
+		massert.Equal(false, peer.acceptApp(unknown)),
+		massert.Equal(true, peer.acceptApp(allowed)),
+	)
+}
+
+func TestPeerServerAddr(t *T) {
+	evCh := make(chan PeerEvent, 1)
+	peer := &Peer{
+		network:       "udp",
+		serverAddrStr: "127.0.0.1:7890",
+		po:            PeerOpts{ServerAddrTTL: -1, EventCh: evCh},
+	}
+
+	addr, err := peer.serverAddr()
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal("127.0.0.1:7890", addr.String()),
+	)
+
+	// with a static address the new address shouldn't even be looked at
+	peer.serverAddrStr = "127.0.0.2:7890"
+	addr, err = peer.serverAddr()
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal("127.0.0.1:7890", addr.String()),
+	)
+
+	// with a TTL of 0 it should be, and the Peer has switched servers
+	peer.po.ServerAddrTTL = 0
+	addr, err = peer.serverAddr()
+	ev := <-evCh
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal("127.0.0.2:7890", addr.String()),
+		massert.Equal(PeerEventServerChanged, ev.Type),
+	)
+
+	// if resolving fails the previous address should be used, but an event
+	// should be emitted
+	peer.serverAddrStr = "bad-addr"
+	addr, err = peer.serverAddr()
+	ev = <-evCh
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal("127.0.0.2:7890", addr.String()),
+		massert.Equal(PeerEventResolveFailed, ev.Type),
+		massert.Not(massert.Nil(ev.Err)),
+	)
+}
+
+func TestPeerAddrsSince(t *T) {
+	peer := &Peer{po: PeerOpts{MaxPeers: 2}}
+	peer.clearPeers()
+
+	a, b, c := addrString("127.0.0.1:1"), addrString("127.0.0.1:2"), addrString("127.0.0.1:3")
+	assertDiff := func(diff PeerAddrsDiff, gen uint64, full bool, added, removed []net.Addr) massert.Assertion {
+		return massert.All(
+			massert.Equal(gen, diff.Gen),
+			massert.Equal(full, diff.Full),
+			massert.Length(diff.Added, len(added)),
+			massert.Subset(diff.Added, added),
+			massert.Length(diff.Removed, len(removed)),
+			massert.Subset(diff.Removed, removed),
+		)
+	}
+
+	massert.Require(t, assertDiff(peer.PeerAddrsSince(0), 0, false, nil, nil))
+
+	peer.addPeer(a)
+	peer.addPeer(b)
+	massert.Require(t,
+		assertDiff(peer.PeerAddrsSince(0), 2, false, []net.Addr{a, b}, nil),
+		assertDiff(peer.PeerAddrsSince(1), 2, false, []net.Addr{b}, nil),
+		assertDiff(peer.PeerAddrsSince(2), 2, false, nil, nil),
+	)
+
+	// adding c evicts one of the others
+	peer.addPeer(c)
+	diff := peer.PeerAddrsSince(2)
+	massert.Require(t,
+		massert.Equal(uint64(4), diff.Gen),
+		massert.Length(diff.Added, 1),
+		massert.Equal(c, diff.Added[0]),
+		massert.Length(diff.Removed, 1),
+	)
+
+	// removing and re-adding results in no change
+	peer.removePeer(c.String())
+	peer.addPeer(c)
+	massert.Require(t, assertDiff(peer.PeerAddrsSince(4), 6, false, nil, nil))
+
+	// once enough changes have happened the oldest are forgotten
+	for i := 0; i < 4; i++ {
+		peer.removePeer(c.String())
+		peer.addPeer(c)
+	}
+	diff = peer.PeerAddrsSince(0)
+	massert.Require(t,
+		massert.Equal(true, diff.Full),
+		massert.Length(diff.Added, 2),
+		massert.Subset(diff.Added, peer.PeerAddrs()),
+	)
+}
+
+func TestPeerDeclineIntroductions(t *T) {
+	peer := &Peer{po: PeerOpts{ReadyToMingleInterval: 1}, serverAddrStr: "127.0.0.1:0"}
+	massert.Require(t, massert.Equal(true, peer.mingles()))
+
+	// the Peer has no connection, so it would panic if it tried to respond to
+	// the Meet.
+	peer.po.DeclineIntroductions = true
+	err := peer.processMessage(addrString("127.0.0.1:1"), Message{
+		Type: Meet,
+		MeetBody: MeetBody{
+			Fingerprint: make([]byte, FingerprintSize),
+			Addr:        addrString("127.0.0.1:2"),
+		},
+	})
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(false, peer.mingles()),
+	)
+}
+
+func TestPeerSetOptions(t *T) {
+	peer := &Peer{
+		po:         PeerOpts{MaxPeers: 3, DeclineIntroductions: true}.withDefaults(),
+		reconfigCh: make(chan struct{}, 1),
+	}
+	peer.clearPeers()
+	peer.addPeer(addrString("127.0.0.1:1"))
+	peer.addPeer(addrString("127.0.0.1:2"))
+	peer.addPeer(addrString("127.0.0.1:3"))
+
+	// the Peer has no connection, so it would panic if SetOptions caused it to
+	// start mingling.
+	opts := peer.Options()
+	opts.MaxPeers = 1
+	opts.PacketBlastCount = 0
+	opts.ReadyToMingleInterval = 5
+	massert.Require(t, massert.Nil(peer.SetOptions(opts)))
+
+	opts = peer.Options()
+	massert.Require(t,
+		massert.Length(peer.PeerAddrs(), 1),
+		massert.Equal(1, opts.MaxPeers),
+		massert.Equal(3, opts.PacketBlastCount),
+		massert.Equal(time.Duration(5), opts.ReadyToMingleInterval),
+		massert.Equal(1, len(peer.reconfigCh)),
+	)
+}
+
+func TestPeerUnreachable(t *T) {
+	eventCh := make(chan PeerEvent, 10)
+	peer := &Peer{po: PeerOpts{
+		MaxPeers:             2,
+		UnreachableThreshold: 2,
+		EventCh:              eventCh,
+	}}
+	peer.clearPeers()
+
+	a, b := addrString("127.0.0.1:1"), addrString("127.0.0.1:2")
+	peer.addPeer(a)
+
+	// addresses which aren't peers still cause events.
+	peer.unreachable(b)
+	peer.unreachable(a)
+	massert.Require(t, massert.Equal([]net.Addr{a}, peer.PeerAddrs()))
+
+	// hearing from the peer again resets its count.
+	peer.addPeer(a)
+	peer.unreachable(a)
+	massert.Require(t, massert.Equal([]net.Addr{a}, peer.PeerAddrs()))
+	peer.unreachable(a)
+	massert.Require(t, massert.Length(peer.PeerAddrs(), 0))
+
+	massert.Require(t, massert.Equal(4, len(eventCh)))
+	for _, expAddr := range []net.Addr{b, a, a, a} {
+		ev := <-eventCh
+		massert.Require(t,
+			massert.Equal(PeerEventUnreachable, ev.Type),
+			massert.Equal(expAddr, ev.Addr),
+		)
+	}
+}
+
+func TestPeerState(t *T) {
+	evCh := make(chan PeerEvent, 1)
+	peer := &Peer{po: PeerOpts{MaxPeers: 1, EventCh: evCh}}
+	peer.clearPeers()
+
+	assertState := func(state PeerState) massert.Assertion {
+		ev := <-evCh
+		return massert.All(
+			massert.Equal(state, peer.State()),
+			massert.Equal(PeerEventStateChanged, ev.Type),
+			massert.Equal(state, ev.State),
+		)
+	}
+
+	massert.Require(t, massert.Equal(PeerStateInit, peer.State()))
+	peer.lockedSetState(PeerStateAwaitingHello)
+	massert.Require(t, assertState(PeerStateAwaitingHello))
+
+	// receiving a HelloPeer during bootstrap doesn't change the state, that's
+	// left to NewPeer.
+	hello := Message{
+		Type:          HelloPeer,
+		HelloPeerBody: HelloPeerBody{Addr: addrString("127.0.0.1:1")},
+	}
+	massert.Require(t,
+		massert.Nil(peer.processMessage(addrString("127.0.0.1:2"), hello)),
+		massert.Equal(PeerStateAwaitingHello, peer.State()),
+		massert.Equal(0, len(evCh)),
+	)
+
+	peer.lockedSetState(PeerStateEstablished)
+	massert.Require(t, assertState(PeerStateEstablished))
+
+	// once re-bootstrapping, the next HelloPeer re-establishes the Peer.
+	peer.lockedSetState(PeerStateRebootstrapping)
+	massert.Require(t, assertState(PeerStateRebootstrapping))
+	peer.processMessage(addrString("127.0.0.1:3"), hello)
+	massert.Require(t, assertState(PeerStateEstablished))
+
+	defer func() {
+		massert.Require(t, massert.Not(massert.Nil(recover())))
+	}()
+	peer.lockedSetState(PeerStateGatewayFallback)
+}
+
+func TestPeerBootstrapTimeouts(t *T) {
+	// a server which never responds
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer server.Close()
+	serverAddr := server.LocalAddr().String()
+
+	newPeer := func(ctx context.Context, opts PeerOpts) (time.Duration, error) {
+		opts.InitTimeoutUntilGateway = -1
+		start := time.Now()
+		_, err := NewPeer(ctx, "udp", serverAddr, &opts)
+		return time.Since(start), err
+	}
+
+	took, err := newPeer(context.Background(), PeerOpts{HelloWaitTimeout: 200 * time.Millisecond})
+	massert.Require(t,
+		massert.Equal(true, errors.Is(err, ErrServerUnreachable)),
+		massert.Equal(true, took < time.Second),
+	)
+
+	took, err = newPeer(context.Background(), PeerOpts{TotalBootstrapTimeout: 200 * time.Millisecond})
+	massert.Require(t,
+		massert.Equal(true, errors.Is(err, context.DeadlineExceeded)),
+		massert.Equal(true, errors.Is(err, ErrServerUnreachable)),
+		massert.Equal(true, took < time.Second),
+	)
+
+	// the Context's deadline is honored even when it's earlier than
+	// HelloWaitTimeout, and isn't mistaken for it.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	took, err = newPeer(ctx, PeerOpts{HelloWaitTimeout: 5 * time.Second})
+	massert.Require(t,
+		massert.Equal(true, errors.Is(err, context.DeadlineExceeded)),
+		massert.Equal(true, took < time.Second),
+	)
+}
+
+func TestPeerParallelGatewayDiscovery(t *T) {
+	// a server which never responds
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer server.Close()
+
+	// there's no gateway to be found, so discovery will fail during the
+	// initial wait and NewPeer should fail as soon as it falls back.
+	evCh := make(chan PeerEvent, 8)
+	start := time.Now()
+	_, err = NewPeer(context.Background(), "udp", server.LocalAddr().String(), &PeerOpts{
+		InitTimeoutUntilGateway:  200 * time.Millisecond,
+		GatewayDiscoveryTimeout:  100 * time.Millisecond,
+		TotalBootstrapTimeout:    2 * time.Second,
+		ParallelGatewayDiscovery: true,
+		EventCh:                  evCh,
+	})
+	took := time.Since(start)
+	close(evCh)
+
+	var states []PeerState
+	for ev := range evCh {
+		if ev.Type == PeerEventStateChanged {
+			states = append(states, ev.State)
+		}
+	}
+	var bsErr *BootstrapError
+	massert.Require(t,
+		massert.Equal(true, errors.As(err, &bsErr)),
+		massert.Equal(true, errors.Is(err, ErrGatewayUnavailable)),
+		massert.Equal(true, took < time.Second),
+		massert.Equal([]PeerState{PeerStateAwaitingHello, PeerStateGatewayFallback}, states),
+	)
+	massert.Require(t,
+		massert.Equal(2, len(bsErr.Report.Phases)),
+		massert.Equal(false, bsErr.Report.ServerResponded),
+	)
+	massert.Require(t,
+		massert.Equal(BootstrapPhaseHello, bsErr.Report.Phases[0].Name),
+		massert.Equal(BootstrapPhaseGateway, bsErr.Report.Phases[1].Name),
+		massert.Not(massert.Nil(bsErr.Report.Phases[1].Err)),
+	)
+}
+
+func TestNewPeerAsync(t *T) {
+	// a server which only responds when told to
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer server.Close()
+	serverAddr := server.LocalAddr().String()
+	respond := func() {
+		b := make([]byte, MaxMessageSize)
+		n, addr, err := server.ReadFrom(b)
+		massert.Require(t, massert.Nil(err))
+		var hello Message
+		massert.Require(t, massert.Nil(hello.UnmarshalBinary(b[:n])))
+		b, err = Message{
+			Fingerprint:   hello.Fingerprint,
+			Type:          HelloPeer,
+			HelloPeerBody: HelloPeerBody{Addr: addr},
+		}.MarshalBinary()
+		massert.Require(t, massert.Nil(err))
+		_, err = server.WriteTo(b, addr)
+		massert.Require(t, massert.Nil(err))
+	}
+
+	opts := &PeerOpts{InitTimeoutUntilGateway: -1, ListenAddr: "127.0.0.1:0"}
+	peer, err := NewPeerAsync(context.Background(), "udp", serverAddr, opts)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(PeerStateAwaitingHello, peer.State()),
+	)
+	defer peer.Close()
+	go func() {
+		b := make([]byte, MaxMessageSize)
+		for {
+			if _, _, err := peer.ReadFrom(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	// the Peer can't be re-bootstrapped until it's bootstrapped.
+	massert.Require(t,
+		massert.Equal(errNotBootstrapped, peer.Migrate()),
+		massert.Equal(errNotBootstrapped, peer.ResetPeers()),
+		massert.Equal(PeerStateAwaitingHello, peer.State()),
+	)
+
+	respond()
+	select {
+	case <-peer.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("peer not ready")
+	}
+	massert.Require(t,
+		massert.Nil(peer.BootstrapErr()),
+		massert.Equal(PeerStateEstablished, peer.State()),
+		massert.Equal(peer.LocalAddr().String(), peer.RemoteAddr().String()),
+	)
+
+	// if bootstrapping fails the Peer is closed.
+	opts.TotalBootstrapTimeout = 200 * time.Millisecond
+	peer, err = NewPeerAsync(context.Background(), "udp", serverAddr, opts)
+	massert.Require(t, massert.Nil(err))
+	<-peer.Ready()
+	massert.Require(t,
+		massert.Equal(true, errors.Is(peer.BootstrapErr(), context.DeadlineExceeded)),
+		massert.Not(massert.Nil(peer.Close())),
+	)
+
+	// closing the Peer stops the bootstrap.
+	opts.TotalBootstrapTimeout = 0
+	peer, err = NewPeerAsync(context.Background(), "udp", serverAddr, opts)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Nil(peer.Close()),
+		massert.Equal(true, errors.Is(peer.BootstrapErr(), context.Canceled)),
+	)
+}
+
+func TestPeerWaitForPeers(t *T) {
+	peer := &Peer{po: PeerOpts{MaxPeers: 2}, closeCh: make(chan bool)}
+	peer.clearPeers()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	massert.Require(t,
+		massert.Nil(peer.WaitForPeers(ctx, 0)),
+		massert.Equal(context.DeadlineExceeded, peer.WaitForPeers(ctx, 1)),
+		massert.Not(massert.Nil(peer.WaitForPeers(context.Background(), 3))),
+	)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- peer.WaitForPeers(context.Background(), 2) }()
+	for _, addr := range []net.Addr{addrString("127.0.0.1:1"), addrString("127.0.0.1:2")} {
+		time.Sleep(10 * time.Millisecond)
+		peer.l.Lock()
+		peer.addPeer(addr)
+		peer.l.Unlock()
+	}
+	massert.Require(t, massert.Nil(<-errCh))
+
+	// closing the Peer interrupts waiting.
+	peer.l.Lock()
+	peer.clearPeers()
+	peer.l.Unlock()
+	go func() { errCh <- peer.WaitForPeers(context.Background(), 1) }()
+	close(peer.closeCh)
+	massert.Require(t, massert.Not(massert.Nil(<-errCh)))
+}
+
+// lockedBuffer is a bytes.Buffer which may be written to concurrently.
+type lockedBuffer struct {
+	l   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(b []byte) (int, error) {
+	lb.l.Lock()
+	defer lb.l.Unlock()
+	return lb.buf.Write(b)
+}
+
+// Bytes returns a copy of everything written so far.
+func (lb *lockedBuffer) Bytes() []byte {
+	lb.l.Lock()
+	defer lb.l.Unlock()
+	return append([]byte(nil), lb.buf.Bytes()...)
+}
+
+func TestPeerPadMessages(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pub, key, err := ed25519.GenerateKey(nil)
+	massert.Require(t, massert.Nil(err))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	server.PadMessages = true
+	server.SigningKey = key
+	go server.Serve(ctx, conn)
+	serverAddr := conn.LocalAddr().String()
+
+	newPeer := func(buf io.Writer) *Peer {
+		peer, err := NewPeer(ctx, "udp", serverAddr, &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			ListenAddr:              "127.0.0.1:0",
+			PadMessages:             true,
+			ServerPublicKey:         pub,
+			RecordWriter:            buf,
+		})
+		massert.Require(t, massert.Nil(err))
+		peer.SetReadDeadline(time.Time{})
+		go func() {
+			b := make([]byte, MaxMessageSize)
+			for {
+				if _, _, err := peer.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+		return peer
+	}
+
+	// peerA must verify the padded, signed Meet in order for peerB to meet it.
+	// HelloPeer messages are written in the background, and may still be
+	// being recorded after Close.
+	bufA, bufB := new(lockedBuffer), new(lockedBuffer)
+	peerA := newPeer(bufA)
+	for len(server.Minglers()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	peerB := newPeer(bufB)
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	massert.Require(t, massert.Nil(peerB.WaitForPeers(waitCtx, 1)))
+	peerA.Close()
+	peerB.Close()
+
+	for _, buf := range []*lockedBuffer{bufA, bufB} {
+		// a packet may have been part way through being recorded
+		rec, err := ReadRecording(bytes.NewReader(buf.Bytes()))
+		massert.Require(t, massert.Any(
+			massert.Nil(err),
+			massert.Equal(io.ErrUnexpectedEOF, err),
+		))
+		for _, pkt := range rec.Packets {
+			massert.Require(t, massert.Equal(MaxMessageSize, len(pkt.Data)))
+		}
+	}
+}
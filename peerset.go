@@ -0,0 +1,191 @@
+package bonfire
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// maxPeerChanges is the number of changes to the peer set which are retained
+// for the purpose of PeerAddrsSince, as a multiple of MaxPeers.
+const maxPeerChanges = 4
+
+type peerChange struct {
+	gen   uint64
+	addr  net.Addr
+	added bool
+}
+
+// PeerAddrsDiff describes the changes made to a Peer's set of peers since some
+// previous generation of that set. See PeerAddrsSince.
+type PeerAddrsDiff struct {
+	// Gen is the current generation of the set, which can be passed into the
+	// next call to PeerAddrsSince.
+	Gen uint64
+
+	// If Full is true then the changes since the requested generation are no
+	// longer known. Added will contain the full current set, and the caller
+	// should discard whatever it had previously.
+	Full bool
+
+	Added, Removed []net.Addr
+}
+
+// addPeer adds the address to the set of peers, evicting an existing peer if
+// the set is full.
+//
+// This must be called with the lock held.
+func (p *Peer) addPeer(addr net.Addr) {
+	addrStr := addr.String()
+	delete(p.unreachableCounts, addrStr)
+	if _, ok := p.peers[addrStr]; ok {
+		p.peers[addrStr] = addr
+		p.seen(addr)
+		return
+	}
+
+	if len(p.peers) >= p.po.MaxPeers {
+		for peerAddrStr := range p.peers {
+			p.removePeer(peerAddrStr)
+			break
+		}
+	}
+	p.peers[addrStr] = addr
+	p.seen(addr)
+	p.recordPeerChange(addr, true)
+	p.sendHandshake(addr, p.lastFingerprint, false)
+}
+
+// removePeer removes the address from the set of peers, if it's in it.
+//
+// This must be called with the lock held.
+func (p *Peer) removePeer(addrStr string) {
+	addr, ok := p.peers[addrStr]
+	if !ok {
+		return
+	}
+	delete(p.peers, addrStr)
+	delete(p.unreachableCounts, addrStr)
+	delete(p.handshakes, addrStr)
+	delete(p.peerTags, addrStr)
+	delete(p.peerLastSeen, addrStr)
+	p.recordPeerChange(addr, false)
+}
+
+// clearPeers removes all addresses from the set of peers.
+//
+// This must be called with the lock held.
+func (p *Peer) clearPeers() {
+	if p.peers == nil {
+		p.peers = map[string]net.Addr{}
+	}
+	for addrStr := range p.peers {
+		p.removePeer(addrStr)
+	}
+}
+
+func (p *Peer) recordPeerChange(addr net.Addr, added bool) {
+	if p.peersChangedCh != nil {
+		close(p.peersChangedCh)
+		p.peersChangedCh = nil
+	}
+	p.peersGen++
+	p.peerChanges = append(p.peerChanges, peerChange{
+		gen:   p.peersGen,
+		addr:  addr,
+		added: added,
+	})
+	if max := p.po.MaxPeers * maxPeerChanges; len(p.peerChanges) > max {
+		p.peerChanges = p.peerChanges[len(p.peerChanges)-max:]
+	}
+}
+
+// PeerAddrsSince returns the changes made to the set of peers (see PeerAddrs)
+// since the given generation. The generation of an empty set, prior to any
+// changes, is 0.
+//
+// Only a limited number of changes are retained, so if the given generation is
+// too old the returned diff will describe the full current set instead.
+func (p *Peer) PeerAddrsSince(gen uint64) PeerAddrsDiff {
+	p.l.RLock()
+	defer p.l.RUnlock()
+
+	diff := PeerAddrsDiff{Gen: p.peersGen}
+	if gen == p.peersGen {
+		return diff
+	} else if gen > p.peersGen ||
+		len(p.peerChanges) == 0 ||
+		p.peerChanges[0].gen > gen+1 {
+		diff.Full = true
+		for _, addr := range p.peers {
+			diff.Added = append(diff.Added, addr)
+		}
+		return diff
+	}
+
+	// for each address changed, determine whether it was in the set at the
+	// given generation by the first change to it after that generation, and
+	// whether it's in the set now by the last change.
+	type state struct {
+		addr        net.Addr
+		wasIn, isIn bool
+	}
+	states := map[string]*state{}
+	var order []string
+	for _, change := range p.peerChanges {
+		if change.gen <= gen {
+			continue
+		}
+		addrStr := change.addr.String()
+		s, ok := states[addrStr]
+		if !ok {
+			s = &state{wasIn: !change.added}
+			states[addrStr] = s
+			order = append(order, addrStr)
+		}
+		s.addr = change.addr
+		s.isIn = change.added
+	}
+
+	for _, addrStr := range order {
+		s := states[addrStr]
+		if s.isIn && !s.wasIn {
+			diff.Added = append(diff.Added, s.addr)
+		} else if !s.isIn && s.wasIn {
+			diff.Removed = append(diff.Removed, s.addr)
+		}
+	}
+	return diff
+}
+
+// WaitForPeers blocks until the set of peers (see PeerAddrs) contains at least
+// n peers, or the Context is done, in which case its error is returned. An
+// error is also returned if the Peer is closed while waiting, or if n is
+// greater than MaxPeers.
+//
+// Peers are only added as their HelloPeer messages are processed, so ReadFrom
+// must be called while waiting.
+func (p *Peer) WaitForPeers(ctx context.Context, n int) error {
+	for {
+		p.l.Lock()
+		if len(p.peers) >= n {
+			p.l.Unlock()
+			return nil
+		} else if n > p.po.MaxPeers {
+			p.l.Unlock()
+			return errors.New("can't wait for more than MaxPeers peers")
+		} else if p.peersChangedCh == nil {
+			p.peersChangedCh = make(chan struct{})
+		}
+		changedCh := p.peersChangedCh
+		p.l.Unlock()
+
+		select {
+		case <-changedCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.closeCh:
+			return errors.New("bonfire.Peer is closed")
+		}
+	}
+}
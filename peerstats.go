@@ -0,0 +1,66 @@
+package bonfire
+
+import "sync/atomic"
+
+// PeerStats describes the activity of a Peer since it was created.
+type PeerStats struct {
+	// Number of batches of bonfire messages (e.g. the HelloPeer messages sent
+	// to a newly met peer) which were queued to be sent in the background. See
+	// PeerOpts' SendQueueSize.
+	SendsQueued uint64
+
+	// Number of queued batches which were dropped without being sent, because
+	// the queue was full when a newer one was added.
+	SendsDropped uint64
+
+	// Number of application packets which were queued to be sent in the
+	// background by SendAsync, or by WriteTo and Send if PeerOpts' QueueSends
+	// is set.
+	AppSendsQueued uint64
+
+	// Number of queued application packets which were dropped without being
+	// sent, because the queue was full when a newer one was added.
+	AppSendsDropped uint64
+
+	// Number of packets which were dropped by PeerOpts' PacketFilter.
+	PacketsFiltered uint64
+
+	// Activity with each of the servers the Peer has used (up to the last 8),
+	// from the least to the most recently used, so the last is the server
+	// currently in use.
+	Servers []PeerServerStats
+
+	// Number of times the Peer's watchdog has acted, see PeerOpts'
+	// WatchdogTimeout.
+	WatchdogTrips uint64
+
+	// How long it took from the Peer (re-)bootstrapping to its first
+	// Handshake being answered by another peer, for each time it did. Only
+	// used if PeerOpts' HandshakePayload is set.
+	HandshakeLatency LatencyHistogram
+}
+
+// peerStats holds the counters making up PeerStats, which are updated
+// concurrently by the Peer's go-routines.
+type peerStats struct {
+	sendsQueued, sendsDropped       atomic.Uint64
+	appSendsQueued, appSendsDropped atomic.Uint64
+	packetsFiltered                 atomic.Uint64
+	watchdogTrips                   atomic.Uint64
+	handshakeLatency                latencyHistogram
+}
+
+// Stats returns the current PeerStats of the Peer.
+func (p *Peer) Stats() PeerStats {
+	return PeerStats{
+		SendsQueued:     p.stats.sendsQueued.Load(),
+		SendsDropped:    p.stats.sendsDropped.Load(),
+		AppSendsQueued:  p.stats.appSendsQueued.Load(),
+		AppSendsDropped: p.stats.appSendsDropped.Load(),
+		PacketsFiltered: p.stats.packetsFiltered.Load(),
+		Servers:         p.serverStatsSnapshot(),
+		WatchdogTrips:   p.stats.watchdogTrips.Load(),
+
+		HandshakeLatency: p.stats.handshakeLatency.snapshot(),
+	}
+}
@@ -0,0 +1,95 @@
+package bonfire
+
+import (
+	"errors"
+	"net"
+	"sort"
+)
+
+// TagPeer adds the given tags to the peer at the given address, which must be
+// in the set of peers (see PeerAddrs). Tags are arbitrary strings which the
+// application can use to categorize its peers (e.g. "relay" or "same-dc"), see
+// PeerAddrsWithTags. A peer's tags are discarded when it's removed from the
+// set of peers.
+func (p *Peer) TagPeer(addr net.Addr, tags ...string) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	addrStr := addr.String()
+	if _, ok := p.peers[addrStr]; !ok {
+		return errors.New("address is not in the set of peers")
+	}
+
+	if p.peerTags == nil {
+		p.peerTags = map[string]map[string]struct{}{}
+	}
+	peerTags := p.peerTags[addrStr]
+	if peerTags == nil {
+		peerTags = map[string]struct{}{}
+		p.peerTags[addrStr] = peerTags
+	}
+	for _, tag := range tags {
+		peerTags[tag] = struct{}{}
+	}
+	return nil
+}
+
+// UntagPeer removes the given tags from the peer at the given address, if it
+// has them.
+func (p *Peer) UntagPeer(addr net.Addr, tags ...string) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	addrStr := addr.String()
+	peerTags := p.peerTags[addrStr]
+	for _, tag := range tags {
+		delete(peerTags, tag)
+	}
+	if len(peerTags) == 0 {
+		delete(p.peerTags, addrStr)
+	}
+}
+
+// PeerTags returns the tags of the peer at the given address (see TagPeer),
+// sorted.
+func (p *Peer) PeerTags(addr net.Addr) []string {
+	p.l.RLock()
+	defer p.l.RUnlock()
+
+	peerTags := p.peerTags[addr.String()]
+	tags := make([]string, 0, len(peerTags))
+	for tag := range peerTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// PeerAddrsWithTags works like PeerAddrs, but only returns the addresses of
+// peers which have all of the given tags (see TagPeer).
+func (p *Peer) PeerAddrsWithTags(tags ...string) []net.Addr {
+	p.l.RLock()
+	defer p.l.RUnlock()
+
+	addrs := []net.Addr{}
+	for addrStr, addr := range p.peers {
+		if p.hasTags(addrStr, tags) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// hasTags returns whether the peer at the given address has all of the given
+// tags.
+//
+// This must be called with the lock held.
+func (p *Peer) hasTags(addrStr string, tags []string) bool {
+	peerTags := p.peerTags[addrStr]
+	for _, tag := range tags {
+		if _, ok := peerTags[tag]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package bonfire
+
+import (
+	"net"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerTags(t *T) {
+	peer := &Peer{po: PeerOpts{MaxPeers: 10}}
+	peer.clearPeers()
+	a, b, c := addrString("127.0.0.1:1"), addrString("127.0.0.1:2"), addrString("127.0.0.1:3")
+	peer.addPeer(a)
+	peer.addPeer(b)
+
+	massert.Require(t,
+		massert.Nil(peer.TagPeer(a, "relay", "storage")),
+		massert.Nil(peer.TagPeer(b, "relay")),
+		massert.Not(massert.Nil(peer.TagPeer(c, "relay"))),
+		massert.Equal([]string{"relay", "storage"}, peer.PeerTags(a)),
+		massert.Equal([]string{}, peer.PeerTags(c)),
+		massert.Length(peer.PeerAddrsWithTags("relay"), 2),
+		massert.Equal([]net.Addr{a}, peer.PeerAddrsWithTags("relay", "storage")),
+		massert.Length(peer.PeerAddrsWithTags(), 2),
+		massert.Length(peer.PeerAddrsWithTags("same-dc"), 0),
+	)
+
+	peer.UntagPeer(a, "storage")
+	massert.Require(t,
+		massert.Equal([]string{"relay"}, peer.PeerTags(a)),
+		massert.Length(peer.PeerAddrsWithTags("storage"), 0),
+	)
+
+	// tags are discarded along with the peer, and don't come back with it.
+	peer.removePeer(b.String())
+	peer.addPeer(b)
+	massert.Require(t,
+		massert.Equal([]string{}, peer.PeerTags(b)),
+		massert.Equal([]net.Addr{a}, peer.PeerAddrsWithTags("relay")),
+	)
+}
@@ -0,0 +1,88 @@
+package bonfire
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"net"
+)
+
+// sealer encrypts and decrypts blobs using a key shared by all peers in a
+// network, but not by the server.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal returns the encrypted form of the given candidates, prefixed with the
+// random nonce used.
+func (s *sealer) seal(candidates []net.Addr) ([]byte, error) {
+	w := &msgWriter{b: make([]byte, s.aead.NonceSize(), MaxMessageSize)}
+	if _, err := rand.Read(w.b); err != nil {
+		return nil, err
+	} else if err := w.writeCandidates("", candidates); err != nil {
+		return nil, err
+	}
+	nonce, plaintext := w.b[:s.aead.NonceSize()], w.b[s.aead.NonceSize():]
+	return s.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts a blob created by seal. It will return an error if the blob
+// was not sealed using the same key.
+func (s *sealer) open(sealed []byte) ([]net.Addr, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("sealed blob too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseCandidates(plaintext, false)
+}
+
+// privacyFingerprint generates a new fingerprint to be used for a single
+// HelloServer or ReadyToMingle message, and remembers it (along with the last
+// PrivacyFingerprints generated) so that messages sent to it are accepted.
+//
+// This must be called with the lock held.
+func (p *Peer) privacyFingerprint() ([]byte, error) {
+	fingerprint, err := p.genFingerprint()
+	if err != nil {
+		return nil, err
+	}
+	p.privacyFingerprints = append(p.privacyFingerprints, fingerprint)
+	if len(p.privacyFingerprints) > p.po.PrivacyFingerprints {
+		p.privacyFingerprints = p.privacyFingerprints[1:]
+	}
+	return fingerprint, nil
+}
+
+// isOwnFingerprint returns whether the given fingerprint is one which messages
+// meant for this Peer may be sent with.
+//
+// This must be called with the lock held.
+func (p *Peer) isOwnFingerprint(fingerprint []byte) bool {
+	if bytes.Equal(fingerprint, p.lastFingerprint) {
+		return true
+	}
+	for _, privacyFingerprint := range p.privacyFingerprints {
+		if bytes.Equal(fingerprint, privacyFingerprint) {
+			return true
+		}
+	}
+	return false
+}
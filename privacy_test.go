@@ -0,0 +1,104 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestSealer(t *T) {
+	key := mrand.Bytes(32)
+	s, err := newSealer(key)
+	massert.Require(t, massert.Nil(err))
+
+	candidates := []net.Addr{
+		addrString("192.168.1.2:6666"),
+		addrString("[fd00::2]:6666"),
+	}
+	sealed, err := s.seal(candidates)
+	massert.Require(t, massert.Nil(err))
+
+	opened, err := s.open(sealed)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(opened, 2),
+		massert.Equal(candidates[0].String(), opened[0].String()),
+		massert.Equal(candidates[1].String(), opened[1].String()),
+	)
+
+	// sealing with no candidates should still produce something which can be
+	// opened
+	sealed, err = s.seal(nil)
+	massert.Require(t, massert.Nil(err))
+	opened, err = s.open(sealed)
+	massert.Require(t, massert.Nil(err), massert.Length(opened, 0))
+
+	// a different key shouldn't be able to open it
+	s2, err := newSealer(mrand.Bytes(32))
+	massert.Require(t, massert.Nil(err))
+	_, err = s2.open(sealed)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	// nor should a missing blob
+	_, err = s.open(nil)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+}
+
+func TestPeerPrivacyFingerprints(t *T) {
+	peer := &Peer{po: PeerOpts{}.withDefaults()}
+	_, err := peer.fingerprint()
+	massert.Require(t, massert.Nil(err))
+
+	var fingerprints [][]byte
+	for i := 0; i < peer.po.PrivacyFingerprints+1; i++ {
+		fingerprint, err := peer.privacyFingerprint()
+		massert.Require(t, massert.Nil(err))
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	massert.Require(t,
+		massert.Equal(true, peer.isOwnFingerprint(peer.lastFingerprint)),
+		massert.Equal(false, peer.isOwnFingerprint(fingerprints[0])),
+		massert.Equal(true, peer.isOwnFingerprint(fingerprints[1])),
+		massert.Equal(true, peer.isOwnFingerprint(fingerprints[peer.po.PrivacyFingerprints])),
+		massert.Equal(false, peer.isOwnFingerprint(mrand.Bytes(FingerprintSize))),
+	)
+}
+
+func TestPeerPrivacyHelloServer(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// the server never responds, so the peer resends its HelloServer until
+	// the Context is done.
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer serverConn.Close()
+	go NewPeer(ctx, "udp", serverConn.LocalAddr().String(), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		PacketBlastCount:        3,
+		RampBlastCount:          true,
+		ListenAddr:              "127.0.0.1:0",
+		PrivacyKey:              mrand.Bytes(16),
+	})
+
+	fingerprints := map[string]bool{}
+	b := make([]byte, MaxMessageSize)
+	for len(fingerprints) < 3 {
+		serverConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := serverConn.ReadFrom(b)
+		massert.Require(t, massert.Nil(err))
+		var msg Message
+		massert.Require(t,
+			massert.Nil(msg.UnmarshalBinary(b[:n])),
+			massert.Equal(HelloServer, msg.Type),
+		)
+		// every HelloServer should have a fingerprint of its own
+		massert.Require(t, massert.Equal(false, fingerprints[string(msg.Fingerprint)]))
+		fingerprints[string(msg.Fingerprint)] = true
+	}
+}
@@ -0,0 +1,183 @@
+package bonfire
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// NATMapping describes how the NAT which a Peer is behind, if any, maps the
+// Peer's local address onto the addresses that others observe it at. It is
+// determined by ProbeNAT.
+type NATMapping int
+
+// Possible NATMapping values.
+const (
+	// NATMappingEndpointIndependent indicates that the Peer is observed at
+	// the same address by every host it sends to, which is the case when
+	// there's no NAT at all. Peers behind such a NAT can generally be
+	// introduced to any other.
+	NATMappingEndpointIndependent NATMapping = iota
+
+	// NATMappingEndpointDependent indicates that the Peer is observed at a
+	// different address by each host it sends to, i.e. it's behind a
+	// symmetric NAT. The address which the server observes isn't the one
+	// other peers will, so introductions to peers also behind such a NAT will
+	// generally fail.
+	NATMappingEndpointDependent
+)
+
+func (m NATMapping) String() string {
+	switch m {
+	case NATMappingEndpointIndependent:
+		return "EndpointIndependent"
+	case NATMappingEndpointDependent:
+		return "EndpointDependent"
+	default:
+		return fmt.Sprintf("NATMapping(%d)", int(m))
+	}
+}
+
+// NATProbe describes the result of ProbeNAT.
+type NATProbe struct {
+	Mapping NATMapping
+
+	// Addrs holds the address which the Peer was observed at by each server
+	// endpoint, in the order they were probed. The first is the server's main
+	// address, i.e. the one the Peer was created with.
+	Addrs []net.Addr
+}
+
+// ProbeNAT determines what sort of NAT the Peer is behind, by sending a Probe
+// message from its PacketConn to two endpoints of the server and comparing
+// the addresses which each observed it at. The server must have at least two
+// endpoints (see Server's ListenEndpoints), which it advertises in its
+// response to the first Probe; an error is returned otherwise.
+//
+// An error is returned if the Context is done before both endpoints answer.
+// Servers which predate Probe don't answer at all.
+//
+// As with WaitForPeers, ReadFrom must be called in order for the answers to be
+// processed.
+func (p *Peer) ProbeNAT(ctx context.Context) (NATProbe, error) {
+	p.l.Lock()
+	if p.serverAddrStr == "" {
+		p.l.Unlock()
+		return NATProbe{}, errors.New("a server address is required to probe the NAT")
+	}
+	serverAddr, err := p.serverAddr()
+	p.l.Unlock()
+	if err != nil {
+		return NATProbe{}, err
+	}
+
+	resp, err := p.probe(ctx, serverAddr)
+	if err != nil {
+		return NATProbe{}, err
+	}
+
+	altAddr := probeAltAddr(serverAddr, resp.Candidates)
+	if altAddr == nil {
+		return NATProbe{}, errors.New("server has no other endpoint to probe")
+	}
+
+	altResp, err := p.probe(ctx, altAddr)
+	if err != nil {
+		return NATProbe{}, fmt.Errorf("probing server endpoint %v: %w", altAddr, err)
+	}
+
+	res := NATProbe{
+		Mapping: NATMappingEndpointIndependent,
+		Addrs:   []net.Addr{resp.ProbeBody.Addr, altResp.ProbeBody.Addr},
+	}
+	if res.Addrs[0].String() != res.Addrs[1].String() {
+		res.Mapping = NATMappingEndpointDependent
+	}
+	return res, nil
+}
+
+// probeAltAddr returns the first of the endpoints advertised by the server at
+// serverAddr which differs from serverAddr, or nil. An endpoint listening on
+// an unspecified IP (e.g. 0.0.0.0) is assumed to be reachable on the IP of
+// serverAddr.
+func probeAltAddr(serverAddr net.Addr, endpoints []net.Addr) net.Addr {
+	serverUDPAddr, _ := serverAddr.(*net.UDPAddr)
+	for _, endpoint := range endpoints {
+		udpAddr, ok := endpoint.(*net.UDPAddr)
+		if !ok {
+			continue
+		} else if udpAddr.IP.IsUnspecified() && serverUDPAddr != nil {
+			udpAddr = &net.UDPAddr{IP: serverUDPAddr.IP, Port: udpAddr.Port}
+		}
+		if udpAddr.String() != serverAddr.String() {
+			return udpAddr
+		}
+	}
+	return nil
+}
+
+// probe sends a Probe message to the given server endpoint, and returns its
+// response.
+func (p *Peer) probe(ctx context.Context, dst net.Addr) (Message, error) {
+	ch := make(chan Message, 1)
+
+	p.l.Lock()
+	if p.probeChs == nil {
+		p.probeChs = map[string][]chan Message{}
+	}
+	key := dst.String()
+	p.probeChs[key] = append(p.probeChs[key], ch)
+	defer p.removeProbeCh(key, ch)
+
+	err := multiSend(p.newSendBatch(), dst, p.po.PacketBlastCount, Message{
+		Fingerprint: p.lastFingerprint,
+		Type:        Probe,
+	})
+	p.l.Unlock()
+	if err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	case <-p.closeCh:
+		return Message{}, errors.New("bonfire.Peer is closed")
+	}
+}
+
+func (p *Peer) removeProbeCh(key string, ch chan Message) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	chs := p.probeChs[key]
+	for i := range chs {
+		if chs[i] == ch {
+			chs = append(chs[:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(chs) == 0 {
+		delete(p.probeChs, key)
+	} else {
+		p.probeChs[key] = chs
+	}
+}
+
+// processProbe passes a Probe response on to all calls to ProbeNAT which are
+// waiting on the endpoint it came from. Probes from anywhere else are ignored.
+//
+// This must be called with the lock held.
+func (p *Peer) processProbe(addr net.Addr, msg Message) {
+	if msg.ProbeBody.Addr == nil {
+		return
+	}
+	for _, ch := range p.probeChs[addr.String()] {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
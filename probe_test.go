@@ -0,0 +1,130 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+// portShiftConn behaves like a NAT with an endpoint-dependent mapping, from
+// the point of view of a server listening on it: every peer appears to be at a
+// port one higher than it really is.
+type portShiftConn struct {
+	net.PacketConn
+}
+
+func (c portShiftConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		addr = &net.UDPAddr{IP: udpAddr.IP, Port: udpAddr.Port + 1}
+	}
+	return n, addr, err
+}
+
+func (c portShiftConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		addr = &net.UDPAddr{IP: udpAddr.IP, Port: udpAddr.Port - 1}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestPeerProbeNAT(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newServer := func(shiftAlt bool) (string, *Server) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		altConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+
+		server := NewServer()
+		if shiftAlt {
+			var n atomic.Int32
+			server.WrapConn = func(conn net.PacketConn) (net.PacketConn, error) {
+				if n.Add(1) == 2 {
+					return portShiftConn{conn}, nil
+				}
+				return conn, nil
+			}
+		}
+		go server.Serve(ctx, conn, altConn)
+		return conn.LocalAddr().String(), server
+	}
+
+	probe := func(serverAddr string) (NATProbe, *Peer, error) {
+		peer, err := NewPeer(ctx, "udp", serverAddr, &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			PacketBlastCount:        1,
+			ListenAddr:              "127.0.0.1:0",
+		})
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { peer.Close() })
+		peer.SetReadDeadline(time.Time{})
+		go func() {
+			b := make([]byte, MaxMessageSize)
+			for {
+				if _, _, err := peer.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		res, err := peer.ProbeNAT(ctx)
+		return res, peer, err
+	}
+
+	t.Run("independent", func(t *T) {
+		serverAddr, server := newServer(false)
+		res, peer, err := probe(serverAddr)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(NATMappingEndpointIndependent, res.Mapping),
+			massert.Length(res.Addrs, 2),
+		)
+		massert.Require(t,
+			massert.Equal(peer.LocalAddr().String(), res.Addrs[0].String()),
+			massert.Equal(peer.LocalAddr().String(), res.Addrs[1].String()),
+			massert.Equal(uint64(2), server.Stats().Probes),
+		)
+	})
+
+	t.Run("dependent", func(t *T) {
+		serverAddr, _ := newServer(true)
+		res, _, err := probe(serverAddr)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(NATMappingEndpointDependent, res.Mapping),
+		)
+	})
+
+	t.Run("single endpoint", func(t *T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		go NewServer().Serve(ctx, conn)
+		_, _, err = probe(conn.LocalAddr().String())
+		massert.Require(t, massert.Not(massert.Nil(err)))
+	})
+}
+
+func TestProbeAltAddr(t *T) {
+	serverAddr := addrString("1.2.3.4:6666")
+	massert.Require(t,
+		massert.Nil(probeAltAddr(serverAddr, nil)),
+		massert.Nil(probeAltAddr(serverAddr, []net.Addr{serverAddr})),
+		massert.Equal(
+			"1.2.3.4:7777",
+			probeAltAddr(serverAddr, []net.Addr{addrString("0.0.0.0:7777")}).String(),
+		),
+		massert.Equal(
+			"5.6.7.8:6666",
+			probeAltAddr(serverAddr, []net.Addr{serverAddr, addrString("5.6.7.8:6666")}).String(),
+		),
+	)
+}
@@ -0,0 +1,102 @@
+package bonfire
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ProtocolID is the first byte of every packet multiplexed over a Peer's
+// socket, and is used to determine which protocol the packet belongs to.
+//
+// IDs below MinAppProtocolID are reserved for bonfire itself (the first byte of
+// a bonfire message is its version, which will always fall within this range).
+// Applications may register any ID from MinAppProtocolID up.
+type ProtocolID byte
+
+// MinAppProtocolID is the smallest ProtocolID which may be registered by an
+// application using RegisterProtocol.
+const MinAppProtocolID ProtocolID = 16
+
+// Packet describes a single packet which has been received from a remote
+// address on behalf of a registered protocol.
+type Packet struct {
+	Addr net.Addr
+
+	// B does not contain the leading ProtocolID byte.
+	B []byte
+}
+
+// RegisterProtocol registers the given ProtocolID with the Peer. All incoming
+// packets whose first byte is that ID will have that byte stripped and will be
+// written to the given channel, rather than being returned from ReadFrom. If
+// the channel blocks the packet will be dropped.
+//
+// As with other bonfire processing, ReadFrom must be called repeatedly in order
+// for packets to be routed.
+//
+// Packets for a registered protocol should be sent using WriteToProtocol, so
+// that they are prefixed with the ID.
+func (p *Peer) RegisterProtocol(id ProtocolID, ch chan<- Packet) error {
+	if id < MinAppProtocolID {
+		return fmt.Errorf("protocol id %d is reserved for bonfire", id)
+	} else if ch == nil {
+		return errors.New("nil channel passed to RegisterProtocol")
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	if _, ok := p.protocols[id]; ok {
+		return fmt.Errorf("protocol id %d is already registered", id)
+	}
+	p.protocols[id] = ch
+	return nil
+}
+
+// UnregisterProtocol removes a ProtocolID which was previously registered using
+// RegisterProtocol. Packets for that ID will be returned from ReadFrom again.
+func (p *Peer) UnregisterProtocol(id ProtocolID) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	delete(p.protocols, id)
+}
+
+// WriteToProtocol writes the given bytes to the given address, prefixed with
+// the given ProtocolID. The returned int will not include the prefix byte.
+func (p *Peer) WriteToProtocol(id ProtocolID, b []byte, addr net.Addr) (int, error) {
+	if id < MinAppProtocolID {
+		return 0, fmt.Errorf("protocol id %d is reserved for bonfire", id)
+	}
+
+	pb := make([]byte, len(b)+1)
+	pb[0] = byte(id)
+	copy(pb[1:], b)
+	n, err := p.PacketConn.WriteTo(pb, addr)
+	if n > 0 {
+		n--
+	}
+	return n, err
+}
+
+// routeProtocol returns true if the given packet belongs to a registered
+// protocol, in which case it has been handled.
+func (p *Peer) routeProtocol(b []byte, addr net.Addr) bool {
+	if len(b) == 0 || ProtocolID(b[0]) < MinAppProtocolID {
+		return false
+	}
+
+	p.l.RLock()
+	ch, ok := p.protocols[ProtocolID(b[0])]
+	p.l.RUnlock()
+	if !ok {
+		return false
+	}
+
+	pkt := Packet{Addr: addr, B: make([]byte, len(b)-1)}
+	copy(pkt.B, b[1:])
+	select {
+	case ch <- pkt:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package bonfire
+
+import (
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestProtocolRouting(t *T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	peer := &Peer{
+		PacketConn: listen(),
+		protocols:  map[ProtocolID]chan<- Packet{},
+	}
+	defer peer.PacketConn.Close()
+	other := listen()
+	defer other.Close()
+
+	ch := make(chan Packet, 1)
+	massert.Require(t,
+		massert.Not(massert.Nil(peer.RegisterProtocol(0, ch))),
+		massert.Not(massert.Nil(peer.RegisterProtocol(MinAppProtocolID-1, ch))),
+		massert.Nil(peer.RegisterProtocol(MinAppProtocolID, ch)),
+		massert.Not(massert.Nil(peer.RegisterProtocol(MinAppProtocolID, ch))),
+	)
+
+	// a payload starting with 0x00, which would otherwise look like a bonfire
+	// message version
+	routed := append([]byte{0}, mrand.Bytes(99)...)
+	routedPB := append([]byte{byte(MinAppProtocolID)}, routed...)
+	unrouted := append([]byte{byte(MinAppProtocolID + 1)}, mrand.Bytes(99)...)
+
+	if _, err := other.WriteTo(routedPB, peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	} else if _, err := other.WriteTo(unrouted, peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	peer.SetReadDeadline(time.Now().Add(1 * time.Second))
+	b := make([]byte, MaxMessageSize)
+	n, _, err := peer.ReadFrom(b)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(unrouted, b[:n]),
+	)
+
+	pkt := <-ch
+	massert.Require(t,
+		massert.Equal(routed, pkt.B),
+		massert.Equal(other.LocalAddr().String(), pkt.Addr.String()),
+	)
+
+	// ensure WriteToProtocol prefixes the id
+	n, err = peer.WriteToProtocol(MinAppProtocolID, routed, other.LocalAddr())
+	massert.Require(t, massert.Nil(err), massert.Equal(len(routed), n))
+	other.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, _, err = other.ReadFrom(b)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(routedPB, b[:n]),
+	)
+}
@@ -0,0 +1,226 @@
+package bonfire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// proxyV2Sig is the signature which every PROXY protocol version 2 header
+// begins with.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyV2FixedSize is the size of a PROXY protocol version 2 header, not
+	// including its address block.
+	proxyV2FixedSize = 16
+
+	// proxyMaxHeaderSize is the largest PROXY protocol header, address block
+	// and TLVs included, which a ProxyConn will accept. Packets with larger
+	// headers are dropped.
+	proxyMaxHeaderSize = 512
+)
+
+// ProxyConnOpts are parameters to NewProxyConn. Only TrustedProxies is
+// required.
+type ProxyConnOpts struct {
+	// Only packets coming from these networks are accepted, all others being
+	// dropped. Since the PROXY header can claim any source address, this must
+	// be set to the networks of the load balancer, and must not include any
+	// from which others can reach the ProxyConn's port. Required.
+	TrustedProxies []*net.IPNet
+
+	// How long the ProxyConn remembers which proxy address a source address
+	// was last seen through, so that packets written to the source address
+	// are sent back through the same proxy. This should be at least the
+	// Server's ReadyToMingleTimeout, so that Meet messages sent to
+	// ready-to-mingle peers go through the proxy. Default is 5 minutes.
+	FlowTimeout time.Duration
+
+	// If true, packets are always written directly to their destination,
+	// rather than back through the proxy which the destination was seen
+	// through. This is for load balancers which use direct server return.
+	DirectReplies bool
+}
+
+func (o ProxyConnOpts) withDefaults() ProxyConnOpts {
+	if o.FlowTimeout == 0 {
+		o.FlowTimeout = 5 * time.Minute
+	}
+	return o
+}
+
+// proxyFlow describes the proxy address which a source address was last seen
+// through.
+type proxyFlow struct {
+	proxy    net.Addr
+	lastSeen time.Time
+}
+
+// ProxyConn wraps a PacketConn which receives its packets through a UDP load
+// balancer (or DDoS-scrubbing layer, or other proxy) which prepends a PROXY
+// protocol version 2 header to each packet, carrying the packet's original
+// source address. ReadFrom strips the header and returns the original source
+// address, so that a Server can introduce peers to each other by their real
+// addresses. Packets without a valid header are dropped.
+//
+// Packets written to an address are sent, without any header, to the proxy
+// address which that address was most recently seen through (see
+// ProxyConnOpts' FlowTimeout and DirectReplies). Addresses which haven't been
+// seen at all are written to directly.
+//
+// A ProxyConn is intended to be passed to Server's Serve, alongside any other
+// endpoints which peers reach directly. Peers themselves don't need to know
+// that the proxy exists.
+type ProxyConn struct {
+	net.PacketConn
+	opts    ProxyConnOpts
+	bufPool sync.Pool
+
+	l         sync.Mutex
+	flows     map[string]proxyFlow
+	lastPrune time.Time
+}
+
+// NewProxyConn wraps the PacketConn in a ProxyConn. An error is returned if
+// opts doesn't have any TrustedProxies.
+func NewProxyConn(conn net.PacketConn, opts *ProxyConnOpts) (*ProxyConn, error) {
+	if opts == nil || len(opts.TrustedProxies) == 0 {
+		return nil, errors.New("ProxyConnOpts' TrustedProxies must be set")
+	}
+	return &ProxyConn{
+		PacketConn: conn,
+		opts:       opts.withDefaults(),
+		flows:      map[string]proxyFlow{},
+		lastPrune:  time.Now(),
+	}, nil
+}
+
+// parseProxyHeader parses the PROXY protocol version 2 header at the start of
+// the packet, returning the size of the header and the original source address
+// it describes. The address is nil if the header doesn't describe one, e.g.
+// for health checks from the proxy itself. ok is false if the packet doesn't
+// begin with a valid header.
+func parseProxyHeader(b []byte) (n int, src net.Addr, ok bool) {
+	if len(b) < proxyV2FixedSize || !bytes.Equal(b[:12], proxyV2Sig) {
+		return 0, nil, false
+	}
+
+	verCmd, fam := b[12], b[13]
+	n = proxyV2FixedSize + int(binary.BigEndian.Uint16(b[14:16]))
+	if verCmd>>4 != 2 || n > len(b) {
+		return 0, nil, false
+	}
+	addrs := b[proxyV2FixedSize:n]
+
+	switch verCmd & 0xf {
+	case 0: // LOCAL
+		return n, nil, true
+	case 1: // PROXY
+	default:
+		return 0, nil, false
+	}
+
+	// only UDP over IPv4 or IPv6 carries an address which bonfire can use,
+	// the addresses of other families are ignored as with LOCAL.
+	var ipLen int
+	switch fam {
+	case 0x12:
+		ipLen = net.IPv4len
+	case 0x22:
+		ipLen = net.IPv6len
+	default:
+		return n, nil, true
+	}
+
+	if len(addrs) < 2*ipLen+4 {
+		return 0, nil, false
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, addrs[:ipLen])
+	port := binary.BigEndian.Uint16(addrs[2*ipLen:])
+	return n, &net.UDPAddr{IP: ip, Port: int(port)}, true
+}
+
+// trusted returns whether packets from the given proxy address are accepted.
+func (c *ProxyConn) trusted(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range c.opts.TrustedProxies {
+		if ipNet.Contains(udpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// observe records that the source address was seen through the proxy address,
+// and prunes the flows which have timed out every so often.
+func (c *ProxyConn) observe(src, proxy net.Addr) {
+	now := time.Now()
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.flows[src.String()] = proxyFlow{proxy: proxy, lastSeen: now}
+
+	if now.Sub(c.lastPrune) < c.opts.FlowTimeout {
+		return
+	}
+	c.lastPrune = now
+	for addrStr, flow := range c.flows {
+		if now.Sub(flow.lastSeen) > c.opts.FlowTimeout {
+			delete(c.flows, addrStr)
+		}
+	}
+}
+
+// ReadFrom implements the method for the net.PacketConn interface. The
+// returned address is the packet's original source, as described by its PROXY
+// header, or the proxy's own address if the header doesn't describe one.
+// Packets which don't have a valid header, or which come from untrusted
+// proxies, are dropped, and reading continues with the next.
+func (c *ProxyConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	bp, _ := c.bufPool.Get().(*[]byte)
+	if bp == nil || cap(*bp) < len(b)+proxyMaxHeaderSize {
+		buf := make([]byte, len(b)+proxyMaxHeaderSize)
+		bp = &buf
+	}
+	*bp = (*bp)[:len(b)+proxyMaxHeaderSize]
+	defer c.bufPool.Put(bp)
+
+	for {
+		n, proxy, err := c.PacketConn.ReadFrom(*bp)
+		if err != nil {
+			return 0, proxy, err
+		} else if !c.trusted(proxy) {
+			continue
+		}
+
+		hdrLen, src, ok := parseProxyHeader((*bp)[:n])
+		if !ok || n-hdrLen > len(b) {
+			continue
+		} else if src == nil {
+			src = proxy
+		} else if !c.opts.DirectReplies {
+			c.observe(src, proxy)
+		}
+		return copy(b, (*bp)[hdrLen:n]), src, nil
+	}
+}
+
+// WriteTo implements the method for the net.PacketConn interface.
+func (c *ProxyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if !c.opts.DirectReplies {
+		c.l.Lock()
+		flow, ok := c.flows[addr.String()]
+		c.l.Unlock()
+		if ok && time.Since(flow.lastSeen) <= c.opts.FlowTimeout {
+			addr = flow.proxy
+		}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
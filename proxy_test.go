@@ -0,0 +1,209 @@
+package bonfire
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+// appendProxyHeader appends a PROXY protocol version 2 header to b, describing
+// a UDP packet from src to dst, which must both be UDP addresses of the same
+// family.
+func appendProxyHeader(b []byte, src, dst *net.UDPAddr) []byte {
+	fam, srcIP, dstIP := byte(0x12), src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		fam, srcIP, dstIP = 0x22, src.IP.To16(), dst.IP.To16()
+	}
+	b = append(b, proxyV2Sig...)
+	b = append(b, 0x21, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(2*len(srcIP)+4))
+	b = append(b, srcIP...)
+	b = append(b, dstIP...)
+	b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+	return binary.BigEndian.AppendUint16(b, uint16(dst.Port))
+}
+
+func TestParseProxyHeader(t *T) {
+	v4Src, v4Dst := addrString("1.2.3.4:5678").(*net.UDPAddr), addrString("10.0.0.1:7890").(*net.UDPAddr)
+	v6Src, v6Dst := addrString("[2001:db8::1]:5678").(*net.UDPAddr), addrString("[2001:db8::2]:7890").(*net.UDPAddr)
+
+	b := appendProxyHeader(nil, v4Src, v4Dst)
+	n, src, ok := parseProxyHeader(append(b, "payload"...))
+	massert.Require(t,
+		massert.Equal(true, ok),
+		massert.Equal(len(b), n),
+		massert.Equal(v4Src.String(), src.String()),
+	)
+
+	b = appendProxyHeader(nil, v6Src, v6Dst)
+	n, src, ok = parseProxyHeader(b)
+	massert.Require(t,
+		massert.Equal(true, ok),
+		massert.Equal(len(b), n),
+		massert.Equal(v6Src.String(), src.String()),
+	)
+
+	// TLVs following the addresses are skipped over
+	tlv := []byte{0x04, 0, 2, 'h', 'i'}
+	b = appendProxyHeader(nil, v4Src, v4Dst)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-proxyV2FixedSize+len(tlv)))
+	b = append(b, tlv...)
+	n, src, ok = parseProxyHeader(b)
+	massert.Require(t,
+		massert.Equal(true, ok),
+		massert.Equal(len(b), n),
+		massert.Equal(v4Src.String(), src.String()),
+	)
+
+	// a LOCAL header describes no address
+	local := append(append([]byte(nil), proxyV2Sig...), 0x20, 0, 0, 0)
+	n, src, ok = parseProxyHeader(local)
+	massert.Require(t,
+		massert.Equal(true, ok),
+		massert.Equal(len(local), n),
+		massert.Nil(src),
+	)
+
+	b = appendProxyHeader(nil, v4Src, v4Dst)
+	for _, invalid := range [][]byte{
+		nil,
+		[]byte("payload"),
+		b[:len(b)-1],
+		append(append([]byte(nil), b[:12]...), 0x11, b[13], b[14], b[15]),
+		append(append([]byte(nil), b[:12]...), 0x22, b[13], b[14], b[15]),
+	} {
+		_, _, ok := parseProxyHeader(invalid)
+		massert.Require(t, massert.Equal(false, ok))
+	}
+}
+
+// fakeProxy forwards packets from clients to a server, prepending a PROXY
+// header to each, using a separate upstream PacketConn for each client so that
+// the server's responses can be forwarded back to it.
+type fakeProxy struct {
+	front  net.PacketConn
+	server net.Addr
+
+	l         sync.Mutex
+	upstreams map[string]net.PacketConn
+}
+
+func (fp *fakeProxy) run() {
+	b := make([]byte, MaxMessageSize)
+	for {
+		n, client, err := fp.front.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		fp.l.Lock()
+		up, ok := fp.upstreams[client.String()]
+		if !ok {
+			if up, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+				fp.l.Unlock()
+				return
+			}
+			fp.upstreams[client.String()] = up
+			go func() {
+				b := make([]byte, MaxMessageSize)
+				for {
+					n, _, err := up.ReadFrom(b)
+					if err != nil {
+						return
+					}
+					fp.front.WriteTo(b[:n], client)
+				}
+			}()
+		}
+		fp.l.Unlock()
+
+		pkt := appendProxyHeader(nil, client.(*net.UDPAddr), fp.front.LocalAddr().(*net.UDPAddr))
+		up.WriteTo(append(pkt, b[:n]...), fp.server)
+	}
+}
+
+func (fp *fakeProxy) close() {
+	fp.front.Close()
+	fp.l.Lock()
+	defer fp.l.Unlock()
+	for _, up := range fp.upstreams {
+		up.Close()
+	}
+}
+
+func TestServerProxyConn(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	serverConn := listen()
+	server := NewServer()
+	// the proxy's networks must be given.
+	_, err := NewProxyConn(serverConn, nil)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+	_, err = NewProxyConn(serverConn, &ProxyConnOpts{})
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	proxyConn, err := NewProxyConn(serverConn, &ProxyConnOpts{
+		TrustedProxies: []*net.IPNet{loopback},
+	})
+	massert.Require(t, massert.Nil(err))
+	go server.Serve(ctx, proxyConn)
+
+	fp := &fakeProxy{
+		front:     listen(),
+		server:    serverConn.LocalAddr(),
+		upstreams: map[string]net.PacketConn{},
+	}
+	go fp.run()
+	defer fp.close()
+
+	newPeer := func() *Peer {
+		peer, err := NewPeer(ctx, "udp", fp.front.LocalAddr().String(), &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			ListenAddr:              "127.0.0.1:0",
+		})
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { peer.Close() })
+		peer.SetReadDeadline(time.Time{})
+		go func() {
+			b := make([]byte, MaxMessageSize)
+			for {
+				if _, _, err := peer.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+		return peer
+	}
+
+	// the server sees the peers by their real addresses, rather than those
+	// of the proxy, and so introduces them to each other correctly.
+	peerA := newPeer()
+	for len(server.Minglers()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	massert.Require(t,
+		massert.Equal(peerA.LocalAddr().String(), server.Minglers()[0].Addr.String()),
+	)
+
+	peerB := newPeer()
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	massert.Require(t, massert.Nil(peerB.WaitForPeers(waitCtx, 1)))
+	massert.Require(t,
+		massert.Equal(peerA.LocalAddr().String(), peerB.PeerAddrs()[0].String()),
+	)
+}
@@ -0,0 +1,46 @@
+package bonfire
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+// pskNonceSize is the number of random bytes at the start of a fingerprint
+// generated by PSKFingerprintFunc, the rest being their HMAC-SHA256.
+const pskNonceSize = FingerprintSize - sha256.Size
+
+func pskMAC(key, nonce []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+// PSKFingerprintFunc returns a function, to be used as PeerOpts'
+// FingerprintFunc, which generates fingerprints proving knowledge of the given
+// pre-shared key: each is 32 random bytes followed by their HMAC-SHA256 using
+// the key. A Server can require that peers know the key by using
+// PSKFingerprintCheck with the same key. The key isn't revealed by the
+// fingerprints, but any fingerprint observed on the network can be replayed.
+func PSKFingerprintFunc(key []byte) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		fingerprint := make([]byte, pskNonceSize, FingerprintSize)
+		if _, err := rand.Read(fingerprint); err != nil {
+			return nil, err
+		}
+		return append(fingerprint, pskMAC(key, fingerprint)...), nil
+	}
+}
+
+// PSKFingerprintCheck returns a function, to be used as Server's
+// FingerprintCheck (and/or OccupancyCheck), which only accepts fingerprints
+// generated by PSKFingerprintFunc with the same pre-shared key.
+func PSKFingerprintCheck(key []byte) func([]byte) bool {
+	return func(fingerprint []byte) bool {
+		if len(fingerprint) != FingerprintSize {
+			return false
+		}
+		nonce, mac := fingerprint[:pskNonceSize], fingerprint[pskNonceSize:]
+		return hmac.Equal(mac, pskMAC(key, nonce))
+	}
+}
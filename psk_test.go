@@ -0,0 +1,38 @@
+package bonfire
+
+import (
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPSKFingerprint(t *T) {
+	key := mrand.Bytes(32)
+	gen, check := PSKFingerprintFunc(key), PSKFingerprintCheck(key)
+
+	fingerprint, err := gen()
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Length(fingerprint, FingerprintSize),
+		massert.Equal(true, check(fingerprint)),
+	)
+
+	// fingerprints are random, so successive ones can't be linked by
+	// comparing them.
+	fingerprint2, err := gen()
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Not(massert.Equal(fingerprint, fingerprint2)),
+		massert.Equal(true, check(fingerprint2)),
+	)
+
+	// a different key, a tampered fingerprint, or a random one all fail.
+	massert.Require(t,
+		massert.Equal(false, PSKFingerprintCheck(mrand.Bytes(32))(fingerprint)),
+		massert.Equal(false, check(mrand.Bytes(FingerprintSize))),
+		massert.Equal(false, check(fingerprint[:FingerprintSize-1])),
+	)
+	fingerprint[0] ^= 1
+	massert.Require(t, massert.Equal(false, check(fingerprint)))
+}
@@ -0,0 +1,373 @@
+package bonfire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// recordMagic begins every recording written due to PeerOpts' RecordWriter.
+const recordMagic = "bfrec\x00"
+
+// RecordDirection indicates whether a RecordedPacket was received or sent.
+type RecordDirection byte
+
+// Possible RecordDirection values.
+const (
+	RecordIn RecordDirection = iota
+	RecordOut
+)
+
+func (d RecordDirection) String() string {
+	switch d {
+	case RecordIn:
+		return "In"
+	case RecordOut:
+		return "Out"
+	default:
+		return fmt.Sprintf("RecordDirection(%d)", byte(d))
+	}
+}
+
+// RecordedPacket describes a single packet which was received or sent by a
+// Peer.
+type RecordedPacket struct {
+	Time time.Time
+	Dir  RecordDirection
+
+	// The address the packet was received from or sent to.
+	Addr net.Addr
+
+	Data []byte
+}
+
+// Recording is the decoded form of everything written to a PeerOpts'
+// RecordWriter.
+type Recording struct {
+	// The local address of the Peer's socket when recording began.
+	LocalAddr net.Addr
+
+	Packets []RecordedPacket
+}
+
+// recorder writes packets to a RecordWriter. Packet records are written as:
+//
+//	[time (unix nanoseconds):8][dir:1][addr len:1][addr][data len:2][data]
+//
+// following a header of recordMagic and the length-prefixed local address.
+type recorder struct {
+	l     sync.Mutex
+	w     io.Writer
+	errFn func(error)
+	err   error
+	buf   []byte
+}
+
+func appendRecordAddr(b []byte, addr net.Addr) []byte {
+	str := addr.String()
+	if len(str) > 255 {
+		str = str[:255]
+	}
+	b = append(b, byte(len(str)))
+	return append(b, str...)
+}
+
+func newRecorder(w io.Writer, localAddr net.Addr, errFn func(error)) (*recorder, error) {
+	b := appendRecordAddr([]byte(recordMagic), localAddr)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	return &recorder{w: w, errFn: errFn}, nil
+}
+
+// record writes a record of the packet. If writing fails then errFn is called
+// and nothing further is recorded.
+func (r *recorder) record(dir RecordDirection, addr net.Addr, data []byte) {
+	if r == nil {
+		return
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.err != nil {
+		return
+	}
+
+	b := binary.BigEndian.AppendUint64(r.buf[:0], uint64(time.Now().UnixNano()))
+	b = append(b, byte(dir))
+	b = appendRecordAddr(b, addr)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	b = append(b, data...)
+	r.buf = b
+
+	if _, r.err = r.w.Write(b); r.err != nil {
+		r.errFn(fmt.Errorf("writing to RecordWriter: %w", r.err))
+	}
+}
+
+// recordedAddr is used for addresses in a Recording which can't be parsed as a
+// UDP address.
+type recordedAddr string
+
+func (a recordedAddr) Network() string { return "udp" }
+func (a recordedAddr) String() string  { return string(a) }
+
+func readRecordAddr(r *bufio.Reader) (net.Addr, error) {
+	l, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if addr, err := net.ResolveUDPAddr("udp", string(b)); err == nil && addr.IP != nil {
+		return addr, nil
+	}
+	return recordedAddr(b), nil
+}
+
+// ReadRecording decodes everything which was written to a PeerOpts'
+// RecordWriter. If the recording was cut off part way through a packet, all
+// packets prior to that one are returned along with io.ErrUnexpectedEOF.
+func ReadRecording(r io.Reader) (Recording, error) {
+	br := bufio.NewReader(r)
+	var rec Recording
+
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != recordMagic {
+		return rec, errors.New("not a bonfire recording")
+	}
+
+	var err error
+	if rec.LocalAddr, err = readRecordAddr(br); err != nil {
+		return rec, fmt.Errorf("reading local address: %w", err)
+	}
+
+	for {
+		var head [9]byte
+		if _, err := io.ReadFull(br, head[:]); err == io.EOF {
+			return rec, nil
+		} else if err != nil {
+			return rec, io.ErrUnexpectedEOF
+		}
+
+		pkt := RecordedPacket{
+			Time: time.Unix(0, int64(binary.BigEndian.Uint64(head[:8]))),
+			Dir:  RecordDirection(head[8]),
+		}
+		if pkt.Addr, err = readRecordAddr(br); err != nil {
+			return rec, io.ErrUnexpectedEOF
+		}
+
+		var l [2]byte
+		if _, err := io.ReadFull(br, l[:]); err != nil {
+			return rec, io.ErrUnexpectedEOF
+		}
+		pkt.Data = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(br, pkt.Data); err != nil {
+			return rec, io.ErrUnexpectedEOF
+		}
+		rec.Packets = append(rec.Packets, pkt)
+	}
+}
+
+// Out returns only those packets in the Recording which were sent.
+func (rec Recording) Out() []RecordedPacket {
+	var pkts []RecordedPacket
+	for _, pkt := range rec.Packets {
+		if pkt.Dir == RecordOut {
+			pkts = append(pkts, pkt)
+		}
+	}
+	return pkts
+}
+
+// replayIn is an inbound packet of a ReplayConn, along with the number of
+// packets which were sent prior to it being received.
+type replayIn struct {
+	RecordedPacket
+	outBefore int
+}
+
+// ReplayConn is a net.PacketConn which replays the received packets of a
+// Recording, for the purpose of reproducing the behavior of a Peer (see
+// NewPeerConn) or Server under test.
+//
+// Each received packet is only returned from ReadFrom once as many packets
+// have been written to the ReplayConn as had been sent prior to it in the
+// Recording, so that responses don't arrive before the requests which caused
+// them. Once all packets have been returned ReadFrom blocks until its
+// deadline, or until the ReplayConn is closed.
+type ReplayConn struct {
+	rec Recording
+	in  []replayIn
+
+	l            sync.Mutex
+	next         int
+	written      []RecordedPacket
+	readDeadline time.Time
+	changedCh    chan struct{} // closed and replaced whenever the above change
+	closed       bool
+}
+
+var _ net.PacketConn = new(ReplayConn)
+
+// NewReplayConn initializes and returns a ReplayConn for the given Recording.
+func NewReplayConn(rec Recording) *ReplayConn {
+	c := &ReplayConn{rec: rec, changedCh: make(chan struct{})}
+	var outBefore int
+	for _, pkt := range rec.Packets {
+		if pkt.Dir == RecordOut {
+			outBefore++
+			continue
+		}
+		c.in = append(c.in, replayIn{RecordedPacket: pkt, outBefore: outBefore})
+	}
+	return c
+}
+
+// this must be called with the lock held.
+func (c *ReplayConn) changed() {
+	close(c.changedCh)
+	c.changedCh = make(chan struct{})
+}
+
+// ReadFrom implements the method for the net.PacketConn interface.
+func (c *ReplayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.l.Lock()
+		if c.closed {
+			c.l.Unlock()
+			return 0, nil, net.ErrClosed
+		} else if c.next < len(c.in) && len(c.written) >= c.in[c.next].outBefore {
+			pkt := c.in[c.next]
+			c.next++
+			c.l.Unlock()
+			return copy(b, pkt.Data), pkt.Addr, nil
+		}
+		deadline, changedCh := c.readDeadline, c.changedCh
+		c.l.Unlock()
+
+		var timer *time.Timer
+		var timeoutCh <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeoutCh = timer.C
+		}
+
+		select {
+		case <-changedCh:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-timeoutCh:
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// WriteTo implements the method for the net.PacketConn interface. Written
+// packets are kept, see Written.
+func (c *ReplayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.written = append(c.written, RecordedPacket{
+		Time: time.Now(),
+		Dir:  RecordOut,
+		Addr: addr,
+		Data: append([]byte(nil), b...),
+	})
+	c.changed()
+	return len(b), nil
+}
+
+// Written returns all packets which have been written to the ReplayConn so
+// far, which can be compared to the Recording's Out packets.
+func (c *ReplayConn) Written() []RecordedPacket {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return append([]RecordedPacket(nil), c.written...)
+}
+
+// FingerprintFunc returns a function, suitable for PeerOpts' FingerprintFunc,
+// which returns the fingerprints the recorded Peer used for its HelloServer
+// and ReadyToMingle messages, in the order they were first used. This allows
+// the replayed packets, which refer to those fingerprints, to be recognized.
+func (c *ReplayConn) FingerprintFunc() func() ([]byte, error) {
+	var fingerprints [][]byte
+	seen := map[string]bool{}
+	for _, pkt := range c.rec.Packets {
+		var msg Message
+		if pkt.Dir != RecordOut || msg.UnmarshalBinary(pkt.Data) != nil {
+			continue
+		} else if msg.Type != HelloServer && msg.Type != ReadyToMingle {
+			continue
+		} else if seen[string(msg.Fingerprint)] {
+			continue
+		}
+		seen[string(msg.Fingerprint)] = true
+		fingerprints = append(fingerprints, msg.Fingerprint)
+	}
+
+	var l sync.Mutex
+	return func() ([]byte, error) {
+		l.Lock()
+		defer l.Unlock()
+		if len(fingerprints) == 0 {
+			return nil, errors.New("no more fingerprints in recording")
+		}
+		fp := fingerprints[0]
+		fingerprints = fingerprints[1:]
+		return fp, nil
+	}
+}
+
+// Close implements the method for the net.PacketConn interface.
+func (c *ReplayConn) Close() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.closed = true
+	c.changed()
+	return nil
+}
+
+// LocalAddr implements the method for the net.PacketConn interface, returning
+// the Recording's LocalAddr.
+func (c *ReplayConn) LocalAddr() net.Addr {
+	return c.rec.LocalAddr
+}
+
+// SetDeadline implements the method for the net.PacketConn interface. Writes
+// never block, so only the read deadline is relevant.
+func (c *ReplayConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements the method for the net.PacketConn interface.
+func (c *ReplayConn) SetReadDeadline(t time.Time) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.readDeadline = t
+	c.changed()
+	return nil
+}
+
+// SetWriteDeadline implements the method for the net.PacketConn interface.
+// Writes never block, so this does nothing.
+func (c *ReplayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
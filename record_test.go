@@ -0,0 +1,79 @@
+package bonfire
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestRecordReplay(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer().Serve(ctx, conn)
+	serverAddr := conn.LocalAddr().String()
+
+	buf := new(bytes.Buffer)
+	peer, err := NewPeer(ctx, "udp", serverAddr, &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		ReadyToMingleInterval:   -1,
+		ListenAddr:              "127.0.0.1:0",
+		RecordWriter:            buf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteAddr := peer.RemoteAddr()
+	peer.Close()
+
+	b := buf.Bytes()
+	rec, err := ReadRecording(bytes.NewReader(b))
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Equal(peer.LocalAddr().String(), rec.LocalAddr.String()),
+		massert.Length(rec.Out(), 3), // HelloServer * PacketBlastCount
+		massert.Equal(RecordIn, rec.Packets[len(rec.Packets)-1].Dir),
+		massert.Equal(serverAddr, rec.Packets[len(rec.Packets)-1].Addr.String()),
+	)
+
+	// a truncated recording returns what it can
+	truncRec, err := ReadRecording(bytes.NewReader(b[:len(b)-1]))
+	massert.Require(t,
+		massert.Equal(io.ErrUnexpectedEOF, err),
+		massert.Length(truncRec.Packets, len(rec.Packets)-1),
+	)
+
+	// replaying the recording into a new Peer should result in it behaving
+	// the same way.
+	replayConn := NewReplayConn(rec)
+	replayPeer, err := NewPeerConn(ctx, replayConn, serverAddr, &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		ReadyToMingleInterval:   -1,
+		FingerprintFunc:         replayConn.FingerprintFunc(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayPeer.Close()
+
+	written := replayConn.Written()
+	massert.Require(t,
+		massert.Equal(remoteAddr.String(), replayPeer.RemoteAddr().String()),
+		massert.Length(written, len(rec.Out())),
+	)
+	for i, pkt := range rec.Out() {
+		massert.Require(t,
+			massert.Equal(pkt.Addr.String(), written[i].Addr.String()),
+			massert.Equal(pkt.Data, written[i].Data),
+		)
+	}
+}
@@ -0,0 +1,98 @@
+package bonfire
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// enableRecvErr sets IP_RECVERR on the socket, if it is one, so that ICMP
+// errors caused by packets sent to unreachable destinations are queued on the
+// socket. They are collected by readErrQueue.
+func enableRecvErr(conn net.PacketConn) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	rawConn.Control(func(fd uintptr) {
+		// which of these applies depends on the socket's family, and a
+		// dual-stack socket needs both.
+		syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVERR, 1)
+		syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, syscall.IPV6_RECVERR, 1)
+	})
+}
+
+// readErrQueue reads all errors queued on the socket due to IP_RECVERR, and
+// returns the destinations which were reported as unreachable.
+func readErrQueue(conn net.PacketConn) []net.Addr {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var addrs []net.Addr
+	rawConn.Control(func(fd uintptr) {
+		oob := make([]byte, 256)
+		for {
+			_, oobn, _, from, err := syscall.Recvmsg(
+				int(fd), nil, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT,
+			)
+			if err != nil {
+				return
+			} else if !isUnreachableErrQueue(oob[:oobn]) {
+				continue
+			} else if addr := sockaddrToUDP(from); addr != nil {
+				addrs = append(addrs, addr)
+			}
+		}
+	})
+	return addrs
+}
+
+// isUnreachableErrQueue returns whether the control messages read from the
+// error queue describe an unreachable destination.
+func isUnreachableErrQueue(oob []byte) bool {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return false
+	}
+	for _, msg := range msgs {
+		isRecvErr := (msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_RECVERR) ||
+			(msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == syscall.IPV6_RECVERR)
+		if !isRecvErr || len(msg.Data) < 4 {
+			continue
+		}
+		// the data is a sock_extended_err, which begins with the errno.
+		errno := syscall.Errno(binary.NativeEndian.Uint32(msg.Data))
+		return isUnreachableErr(errno)
+	}
+	return false
+}
+
+func sockaddrToUDP(sa syscall.Sockaddr) *net.UDPAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.UDPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		addr := &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}
+		if sa.ZoneId != 0 {
+			if iface, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				addr.Zone = iface.Name
+			} else {
+				addr.Zone = strconv.Itoa(int(sa.ZoneId))
+			}
+		}
+		return addr
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package bonfire
+
+import "net"
+
+// Other platforms don't deliver ICMP errors to unconnected UDP sockets, so
+// unreachable destinations can only be detected by write errors.
+
+func enableRecvErr(conn net.PacketConn) {}
+
+func readErrQueue(conn net.PacketConn) []net.Addr { return nil }
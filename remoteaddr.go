@@ -0,0 +1,139 @@
+package bonfire
+
+import (
+	"net"
+)
+
+// maxRemoteAddrVotes is the number of observers whose reports of the Peer's
+// remote address will be kept at once.
+const maxRemoteAddrVotes = 32
+
+// observeRemoteAddr is called for every HelloPeer received from the given
+// address, and every YouAre received from the server, and updates the Peer's
+// remote address to whichever address has been reported by the most
+// observers. Ties are decided in favor of the server's report, and then in
+// favor of the current remote address.
+//
+// Observers on a local network see the Peer's local address rather than the
+// one its NAT maps it to, so their reports are only used if nothing else is
+// known.
+//
+// This must be called with the lock held.
+func (p *Peer) observeRemoteAddr(src net.Addr, msg Message) {
+	observed := msg.HelloPeerBody.Addr
+	if msg.Type == YouAre {
+		observed = msg.YouAreBody.Addr
+	}
+	if observed == nil {
+		return
+	}
+
+	if p.isServer(src) {
+		p.checkAdvertiseAddr(observed)
+	}
+
+	// reports made prior to migrating refer to the old address.
+	if p.migrating {
+		p.remoteAddrVotes = nil
+	}
+
+	if !onLocalNetwork(src) {
+		if p.remoteAddrVotes == nil {
+			p.remoteAddrVotes = map[string]net.Addr{}
+		}
+		srcStr := src.String()
+		if _, ok := p.remoteAddrVotes[srcStr]; !ok && len(p.remoteAddrVotes) >= maxRemoteAddrVotes {
+			p.evictRemoteAddrVote()
+		}
+		p.remoteAddrVotes[srcStr] = observed
+	}
+
+	oldRemoteAddr := p.remoteAddr
+	if remoteAddr := p.tallyRemoteAddr(); remoteAddr != nil {
+		p.remoteAddr = remoteAddr
+	} else if p.remoteAddr == nil || p.remoteAddrCached || p.migrating {
+		p.remoteAddr = observed
+	}
+	p.remoteAddrCached = false
+	p.recordRemoteAddr(p.remoteAddr)
+
+	if oldRemoteAddr != nil && oldRemoteAddr.String() != p.remoteAddr.String() {
+		p.event(PeerEvent{
+			Type:    PeerEventRemoteAddrChanged,
+			Addr:    p.remoteAddr,
+			Message: &msg,
+		})
+	}
+
+	if observed.String() != p.remoteAddr.String() {
+		p.event(PeerEvent{
+			Type:    PeerEventRemoteAddrDisputed,
+			Addr:    src,
+			Message: &msg,
+		})
+	}
+
+	if p.migrating && p.po.OnMigrate != nil {
+		go p.po.OnMigrate(oldRemoteAddr, p.remoteAddr)
+	}
+	p.migrating = false
+}
+
+// evictRemoteAddrVote removes the vote of an arbitrary observer other than
+// the server, to make room for another.
+//
+// This must be called with the lock held.
+func (p *Peer) evictRemoteAddrVote() {
+	for srcStr := range p.remoteAddrVotes {
+		if p.lastServerAddr == nil || srcStr != p.lastServerAddr.String() {
+			delete(p.remoteAddrVotes, srcStr)
+			return
+		}
+	}
+}
+
+// tallyRemoteAddr returns the remote address reported by the most observers,
+// or nil if there are no reports.
+//
+// This must be called with the lock held.
+func (p *Peer) tallyRemoteAddr() net.Addr {
+	var serverVote string
+	if p.lastServerAddr != nil {
+		if addr, ok := p.remoteAddrVotes[p.lastServerAddr.String()]; ok {
+			serverVote = addr.String()
+		}
+	}
+	var current string
+	if p.remoteAddr != nil {
+		current = p.remoteAddr.String()
+	}
+
+	// each address is ranked by its number of votes, then by whether the
+	// server voted for it, then by whether it's the current one.
+	rank := func(addrStr string, votes int) int {
+		r := votes * 4
+		if addrStr == serverVote {
+			r += 2
+		}
+		if addrStr == current {
+			r++
+		}
+		return r
+	}
+
+	counts := map[string]int{}
+	addrs := map[string]net.Addr{}
+	for _, addr := range p.remoteAddrVotes {
+		counts[addr.String()]++
+		addrs[addr.String()] = addr
+	}
+
+	var best net.Addr
+	var bestRank int
+	for addrStr, votes := range counts {
+		if r := rank(addrStr, votes); best == nil || r > bestRank {
+			best, bestRank = addrs[addrStr], r
+		}
+	}
+	return best
+}
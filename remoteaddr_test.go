@@ -0,0 +1,72 @@
+package bonfire
+
+import (
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerRemoteAddrConsensus(t *T) {
+	evCh := make(chan PeerEvent, 10)
+	serverAddr := addrString("198.51.100.1:1")
+	peer := &Peer{
+		po:             PeerOpts{MaxPeers: 10, EventCh: evCh},
+		lastServerAddr: serverAddr,
+	}
+	peer.clearPeers()
+
+	x, y := addrString("203.0.113.1:1"), addrString("203.0.113.2:2")
+	hello := func(src, observed string) {
+		peer.processMessage(addrString(src), Message{
+			Type:          HelloPeer,
+			HelloPeerBody: HelloPeerBody{Addr: addrString(observed)},
+		})
+	}
+	assertRemoteAddr := func(exp string) massert.Assertion {
+		return massert.Equal(exp, peer.RemoteAddr().String())
+	}
+
+	hello(serverAddr.String(), x.String())
+	massert.Require(t, assertRemoteAddr(x.String()), massert.Equal(0, len(evCh)))
+
+	// a single peer disagreeing with the server doesn't change anything, but
+	// is reported.
+	hello("198.51.100.2:1", y.String())
+	massert.Require(t, assertRemoteAddr(x.String()), massert.Equal(1, len(evCh)))
+	ev := <-evCh
+	massert.Require(t,
+		massert.Equal(PeerEventRemoteAddrDisputed, ev.Type),
+		massert.Equal("198.51.100.2:1", ev.Addr.String()),
+	)
+
+	// once the majority disagrees the remote address changes, which is
+	// reported.
+	assertChanged := func(exp string) massert.Assertion {
+		if len(evCh) != 1 {
+			return massert.Equal(1, len(evCh))
+		}
+		ev := <-evCh
+		return massert.All(
+			massert.Equal(PeerEventRemoteAddrChanged, ev.Type),
+			massert.Equal(exp, ev.Addr.String()),
+		)
+	}
+	hello("198.51.100.3:1", y.String())
+	massert.Require(t, assertRemoteAddr(y.String()), assertChanged(y.String()))
+
+	// an observer repeating its report only counts once, so a tie is decided
+	// by the server.
+	hello("198.51.100.3:1", y.String())
+	massert.Require(t, assertRemoteAddr(y.String()), massert.Equal(0, len(evCh)))
+	hello("198.51.100.4:1", x.String())
+	massert.Require(t, assertRemoteAddr(x.String()), assertChanged(x.String()))
+
+	// migrating discards all previous reports.
+	peer.migrating = true
+	hello("198.51.100.2:1", y.String())
+	massert.Require(t,
+		assertRemoteAddr(y.String()),
+		massert.Equal(false, peer.migrating),
+		massert.Length(peer.remoteAddrVotes, 1),
+	)
+}
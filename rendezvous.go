@@ -0,0 +1,99 @@
+package bonfire
+
+import (
+	"crypto/sha256"
+	"net"
+	"sync"
+	"time"
+)
+
+// rendezvousKey returns the key which is sent in place of the given
+// rendezvous, so that the server doesn't learn the rendezvous itself. It
+// returns nil for the empty rendezvous.
+func rendezvousKey(rendezvous string) []byte {
+	if rendezvous == "" {
+		return nil
+	}
+	key := sha256.Sum256([]byte(rendezvous))
+	return key[:]
+}
+
+// zsets holds a separate zset of ready-to-mingle peers for each rendezvous
+// key, so that peers are only introduced to other peers using the same key.
+// Peers which don't use a rendezvous key share the zset of the empty key.
+type zsets struct {
+	l        sync.RWMutex
+	m        map[string]*zset
+	capacity MingleCapacity
+
+	// if set, used in place of time.Now by the zsets.
+	now func() time.Time
+}
+
+func newZSets() *zsets {
+	return &zsets{m: map[string]*zset{}}
+}
+
+// get returns the zset for the given key, or nil if there isn't one.
+func (zs *zsets) get(key []byte) *zset {
+	zs.l.RLock()
+	defer zs.l.RUnlock()
+	return zs.m[string(key)]
+}
+
+// add adds the peer to the zset for the given key, creating it if necessary.
+func (zs *zsets) add(key []byte, addr net.Addr, conn net.PacketConn, fingerprint []byte, capacity MingleCapacity) {
+	// the write lock is held throughout, so that expire can't discard the zset
+	// in between it being created and added to.
+	zs.l.Lock()
+	defer zs.l.Unlock()
+	z, ok := zs.m[string(key)]
+	if !ok {
+		z = newZSet()
+		z.capacity = zs.capacity
+		z.now = zs.now
+		zs.m[string(key)] = z
+	}
+	z.add(addr, conn, fingerprint, capacity)
+}
+
+// each calls fn for every zset, along with its key.
+func (zs *zsets) each(fn func(key []byte, z *zset)) {
+	zs.l.RLock()
+	defer zs.l.RUnlock()
+	for key, z := range zs.m {
+		fn([]byte(key), z)
+	}
+}
+
+// setCapacity calls setCapacity on every zset, and applies the capacity to
+// zsets created in the future as well.
+func (zs *zsets) setCapacity(capacity MingleCapacity) {
+	zs.l.Lock()
+	defer zs.l.Unlock()
+	zs.capacity = capacity
+	for _, z := range zs.m {
+		z.setCapacity(capacity)
+	}
+}
+
+// expire calls expire on every zset, discarding those which are left empty.
+// If onExpire is given it's called with each expired peer, along with the key
+// of its zset.
+func (zs *zsets) expire(t time.Time, onExpire func(key []byte, zEl zsetEl)) {
+	zs.l.Lock()
+	defer zs.l.Unlock()
+	for key, z := range zs.m {
+		var zOnExpire func(zsetEl)
+		if onExpire != nil {
+			zOnExpire = func(zEl zsetEl) { onExpire([]byte(key), zEl) }
+		}
+		z.expire(t, zOnExpire)
+		z.Lock()
+		empty := len(z.m) == 0
+		z.Unlock()
+		if empty {
+			delete(zs.m, key)
+		}
+	}
+}
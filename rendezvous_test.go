@@ -0,0 +1,100 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerRendezvous(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	go server.Serve(ctx, conn)
+	serverAddr := conn.LocalAddr().String()
+
+	newPeer := func(rendezvous string) *Peer {
+		peer, err := NewPeer(ctx, "udp", serverAddr, &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			PacketBlastCount:        1,
+			ListenAddr:              "127.0.0.1:0",
+			Rendezvous:              rendezvous,
+		})
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { peer.Close() })
+		peer.SetReadDeadline(time.Time{})
+		go func() {
+			b := make([]byte, MaxMessageSize)
+			for {
+				if _, _, err := peer.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+		return peer
+	}
+
+	waitForMinglers := func(n int) {
+		for len(server.Minglers()) < n {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	a1 := newPeer("a")
+	waitForMinglers(1)
+	b := newPeer("b")
+	waitForMinglers(2)
+	a2 := newPeer("a")
+
+	// only the newcomer learns of the peers it's introduced to, so a2 should
+	// have met a1, but b shouldn't have met anyone.
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	massert.Require(t, massert.Nil(a2.WaitForPeers(waitCtx, 1)))
+	waitForMinglers(3)
+
+	a2Addrs := a2.PeerAddrs()
+	massert.Require(t,
+		massert.Length(a2Addrs, 1),
+		massert.Length(b.PeerAddrs(), 0),
+		massert.Equal(3, server.Stats().Minglers),
+	)
+	massert.Require(t,
+		massert.Equal(a1.LocalAddr().String(), a2Addrs[0].String()),
+	)
+
+	for _, mingler := range server.Minglers() {
+		rendezvous := rendezvousKey("a")
+		if mingler.Addr.String() == b.LocalAddr().String() {
+			rendezvous = rendezvousKey("b")
+		}
+		massert.Require(t, massert.Equal(rendezvous, mingler.Rendezvous))
+	}
+}
+
+func TestZSetsExpire(t *T) {
+	zs := newZSets()
+	now := time.Now()
+	zs.add(nil, addrString("127.0.0.1:1"), nil, nil, MingleCapacity{})
+	zs.add(rendezvousKey("a"), addrString("127.0.0.1:2"), nil, nil, MingleCapacity{})
+	massert.Require(t,
+		massert.Not(massert.Nil(zs.get(nil))),
+		massert.Not(massert.Nil(zs.get(rendezvousKey("a")))),
+		massert.Nil(zs.get(rendezvousKey("b"))),
+	)
+
+	// expiring drops zsets which are left empty
+	zs.expire(now.Add(-time.Minute), nil)
+	massert.Require(t, massert.Equal(2, len(zs.m)))
+	zs.expire(now.Add(time.Minute), nil)
+	massert.Require(t,
+		massert.Equal(0, len(zs.m)),
+		massert.Nil(zs.get(nil)),
+	)
+}
@@ -0,0 +1,77 @@
+package bonfire
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxReplays is the number of recently received messages which a Server
+// remembers in order to drop copies of them. Once reached, the least recently
+// received message is forgotten to make room for each new one.
+const maxReplays = 8192
+
+// replayKey identifies a message for the purpose of detecting copies of it.
+type replayKey struct {
+	fingerprint string
+	typ         MessageType
+	timestamp   int64
+}
+
+type replay struct {
+	key        replayKey
+	receivedAt time.Time
+}
+
+// replayCache remembers the timestamped messages which have been received
+// recently, so that copies of them can be dropped. Messages are remembered in
+// the order they were received.
+type replayCache struct {
+	l     sync.Mutex
+	m     map[replayKey]*list.Element
+	order list.List
+}
+
+// seen returns whether a copy of the Message was already received, and if not
+// records it as having been. Messages without a Timestamp are never
+// considered copies, since there's no way to tell them apart.
+func (rc *replayCache) seen(msg Message, now time.Time) bool {
+	if msg.Timestamp.IsZero() {
+		return false
+	}
+
+	key := replayKey{
+		fingerprint: string(msg.Fingerprint),
+		typ:         msg.Type,
+		timestamp:   msg.Timestamp.UnixMilli(),
+	}
+
+	rc.l.Lock()
+	defer rc.l.Unlock()
+
+	if _, ok := rc.m[key]; ok {
+		return true
+	} else if rc.m == nil {
+		rc.m = map[replayKey]*list.Element{}
+	} else if len(rc.m) >= maxReplays {
+		oldest := rc.order.Front()
+		delete(rc.m, oldest.Value.(replay).key)
+		rc.order.Remove(oldest)
+	}
+	rc.m[key] = rc.order.PushBack(replay{key: key, receivedAt: now})
+	return false
+}
+
+// prune forgets all messages which were received prior to the given time.
+func (rc *replayCache) prune(t time.Time) {
+	rc.l.Lock()
+	defer rc.l.Unlock()
+	for el := rc.order.Front(); el != nil; el = rc.order.Front() {
+		r := el.Value.(replay)
+		if !r.receivedAt.Before(t) {
+			return
+		}
+		delete(rc.m, r.key)
+		rc.order.Remove(el)
+	}
+}
@@ -0,0 +1,214 @@
+package bonfire
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// resolveUDPAddr works like net.ResolveUDPAddr, but uses the given Resolver
+// (which may be nil, in which case net.DefaultResolver is used).
+func resolveUDPAddr(ctx context.Context, r *net.Resolver, network, addr string) (*net.UDPAddr, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := r.LookupPort(ctx, network, portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+
+	ipAddrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ipAddr := range ipAddrs {
+		isV4 := ipAddr.IP.To4() != nil
+		if (network == "udp4" && !isV4) || (network == "udp6" && isV4) {
+			continue
+		}
+		return &net.UDPAddr{IP: ipAddr.IP, Port: port, Zone: ipAddr.Zone}, nil
+	}
+	return nil, fmt.Errorf("no suitable address found for host %q", host)
+}
+
+// serverAddr returns the address of the server, resolving it if necessary as
+// determined by ServerAddrTTL.
+//
+// This must be called with the lock held.
+func (p *Peer) serverAddr() (_ net.Addr, err error) {
+	if p.lastServerAddr != nil {
+		if p.po.ServerAddrTTL < 0 {
+			return p.lastServerAddr, nil
+		} else if p.po.ServerAddrTTL > 0 &&
+			time.Since(p.lastServerAddrTS) < p.po.ServerAddrTTL {
+			return p.lastServerAddr, nil
+		}
+	}
+
+	ctx := context.Background()
+	if p.traceCtx != nil {
+		var span trace.Span
+		ctx, span = p.tracer.Start(p.traceCtx, "bonfire.Peer.resolve", trace.WithAttributes(
+			attrServerAddr.String(p.serverAddrStr),
+		))
+		defer func() { endSpan(span, err) }()
+	}
+
+	addr, err := resolveUDPAddr(ctx, p.po.Resolver, p.network, p.serverAddrStr)
+	if err != nil {
+		err = fmt.Errorf("resolving server address %q: %s", p.serverAddrStr, err)
+		p.event(PeerEvent{Type: PeerEventResolveFailed, Err: err})
+		if p.lastServerAddr != nil {
+			return p.lastServerAddr, nil
+		}
+		return nil, err
+	}
+
+	p.useServer(p.lastServerAddr, addr)
+	p.lastServerAddr = addr
+	p.lastServerAddrTS = time.Now()
+	return addr, nil
+}
+
+// isServer returns whether the address is that of the server, as it was last
+// resolved.
+//
+// This must be called with the lock held.
+func (p *Peer) isServer(addr net.Addr) bool {
+	return p.lastServerAddr != nil && addr.String() == p.lastServerAddr.String()
+}
+
+// maxAddrCacheEntries is the number of addresses an AddrCache will hold before
+// it starts evicting them.
+const maxAddrCacheEntries = 1024
+
+type addrCacheEntry struct {
+	addr    net.Addr
+	err     error
+	expires time.Time // zero if it never expires
+}
+
+// AddrCache resolves address strings (e.g. "example.com:6666") into net.Addrs
+// which can be passed to Peer's Send, caching the results so that sending to
+// the same addresses repeatedly doesn't involve a DNS lookup for every packet.
+// Lookups which fail are cached too, so that an unresolvable address doesn't
+// cause a lookup every time either.
+//
+// The zero value is ready to use, and an AddrCache may be used from multiple
+// go-routines at once.
+type AddrCache struct {
+	// Resolver is used to resolve addresses. Default is net.DefaultResolver.
+	Resolver *net.Resolver
+
+	// Network is the network addresses are resolved for, "udp", "udp4" or
+	// "udp6". Default is "udp".
+	Network string
+
+	// TTL determines how long a resolved address is used before being resolved
+	// again. If -1 addresses are only ever resolved once. Default is 1 *
+	// time.Minute.
+	TTL time.Duration
+
+	// NegativeTTL determines how long a failure to resolve an address is
+	// remembered, during which Resolve returns the same error without trying
+	// again. If -1 failures aren't remembered. Default is 5 * time.Second.
+	NegativeTTL time.Duration
+
+	// resolve is used in place of resolveUDPAddr, for testing.
+	resolve func(ctx context.Context, r *net.Resolver, network, addr string) (*net.UDPAddr, error)
+
+	l       sync.Mutex
+	entries map[string]addrCacheEntry
+}
+
+// Resolve returns the resolved form of the given address, resolving it only if
+// it isn't already cached.
+func (c *AddrCache) Resolve(ctx context.Context, addrStr string) (net.Addr, error) {
+	now := time.Now()
+	c.l.Lock()
+	entry, ok := c.entries[addrStr]
+	c.l.Unlock()
+	if ok && (entry.expires.IsZero() || now.Before(entry.expires)) {
+		return entry.addr, entry.err
+	}
+
+	network, resolve := c.Network, c.resolve
+	if network == "" {
+		network = "udp"
+	}
+	if resolve == nil {
+		resolve = resolveUDPAddr
+	}
+
+	// the lock isn't held while resolving, so that other addresses can still
+	// be looked up in the meantime. If two go-routines resolve the same
+	// address at once both results are equally good.
+	udpAddr, err := resolve(ctx, c.Resolver, network, addrStr)
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = 1 * time.Minute
+	}
+	if err == nil {
+		entry = addrCacheEntry{addr: udpAddr}
+	} else {
+		err = fmt.Errorf("resolving address %q: %w", addrStr, err)
+		entry = addrCacheEntry{err: err}
+		if ttl = c.NegativeTTL; ttl == 0 {
+			ttl = 5 * time.Second
+		}
+
+		// a lookup which failed because the Context was canceled says nothing
+		// about the address.
+		if ttl < 0 || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]addrCacheEntry{}
+	} else if len(c.entries) >= maxAddrCacheEntries {
+		c.evict(now)
+	}
+	c.entries[addrStr] = entry
+	return entry.addr, entry.err
+}
+
+// evict removes all expired entries from the cache, or a random one if none
+// have expired.
+//
+// This must be called with the lock held.
+func (c *AddrCache) evict(now time.Time) {
+	var evicted bool
+	for addrStr, entry := range c.entries {
+		if !entry.expires.IsZero() && !now.Before(entry.expires) {
+			delete(c.entries, addrStr)
+			evicted = true
+		}
+	}
+	for addrStr := range c.entries {
+		if evicted {
+			break
+		}
+		delete(c.entries, addrStr)
+		evicted = true
+	}
+}
@@ -0,0 +1,59 @@
+package bonfire
+
+import (
+	"context"
+	"errors"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestAddrCache(t *T) {
+	var lookups int
+	cache := &AddrCache{
+		TTL:         100 * time.Millisecond,
+		NegativeTTL: 100 * time.Millisecond,
+		resolve: func(ctx context.Context, _ *net.Resolver, network, addr string) (*net.UDPAddr, error) {
+			lookups++
+			if addr != "127.0.0.1:1" {
+				return nil, errors.New("no such host")
+			}
+			return net.ResolveUDPAddr(network, addr)
+		},
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		addr, err := cache.Resolve(ctx, "127.0.0.1:1")
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal("127.0.0.1:1", addr.String()),
+			massert.Equal(1, lookups),
+		)
+	}
+
+	for i := 0; i < 2; i++ {
+		addr, err := cache.Resolve(ctx, "bad:1")
+		massert.Require(t,
+			massert.Not(massert.Nil(err)),
+			massert.Nil(addr),
+			massert.Equal(2, lookups),
+		)
+	}
+
+	// once expired both are looked up again
+	time.Sleep(150 * time.Millisecond)
+	cache.Resolve(ctx, "127.0.0.1:1")
+	cache.Resolve(ctx, "bad:1")
+	massert.Require(t, massert.Equal(4, lookups))
+
+	// failures aren't cached if the Context was canceled
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	cache.NegativeTTL = time.Minute
+	cache.Resolve(canceledCtx, "other:1")
+	cache.Resolve(canceledCtx, "other:1")
+	massert.Require(t, massert.Equal(6, lookups))
+}
@@ -0,0 +1,13 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package bonfire
+
+import (
+	"os"
+	"syscall"
+)
+
+func setReusePort(fd uintptr) error {
+	err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+	return os.NewSyscallError("setsockopt", err)
+}
@@ -0,0 +1,14 @@
+package bonfire
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func setReusePort(fd uintptr) error {
+	// the syscall package doesn't define SO_REUSEPORT on linux, and its value
+	// differs between architectures (e.g. mips and sparc).
+	err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	return os.NewSyscallError("setsockopt", err)
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package bonfire
+
+func setReusePort(fd uintptr) error {
+	return errReusePortUnsupported
+}
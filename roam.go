@@ -0,0 +1,119 @@
+package bonfire
+
+import (
+	"net"
+	"time"
+)
+
+// maxServerStats is the number of servers a Peer keeps PeerServerStats for.
+const maxServerStats = 8
+
+// PeerServerStats describes a Peer's activity with one of the servers it has
+// used, see PeerStats' Servers.
+type PeerServerStats struct {
+	// Address of the server, as it was resolved.
+	Addr string
+
+	// Number of bonfire messages received from the server.
+	Received uint64
+
+	// Number of times sending a ReadyToMingle to the server failed, or the
+	// server was reported as unreachable.
+	Failures uint64
+
+	// When the last message was received from the server, or the zero value
+	// if none has been.
+	LastReceived time.Time
+
+	// When the Peer last switched to using the server.
+	Since time.Time
+}
+
+// ServerAddr returns the address of the server the Peer is currently using,
+// i.e. the address its server address was last resolved to, or nil if it
+// hasn't been resolved yet.
+func (p *Peer) ServerAddr() net.Addr {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	return p.lastServerAddr
+}
+
+// serverStats returns the PeerServerStats of the server at the given address,
+// or nil if there aren't any.
+//
+// This must be called with the lock held.
+func (p *Peer) serverStats(addr net.Addr) *PeerServerStats {
+	if addr == nil {
+		return nil
+	}
+	addrStr := addr.String()
+	for _, stats := range p.servers {
+		if stats.Addr == addrStr {
+			return stats
+		}
+	}
+	return nil
+}
+
+// useServer is called whenever the server address is resolved to addr, where
+// prev is the address it was last resolved to (if any). If they differ then the
+// Peer has switched to a different server, e.g. because of DNS-based failover,
+// and that server has no record of the Peer being ready-to-mingle. The
+// circuit breaker is reset, since it described the previous server, and the
+// spinReadyToMingle go-routine is woken so that a ReadyToMingle is sent to the
+// new server straight away.
+//
+// This must be called with the lock held.
+func (p *Peer) useServer(prev, addr net.Addr) {
+	if prev != nil && prev.String() == addr.String() {
+		return
+	}
+
+	now := time.Now()
+	stats := p.serverStats(addr)
+	if stats == nil {
+		stats = &PeerServerStats{Addr: addr.String()}
+		if len(p.servers) >= maxServerStats {
+			p.servers = append(p.servers[:0], p.servers[1:]...)
+		}
+	} else {
+		for i := range p.servers {
+			if p.servers[i] == stats {
+				p.servers = append(p.servers[:i], p.servers[i+1:]...)
+				break
+			}
+		}
+	}
+	stats.Since = now
+	p.servers = append(p.servers, stats)
+
+	if prev == nil {
+		return
+	}
+
+	p.serverInstanceID = nil
+	p.circuit.failures, p.circuit.backoff = 0, 0
+	p.circuit.attempting, p.circuit.attemptFailed = false, false
+	p.setCircuitState(ServerCircuitClosed, nil)
+	p.event(PeerEvent{Type: PeerEventServerChanged, Addr: addr})
+
+	select {
+	case p.remingleCh <- struct{}{}:
+	default:
+	}
+}
+
+// serverStatsSnapshot returns a copy of the Peer's PeerServerStats, from the
+// least to the most recently used server.
+func (p *Peer) serverStatsSnapshot() []PeerServerStats {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	if len(p.servers) == 0 {
+		return nil
+	}
+	servers := make([]PeerServerStats, len(p.servers))
+	for i, stats := range p.servers {
+		servers[i] = *stats
+	}
+	return servers
+}
@@ -0,0 +1,77 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerServerChanged(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newServer := func() (*Server, net.Addr) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		server := NewServer()
+		go server.Serve(ctx, conn)
+		return server, conn.LocalAddr()
+	}
+	serverA, addrA := newServer()
+	serverB, addrB := newServer()
+
+	evCh := make(chan PeerEvent, 16)
+	peer, err := NewPeer(ctx, "udp", addrA.String(), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		ListenAddr:              "127.0.0.1:0",
+		ReadyToMingleInterval:   time.Minute,
+		EventCh:                 evCh,
+	})
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+
+	for serverA.Stats().ReadyToMingles == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	massert.Require(t, massert.Equal(addrA.String(), peer.ServerAddr().String()))
+
+	// the server's address now resolves to serverB, as it would after a
+	// DNS-based failover, which is noticed the next time it's resolved.
+	peer.l.Lock()
+	peer.serverAddrStr = addrB.String()
+	_, err = peer.serverAddr()
+	peer.l.Unlock()
+	massert.Require(t, massert.Nil(err))
+
+	for serverB.Stats().ReadyToMingles == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("no ReadyToMingle sent to new server")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	var changed []PeerEvent
+	for len(evCh) > 0 {
+		if ev := <-evCh; ev.Type == PeerEventServerChanged {
+			changed = append(changed, ev)
+		}
+	}
+	massert.Require(t, massert.Equal(1, len(changed)))
+
+	servers := peer.Stats().Servers
+	massert.Require(t,
+		massert.Equal(addrB.String(), changed[0].Addr.String()),
+		massert.Equal(addrB.String(), peer.ServerAddr().String()),
+		massert.Equal(2, len(servers)),
+	)
+	massert.Require(t,
+		massert.Equal(addrA.String(), servers[0].Addr),
+		massert.Equal(addrB.String(), servers[1].Addr),
+		massert.Equal(true, servers[0].Received > 0),
+		massert.Equal(true, servers[1].Since.After(servers[0].Since)),
+	)
+}
@@ -0,0 +1,64 @@
+package bonfire
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// errSameNATNoCandidates is the Err of a PeerEventSameNAT when the introduced
+// peer can't be reached directly.
+var errSameNATNoCandidates = errors.New("peer is behind the same NAT but advertised no addresses on the local network, it can only be reached if the NAT supports hairpinning")
+
+// sameNAT returns whether the given address, at which the server has observed
+// some other peer, shares this Peer's external IP, i.e. the other peer is
+// behind the same NAT. It returns false if this Peer isn't behind a NAT, or
+// doesn't yet know its remote address.
+//
+// This must be called with the lock held.
+func (p *Peer) sameNAT(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	remoteAddr, _ := p.remoteAddr.(*net.UDPAddr)
+	if !ok || remoteAddr == nil || !udpAddr.IP.Equal(remoteAddr.IP) {
+		return false
+	}
+
+	// if the remote address is one of the host's own then there's no NAT in
+	// between, and the other peer is on the same host.
+	for _, ipNet := range localIPNets() {
+		if ipNet.IP.Equal(remoteAddr.IP) {
+			return false
+		}
+	}
+	return !remoteAddr.IP.IsLoopback()
+}
+
+// checkSameNAT is called when the server has introduced this Peer to a peer at
+// the given address, which advertised the given candidates. If the two are
+// behind the same NAT then PeerEventSameNAT is emitted. Many NATs don't
+// support hairpinning, so if none of the candidates are on the local network
+// the Peer falls back to announcing itself to its multicast group (if
+// MulticastAddr is set), in the hope that the other peer is a member of it.
+// There's no further fallback, see PeerEventSameNAT.
+//
+// This must be called with the lock held.
+func (p *Peer) checkSameNAT(addr net.Addr, candidates []net.Addr) {
+	if !p.sameNAT(addr) {
+		return
+	}
+
+	for _, candidate := range candidates {
+		if onLocalNetwork(candidate) {
+			p.event(PeerEvent{Type: PeerEventSameNAT, Addr: addr})
+			return
+		}
+	}
+
+	p.event(PeerEvent{Type: PeerEventSameNAT, Addr: addr, Err: errSameNATNoCandidates})
+	if p.mcastAddr == nil {
+		return
+	} else if err := p.announce(p.po.PacketBlastCount); err != nil {
+		err = fmt.Errorf("announcing to multicast group: %w", err)
+		p.event(PeerEvent{Type: PeerEventError, Err: err})
+	}
+}
@@ -0,0 +1,51 @@
+package bonfire
+
+import (
+	"net"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerCheckSameNAT(t *T) {
+	eventCh := make(chan PeerEvent, 10)
+	peer := &Peer{po: PeerOpts{EventCh: eventCh}}
+	peer.remoteAddr = addrString("203.0.113.5:1000")
+
+	nextEvent := func() *PeerEvent {
+		select {
+		case ev := <-eventCh:
+			return &ev
+		default:
+			return nil
+		}
+	}
+
+	// a peer behind a different NAT, or on the same host, isn't reported.
+	peer.checkSameNAT(addrString("203.0.113.6:1000"), nil)
+	massert.Require(t, massert.Nil(nextEvent()))
+
+	other := addrString("203.0.113.5:2000")
+	peer.checkSameNAT(other, []net.Addr{other})
+	ev := nextEvent()
+	massert.Require(t, massert.Not(massert.Nil(ev)))
+	massert.Require(t,
+		massert.Equal(PeerEventSameNAT, ev.Type),
+		massert.Equal(other, ev.Addr),
+		massert.Equal(errSameNATNoCandidates, ev.Err),
+	)
+
+	ipNets := localIPNets()
+	if len(ipNets) == 0 {
+		t.Log("no local networks, skipping candidates check")
+		return
+	}
+	candidate := &net.UDPAddr{IP: ipNets[0].IP, Port: 2000}
+	peer.checkSameNAT(other, []net.Addr{other, candidate})
+	ev = nextEvent()
+	massert.Require(t, massert.Not(massert.Nil(ev)))
+	massert.Require(t,
+		massert.Equal(PeerEventSameNAT, ev.Type),
+		massert.Nil(ev.Err),
+	)
+}
@@ -0,0 +1,52 @@
+package bonfire
+
+import (
+	"errors"
+)
+
+// Seek asks the server to introduce the Peer to the peer whose ReadyToMingle
+// messages use the given fingerprint, if that peer is currently mingling. If
+// so the server sends it a Meet, and it will say hello to this Peer as usual;
+// otherwise nothing happens. This can be used to reconnect to known peers
+// after either has changed address.
+//
+// A peer's fingerprint is only a stable identity if it is generated by a
+// FingerprintFunc which always returns the same value. Peers in privacy mode
+// use a fresh fingerprint for every ReadyToMingle, and so can't be sought.
+//
+// As with ResetPeers, ReadFrom must be called in order for the resulting
+// HelloPeer message to be processed.
+func (p *Peer) Seek(fingerprint []byte) error {
+	if len(fingerprint) != FingerprintSize {
+		return errors.New("fingerprint is not the correct size")
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	if p.serverAddrStr == "" {
+		return errors.New("a server address is required to Seek")
+	}
+	serverAddr, err := p.serverAddr()
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		Fingerprint: p.lastFingerprint,
+		Type:        Seek,
+		SeekBody:    SeekBody{Fingerprint: fingerprint},
+		Candidates:  p.candidates(),
+		Rendezvous:  p.rendezvous,
+	}
+
+	// as with HelloServer, in privacy mode the candidates are only sent in
+	// sealed form.
+	if p.sealer != nil {
+		if msg.Sealed, err = p.sealer.seal(msg.Candidates); err != nil {
+			return err
+		}
+		msg.Candidates = nil
+	}
+
+	return multiSend(p.newSendBatch(), serverAddr, p.po.PacketBlastCount, msg)
+}
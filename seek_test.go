@@ -0,0 +1,54 @@
+package bonfire
+
+import (
+	"context"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerSeek(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	server, serverAddr := testServer(ctx, t, nil)
+	newPeer := func(fingerprint []byte, declineIntroductions bool) *Peer {
+		return testPeer(ctx, t, serverAddr.String(), PeerOpts{
+			PacketBlastCount:     1,
+			FingerprintFunc:      func() ([]byte, error) { return fingerprint, nil },
+			DeclineIntroductions: declineIntroductions,
+		})
+	}
+
+	// the seeker is started first and doesn't mingle, so that the server won't
+	// introduce the two peers on its own.
+	seeker := newPeer(mrand.Bytes(FingerprintSize), true)
+	soughtFingerprint := mrand.Bytes(FingerprintSize)
+	sought := newPeer(soughtFingerprint, false)
+	for len(server.Minglers()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	massert.Require(t, massert.Length(seeker.PeerAddrs(), 0))
+
+	// seeking a peer which isn't mingling does nothing
+	massert.Require(t, massert.Nil(seeker.Seek(mrand.Bytes(FingerprintSize))))
+	for server.Stats().Seeks < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	massert.Require(t, massert.Equal(uint64(0), server.Stats().MeetsSent))
+
+	massert.Require(t, massert.Nil(seeker.Seek(soughtFingerprint)))
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	massert.Require(t, massert.Nil(seeker.WaitForPeers(waitCtx, 1)))
+
+	peerAddrs := seeker.PeerAddrs()
+	massert.Require(t,
+		massert.Length(peerAddrs, 1),
+		massert.Equal(sought.LocalAddr().String(), peerAddrs[0].String()),
+		massert.Equal(uint64(2), server.Stats().Seeks),
+		massert.Equal(uint64(1), server.Stats().MeetsSent),
+	)
+}
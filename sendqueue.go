@@ -0,0 +1,165 @@
+package bonfire
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+type queuedSend struct {
+	sb    *sendBatch
+	errFn func(error)
+}
+
+// sendLane is one of the queues making up a sendQueue, with the counters it
+// updates.
+type sendLane struct {
+	q               []queuedSend
+	queued, dropped *atomic.Uint64
+}
+
+// sendQueue holds sendBatches which are waiting to be flushed by a single
+// background go-routine, so that a slow or blocked socket doesn't hold up
+// message processing, nor cause go-routines to pile up. Once the queue is full
+// the oldest batch is dropped to make room for each new one.
+//
+// There are two lanes: one for the Peer's own bonfire messages, and one for
+// application packets (see SendAsync). Batches in the first are always
+// flushed before any in the second, so that messages which must be sent in a
+// timely manner (e.g. HelloPeers, while hole punching) aren't held up behind
+// heavy application traffic. Each lane holds up to size batches.
+type sendQueue struct {
+	size     int
+	notifyCh chan struct{}
+
+	l            sync.Mutex
+	control, app sendLane
+}
+
+func newSendQueue(size int, stats *peerStats) *sendQueue {
+	return &sendQueue{
+		size:     size,
+		notifyCh: make(chan struct{}, 1),
+		control:  sendLane{queued: &stats.sendsQueued, dropped: &stats.sendsDropped},
+		app:      sendLane{queued: &stats.appSendsQueued, dropped: &stats.appSendsDropped},
+	}
+}
+
+// push adds the sendBatch to the control lane of the queue. errFn, if given,
+// is called by the background go-routine with the error returned from
+// flushing the batch, if any.
+func (sq *sendQueue) push(sb *sendBatch, errFn func(error)) {
+	sq.pushLane(&sq.control, sb, errFn)
+}
+
+// pushApp works like push, but adds the sendBatch to the app lane.
+func (sq *sendQueue) pushApp(sb *sendBatch, errFn func(error)) {
+	sq.pushLane(&sq.app, sb, errFn)
+}
+
+func (sq *sendQueue) pushLane(lane *sendLane, sb *sendBatch, errFn func(error)) {
+	sq.l.Lock()
+	if len(lane.q) >= sq.size {
+		lane.q[0].sb.release()
+		lane.q[0] = queuedSend{}
+		lane.q = lane.q[1:]
+		lane.dropped.Add(1)
+	}
+	lane.q = append(lane.q, queuedSend{sb: sb, errFn: errFn})
+	lane.queued.Add(1)
+	sq.l.Unlock()
+
+	select {
+	case sq.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the oldest batch in the control lane, or if it's empty the
+// oldest in the app lane.
+func (sq *sendQueue) pop() (queuedSend, bool) {
+	sq.l.Lock()
+	defer sq.l.Unlock()
+	lane := &sq.control
+	if len(lane.q) == 0 {
+		lane = &sq.app
+	}
+	if len(lane.q) == 0 {
+		return queuedSend{}, false
+	}
+	qs := lane.q[0]
+	lane.q[0] = queuedSend{}
+	lane.q = lane.q[1:]
+	return qs, true
+}
+
+// run flushes queued batches, in the order they were pushed (the control lane
+// taking priority), until closeCh is closed. Any batches which are still
+// queued at that point are dropped.
+func (sq *sendQueue) run(closeCh <-chan bool) {
+	for {
+		select {
+		case <-sq.notifyCh:
+		case <-closeCh:
+			for qs, ok := sq.pop(); ok; qs, ok = sq.pop() {
+				qs.sb.release()
+			}
+			return
+		}
+
+		for qs, ok := sq.pop(); ok; qs, ok = sq.pop() {
+			if err := qs.sb.flush(); err != nil && qs.errFn != nil {
+				qs.errFn(err)
+			}
+		}
+	}
+}
+
+func (p *Peer) spinSendQueue() {
+	defer p.wg.Done()
+	p.sendq.run(p.closeCh)
+}
+
+// flushAsync flushes the sendBatch in the background, using the Peer's send
+// queue. If errFn is given it will be called with the error returned from
+// flushing, if any.
+func (p *Peer) flushAsync(sb *sendBatch, errFn func(error)) {
+	if p.sendq == nil {
+		sb.flushAsync(errFn)
+		return
+	}
+	p.sendq.push(sb, errFn)
+}
+
+// WriteTo implements the method for net.PacketConn. If PeerOpts' QueueSends is
+// set the packet is queued as if passed to SendAsync, otherwise it's written
+// before WriteTo returns.
+func (p *Peer) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if !p.po.QueueSends {
+		return p.PacketConn.WriteTo(b, addr)
+	}
+	p.SendAsync(b, addr)
+	return len(b), nil
+}
+
+// SendAsync works like Send, but the packet is written in the background by
+// the same go-routine which writes the Peer's own bonfire messages, and so
+// SendAsync doesn't block. The Peer's own messages are always written before
+// any packets passed to SendAsync, so that heavy application traffic doesn't
+// delay them. Up to SendQueueSize packets may be waiting to be written; once
+// that's reached the oldest waiting packet is dropped to make room for each
+// new one (see Stats). Errors encountered when writing are emitted as
+// PeerEventError events.
+//
+// b may be reused once SendAsync returns. SendAsync is safe to call
+// concurrently with all other methods.
+func (p *Peer) SendAsync(b []byte, addrs ...net.Addr) {
+	b = append([]byte(nil), b...)
+	sb := newSendBatch(p.mconn)
+	for _, addr := range addrs {
+		sb.addRaw(addr, b)
+	}
+	p.sendq.pushApp(sb, func(err error) {
+		p.event(PeerEvent{Type: PeerEventError, Err: err})
+	})
+}
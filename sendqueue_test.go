@@ -0,0 +1,108 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestSendQueue(t *T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer udpConn.Close()
+	conn := &dstsConn{PacketConn: udpConn, dsts: map[string]bool{}}
+
+	var addrs []net.Addr
+	var stats peerStats
+	sq := newSendQueue(2, &stats)
+	for _, addrStr := range []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"} {
+		addr := addrString(addrStr)
+		addrs = append(addrs, addr)
+		sb := newSendBatch(conn)
+		sb.addRaw(addr, []byte("hi"))
+		sq.push(sb, nil)
+	}
+	massert.Require(t,
+		massert.Equal(uint64(3), stats.sendsQueued.Load()),
+		massert.Equal(uint64(1), stats.sendsDropped.Load()),
+	)
+
+	// closing closeCh once the queue has been drained stops run.
+	closeCh := make(chan bool)
+	doneCh := make(chan struct{})
+	go func() {
+		sq.run(closeCh)
+		close(doneCh)
+	}()
+	for !conn.wroteTo(addrs[2]) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(closeCh)
+	<-doneCh
+
+	massert.Require(t,
+		massert.Equal(false, conn.wroteTo(addrs[0])),
+		massert.Equal(true, conn.wroteTo(addrs[1])),
+		massert.Equal(true, conn.wroteTo(addrs[2])),
+	)
+}
+
+func TestSendQueueLanes(t *T) {
+	var stats peerStats
+	sq := newSendQueue(2, &stats)
+	push := func(push func(*sendBatch, func(error)), addrStr string) {
+		sb := newSendBatch(nil)
+		sb.addRaw(addrString(addrStr), []byte("hi"))
+		push(sb, nil)
+	}
+	push(sq.pushApp, "127.0.0.1:1")
+	push(sq.pushApp, "127.0.0.1:2")
+	push(sq.push, "127.0.0.1:3")
+	push(sq.pushApp, "127.0.0.1:4")
+	massert.Require(t,
+		massert.Equal(uint64(1), stats.sendsQueued.Load()),
+		massert.Equal(uint64(0), stats.sendsDropped.Load()),
+		massert.Equal(uint64(3), stats.appSendsQueued.Load()),
+		massert.Equal(uint64(1), stats.appSendsDropped.Load()),
+	)
+
+	// the control lane is emptied first, even though its batch was pushed
+	// after some of the app lane's.
+	var got []string
+	for qs, ok := sq.pop(); ok; qs, ok = sq.pop() {
+		got = append(got, qs.sb.pkts[0].dst.String())
+	}
+	massert.Require(t, massert.Equal(
+		[]string{"127.0.0.1:3", "127.0.0.1:2", "127.0.0.1:4"}, got,
+	))
+}
+
+func TestPeerQueueSends(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, serverAddr := testServer(ctx, t, nil)
+	peer := testPeer(ctx, t, serverAddr.String(), PeerOpts{QueueSends: true})
+
+	recv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer recv.Close()
+
+	n, err := peer.WriteTo([]byte("foo"), recv.LocalAddr())
+	massert.Require(t, massert.Nil(err), massert.Equal(3, n))
+	massert.Require(t, massert.Nil(peer.Send([]byte("bar"), recv.LocalAddr())))
+
+	b := make([]byte, 3)
+	for _, exp := range []string{"foo", "bar"} {
+		recv.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := recv.ReadFrom(b)
+		massert.Require(t,
+			massert.Nil(err),
+			massert.Equal(exp, string(b[:n])),
+		)
+	}
+	massert.Require(t, massert.Equal(uint64(2), peer.Stats().AppSendsQueued))
+}
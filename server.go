@@ -1,14 +1,20 @@
 package bonfire
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"net"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Server implements a bonfire server which can listen for and handle peers on a
-// single network address.
+// Server implements a bonfire server which can listen for and handle peers on
+// one or more network addresses (see ListenEndpoints).
 type Server struct {
 	// Errors encountered when interacting with peers will be written
 	// here. If nil or if the channel blocks errors will be dropped.
@@ -29,44 +35,371 @@ type Server struct {
 
 	// Maximum number of go-routines handling incoming packets at any given
 	// moment. Each packet is handled by its own go-routine. Default is 500.
+	//
+	// If a HelloServer message arrives while this many go-routines are
+	// already running, the server is considered overloaded and will respond
+	// with a Busy message rather than handling it.
 	MaxConcurrent int
 
+	// The maximum number of Meet messages which will be sent to any single
+	// ready-to-mingle peer per MeetBudgetInterval. Once a peer has been sent
+	// this many it is passed over in favor of others until the interval is
+	// up, so that introductions are spread fairly across all peers. If 0 (the
+	// default) there is no limit, other than what peers ask for themselves.
+	MaxMeetsPerMingler int
+
+	// The interval over which MaxMeetsPerMingler applies. Default is
+	// ReadyToMingleTimeout.
+	MeetBudgetInterval time.Duration
+
+	// The time which peers are asked to wait before retrying, when the server
+	// responds to them with a Busy message. Default is 5 * time.Second.
+	BusyRetryAfter time.Duration
+
+	// The minimum interval between Occupancy messages from any single IP which
+	// the server will answer. Others received within the interval are dropped.
+	// Default is time.Second.
+	OccupancyInterval time.Duration
+
+	// If greater than 0, every message sent by the server includes the time it
+	// was sent, and messages received which don't, or which are older than
+	// this (or further than this in the future), are dropped. Copies of a
+	// message received within that time are dropped as well, including those
+	// sent due to a peer's PacketBlastCount, so that captured messages can't
+	// be replayed. See PeerOpts' MaxMessageAge, which peers must set as well.
+	MaxMessageAge time.Duration
+
 	// An optional function which can be used to filter out messages based on
 	// their fingerprint. If FingerprintCheck returns false the packet is
-	// dropped.
+	// dropped (see SendAuthFailed), and counted against the IP it came from
+	// (see AuthFailures).
 	//
 	// One example use-case is the peer and server having a pre-shared key, and
-	// the peer using a random set of bytes and an HMAC-SHA1 of those bytes, and
+	// the peer using a random set of bytes and an HMAC of those bytes, and
 	// setting the fingerprint to the concatenation of those two values. The
 	// server can then use FingerprintCheck to ensure that all peers know the
-	// pre-shared secret.
+	// pre-shared secret. PSKFingerprintFunc and PSKFingerprintCheck implement
+	// this.
 	FingerprintCheck func([]byte) bool
 
-	conn       net.PacketConn // created and set during Listen
-	mingleZSet *zset
+	// An optional function which, if set, must return true for the
+	// fingerprint of an Occupancy message in order for the server to answer
+	// it. This can be used to only reveal occupancy to peers which know some
+	// secret, in the same way as FingerprintCheck (which also applies).
+	OccupancyCheck func([]byte) bool
+
+	// An optional callback which is called for every Meet message sent by the
+	// server, e.g. for the purpose of keeping an audit log (see AuditLog).
+	// Errors returned are written to ErrCh.
+	OnIntroduction func(Introduction) error
+
+	// If set, an OpenTelemetry span is recorded for every packet handled by
+	// the server.
+	TracerProvider trace.TracerProvider
+
+	// If true, Listen creates its UDP port with SO_REUSEPORT set, so that
+	// multiple Servers (possibly in separate processes) may listen on the same
+	// address and have the kernel spread incoming packets across them. Each
+	// Server keeps its own set of ready-to-mingle peers. Listen will return an
+	// error on platforms where this isn't supported.
+	ReusePort bool
+
+	// If true, and running on Linux, the copies of each message which are
+	// sent due to PacketBlastCount are written using UDP segmentation offload
+	// (UDP_SEGMENT), so that the kernel sends them all as the result of a
+	// single write. This reduces the cost of sending for busy servers. If the
+	// kernel or network device doesn't support it, or on other platforms, the
+	// messages are sent as normal. It has no effect on endpoints which have
+	// been wrapped by WrapConn.
+	SegmentOffload bool
+
+	// If true, packets are handled one at a time, in the order they're read,
+	// on the go-routine which read them, rather than each on its own
+	// go-routine, and ready-to-mingle peers are expired in between packets
+	// rather than in the background. Along with Now, and a single endpoint,
+	// this makes the Server's behavior depend only on the packets it receives,
+	// so that simulations and fuzzers can reproduce ordering-dependent bugs.
+	// MaxConcurrent is ignored, and no Busy messages are sent.
+	Synchronous bool
+
+	// If set, it's used in place of time.Now for all of the Server's
+	// timekeeping, e.g. when expiring ready-to-mingle peers, rate limiting,
+	// and stamping and signing messages. This is intended for simulations
+	// which control the passing of time. It must be safe to call concurrently
+	// unless Synchronous is set.
+	Now func() time.Time
+
+	// If set, every message sent by the server is signed with this key, so
+	// that peers which have the corresponding public key (see PeerOpts'
+	// ServerPublicKey) can tell that it wasn't forged.
+	SigningKey ed25519.PrivateKey
+
+	// If true, every message sent by the server is padded to MaxMessageSize
+	// bytes, so that they can't be told apart from each other (or identified
+	// as bonfire messages) by their size. See PeerOpts' PadMessages.
+	PadMessages bool
+
+	// If set, each PacketConn passed to Serve (including by Listen) is passed
+	// through WrapConn, and the returned PacketConn is used in its place. This
+	// allows the server's traffic to be obfuscated, see PeerOpts' WrapConn.
+	// If WrapConn returns an error it is returned from Serve, and the
+	// original PacketConn is closed.
+	WrapConn func(net.PacketConn) (net.PacketConn, error)
+
+	// If true, the server responds to every HelloServer with a YouAre
+	// message, carrying the address which the HelloServer was observed coming
+	// from, in addition to any Meet or HelloPeer messages. Otherwise peers
+	// only learn their remote address (see Peer's RemoteAddr) from HelloPeer
+	// messages, which the server only sends itself if there aren't enough
+	// ready-to-mingle peers. Peers which predate this option will ignore
+	// YouAre messages.
+	SendYouAre bool
+
+	// If true, peers whose addresses are publicly routable are never
+	// introduced to private or otherwise non-routable addresses (see
+	// IsBogon), which peers behind broken NATs sometimes advertise. Such
+	// candidates are removed from the Meet messages sent to public peers,
+	// and public peers aren't sent Meet messages at all for peers which the
+	// server observed at a non-routable address. Peers on private networks
+	// are introduced as usual. Candidates within Sealed blobs (see PeerOpts'
+	// PrivacyKey) can't be filtered.
+	FilterBogons bool
+
+	// If true along with FilterBogons, the candidates which FilterBogons
+	// removes from a Meet are instead included as its LANCandidates, when the
+	// mingler it's sent to was observed at the same IP as the peer being
+	// introduced. The two are then behind the same NAT, and may be able to
+	// reach each other over their local network. Peers which predate this
+	// option will ignore LANCandidates.
+	SameNATCandidates bool
+
+	// If true, messages which fail the FingerprintCheck are responded to with
+	// an AuthFailed message, rather than being dropped silently, so that
+	// misconfigured peers can tell what's wrong. AuthFailed messages aren't
+	// authenticated in any way, and are sent to each IP at most once every 10
+	// seconds. Peers which predate this option will ignore AuthFailed
+	// messages.
+	SendAuthFailed bool
+
+	// If set, every message sent by the server carries this ID (see Message's
+	// InstanceID), which may be at most MaxInstanceIDSize bytes long. When
+	// multiple Servers share an anycast address, so that consecutive packets
+	// from a peer may reach different ones, each should be given a distinct
+	// ID. Peers then notice when they start reaching a different instance and
+	// send it a ReadyToMingle straight away, rather than remaining unknown to
+	// it until their next ReadyToMingleInterval. Instances don't otherwise
+	// share any state, so each only introduces peers to those which have
+	// reached it, unless OnMinglerAdded and AddMingler are used.
+	InstanceID []byte
+
+	// If set, OnMinglerAdded is called with each ready-to-mingle peer whenever
+	// a ReadyToMingle is received from it, and OnMinglerExpired with each
+	// which has expired (see ReadyToMingleTimeout). Along with AddMingler,
+	// these allow a cluster of Servers (e.g. instances sharing an anycast
+	// address, see InstanceID) to share their ready-to-mingle peers with each
+	// other. They are called on the go-routine handling the packet or doing
+	// the expiry, so must not block.
+	OnMinglerAdded, OnMinglerExpired func(Mingler)
+
+	// If set, the address of an upstream Server which this one federates with,
+	// so that a federation of small servers can share their ready-to-mingle
+	// peers. The server registers with the upstream as a ready-to-mingle
+	// "super peer", and relays each Meet it receives from it to one of its own
+	// ready-to-mingle peers. When the server has fewer ready-to-mingle peers
+	// than PeersToMeet for a HelloServer, it also forwards the HelloServer to
+	// the upstream (see Message's ForwardedFor), which introduces the peer to
+	// its own. The upstream must include this server in its Downstreams.
+	//
+	// A federation must form a tree, i.e. a server mustn't be upstream of
+	// itself. Only peers without a Rendezvous key are federated. Upstreams
+	// which predate this option will drop forwarded HelloServer messages.
+	// UpstreamPublicKey must be set along with it.
+	Upstream string
+
+	// Generates the fingerprints of the ReadyToMingle messages sent to the
+	// Upstream, as PeerOpts' FingerprintFunc does for a Peer, e.g. so that
+	// they pass its FingerprintCheck. Default is random fingerprints.
+	UpstreamFingerprintFunc func() ([]byte, error)
+
+	// Meet messages from the Upstream are only relayed if they're signed using
+	// the private key corresponding to this one (see SigningKey). Such Meets
+	// carry the fingerprints of the upstream's peers, so aren't subject to the
+	// FingerprintCheck. Required if Upstream is set.
+	UpstreamPublicKey ed25519.PublicKey
+
+	// Networks of the downstream servers (see Upstream) whose forwarded
+	// HelloServer messages are accepted. Others are dropped, since they would
+	// allow anyone to have the server introduce arbitrary addresses to its
+	// peers.
+	Downstreams []*net.IPNet
+
+	conns           []net.PacketConn // created and set during Listen
+	upstream        net.Addr         // resolved from Upstream by Serve
+	tracer          trace.Tracer     // built from TracerProvider by Serve
+	relayLimits     *ipLimiter       // Meets recently relayed from upstream
+	mingleZSets     *zsets
+	occupancyLimits *ipLimiter
+
+	authFailures     authFailures
+	authFailedLimits *ipLimiter
+
+	replays replayCache // see MaxMessageAge
+
+	families map[net.PacketConn]int // of conns, see SegmentOffload
+
+	cfgL       sync.RWMutex
+	cfg        *ServerConfig // set by Serve or UpdateConfig
+	reconfigCh chan struct{}
+	throttle   *throttle
+
+	// syncL is held while handling a packet when Synchronous is set, and
+	// nextExpire is when expiry is next due.
+	syncL      sync.Mutex
+	nextExpire time.Time
+
+	stats serverStats
+	banL  sync.RWMutex
+	bans  map[string]net.IP
+}
+
+// ServerConfig holds the parameters of a Server which may be changed while it
+// is serving, using UpdateConfig. Each field has the same meaning as the
+// Server field of the same name.
+type ServerConfig struct {
+	PacketBlastCount     int
+	PeersToMeet          int
+	ReadyToMingleTimeout time.Duration
+	MaxConcurrent        int
+	MaxMeetsPerMingler   int
+	MeetBudgetInterval   time.Duration
+	BusyRetryAfter       time.Duration
+	OccupancyInterval    time.Duration
+	MaxMessageAge        time.Duration
+}
+
+func (cfg ServerConfig) withDefaults() ServerConfig {
+	if cfg.PacketBlastCount == 0 {
+		cfg.PacketBlastCount = 3
+	}
+	if cfg.PeersToMeet == 0 {
+		cfg.PeersToMeet = 3
+	}
+	if cfg.ReadyToMingleTimeout == 0 {
+		cfg.ReadyToMingleTimeout = 2 * time.Minute
+	}
+	if cfg.MaxConcurrent == 0 {
+		cfg.MaxConcurrent = 500
+	}
+	if cfg.MeetBudgetInterval == 0 {
+		cfg.MeetBudgetInterval = cfg.ReadyToMingleTimeout
+	}
+	if cfg.BusyRetryAfter == 0 {
+		cfg.BusyRetryAfter = 5 * time.Second
+	}
+	if cfg.OccupancyInterval == 0 {
+		cfg.OccupancyInterval = time.Second
+	}
+	return cfg
 }
 
 // NewServer instantiates and returns a usable Server instance. Public fields on
 // the instance may be modified to change its behavior prior to any methods
-// being called, but not after.
+// being called, but not after. Some may be changed later using UpdateConfig.
 func NewServer() *Server {
-	return &Server{
+	s := &Server{
 		PacketBlastCount:     3,
 		PeersToMeet:          3,
 		ReadyToMingleTimeout: 2 * time.Minute,
 		MaxConcurrent:        500,
-		mingleZSet:           newZSet(),
+		BusyRetryAfter:       5 * time.Second,
+		OccupancyInterval:    time.Second,
+		mingleZSets:          newZSets(),
+		occupancyLimits:      new(ipLimiter),
+		authFailedLimits:     new(ipLimiter),
+		relayLimits:          new(ipLimiter),
+		reconfigCh:           make(chan struct{}, 1),
+		throttle:             new(throttle),
+		tracer:               tracer(nil),
+	}
+	s.mingleZSets.now = s.now
+	return s
+}
+
+// now returns the current time, according to the Server's Now field if set.
+func (s *Server) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// Config returns the ServerConfig currently in effect.
+func (s *Server) Config() ServerConfig {
+	s.cfgL.RLock()
+	defer s.cfgL.RUnlock()
+	if s.cfg != nil {
+		return *s.cfg
+	}
+	return s.fieldsConfig()
+}
+
+func (s *Server) fieldsConfig() ServerConfig {
+	return ServerConfig{
+		PacketBlastCount:     s.PacketBlastCount,
+		PeersToMeet:          s.PeersToMeet,
+		ReadyToMingleTimeout: s.ReadyToMingleTimeout,
+		MaxConcurrent:        s.MaxConcurrent,
+		MaxMeetsPerMingler:   s.MaxMeetsPerMingler,
+		MeetBudgetInterval:   s.MeetBudgetInterval,
+		BusyRetryAfter:       s.BusyRetryAfter,
+		OccupancyInterval:    s.OccupancyInterval,
+		MaxMessageAge:        s.MaxMessageAge,
+	}.withDefaults()
+}
+
+// UpdateConfig atomically replaces the Server's configuration, and may be
+// called at any time, including while Serve is running. Zero values are
+// replaced with their defaults, so the simplest way to change a single field
+// is to modify the value returned from Config and pass that in.
+//
+// Changes apply to all packets handled after UpdateConfig returns. Peers which
+// are already ready-to-mingle are kept, and are expired according to the new
+// ReadyToMingleTimeout. If any field of the ServerConfig is invalid an error
+// is returned and the configuration is left unchanged.
+func (s *Server) UpdateConfig(cfg ServerConfig) error {
+	cfg = cfg.withDefaults()
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	s.setConfig(cfg)
+	select {
+	case s.reconfigCh <- struct{}{}:
+	default:
 	}
+	return nil
+}
+
+func (s *Server) setConfig(cfg ServerConfig) {
+	s.cfgL.Lock()
+	s.cfg = &cfg
+	s.cfgL.Unlock()
+
+	s.throttle.setMax(cfg.MaxConcurrent)
+	s.mingleZSets.setCapacity(MingleCapacity{
+		Meets:    cfg.MaxMeetsPerMingler,
+		Interval: cfg.MeetBudgetInterval,
+	})
 }
 
 // Listen blocks while the Server listens for and handles communicating with
-// peers on the given address. Currently the only supported network is "udp".
+// peers on the given address. The network may be "udp", or "udp4" or "udp6" to
+// restrict the Server to a single address family.
 func (s *Server) Listen(ctx context.Context, network, addr string) error {
-	if network != "udp" {
-		panic("only network 'udp' is supported by Listen")
+	if err := checkNetwork(network); err != nil {
+		return err
 	}
 
-	conn, err := net.ListenPacket(network, addr)
+	conn, err := listenPacket(network, addr, s.ReusePort)
 	if err != nil {
 		return err
 	}
@@ -74,36 +407,201 @@ func (s *Server) Listen(ctx context.Context, network, addr string) error {
 	return s.Serve(ctx, conn)
 }
 
+// ListenEndpoints is like Listen, but listens on all of the given addresses at
+// once, each being an endpoint of the Server. Peers are introduced to each
+// other regardless of which endpoints they use.
+//
+// A Server with multiple endpoints, on distinct IPs or ports, allows peers to
+// determine what sort of NAT they are behind by comparing the addresses which
+// each endpoint observes them at. See Peer's ProbeNAT.
+func (s *Server) ListenEndpoints(ctx context.Context, network string, addrs ...string) error {
+	if err := checkNetwork(network); err != nil {
+		return err
+	}
+
+	conns := make([]net.PacketConn, 0, len(addrs))
+	for _, addr := range addrs {
+		conn, err := listenPacket(network, addr, s.ReusePort)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return err
+		}
+		conns = append(conns, conn)
+	}
+
+	return s.Serve(ctx, conns...)
+}
+
 // Serve blocks while the Server listens for and handles communicating with
-// peers accepted from the given PacketConn. It will return context.Canceled if
-// the context is canceled.
-func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
-	s.conn = conn
+// peers accepted from the given PacketConns, each being an endpoint of the
+// Server (see ListenEndpoints). It will return context.Canceled if the context
+// is canceled, or an error without serving if any of the Server's fields are
+// invalid.
+func (s *Server) Serve(ctx context.Context, conns ...net.PacketConn) error {
+	if len(conns) == 0 {
+		return errors.New("at least one PacketConn must be given to Serve")
+	}
+
+	// if UpdateConfig was called prior to Serve then that config is used,
+	// otherwise the public fields are.
+	s.cfgL.RLock()
+	cfg := s.cfg
+	s.cfgL.RUnlock()
+	if cfg == nil {
+		fieldsCfg := s.fieldsConfig()
+		cfg = &fieldsCfg
+	}
+	if err := s.validate(*cfg); err != nil {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return err
+	}
+
+	if err := s.resolveUpstream(connNetwork(conns[0])); err != nil {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return err
+	}
+
+	s.conns = make([]net.PacketConn, len(conns))
+	for i, conn := range conns {
+		conn, err := wrapConn(s.WrapConn, conn)
+		if err != nil {
+			for _, conn := range s.conns[:i] {
+				conn.Close()
+			}
+			for _, conn := range conns[i+1:] {
+				conn.Close()
+			}
+			return err
+		}
+		s.conns[i] = conn
+	}
+
+	// segmentation offload sends need to know the family of the socket, which
+	// doesn't change.
+	if s.SegmentOffload {
+		s.families = map[net.PacketConn]int{}
+		for _, conn := range s.conns {
+			if udpConn, ok := conn.(*net.UDPConn); ok {
+				s.families[conn] = sockFamily(udpConn)
+			}
+		}
+	}
+
+	s.setConfig(*cfg)
+	s.tracer = tracer(s.TracerProvider)
+
+	// if any endpoint fails then the others are stopped too.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	wg := new(sync.WaitGroup)
 	defer wg.Wait()
 
-	// set up a routine which will periodically expire out ready-to-mingle peers
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		t := time.NewTicker(s.ReadyToMingleTimeout / 2)
-		defer t.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-t.C:
-				s.mingleZSet.expire(time.Now().Add(-s.ReadyToMingleTimeout))
+	// set up a routine which will periodically expire out ready-to-mingle
+	// peers, unless that's done between packets.
+	if !s.Synchronous {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				// the config is re-checked every time, in case it's been
+				// changed by UpdateConfig.
+				cfg := s.Config()
+				timeout := cfg.ReadyToMingleTimeout
+				t := time.NewTimer(timeout / 2)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return
+				case <-s.reconfigCh:
+					t.Stop()
+				case <-t.C:
+					s.expire(cfg, s.now())
+				}
 			}
+		}()
+	}
+
+	if s.upstream != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.spinUpstream(ctx)
+		}()
+	}
+
+	errCh := make(chan error, len(s.conns))
+	for _, conn := range s.conns {
+		wg.Add(1)
+		go func(conn net.PacketConn) {
+			defer wg.Done()
+			errCh <- s.serveConn(ctx, wg, conn)
+		}(conn)
+	}
+
+	err := <-errCh
+	cancel()
+	return err
+}
+
+// expire discards ready-to-mingle peers, and rate limiting state, which are
+// older than the config allows as of the given time.
+func (s *Server) expire(cfg ServerConfig, now time.Time) {
+	// OnMinglerExpired is called once the zsets are unlocked, in case it
+	// calls back into the Server.
+	var expired []Mingler
+	var onExpire func([]byte, zsetEl)
+	if s.OnMinglerExpired != nil {
+		onExpire = func(rendezvous []byte, zEl zsetEl) {
+			expired = append(expired, zEl.mingler(rendezvous))
 		}
-	}()
+	}
+	s.mingleZSets.expire(now.Add(-cfg.ReadyToMingleTimeout), onExpire)
+	for _, mingler := range expired {
+		s.OnMinglerExpired(mingler)
+	}
+	s.occupancyLimits.prune(now.Add(-cfg.OccupancyInterval))
+	s.authFailedLimits.prune(now.Add(-authFailedInterval))
+	s.relayLimits.prune(now.Add(-relayInterval))
+
+	// a message's Timestamp may be up to MaxMessageAge ahead of when it was
+	// received, and a copy of it is fresh until MaxMessageAge after that.
+	s.replays.prune(now.Add(-2 * cfg.MaxMessageAge))
+}
 
-	// set up a throttle. each go-routine will need to read an element from the
-	// throttle to be created, and will write the element back when its done.
-	throttle := make(chan struct{}, s.MaxConcurrent)
-	for i := 0; i < s.MaxConcurrent; i++ {
-		throttle <- struct{}{}
+// handleSync handles the packet on the calling go-routine, see Synchronous.
+// Packets from all endpoints are handled one at a time. Expiry is done before
+// handling the packet, once half of the ReadyToMingleTimeout has passed since
+// it was last done, as it would be by the background routine.
+func (s *Server) handleSync(conn net.PacketConn, b []byte, src net.Addr, readAt time.Time) {
+	s.syncL.Lock()
+	defer s.syncL.Unlock()
+	cfg, now := s.Config(), s.now()
+	if s.nextExpire.IsZero() {
+		s.nextExpire = now.Add(cfg.ReadyToMingleTimeout / 2)
+	} else if !now.Before(s.nextExpire) {
+		s.expire(cfg, now)
+		s.nextExpire = now.Add(cfg.ReadyToMingleTimeout / 2)
+	}
+	s.handlePacket(conn, b, src, readAt)
+}
+
+// serveConn reads and handles packets from a single endpoint, until the
+// context is canceled or reading fails. Go-routines spawned to handle packets
+// are added to the WaitGroup.
+func (s *Server) serveConn(ctx context.Context, wg *sync.WaitGroup, conn net.PacketConn) error {
+	// packets are read in batches where the platform allows it. Each buffer
+	// is handed off to the go-routine handling its packet, and so is replaced
+	// once read into.
+	pkts := make([]inPacket, readBatchSize)
+	for i := range pkts {
+		pkts[i].b = make([]byte, MaxMessageSize)
 	}
 
 	for {
@@ -111,9 +609,8 @@ func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
 			return err
 		}
 
-		b := make([]byte, MaxMessageSize)
-		s.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, srcAddr, err := s.conn.ReadFrom(b)
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := readPackets(conn, pkts)
 		if err != nil {
 			if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
 				continue
@@ -121,14 +618,103 @@ func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
 			return err
 		}
 
-		<-throttle
-		wg.Add(1)
-		go func(b []byte, srcAddr net.Addr) {
-			defer wg.Done()
-			s.handlePacket(b, srcAddr)
-			throttle <- struct{}{}
-		}(b[:n], srcAddr)
+		readAt := time.Now()
+		for i := range pkts[:n] {
+			b, srcAddr := pkts[i].b[:pkts[i].n], pkts[i].src
+			s.stats.packetsReceived.Add(1)
+
+			if s.Synchronous {
+				s.handleSync(conn, b, srcAddr, readAt)
+				continue
+			}
+
+			// each go-routine must acquire from the throttle to be created,
+			// and releases back to it when done.
+			if !s.throttle.tryAcquire() {
+				// all go-routines are busy, so tell new peers to back off
+				// rather than leaving them waiting.
+				if s.replyBusy(conn, b, srcAddr) {
+					continue
+				}
+				s.throttle.acquire()
+			}
+
+			pkts[i].b = make([]byte, MaxMessageSize)
+			wg.Add(1)
+			go func(b []byte, srcAddr net.Addr) {
+				defer wg.Done()
+				s.handlePacket(conn, b, srcAddr, readAt)
+				s.throttle.release()
+			}(b, srcAddr)
+		}
+	}
+}
+
+// newSendBatch returns a sendBatch for sending messages from the given
+// endpoint of the Server.
+func (s *Server) newSendBatch(conn net.PacketConn) *sendBatch {
+	sb := newSendBatch(conn)
+	if s.PadMessages {
+		sb.padTo = MaxMessageSize
 	}
+	sb.stamp = s.Config().MaxMessageAge > 0
+	sb.signKey = s.SigningKey
+	sb.instanceID = s.InstanceID
+	sb.segment = s.SegmentOffload
+	sb.family = s.families[conn]
+	sb.now = s.Now
+	return sb
+}
+
+// sendBatches holds a sendBatch for each endpoint of a Server, for when the
+// messages resulting from a single packet must be sent from more than one of
+// them.
+type sendBatches struct {
+	s  *Server
+	m  map[net.PacketConn]*sendBatch
+	mL []net.PacketConn // keys of m, in the order they were added
+}
+
+func (s *Server) newSendBatches() *sendBatches {
+	return &sendBatches{s: s, m: map[net.PacketConn]*sendBatch{}}
+}
+
+// get returns the sendBatch for the given endpoint, creating it if necessary.
+func (sbs *sendBatches) get(conn net.PacketConn) *sendBatch {
+	sb, ok := sbs.m[conn]
+	if !ok {
+		sb = sbs.s.newSendBatch(conn)
+		sbs.m[conn] = sb
+		sbs.mL = append(sbs.mL, conn)
+	}
+	return sb
+}
+
+// flush flushes every sendBatch, returning a SendError covering all of them
+// if any fail.
+func (sbs *sendBatches) flush() error {
+	var sendErr SendError
+	for _, conn := range sbs.mL {
+		if err := sbs.m[conn].flush(); err != nil {
+			sendErr = append(sendErr, err.(SendError)...)
+		}
+	}
+	if len(sendErr) > 0 {
+		return sendErr
+	}
+	return nil
+}
+
+// endpointAddrs returns the local addresses of all of the Server's endpoints
+// other than the given one.
+func (s *Server) endpointAddrs(exclude net.PacketConn) []net.Addr {
+	var addrs []net.Addr
+	for _, conn := range s.conns {
+		if conn != exclude {
+			addrs = append(addrs, conn.LocalAddr())
+		}
+	}
+	return addrs
 }
 
 func (s *Server) err(err error) {
@@ -141,60 +727,207 @@ func (s *Server) err(err error) {
 	}
 }
 
-func (s *Server) addMingler(addr net.Addr, fingerprint []byte) {
-	s.mingleZSet.add(addr, fingerprint)
+// replyBusy sends a Busy message in response to the given packet, if it's a
+// HelloServer message. It returns true if the packet should be dropped.
+func (s *Server) replyBusy(conn net.PacketConn, b []byte, src net.Addr) bool {
+	var msg Message
+	if err := msg.UnmarshalBinaryNoCopy(b); err != nil || msg.Type != HelloServer {
+		return false
+	} else if s.banned(src) ||
+		(s.FingerprintCheck != nil && !s.FingerprintCheck(msg.Fingerprint)) ||
+		!msg.fresh(s.Config().MaxMessageAge, s.now()) {
+		s.stats.packetsDropped.Add(1)
+		return true
+	}
+
+	// only a single Busy is sent, since the server is already overloaded
+	err := multiSend(s.newSendBatch(conn), src, 1, Message{
+		Fingerprint: msg.Fingerprint,
+		Type:        Busy,
+		BusyBody:    BusyBody{RetryAfter: s.Config().BusyRetryAfter},
+	})
+	if err != nil {
+		s.err(err)
+	} else {
+		s.stats.busySent.Add(1)
+	}
+	return true
 }
 
-func (s *Server) getMinglers(n int, excludeAddr net.Addr) []zsetEl {
-	zEls := s.mingleZSet.get(n+1, time.Now().Add(-s.ReadyToMingleTimeout))
-	if excludeAddr != nil {
-		outZEls := zEls[:0]
-		for _, zEl := range zEls {
-			if zEl.addr.Network() == excludeAddr.Network() &&
-				zEl.addr.String() == excludeAddr.String() {
-				continue
-			}
-			outZEls = append(outZEls, zEl)
+func (s *Server) addMingler(rendezvous []byte, addr net.Addr, conn net.PacketConn, fingerprint []byte, capacity MingleCapacity) {
+	if capacity.Meets > 0 && capacity.Interval <= 0 {
+		capacity.Interval = s.Config().ReadyToMingleTimeout
+	}
+	s.mingleZSets.add(rendezvous, addr, conn, fingerprint, capacity)
+	if s.OnMinglerAdded != nil {
+		// the rendezvous key may refer into the packet's buffer.
+		zEl := zsetEl{t: s.now(), addr: addr, fingerprint: fingerprint}
+		s.OnMinglerAdded(zEl.mingler(bytes.Clone(rendezvous)))
+	}
+}
+
+func (s *Server) getMinglers(rendezvous []byte, n int, excludeAddrs ...net.Addr) []zsetEl {
+	z := s.mingleZSets.get(rendezvous)
+	if z == nil {
+		return nil
+	}
+	expire := s.now().Add(-s.Config().ReadyToMingleTimeout)
+	return z.get(n, expire, excludeAddrs...)
+}
+
+func (s *Server) getMinglerByFingerprint(rendezvous, fingerprint []byte) (zsetEl, bool) {
+	z := s.mingleZSets.get(rendezvous)
+	if z == nil {
+		return zsetEl{}, false
+	}
+	expire := s.now().Add(-s.Config().ReadyToMingleTimeout)
+	return z.getByFingerprint(fingerprint, expire)
+}
+
+func (s *Server) introduced(addr net.Addr, fingerprint []byte, mingler zsetEl) {
+	if s.OnIntroduction == nil {
+		return
+	}
+	// the fingerprint refers into the packet's buffer, so is copied in case
+	// OnIntroduction retains it.
+	err := s.OnIntroduction(Introduction{
+		Time:               s.now(),
+		Addr:               addr,
+		Fingerprint:        append([]byte(nil), fingerprint...),
+		MinglerAddr:        mingler.addr,
+		MinglerFingerprint: mingler.fingerprint,
+	})
+	if err != nil {
+		s.err(err)
+	}
+}
+
+// addMeet adds a Meet message to the batches, introducing the sender of msg (a
+// HelloServer or Seek) at src to the mingler. The Meet is sent from the
+// endpoint which the mingler is using, since its NAT may not accept packets
+// from any other.
+func (s *Server) addMeet(sbs *sendBatches, cfg ServerConfig, src net.Addr, msg Message, mingler zsetEl) {
+	candidates := msg.Candidates
+	var lanCandidates []net.Addr
+	if s.FilterBogons && !isBogonAddr(mingler.addr) {
+		if isBogonAddr(src) {
+			return
 		}
-		zEls = outZEls
+		candidates = withoutBogons(candidates)
+		if s.SameNATCandidates && sameIP(src, mingler.addr) {
+			lanCandidates = onlyBogons(msg.Candidates)
+		}
+	}
+
+	meet := Message{
+		Fingerprint: mingler.fingerprint,
+		Type:        Meet,
+		MeetBody: MeetBody{
+			Fingerprint: msg.Fingerprint,
+			Addr:        src,
+		},
+		Candidates:    candidates,
+		LANCandidates: lanCandidates,
+		Sealed:        msg.Sealed,
 	}
-	if len(zEls) > n {
-		zEls = zEls[:n]
+
+	// minglers which were added by AddMingler have no endpoint of their own,
+	// and are sent Meets from the main one.
+	minglerConn := mingler.conn
+	if minglerConn == nil && len(s.conns) > 0 {
+		minglerConn = s.conns[0]
+	}
+	if err := sbs.get(minglerConn).add(mingler.addr, cfg.PacketBlastCount, meet); err != nil {
+		s.err(err)
+		return
 	}
-	return zEls
+	s.stats.meetsSent.Add(1)
+	s.introduced(src, msg.Fingerprint, mingler)
 }
 
-func (s *Server) handlePacket(b []byte, src net.Addr) {
+// handlePacket handles a packet which was read from the given endpoint at
+// readAt, which the latency of introductions is measured from (see
+// ServerStats' IntroLatency).
+func (s *Server) handlePacket(conn net.PacketConn, b []byte, src net.Addr, readAt time.Time) {
+	_, span := s.tracer.Start(
+		context.Background(), "bonfire.Server.handlePacket",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrPeerAddr.String(src.String())),
+	)
+
+	// each packet gets its own buffer, so the message may refer into it.
 	var msg Message
-	if err := msg.UnmarshalBinary(b); err != nil {
+	if err := msg.UnmarshalBinaryNoCopy(b); err != nil {
+		s.stats.packetsDropped.Add(1)
 		s.err(err)
+		endSpan(span, err)
 		return
 	}
+	span.SetAttributes(attrMessageType.String(msg.Type.String()))
+	defer span.End()
 
-	if s.FingerprintCheck != nil && !s.FingerprintCheck(msg.Fingerprint) {
+	cfg := s.Config()
+	upstreamMeet := s.verifyUpstreamMeet(src, msg)
+	if s.banned(src) || !msg.fresh(cfg.MaxMessageAge, s.now()) {
+		s.stats.packetsDropped.Add(1)
+		span.SetStatus(codes.Error, "packet dropped")
+		return
+	} else if s.FingerprintCheck != nil && !upstreamMeet && !s.FingerprintCheck(msg.Fingerprint) {
+		s.stats.packetsDropped.Add(1)
+		span.SetStatus(codes.Error, "fingerprint check failed")
+		s.authFailed(conn, src, msg)
+		return
+	} else if cfg.MaxMessageAge > 0 && s.replays.seen(msg, s.now()) {
+		s.stats.packetsDropped.Add(1)
+		s.stats.replays.Add(1)
+		span.SetStatus(codes.Error, "replayed message")
 		return
 	}
 
 	switch msg.Type {
 	case HelloServer:
-		minglers := s.getMinglers(s.PeersToMeet, src)
-		for _, mingler := range minglers {
-			err := multiSend(mingler.addr, s.conn, s.PacketBlastCount, Message{
-				Fingerprint: mingler.fingerprint,
-				Type:        Meet,
-				MeetBody: MeetBody{
-					Fingerprint: msg.Fingerprint,
-					Addr:        src,
-				},
-			})
-			if err != nil {
+		// a HelloServer forwarded by a downstream server introduces the peer
+		// which originally sent it, and nothing is sent to that peer since it
+		// doesn't know about this server. See Upstream.
+		if msg.ForwardedFor != nil {
+			if !s.isDownstream(src) {
+				s.stats.packetsDropped.Add(1)
+				span.SetStatus(codes.Error, "packet dropped")
+				return
+			}
+			s.stats.helloServers.Add(1)
+			sbs := s.newSendBatches()
+			minglers := s.getMinglers(msg.Rendezvous, cfg.PeersToMeet, msg.ForwardedFor, src)
+			for _, mingler := range minglers {
+				s.addMeet(sbs, cfg, msg.ForwardedFor, msg, mingler)
+			}
+			span.SetAttributes(attrMeets.Int(len(minglers)))
+			if err := sbs.flush(); err != nil {
+				span.RecordError(err)
 				s.err(err)
+			} else if len(minglers) > 0 {
+				s.stats.introLatency.observe(time.Since(readAt))
 			}
+			return
+		}
+		s.stats.helloServers.Add(1)
+
+		// all messages resulting from the HelloServer are written together.
+		sbs := s.newSendBatches()
+		minglers := s.getMinglers(msg.Rendezvous, cfg.PeersToMeet, src)
+		for _, mingler := range minglers {
+			s.addMeet(sbs, cfg, src, msg, mingler)
+		}
+		span.SetAttributes(attrMeets.Int(len(minglers)))
+
+		if len(minglers) < cfg.PeersToMeet {
+			s.forwardHelloServer(sbs, src, msg)
 		}
+
 		// if the server didn't have as many minglers available as it wanted to,
 		// it sends a Hello from itself.
-		if len(minglers) < s.PeersToMeet {
-			err := multiSend(src, s.conn, s.PacketBlastCount, Message{
+		if len(minglers) < cfg.PeersToMeet {
+			err := sbs.get(conn).add(src, cfg.PacketBlastCount, Message{
 				Fingerprint: msg.Fingerprint,
 				Type:        HelloPeer,
 				HelloPeerBody: HelloPeerBody{
@@ -203,12 +936,151 @@ func (s *Server) handlePacket(b []byte, src net.Addr) {
 			})
 			if err != nil {
 				s.err(err)
+			} else {
+				s.stats.helloPeersSent.Add(1)
 			}
 		}
+		if s.SendYouAre {
+			err := sbs.get(conn).add(src, cfg.PacketBlastCount, Message{
+				Fingerprint: msg.Fingerprint,
+				Type:        YouAre,
+				YouAreBody:  YouAreBody{Addr: src},
+			})
+			if err != nil {
+				s.err(err)
+			} else {
+				s.stats.youAresSent.Add(1)
+			}
+		}
+		if err := sbs.flush(); err != nil {
+			span.RecordError(err)
+			s.err(err)
+		} else if len(minglers) > 0 {
+			s.stats.introLatency.observe(time.Since(readAt))
+		}
+
+	case Seek:
+		s.stats.seeks.Add(1)
+
+		// if the sought peer isn't mingling then the seeker gets no response,
+		// and can fall back to HelloServer.
+		mingler, ok := s.getMinglerByFingerprint(msg.Rendezvous, msg.SeekBody.Fingerprint)
+		if !ok {
+			span.SetAttributes(attrMeets.Int(0))
+			return
+		}
+		span.SetAttributes(attrMeets.Int(1))
+
+		sbs := s.newSendBatches()
+		s.addMeet(sbs, cfg, src, msg, mingler)
+		if err := sbs.flush(); err != nil {
+			span.RecordError(err)
+			s.err(err)
+		}
+
+	case Occupancy:
+		if !s.occupancyAllowed(msg, src, cfg) {
+			s.stats.packetsDropped.Add(1)
+			span.SetStatus(codes.Error, "packet dropped")
+			return
+		}
+		s.stats.occupancies.Add(1)
+
+		err := multiSend(s.newSendBatch(conn), src, 1, Message{
+			Fingerprint:   msg.Fingerprint,
+			Type:          Occupancy,
+			OccupancyBody: OccupancyBody{Minglers: uint32(s.Occupancy(msg.Rendezvous))},
+			Rendezvous:    msg.Rendezvous,
+		})
+		if err != nil {
+			span.RecordError(err)
+			s.err(err)
+		}
+
+	case Probe:
+		// only requests are answered, responses are never sent to the server
+		// by well-behaved peers.
+		if msg.ProbeBody.Addr != nil {
+			s.stats.packetsDropped.Add(1)
+			span.SetStatus(codes.Error, "packet dropped")
+			return
+		}
+		s.stats.probes.Add(1)
+
+		err := multiSend(s.newSendBatch(conn), src, 1, Message{
+			Fingerprint: msg.Fingerprint,
+			Type:        Probe,
+			ProbeBody:   ProbeBody{Addr: src},
+			Candidates:  s.endpointAddrs(conn),
+		})
+		if err != nil {
+			span.RecordError(err)
+			s.err(err)
+		}
+
+	case Meet:
+		// Meet messages are only expected from the Upstream.
+		if !upstreamMeet {
+			return
+		}
+		if err := s.relayMeet(cfg, msg); err != nil {
+			span.RecordError(err)
+			s.err(err)
+		}
 
 	case ReadyToMingle:
-		s.addMingler(src, msg.Fingerprint)
+		s.stats.readyToMingles.Add(1)
+
+		// the fingerprint refers into the packet's buffer, copy it so the rest
+		// of the buffer isn't retained along with it. The rendezvous key is
+		// only used as a map key, which copies it anyway.
+		s.addMingler(msg.Rendezvous, src, conn, append([]byte(nil), msg.Fingerprint...), msg.MingleCapacity)
 	default:
 		return
 	}
 }
+
+// throttle limits the number of go-routines handling packets. Unlike a buffered
+// channel its limit can be changed while it's in use; if lowered, no new
+// go-routines are allowed until enough of the existing ones have finished.
+type throttle struct {
+	l      sync.Mutex
+	cond   *sync.Cond
+	n, max int
+}
+
+func (t *throttle) setMax(max int) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.cond == nil {
+		t.cond = sync.NewCond(&t.l)
+	}
+	t.max = max
+	t.cond.Broadcast()
+}
+
+func (t *throttle) tryAcquire() bool {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.n >= t.max {
+		return false
+	}
+	t.n++
+	return true
+}
+
+func (t *throttle) acquire() {
+	t.l.Lock()
+	defer t.l.Unlock()
+	for t.n >= t.max {
+		t.cond.Wait()
+	}
+	t.n++
+}
+
+func (t *throttle) release() {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.n--
+	t.cond.Signal()
+}
@@ -3,6 +3,7 @@ package bonfire
 import (
 	"context"
 	"net"
+	"sync"
 	. "testing"
 	"time"
 
@@ -120,3 +121,377 @@ func TestServerPeer(t *T) {
 
 	massert.Require(t, assertAddr(peerA.RemoteAddr(), peerB.PeerAddrs()[0]))
 }
+
+func TestServerUpdateConfig(t *T) {
+	server := NewServer()
+	server.PeersToMeet = 4
+	massert.Require(t,
+		massert.Equal(4, server.Config().PeersToMeet),
+		massert.Equal(server.ReadyToMingleTimeout, server.Config().MeetBudgetInterval),
+	)
+
+	cfg := server.Config()
+	cfg.PeersToMeet = 5
+	cfg.MaxMeetsPerMingler = 2
+	cfg.PacketBlastCount = 0
+	server.UpdateConfig(cfg)
+	massert.Require(t,
+		massert.Equal(5, server.Config().PeersToMeet),
+		massert.Equal(3, server.Config().PacketBlastCount),
+		massert.Equal(2, server.mingleZSets.capacity.Meets),
+	)
+}
+
+func TestServerServeLeavesFields(t *T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer conn.Close()
+
+	// the defaults Serve resolves are kept internally, and the public fields
+	// are left as they were.
+	server := NewServer()
+	server.Serve(ctx, conn)
+	massert.Require(t,
+		massert.Equal(time.Duration(0), server.MeetBudgetInterval),
+		massert.Equal(server.ReadyToMingleTimeout, server.Config().MeetBudgetInterval),
+	)
+}
+
+func TestThrottle(t *T) {
+	th := new(throttle)
+	th.setMax(1)
+	massert.Require(t,
+		massert.Equal(true, th.tryAcquire()),
+		massert.Equal(false, th.tryAcquire()),
+	)
+
+	// raising the limit unblocks a waiting acquire
+	acquiredCh := make(chan struct{})
+	go func() {
+		th.acquire()
+		close(acquiredCh)
+	}()
+	th.setMax(2)
+	<-acquiredCh
+
+	// lowering it prevents new acquires until enough are released
+	th.setMax(1)
+	th.release()
+	massert.Require(t, massert.Equal(false, th.tryAcquire()))
+	th.release()
+	massert.Require(t, massert.Equal(true, th.tryAcquire()))
+}
+
+func TestServerBan(t *T) {
+	server := NewServer()
+	a, b := addrString("127.0.0.1:1"), addrString("127.0.0.2:1")
+	msgB, err := Message{
+		Fingerprint: make([]byte, FingerprintSize),
+		Type:        ReadyToMingle,
+	}.MarshalBinary()
+	massert.Require(t, massert.Nil(err))
+
+	server.handlePacket(nil, msgB, a, time.Now())
+	server.handlePacket(nil, msgB, b, time.Now())
+	massert.Require(t,
+		massert.Length(server.Minglers(), 2),
+		massert.Equal(uint64(2), server.Stats().ReadyToMingles),
+	)
+
+	server.Ban(net.ParseIP("127.0.0.2"))
+	server.handlePacket(nil, msgB, b, time.Now())
+	minglers := server.Minglers()
+	stats := server.Stats()
+	massert.Require(t,
+		massert.Length(minglers, 1),
+		massert.Equal(a, minglers[0].Addr),
+		massert.Equal(uint64(2), stats.ReadyToMingles),
+		massert.Equal(uint64(1), stats.PacketsDropped),
+		massert.Equal(1, stats.Minglers),
+		massert.Length(server.Bans(), 1),
+	)
+
+	server.Unban(net.ParseIP("127.0.0.2"))
+	server.handlePacket(nil, msgB, b, time.Now())
+	massert.Require(t,
+		massert.Length(server.Minglers(), 2),
+		massert.Length(server.Bans(), 0),
+	)
+}
+
+// dstsConn records the destination of every packet written to it.
+type dstsConn struct {
+	net.PacketConn
+	l    sync.Mutex
+	dsts map[string]bool
+}
+
+func (c *dstsConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.l.Lock()
+	c.dsts[addr.String()] = true
+	c.l.Unlock()
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *dstsConn) wroteTo(addr net.Addr) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.dsts[addr.String()]
+}
+
+func TestServerEndpoints(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var conns []*dstsConn
+	var addrs []string
+	for range 2 {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		conns = append(conns, &dstsConn{PacketConn: conn, dsts: map[string]bool{}})
+		addrs = append(addrs, conn.LocalAddr().String())
+	}
+
+	server := NewServer()
+	go server.Serve(ctx, conns[0], conns[1])
+
+	newPeer := func(serverAddr string) *Peer {
+		peer, err := NewPeer(ctx, "udp", serverAddr, &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			PacketBlastCount:        1,
+			ListenAddr:              "127.0.0.1:0",
+		})
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { peer.Close() })
+		peer.SetReadDeadline(time.Time{})
+		go func() {
+			b := make([]byte, MaxMessageSize)
+			for {
+				if _, _, err := peer.ReadFrom(b); err != nil {
+					return
+				}
+			}
+		}()
+		return peer
+	}
+
+	a := newPeer(addrs[0])
+	for len(server.Minglers()) < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	b := newPeer(addrs[1])
+
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	massert.Require(t, massert.Nil(b.WaitForPeers(waitCtx, 1)))
+
+	// the Meet for a must have come from the endpoint a is using, and b's
+	// HelloPeer from the server from the endpoint b is using.
+	massert.Require(t,
+		massert.Equal(true, conns[0].wroteTo(a.LocalAddr())),
+		massert.Equal(false, conns[1].wroteTo(a.LocalAddr())),
+		massert.Equal(true, conns[1].wroteTo(b.LocalAddr())),
+		massert.Equal(false, conns[0].wroteTo(b.LocalAddr())),
+	)
+}
+
+func TestServerMaxMessageAge(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	server.MaxMessageAge = time.Minute
+	go server.Serve(ctx, conn)
+	serverAddr := conn.LocalAddr().String()
+
+	newPeer := func(maxMessageAge time.Duration) (*Peer, error) {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		return NewPeer(ctx, "udp", serverAddr, &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			PacketBlastCount:        1,
+			ListenAddr:              "127.0.0.1:0",
+			MaxMessageAge:           maxMessageAge,
+		})
+	}
+
+	// a peer which doesn't timestamp its messages is ignored.
+	_, err = newPeer(0)
+	massert.Require(t,
+		massert.Not(massert.Nil(err)),
+		massert.Equal(uint64(0), server.Stats().HelloServers),
+	)
+	massert.Require(t, massert.Equal(true, server.Stats().PacketsDropped > 0))
+
+	peer, err := newPeer(time.Minute)
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+	massert.Require(t,
+		massert.Equal(peer.LocalAddr().String(), peer.RemoteAddr().String()),
+		massert.Equal(true, server.Stats().HelloServers > 0),
+	)
+
+	// a copy of a message which was already received is dropped.
+	raw, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer raw.Close()
+	b, err := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        ReadyToMingle,
+		Timestamp:   time.Now(),
+	}.MarshalBinary()
+	massert.Require(t, massert.Nil(err))
+
+	replays := server.Stats().Replays
+	for range 2 {
+		_, err = raw.WriteTo(b, conn.LocalAddr())
+		massert.Require(t, massert.Nil(err))
+	}
+	for server.Stats().Replays == replays {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var minglers int
+	for _, mingler := range server.Minglers() {
+		if mingler.Addr.String() == raw.LocalAddr().String() {
+			minglers++
+		}
+	}
+	massert.Require(t,
+		massert.Equal(replays+1, server.Stats().Replays),
+		massert.Equal(1, minglers),
+	)
+}
+
+func TestServerYouAre(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	server.PeersToMeet = 1
+	server.SendYouAre = true
+	go server.Serve(ctx, conn)
+
+	// a mingler which never responds to its Meets, so that the server doesn't
+	// send a HelloPeer of its own, and no peer does either.
+	mingler, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	defer mingler.Close()
+	b, err := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        ReadyToMingle,
+	}.MarshalBinary()
+	massert.Require(t, massert.Nil(err))
+	_, err = mingler.WriteTo(b, conn.LocalAddr())
+	massert.Require(t, massert.Nil(err))
+	for len(server.Minglers()) < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	peer, err := NewPeerAsync(ctx, "udp", conn.LocalAddr().String(), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		PacketBlastCount:        1,
+		ListenAddr:              "127.0.0.1:0",
+	})
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+	go func() {
+		b := make([]byte, MaxMessageSize)
+		for {
+			if _, _, err := peer.ReadFrom(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	for peer.RemoteAddr() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	massert.Require(t,
+		massert.Equal(peer.LocalAddr().String(), peer.RemoteAddr().String()),
+		massert.Equal(uint64(0), server.Stats().HelloPeersSent),
+		massert.Equal(uint64(1), server.Stats().YouAresSent),
+	)
+}
+
+func TestServerSynchronous(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var nowL sync.Mutex
+	now := time.Unix(1000, 0)
+	advance := func(d time.Duration) {
+		nowL.Lock()
+		defer nowL.Unlock()
+		now = now.Add(d)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	server.PacketBlastCount = 1
+	server.ReadyToMingleTimeout = time.Minute
+	server.Synchronous = true
+	server.Now = func() time.Time {
+		nowL.Lock()
+		defer nowL.Unlock()
+		return now
+	}
+	go server.Serve(ctx, conn)
+
+	listen := func() net.PacketConn {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		massert.Require(t, massert.Nil(err))
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	send := func(c net.PacketConn, typ MessageType) {
+		b, err := Message{
+			Fingerprint: mrand.Bytes(FingerprintSize),
+			Type:        typ,
+		}.MarshalBinary()
+		massert.Require(t, massert.Nil(err))
+		_, err = c.WriteTo(b, conn.LocalAddr())
+		massert.Require(t, massert.Nil(err))
+	}
+	recvType := func(c net.PacketConn) MessageType {
+		b := make([]byte, MaxMessageSize)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := c.ReadFrom(b)
+		massert.Require(t, massert.Nil(err))
+		var msg Message
+		massert.Require(t, massert.Nil(msg.UnmarshalBinary(b[:n])))
+		return msg.Type
+	}
+
+	mingler := listen()
+	send(mingler, ReadyToMingle)
+	for len(server.Minglers()) < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	massert.Require(t, massert.Equal(time.Unix(1000, 0), server.Minglers()[0].LastSeen))
+
+	// while the mingler hasn't expired, according to the Server's clock, a
+	// new peer is introduced to it.
+	advance(50 * time.Second)
+	send(listen(), HelloServer)
+	massert.Require(t, massert.Equal(Meet, recvType(mingler)))
+
+	// once it has the server says hello itself, despite no real time having
+	// passed.
+	advance(20 * time.Second)
+	peer := listen()
+	send(peer, HelloServer)
+	massert.Require(t,
+		massert.Equal(HelloPeer, recvType(peer)),
+		massert.Length(server.Minglers(), 0),
+	)
+}
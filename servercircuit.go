@@ -0,0 +1,155 @@
+package bonfire
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errServerSilent is passed to serverFailed when an attempt to contact the
+// server got no answer.
+var errServerSilent = errors.New("no messages received from server since the last ReadyToMingle")
+
+// ServerCircuitState describes whether a Peer currently considers its server
+// to be healthy, see PeerOpts' ServerFailureThreshold.
+type ServerCircuitState int
+
+// Possible ServerCircuitStates.
+const (
+	// ServerCircuitClosed is the state of a Peer whose server is healthy, or
+	// which doesn't use a circuit breaker at all. ReadyToMingle messages are
+	// sent every ReadyToMingleInterval.
+	ServerCircuitClosed ServerCircuitState = iota
+
+	// ServerCircuitOpen is the state of a Peer which has failed to contact its
+	// server ServerFailureThreshold times in a row. No ReadyToMingle messages
+	// are sent until the current backoff has passed.
+	ServerCircuitOpen
+
+	// ServerCircuitHalfOpen is the state of a Peer whose backoff has passed,
+	// and which has sent a single ReadyToMingle to the server to probe whether
+	// it has recovered. If it fails the circuit opens again with double the
+	// backoff, otherwise it closes.
+	ServerCircuitHalfOpen
+)
+
+func (s ServerCircuitState) String() string {
+	switch s {
+	case ServerCircuitClosed:
+		return "Closed"
+	case ServerCircuitOpen:
+		return "Open"
+	case ServerCircuitHalfOpen:
+		return "HalfOpen"
+	default:
+		return fmt.Sprintf("ServerCircuitState(%d)", int(s))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface, so that the
+// ServerCircuitState is encoded by name, e.g. in JSON.
+func (s ServerCircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// serverCircuit holds the state of a Peer's circuit breaker around its server.
+// Each ReadyToMingle sent to the server is an attempt, which fails if sending
+// it errors, the server is reported as unreachable, or no message is received
+// from the server before the next one is due, and succeeds otherwise. A Probe
+// is sent along with each ReadyToMingle, so that a healthy server always
+// sends something back.
+type serverCircuit struct {
+	state         ServerCircuitState
+	failures      int  // consecutive failed attempts
+	attempting    bool // whether an attempt is in progress
+	attemptFailed bool // whether the attempt in progress has failed
+	answered      bool // whether the server has sent anything during the attempt
+	backoff       time.Duration
+	retryAt       time.Time // when the circuit is open, the time of the next probe
+}
+
+// ServerCircuitState returns the current state of the Peer's circuit breaker
+// around its server, see PeerOpts' ServerFailureThreshold.
+func (p *Peer) ServerCircuitState() ServerCircuitState {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	return p.circuit.state
+}
+
+// setCircuitState moves the circuit breaker into the given state, emitting a
+// PeerEventServerCircuitChanged if it's a different one.
+//
+// This must be called with the lock held.
+func (p *Peer) setCircuitState(s ServerCircuitState, err error) {
+	if s == p.circuit.state {
+		return
+	}
+	p.circuit.state = s
+	p.event(PeerEvent{Type: PeerEventServerCircuitChanged, Err: err, ServerCircuit: s})
+}
+
+// circuitAllow is called whenever a ReadyToMingle is due to be sent, and
+// returns whether it should be. The previous attempt, if there was one, has
+// failed if the server didn't send anything during it. If it did then the
+// circuit was already closed at that point, see serverSucceeded.
+//
+// This must be called with the lock held.
+func (p *Peer) circuitAllow(now time.Time) bool {
+	c := &p.circuit
+	if c.attempting && !c.answered && !c.attemptFailed && p.po.ServerFailureThreshold > 0 {
+		p.serverFailed(errServerSilent)
+	}
+	c.attempting, c.attemptFailed, c.answered = false, false, false
+
+	if c.state == ServerCircuitOpen {
+		if now.Before(c.retryAt) {
+			return false
+		}
+		p.setCircuitState(ServerCircuitHalfOpen, nil)
+	}
+	c.attempting = true
+	return true
+}
+
+// serverFailed records that the current attempt to contact the server has
+// failed, opening the circuit if there have been ServerFailureThreshold such
+// failures in a row, or if the failed attempt was a probe. Only the first
+// failure of each attempt is counted.
+//
+// This must be called with the lock held.
+func (p *Peer) serverFailed(err error) {
+	if stats := p.serverStats(p.lastServerAddr); stats != nil {
+		stats.Failures++
+	}
+	c := &p.circuit
+	if p.po.ServerFailureThreshold <= 0 || c.attemptFailed {
+		return
+	}
+	c.attemptFailed = true
+	c.failures++
+
+	switch {
+	case c.state == ServerCircuitHalfOpen:
+		c.backoff *= 2
+		if c.backoff > p.po.ServerMaxBackoff {
+			c.backoff = p.po.ServerMaxBackoff
+		}
+	case c.state == ServerCircuitClosed && c.failures >= p.po.ServerFailureThreshold:
+		c.backoff = min(p.po.ReadyToMingleInterval, p.po.ServerMaxBackoff)
+	default:
+		return
+	}
+	c.retryAt = time.Now().Add(c.backoff + jitter(c.backoff/8))
+	p.setCircuitState(ServerCircuitOpen, err)
+}
+
+// serverSucceeded records that a message has been received from the server,
+// closing the circuit.
+//
+// This must be called with the lock held.
+func (p *Peer) serverSucceeded() {
+	p.circuit.answered = true
+	p.circuit.failures = 0
+	p.circuit.backoff = 0
+	p.setCircuitState(ServerCircuitClosed, nil)
+}
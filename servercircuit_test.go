@@ -0,0 +1,121 @@
+package bonfire
+
+import (
+	"context"
+	"errors"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerServerCircuit(t *T) {
+	evCh := make(chan PeerEvent, 16)
+	peer := &Peer{po: PeerOpts{
+		ReadyToMingleInterval:  time.Minute,
+		ServerFailureThreshold: 2,
+		ServerMaxBackoff:       3 * time.Minute,
+		EventCh:                evCh,
+	}}
+	errFailed := errors.New("failed")
+
+	assertState := func(state ServerCircuitState) massert.Assertion {
+		ev := <-evCh
+		return massert.All(
+			massert.Equal(PeerEventServerCircuitChanged, ev.Type),
+			massert.Equal(state, ev.ServerCircuit),
+			massert.Equal(state, peer.ServerCircuitState()),
+		)
+	}
+
+	// the circuit opens after two failed attempts in a row, with each attempt
+	// only counting once however many failures it has.
+	massert.Require(t, massert.Equal(true, peer.circuitAllow(time.Now())))
+	peer.serverFailed(errFailed)
+	massert.Require(t, massert.Equal(true, peer.circuitAllow(time.Now())))
+	peer.serverFailed(errFailed)
+	peer.serverFailed(errFailed)
+	massert.Require(t,
+		assertState(ServerCircuitOpen),
+		massert.Equal(time.Minute, peer.circuit.backoff),
+		massert.Equal(false, peer.circuitAllow(time.Now())),
+	)
+
+	// each failed probe doubles the backoff, up to ServerMaxBackoff.
+	massert.Require(t, massert.Equal(true, peer.circuitAllow(time.Now().Add(2*time.Minute))))
+	massert.Require(t, assertState(ServerCircuitHalfOpen))
+	peer.serverFailed(errFailed)
+	massert.Require(t,
+		assertState(ServerCircuitOpen),
+		massert.Equal(2*time.Minute, peer.circuit.backoff),
+		massert.Equal(false, peer.circuitAllow(time.Now().Add(time.Minute))),
+	)
+
+	massert.Require(t, massert.Equal(true, peer.circuitAllow(time.Now().Add(3*time.Minute))))
+	massert.Require(t, assertState(ServerCircuitHalfOpen))
+	peer.serverFailed(errFailed)
+	massert.Require(t,
+		assertState(ServerCircuitOpen),
+		massert.Equal(3*time.Minute, peer.circuit.backoff),
+	)
+
+	// a probe which the server answers closes the circuit.
+	massert.Require(t, massert.Equal(true, peer.circuitAllow(time.Now().Add(4*time.Minute))))
+	massert.Require(t, assertState(ServerCircuitHalfOpen))
+	peer.serverSucceeded()
+	massert.Require(t,
+		assertState(ServerCircuitClosed),
+		massert.Equal(0, peer.circuit.failures),
+		massert.Equal(true, peer.circuitAllow(time.Now())),
+	)
+
+	// as does any message from the server while it's open.
+	peer.serverFailed(errFailed)
+	massert.Require(t, massert.Equal(true, peer.circuitAllow(time.Now())))
+	peer.serverFailed(errFailed)
+	massert.Require(t, assertState(ServerCircuitOpen))
+	peer.serverSucceeded()
+	massert.Require(t,
+		assertState(ServerCircuitClosed),
+		massert.Equal(true, peer.circuitAllow(time.Now())),
+	)
+
+	// attempts which the server doesn't answer at all fail too.
+	massert.Require(t,
+		massert.Equal(true, peer.circuitAllow(time.Now())),
+		massert.Equal(1, peer.circuit.failures),
+		massert.Equal(false, peer.circuitAllow(time.Now())),
+	)
+	ev := <-evCh
+	massert.Require(t,
+		massert.Equal(ServerCircuitOpen, ev.ServerCircuit),
+		massert.Equal(errServerSilent, ev.Err),
+	)
+}
+
+func TestPeerServerCircuitSilent(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	serverCtx, serverCancel := context.WithCancel(ctx)
+	server, serverAddr := testServer(serverCtx, t, nil)
+	peer := testPeer(ctx, t, serverAddr.String(), PeerOpts{
+		ReadyToMingleInterval:  50 * time.Millisecond,
+		ServerFailureThreshold: 2,
+	})
+
+	// the server answers the Probe sent with each ReadyToMingle, so the
+	// circuit stays closed even though nothing else is sent to the peer.
+	time.Sleep(300 * time.Millisecond)
+	massert.Require(t,
+		massert.Equal(ServerCircuitClosed, peer.ServerCircuitState()),
+		massert.Equal(true, server.Stats().Probes > 0),
+	)
+
+	// once the server goes away the circuit opens.
+	serverCancel()
+	for peer.ServerCircuitState() != ServerCircuitOpen {
+		massert.Require(t, massert.Nil(ctx.Err()))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,214 @@
+package bonfire
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ServerStats describes the activity of a Server since it was created.
+type ServerStats struct {
+	// Number of packets read from the Server's PacketConns.
+	PacketsReceived uint64
+
+	// Number of packets which were dropped because they weren't valid bonfire
+	// messages, failed the Server's FingerprintCheck, were older than its
+	// MaxMessageAge or copies of ones already received, or came from a banned
+	// address. Occupancy messages which the Server declined to answer, due to
+	// OccupancyCheck or OccupancyInterval, are also counted, as are Probe
+	// messages which aren't requests.
+	PacketsDropped uint64
+
+	// Number of HelloServer, ReadyToMingle and Seek messages handled.
+	HelloServers, ReadyToMingles, Seeks uint64
+
+	// Number of Occupancy and Probe messages answered.
+	Occupancies, Probes uint64
+
+	// Number of Meet, HelloPeer, Busy, YouAre and AuthFailed messages sent,
+	// not counting duplicates sent due to PacketBlastCount.
+	MeetsSent, HelloPeersSent, BusySent, YouAresSent, AuthFailedSent uint64
+
+	// Number of HelloServer messages forwarded to the Server's Upstream, and
+	// of Meet messages from it which were relayed to the Server's own
+	// ready-to-mingle peers. Relayed Meets are also counted in MeetsSent.
+	HelloServersForwarded, MeetsRelayed uint64
+
+	// Number of messages which failed the Server's FingerprintCheck. These
+	// are also counted in PacketsDropped. See AuthFailures for a breakdown by
+	// IP.
+	AuthFailures uint64
+
+	// Number of messages which were dropped for being copies of ones already
+	// received, see MaxMessageAge. These are also counted in PacketsDropped.
+	Replays uint64
+
+	// Number of peers currently considered ready-to-mingle. Some of these may
+	// have expired but not yet been cleaned up.
+	Minglers int
+
+	// How long it took from a HelloServer being read to the Meet messages
+	// introducing its sender being written, for those which resulted in any.
+	IntroLatency LatencyHistogram
+}
+
+// serverStats holds the counters making up ServerStats, which are updated
+// concurrently by the go-routines handling packets.
+type serverStats struct {
+	packetsReceived, packetsDropped atomic.Uint64
+	helloServers, readyToMingles    atomic.Uint64
+	seeks, occupancies, probes      atomic.Uint64
+	meetsSent, helloPeersSent       atomic.Uint64
+	busySent, youAresSent           atomic.Uint64
+	authFailedSent, authFailures    atomic.Uint64
+	replays                         atomic.Uint64
+	helloServersForwarded           atomic.Uint64
+	meetsRelayed                    atomic.Uint64
+	introLatency                    latencyHistogram
+}
+
+// Stats returns the current ServerStats of the Server.
+func (s *Server) Stats() ServerStats {
+	var minglers int
+	s.mingleZSets.each(func(_ []byte, z *zset) {
+		z.Lock()
+		minglers += len(z.m)
+		z.Unlock()
+	})
+
+	return ServerStats{
+		PacketsReceived: s.stats.packetsReceived.Load(),
+		PacketsDropped:  s.stats.packetsDropped.Load(),
+		HelloServers:    s.stats.helloServers.Load(),
+		ReadyToMingles:  s.stats.readyToMingles.Load(),
+		Seeks:           s.stats.seeks.Load(),
+		Occupancies:     s.stats.occupancies.Load(),
+		Probes:          s.stats.probes.Load(),
+		MeetsSent:       s.stats.meetsSent.Load(),
+		HelloPeersSent:  s.stats.helloPeersSent.Load(),
+		BusySent:        s.stats.busySent.Load(),
+		YouAresSent:     s.stats.youAresSent.Load(),
+		AuthFailedSent:  s.stats.authFailedSent.Load(),
+		AuthFailures:    s.stats.authFailures.Load(),
+		Replays:         s.stats.replays.Load(),
+		Minglers:        minglers,
+
+		HelloServersForwarded: s.stats.helloServersForwarded.Load(),
+		MeetsRelayed:          s.stats.meetsRelayed.Load(),
+		IntroLatency:          s.stats.introLatency.snapshot(),
+	}
+}
+
+// Mingler describes a peer which the Server considers ready-to-mingle.
+type Mingler struct {
+	Addr        net.Addr
+	Fingerprint []byte
+
+	// The rendezvous key given in the peer's ReadyToMingle messages, if any.
+	Rendezvous []byte
+
+	// The time the most recent ReadyToMingle message was received from the
+	// peer.
+	LastSeen time.Time
+}
+
+// mingler returns the Mingler describing the zsetEl, which is in the zset for
+// the given rendezvous key.
+func (zEl zsetEl) mingler(rendezvous []byte) Mingler {
+	if len(rendezvous) == 0 {
+		rendezvous = nil
+	}
+	return Mingler{
+		Addr:        zEl.addr,
+		Fingerprint: zEl.fingerprint,
+		Rendezvous:  rendezvous,
+		LastSeen:    zEl.t,
+	}
+}
+
+// Minglers returns all peers which the Server currently considers
+// ready-to-mingle, ordered from least to most recently seen.
+func (s *Server) Minglers() []Mingler {
+	expire := s.now().Add(-s.Config().ReadyToMingleTimeout)
+	minglers := []Mingler{}
+	s.mingleZSets.each(func(rendezvous []byte, z *zset) {
+		for _, zEl := range z.all() {
+			if zEl.t.After(expire) {
+				minglers = append(minglers, zEl.mingler(rendezvous))
+			}
+		}
+	})
+
+	// each zset is already ordered, but they must be merged.
+	sort.SliceStable(minglers, func(i, j int) bool {
+		return minglers[i].LastSeen.Before(minglers[j].LastSeen)
+	})
+	return minglers
+}
+
+// Ban causes all packets from the given IP to be dropped by the Server. If the
+// IP has any ready-to-mingle peers they are immediately forgotten.
+func (s *Server) Ban(ip net.IP) {
+	s.banL.Lock()
+	if s.bans == nil {
+		s.bans = map[string]net.IP{}
+	}
+	s.bans[ip.String()] = ip
+	s.banL.Unlock()
+
+	s.mingleZSets.each(func(_ []byte, z *zset) {
+		z.removeFunc(func(addr net.Addr) bool {
+			return addrIP(addr).Equal(ip)
+		})
+	})
+}
+
+// Unban undoes a previous call to Ban for the given IP.
+func (s *Server) Unban(ip net.IP) {
+	s.banL.Lock()
+	defer s.banL.Unlock()
+	delete(s.bans, ip.String())
+}
+
+// Bans returns all IPs which are currently banned.
+func (s *Server) Bans() []net.IP {
+	s.banL.RLock()
+	defer s.banL.RUnlock()
+	ips := make([]net.IP, 0, len(s.bans))
+	for _, ip := range s.bans {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func (s *Server) banned(addr net.Addr) bool {
+	s.banL.RLock()
+	defer s.banL.RUnlock()
+	if len(s.bans) == 0 {
+		return false
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	_, ok := s.bans[ip.String()]
+	return ok
+}
+
+// addrIP returns the IP of the given address, or nil if it doesn't have one.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,101 @@
+package bonfire
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// maxSignatureAge is how long after being signed a Message's signature is
+// still accepted. Signatures from up to this far in the future are also
+// accepted, to allow for clock skew between servers and peers.
+const maxSignatureAge = 2 * time.Minute
+
+// signatureExtSize is the number of bytes which the signature extension adds
+// to a marshaled Message: the extension's type and length, followed by the
+// time and signature.
+const signatureExtSize = 1 + 2 + 8 + ed25519.SignatureSize
+
+// signedBytes returns the bytes which are covered by a Message's signature:
+// the marshaled form of the Message without its signature, followed by the
+// time it was signed.
+func (m Message) signedBytes(signedAt []byte) ([]byte, error) {
+	m.Signature = nil
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(b, signedAt...), nil
+}
+
+// Sign sets the Message's Signature field using the given key. The signature
+// covers every other field of the Message, along with the current time.
+func (m *Message) Sign(key ed25519.PrivateKey) error {
+	return m.signAt(key, time.Now())
+}
+
+func (m *Message) signAt(key ed25519.PrivateKey, t time.Time) error {
+	signedAt := binary.BigEndian.AppendUint64(nil, uint64(t.UnixMilli()))
+	b, err := m.signedBytes(signedAt)
+	if err != nil {
+		return err
+	}
+	m.Signature = append(signedAt, ed25519.Sign(key, b)...)
+	return nil
+}
+
+// VerifySignature returns an error if the Message's Signature field is missing,
+// wasn't created by the holder of the private key corresponding to the given
+// public key, or was created too long ago.
+func (m Message) VerifySignature(pub ed25519.PublicKey) error {
+	if len(m.Signature) == 0 {
+		return errors.New("message is not signed")
+	} else if len(m.Signature) != 8+ed25519.SignatureSize {
+		return errors.New("malformed signature")
+	}
+
+	signedAt, sig := m.Signature[:8], m.Signature[8:]
+	b, err := m.signedBytes(signedAt)
+	if err != nil {
+		return err
+	} else if !ed25519.Verify(pub, b, sig) {
+		return errors.New("invalid signature")
+	}
+
+	age := time.Since(time.UnixMilli(int64(binary.BigEndian.Uint64(signedAt))))
+	if age > maxSignatureAge || age < -maxSignatureAge {
+		return errors.New("signature has expired")
+	}
+	return nil
+}
+
+// serverOnly returns whether messages of the given type, when received by a
+// peer, can only have been sent by a server.
+func serverOnly(typ MessageType) bool {
+	switch typ {
+	case Meet, Busy, Occupancy, Probe, YouAre, AuthFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// verifyServerMessage returns an error if the Peer has a ServerPublicKey and
+// the message, received from the given address, should have been signed using
+// it but wasn't. That's the case for messages of types which only servers send
+// (see serverOnly), and for all messages coming from the server's address.
+//
+// This must be called with the lock held.
+func (p *Peer) verifyServerMessage(addr net.Addr, msg Message) error {
+	if p.po.ServerPublicKey == nil {
+		return nil
+	} else if !serverOnly(msg.Type) && !p.isServer(addr) {
+		return nil
+	} else if err := msg.VerifySignature(p.po.ServerPublicKey); err != nil {
+		return fmt.Errorf("verifying %s: %w", msg.Type, err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package bonfire
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mrand"
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestMessageSign(t *T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	massert.Require(t, massert.Nil(err))
+
+	msg := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        Meet,
+		MeetBody: MeetBody{
+			Fingerprint: mrand.Bytes(FingerprintSize),
+			Addr:        addrString("1.2.3.4:6666"),
+		},
+		Candidates: []net.Addr{addrString("192.168.1.2:6666")},
+	}
+	massert.Require(t,
+		massert.Not(massert.Nil(msg.VerifySignature(pub))),
+		massert.Nil(msg.Sign(key)),
+	)
+
+	// the signature should survive being marshaled and unmarshaled
+	b, err := msg.MarshalBinary()
+	massert.Require(t, massert.Nil(err))
+	var msg2 Message
+	massert.Require(t,
+		massert.Nil(msg2.UnmarshalBinary(b)),
+		massert.Nil(msg2.VerifySignature(pub)),
+	)
+
+	// changing any field should invalidate the signature
+	tampered := msg2
+	tampered.MeetBody.Addr = addrString("4.3.2.1:6666")
+	massert.Require(t, massert.Not(massert.Nil(tampered.VerifySignature(pub))))
+	tampered = msg2
+	tampered.Candidates = []net.Addr{addrString("10.0.0.1:6666")}
+	massert.Require(t, massert.Not(massert.Nil(tampered.VerifySignature(pub))))
+
+	// as should using a different key
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	massert.Require(t,
+		massert.Nil(err),
+		massert.Not(massert.Nil(msg2.VerifySignature(otherPub))),
+	)
+
+	// and being too old
+	massert.Require(t,
+		massert.Nil(msg.signAt(key, time.Now().Add(-2*maxSignatureAge))),
+		massert.Not(massert.Nil(msg.VerifySignature(pub))),
+	)
+}
+
+func TestPeerVerifyServerMessage(t *T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	massert.Require(t, massert.Nil(err))
+
+	eventCh := make(chan PeerEvent, 1)
+	peer := &Peer{po: PeerOpts{ServerPublicKey: pub, EventCh: eventCh}}
+
+	// the Peer has no connection, so it would panic if it tried to respond to
+	// the Meet.
+	meet := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        Meet,
+		MeetBody: MeetBody{
+			Fingerprint: mrand.Bytes(FingerprintSize),
+			Addr:        addrString("127.0.0.1:2"),
+		},
+	}
+	massert.Require(t,
+		massert.Nil(peer.processMessage(addrString("127.0.0.1:1"), meet)),
+		massert.Equal(1, len(eventCh)),
+		massert.Equal(PeerEventError, (<-eventCh).Type),
+	)
+
+	massert.Require(t, massert.Nil(meet.Sign(key)))
+	massert.Require(t, massert.Nil(peer.verifyServerMessage(addrString("127.0.0.1:1"), meet)))
+
+	// messages from the server's address must be signed, whatever their type,
+	// while those from peers needn't be.
+	peer.lastServerAddr = addrString("127.0.0.1:1")
+	hello := Message{
+		Fingerprint:   mrand.Bytes(FingerprintSize),
+		Type:          HelloPeer,
+		HelloPeerBody: HelloPeerBody{Addr: addrString("127.0.0.1:3")},
+	}
+	massert.Require(t,
+		massert.Not(massert.Nil(peer.verifyServerMessage(addrString("127.0.0.1:1"), hello))),
+		massert.Nil(peer.verifyServerMessage(addrString("127.0.0.1:2"), hello)),
+		massert.Nil(hello.Sign(key)),
+		massert.Nil(peer.verifyServerMessage(addrString("127.0.0.1:1"), hello)),
+	)
+
+	youAre := Message{
+		Fingerprint: mrand.Bytes(FingerprintSize),
+		Type:        YouAre,
+		YouAreBody:  YouAreBody{Addr: addrString("127.0.0.1:3")},
+	}
+	massert.Require(t,
+		massert.Not(massert.Nil(peer.verifyServerMessage(addrString("127.0.0.1:2"), youAre))),
+	)
+}
+
+func TestPeerServerPublicKey(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pub, key, err := ed25519.GenerateKey(nil)
+	massert.Require(t, massert.Nil(err))
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	massert.Require(t, massert.Nil(err))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	server := NewServer()
+	server.SigningKey = key
+	server.SendYouAre = true
+	go server.Serve(ctx, conn)
+
+	newPeer := func(pub ed25519.PublicKey) (*Peer, error) {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		return NewPeer(ctx, "udp", conn.LocalAddr().String(), &PeerOpts{
+			InitTimeoutUntilGateway: -1,
+			PacketBlastCount:        1,
+			ListenAddr:              "127.0.0.1:0",
+			ServerPublicKey:         pub,
+		})
+	}
+
+	// a peer which has pinned some other key ignores everything the server
+	// sends it, and so can't bootstrap.
+	_, err = newPeer(otherPub)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	peer, err := newPeer(pub)
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+	massert.Require(t,
+		massert.Equal(peer.LocalAddr().String(), peer.RemoteAddr().String()),
+	)
+}
@@ -0,0 +1,129 @@
+package bonfire
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PeerState describes where a Peer is in the process of discovering other
+// peers.
+type PeerState int
+
+// Possible PeerStates. A Peer moves through them in the following order:
+//
+//	Init -> AwaitingHello -> [GatewayFallback ->] Established
+//
+// Once Established, ResetPeers and Migrate move the Peer into Rebootstrapping,
+// and it returns to Established once a HelloPeer message is next received.
+const (
+	// PeerStateInit is the state of a Peer which is still being set up, and
+	// which hasn't yet contacted the server or any other peers.
+	PeerStateInit PeerState = iota
+
+	// PeerStateAwaitingHello is the state of a Peer which has sent its
+	// HelloServer (or Greet, or multicast announcement) and is waiting for a
+	// HelloPeer in response.
+	PeerStateAwaitingHello
+
+	// PeerStateGatewayFallback is the state of a Peer which received no
+	// HelloPeer within InitTimeoutUntilGateway, and so is forwarding a port on
+	// its gateway and trying again.
+	PeerStateGatewayFallback
+
+	// PeerStateEstablished is the state of a Peer which NewPeer has returned
+	// successfully.
+	PeerStateEstablished
+
+	// PeerStateRebootstrapping is the state of a Peer which has cleared its
+	// peers, due to ResetPeers or Migrate, and hasn't yet received a HelloPeer.
+	PeerStateRebootstrapping
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerStateInit:
+		return "Init"
+	case PeerStateAwaitingHello:
+		return "AwaitingHello"
+	case PeerStateGatewayFallback:
+		return "GatewayFallback"
+	case PeerStateEstablished:
+		return "Established"
+	case PeerStateRebootstrapping:
+		return "Rebootstrapping"
+	default:
+		return fmt.Sprintf("PeerState(%d)", int(s))
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface, so that the
+// PeerState is encoded by name, e.g. in JSON.
+func (s PeerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// peerStateTransitions holds, for each PeerState, the states which may be
+// moved into from it.
+var peerStateTransitions = map[PeerState][]PeerState{
+	PeerStateInit:            {PeerStateAwaitingHello},
+	PeerStateAwaitingHello:   {PeerStateGatewayFallback, PeerStateEstablished},
+	PeerStateGatewayFallback: {PeerStateEstablished},
+	PeerStateEstablished:     {PeerStateRebootstrapping},
+	PeerStateRebootstrapping: {PeerStateEstablished},
+}
+
+func (s PeerState) canTransition(to PeerState) bool {
+	for _, allowed := range peerStateTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns the current PeerState of the Peer.
+func (p *Peer) State() PeerState {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	return p.state
+}
+
+// setState moves the Peer into the given state, emitting a
+// PeerEventStateChanged. Moving into the current state does nothing, and
+// moving into a state which isn't reachable from the current one panics, as
+// that indicates a bug.
+//
+// This must be called with the lock held.
+func (p *Peer) setState(s PeerState) {
+	if s == p.state {
+		return
+	} else if !p.state.canTransition(s) {
+		panic(fmt.Sprintf("invalid Peer state transition from %v to %v", p.state, s))
+	}
+	p.state = s
+	p.event(PeerEvent{Type: PeerEventStateChanged, State: s})
+}
+
+// lockedSetState is like setState, but acquires the lock itself.
+func (p *Peer) lockedSetState(s PeerState) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	p.setState(s)
+}
+
+// errNotBootstrapped is returned by methods which re-bootstrap the Peer (e.g.
+// Migrate) when it hasn't yet finished bootstrapping the first time.
+var errNotBootstrapped = errors.New("bonfire.Peer isn't bootstrapped yet")
+
+// checkCanRebootstrap returns errNotBootstrapped if the Peer can't yet move
+// into PeerStateRebootstrapping, e.g. because it was created by NewPeerAsync
+// and is still waiting for its first HelloPeer.
+//
+// This must be called with the lock held.
+func (p *Peer) checkCanRebootstrap() error {
+	const to = PeerStateRebootstrapping
+	if p.state != to && !p.state.canTransition(to) {
+		return errNotBootstrapped
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package bonfire
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation name given to the TracerProviders set on
+// PeerOpts and Server.
+const tracerName = "github.com/mediocregopher/bonfire"
+
+// Attribute keys used on spans.
+const (
+	attrMessageType = attribute.Key("bonfire.message.type")
+	attrPeerAddr    = attribute.Key("bonfire.peer.addr")
+	attrServerAddr  = attribute.Key("bonfire.server.addr")
+	attrRemoteAddr  = attribute.Key("bonfire.remote.addr")
+	attrBlastCount  = attribute.Key("bonfire.blast_count")
+	attrMeets       = attribute.Key("bonfire.meets")
+)
+
+func tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// endSpan ends the span, first recording the error on it if there is one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
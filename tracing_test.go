@@ -0,0 +1,69 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanNames(spans []sdktrace.ReadOnlySpan) []string {
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name()
+	}
+	return names
+}
+
+func TestTracing(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	serverRec := tracetest.NewSpanRecorder()
+	server := NewServer()
+	server.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(serverRec))
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ctx, conn)
+
+	peerRec := tracetest.NewSpanRecorder()
+	peer, err := NewPeer(ctx, "udp", conn.LocalAddr().String(), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		ReadyToMingleInterval:   -1,
+		TracerProvider:          sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(peerRec)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// spans are recorded as they end, so children come before parents
+	peerSpans := peerRec.Ended()
+	massert.Require(t,
+		massert.Equal([]string{
+			"bonfire.Peer.resolve",
+			"bonfire.Peer.helloServer",
+			"bonfire.Peer.waitForPeer",
+			"bonfire.Peer.bootstrap",
+		}, spanNames(peerSpans)),
+		massert.Equal(peerSpans[3].SpanContext().SpanID(), peerSpans[1].Parent().SpanID()),
+		massert.Equal(peerSpans[1].SpanContext().SpanID(), peerSpans[0].Parent().SpanID()),
+	)
+
+	// the server may not have ended its span by the time the peer got its
+	// response.
+	time.Sleep(100 * time.Millisecond)
+	serverSpans := serverRec.Ended()
+	massert.Require(t,
+		massert.Length(serverSpans, 3), // PacketBlastCount HelloServers
+		massert.Equal("bonfire.Server.handlePacket", serverSpans[0].Name()),
+		massert.HasValue(serverSpans[0].Attributes(), attrMessageType.String("HelloServer")),
+		massert.HasValue(serverSpans[0].Attributes(), attrMeets.Int(0)),
+	)
+}
@@ -0,0 +1,61 @@
+package bonfire
+
+import (
+	"errors"
+	"net"
+)
+
+// watchUnreachable causes addresses which are reported as being unreachable to
+// be written (without blocking) to the returned channel. This must be called
+// prior to the migratingConn being used.
+func (c *migratingConn) watchUnreachable() <-chan net.Addr {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.unreachableCh = make(chan net.Addr, 16)
+	enableRecvErr(c.conn)
+	return c.unreachableCh
+}
+
+func (c *migratingConn) reportUnreachable(addr net.Addr) {
+	if c.unreachableCh == nil || addr == nil {
+		return
+	}
+	select {
+	case c.unreachableCh <- addr:
+	default:
+	}
+}
+
+// unreachable is called whenever an address the Peer has sent to is reported
+// as being unreachable.
+func (p *Peer) unreachable(addr net.Addr) {
+	p.l.Lock()
+	addrStr := addr.String()
+	if _, ok := p.peers[addrStr]; ok {
+		if p.unreachableCounts == nil {
+			p.unreachableCounts = map[string]int{}
+		}
+		p.unreachableCounts[addrStr]++
+		if p.unreachableCounts[addrStr] >= p.po.UnreachableThreshold {
+			p.removePeer(addrStr)
+		}
+	}
+	if p.isServer(addr) {
+		p.serverFailed(errors.New("server reported unreachable"))
+	}
+	p.l.Unlock()
+
+	p.event(PeerEvent{Type: PeerEventUnreachable, Addr: addr})
+}
+
+func (p *Peer) spinUnreachable(ch <-chan net.Addr) {
+	defer p.wg.Done()
+	for {
+		select {
+		case addr := <-ch:
+			p.unreachable(addr)
+		case <-p.closeCh:
+			return
+		}
+	}
+}
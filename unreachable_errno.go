@@ -0,0 +1,15 @@
+//go:build !plan9
+
+package bonfire
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isUnreachableErr returns true if the error indicates that a particular
+// destination couldn't be reached, rather than there being a problem with the
+// local socket or network.
+func isUnreachableErr(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH)
+}
@@ -0,0 +1,7 @@
+package bonfire
+
+// isUnreachableErr always returns false, as plan9 doesn't describe errors
+// using errnos.
+func isUnreachableErr(err error) bool {
+	return false
+}
@@ -0,0 +1,137 @@
+package bonfire
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// validator collects the errors found while validating the fields of some
+// options struct.
+type validator struct {
+	typ  string
+	errs []error
+}
+
+func (v *validator) invalid(field, reason string) {
+	v.errs = append(v.errs, fmt.Errorf("invalid %s.%s: %s", v.typ, field, reason))
+}
+
+func (v *validator) nonNegative(field string, n int) {
+	if n < 0 {
+		v.invalid(field, "must not be negative")
+	}
+}
+
+// nonNegativeDur checks a duration, which may also be -1 if minusOne is set.
+func (v *validator) nonNegativeDur(field string, d time.Duration, minusOne bool) {
+	if d < 0 && !(minusOne && d == -1) {
+		if minusOne {
+			v.invalid(field, "must not be negative, other than -1")
+		} else {
+			v.invalid(field, "must not be negative")
+		}
+	}
+}
+
+func (v *validator) err() error {
+	return errors.Join(v.errs...)
+}
+
+// validate returns an error describing every field of the PeerOpts which has
+// an invalid value, or nil if there are none. Defaults should be filled in
+// first.
+func (po PeerOpts) validate() error {
+	v := validator{typ: "PeerOpts"}
+	v.nonNegative("PacketBlastCount", po.PacketBlastCount)
+	v.nonNegative("MaxPeers", po.MaxPeers)
+	v.nonNegative("MaxIntroductions", po.MaxIntroductions)
+	v.nonNegative("PrivacyFingerprints", po.PrivacyFingerprints)
+	v.nonNegative("UnreachableThreshold", po.UnreachableThreshold)
+	v.nonNegative("ServerFailureThreshold", po.ServerFailureThreshold)
+	v.nonNegativeDur("InitTimeoutUntilGateway", po.InitTimeoutUntilGateway, true)
+	v.nonNegativeDur("HelloWaitTimeout", po.HelloWaitTimeout, false)
+	v.nonNegativeDur("GatewayDiscoveryTimeout", po.GatewayDiscoveryTimeout, false)
+	v.nonNegativeDur("TotalBootstrapTimeout", po.TotalBootstrapTimeout, false)
+	v.nonNegativeDur("GatewayPortMapTimeout", po.GatewayPortMapTimeout, false)
+	v.nonNegativeDur("ReadyToMingleInterval", po.ReadyToMingleInterval, true)
+	v.nonNegativeDur("MigrateCheckInterval", po.MigrateCheckInterval, false)
+	v.nonNegativeDur("WatchdogTimeout", po.WatchdogTimeout, false)
+	v.nonNegativeDur("ServerAddrTTL", po.ServerAddrTTL, true)
+	v.nonNegativeDur("StartJitter", po.StartJitter, false)
+	v.nonNegativeDur("MaxMessageAge", po.MaxMessageAge, false)
+	v.nonNegativeDur("ServerMaxBackoff", po.ServerMaxBackoff, false)
+
+	if po.MulticastTTL < 0 || po.MulticastTTL > 255 {
+		v.invalid("MulticastTTL", "must be between 0 and 255")
+	}
+	if n := len(po.PrivacyKey); n != 0 && n != 16 && n != 24 && n != 32 {
+		v.invalid("PrivacyKey", "must be 16, 24 or 32 bytes long")
+	}
+	if n := len(po.ServerPublicKey); n != 0 && n != ed25519.PublicKeySize {
+		v.invalid("ServerPublicKey", fmt.Sprintf("must be %d bytes long", ed25519.PublicKeySize))
+	}
+	if len(po.HandshakePayload) > MaxHandshakePayloadSize {
+		v.invalid("HandshakePayload", fmt.Sprintf("may be at most %d bytes", MaxHandshakePayloadSize))
+	}
+	if po.AdvertiseAddr != "" {
+		if _, _, err := net.SplitHostPort(po.AdvertiseAddr); err != nil {
+			v.invalid("AdvertiseAddr", err.Error())
+		}
+	}
+	if _, err := parseCachedAddr(po.CachedAddrs.RemoteAddr); err != nil {
+		v.invalid("CachedAddrs.RemoteAddr", err.Error())
+	}
+	if _, err := parseCachedAddr(po.CachedAddrs.GatewayAddr); err != nil {
+		v.invalid("CachedAddrs.GatewayAddr", err.Error())
+	}
+	return v.err()
+}
+
+// validate returns an error describing every field of the ServerConfig which
+// has an invalid value, or nil if there are none. Defaults should be filled in
+// first.
+func (cfg ServerConfig) validate() error {
+	v := validator{typ: "ServerConfig"}
+	v.nonNegative("PacketBlastCount", cfg.PacketBlastCount)
+	v.nonNegative("PeersToMeet", cfg.PeersToMeet)
+	v.nonNegative("MaxConcurrent", cfg.MaxConcurrent)
+	v.nonNegative("MaxMeetsPerMingler", cfg.MaxMeetsPerMingler)
+	v.nonNegativeDur("ReadyToMingleTimeout", cfg.ReadyToMingleTimeout, false)
+	v.nonNegativeDur("MeetBudgetInterval", cfg.MeetBudgetInterval, false)
+	v.nonNegativeDur("BusyRetryAfter", cfg.BusyRetryAfter, false)
+	v.nonNegativeDur("OccupancyInterval", cfg.OccupancyInterval, false)
+	v.nonNegativeDur("MaxMessageAge", cfg.MaxMessageAge, false)
+	return v.err()
+}
+
+// validate is like ServerConfig's validate, but also covers the Server's
+// fields which can't be changed using UpdateConfig.
+func (s *Server) validate(cfg ServerConfig) error {
+	errs := []error{cfg.validate()}
+	if n := len(s.SigningKey); n != 0 && n != ed25519.PrivateKeySize {
+		errs = append(errs, fmt.Errorf("invalid Server.SigningKey: must be %d bytes long", ed25519.PrivateKeySize))
+	}
+	if n := len(s.UpstreamPublicKey); n != 0 && n != ed25519.PublicKeySize {
+		errs = append(errs, fmt.Errorf("invalid Server.UpstreamPublicKey: must be %d bytes long", ed25519.PublicKeySize))
+	} else if n == 0 && s.Upstream != "" {
+		errs = append(errs, errors.New("invalid Server.UpstreamPublicKey: must be set along with Server.Upstream"))
+	}
+	if len(s.InstanceID) > MaxInstanceIDSize {
+		errs = append(errs, fmt.Errorf("invalid Server.InstanceID: may be at most %d bytes long", MaxInstanceIDSize))
+	}
+	return errors.Join(errs...)
+}
+
+// checkNetwork returns an error if the given network isn't one of those which
+// bonfire supports.
+func checkNetwork(network string) error {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return nil
+	default:
+		return fmt.Errorf("unsupported network %q, must be \"udp\", \"udp4\" or \"udp6\"", network)
+	}
+}
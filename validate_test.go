@@ -0,0 +1,59 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerOptsValidate(t *T) {
+	massert.Require(t, massert.Nil(PeerOpts{}.withDefaults().validate()))
+
+	err := PeerOpts{
+		PacketBlastCount:      -1,
+		ReadyToMingleInterval: -1,
+		ServerAddrTTL:         -2,
+		PrivacyKey:            make([]byte, 10),
+		AdvertiseAddr:         "no-port",
+	}.withDefaults().validate()
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	// every invalid field is reported, and only those.
+	lines := strings.Split(err.Error(), "\n")
+	massert.Require(t, massert.Equal(4, len(lines)))
+	massert.Require(t,
+		massert.Equal(true, strings.HasPrefix(lines[0], "invalid PeerOpts.PacketBlastCount: ")),
+		massert.Equal(true, strings.HasPrefix(lines[1], "invalid PeerOpts.ServerAddrTTL: ")),
+		massert.Equal(true, strings.HasPrefix(lines[2], "invalid PeerOpts.PrivacyKey: ")),
+		massert.Equal(true, strings.HasPrefix(lines[3], "invalid PeerOpts.AdvertiseAddr: ")),
+	)
+}
+
+func TestServerValidate(t *T) {
+	server := NewServer()
+	cfg := server.Config()
+	cfg.PeersToMeet = -1
+	massert.Require(t,
+		massert.Not(massert.Nil(server.UpdateConfig(cfg))),
+		massert.Equal(3, server.Config().PeersToMeet),
+	)
+
+	// Serve returns the error rather than serving, and closes the conns.
+	server = NewServer()
+	server.BusyRetryAfter = -time.Second
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	err = server.Serve(context.Background(), conn)
+	massert.Require(t, massert.Not(massert.Nil(err)))
+	_, err = conn.WriteTo([]byte("x"), conn.LocalAddr())
+	massert.Require(t, massert.Not(massert.Nil(err)))
+
+	massert.Require(t,
+		massert.Not(massert.Nil(server.Serve(context.Background()))),
+		massert.Not(massert.Nil(server.Listen(context.Background(), "tcp", ":0"))),
+	)
+}
@@ -0,0 +1,150 @@
+package bonfire
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// watchdogProbeMagic prefixes the probes which a Peer's watchdog sends to
+// itself. The first byte is greater than any version, so a probe is never
+// mistaken for a bonfire message.
+var watchdogProbeMagic = []byte{0xff, 'b', 'f', 'w', 'd'}
+
+// watchdog notices when a Peer hasn't read a packet for PeerOpts'
+// WatchdogTimeout, see spinWatchdog.
+type watchdog struct {
+	// when ReadFrom last read a packet, as unix nanoseconds.
+	lastRead atomic.Int64
+
+	// the probe which the Peer sends to itself, and which is written to when
+	// ReadFrom reads it.
+	probe   []byte
+	probeCh chan struct{}
+}
+
+func newWatchdog() (*watchdog, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("generating watchdog probe: %w", err)
+	}
+	return &watchdog{
+		probe:   append(append([]byte(nil), watchdogProbeMagic...), token...),
+		probeCh: make(chan struct{}, 1),
+	}, nil
+}
+
+// read is called by ReadFrom with every packet it reads, and returns true if
+// the packet is the watchdog's probe, which must not be passed on.
+func (wd *watchdog) read(b []byte) bool {
+	if wd == nil {
+		return false
+	}
+	wd.lastRead.Store(time.Now().UnixNano())
+	if !bytes.Equal(b, wd.probe) {
+		return false
+	}
+	select {
+	case wd.probeCh <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// idle returns how long it's been since a packet was read.
+func (wd *watchdog) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, wd.lastRead.Load()))
+}
+
+// probeAddr returns the address which the Peer's probes are sent to, i.e. its
+// local address, or the loopback address on the same port if it's bound to
+// all interfaces.
+func (p *Peer) probeAddr() net.Addr {
+	udpAddr, ok := p.PacketConn.LocalAddr().(*net.UDPAddr)
+	if !ok || !udpAddr.IP.IsUnspecified() {
+		return p.PacketConn.LocalAddr()
+	}
+	ip := net.IPv4(127, 0, 0, 1)
+	if p.network == "udp6" {
+		ip = net.IPv6loopback
+	}
+	return &net.UDPAddr{IP: ip, Port: udpAddr.Port}
+}
+
+// probeSocket sends the watchdog's probe to the Peer itself, and returns nil if
+// ReadFrom reads it within the given timeout. If it doesn't then either the
+// socket is no longer usable, or ReadFrom isn't being called.
+func (p *Peer) probeSocket(timeout time.Duration) error {
+	// a probe from a previous check may have arrived late.
+	select {
+	case <-p.wd.probeCh:
+	default:
+	}
+
+	if _, err := p.PacketConn.WriteTo(p.wd.probe, p.probeAddr()); err != nil {
+		return err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-p.wd.probeCh:
+		return nil
+	case <-t.C:
+		return errors.New("socket probe was not read")
+	case <-p.closeCh:
+		return nil
+	}
+}
+
+// spinWatchdog periodically checks whether the Peer has read any packets
+// within WatchdogTimeout. If it hasn't then the socket is probed. If the probe
+// is read then the socket is healthy, and the Peer re-bootstraps in case it
+// has silently lost contact with the server and its peers. Otherwise the
+// socket is re-bound, as with Migrate. Either way PeerEventWatchdog is emitted,
+// and the Peer waits another WatchdogTimeout before checking again.
+func (p *Peer) spinWatchdog() {
+	defer p.wg.Done()
+	timeout := p.po.WatchdogTimeout
+	t := time.NewTicker(timeout / 4)
+	defer t.Stop()
+
+	p.wd.lastRead.Store(time.Now().UnixNano())
+	var lastTrip time.Time
+	for {
+		select {
+		case <-t.C:
+		case <-p.closeCh:
+			return
+		}
+
+		now := time.Now()
+		if p.wd.idle(now) < timeout || now.Sub(lastTrip) < timeout {
+			continue
+		}
+		lastTrip = now
+		p.stats.watchdogTrips.Add(1)
+
+		var err error
+		if probeErr := p.probeSocket(timeout / 4); probeErr != nil {
+			err = errors.Join(probeErr, p.Migrate())
+		} else if resetErr := p.ResetPeers(); resetErr != nil {
+			err = resetErr
+		}
+
+		select {
+		case <-p.closeCh:
+			return
+		default:
+		}
+		p.event(PeerEvent{
+			Type: PeerEventWatchdog,
+			Addr: p.PacketConn.LocalAddr(),
+			Err:  err,
+		})
+	}
+}
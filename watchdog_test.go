@@ -0,0 +1,74 @@
+package bonfire
+
+import (
+	"context"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/mtest/massert"
+)
+
+func TestPeerWatchdog(t *T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	massert.Require(t, massert.Nil(err))
+	go NewServer().Serve(ctx, serverConn)
+
+	evCh := make(chan PeerEvent, 64)
+	peer, err := NewPeer(ctx, "udp", serverConn.LocalAddr().String(), &PeerOpts{
+		InitTimeoutUntilGateway: -1,
+		ListenAddr:              "127.0.0.1:0",
+		ReadyToMingleInterval:   time.Minute,
+		WatchdogTimeout:         200 * time.Millisecond,
+		EventCh:                 evCh,
+	})
+	massert.Require(t, massert.Nil(err))
+	defer peer.Close()
+
+	nextWatchdog := func() PeerEvent {
+		for {
+			select {
+			case ev := <-evCh:
+				if ev.Type == PeerEventWatchdog {
+					return ev
+				}
+			case <-ctx.Done():
+				t.Fatal("watchdog didn't act")
+			}
+		}
+	}
+
+	// ReadFrom isn't being called, so the probe isn't read and the socket is
+	// re-bound.
+	localAddr := peer.LocalAddr().String()
+	ev := nextWatchdog()
+	massert.Require(t,
+		massert.Not(massert.Nil(ev.Err)),
+		massert.Not(massert.Equal(localAddr, peer.LocalAddr().String())),
+	)
+
+	// once ReadFrom is being called the probe is read, and isn't passed on to
+	// the application, so the Peer only re-bootstraps.
+	appCh := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, MaxMessageSize)
+		for {
+			n, _, err := peer.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			appCh <- append([]byte(nil), b[:n]...)
+		}
+	}()
+	for ev = nextWatchdog(); ev.Err != nil; ev = nextWatchdog() {
+	}
+	select {
+	case b := <-appCh:
+		t.Fatalf("unexpected packet passed on: %q", b)
+	default:
+	}
+	massert.Require(t, massert.Equal(true, peer.Stats().WatchdogTrips >= 2))
+}
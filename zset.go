@@ -15,12 +15,60 @@ type zset struct {
 	timeL  *list.List                  // oldest -> newest
 	usageL *list.List                  // most recently used -> never used
 	m      map[string][2]*list.Element // addr -> {timeL element, usageL element}
+	fps    map[string]string           // fingerprint -> addr
+
+	// capacity is applied to all peers, in addition to whatever capacity they
+	// indicate themselves.
+	capacity MingleCapacity
+
+	// if set, used in place of time.Now.
+	now func() time.Time
 }
 
 type zsetEl struct {
 	t           time.Time
 	addr        net.Addr
 	fingerprint []byte
+	budget      *meetBudget
+
+	// conn is the server endpoint which the peer's ReadyToMingle was received
+	// on, and which Meet messages for it must be sent from.
+	conn net.PacketConn
+}
+
+// meetWindow counts how many times a peer has been returned from get within
+// the current interval of a MingleCapacity.
+type meetWindow struct {
+	capacity MingleCapacity
+	start    time.Time
+	count    int
+}
+
+func (w *meetWindow) allowed(now time.Time) bool {
+	if w.capacity.Meets <= 0 {
+		return true
+	} else if now.Sub(w.start) >= w.capacity.Interval {
+		w.start, w.count = now, 0
+	}
+	return w.count < w.capacity.Meets
+}
+
+// meetBudget tracks how many times a peer has been returned from get, so that
+// it isn't sent more Meets than either it or the server allow. It is shared
+// between all copies of a peer's zsetEl, and is only accessed with the zset's
+// lock held.
+type meetBudget struct {
+	peer, server meetWindow
+}
+
+// take returns true if the peer may be used, counting the use if so.
+func (b *meetBudget) take(now time.Time) bool {
+	if !b.peer.allowed(now) || !b.server.allowed(now) {
+		return false
+	}
+	b.peer.count++
+	b.server.count++
+	return true
 }
 
 func newZSet() *zset {
@@ -28,20 +76,37 @@ func newZSet() *zset {
 		timeL:  list.New(),
 		usageL: list.New(),
 		m:      map[string][2]*list.Element{},
+		fps:    map[string]string{},
+	}
+}
+
+// timeNow returns the current time, according to the zset's now if set.
+func (z *zset) timeNow() time.Time {
+	if z.now != nil {
+		return z.now()
 	}
+	return time.Now()
 }
 
-func (z *zset) add(addr net.Addr, fingerprint []byte) {
+func (z *zset) add(addr net.Addr, conn net.PacketConn, fingerprint []byte, capacity MingleCapacity) {
 	z.Lock()
 	defer z.Unlock()
 
+	// the budget is kept across adds, otherwise a peer could reset its count
+	// simply by sending another ReadyToMingle.
+	budget := new(meetBudget)
 	addrStr := addr.String()
 	listEls, ok := z.m[addrStr]
 	if ok {
+		prev := listEls[0].Value.(zsetEl)
+		budget = prev.budget
 		z.timeL.Remove(listEls[0])
+		z.removeFingerprint(prev)
 	}
+	budget.peer.capacity = capacity
+	budget.server.capacity = z.capacity
 
-	el := zsetEl{time.Now(), addr, fingerprint}
+	el := zsetEl{z.timeNow(), addr, fingerprint, budget, conn}
 	listEls[0] = z.timeL.PushBack(el)
 	if listEls[1] == nil {
 		listEls[1] = z.usageL.PushBack(el)
@@ -49,12 +114,50 @@ func (z *zset) add(addr net.Addr, fingerprint []byte) {
 		listEls[1].Value = el
 	}
 	z.m[addrStr] = listEls
+	z.fps[string(fingerprint)] = addrStr
+}
+
+// removeFingerprint removes the zsetEl's fingerprint from the fingerprint
+// index, unless it has since been taken over by another addr.
+//
+// This must be called with the lock held.
+func (z *zset) removeFingerprint(zEl zsetEl) {
+	fpStr := string(zEl.fingerprint)
+	if z.fps[fpStr] == zEl.addr.String() {
+		delete(z.fps, fpStr)
+	}
 }
 
-func (z *zset) get(n int, expire time.Time) []zsetEl {
+// remove removes the addr from the set entirely.
+//
+// This must be called with the lock held.
+func (z *zset) remove(addrStr string) {
+	listEls := z.m[addrStr]
+	z.removeFingerprint(listEls[0].Value.(zsetEl))
+	z.timeL.Remove(listEls[0])
+	z.usageL.Remove(listEls[1])
+	delete(z.m, addrStr)
+}
+
+// setCapacity changes the capacity applied to all peers, including those
+// already in the set.
+func (z *zset) setCapacity(capacity MingleCapacity) {
 	z.Lock()
 	defer z.Unlock()
+	z.capacity = capacity
+	for _, listEls := range z.m {
+		listEls[0].Value.(zsetEl).budget.server.capacity = capacity
+	}
+}
 
+// get returns up to n of the least recently used peers which were added after
+// expire, skipping excludeAddrs and any peers which have used up their
+// meetBudget.
+func (z *zset) get(n int, expire time.Time, excludeAddrs ...net.Addr) []zsetEl {
+	z.Lock()
+	defer z.Unlock()
+
+	now := z.timeNow()
 	zEls := make([]zsetEl, 0, n)
 	els := make([]*list.Element, 0, n)
 	el := z.usageL.Back()
@@ -64,7 +167,9 @@ func (z *zset) get(n int, expire time.Time) []zsetEl {
 		}
 
 		zEl := el.Value.(zsetEl)
-		if zEl.t.After(expire) {
+		if excluded(zEl.addr, excludeAddrs) {
+			// skip
+		} else if zEl.t.After(expire) && zEl.budget.take(now) {
 			zEls = append(zEls, zEl)
 			els = append(els, el)
 		}
@@ -79,8 +184,78 @@ func (z *zset) get(n int, expire time.Time) []zsetEl {
 	return zEls
 }
 
-// expire removes all addrs which were added prior to the given time
-func (z *zset) expire(t time.Time) {
+// excluded returns whether the address is one of the excluded ones, which may
+// include nils.
+func excluded(addr net.Addr, excludeAddrs []net.Addr) bool {
+	for _, excludeAddr := range excludeAddrs {
+		if excludeAddr != nil &&
+			addr.Network() == excludeAddr.Network() &&
+			addr.String() == excludeAddr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// getByFingerprint returns the peer which most recently sent a ReadyToMingle
+// with the given fingerprint, if it was added after expire and hasn't used up
+// its meetBudget.
+func (z *zset) getByFingerprint(fingerprint []byte, expire time.Time) (zsetEl, bool) {
+	z.Lock()
+	defer z.Unlock()
+
+	addrStr, ok := z.fps[string(fingerprint)]
+	if !ok {
+		return zsetEl{}, false
+	}
+	listEls := z.m[addrStr]
+	zEl := listEls[0].Value.(zsetEl)
+	if !zEl.t.After(expire) || !zEl.budget.take(z.timeNow()) {
+		return zsetEl{}, false
+	}
+	z.usageL.MoveToFront(listEls[1])
+	return zEl, true
+}
+
+// count returns the number of peers in the set which were added after expire.
+func (z *zset) count(expire time.Time) int {
+	z.Lock()
+	defer z.Unlock()
+	var n int
+	for el := z.timeL.Back(); el != nil; el = el.Prev() {
+		if !el.Value.(zsetEl).t.After(expire) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// all returns every peer in the set, ordered from oldest to newest.
+func (z *zset) all() []zsetEl {
+	z.Lock()
+	defer z.Unlock()
+	zEls := make([]zsetEl, 0, z.timeL.Len())
+	for el := z.timeL.Front(); el != nil; el = el.Next() {
+		zEls = append(zEls, el.Value.(zsetEl))
+	}
+	return zEls
+}
+
+// removeFunc removes all addrs for which fn returns true.
+func (z *zset) removeFunc(fn func(net.Addr) bool) {
+	z.Lock()
+	defer z.Unlock()
+	for addrStr, listEls := range z.m {
+		if fn(listEls[0].Value.(zsetEl).addr) {
+			z.remove(addrStr)
+		}
+	}
+}
+
+// expire removes all addrs which were added prior to the given time, calling
+// onExpire (if given) with each.
+func (z *zset) expire(t time.Time, onExpire func(zsetEl)) {
 	z.Lock()
 	defer z.Unlock()
 
@@ -94,17 +269,14 @@ func (z *zset) expire(t time.Time) {
 		if zEl.t.After(t) {
 			break
 		}
-		addrStr := zEl.addr.String()
 
 		// once el is removed from timeL its Next won't be usable anymore, so
 		// grab that now
 		nextEl := el.Next()
-
-		z.timeL.Remove(el)
-		usageLEl := z.m[addrStr][1]
-		z.usageL.Remove(usageLEl)
-		delete(z.m, addrStr)
-
+		z.remove(zEl.addr.String())
+		if onExpire != nil {
+			onExpire(zEl)
+		}
 		el = nextEl
 	}
 }
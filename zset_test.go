@@ -76,22 +76,22 @@ func TestZSet(t *T) {
 		aa = append(aa, assertEls(z.usageL))
 		aa = append(aa, massert.Length(z.m, 0))
 
-		z.add(addrString(a), fa)
+		z.add(addrString(a), nil, fa, MingleCapacity{})
 		aa = append(aa, assertEls(z.timeL, za))
 		aa = append(aa, assertEls(z.usageL, za))
 		aa = append(aa, massert.Length(z.m, 1))
 
-		z.add(addrString(b), fb)
+		z.add(addrString(b), nil, fb, MingleCapacity{})
 		aa = append(aa, assertEls(z.timeL, za, zb))
 		aa = append(aa, assertEls(z.usageL, za, zb))
 		aa = append(aa, massert.Length(z.m, 2))
 
-		z.add(addrString(a), fc)
+		z.add(addrString(a), nil, fc, MingleCapacity{})
 		aa = append(aa, assertEls(z.timeL, zb, zEl{a, fc}))
 		aa = append(aa, assertEls(z.usageL, zEl{a, fc}, zb))
 		aa = append(aa, massert.Length(z.m, 2))
 
-		z.add(addrString(c), fc)
+		z.add(addrString(c), nil, fc, MingleCapacity{})
 		aa = append(aa, assertEls(z.timeL, zb, zEl{a, fc}, zc))
 		aa = append(aa, assertEls(z.usageL, zEl{a, fc}, zb, zc))
 		aa = append(aa, massert.Length(z.m, 3))
@@ -103,36 +103,36 @@ func TestZSet(t *T) {
 		var aa []massert.Assertion
 		z := newZSet()
 
-		out := z.get(2, time.Time{})
+		out := z.get(2, time.Time{}, nil)
 		aa = append(aa, massert.Length(out, 0))
 
-		z.add(addrString(a), fa)
-		z.add(addrString(b), fb)
-		z.add(addrString(c), fc)
-		z.add(addrString(d), fd)
-		z.add(addrString(e), fe)
+		z.add(addrString(a), nil, fa, MingleCapacity{})
+		z.add(addrString(b), nil, fb, MingleCapacity{})
+		z.add(addrString(c), nil, fc, MingleCapacity{})
+		z.add(addrString(d), nil, fd, MingleCapacity{})
+		z.add(addrString(e), nil, fe, MingleCapacity{})
 		aa = append(aa, assertEls(z.timeL, za, zb, zc, zd, ze))
 		aa = append(aa, assertEls(z.usageL, za, zb, zc, zd, ze))
 		aa = append(aa, massert.Length(z.m, 5))
 
-		addrStrs := elsToAddrs(z.get(2, time.Time{}))
+		addrStrs := elsToAddrs(z.get(2, time.Time{}, nil))
 		aa = append(aa, massert.Equal(addrStrs, []string{e, d}))
 		aa = append(aa, assertEls(z.timeL, za, zb, zc, zd, ze))
 		aa = append(aa, assertEls(z.usageL, zd, ze, za, zb, zc))
 		aa = append(aa, massert.Length(z.m, 5))
 
-		aa = append(aa, massert.Length(z.get(2, time.Now()), 0))
+		aa = append(aa, massert.Length(z.get(2, time.Now(), nil), 0))
 		aa = append(aa, assertEls(z.timeL, za, zb, zc, zd, ze))
 		aa = append(aa, assertEls(z.usageL, zd, ze, za, zb, zc))
 		aa = append(aa, massert.Length(z.m, 5))
 
-		addrStrs = elsToAddrs(z.get(6, time.Time{}))
+		addrStrs = elsToAddrs(z.get(6, time.Time{}, nil))
 		aa = append(aa, massert.Equal(addrStrs, []string{c, b, a, e, d}))
 		aa = append(aa, assertEls(z.timeL, za, zb, zc, zd, ze))
 		aa = append(aa, assertEls(z.usageL, zd, ze, za, zb, zc))
 		aa = append(aa, massert.Length(z.m, 5))
 
-		aa = append(aa, massert.Length(z.get(0, time.Time{}), 0))
+		aa = append(aa, massert.Length(z.get(0, time.Time{}, nil), 0))
 		aa = append(aa, assertEls(z.timeL, za, zb, zc, zd, ze))
 		aa = append(aa, assertEls(z.usageL, zd, ze, za, zb, zc))
 		aa = append(aa, massert.Length(z.m, 5))
@@ -143,36 +143,114 @@ func TestZSet(t *T) {
 	t.Run("expire", func(t *T) {
 		var aa []massert.Assertion
 		z := newZSet()
-		z.add(addrString(a), fa)
+		z.add(addrString(a), nil, fa, MingleCapacity{})
 		time.Sleep(1 * time.Millisecond)
-		z.add(addrString(b), fb)
+		z.add(addrString(b), nil, fb, MingleCapacity{})
 		time.Sleep(1 * time.Millisecond)
-		z.add(addrString(c), fc)
+		z.add(addrString(c), nil, fc, MingleCapacity{})
 		time.Sleep(1 * time.Millisecond)
-		z.add(addrString(d), fd)
+		z.add(addrString(d), nil, fd, MingleCapacity{})
 		time.Sleep(1 * time.Millisecond)
-		z.add(addrString(e), fe)
+		z.add(addrString(e), nil, fe, MingleCapacity{})
 		time.Sleep(1 * time.Millisecond)
-		z.get(1, time.Time{}) // mix up the order of usageL a bit
+		z.get(1, time.Time{}, nil) // mix up the order of usageL a bit
 
 		// get the time b was added, remove a and b
 		expire := z.timeL.Front().Next().Value.(zsetEl).t
-		z.expire(expire)
+		z.expire(expire, nil)
 		aa = append(aa, assertEls(z.timeL, zc, zd, ze))
 		aa = append(aa, assertEls(z.usageL, ze, zc, zd))
 		aa = append(aa, massert.Length(z.m, 3))
 
-		z.get(1, time.Time{}) // mixing up the order again
+		z.get(1, time.Time{}, nil) // mixing up the order again
 		aa = append(aa, assertEls(z.timeL, zc, zd, ze))
 		aa = append(aa, assertEls(z.usageL, zd, ze, zc))
 		aa = append(aa, massert.Length(z.m, 3))
 
 		// expire everything
-		z.expire(time.Now())
+		z.expire(time.Now(), nil)
 		aa = append(aa, assertEls(z.timeL))
 		aa = append(aa, assertEls(z.usageL))
 		aa = append(aa, massert.Length(z.m, 0))
 
 		massert.Require(t, aa...)
 	})
+
+	t.Run("budget", func(t *T) {
+		z := newZSet()
+		z.add(addrString(a), nil, fa, MingleCapacity{Meets: 1, Interval: time.Hour})
+		z.add(addrString(b), nil, fb, MingleCapacity{})
+
+		massert.Require(t,
+			massert.Equal([]string{b, a}, elsToAddrs(z.get(2, time.Time{}, nil))),
+			massert.Equal([]string{b}, elsToAddrs(z.get(2, time.Time{}, nil))),
+		)
+
+		// re-adding shouldn't reset the budget
+		z.add(addrString(a), nil, fa, MingleCapacity{Meets: 1, Interval: time.Hour})
+		massert.Require(t,
+			massert.Equal([]string{b}, elsToAddrs(z.get(2, time.Time{}, nil))),
+		)
+
+		// excluded addrs shouldn't use up their budget
+		z.add(addrString(c), nil, fc, MingleCapacity{Meets: 1, Interval: time.Hour})
+		massert.Require(t,
+			massert.Equal([]string{b}, elsToAddrs(z.get(2, time.Time{}, addrString(c)))),
+			massert.Equal([]string{c, b}, elsToAddrs(z.get(2, time.Time{}, nil))),
+		)
+	})
+
+	t.Run("getByFingerprint", func(t *T) {
+		z := newZSet()
+		z.add(addrString(a), nil, fa, MingleCapacity{Meets: 1, Interval: time.Hour})
+		z.add(addrString(b), nil, fb, MingleCapacity{})
+
+		zEl, ok := z.getByFingerprint(fa, time.Time{})
+		massert.Require(t,
+			massert.Equal(true, ok),
+			massert.Equal(a, zEl.addr.String()),
+			massert.Equal(true, z.usageL.Front().Value.(zsetEl).addr.String() == a),
+		)
+
+		// a's budget is used up
+		_, ok = z.getByFingerprint(fa, time.Time{})
+		massert.Require(t, massert.Equal(false, ok))
+
+		// a fingerprint moves with its addr's latest ReadyToMingle, and is
+		// taken over by the latest addr to use it.
+		z.add(addrString(b), nil, fc, MingleCapacity{})
+		_, okB := z.getByFingerprint(fb, time.Time{})
+		zEl, okC := z.getByFingerprint(fc, time.Time{})
+		massert.Require(t,
+			massert.Equal(false, okB),
+			massert.Equal(true, okC),
+			massert.Equal(b, zEl.addr.String()),
+		)
+		z.add(addrString(c), nil, fc, MingleCapacity{})
+		zEl, _ = z.getByFingerprint(fc, time.Time{})
+		massert.Require(t, massert.Equal(c, zEl.addr.String()))
+
+		// expired and removed peers can't be found
+		_, ok = z.getByFingerprint(fc, time.Now())
+		massert.Require(t, massert.Equal(false, ok))
+		z.expire(time.Now(), nil)
+		_, ok = z.getByFingerprint(fc, time.Time{})
+		massert.Require(t,
+			massert.Equal(false, ok),
+			massert.Length(z.fps, 0),
+		)
+	})
+
+	t.Run("serverBudget", func(t *T) {
+		z := newZSet()
+		z.capacity = MingleCapacity{Meets: 2, Interval: time.Hour}
+		z.add(addrString(a), nil, fa, MingleCapacity{})
+		z.add(addrString(b), nil, fb, MingleCapacity{Meets: 1, Interval: time.Hour})
+
+		massert.Require(t,
+			massert.Equal([]string{b, a}, elsToAddrs(z.get(2, time.Time{}, nil))),
+			massert.Equal([]string{a}, elsToAddrs(z.get(2, time.Time{}, nil))),
+			massert.Length(z.get(2, time.Time{}, nil), 0),
+		)
+	})
 }